@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// Rows of each table printed per interval in text output, JSON gets all
+const aggregateRows = 20
+
+// aggregates is one --interval of the --aggregate counters, busiest first
+type aggregates struct {
+	Drops       []dropCount
+	Retransmits []retransmitCount
+	Overflow    uint64 // Counts that didn't fit in the kernel's tables
+}
+
+type dropCount struct {
+	Reason   uint32
+	Location uint64
+	Count    uint64
+}
+
+type retransmitCount struct {
+	Pid          uint32
+	Comm         string
+	Family       uint32
+	Saddr, Daddr [16]byte
+	Sport, Dport uint16
+	Netns        uint32
+	NetnsName    string // Filled in after the drain, see netnsResolver
+	Count        uint64
+}
+
+// drainAggregates reads and clears the --aggregate tables. Like
+// drainHistograms, counts added between the lookup and the delete of an
+// entry are lost.
+func drainAggregates(objs *monitorObjects) (*aggregates, error) {
+	a := &aggregates{}
+
+	var dropKeys []monitorDropCountKey
+	var dk monitorDropCountKey
+	var n uint64
+	iter := objs.DropCounts.Iterate()
+	for iter.Next(&dk, &n) {
+		a.Drops = append(a.Drops, dropCount{Reason: dk.Reason, Location: dk.Location, Count: n})
+		dropKeys = append(dropKeys, dk)
+	}
+	if err := iter.Err(); err != nil {
+		return a, fmt.Errorf("iterating drop counts: %w", err)
+	}
+	for _, k := range dropKeys {
+		if err := objs.DropCounts.Delete(k); err != nil {
+			return a, fmt.Errorf("clearing drop counts: %w", err)
+		}
+	}
+
+	var retransmitKeys []monitorRetransmitCountKey
+	var rk monitorRetransmitCountKey
+	var rv monitorRetransmitCount
+	iter = objs.RetransmitCounts.Iterate()
+	for iter.Next(&rk, &rv) {
+		var comm [16]byte
+		for i, c := range rv.Comm {
+			comm[i] = byte(c)
+		}
+		a.Retransmits = append(a.Retransmits, retransmitCount{
+			Pid: rk.Pid, Comm: commString(comm[:]), Family: rk.Family,
+			Saddr: rk.Saddr, Daddr: rk.Daddr, Sport: rk.Sport, Dport: rk.Dport,
+			Netns: rk.Netns, Count: rv.Count,
+		})
+		retransmitKeys = append(retransmitKeys, rk)
+	}
+	if err := iter.Err(); err != nil {
+		return a, fmt.Errorf("iterating retransmit counts: %w", err)
+	}
+	for _, k := range retransmitKeys {
+		if err := objs.RetransmitCounts.Delete(k); err != nil {
+			return a, fmt.Errorf("clearing retransmit counts: %w", err)
+		}
+	}
+
+	a.Overflow = sumCounters(objs.AggregateOverflow)
+	if a.Overflow > 0 {
+		cpus, err := ebpf.PossibleCPU()
+		if err != nil {
+			return a, err
+		}
+		if err := objs.AggregateOverflow.Put(uint32(0), make([]uint64, cpus)); err != nil {
+			return a, fmt.Errorf("clearing overflow count: %w", err)
+		}
+	}
+
+	sort.Slice(a.Drops, func(i, j int) bool { return a.Drops[i].Count > a.Drops[j].Count })
+	sort.Slice(a.Retransmits, func(i, j int) bool { return a.Retransmits[i].Count > a.Retransmits[j].Count })
+	return a, nil
+}
+
+// aggregateObserver is implemented by observers that want the --aggregate
+// counts each interval, since no events arrive for them
+// Called from the processor goroutine, like Observe
+type aggregateObserver interface {
+	ObserveAggregates(a *aggregates, p *EventProcessor)
+}
+
+// --aggregate rows with --format=json, one object per row per interval
+type jsonDropCount struct {
+	Timestamp string `json:"timestamp"`
+	Type      string `json:"type"` // Always "drop_count"
+	Reason    string `json:"reason"`
+	Function  string `json:"function,omitempty"`
+	Layer     string `json:"layer"`
+	Count     uint64 `json:"count"`
+
+	Labels map[string]string `json:"labels,omitempty"` // --label
+}
+
+type jsonRetransmitCount struct {
+	Timestamp string `json:"timestamp"`
+	Type      string `json:"type"` // Always "retransmit_count"
+	Pid       uint32 `json:"pid"`
+	Comm      string `json:"comm"`
+	Family    string `json:"family"`
+	Saddr     string `json:"saddr"`
+	Sport     uint16 `json:"sport"`
+	Daddr     string `json:"daddr"`
+	Dport     uint16 `json:"dport"`
+	Netns     uint32 `json:"netns,omitempty"`
+	NetnsName string `json:"netns_name,omitempty"`
+	Count     uint64 `json:"count"`
+
+	Labels map[string]string `json:"labels,omitempty"` // --label
+}
+
+// PrintAggregates writes one interval's counts
+func (p *EventProcessor) PrintAggregates(a *aggregates) {
+	drops, retransmits := a.Drops, a.Retransmits
+	now := time.Now()
+	defer p.Flush()
+
+	if p.format == formatJSON {
+		ts := now.Format(time.RFC3339Nano)
+		for _, d := range drops {
+			reason, function := p.reasonName(d.Reason), findNearestSymbol(d.Location)
+			b, _ := json.Marshal(&jsonDropCount{
+				Timestamp: ts, Type: "drop_count",
+				Reason: reason, Function: function, Layer: dropLayer(function, reason),
+				Count: d.Count, Labels: p.labels,
+			})
+			p.buffered.Write(append(b, '\n'))
+		}
+		for _, r := range retransmits {
+			b, _ := json.Marshal(&jsonRetransmitCount{
+				Timestamp: ts, Type: "retransmit_count",
+				Pid: r.Pid, Comm: r.Comm, Family: familyNames[r.Family],
+				Saddr: formatAddr(r.Saddr), Sport: r.Sport,
+				Daddr: formatAddr(r.Daddr), Dport: r.Dport,
+				Netns: r.Netns, NetnsName: r.NetnsName,
+				Count: r.Count, Labels: p.labels,
+			})
+			p.buffered.Write(append(b, '\n'))
+		}
+		return
+	}
+
+	if len(drops) == 0 && len(retransmits) == 0 && a.Overflow == 0 {
+		return // Quiet interval
+	}
+	if len(drops) > aggregateRows {
+		drops = drops[:aggregateRows]
+	}
+	if len(retransmits) > aggregateRows {
+		retransmits = retransmits[:aggregateRows]
+	}
+	fmt.Fprintf(p.buffered, "\n%s\n", now.Format("15:04:05"))
+	if len(drops) > 0 {
+		fmt.Fprintf(p.buffered, "%10s  %-24s %-10s %s\n", "DROPS", "REASON", "LAYER", "FUNCTION")
+		for _, d := range drops {
+			reason, function := p.reasonName(d.Reason), findNearestSymbol(d.Location)
+			fmt.Fprintf(p.buffered, "%10d  %-24s %-10s %s\n", d.Count, reason, dropLayer(function, reason), function)
+		}
+	}
+	if len(retransmits) > 0 {
+		fmt.Fprintf(p.buffered, "%10s  %-7s %-16s %-47s %-47s %s\n", "RETRANS", "PID", "COMM", "LADDR", "RADDR", "NETNS")
+		for _, r := range retransmits {
+			fmt.Fprintf(p.buffered, "%10d  %-7d %-16s %-47s %-47s %s\n", r.Count, r.Pid, r.Comm,
+				formatEndpoint(r.Saddr, r.Sport), formatEndpoint(r.Daddr, r.Dport), netnsLabel(r.Netns, r.NetnsName))
+		}
+	}
+	if a.Overflow > 0 {
+		fmt.Fprintf(p.buffered, "%10d  not counted, the kernel tables were full\n", a.Overflow)
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// The alerts section of --config:
+//
+//	alerts:
+//	  rules:
+//	    - name: postgres-retransmits
+//	      event: retransmit
+//	      ports: [5432]
+//	      above: 5      # Events per second, averaged over window
+//	      window: 60s
+//	      for: 60s      # How long the rate has to stay above before firing
+//	      notify: [oncall]
+//	    - name: postgres-retransmit-ratio
+//	      event: retransmit
+//	      ports: [5432]
+//	      per: segments # above is a percentage of the segments sent instead
+//	      above: 5
+//	      notify: [oncall]
+//	    - name: unusual-drops
+//	      event: drop
+//	      anomaly: true # Only drops --anomaly flagged, no threshold to pick
+//	      notify: [oncall]
+//	  notifiers:
+//	    - name: oncall
+//	      type: pagerduty
+//	      routing_key: R0123456789
+type configAlerts struct {
+	Rules     []configAlertRule `yaml:"rules"`
+	Notifiers []configNotifier  `yaml:"notifiers"`
+}
+
+type configAlertRule struct {
+	Name          string   `yaml:"name"`
+	Event         string   `yaml:"event"`   // drop, retransmit, state, close or connect
+	Reasons       []string `yaml:"reasons"` // Events with a reason, e.g. NO_SOCKET
+	Layers        []string `yaml:"layers"`  // Drops only, e.g. netfilter, see droplayers.go
+	configFilters `yaml:",inline"`
+	Anomaly       bool     `yaml:"anomaly"` // Only drops and retransmits --anomaly flagged, which turns it on
+	Above         float64  `yaml:"above"`
+	Per           string   `yaml:"per"`      // segments: retransmits per 100 segments the matching connections sent
+	Window        string   `yaml:"window"`   // Defaults to 60s
+	For           string   `yaml:"for"`      // Defaults to 0, fire right away
+	Severity      string   `yaml:"severity"` // For PagerDuty: critical, error, warning (default) or info
+	Notify        []string `yaml:"notify"`
+}
+
+type configNotifier struct {
+	Name       string            `yaml:"name"`
+	Type       string            `yaml:"type"`        // webhook, slack or pagerduty
+	URL        string            `yaml:"url"`         // webhook and slack
+	RoutingKey string            `yaml:"routing_key"` // pagerduty
+	Headers    map[string]string `yaml:"headers"`     // webhook, e.g. Authorization
+}
+
+// Rates are counted in one second slots
+const alertSlot = time.Second
+
+type alertRule struct {
+	name       string
+	eventType  uint32
+	reasons    []string
+	layers     []string
+	filter     *Filters
+	anomaly    bool
+	above      float64
+	perSegment bool // per: segments
+	window     time.Duration
+	hold       time.Duration // for:
+	severity   string
+	notifiers  []notifier
+
+	// Owned by Alerter.mu
+	slots        []uint64 // Ring of per second counts over window
+	segs         []uint64 // per: segments, the segments sent in each of them
+	cur          int
+	pendingSince time.Time // When the rate went above, zero while it's below
+	firing       bool
+}
+
+// alertNotification is what every notifier is handed, and the webhook body
+type alertNotification struct {
+	Rule      string    `json:"rule"`
+	Status    string    `json:"status"` // firing or resolved
+	Event     string    `json:"event"`
+	Rate      float64   `json:"rate"` // Events per second over the window, or with per the percentage
+	Threshold float64   `json:"threshold"`
+	Per       string    `json:"per,omitempty"` // segments
+	Window    string    `json:"window"`
+	Host      string    `json:"host"`
+	Since     time.Time `json:"since"` // When the rate first went above
+	Time      time.Time `json:"time"`
+	Summary   string    `json:"summary"`
+	severity  string
+}
+
+type notifier interface {
+	notify(n *alertNotification) error
+}
+
+// Alerter evaluates the alert rules. It's an observer counting matching
+// events on the processor goroutine; once a second the rates are checked and
+// notifications are queued for a sender goroutine, so a slow webhook never
+// holds up events. Rules with per: segments also need what their
+// connections sent, which the same goroutine reads from conns first.
+type Alerter struct {
+	mu    sync.Mutex
+	rules []*alertRule
+
+	conns  *ebpf.Map         // For per: segments, nil leaves them at 0
+	sent   map[uint64]uint32 // evaluate only: each connection's segs_out at the last walk
+	walked uint64            // And when that was, bpf_ktime_get_ns() time
+
+	host  string
+	queue chan *alertNotification
+	quit  chan struct{}
+	done  sync.WaitGroup
+}
+
+var eventTypesByName = map[string]uint32{
+	"drop":        eventDrop,
+	"retransmit":  eventRetransmit,
+	"dsack":       eventDSACK,
+	"state":       eventState,
+	"close":       eventClose,
+	"connect":     eventConnect,
+	"reset":       eventReset,
+	"zero_window": eventZeroWindow,
+	"udp_error":   eventUDPError,
+	"icmp_error":  eventICMPError,
+	"keepalive":   eventKeepalive,
+	"fastopen":    eventFastOpen,
+	"buffer":      eventBuffer,
+	"tls":         eventTLS,
+	"syn_flood":   eventSynFlood,
+	"blocked":     eventBlocked,
+	"sockopt":     eventSockopt,
+	"listen":      eventListen,
+}
+
+// Events eventReason names a reason for, the ones rules can match reasons of
+var eventsWithReasons = map[uint32]bool{
+	eventDrop: true, eventReset: true, eventUDPError: true, eventICMPError: true, eventKeepalive: true, eventFastOpen: true, eventBuffer: true, eventSockopt: true, eventListen: true,
+}
+
+func NewAlerter(c configAlerts, conns *ebpf.Map) (*Alerter, error) {
+	notifiers := make(map[string]notifier)
+	for _, n := range c.Notifiers {
+		if n.Name == "" {
+			return nil, fmt.Errorf("notifier without a name")
+		}
+		var nt notifier
+		switch n.Type {
+		case "webhook":
+			nt = &webhookNotifier{url: n.URL, headers: n.Headers}
+		case "slack":
+			nt = &slackNotifier{url: n.URL}
+		case "pagerduty":
+			if n.RoutingKey == "" {
+				return nil, fmt.Errorf("notifier %s: pagerduty needs a routing_key", n.Name)
+			}
+			nt = &pagerDutyNotifier{url: n.URL, routingKey: n.RoutingKey}
+		default:
+			return nil, fmt.Errorf("notifier %s: unknown type %q, use: webhook, slack or pagerduty", n.Name, n.Type)
+		}
+		if n.Type != "pagerduty" && n.URL == "" {
+			return nil, fmt.Errorf("notifier %s: %s needs a url", n.Name, n.Type)
+		}
+		notifiers[n.Name] = nt
+	}
+
+	a := &Alerter{conns: conns, queue: make(chan *alertNotification, 64), quit: make(chan struct{})}
+	a.host, _ = os.Hostname()
+	names := make(map[string]bool, len(c.Rules))
+	for _, rc := range c.Rules {
+		r, err := newAlertRule(rc, notifiers)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %s: %w", rc.Name, err)
+		}
+		// Notifications find their rule by name, see send
+		if names[r.name] {
+			return nil, fmt.Errorf("alert rule %s: another rule has the same name", r.name)
+		}
+		names[r.name] = true
+		a.rules = append(a.rules, r)
+	}
+
+	a.done.Add(2)
+	go a.evaluate()
+	go a.send()
+	return a, nil
+}
+
+func newAlertRule(c configAlertRule, notifiers map[string]notifier) (*alertRule, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("needs a name")
+	}
+	eventType, ok := eventTypesByName[c.Event]
+	if !ok {
+		return nil, fmt.Errorf("unknown event %q, use: drop, retransmit, state, close or connect", c.Event)
+	}
+	if len(c.Reasons) > 0 && !eventsWithReasons[eventType] {
+		return nil, fmt.Errorf("reasons only apply to drop, reset, udp_error, icmp_error, keepalive, fastopen, buffer, sockopt and listen")
+	}
+	if len(c.Layers) > 0 && eventType != eventDrop {
+		return nil, fmt.Errorf("layers only apply to drop")
+	}
+	if c.Cgroup != "" {
+		return nil, fmt.Errorf("cgroup isn't supported in rules, use the top level --cgroup")
+	}
+	filter, err := c.configFilters.parse()
+	if err != nil {
+		return nil, err
+	}
+	if c.Above < 0 {
+		return nil, fmt.Errorf("above must not be negative")
+	}
+	if c.Anomaly && eventType != eventDrop && eventType != eventRetransmit {
+		return nil, fmt.Errorf("anomaly only applies to drop and retransmit")
+	}
+	if c.Per != "" && c.Per != "segments" {
+		return nil, fmt.Errorf("unknown per %q, use: segments", c.Per)
+	}
+	if c.Per != "" && eventType != eventRetransmit {
+		return nil, fmt.Errorf("per only applies to retransmit")
+	}
+
+	r := &alertRule{
+		name:       c.Name,
+		eventType:  eventType,
+		reasons:    c.Reasons,
+		layers:     c.Layers,
+		filter:     filter,
+		anomaly:    c.Anomaly,
+		above:      c.Above,
+		perSegment: c.Per == "segments",
+		window:     time.Minute,
+		severity:   "warning",
+	}
+	if c.Window != "" {
+		if r.window, err = time.ParseDuration(c.Window); err != nil {
+			return nil, fmt.Errorf("window: %w", err)
+		}
+		if r.window < alertSlot {
+			return nil, fmt.Errorf("window must be at least %s", alertSlot)
+		}
+	}
+	if c.For != "" {
+		if r.hold, err = time.ParseDuration(c.For); err != nil {
+			return nil, fmt.Errorf("for: %w", err)
+		}
+	}
+	if c.Severity != "" {
+		if !slices.Contains([]string{"critical", "error", "warning", "info"}, c.Severity) {
+			return nil, fmt.Errorf("unknown severity %q, use: critical, error, warning or info", c.Severity)
+		}
+		r.severity = c.Severity
+	}
+	if len(c.Notify) == 0 {
+		return nil, fmt.Errorf("notify lists no notifiers")
+	}
+	for _, name := range c.Notify {
+		n, ok := notifiers[name]
+		if !ok {
+			return nil, fmt.Errorf("no notifier named %q", name)
+		}
+		r.notifiers = append(r.notifiers, n)
+	}
+	r.slots = make([]uint64, (r.window+alertSlot-1)/alertSlot)
+	if r.perSegment {
+		r.segs = make([]uint64, len(r.slots))
+	}
+	return r, nil
+}
+
+func (a *Alerter) Observe(event *TcpEvent, p *EventProcessor) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range a.rules {
+		if r.eventType != event.Type || !r.filter.match(event) || (r.anomaly && !event.Anomaly) {
+			continue
+		}
+		if len(r.reasons) > 0 && !slices.Contains(r.reasons, p.eventReason(event)) {
+			continue
+		}
+		if len(r.layers) > 0 && !slices.Contains(r.layers, p.dropLayer(event)) {
+			continue
+		}
+		r.slots[r.cur] += event.occurrences()
+	}
+}
+
+func (a *Alerter) evaluate() {
+	defer a.done.Done()
+	ticker := time.NewTicker(alertSlot)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			sent := a.segmentsSent()
+			a.mu.Lock()
+			for i, r := range a.rules {
+				if r.perSegment && sent != nil {
+					r.segs[r.cur] += sent[i]
+				}
+				if n := r.tick(now); n != nil {
+					n.Host = a.host
+					select {
+					case a.queue <- n:
+					default:
+						slog.Warn("alert notification queue full, dropping it", "rule", n.Rule, "status", n.Status)
+					}
+				}
+			}
+			a.mu.Unlock()
+		case <-a.quit:
+			close(a.queue)
+			return
+		}
+	}
+}
+
+// segmentsSent walks conns for the per: segments rules and returns the
+// segments each rule's connections sent since the last walk, by the rule's
+// index, nil without such rules. segs_out is what the connection had at its
+// last RTT sample, so this lags by up to RTT_SAMPLE_NS. A connection seen
+// for the first time counts from its start if that was after the last walk,
+// from now on if it was there already, tracked since or sampled late.
+func (a *Alerter) segmentsSent() []uint64 {
+	if a.conns == nil || !slices.ContainsFunc(a.rules, func(r *alertRule) bool { return r.perSegment }) {
+		return nil
+	}
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return nil
+	}
+	now := uint64(ts.Nano()) // start_ns is bpf_ktime_get_ns()
+
+	sent := make([]uint64, len(a.rules))
+	seen := make(map[uint64]uint32, len(a.sent))
+	var key uint64
+	var info monitorConnInfo
+	iter := a.conns.Iterate()
+	for iter.Next(&key, &info) {
+		if info.SegsOut == 0 {
+			continue // Not sampled yet
+		}
+		seen[key] = info.SegsOut
+		last, ok := a.sent[key]
+		var n uint32
+		switch {
+		case ok && info.SegsOut >= last:
+			n = info.SegsOut - last
+		case ok || a.walked != 0 && info.StartNs >= a.walked:
+			n = info.SegsOut // A new connection, or one at a closed one's sock address
+		}
+		if n == 0 {
+			continue
+		}
+		event := TcpEvent{Pid: info.Pid, Saddr: info.Saddr, Daddr: info.Daddr, Sport: info.Sport, Dport: info.Dport}
+		for i, c := range info.Comm {
+			event.Comm[i] = byte(c)
+		}
+		for i, r := range a.rules {
+			if r.perSegment && r.filter.match(&event) {
+				sent[i] += uint64(n)
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.Warn("iterating connection table for alert rules", "err", err)
+	}
+	a.sent, a.walked = seen, now
+	return sent
+}
+
+// tick closes the current slot and returns a notification if the rule
+// started or stopped firing
+func (r *alertRule) tick(now time.Time) *alertNotification {
+	var sum uint64
+	for _, c := range r.slots {
+		sum += c
+	}
+	rate := float64(sum) / r.window.Seconds()
+	if r.perSegment {
+		var segs uint64
+		for _, s := range r.segs {
+			segs += s
+		}
+		rate = 0 // Nothing sent, or nothing sampled: no ratio to speak of
+		if segs > 0 {
+			rate = 100 * float64(sum) / float64(segs)
+		}
+	}
+	r.cur = (r.cur + 1) % len(r.slots)
+	r.slots[r.cur] = 0
+	if r.perSegment {
+		r.segs[r.cur] = 0
+	}
+
+	if rate <= r.above {
+		since := r.pendingSince
+		r.pendingSince = time.Time{}
+		if !r.firing {
+			return nil
+		}
+		r.firing = false
+		return r.notification("resolved", rate, since, now)
+	}
+	if r.pendingSince.IsZero() {
+		r.pendingSince = now
+	}
+	if r.firing || now.Sub(r.pendingSince) < r.hold {
+		return nil
+	}
+	r.firing = true
+	return r.notification("firing", rate, r.pendingSince, now)
+}
+
+func (r *alertRule) notification(status string, rate float64, since, now time.Time) *alertNotification {
+	event := eventTypeNames[r.eventType]
+	summary := fmt.Sprintf("%s: %.2f %ss/s over %s (threshold %g)", r.name, rate, event, r.window, r.above)
+	if status == "resolved" {
+		summary = fmt.Sprintf("%s resolved: %.2f %ss/s over %s", r.name, rate, event, r.window)
+	}
+	per := ""
+	if r.perSegment {
+		per = "segments"
+		summary = fmt.Sprintf("%s: %.2f%% of segments sent were %ss over %s (threshold %g%%)", r.name, rate, event, r.window, r.above)
+		if status == "resolved" {
+			summary = fmt.Sprintf("%s resolved: %.2f%% of segments sent were %ss over %s", r.name, rate, event, r.window)
+		}
+	}
+	return &alertNotification{
+		Rule:      r.name,
+		Status:    status,
+		Event:     event,
+		Rate:      rate,
+		Threshold: r.above,
+		Per:       per,
+		Window:    r.window.String(),
+		Since:     since,
+		Time:      now,
+		Summary:   summary,
+		severity:  r.severity,
+	}
+}
+
+// send delivers the queued notifications one at a time, in order
+func (a *Alerter) send() {
+	defer a.done.Done()
+	rules := make(map[string]*alertRule, len(a.rules))
+	for _, r := range a.rules {
+		rules[r.name] = r
+	}
+	for n := range a.queue {
+		slog.Info("alert", "rule", n.Rule, "status", n.Status, "summary", n.Summary)
+		for _, nt := range rules[n.Rule].notifiers {
+			if err := nt.notify(n); err != nil {
+				slog.Warn("sending alert notification", "rule", n.Rule, "err", err)
+			}
+		}
+	}
+}
+
+// Close stops evaluating and waits a few seconds for the notifications
+// already queued. Alerts still firing stay open; the monitor stopping
+// doesn't mean the problem went away.
+func (a *Alerter) Close() {
+	close(a.quit)
+	done := make(chan struct{})
+	go func() {
+		a.done.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		slog.Warn("gave up on sending the remaining alert notifications")
+	}
+}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(url string, body any, headers map[string]string) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookNotifier POSTs the alertNotification as is
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+func (w *webhookNotifier) notify(n *alertNotification) error {
+	return postJSON(w.url, n, w.headers)
+}
+
+// slackNotifier posts to a Slack incoming webhook
+type slackNotifier struct{ url string }
+
+func (s *slackNotifier) notify(n *alertNotification) error {
+	icon := ":rotating_light:"
+	if n.Status == "resolved" {
+		icon = ":white_check_mark:"
+	}
+	return postJSON(s.url, map[string]string{"text": fmt.Sprintf("%s [%s] %s", icon, n.Host, n.Summary)}, nil)
+}
+
+// pagerDutyNotifier sends Events API v2 triggers and resolves, deduplicated
+// per host and rule so a resolve closes the incident its trigger opened
+type pagerDutyNotifier struct {
+	url        string // Defaults to the public endpoint
+	routingKey string
+}
+
+func (p *pagerDutyNotifier) notify(n *alertNotification) error {
+	url := p.url
+	if url == "" {
+		url = "https://events.pagerduty.com/v2/enqueue"
+	}
+	action := "trigger"
+	if n.Status == "resolved" {
+		action = "resolve"
+	}
+	body := map[string]any{
+		"routing_key":  p.routingKey,
+		"event_action": action,
+		"dedup_key":    "tcpmon/" + n.Host + "/" + n.Rule,
+	}
+	if action == "trigger" {
+		body["payload"] = map[string]any{
+			"summary":        n.Summary,
+			"source":         n.Host,
+			"severity":       n.severity,
+			"component":      "tcpmon",
+			"custom_details": n,
+		}
+	}
+	return postJSON(url, body, nil)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertRuleDuplicateName(t *testing.T) {
+	rule := configAlertRule{Name: "retransmits", Event: "retransmit", Above: 5, Notify: []string{"hook"}}
+	c := configAlerts{
+		Rules:     []configAlertRule{rule, rule},
+		Notifiers: []configNotifier{{Name: "hook", Type: "webhook", URL: "http://127.0.0.1:1/"}},
+	}
+	if _, err := NewAlerter(c, nil); err == nil || !strings.Contains(err.Error(), "same name") {
+		t.Errorf("got %v, want an error for the second rule", err)
+	}
+}
+
+// per: segments compares the window's retransmits to the segments sent in it
+func TestAlertRulePerSegment(t *testing.T) {
+	notifiers := map[string]notifier{"hook": &webhookNotifier{}}
+	r, err := newAlertRule(configAlertRule{Name: "ratio", Event: "retransmit", Per: "segments", Above: 5, Window: "2s", Notify: []string{"hook"}}, notifiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	r.slots[r.cur], r.segs[r.cur] = 4, 100
+	if n := r.tick(now); n != nil {
+		t.Errorf("4%% fired: %+v", n)
+	}
+	r.slots[r.cur], r.segs[r.cur] = 8, 100
+	n := r.tick(now.Add(time.Second))
+	if n == nil || n.Status != "firing" || n.Rate != 6 || n.Per != "segments" {
+		t.Fatalf("6%% over the window: got %+v, want firing at 6", n)
+	}
+	// The first second is out of the window, 0 of 100 next to the 8 of 100 is 4%
+	r.segs[r.cur] = 100
+	if n := r.tick(now.Add(2 * time.Second)); n == nil || n.Status != "resolved" || n.Rate != 4 {
+		t.Errorf("4%% again: got %+v, want resolved at 4", n)
+	}
+
+	if _, err := newAlertRule(configAlertRule{Name: "drops", Event: "drop", Per: "segments", Notify: []string{"hook"}}, notifiers); err == nil {
+		t.Error("no error for per on drops")
+	}
+}
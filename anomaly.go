@@ -0,0 +1,253 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --anomaly learns what the drop and retransmit rates normally are, and
+// marks events while one is unusually high, so an alert can be "more than
+// usual" rather than a number someone has to pick for every host. Every
+// anomalyInterval, the rate of each series (the host's, and those of the
+// --anomaly-top busiest destinations) is scored against an exponentially
+// weighted mean and standard deviation of its earlier rates, then folded
+// into them. More than --anomaly-threshold deviations above the mean makes
+// the series anomalous until an interval that isn't, and its drops or
+// retransmits get anomaly=true.
+//
+// Only new destinations need a warm-up of their own: a busy one that shows
+// up out of nowhere is still caught by the host's rate.
+
+const (
+	anomalyInterval  = 10 * time.Second
+	anomalyAlpha     = 0.05 // Weight of the newest interval, about the last 7 minutes are in the baseline
+	anomalyWarmup    = 30   // Intervals a baseline learns for before it flags anything, 5 minutes
+	anomalyMinEvents = 10   // In an interval, fewer are never a spike however quiet it was
+)
+
+// anomalyKey is a series: an event type, for the host or one destination
+type anomalyKey struct {
+	eventType uint32
+	daddr     [16]byte // Zero for the host
+	dport     uint16
+}
+
+func (k anomalyKey) host() bool { return k.daddr == [16]byte{} && k.dport == 0 }
+
+func (k anomalyKey) String() string {
+	if k.host() {
+		return "host"
+	}
+	return net.JoinHostPort(formatAddr(k.daddr), strconv.Itoa(int(k.dport)))
+}
+
+type anomalyBaseline struct {
+	mean, variance float64 // Of the rates so far
+	samples        int
+
+	// The last interval's, for the API and the log
+	rate, expected, stddev, score float64
+	anomalous                     bool
+}
+
+// deviation is what rates are scored with. Counts are noisy however steady
+// the rate, so it's never tighter than a Poisson process at the mean.
+func (b *anomalyBaseline) deviation() float64 {
+	secs := anomalyInterval.Seconds()
+	return max(math.Sqrt(b.variance), math.Sqrt(max(b.mean, 1/secs)/secs))
+}
+
+// unusual is whether count events in an interval are a spike. Part of an
+// interval counts too: once it's over, the rest can only add to it.
+func (b *anomalyBaseline) unusual(count uint64, threshold float64) bool {
+	rate := float64(count) / anomalyInterval.Seconds()
+	return b.samples >= anomalyWarmup && count >= anomalyMinEvents && (rate-b.mean)/b.deviation() > threshold
+}
+
+// observe scores one interval's rate against the baseline, then folds it in
+func (b *anomalyBaseline) observe(count uint64, threshold float64) {
+	rate := float64(count) / anomalyInterval.Seconds()
+	if b.samples == 0 {
+		b.mean = rate
+	}
+	b.rate, b.expected, b.stddev = rate, b.mean, b.deviation()
+	b.score = (rate - b.mean) / b.stddev
+	b.anomalous = b.unusual(count, threshold)
+
+	diff := rate - b.mean
+	b.mean += anomalyAlpha * diff
+	b.variance = (1 - anomalyAlpha) * (b.variance + anomalyAlpha*diff*diff)
+	b.samples++
+}
+
+// AnomalyDetector is an enricher: it counts drops and retransmits as they
+// go by and marks those of anomalous series, from the event that takes an
+// interval's count past the threshold on
+type AnomalyDetector struct {
+	top       int
+	threshold float64
+
+	mu        sync.Mutex // Enrich runs on the processor goroutine, evaluate and the API on their own
+	counts    map[anomalyKey]uint64
+	baselines map[anomalyKey]*anomalyBaseline
+}
+
+// GET /api/v1/anomalies, every series with a baseline
+type apiAnomaly struct {
+	Event       string  `json:"event"`
+	Destination string  `json:"destination"` // host for the host's rate
+	Rate        float64 `json:"rate"`        // Per second over the last interval
+	Baseline    float64 `json:"baseline"`    // What it was expected to be
+	Stddev      float64 `json:"stddev"`
+	Score       float64 `json:"score"` // Standard deviations above the baseline
+	Anomaly     bool    `json:"anomaly"`
+	Learning    bool    `json:"learning"` // Not flagging anything yet, see anomalyWarmup
+}
+
+func NewAnomalyDetector(top int, threshold float64) *AnomalyDetector {
+	d := &AnomalyDetector{
+		top:       top,
+		threshold: threshold,
+		counts:    make(map[anomalyKey]uint64),
+		baselines: make(map[anomalyKey]*anomalyBaseline),
+	}
+	for _, t := range []uint32{eventDrop, eventRetransmit} {
+		d.baselines[anomalyKey{eventType: t}] = &anomalyBaseline{}
+	}
+	go d.watch()
+	return d
+}
+
+func (d *AnomalyDetector) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/anomalies", d.handleAnomalies)
+}
+
+func (d *AnomalyDetector) Enrich(event *TcpEvent) {
+	if event.Type != eventDrop && event.Type != eventRetransmit {
+		return
+	}
+	host := anomalyKey{eventType: event.Type}
+	n := event.occurrences()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	event.Anomaly = d.count(host, n)
+	if event.Family == 0 {
+		return // Drops without a tuple have no destination
+	}
+	if d.count(anomalyKey{eventType: event.Type, daddr: event.Daddr, dport: event.Dport}, n) {
+		event.Anomaly = true
+	}
+}
+
+// count adds n to k's interval, and says whether k is anomalous. Called
+// with mu held.
+func (d *AnomalyDetector) count(k anomalyKey, n uint64) bool {
+	d.counts[k] += n
+	b := d.baselines[k]
+	return b != nil && (b.anomalous || b.unusual(d.counts[k], d.threshold))
+}
+
+func (d *AnomalyDetector) watch() {
+	ticker := time.NewTicker(anomalyInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.evaluate()
+	}
+}
+
+// evaluate closes an interval: the destinations tracked are brought back
+// to the busiest, then every series is scored
+func (d *AnomalyDetector) evaluate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.keepTop()
+	for k, b := range d.baselines {
+		was := b.anomalous
+		b.observe(d.counts[k], d.threshold)
+		event := eventTypeNames[k.eventType]
+		switch {
+		case b.anomalous && !was:
+			slog.Warn("rate above its baseline", "event", event, "destination", k.String(),
+				"rate", round2(b.rate), "baseline", round2(b.expected), "stddev", round2(b.stddev), "score", round2(b.score))
+		case was && !b.anomalous:
+			slog.Info("rate back to its baseline", "event", event, "destination", k.String(), "rate", round2(b.rate))
+		}
+	}
+	clear(d.counts)
+}
+
+// keepTop keeps baselines for the top busiest destinations of each event
+// type, by their mean or this interval's count, whichever is more. Called
+// with mu held.
+func (d *AnomalyDetector) keepTop() {
+	type candidate struct {
+		key    anomalyKey
+		weight float64
+	}
+	byType := make(map[uint32][]candidate)
+	seen := make(map[anomalyKey]bool)
+	for k, b := range d.baselines {
+		if !k.host() {
+			byType[k.eventType] = append(byType[k.eventType], candidate{k, max(b.mean, float64(d.counts[k])/anomalyInterval.Seconds())})
+			seen[k] = true
+		}
+	}
+	for k, n := range d.counts {
+		if !k.host() && !seen[k] {
+			byType[k.eventType] = append(byType[k.eventType], candidate{k, float64(n) / anomalyInterval.Seconds()})
+		}
+	}
+	for _, cs := range byType {
+		sort.Slice(cs, func(i, j int) bool { return cs[i].weight > cs[j].weight })
+		for i, c := range cs {
+			switch {
+			case i >= d.top:
+				delete(d.baselines, c.key)
+			case d.baselines[c.key] == nil:
+				d.baselines[c.key] = &anomalyBaseline{}
+			}
+		}
+	}
+}
+
+func (d *AnomalyDetector) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	series := make([]apiAnomaly, 0, len(d.baselines))
+	for k, b := range d.baselines {
+		series = append(series, apiAnomaly{
+			Event:       eventTypeNames[k.eventType],
+			Destination: k.String(),
+			Rate:        b.rate,
+			Baseline:    b.expected,
+			Stddev:      b.stddev,
+			Score:       b.score,
+			Anomaly:     b.anomalous,
+			Learning:    b.samples < anomalyWarmup,
+		})
+	}
+	d.mu.Unlock()
+
+	// By event, the host's first, then the most unusual
+	sort.SliceStable(series, func(i, j int) bool {
+		a, b := series[i], series[j]
+		if a.Event != b.Event {
+			return a.Event < b.Event
+		}
+		if (a.Destination == "host") != (b.Destination == "host") {
+			return a.Destination == "host"
+		}
+		return a.Score > b.Score
+	})
+	writeJSON(w, series)
+}
+
+// round2 keeps log records readable
+func round2(f float64) float64 { return math.Round(f*100) / 100 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// APIServer answers the /api/v1 endpoints with JSON snapshots, next to
+// /metrics on --listen-addr. Connections are read from the kernel's conns
+// map on every request like the Prometheus gauges; drop and retransmit
+// totals since startup are kept here as an observer.
+type APIServer struct {
+	conns      *ebpf.Map
+	metrics    *Metrics
+	lost       func() uint64
+	queue      *eventQueue
+	pods       *K8sEnricher       // nil without --k8s
+	containers *ContainerEnricher // nil without --containers
+	probes     func() []string    // Attached right now, see ProbeManager
+	programs   []attachedProgram  // --bpf-stats, nil without it
+
+	mu          sync.Mutex // Observe runs on the processor goroutine, handlers on net/http's
+	drops       map[apiDropKey]*apiDrop
+	retransmits uint64
+	closes      uint64
+}
+
+type apiDropKey struct{ reason, function, comm string }
+
+// GET /api/v1/drops, one entry per reason, kernel function and process,
+// most frequent first
+type apiDrop struct {
+	Reason   string    `json:"reason"`
+	Function string    `json:"function"`
+	Layer    string    `json:"layer"` // See droplayers.go
+	Comm     string    `json:"comm"`
+	Count    uint64    `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// GET /api/v1/connections, what the kernel is tracking right now
+type apiConnection struct {
+	Pid         uint32          `json:"pid"`
+	Comm        string          `json:"comm"`
+	Family      string          `json:"family"`
+	Saddr       string          `json:"saddr"`
+	Sport       uint16          `json:"sport"`
+	Daddr       string          `json:"daddr"`
+	Dport       uint16          `json:"dport"`
+	AgeNs       uint64          `json:"age_ns"`
+	Retransmits uint32          `json:"retransmits"`
+	Rtt         *jsonRtt        `json:"rtt,omitempty"`        // Left out when RTT was never sampled
+	Congestion  *jsonCongestion `json:"congestion,omitempty"` // Sampled with the RTT
+	Reorder     *jsonReorder    `json:"reorder,omitempty"`    // Degree sampled with the RTT, left out when neither was
+	Sack        *jsonSack       `json:"sack,omitempty"`       // Left out until the peer sent a SACK
+	CgroupID    uint64          `json:"cgroup_id"`
+	Pod         *jsonPod        `json:"pod,omitempty"`
+	Container   *jsonContainer  `json:"container,omitempty"`
+}
+
+// The congestion window is what caps throughput once the receiver keeps up:
+// a cwnd that collapses and stays low next to retransmits is loss, a low
+// ssthresh is loss that already happened
+type jsonCongestion struct {
+	Algorithm string `json:"algorithm"`
+	Cwnd      uint32 `json:"cwnd"`               // Segments
+	Ssthresh  uint32 `json:"ssthresh,omitempty"` // Segments, left out during the first slow start
+}
+
+// tcpInfiniteSsthresh is the kernel's ssthresh before the first loss
+const tcpInfiniteSsthresh = 0x7fffffff
+
+// congestionFromConn is nil for connections the rtt probe hasn't sampled
+func congestionFromConn(info *monitorConnInfo) *jsonCongestion {
+	var name [16]byte
+	for i, c := range info.CaName {
+		name[i] = byte(c)
+	}
+	if name[0] == 0 {
+		return nil
+	}
+	c := &jsonCongestion{Algorithm: commString(name[:]), Cwnd: info.SndCwnd}
+	if info.SndSsthresh != tcpInfiniteSsthresh {
+		c.Ssthresh = info.SndSsthresh
+	}
+	return c
+}
+
+// GET /api/v1/summary
+type apiSummary struct {
+	StartTime         time.Time         `json:"start_time"`
+	UptimeSeconds     float64           `json:"uptime_seconds"`
+	Probes            []string          `json:"probes"`
+	EventsRead        uint64            `json:"events_read"`
+	EventsLost        uint64            `json:"events_lost"`
+	EventsDropped     uint64            `json:"events_dropped"` // --overflow-policy drop
+	QueueDepth        int               `json:"queue_depth"`
+	Drops             uint64            `json:"drops"`
+	DropsByReason     map[string]uint64 `json:"drops_by_reason"`
+	Retransmits       uint64            `json:"retransmits"`
+	Closes            uint64            `json:"closes"`
+	ActiveConnections int               `json:"active_connections"`
+	Programs          []apiProgram      `json:"programs,omitempty"` // --bpf-stats
+}
+
+type apiProgram struct {
+	Probe          string  `json:"probe"`
+	Attachment     string  `json:"attachment"`
+	RunCount       uint64  `json:"run_count"`
+	RuntimeSeconds float64 `json:"runtime_seconds"`
+}
+
+func NewAPIServer(conns *ebpf.Map, metrics *Metrics, lost func() uint64, queue *eventQueue, probes func() []string, programs []attachedProgram, pods *K8sEnricher, containers *ContainerEnricher) *APIServer {
+	return &APIServer{
+		conns:      conns,
+		queue:      queue,
+		probes:     probes,
+		programs:   programs,
+		metrics:    metrics,
+		lost:       lost,
+		pods:       pods,
+		containers: containers,
+		drops:      make(map[apiDropKey]*apiDrop),
+	}
+}
+
+func (a *APIServer) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/connections", a.handleConnections)
+	mux.HandleFunc("GET /api/v1/drops", a.handleDrops)
+	mux.HandleFunc("GET /api/v1/summary", a.handleSummary)
+}
+
+func (a *APIServer) Observe(event *TcpEvent, p *EventProcessor) {
+	switch event.Type {
+	case eventDrop:
+		k := apiDropKey{p.reasonName(event.Reason), findNearestSymbol(event.Location), commString(event.Comm[:])}
+		a.mu.Lock()
+		d := a.drops[k]
+		if d == nil {
+			d = &apiDrop{Reason: k.reason, Function: k.function, Layer: dropLayer(k.function, k.reason), Comm: k.comm}
+			a.drops[k] = d
+		}
+		d.Count += event.occurrences()
+		d.LastSeen = time.Now()
+		a.mu.Unlock()
+	case eventRetransmit:
+		a.mu.Lock()
+		a.retransmits += event.occurrences()
+		a.mu.Unlock()
+	case eventClose:
+		a.mu.Lock()
+		a.closes++
+		a.mu.Unlock()
+	}
+}
+
+func (a *APIServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	conns, err := a.connections()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, conns)
+}
+
+func (a *APIServer) connections() ([]apiConnection, error) {
+	// start_ns is bpf_ktime_get_ns(), i.e. CLOCK_MONOTONIC
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return nil, err
+	}
+	now := uint64(ts.Nano())
+
+	conns := []apiConnection{} // [] rather than null when there are none
+	var key uint64
+	var info monitorConnInfo
+	iter := a.conns.Iterate()
+	for iter.Next(&key, &info) {
+		var comm [16]byte
+		for i, c := range info.Comm {
+			comm[i] = byte(c)
+		}
+		c := apiConnection{
+			Pid:         info.Pid,
+			Comm:        commString(comm[:]),
+			Family:      familyNames[info.Family],
+			Saddr:       formatAddr(info.Saddr),
+			Sport:       info.Sport,
+			Daddr:       formatAddr(info.Daddr),
+			Dport:       info.Dport,
+			Retransmits: info.Retransmits,
+			CgroupID:    info.CgroupId,
+		}
+		if now > info.StartNs {
+			c.AgeNs = now - info.StartNs
+		}
+		if info.RttSamples > 0 {
+			c.Rtt = &jsonRtt{
+				MinUs: info.RttMinUs,
+				AvgUs: uint32(info.RttSumUs / uint64(info.RttSamples)),
+				MaxUs: info.RttMaxUs,
+				VarUs: info.RttvarUs,
+			}
+		}
+		c.Congestion = congestionFromConn(&info)
+		if info.Reordering != 0 || info.OooPackets != 0 {
+			c.Reorder = &jsonReorder{OooPackets: info.OooPackets, OooMaxBytes: info.OooMaxBytes, Degree: info.Reordering}
+		}
+		if info.Sacks != 0 {
+			c.Sack = &jsonSack{Acks: info.Sacks, Blocks: info.SackBlocks, Dsacks: info.Dsacks, DsackBytes: info.DsackBytes}
+		}
+		if a.pods != nil {
+			if pod := a.pods.Pod(info.CgroupId); pod != nil {
+				c.Pod = &jsonPod{Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID, Labels: pod.Labels}
+			}
+		}
+		if a.containers != nil {
+			if ct := a.containers.Container(info.CgroupId, info.Pid); ct != nil {
+				c.Container = &jsonContainer{ID: ct.ID, Name: ct.Name, Image: ct.Image}
+			}
+		}
+		conns = append(conns, c)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].AgeNs > conns[j].AgeNs })
+	return conns, nil
+}
+
+func (a *APIServer) handleDrops(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	drops := make([]apiDrop, 0, len(a.drops))
+	for _, d := range a.drops {
+		drops = append(drops, *d)
+	}
+	a.mu.Unlock()
+	sort.Slice(drops, func(i, j int) bool { return drops[i].Count > drops[j].Count })
+	writeJSON(w, drops)
+}
+
+func (a *APIServer) handleSummary(w http.ResponseWriter, r *http.Request) {
+	s := apiSummary{
+		StartTime:     a.metrics.StartTime,
+		UptimeSeconds: time.Since(a.metrics.StartTime).Seconds(),
+		Probes:        a.probes(),
+		EventsRead:    a.metrics.EventsRead.Load(),
+		EventsLost:    a.lost(),
+		EventsDropped: a.queue.Dropped(),
+		QueueDepth:    a.queue.Depth(),
+		DropsByReason: make(map[string]uint64),
+	}
+	a.mu.Lock()
+	for k, d := range a.drops {
+		s.Drops += d.Count
+		s.DropsByReason[k.reason] += d.Count
+	}
+	s.Retransmits = a.retransmits
+	s.Closes = a.closes
+	a.mu.Unlock()
+	for _, p := range readProgramStats(a.programs) {
+		s.Programs = append(s.Programs, apiProgram{Probe: p.Probe, Attachment: p.Target, RunCount: p.RunCount, RuntimeSeconds: p.Runtime.Seconds()})
+	}
+
+	var key uint64
+	var info monitorConnInfo
+	iter := a.conns.Iterate()
+	for iter.Next(&key, &info) {
+		s.ActiveConnections++
+	}
+	if err := iter.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, s)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("writing API response", "err", err)
+	}
+}
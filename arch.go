@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// The programs are built for amd64, arm64 and 32-bit arm (gen.go), and the
+// binary loads the objects of the architecture it was built for. The kernel
+// has to be of that architecture too: the kprobes read their arguments out
+// of pt_regs, which are laid out like the kernel's, not like userspace's,
+// so a 32-bit arm binary on a 64-bit kernel (a Raspberry Pi OS with the
+// 64-bit kernel) would read garbage. Events are decoded in native byte
+// order, the kernel's and the binary's, both little endian on all three.
+
+// kernelMachines are the uname machines each GOARCH's objects are for
+var kernelMachines = map[string][]string{
+	"amd64": {"x86_64"},
+	"arm64": {"aarch64", "arm64"},
+	"arm":   {"armv6l", "armv7l", "armv8l"},
+}
+
+func kernelMachine() string {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(u.Machine[:])
+}
+
+// checkKernelArch is an error when the running kernel isn't of the
+// architecture the BPF objects were built for. Besides the registers, the
+// 32-bit arm objects take skb->tail and skb->end for the pointers they are
+// on 32-bit kernels (skb_data_offset in bpf/monitor.c), wrong on a 64-bit one
+func checkKernelArch() error {
+	machine := kernelMachine()
+	if machine == "" {
+		return nil
+	}
+	for _, m := range kernelMachines[runtime.GOARCH] {
+		if m == machine {
+			return nil
+		}
+	}
+	if runtime.GOARCH == "arm" && (machine == "aarch64" || machine == "arm64") {
+		return fmt.Errorf("this is a 32-bit arm build on a 64-bit %s kernel, use the arm64 build: it's static and runs on a 32-bit userland too", machine)
+	}
+	return fmt.Errorf("built for %s, the kernel is %s", runtime.GOARCH, machine)
+}
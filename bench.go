@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The bench command runs the monitor with everything attached, like
+// benchmark, against TCP churn it makes itself, and reports what watching
+// it cost: the monitor's CPU, its BPF programs' CPU, events per second and
+// how many were lost. That's the number to have before putting it on a
+// busy host.
+//
+// The churn comes from a child process (bench-load, not in the usage) in
+// a network namespace of its own: a server and clients on its loopback,
+// with netem on it for --loss and --delay, so nothing on the host is
+// touched and the qdisc goes away with the namespace. Being another
+// process keeps its CPU out of the monitor's; the kernel probes see its
+// connections all the same.
+
+// benchLoadCommand is the hidden subcommand the child runs
+const benchLoadCommand = "bench-load"
+
+const (
+	benchMaxInFlight = 4096             // Connections open at once, past that they're skipped
+	benchConnTimeout = 10 * time.Second // For the whole connection, loss can make handshakes slow
+)
+
+// benchLoadStats is what the child reports on its stdout when it's stopped
+type benchLoadStats struct {
+	Connections uint64 `json:"connections"` // Opened, echoed and closed
+	Failed      uint64 `json:"failed"`
+	Skipped     uint64 `json:"skipped"` // Not started, benchMaxInFlight were still open
+}
+
+// benchLoad is the running child, and where the monitor's counters were
+// when it started
+type benchLoad struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	rate   int
+
+	started time.Time
+	usage   unix.Rusage
+	events  uint64
+	bpf     time.Duration
+}
+
+// startBenchLoad starts the child in a new network namespace
+func startBenchLoad(o *options, metrics *Metrics, programs []attachedProgram) (*benchLoad, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, benchLoadCommand,
+		"--rate", strconv.Itoa(o.benchRate),
+		"--payload", strconv.Itoa(o.benchPayload),
+		"--loss", strconv.FormatFloat(o.benchLoss, 'g', -1, 64),
+		"--delay", o.benchDelay.String())
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNET,
+		Setpgid:    true, // Ctrl+C stops the monitor, which stops the load
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &benchLoad{cmd: cmd, stdout: stdout, rate: o.benchRate}
+	b.snapshot(metrics, programs)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", benchLoadCommand, err)
+	}
+	return b, nil
+}
+
+// snapshot keeps the counters the report takes differences of
+func (b *benchLoad) snapshot(metrics *Metrics, programs []attachedProgram) {
+	b.started = time.Now()
+	unix.Getrusage(unix.RUSAGE_SELF, &b.usage)
+	b.events = metrics.EventsRead.Load()
+	b.bpf = programsRuntime(programs)
+}
+
+func programsRuntime(programs []attachedProgram) time.Duration {
+	var total time.Duration
+	for _, s := range readProgramStats(programs) {
+		total += s.Runtime
+	}
+	return total
+}
+
+// Stop ends the load and waits for the child's counts
+func (b *benchLoad) Stop() (benchLoadStats, time.Duration, error) {
+	elapsed := time.Since(b.started)
+	var stats benchLoadStats
+	if err := b.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return stats, elapsed, err
+	}
+	decodeErr := json.NewDecoder(b.stdout).Decode(&stats)
+	if err := b.cmd.Wait(); err != nil {
+		return stats, elapsed, fmt.Errorf("%s: %w", benchLoadCommand, err)
+	}
+	return stats, elapsed, decodeErr
+}
+
+// Report writes the bench box of the end-of-run report. CPU is the share
+// of one CPU, user and system time of the monitor process, and the BPF
+// programs' run time, which the kernel charges to whatever was running.
+func (b *benchLoad) Report(w io.Writer, stats benchLoadStats, elapsed time.Duration, metrics *Metrics, lost, dropped uint64, programs []attachedProgram) {
+	var usage unix.Rusage
+	unix.Getrusage(unix.RUSAGE_SELF, &usage)
+	user := time.Duration(usage.Utime.Nano() - b.usage.Utime.Nano())
+	sys := time.Duration(usage.Stime.Nano() - b.usage.Stime.Nano())
+	events := metrics.EventsRead.Load() - b.events
+	secs := elapsed.Seconds()
+
+	fmt.Fprintln(w, "\n╔══════════════════════════════════════════════════════════════════════╗")
+	fmt.Fprintf(w, "║  %-66s  ║\n", "BENCH")
+	fmt.Fprintln(w, "╠══════════════════════════════════════════════════════════════════════╣")
+	fmt.Fprintf(w, "║ %-20s %-47s ║\n", "Load:", fmt.Sprintf("%.2fs at %d connections/sec", secs, b.rate))
+	fmt.Fprintf(w, "║ %-20s %-47s ║\n", "Connections:", fmt.Sprintf("%d (%.0f/sec), %d failed, %d skipped", stats.Connections, float64(stats.Connections)/secs, stats.Failed, stats.Skipped))
+	fmt.Fprintln(w, "╠══════════════════════════════════════════════════════════════════════╣")
+	fmt.Fprintf(w, "║ %-20s %-47s ║\n", "Monitor CPU:", fmt.Sprintf("%.2f%% (%.2f%% user, %.2f%% system)", cpuPercent(user+sys, elapsed), cpuPercent(user, elapsed), cpuPercent(sys, elapsed)))
+	if programs != nil {
+		fmt.Fprintf(w, "║ %-20s %-47s ║\n", "BPF programs CPU:", fmt.Sprintf("%.2f%%", cpuPercent(programsRuntime(programs)-b.bpf, elapsed)))
+	} else {
+		fmt.Fprintf(w, "║ %-20s %-47s ║\n", "BPF programs CPU:", "unknown, the kernel has no BPF stats")
+	}
+	fmt.Fprintln(w, "╠══════════════════════════════════════════════════════════════════════╣")
+	fmt.Fprintf(w, "║ %-20s %-47s ║\n", "Events:", fmt.Sprintf("%d (%.0f/sec)", events, float64(events)/secs))
+	var lostPct float64
+	if total := events + lost + dropped; total > 0 {
+		lostPct = 100 * float64(lost+dropped) / float64(total)
+	}
+	fmt.Fprintf(w, "║ %-20s %-47s ║\n", "Lost:", fmt.Sprintf("%d in the kernel, %d queue full (%.2f%%)", lost, dropped, lostPct))
+	fmt.Fprintln(w, "╚══════════════════════════════════════════════════════════════════════╝")
+}
+
+// runBenchLoad is the child: it makes connections on the loopback of the
+// namespace it was started in until SIGTERM, then prints its counts
+func runBenchLoad(args []string) {
+	fs := flag.NewFlagSet(benchLoadCommand, flag.ExitOnError)
+	var (
+		rate, payload int
+		loss          float64
+		delay         time.Duration
+	)
+	fs.IntVar(&rate, "rate", 1000, "")
+	fs.IntVar(&payload, "payload", 1024, "")
+	fs.Float64Var(&loss, "loss", 0, "")
+	fs.DurationVar(&delay, "delay", 0, "")
+	fs.Parse(args)
+
+	if err := benchNetns(loss, delay); err != nil {
+		fatal("setting up the bench namespace", "err", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatal("listening", "err", err)
+	}
+	go benchServe(ln)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+
+	var stats benchLoadStats
+	var connections, failed atomic.Uint64
+	var wg sync.WaitGroup
+	inFlight := make(chan struct{}, benchMaxInFlight)
+	addr := ln.Addr().String()
+
+	// Every millisecond, as many connections as are due by then, so rates
+	// past what a ticker can tick at still come out right
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	started := time.Now()
+	var launched uint64
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case now := <-ticker.C:
+			due := uint64(now.Sub(started).Seconds() * float64(rate))
+			for ; launched < due; launched++ {
+				select {
+				case inFlight <- struct{}{}:
+				default:
+					stats.Skipped++
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer func() { <-inFlight; wg.Done() }()
+					if err := benchConn(addr, payload); err != nil {
+						failed.Add(1)
+						return
+					}
+					connections.Add(1)
+				}()
+			}
+		}
+	}
+	wg.Wait() // At most benchConnTimeout
+	stats.Connections, stats.Failed = connections.Load(), failed.Load()
+	json.NewEncoder(os.Stdout).Encode(stats)
+}
+
+// benchNetns brings up the new namespace's loopback, makes room for the
+// ports the churn goes through, and puts netem on lo for loss and delay.
+// lo is both ways, so --delay is added twice to the RTT.
+func benchNetns(loss float64, delay time.Duration) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("reading lo flags: %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("bringing lo up: %w", err)
+	}
+
+	// Clients close first, so their ports sit in TIME_WAIT
+	for path, value := range map[string]string{
+		"/proc/sys/net/ipv4/ip_local_port_range": "1024 65535",
+		"/proc/sys/net/ipv4/tcp_tw_reuse":        "1",
+	} {
+		if err := os.WriteFile(path, []byte(value), 0o644); err != nil {
+			slog.Warn("tuning the bench namespace, high rates may run out of ports", "path", path, "err", err)
+		}
+	}
+
+	if loss == 0 && delay == 0 {
+		return nil
+	}
+	args := []string{"qdisc", "add", "dev", "lo", "root", "netem"}
+	if loss > 0 {
+		args = append(args, "loss", strconv.FormatFloat(loss, 'g', -1, 64)+"%")
+	}
+	if delay > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dus", delay.Microseconds()))
+	}
+	if out, err := exec.Command("tc", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tc %v (needs the sch_netem module): %w: %s", args, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// benchServe echoes whatever each connection sends until it's closed
+func benchServe(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			slog.Warn("accepting", "err", err)
+			return
+		}
+		go func() {
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(benchConnTimeout))
+			io.Copy(c, c)
+		}()
+	}
+}
+
+// benchConn is one connection: connect, send payload bytes, read them
+// back, close
+func benchConn(addr string, payload int) error {
+	c, err := net.DialTimeout("tcp", addr, benchConnTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(benchConnTimeout))
+	if payload == 0 {
+		return nil
+	}
+	buf := make([]byte, payload)
+	if _, err := c.Write(buf); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(c, buf)
+	return err
+}
@@ -1,18 +1,238 @@
 // +build ignore
 //Above comment is a Go directive
 //Tells Go to ignore this file when we run go build
-//Otherwise it tries to compile it using cgo 
+//Otherwise it tries to compile it using cgo
 //And we are only using this fiel for eBPF generation
 
 #include "vmlinux.h" //Single file that contains every struct def in current kernel
-#include <bpf/bpf_helpers.h> 
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_core_read.h> //BPF_CORE_READ for reading kernel structs (tcp_sock) safely
+#include <bpf/bpf_endian.h>    //bpf_ntohs
+#include <bpf/bpf_tracing.h>   //BPF_KPROBE, needs the __TARGET_ARCH_* bpf2go sets per -target
 
+#define EVENT_DROP       1
+#define EVENT_RETRANSMIT 2
+#define EVENT_STATE      3
+#define EVENT_CLOSE      4
+#define EVENT_CONNECT    5
+#define EVENT_RESET      6
+#define EVENT_ZERO_WINDOW 7
+#define EVENT_UDP_ERROR  8
+#define EVENT_ICMP_ERROR 9
+#define EVENT_DSACK      10
+#define EVENT_KEEPALIVE  11
+#define EVENT_FASTOPEN   12
+#define EVENT_BUFFER     13
+#define EVENT_TLS        14
+#define EVENT_SYN_FLOOD  15
+#define EVENT_BLOCKED    16
+#define EVENT_SOCKOPT    17
+#define EVENT_LISTEN     18
+
+#define RST_SENT     1
+#define RST_RECEIVED 2
+
+#define WINDOW_SENT     1 //We advertised a zero window: the local process isn't reading
+#define WINDOW_RECEIVED 2 //The peer did, and we're probing it from the persist timer
+
+#define UDP_SENT     1 //udp_sendmsg failed
+#define UDP_RECEIVED 2 //A datagram couldn't be queued on its socket
+
+#define KEEPALIVE_UNANSWERED 1 //A keepalive probe went unanswered, the next one is going out
+#define KEEPALIVE_TIMEOUT    2 //Out of probes (or past TCP_USER_TIMEOUT), the connection was reset and closed
+
+#define FASTOPEN_SENT     1 //Our connect, when the SYN-ACK comes back
+#define FASTOPEN_RECEIVED 2 //A SYN to one of our listeners
+
+//What came of a Fast Open SYN, the reason of EVENT_FASTOPEN
+#define FASTOPEN_COOKIE_REQUEST    1 //Asked for a cookie and got one: kept for the next connect (sent), or handed out (received)
+#define FASTOPEN_ACCEPTED          2 //The SYN's data was accepted, it didn't wait for the handshake
+#define FASTOPEN_NO_COOKIE         3 //Sent: asked for a cookie, the server didn't send one
+#define FASTOPEN_DATA_NOT_ACKED    4 //Sent: the server only acknowledged the SYN, the data goes again
+#define FASTOPEN_SYN_RETRANSMITTED 5 //Sent: the SYN with data timed out, a plain one got through
+#define FASTOPEN_BLACKHOLE         6 //Sent: active TFO is off for a while after SYNs with data got lost on the path
+#define FASTOPEN_INVALID_COOKIE    7 //Received: the cookie didn't check out, the SYN-ACK has the right one
+#define FASTOPEN_REFUSED           8 //Received: TFO is off for the listener, or its TFO queue (TCP_FASTOPEN) is full
+
+#define TFO_CLIENT_COOKIE_UNAVAILABLE 1 //enum tcp_fastopen_client_fail, 5.5+
+
+//What tcp_prune_queue had to do to fit a segment into the receive buffer, mildest first
+#define BUFFER_COLLAPSED  1 //Copied the queued segments into fewer, fuller buffers (CPU, no data lost)
+#define BUFFER_OFO_PRUNED 2 //Threw away out-of-order data, the peer has to send it again
+#define BUFFER_DROPPED    3 //Still over, the segment that arrived was dropped too
+
+#define BUFFER_RCVBUF_LOCKED 0x1 //SO_RCVBUF was set, so the kernel doesn't grow the buffer
+#define BUFFER_MEM_PRESSURE  0x2 //TCP as a whole is over net.ipv4.tcp_mem
+
+#define SOCK_RCVBUF_LOCK 2
+
+#define LISTEN_STARTED 1 //listen() made the socket a listener, or changed the backlog of one
+#define LISTEN_FAILED  2 //listen() failed, reason is the errno
+#define BIND_FAILED    3 //bind() on a TCP socket failed, the address is the one asked for
+#define LISTEN_CLOSED  4 //A listener was closed
+
+#define TLS_CLIENT 1 //The handshake of a connection we opened
+#define TLS_SERVER 2 //Of one we accepted
+
+#define NAT_SRC   0x1 //Source NAT: masquerade, SNAT
+#define NAT_DST   0x2 //Destination NAT: a Kubernetes Service, DNAT, a port forward
+#define NAT_REPLY 0x4 //The packet was going the reply way, server to client
+
+#define AF_INET       2
+#define AF_INET6      10
+#define IPPROTO_TCP   6
+#define IPPROTO_UDP   17
+#define ETIMEDOUT     110
+#define ETH_P_IP      0x0800
+#define ETH_P_IPV6    0x86DD
+#define ETH_P_8021Q   0x8100
+#define ETH_P_8021AD  0x88A8
+#define TASK_COMM_LEN 16
+#define TCP_CA_NAME_MAX 16
+
+#define RTT_SAMPLE_NS 100000000ULL //Sample a connection's RTT at most every 100ms
+
+//pid, comm and cgroup_id describe the connection owner when it is known (see set_owner),
+//otherwise the task that was running when the probe fired
+//Every field is fixed size and every u64 8 byte aligned with no holes for the compiler to
+//fill, so the layout is the same on amd64, arm64 and 32-bit arm userspace, whose Go only
+//aligns u64 to 4. decodeEvent in events.go has the offsets, checked at compile time.
 struct event{
     u32 pid;
-    u32 reason;
+    u32 reason;   //enum skb_drop_reason for drops, enum sk_rst_reason for sent resets on 6.10+, errno for EVENT_UDP_ERROR,
+                  //ICMP type << 8 | code for EVENT_ICMP_ERROR
     u64 location; //Memory address of the drop
+    u32 type;     //One of the EVENT_* defines above
+    u32 state;    //TCP socket state (new state for EVENT_STATE), 0 for EVENT_ICMP_ERROR on untracked connections
+    u32 old_state; //Only set for EVENT_STATE
+    u32 family;   //AF_INET or AF_INET6, 0 for drops we couldn't parse
+    u8 saddr[16]; //Network byte order, IPv4 stored IPv4-mapped (see set_addr)
+    u8 daddr[16];
+    u16 sport;    //Host byte order, the tracepoint already converts it
+    u16 dport;
+    u32 retransmits;    //EVENT_CLOSE only
+    u64 duration_ns;    //EVENT_CLOSE: time from connect/accept to close, EVENT_CONNECT: handshake time,
+                        //EVENT_KEEPALIVE: time since the peer was last heard from, 0 if unknown,
+                        //EVENT_TLS: from the first SSL_do_handshake call to the one that finished it
+    u64 bytes_sent;     //EVENT_CLOSE only
+    u64 bytes_received; //EVENT_CLOSE only
+    char comm[TASK_COMM_LEN]; //Process name
+    u64 cgroup_id;      //cgroup v2 id, userspace maps it to a pod/container
+    u32 rtt_min_us;     //EVENT_CLOSE only: smoothed RTT over the sampled lifetime, 0 if never sampled
+    u32 rtt_avg_us;
+    u32 rtt_max_us;
+    u32 rttvar_us;      //EVENT_CLOSE only: RTT mean deviation at the last sample
+    u32 suppressed;     //Drops and retransmits: events of this type on this tuple left out by --conn-limit since the last one sent
+    u32 netns;          //Network namespace inode, tells apart containers reusing the same addresses (see netns.go)
+    u32 direction;      //EVENT_RESET: RST_SENT or RST_RECEIVED, EVENT_ZERO_WINDOW: WINDOW_SENT or WINDOW_RECEIVED, EVENT_UDP_ERROR: UDP_SENT or UDP_RECEIVED,
+                        //EVENT_KEEPALIVE: KEEPALIVE_UNANSWERED or KEEPALIVE_TIMEOUT, EVENT_FASTOPEN: FASTOPEN_SENT or FASTOPEN_RECEIVED,
+                        //EVENT_BUFFER: BUFFER_COLLAPSED, BUFFER_OFO_PRUNED or BUFFER_DROPPED,
+                        //EVENT_TLS: TLS_CLIENT or TLS_SERVER, 0 for connections opened before the monitor
+    u32 queued;         //EVENT_ZERO_WINDOW only: bytes waiting to be read (sent) or sent (received)
+    u32 protocol;       //IPPROTO_* of drops with a tuple and EVENT_UDP_ERROR, 0 otherwise (TCP)
+    u32 mtu;            //EVENT_ICMP_ERROR only: next-hop MTU of fragmentation needed and packet too big
+    u32 ooo_packets;    //EVENT_CLOSE only: segments that arrived out of order (trace_tcp_ooo)
+    u32 ooo_max_bytes;  //EVENT_CLOSE only: furthest one of them arrived ahead of the next expected byte
+    u32 reordering;     //EVENT_CLOSE only: the sender's reordering degree in segments (tp->reordering)
+    u32 reord_seen;     //EVENT_CLOSE only: reorderings the sender detected, 0 before 5.0
+    u32 sacks;          //EVENT_CLOSE only: ACKs with SACK blocks (trace_tcp_sack)
+    u32 sack_blocks;    //EVENT_CLOSE only: the blocks they carried
+    u32 dsacks;         //EVENT_CLOSE only: DSACKs among them, segments the peer received twice
+    u32 dsack_bytes;    //EVENT_CLOSE: bytes of all of them, EVENT_DSACK: of this one
+    u32 probes;         //EVENT_KEEPALIVE only: keepalive probes sent without an answer
+    u32 max_probes;     //EVENT_KEEPALIVE only: how many the connection gets (TCP_KEEPCNT or net.ipv4.tcp_keepalive_probes)
+    u32 rmem_alloc;     //EVENT_BUFFER only: receive memory in use when the segment arrived (sk_rmem_alloc, with overhead)
+    u32 rmem_after;     //EVENT_BUFFER only: and after pruning
+    u32 rcvbuf;         //EVENT_BUFFER only: the socket's limit (sk_rcvbuf)
+    u32 rmem_max;       //EVENT_BUFFER only: the most autotuning grows it to, net.ipv4.tcp_rmem[2]
+    u32 collapses;      //EVENT_BUFFER only: tcp_collapse runs it took
+    u32 buffer_flags;   //EVENT_BUFFER only: BUFFER_RCVBUF_LOCKED, BUFFER_MEM_PRESSURE
+    u32 stack_id;       //Drops with --stacks: 1 + the kernel stack's id in drop_stacks, 0 when not captured
+    u32 user_stack_id;  //With --user-stacks, resets, ICMP errors, slow and failed connects: 1 + the id in user_stacks
+                        //of the connect() that opened the connection, 0 without one
+    u64 tcp_connect_ns; //EVENT_TLS only: the TCP handshake before it, 0 for accepted connections
+    u64 tls_wait_ns;    //EVENT_TLS only: from the connection being established to the first SSL_do_handshake call
+    u32 mark;           //Drops and retransmits: skb->mark or sk_mark, for finding the trace behind them (see traces.go)
+    u32 ifindex;        //EVENT_SYN_FLOOD: the --interface the SYNs arrived on. Drops: the packet's device when it was
+                        //dropped, retransmits: the one the route sends out of. 0 when unknown
+    u64 sock_cookie;    //Drops and retransmits: the socket's SO_COOKIE, 0 if nothing asked for it yet
+    u32 prefix_len;     //EVENT_SYN_FLOOD only: saddr is the source prefix of this length
+    u32 syns;           //EVENT_SYN_FLOOD only: SYNs from the prefix in the window, duration_ns into it
+    u32 mptcp_token;    //Events of an MPTCP subflow: the token of the MPTCP connection it belongs to, 0 for plain TCP
+    u32 mptcp_subflow;  //And the subflow's id within it, from 1 (6.6+, 0 before)
+    u64 sock;           //EVENT_SOCKOPT and EVENT_STATE: the socket's address, ties options set before connect() to the connection
+    u32 backlog;        //EVENT_LISTEN: the accept queue's size (sk_max_ack_backlog), after listen() or when closed
+    u32 somaxconn;      //EVENT_LISTEN of listen(): net.core.somaxconn in the socket's namespace, the backlog's cap
+    u32 accept_queue;   //EVENT_LISTEN of a closed listener: connections it had queued and no one accepted, reset with it
+    u32 iif;            //Drops: the interface the packet came in on (skb_iif), 0 for ones sent from here.
+                        //Retransmits: the one the connection's segments arrive on
+    u32 vlan;           //Drops: VLAN_TAGGED | the VLAN id of the 802.1Q tag the packet still had, 0 without one
+    u32 pid_start;      //Events with the owner from the connection table and --process-info: when pid started (task_start),
+                        //so a reused PID's events don't get the old process's details. 0 for the rest
+};
+_Static_assert(sizeof(struct event) == 312, "struct event changed, update decodeEvent in events.go");
+
+//What only some types have goes after struct event in a tail of their own, so the rest
+//don't carry it through the ring buffer. Userspace finds it by the event's type.
+
+//EVENT_DROP's tail
+struct drop_info{
+    u8 ct_saddr[16];    //Drops of translated connections: the conntrack tuple before NAT, as the client sent it
+    u8 ct_daddr[16];
+    u8 nat_saddr[16];   //And after NAT, as the server sees it
+    u8 nat_daddr[16];
+    u16 ct_sport;       //Host byte order, 0 for protocols without ports
+    u16 ct_dport;
+    u16 nat_sport;
+    u16 nat_dport;
+    u32 nat_flags;      //NAT_SRC, NAT_DST, NAT_REPLY, 0 when the drop's connection wasn't translated
+    u32 tunnel;         //Drops of VXLAN and Geneve packets: TUNNEL_VXLAN or TUNNEL_GENEVE, saddr to dport are the
+                        //tunnel endpoints', 0 for anything else
+    u32 vni;            //And the packet's VNI
+    u32 inner_family;   //And the tuple of the packet inside it, the overlay's flow, or 0 when it isn't IP
+    u32 inner_protocol;
+    u8 inner_saddr[16];
+    u8 inner_daddr[16];
+    u16 inner_sport;    //Host byte order, 0 for protocols without ports
+    u16 inner_dport;
+};
+_Static_assert(sizeof(struct drop_info) == 128, "struct drop_info changed, update decodeEvent in events.go");
+
+struct drop_event{
+    struct event e;
+    struct drop_info d;
+};
+
+#define PCAP_MAX_SNAPLEN 256
+
+//With --pcap, drops are sent as the event followed by the start of the packet
+//Userspace tells the two apart by the sample size
+struct drop_capture{
+    struct event e;
+    struct drop_info d;
+    u32 cap_len;  //Bytes of data that are valid, the rest is whatever the buffer held before
+    u32 orig_len; //Length of the whole packet from its IP header on
+    u8 data[PCAP_MAX_SNAPLEN]; //Starts at the IP header
+};
+_Static_assert(sizeof(struct drop_capture) == 312 + 128 + 8 + PCAP_MAX_SNAPLEN, "struct drop_capture changed, update decodeEvent in events.go");
+
+//EVENT_SOCKOPT's tail
+struct sockopt_info{
+    u32 sockopt;        //level << 16 | optname, reason is the errno of a failed call
+    u32 sockopt_old;    //The option as the socket had it before the call and after, as the kernel
+    u32 sockopt_new;    //keeps it (SO_SNDBUF and SO_RCVBUF doubled), 0 for TCP_CONGESTION
+    char ca_old[TCP_CA_NAME_MAX]; //TCP_CONGESTION only: the algorithm before and after
+    char ca_new[TCP_CA_NAME_MAX];
+    u32 pad;
+};
+_Static_assert(sizeof(struct sockopt_info) == 48, "struct sockopt_info changed, update decodeEvent in events.go");
+
+struct sockopt_event{
+    struct event e;
+    struct sockopt_info s;
 };
 
+#ifndef USE_PERF_BUF
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF); //FIFO Queue, better than PerfBuffer cuz its shared across all CPUs
     __uint(max_entries, 1 << 16); //Buffer size must be a power of 2
@@ -20,17 +240,3509 @@ struct {
 } events SEC(".maps"); //ELF section marker
 //Tells the kernel this is a data structure def and not to execute it
 //Allocate memory for this buffer when you load the program
+#else
+//Fallback build for kernels older than 5.8, which don't have ring buffers
+//gen.go compiles this file a second time with -DUSE_PERF_BUF
+struct {
+    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY); //One buffer per CPU, sized by the Go side
+    __uint(key_size, sizeof(u32));
+    __uint(value_size, sizeof(u32));
+} events SEC(".maps");
 
-SEC("tracepoint/skb/kfree_skb") //hook
-int trace_tcp_drop(struct trace_event_raw_kfree_skb *ctx){
-    if (ctx->reason <= 1) return 0;
-    struct event *e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
-    if (!e) return 0;
+//perf_event_output copies from memory we own, so events are built here first
+//Per-CPU so programs running on different CPUs don't overwrite each other
+//Sized for the largest, drop_capture, the others use the start of it
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, struct drop_capture);
+} event_scratch SEC(".maps");
+#endif
+
+//Events that didn't fit in the ring buffer, summed over CPUs by the Go side
+//Defined in both builds so they share monitorObjects, but the perf build
+//leaves it at 0: perf.Reader reports lost samples itself
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, u64);
+} lost_events SEC(".maps");
+
+//Connection table: one entry per live connection, created on connect/accept
+//and removed when the socket reaches TCP_CLOSE
+//The tuple and comm are kept here too so userspace can export live connections
+//straight from this map (see prometheus.go) without replaying events
+//Read by userspace too (api.go, snapshot), laid out without holes like struct event
+struct conn_info{
+    u64 start_ns;
+    u32 pid;         //Owner at connect/accept time, the close usually runs in softirq context
+    u32 retransmits;
+    char comm[TASK_COMM_LEN];
+    u32 family;
+    u8 saddr[16];
+    u8 daddr[16];
+    u16 sport;
+    u16 dport;
+    u64 cgroup_id;
+    //RTT samples from trace_tcp_rtt
+    u64 rtt_last_ns;
+    u64 rtt_sum_us;
+    u32 rtt_samples;
+    u32 rtt_min_us;
+    u32 rtt_max_us;
+    u32 rttvar_us;
+    //Congestion state at the last RTT sample
+    u32 snd_cwnd;     //Segments
+    u32 snd_ssthresh; //TCP_INFINITE_SSTHRESH until the first loss ends slow start
+    char ca_name[TCP_CA_NAME_MAX]; //Congestion control, e.g. cubic or bbr
+    u32 reordering;   //Also at the last RTT sample
+    //Out-of-order segments from trace_tcp_ooo
+    u32 ooo_packets;
+    u32 ooo_max_bytes;
+    //SACKs and DSACKs from trace_tcp_sack
+    u32 sacks;
+    u32 sack_blocks;
+    u32 dsacks;
+    u32 dsack_bytes;
+    u32 user_stack;   //Active opens with --user-stacks: 1 + the connecting task's stack id in user_stacks, 0 if none
+    u64 connect_ns;   //Active opens: the handshake time, 0 for accepted connections
+    //Also at the last RTT sample, for --ipfix-active-timeout's records of live connections
+    u64 bytes_acked;
+    u64 bytes_received;
+    u32 pid_start;    //The owner's task_start, so its proc_owners entry is found after its PID was reused
+    u32 segs_out;     //At the last RTT sample too, what alert rules with per: segments divide by
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 16384);
+    __type(key, u64); //struct sock address
+    __type(value, struct conn_info);
+} conns SEC(".maps");
+//Keyed by the sock pointer rather than the socket cookie:
+//bpf_get_socket_cookie() can't be called from tracepoint programs,
+//and the pointer is unique for exactly the lifetime this table tracks.
+//An entry whose close was missed outlives its socket, see the Readme's Connection Table
+
+//The same connections by tuple, our end first, for probes that only have a packet
+//quoting one of our segments (ICMP errors). Added once the source port is bound: when
+//tcp_v4_connect/tcp_v6_connect return for connects, at ESTABLISHED for accepted sockets
+struct conn_tuple{
+    u8 saddr[16];
+    u8 daddr[16];
+    u16 sport;
+    u16 dport;
+    u32 netns; //The same tuple can be live in two containers
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //Connections whose close we missed are evicted eventually
+    __uint(max_entries, 16384);
+    __type(key, struct conn_tuple);
+    __type(value, u64); //The conns key
+} conn_tuples SEC(".maps");
+
+//Process filters, populated from --pid/--comm (see filter.go)
+//The switches are writable globals rather than const volatile, so a filter
+//reload (SIGHUP, see filter.go) can turn them on and off while the programs run
+volatile u8 filter_by_pid = 0;
+volatile u8 filter_by_comm = 0;
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1024);
+    __type(key, u32); //tgid
+    __type(value, u8);
+} filter_pids SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1024);
+    __type(key, char[TASK_COMM_LEN]); //NUL padded
+    __type(value, u8);
+} filter_comms SEC(".maps");
+
+//Cgroup scope from --cgroup: slot 0 holds the cgroup v2 directory fd, for the current task.
+//Sockets are checked by the directory's id and its depth under the root instead
+volatile u8 filter_by_cgroup = 0;
+volatile u64 filter_cgroup_id = 0;
+volatile u32 filter_cgroup_level = 0;
+
+struct {
+    __uint(type, BPF_MAP_TYPE_CGROUP_ARRAY);
+    __uint(max_entries, 1);
+    __uint(key_size, sizeof(u32));
+    __uint(value_size, sizeof(u32));
+} filter_cgroup SEC(".maps");
+
+//Also true for tasks in descendant cgroups, so a systemd slice or pod covers its children
+static __always_inline bool in_cgroup(void){
+    if (!filter_by_cgroup) return true;
+    return bpf_current_task_under_cgroup(&filter_cgroup, 0) == 1;
+}
+
+//The cgroup a socket was created in, which holds on to it for its whole life, unlike the
+//task on the CPU in softirq and timers. sk_cgrp_data.cgroup is there since 5.15, before that
+//it's packed with the net_cls data and 0 is returned. Request and timewait sockets have none.
+static __always_inline struct cgroup *sock_cgrp(struct sock *sk){
+    if (!sk || !bpf_core_field_exists(sk->sk_cgrp_data.cgroup)) return 0;
+    u8 state = BPF_CORE_READ(sk, __sk_common.skc_state);
+    if (state == TCP_TIME_WAIT || state == TCP_NEW_SYN_RECV) return 0;
+    return BPF_CORE_READ(sk, sk_cgrp_data.cgroup);
+}
+
+//in_cgroup for a socket. Walked up by parent, which every kernel has, where the array of
+//ancestors changed type in 6.1. A socket whose cgroup can't be read uses the current task's
+#define CGROUP_MAX_DEPTH 16
+static __always_inline bool sock_in_cgroup(struct sock *sk){
+    if (!filter_by_cgroup) return true;
+    struct cgroup *cg = sock_cgrp(sk);
+    if (!cg) return in_cgroup();
+    int up = BPF_CORE_READ(cg, level) - (int)filter_cgroup_level;
+    if (up < 0) return false;
+    #pragma unroll
+    for (int i = 0; i < CGROUP_MAX_DEPTH; i++){
+        if (i == up) return BPF_CORE_READ(cg, kn, id) == filter_cgroup_id;
+        cg = BPF_CORE_READ(cg, self.parent, cgroup);
+        if (!cg) return false;
+    }
+    return false; //Deeper than that, not worth the instructions
+}
+
+//An event passes if it matches any of the configured filters
+static __always_inline bool allowed(u32 pid, const char *comm){
+    if (!filter_by_pid && !filter_by_comm) return true;
+    if (filter_by_pid && bpf_map_lookup_elem(&filter_pids, &pid)) return true;
+    if (filter_by_comm && bpf_map_lookup_elem(&filter_comms, comm)) return true;
+    return false;
+}
+
+static __always_inline bool allowed_current(void){
+    if (!in_cgroup()) return false;
+    char comm[TASK_COMM_LEN] = {};
+    bpf_get_current_comm(&comm, sizeof(comm));
+    return allowed(bpf_get_current_pid_tgid() >> 32, comm);
+}
+
+//Drops and retransmits usually run in softirq, where the current task is
+//whatever happened to be on the CPU. The connection owner is the better match.
+//The cgroup was already checked when the owner opened the connection.
+static __always_inline bool allowed_conn(struct conn_info *conn){
+    if (conn) return allowed(conn->pid, conn->comm);
+    return allowed_current();
+}
+
+//The same for probes that have the socket, drops by skb->sk. A socket the table doesn't
+//have (a listener, UDP, opened before the monitor started) has no owner to match, so
+//it only passes without a --pid/--comm filter, and by its own cgroup. No socket falls
+//back to the current task.
+static __always_inline bool allowed_sock(struct sock *sk, struct conn_info *conn){
+    if (conn) return allowed(conn->pid, conn->comm);
+    if (!sk) return allowed_current();
+    if (filter_by_pid || filter_by_comm) return false;
+    return sock_in_cgroup(sk);
+}
+
+//Connection filters, populated from --port/--cidr (see filter.go)
+//A connection passes if either end matches; ports and CIDRs must both match when both are set
+volatile u8 filter_by_port = 0;
+volatile u8 filter_by_cidr = 0;
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1024);
+    __type(key, u16); //Host byte order
+    __type(value, u8);
+} filter_ports SEC(".maps");
+
+struct lpm_key{
+    u32 prefixlen; //LPM tries need the prefix length first
+    u8 addr[16];   //IPv4 CIDRs are stored as ::ffff:0:0/96 + prefix, like addresses
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE); //Longest prefix match, one lookup covers every CIDR
+    __uint(max_entries, 1024);
+    __type(key, struct lpm_key);
+    __type(value, u8);
+    __uint(map_flags, BPF_F_NO_PREALLOC); //Required for LPM tries
+} filter_cidrs SEC(".maps");
+
+static __always_inline bool cidr_match(const u8 *addr){
+    struct lpm_key key = {.prefixlen = 128};
+    __builtin_memcpy(key.addr, addr, sizeof(key.addr));
+    return bpf_map_lookup_elem(&filter_cidrs, &key) != 0;
+}
+
+static __always_inline bool allowed_tuple(const u8 *saddr, const u8 *daddr, u16 sport, u16 dport){
+    if (filter_by_port &&
+        !bpf_map_lookup_elem(&filter_ports, &sport) &&
+        !bpf_map_lookup_elem(&filter_ports, &dport)) return false;
+    if (filter_by_cidr && !cidr_match(saddr) && !cidr_match(daddr)) return false;
+    return true;
+}
+
+//Copies one end's address in the 16 byte form used everywhere:
+//IPv6 as is, IPv4 as ::ffff:a.b.c.d so one field and one LPM trie cover both families
+static __always_inline void set_addr(u8 *dst, u32 family, const u8 *v4, const u8 *v6){
+    if (family == AF_INET6){
+        __builtin_memcpy(dst, v6, 16);
+        return;
+    }
+    __builtin_memset(dst, 0, 10);
+    dst[10] = 0xff;
+    dst[11] = 0xff;
+    __builtin_memcpy(dst + 12, v4, 4);
+}
+
+//Reads a socket's family, addresses and ports in the same form as the tracepoints give them
+//Returns false for sockets that aren't IPv4 or IPv6
+static __always_inline bool read_sock_addrs(struct sock *sk, u32 *family, u8 *saddr, u8 *daddr, u16 *sport, u16 *dport){
+    u16 f = BPF_CORE_READ(sk, __sk_common.skc_family);
+    if (f == AF_INET){
+        u32 s = BPF_CORE_READ(sk, __sk_common.skc_rcv_saddr);
+        u32 d = BPF_CORE_READ(sk, __sk_common.skc_daddr);
+        set_addr(saddr, AF_INET, (u8 *)&s, 0);
+        set_addr(daddr, AF_INET, (u8 *)&d, 0);
+    } else if (f == AF_INET6){
+        BPF_CORE_READ_INTO(saddr, sk, __sk_common.skc_v6_rcv_saddr.in6_u.u6_addr8);
+        BPF_CORE_READ_INTO(daddr, sk, __sk_common.skc_v6_daddr.in6_u.u6_addr8);
+    } else {
+        return false;
+    }
+    *family = f;
+    *sport = BPF_CORE_READ(sk, __sk_common.skc_num); //Already host byte order
+    *dport = bpf_ntohs(BPF_CORE_READ(sk, __sk_common.skc_dport));
+    return true;
+}
+
+//Addresses and ports of a dropped packet, read straight from its headers
+struct tuple{
+    u32 family;
+    u32 protocol; //IPPROTO_*, the IPv6 next header when there are extension headers
+    u8 saddr[16];
+    u8 daddr[16];
+    u16 sport;
+    u16 dport;
+};
+
+//The source and destination ports lead both the TCP and UDP headers
+static __always_inline void read_ports(const unsigned char *l4, u8 protocol, struct tuple *t){
+    if (protocol != IPPROTO_TCP && protocol != IPPROTO_UDP) return;
+    __be16 ports[2];
+    if (bpf_probe_read_kernel(&ports, sizeof(ports), l4)) return;
+    t->sport = bpf_ntohs(ports[0]);
+    t->dport = bpf_ntohs(ports[1]);
+}
+
+//Parses an IP header and the TCP/UDP ports after it, false for anything that isn't IPv4 or IPv6
+//Returns the start of L4 in *l4
+static __always_inline bool read_ip_tuple(const unsigned char *ip, u16 protocol, struct tuple *t, const unsigned char **l4){
+    if (protocol == ETH_P_IP){
+        struct iphdr iph;
+        if (bpf_probe_read_kernel(&iph, sizeof(iph), ip)) return false;
+        if (iph.version != 4) return false;
+        t->family = AF_INET;
+        set_addr(t->saddr, AF_INET, (u8 *)&iph.saddr, 0);
+        set_addr(t->daddr, AF_INET, (u8 *)&iph.daddr, 0);
+        t->protocol = iph.protocol;
+        *l4 = ip + iph.ihl * 4;
+        read_ports(*l4, iph.protocol, t);
+        return true;
+    }
+
+    if (protocol == ETH_P_IPV6){
+        struct ipv6hdr ip6h;
+        if (bpf_probe_read_kernel(&ip6h, sizeof(ip6h), ip)) return false;
+        if (ip6h.version != 6) return false;
+        t->family = AF_INET6;
+        __builtin_memcpy(t->saddr, &ip6h.saddr, sizeof(t->saddr));
+        __builtin_memcpy(t->daddr, &ip6h.daddr, sizeof(t->daddr));
+        t->protocol = ip6h.nexthdr;
+        //Ports are only found when no extension headers sit in between
+        *l4 = ip + sizeof(ip6h);
+        read_ports(*l4, ip6h.nexthdr, t);
+        return true;
+    }
+    return false;
+}
+
+//kfree_skb only gives us the skb, so parse the IP and TCP/UDP headers ourselves
+//skb->transport_header isn't always set yet when early drops happen, so L4 is found from the IP header
+static __always_inline bool read_skb_tuple(struct sk_buff *skb, u16 protocol, struct tuple *t, const unsigned char **l4){
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    u16 network_header = BPF_CORE_READ(skb, network_header);
+    return read_ip_tuple(head + network_header, protocol, t, l4);
+}
+
+//VXLAN and Geneve carry an overlay's packets in UDP between the hosts' tunnel endpoints, so a
+//dropped one's tuple is that of two VTEPs, whatever pods it was between. They're known by their
+//port: 4789 is VXLAN's, 8472 the one Linux picked before it (flannel, Cilium), 6081 Geneve's.
+//The outer tuple had ports, so there's no IPv6 extension header to get past.
+#define TUNNEL_VXLAN  1
+#define TUNNEL_GENEVE 2
+#define ETH_P_TEB     0x6558 //Geneve's protocol for an Ethernet frame
+#define VXLAN_FLAG_VNI 0x08
+
+//The first 8 bytes of either header, Geneve's options follow
+struct tunnel_hdr{
+    u8 flags;        //VXLAN: VXLAN_FLAG_VNI. Geneve: the version, 0, and the options' length in 4-byte words
+    u8 reserved;
+    __be16 protocol; //Geneve only: the payload's EtherType
+    u8 vni[3];
+    u8 reserved2;
+};
+
+static __always_inline u32 tunnel_of(const struct tuple *t){
+    if (t->protocol != IPPROTO_UDP) return 0;
+    if (t->dport == 4789 || t->dport == 8472) return TUNNEL_VXLAN;
+    if (t->dport == 6081) return TUNNEL_GENEVE;
+    return 0;
+}
+
+//Reads the VNI and the tuple of the packet inside a tunnel's, from the UDP header at udp
+//Only Ethernet frames with an IP packet, after one VLAN tag at most, have an inner tuple
+static __always_inline void read_tunnel(const unsigned char *udp, u32 tunnel, u32 *vni, struct tuple *inner){
+    const unsigned char *p = udp + 8;
+    struct tunnel_hdr th;
+    if (bpf_probe_read_kernel(&th, sizeof(th), p)) return;
+    p += sizeof(th);
+    if (tunnel == TUNNEL_VXLAN){
+        if (!(th.flags & VXLAN_FLAG_VNI)) return;
+    } else {
+        if (th.flags >> 6 || bpf_ntohs(th.protocol) != ETH_P_TEB) return;
+        p += (th.flags & 0x3f) * 4;
+    }
+    *vni = (u32)th.vni[0] << 16 | (u32)th.vni[1] << 8 | th.vni[2];
+
+    struct ethhdr eth;
+    if (bpf_probe_read_kernel(&eth, sizeof(eth), p)) return;
+    p += sizeof(eth);
+    u16 proto = bpf_ntohs(eth.h_proto);
+    if (proto == ETH_P_8021Q || proto == ETH_P_8021AD){
+        __be16 tag[2]; //TCI, then the EtherType
+        if (bpf_probe_read_kernel(&tag, sizeof(tag), p)) return;
+        p += sizeof(tag);
+        proto = bpf_ntohs(tag[1]);
+    }
+    const unsigned char *l4;
+    if (!read_ip_tuple(p, proto, inner, &l4)) inner->family = 0;
+}
+
+//On hosts doing NAT the dropped packet may carry either tuple, its conntrack entry has both
+//struct nf_conn lives in the nf_conntrack module's BTF unless it's built in, and CO-RE only
+//relocates these programs against vmlinux, so userspace reads the offsets (see conntrack.go)
+//0 = conntrack isn't there, drops go without their NAT tuples
+const volatile u32 ct_orig_off = 0;   //nf_conn.tuplehash[IP_CT_DIR_ORIGINAL].tuple
+const volatile u32 ct_reply_off = 0;  //nf_conn.tuplehash[IP_CT_DIR_REPLY].tuple
+const volatile u32 ct_status_off = 0; //nf_conn.status
+
+#define NFCT_INFOMASK  7 //skb->_nfct is the nf_conn with enum ip_conntrack_info in the low bits
+#define IP_CT_IS_REPLY 3
+#define IPS_SRC_NAT    0x10
+#define IPS_DST_NAT    0x20
+
+//struct nf_conntrack_tuple, whose layout hasn't changed since 2.6
+struct ct_tuple{
+    u8 saddr[16]; //union nf_inet_addr, IPv4 in the first 4 bytes
+    __be16 sport; //union nf_conntrack_man_proto, the port for TCP and UDP
+    u16 l3num;    //AF_INET or AF_INET6
+    u8 daddr[16];
+    __be16 dport;
+    u8 protonum;
+    u8 dir;
+};
+
+//A translated connection: the tuple the client sent and the one NAT turned it into
+struct nat_tuples{
+    struct tuple orig;
+    struct tuple translated;
+    u32 flags; //NAT_*
+};
+
+static __always_inline void ct_to_tuple(struct ct_tuple *ct, struct tuple *t){
+    t->family = ct->l3num;
+    t->protocol = ct->protonum;
+    set_addr(t->saddr, ct->l3num, ct->saddr, ct->saddr);
+    set_addr(t->daddr, ct->l3num, ct->daddr, ct->daddr);
+    if (ct->protonum == IPPROTO_TCP || ct->protonum == IPPROTO_UDP){
+        t->sport = bpf_ntohs(ct->sport);
+        t->dport = bpf_ntohs(ct->dport);
+    }
+}
+
+//Reads the NAT tuples of the skb's connection, false when it has none or wasn't translated
+//The reply tuple is the server answering the translated address, so its ends are swapped
+static __always_inline bool read_skb_nat(struct sk_buff *skb, struct nat_tuples *nat){
+    if (!ct_orig_off || !bpf_core_field_exists(skb->_nfct)) return false;
+    unsigned long nfct = BPF_CORE_READ(skb, _nfct);
+    void *ct = (void *)(nfct & ~(unsigned long)NFCT_INFOMASK);
+    if (!ct) return false; //Untracked, or conntrack never saw it
+
+    unsigned long status;
+    if (bpf_probe_read_kernel(&status, sizeof(status), ct + ct_status_off)) return false;
+    if (!(status & (IPS_SRC_NAT | IPS_DST_NAT))) return false;
+
+    struct ct_tuple orig, reply;
+    if (bpf_probe_read_kernel(&orig, sizeof(orig), ct + ct_orig_off)) return false;
+    if (bpf_probe_read_kernel(&reply, sizeof(reply), ct + ct_reply_off)) return false;
+    ct_to_tuple(&orig, &nat->orig);
+    struct tuple r = {};
+    ct_to_tuple(&reply, &r);
+    nat->translated = r;
+    __builtin_memcpy(nat->translated.saddr, r.daddr, sizeof(r.daddr));
+    __builtin_memcpy(nat->translated.daddr, r.saddr, sizeof(r.saddr));
+    nat->translated.sport = r.dport;
+    nat->translated.dport = r.sport;
+
+    nat->flags = 0;
+    if (status & IPS_SRC_NAT) nat->flags |= NAT_SRC;
+    if (status & IPS_DST_NAT) nat->flags |= NAT_DST;
+    if ((nfct & NFCT_INFOMASK) >= IP_CT_IS_REPLY) nat->flags |= NAT_REPLY;
+    return true;
+}
+
+//Bit (1 << EVENT_*) set for each event type the command wants, set by the loader
+//The connection table is maintained either way, so e.g. retransmits keep their owner
+const volatile u32 event_mask = 0xffffffff;
+
+//--proto: PROTO_* bits of the protocols whose drops are reported, both without it
+//Drops of other protocols (ICMP, ...) and drops without a tuple are always reported
+#define PROTO_TCP 1
+#define PROTO_UDP 2
+const volatile u32 protocols = PROTO_TCP | PROTO_UDP;
+
+static __always_inline bool wanted_protocol(u32 protocol){
+    if (protocol == IPPROTO_TCP) return protocols & PROTO_TCP;
+    if (protocol == IPPROTO_UDP) return protocols & PROTO_UDP;
+    return true;
+}
+
+//Thresholds that can change while the programs run: set from the flags by the loader,
+//and later by `monitor set` (see tunables.go). Unlike the const volatile knobs the
+//verifier can't prune on them, so each use is a map lookup.
+struct tunables {
+    u64 slow_connect_ns; //--slow-connect: handshakes slower than this are EVENT_CONNECT, 0 = off
+    u64 min_bytes;       //--min-bytes: EVENT_CLOSE only for connections that moved this much, 0 = all
+    u32 sample_rate;     //--sample: only every Nth event of each type is emitted, 0 or 1 = all of them
+    u32 conn_limit;      //--conn-limit: drops and retransmits sent per tuple and second, 0 = no limit
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, struct tunables);
+} tunables SEC(".maps");
+
+//Never null in practice, an array's entries always exist
+static __always_inline struct tunables *get_tunables(void){
+    u32 zero = 0;
+    return bpf_map_lookup_elem(&tunables, &zero);
+}
+
+//Events of each type that passed the filters while sampling, emitted or not
+//Per-CPU, so the sampling is 1/N on each CPU rather than exactly 1/N overall
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, EVENT_TLS + 1); //Not EVENT_SYN_FLOOD, already one per prefix and second
+    __type(key, u32); //EVENT_*
+    __type(value, u64);
+} sample_counts SEC(".maps");
+
+static __always_inline bool sampled(u32 type){
+    struct tunables *t = get_tunables();
+    if (!t) return true;
+    u32 rate = t->sample_rate;
+    if (rate <= 1) return true;
+    u64 *n = bpf_map_lookup_elem(&sample_counts, &type);
+    if (!n) return true;
+    return (*n)++ % rate == 0; //The first one goes through
+}
+
+//--conn-limit: the first conn_limit events of a tuple in each second go through, the rest
+//are only counted
+
+#define CONN_LIMIT_WINDOW_NS 1000000000ULL
+
+struct rate_key{
+    u8 saddr[16];
+    u8 daddr[16];
+    u16 sport;
+    u16 dport;
+    u32 type;
+    u32 netns;
+};
+
+struct rate_state{
+    u64 window_start_ns;
+    u32 count;      //Events in the current window, sent or not
+    u32 suppressed; //Not sent since the last event that was, handed to the next one
+};
+
+//LRU, so a flood of distinct tuples evicts idle ones instead of failing updates
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 16384);
+    __type(key, struct rate_key);
+    __type(value, struct rate_state);
+} conn_rates SEC(".maps");
+
+//Every event --conn-limit held back, summed over CPUs by the Go side
+//Unlike the per-event counts this survives LRU evictions
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, u64);
+} suppressed_events SEC(".maps");
+
+//Returns true when the event should be left out, otherwise sets *suppressed to
+//how many were left out before it
+//Entries are shared between CPUs, so two CPUs starting a new window at the same time may
+//both hand out the suppressed count or let one event too many through; suppressed_events is exact
+static __always_inline bool conn_limited(u32 type, u32 netns, const u8 *saddr, const u8 *daddr, u16 sport, u16 dport, u32 *suppressed){
+    *suppressed = 0;
+    if (!(event_mask & (1 << type))) return false;
+    struct tunables *t = get_tunables();
+    if (!t) return false;
+    u32 limit = t->conn_limit;
+    if (!limit) return false;
+
+    struct rate_key k = {};
+    __builtin_memcpy(k.saddr, saddr, sizeof(k.saddr));
+    __builtin_memcpy(k.daddr, daddr, sizeof(k.daddr));
+    k.sport = sport;
+    k.dport = dport;
+    k.type = type;
+    k.netns = netns;
+
+    u64 now = bpf_ktime_get_ns();
+    struct rate_state *s = bpf_map_lookup_elem(&conn_rates, &k);
+    if (!s){
+        struct rate_state init = {.window_start_ns = now, .count = 1};
+        bpf_map_update_elem(&conn_rates, &k, &init, BPF_NOEXIST);
+        return false;
+    }
+    if (now - s->window_start_ns >= CONN_LIMIT_WINDOW_NS){
+        s->window_start_ns = now;
+        s->count = 1;
+        *suppressed = s->suppressed;
+        s->suppressed = 0;
+        return false;
+    }
+    if (__sync_fetch_and_add(&s->count, 1) < limit){
+        *suppressed = s->suppressed;
+        s->suppressed = 0;
+        return false;
+    }
+    __sync_fetch_and_add(&s->suppressed, 1);
+    u32 zero = 0;
+    u64 *total = bpf_map_lookup_elem(&suppressed_events, &zero);
+    if (total) (*total)++; //Per-CPU, no atomics needed
+    return true;
+}
+
+//--aggregate: drops and retransmits only bump these counters instead of sending events,
+//userspace reads and clears them every --interval (see aggregate.go)
+const volatile u8 aggregate = 0;
+
+struct drop_count_key{
+    u32 reason;
+    u32 pad; //Zeroed, so the key has no holes with garbage in them
+    u64 location;
+};
+
+//Retransmits by owner and connection, same shape as struct top_key
+struct retransmit_count_key{
+    u32 pid;
+    u32 family;
+    u8 saddr[16];
+    u8 daddr[16];
+    u16 sport;
+    u16 dport;
+    u32 netns;
+};
+
+struct retransmit_count{
+    u64 count;
+    char comm[TASK_COMM_LEN];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 4096);
+    __type(key, struct drop_count_key);
+    __type(value, u64);
+} drop_counts SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 16384);
+    __type(key, struct retransmit_count_key);
+    __type(value, struct retransmit_count);
+} retransmit_counts SEC(".maps");
+
+//Counts that didn't fit because a table was full, until the next interval clears it
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, u64);
+} aggregate_overflow SEC(".maps");
+
+static __always_inline void count_overflow(void){
+    u32 zero = 0;
+    u64 *n = bpf_map_lookup_elem(&aggregate_overflow, &zero);
+    if (n) (*n)++;
+}
+
+static __always_inline void count_drop(u32 reason, u64 location){
+    struct drop_count_key k = {.reason = reason, .location = location};
+    u64 *n = bpf_map_lookup_elem(&drop_counts, &k);
+    if (!n){
+        u64 one = 1;
+        //Another CPU may have added it in between, then count again
+        if (!bpf_map_update_elem(&drop_counts, &k, &one, BPF_NOEXIST)) return;
+        n = bpf_map_lookup_elem(&drop_counts, &k);
+        if (!n){
+            count_overflow();
+            return;
+        }
+    }
+    __sync_fetch_and_add(n, 1);
+}
+
+static __always_inline void count_retransmit(struct retransmit_count_key *k, const char *comm){
+    struct retransmit_count *v = bpf_map_lookup_elem(&retransmit_counts, k);
+    if (!v){
+        struct retransmit_count init = {.count = 1};
+        __builtin_memcpy(init.comm, comm, sizeof(init.comm));
+        if (!bpf_map_update_elem(&retransmit_counts, k, &init, BPF_NOEXIST)) return;
+        v = bpf_map_lookup_elem(&retransmit_counts, k);
+        if (!v){
+            count_overflow();
+            return;
+        }
+    }
+    __sync_fetch_and_add(&v->count, 1);
+}
+
+//--cgroup-metrics: drops, retransmits and bytes per cgroup v2 id, counted after the filters
+//and before sampling and --aggregate, so they're exact. Userspace sums the CPUs at every
+//scrape (see cgroupstats.go), nothing is sent per event.
+const volatile u8 count_cgroups = 0;
+
+struct cgroup_stats{
+    u64 drops;
+    u64 retransmits;
+    u64 bytes_sent;
+    u64 bytes_received;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+    __uint(max_entries, 1); //Sized from userspace with --cgroup-metrics, a copy per CPU is preallocated
+    __type(key, u64);
+    __type(value, struct cgroup_stats);
+} cgroup_stats SEC(".maps");
+
+//Per-CPU, so the counters are bumped without atomics
+static __always_inline struct cgroup_stats *cgroup_stats_of(u64 id){
+    struct cgroup_stats *s = bpf_map_lookup_elem(&cgroup_stats, &id);
+    if (s) return s;
+    struct cgroup_stats zero = {};
+    bpf_map_update_elem(&cgroup_stats, &id, &zero, BPF_NOEXIST);
+    return bpf_map_lookup_elem(&cgroup_stats, &id);
+}
+
+//sock_cgrp's id, 0 if there's none
+static __always_inline u64 sock_cgroup(struct sock *sk){
+    struct cgroup *cg = sock_cgrp(sk);
+    if (!cg) return 0;
+    return BPF_CORE_READ(cg, kn, id);
+}
+
+static __always_inline void count_lost(void){
+    u32 zero = 0;
+    u64 *lost = bpf_map_lookup_elem(&lost_events, &zero);
+    if (lost) (*lost)++; //Per-CPU, no atomics needed
+}
+
+//Ringbuf memory isn't zeroed, so without this every program would have to clear the fields it doesn't use
+static __always_inline void init_event(struct event *e, u32 type){
+    __builtin_memset(e, 0, sizeof(*e));
     e->pid = bpf_get_current_pid_tgid() >> 32;
-    e->reason = ctx->reason;
-    e->location = (u64)ctx->location;
-    bpf_ringbuf_submit(e, 0);
+    e->type = type;
+    bpf_get_current_comm(&e->comm, sizeof(e->comm));
+    e->cgroup_id = bpf_get_current_cgroup_id();
+}
+
+//Reserves size bytes in the ring buffer (or the per-CPU scratch slot in the perf build) for
+//an event of type without filling them in. size is a constant at every call, as the
+//verifier wants it
+static __always_inline void *reserve_slot(u32 type, u32 size){
+    if (!(event_mask & (1 << type))) return 0;
+    if (!sampled(type)) return 0;
+#ifndef USE_PERF_BUF
+    void *e = bpf_ringbuf_reserve(&events, size, 0);
+    if (!e){
+        count_lost();
+        return 0;
+    }
+#else
+    u32 zero = 0;
+    void *e = bpf_map_lookup_elem(&event_scratch, &zero);
+#endif
+    return e;
+}
+
+//Reserves a zeroed event
+static __always_inline struct event *reserve_event(u32 type){
+    struct event *e = reserve_slot(type, sizeof(*e));
+    if (!e) return 0;
+    init_event(e, type);
+    return e;
+}
+
+//Same for tc and XDP programs, which have no task: pid, comm and cgroup_id stay 0
+static __always_inline struct event *reserve_packet_event(u32 type){
+    struct event *e = reserve_slot(type, sizeof(*e));
+    if (!e) return 0;
+    __builtin_memset(e, 0, sizeof(*e));
+    e->type = type;
+    return e;
+}
+
+//Like reserve_event, for a drop and its tail
+static __always_inline struct drop_event *reserve_drop(void){
+    struct drop_event *de = reserve_slot(EVENT_DROP, sizeof(*de));
+    if (!de) return 0;
+    init_event(&de->e, EVENT_DROP);
+    __builtin_memset(&de->d, 0, sizeof(de->d));
+    return de;
+}
+
+//Same with room for the packet, see drop_capture
+static __always_inline struct drop_capture *reserve_capture(void){
+    struct drop_capture *c = reserve_slot(EVENT_DROP, sizeof(*c));
+    if (!c) return 0;
+    init_event(&c->e, EVENT_DROP);
+    __builtin_memset(&c->d, 0, sizeof(c->d));
+    c->cap_len = 0;
+    c->orig_len = 0;
+    return c;
+}
+
+//Like reserve_event, for a socket option call and its tail
+static __always_inline struct sockopt_event *reserve_sockopt(void){
+    struct sockopt_event *so = reserve_slot(EVENT_SOCKOPT, sizeof(*so));
+    if (!so) return 0;
+    init_event(&so->e, EVENT_SOCKOPT);
+    __builtin_memset(&so->s, 0, sizeof(so->s));
+    return so;
+}
+
+//Attributes an event to the connection owner instead of the current task
+static __always_inline void set_owner(struct event *e, struct conn_info *conn){
+    e->pid = conn->pid;
+    e->pid_start = conn->pid_start;
+    __builtin_memcpy(e->comm, conn->comm, sizeof(e->comm));
+    e->cgroup_id = conn->cgroup_id;
+}
+
+//The socket cookie SO_COOKIE returns. The kernel only picks one once something asks for it,
+//until then it's 0, and kprobes can't call bpf_get_socket_cookie to make it do so.
+static __always_inline u64 sock_cookie(struct sock *sk){
+    if (!sk) return 0;
+    return BPF_CORE_READ(sk, __sk_common.skc_cookie.counter);
+}
+
+//Network namespace inode of a socket, ns.inum as userspace sees it in /proc/<pid>/ns/net
+static __always_inline u32 sock_netns(struct sock *sk){
+    return BPF_CORE_READ(sk, __sk_common.skc_net.net, ns.inum);
+}
+
+//MPTCP (5.6+) runs each path as a plain TCP socket, a subflow, under one mptcp_sock the
+//application holds. The kernel's own types only exist with CONFIG_MPTCP, hence the flavors:
+//on kernels without it bpf_core_field_exists is false and the reads below are never reached.
+struct tcp_sock___mptcp{
+    bool is_mptcp;
+} __attribute__((preserve_access_index));
+
+struct mptcp_subflow_context___tcpmon{
+    u32 subflow_id; //6.6+
+    struct sock *conn; //The mptcp_sock
+} __attribute__((preserve_access_index));
+
+struct mptcp_sock___tcpmon{
+    u32 token; //Identifies the connection to both ends, the same on every subflow
+} __attribute__((preserve_access_index));
+
+//Tags an event with the MPTCP connection and subflow of its socket, if it is one
+//Only full TCP sockets have the fields, not request or timewait socks, nor UDP ones from drops
+static __always_inline void set_mptcp(struct event *e, struct sock *sk){
+    struct tcp_sock___mptcp *tp = (void *)sk;
+    if (!sk || !bpf_core_field_exists(tp->is_mptcp)) return;
+    if (BPF_CORE_READ_BITFIELD_PROBED(sk, sk_protocol) != IPPROTO_TCP) return; //A bitfield before 5.6
+    u8 state = BPF_CORE_READ(sk, __sk_common.skc_state);
+    if (state == TCP_TIME_WAIT || state == TCP_NEW_SYN_RECV) return;
+    if (!BPF_CORE_READ_BITFIELD_PROBED(tp, is_mptcp)) return;
+
+    struct mptcp_subflow_context___tcpmon *subflow = BPF_CORE_READ((struct inet_connection_sock *)sk, icsk_ulp_data);
+    if (!subflow) return;
+    struct mptcp_sock___tcpmon *msk = (void *)BPF_CORE_READ(subflow, conn);
+    if (!msk) return;
+    e->mptcp_token = BPF_CORE_READ(msk, token);
+    if (bpf_core_field_exists(subflow->subflow_id)) e->mptcp_subflow = BPF_CORE_READ_BITFIELD_PROBED(subflow, subflow_id);
+}
+
+//A dropped packet may have no socket (forwarded) or no device (not routed yet)
+//skb->dev shares a union with dev_scratch, so the socket is tried first
+static __always_inline u32 skb_netns(struct sk_buff *skb){
+    struct sock *sk = BPF_CORE_READ(skb, sk);
+    if (sk) return sock_netns(sk);
+    struct net_device *dev = BPF_CORE_READ(skb, dev);
+    if (dev) return BPF_CORE_READ(dev, nd_net.net, ns.inum);
     return 0;
 }
-char LICENSE[] SEC("license") = "GPL";
 
+//A packet's VLAN tag is in vlan_tci until the VLAN device takes it off, or from when one puts
+//it on until the driver writes it into the frame. Before 6.1 a bit said whether there was one,
+//since then it's any vlan_proto
+#define VLAN_TAGGED 0x10000
+#define VLAN_VID_MASK 0x0fff
+
+struct sk_buff___vlan_present{
+    u8 vlan_present:1;
+} __attribute__((preserve_access_index));
+
+//Where a dropped packet was, for links.go to name: its device, the one it came in on, its tag
+//skb->dev shares a union with dev_scratch, which UDP uses once the packet is queued to a socket
+static __always_inline void set_skb_link(struct event *e, struct sk_buff *skb){
+    struct sock *sk = BPF_CORE_READ(skb, sk);
+    if (!sk || BPF_CORE_READ_BITFIELD_PROBED(sk, sk_protocol) != IPPROTO_UDP) e->ifindex = BPF_CORE_READ(skb, dev, ifindex);
+    e->iif = BPF_CORE_READ(skb, skb_iif);
+    struct sk_buff___vlan_present *old = (void *)skb;
+    bool tagged;
+    if (bpf_core_field_exists(old->vlan_present)) tagged = BPF_CORE_READ_BITFIELD_PROBED(old, vlan_present);
+    else tagged = BPF_CORE_READ(skb, vlan_proto) != 0;
+    if (tagged) e->vlan = VLAN_TAGGED | (BPF_CORE_READ(skb, vlan_tci) & VLAN_VID_MASK);
+}
+
+//The interface a connection learnt incoming segments from, in inet_sock until it moved to sock in 5.16
+struct sock___rx_dst{
+    int sk_rx_dst_ifindex;
+} __attribute__((preserve_access_index));
+
+struct inet_sock___rx_dst{
+    int rx_dst_ifindex;
+} __attribute__((preserve_access_index));
+
+//Where a retransmitting connection's segments go out (its cached route's device) and come in
+//Outgoing is the bond or VLAN device the route points at, not the member the frame leaves by
+static __always_inline void set_sock_link(struct event *e, struct sock *sk){
+    e->ifindex = BPF_CORE_READ(sk, sk_dst_cache, dev, ifindex);
+    struct sock___rx_dst *s = (void *)sk;
+    if (bpf_core_field_exists(s->sk_rx_dst_ifindex)) e->iif = BPF_CORE_READ(s, sk_rx_dst_ifindex);
+    else e->iif = BPF_CORE_READ((struct inet_sock___rx_dst *)sk, rx_dst_ifindex);
+}
+
+//Makes a reserved event visible to userspace
+//Only one event is ever in flight per program, so reusing the scratch slot is safe
+#ifndef USE_PERF_BUF
+#define submit_event(ctx, e) bpf_ringbuf_submit(e, 0)
+#else
+#define submit_event(ctx, e) bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, e, sizeof(*e))
+#endif
+
+//Reasons that don't mean a drop, set from the kernel's BTF before load (see dropreasons.go)
+//enum skb_drop_reason is renumbered between kernel versions, -1 means the kernel has no such value
+const volatile s32 reason_not_dropped = 0; //SKB_NOT_DROPPED_YET
+const volatile s32 reason_consumed = 1;    //SKB_CONSUMED
+
+//Bytes of each dropped packet to send along for --pcap, 0 = off, at most PCAP_MAX_SNAPLEN
+const volatile u32 pcap_snaplen = 0;
+
+//Kernel stacks of drops for --stacks, deduplicated by the kernel, see stacks.go
+//Without BPF_F_REUSE_STACKID an id never changes its stack once userspace has seen it,
+//a new stack whose bucket is taken goes without
+#define STACK_DEPTH 64
+struct {
+    __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+    __uint(max_entries, 1); //Sized from userspace with --stacks, the stacks are preallocated
+    __uint(key_size, sizeof(u32));
+    __uint(value_size, STACK_DEPTH * sizeof(u64));
+} drop_stacks SEC(".maps");
+
+const volatile u8 capture_stacks = 0;
+
+//User stacks of the tasks calling connect() for --user-stacks, sent with the events
+//of connections that fail, see userstacks.go. Walked by frame pointers.
+struct {
+    __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+    __uint(max_entries, 1); //Sized from userspace with --user-stacks
+    __uint(key_size, sizeof(u32));
+    __uint(value_size, STACK_DEPTH * sizeof(u64));
+} user_stacks SEC(".maps");
+
+const volatile u8 capture_user_stacks = 0;
+
+//What /proc says about connection owners for --process-info, read when they connect
+//or accept, so events that come after a short-lived owner exited still name it (see
+//process.go). Keyed by the events' pid and pid_start, which are the owner's (set_owner),
+//so a process that got a dead owner's PID has an entry of its own
+#define OWNER_CMDLINE_LEN 256
+struct proc_owner_key{
+    u32 tgid;
+    u32 start; //task_start
+};
+
+struct proc_owner{
+    u32 uid;         //Effective, like ps shows
+    u32 cmdline_len;
+    char cmdline[OWNER_CMDLINE_LEN]; //NUL separated arguments, like /proc/<pid>/cmdline
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //Owners long gone make room for new ones
+    __uint(max_entries, 1); //Sized from userspace with --process-info
+    __type(key, struct proc_owner_key);
+    __type(value, struct proc_owner);
+} proc_owners SEC(".maps");
+
+//Too big for the stack next to the event, built here first
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, struct proc_owner);
+} owner_scratch SEC(".maps");
+
+const volatile u8 capture_owners = 0;
+
+//Before 5.5 start_boottime was called real_start_time
+struct task_struct___real_start{
+    u64 real_start_time;
+} __attribute__((preserve_access_index));
+
+//A process's start time as /proc/<pid>/stat has it, in USER_HZ (100 a second on every
+//architecture we build for) since boot, cut to 32 bits. A PID and this name one process
+static __always_inline u32 task_start(struct task_struct *task){
+    struct task_struct *leader = BPF_CORE_READ(task, group_leader);
+    u64 ns;
+    if (bpf_core_field_exists(leader->start_boottime)) ns = BPF_CORE_READ(leader, start_boottime);
+    else ns = BPF_CORE_READ((struct task_struct___real_start *)leader, real_start_time);
+    return ns / 10000000;
+}
+
+//Has to run in the owner's context, reading its memory, so not from softirq or sock_ops
+//Returns the owner's task_start for its connection's pid_start, 0 without --process-info
+static __always_inline u32 record_owner(void){
+    if (!capture_owners) return 0;
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    struct proc_owner_key key = {.tgid = bpf_get_current_pid_tgid() >> 32, .start = task_start(task)};
+    if (bpf_map_lookup_elem(&proc_owners, &key)) return key.start; //Read at its first connection already
+
+    u32 zero = 0;
+    struct proc_owner *o = bpf_map_lookup_elem(&owner_scratch, &zero);
+    if (!o) return key.start;
+    o->uid = BPF_CORE_READ(task, cred, euid.val);
+    o->cmdline_len = 0;
+    unsigned long arg_start = BPF_CORE_READ(task, mm, arg_start); //0 for kernel threads, which have no mm
+    unsigned long arg_end = BPF_CORE_READ(task, mm, arg_end);
+    u32 len = arg_end - arg_start;
+    if (len > OWNER_CMDLINE_LEN) len = OWNER_CMDLINE_LEN; //Keeps the verifier happy too
+    if (arg_start && len && !bpf_probe_read_user(o->cmdline, len, (void *)arg_start)) o->cmdline_len = len;
+    bpf_map_update_elem(&proc_owners, &key, o, BPF_ANY);
+    return key.start;
+}
+
+//skb->tail and skb->end (sk_buff_data_t) are offsets from head on 64-bit kernels
+//(NET_SKBUFF_DATA_USES_OFFSET) and pointers on 32-bit ones. vmlinux.h has them as
+//offsets, so on bpf2go's 32-bit arm target what's read is the pointer's value,
+//made an offset here. arch.go refuses that build on a 64-bit kernel
+static __always_inline u32 skb_data_offset(unsigned char *head, u32 value){
+#ifdef __TARGET_ARCH_arm
+    return value - (u32)(unsigned long)head;
+#else
+    return value;
+#endif
+}
+
+//Copies the dropped packet from its IP header on, linear data only
+static __always_inline void capture_packet(struct sk_buff *skb, struct drop_capture *c){
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    unsigned char *data = BPF_CORE_READ(skb, data);
+    u16 network_header = BPF_CORE_READ(skb, network_header);
+    u32 tail = skb_data_offset(head, BPF_CORE_READ(skb, tail));
+    u32 len = BPF_CORE_READ(skb, len);
+
+    if (network_header == (u16)~0U) return; //Never set, no IP header to start from
+    //skb->len counts from skb->data, which may sit before or after the IP header
+    u32 data_off = data - head;
+    if (len + data_off <= network_header || tail <= network_header) return;
+    c->orig_len = len + data_off - network_header;
+
+    u32 n = tail - network_header;
+    if (n > c->orig_len) n = c->orig_len;
+    if (n > pcap_snaplen) n = pcap_snaplen;
+    if (n > PCAP_MAX_SNAPLEN) n = PCAP_MAX_SNAPLEN; //Keeps the verifier happy
+    if (bpf_probe_read_kernel(c->data, n, head + network_header)) return;
+    c->cap_len = n;
+}
+
+//Everything a drop probe does once it has the skb, shared by the tracepoint and kprobe versions
+//protocol is skb->protocol in host byte order, location the caller that freed the skb
+static __always_inline int handle_drop(void *ctx, struct sk_buff *skb, u16 protocol, u32 reason, u64 location){
+    if ((s32)reason == reason_not_dropped || (s32)reason == reason_consumed) return 0;
+    struct sock *sk = BPF_CORE_READ(skb, sk);
+    u64 key = (u64)sk;
+    struct conn_info *conn = sk ? bpf_map_lookup_elem(&conns, &key) : 0;
+    if (!allowed_sock(sk, conn)) return 0;
+
+    struct tuple t = {};
+    const unsigned char *l4 = 0;
+    bool has_tuple = read_skb_tuple(skb, protocol, &t, &l4);
+    //--proto is about the connection, a tunnel's packet is checked again once its inner protocol is known
+    u32 tunnel = has_tuple ? tunnel_of(&t) : 0;
+    if (has_tuple && !tunnel && !wanted_protocol(t.protocol)) return 0;
+    //With a port/CIDR filter set, drops we can't place on a connection are skipped
+    if ((filter_by_port || filter_by_cidr) && !has_tuple) return 0;
+    struct tuple inner = {};
+    u32 vni = 0;
+    if (tunnel){
+        read_tunnel(l4, tunnel, &vni, &inner);
+        if (!wanted_protocol(inner.family ? inner.protocol : t.protocol)) return 0;
+    }
+    struct nat_tuples nat = {};
+    bool translated = has_tuple && read_skb_nat(skb, &nat);
+    //A filter on the client's address or the Service's port matches before and after NAT,
+    //and on a pod's, inside a tunnel or outside it
+    if (!allowed_tuple(t.saddr, t.daddr, t.sport, t.dport) &&
+        !(translated && (allowed_tuple(nat.orig.saddr, nat.orig.daddr, nat.orig.sport, nat.orig.dport) ||
+                         allowed_tuple(nat.translated.saddr, nat.translated.daddr, nat.translated.sport, nat.translated.dport))) &&
+        !(inner.family && allowed_tuple(inner.saddr, inner.daddr, inner.sport, inner.dport))) return 0;
+    if (count_cgroups){
+        //Forwarded packets and ones dropped before a socket was looked up go to cgroup 0
+        struct cgroup_stats *s = cgroup_stats_of(sock_cgroup(sk));
+        if (s) s->drops++;
+    }
+    if (aggregate){
+        if (event_mask & (1 << EVENT_DROP)) count_drop(reason, location);
+        return 0;
+    }
+    //Drops without a tuple share one all-zero key per namespace
+    u32 netns = skb_netns(skb);
+    u32 suppressed;
+    if (conn_limited(EVENT_DROP, netns, t.saddr, t.daddr, t.sport, t.dport, &suppressed)) return 0;
+
+    struct drop_capture *c = 0;
+    struct drop_event *de = 0;
+    struct event *e;
+    struct drop_info *d;
+    if (pcap_snaplen){
+        c = reserve_capture();
+        if (!c) return 0;
+        capture_packet(skb, c);
+        e = &c->e;
+        d = &c->d;
+    } else {
+        de = reserve_drop();
+        if (!de) return 0;
+        e = &de->e;
+        d = &de->d;
+    }
+    if (capture_stacks){
+        //From the tracepoint that's kfree_skb_reason or sk_skb_reason_drop, then its caller
+        long id = bpf_get_stackid(ctx, &drop_stacks, 0);
+        if (id >= 0) e->stack_id = id + 1;
+    }
+    e->reason = reason;
+    e->location = location;
+    e->family = t.family;
+    __builtin_memcpy(e->saddr, t.saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, t.daddr, sizeof(e->daddr));
+    e->sport = t.sport;
+    e->dport = t.dport;
+    e->protocol = t.protocol;
+    e->suppressed = suppressed;
+    e->netns = netns;
+    e->mark = BPF_CORE_READ(skb, mark);
+    e->sock_cookie = sock_cookie(sk);
+    set_mptcp(e, sk);
+    set_skb_link(e, skb);
+    if (conn) set_owner(e, conn);
+    if (tunnel){
+        d->tunnel = tunnel;
+        d->vni = vni;
+        d->inner_family = inner.family;
+        d->inner_protocol = inner.protocol;
+        __builtin_memcpy(d->inner_saddr, inner.saddr, sizeof(d->inner_saddr));
+        __builtin_memcpy(d->inner_daddr, inner.daddr, sizeof(d->inner_daddr));
+        d->inner_sport = inner.sport;
+        d->inner_dport = inner.dport;
+    }
+    if (translated){
+        __builtin_memcpy(d->ct_saddr, nat.orig.saddr, sizeof(d->ct_saddr));
+        __builtin_memcpy(d->ct_daddr, nat.orig.daddr, sizeof(d->ct_daddr));
+        __builtin_memcpy(d->nat_saddr, nat.translated.saddr, sizeof(d->nat_saddr));
+        __builtin_memcpy(d->nat_daddr, nat.translated.daddr, sizeof(d->nat_daddr));
+        d->ct_sport = nat.orig.sport;
+        d->ct_dport = nat.orig.dport;
+        d->nat_sport = nat.translated.sport;
+        d->nat_dport = nat.translated.dport;
+        d->nat_flags = nat.flags;
+    }
+    if (c) submit_event(ctx, c); //The macro sizes the sample from the pointer type
+    else submit_event(ctx, de);
+    return 0;
+}
+
+SEC("tracepoint/skb/kfree_skb") //hook
+int trace_tcp_drop(struct trace_event_raw_kfree_skb *ctx){
+    //Kernels before 5.17 don't pass a reason, so every drop is reported as 0 (NOT_SPECIFIED)
+    u32 reason = 0;
+    if (bpf_core_field_exists(ctx->reason)) reason = ctx->reason;
+    return handle_drop(ctx, (struct sk_buff *)ctx->skbaddr, ctx->protocol, reason, (u64)ctx->location);
+}
+
+//Kprobe fallbacks for when the tracepoint can't be attached (e.g. no tracefs), see probes.go
+//The tracepoint's location is the caller's return address, which is what a kprobe at entry sees too
+//Which function exists depends on the kernel: sk_skb_reason_drop since 6.11, kfree_skb_reason
+//since 5.17, and before that kfree_skb itself
+SEC("kprobe/sk_skb_reason_drop")
+int BPF_KPROBE(kprobe_sk_skb_reason_drop, struct sock *sk, struct sk_buff *skb, u32 reason){
+    u64 ip;
+    BPF_KPROBE_READ_RET_IP(ip, ctx);
+    return handle_drop(ctx, skb, bpf_ntohs(BPF_CORE_READ(skb, protocol)), reason, ip);
+}
+
+SEC("kprobe/kfree_skb_reason")
+int BPF_KPROBE(kprobe_kfree_skb_reason, struct sk_buff *skb, u32 reason){
+    u64 ip;
+    BPF_KPROBE_READ_RET_IP(ip, ctx);
+    return handle_drop(ctx, skb, bpf_ntohs(BPF_CORE_READ(skb, protocol)), reason, ip);
+}
+
+SEC("kprobe/kfree_skb")
+int BPF_KPROBE(kprobe_kfree_skb, struct sk_buff *skb){
+    u64 ip;
+    BPF_KPROBE_READ_RET_IP(ip, ctx);
+    return handle_drop(ctx, skb, bpf_ntohs(BPF_CORE_READ(skb, protocol)), 0, ip);
+}
+
+//What the retransmit and state probes need, from the tracepoint or, in the kprobe
+//fallbacks, read from the socket
+struct sock_event{
+    u64 skaddr;
+    u32 family;
+    u32 state;     //The new state for state changes
+    u32 old_state; //State changes only
+    u8 saddr[16];
+    u8 daddr[16];
+    u16 sport;
+    u16 dport;
+};
+
+//Fills a sock_event from the socket itself, for kprobes
+static __always_inline bool read_sock_event(struct sock *sk, struct sock_event *se){
+    se->skaddr = (u64)sk;
+    se->state = BPF_CORE_READ(sk, __sk_common.skc_state);
+    return read_sock_addrs(sk, &se->family, se->saddr, se->daddr, &se->sport, &se->dport);
+}
+
+static __always_inline int handle_retransmit(void *ctx, struct sock_event *se){
+    u64 key = se->skaddr;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (conn) __sync_fetch_and_add(&conn->retransmits, 1);
+    if (!allowed_conn(conn)) return 0;
+    if (!allowed_tuple(se->saddr, se->daddr, se->sport, se->dport)) return 0;
+    u32 netns = sock_netns((struct sock *)se->skaddr);
+    if (count_cgroups){
+        u64 id = sock_cgroup((struct sock *)se->skaddr);
+        if (!id && conn) id = conn->cgroup_id; //Before 5.15, the owner's
+        struct cgroup_stats *s = cgroup_stats_of(id);
+        if (s) s->retransmits++;
+    }
+    if (aggregate){
+        if (!(event_mask & (1 << EVENT_RETRANSMIT))) return 0;
+        struct retransmit_count_key k = {.pid = bpf_get_current_pid_tgid() >> 32, .family = se->family, .netns = netns};
+        char comm[TASK_COMM_LEN];
+        if (conn){
+            k.pid = conn->pid;
+            __builtin_memcpy(comm, conn->comm, sizeof(comm));
+        } else {
+            bpf_get_current_comm(&comm, sizeof(comm));
+        }
+        __builtin_memcpy(k.saddr, se->saddr, sizeof(k.saddr));
+        __builtin_memcpy(k.daddr, se->daddr, sizeof(k.daddr));
+        k.sport = se->sport;
+        k.dport = se->dport;
+        count_retransmit(&k, comm);
+        return 0;
+    }
+    u32 suppressed;
+    if (conn_limited(EVENT_RETRANSMIT, netns, se->saddr, se->daddr, se->sport, se->dport, &suppressed)) return 0;
+
+    struct event *e = reserve_event(EVENT_RETRANSMIT);
+    if (!e) return 0;
+    e->suppressed = suppressed;
+    e->netns = netns;
+    e->mark = BPF_CORE_READ((struct sock *)se->skaddr, sk_mark);
+    e->sock_cookie = sock_cookie((struct sock *)se->skaddr);
+    set_mptcp(e, (struct sock *)se->skaddr);
+    set_sock_link(e, (struct sock *)se->skaddr);
+    if (conn) set_owner(e, conn);
+    e->state = se->state;
+    e->family = se->family;
+    __builtin_memcpy(e->saddr, se->saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se->daddr, sizeof(e->daddr));
+    e->sport = se->sport;
+    e->dport = se->dport;
+    submit_event(ctx, e);
+    return 0;
+}
+
+SEC("tracepoint/tcp/tcp_retransmit_skb") //fires every time the kernel resends a segment
+int trace_tcp_retransmit(struct trace_event_raw_tcp_event_sk_skb *ctx){
+    if (ctx->family != AF_INET && ctx->family != AF_INET6) return 0;
+
+    struct sock_event se = {
+        .skaddr = (u64)ctx->skaddr,
+        .family = ctx->family,
+        .state = ctx->state,
+        .sport = ctx->sport,
+        .dport = ctx->dport,
+    };
+    set_addr(se.saddr, ctx->family, ctx->saddr, ctx->saddr_v6);
+    set_addr(se.daddr, ctx->family, ctx->daddr, ctx->daddr_v6);
+    return handle_retransmit(ctx, &se);
+}
+
+//Fallback for kernels without the tracepoint (before 4.15) or without tracefs
+//Fires for every attempt, including ones that fail before a segment goes out
+SEC("kprobe/tcp_retransmit_skb")
+int BPF_KPROBE(kprobe_tcp_retransmit_skb, struct sock *sk){
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    return handle_retransmit(ctx, &se);
+}
+
+//Latency histograms (connect time and RTT) per remote address, from --hist-interval
+//Userspace reads and clears the map every interval (see histograms.go)
+//Slot i counts values in [2^i, 2^(i+1)) microseconds, the last slot also takes everything above,
+//unless --connect-buckets or --rtt-buckets set bounds of their own
+#define HIST_SLOTS   27
+#define HIST_CONNECT 1
+#define HIST_RTT     2
+
+const volatile u8 collect_hist = 0;
+
+//Upper bounds of the slots in microseconds, ascending. Unused ones are U64_MAX, so the slot after
+//the last bound takes everything above it. All zero (the default) means log2 slots.
+const volatile u64 connect_bounds[HIST_SLOTS - 1] = {};
+const volatile u64 rtt_bounds[HIST_SLOTS - 1] = {};
+
+struct hist_key{
+    u8 addr[16]; //Remote address, same form as struct event
+    u32 kind;    //HIST_CONNECT or HIST_RTT
+};
+
+struct hist{
+    u64 slots[HIST_SLOTS];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 4096);
+    __type(key, struct hist_key);
+    __type(value, struct hist);
+} latency_hist SEC(".maps");
+
+//Initial value for new histograms, too big to build on the stack next to the rest
+static struct hist zero_hist;
+
+static __always_inline u32 log2_u32(u32 v){
+    u32 r, shift;
+    r = (v > 0xFFFF) << 4; v >>= r;
+    shift = (v > 0xFF) << 3; v >>= shift; r |= shift;
+    shift = (v > 0xF) << 2; v >>= shift; r |= shift;
+    shift = (v > 0x3) << 1; v >>= shift; r |= shift;
+    r |= (v >> 1);
+    return r;
+}
+
+static __always_inline u32 log2_u64(u64 v){
+    u32 hi = v >> 32;
+    return hi ? log2_u32(hi) + 32 : log2_u32(v);
+}
+
+static __always_inline u32 hist_slot(const volatile u64 *bounds, u64 us){
+    if (!bounds[0]){
+        u32 slot = log2_u64(us);
+        return slot >= HIST_SLOTS ? HIST_SLOTS - 1 : slot;
+    }
+#pragma unroll
+    for (u32 i = 0; i < HIST_SLOTS - 1; i++){
+        if (us < bounds[i]) return i;
+    }
+    return HIST_SLOTS - 1;
+}
+
+static __always_inline void hist_record(const u8 *raddr, u32 kind, u64 us){
+    if (!collect_hist) return;
+
+    struct hist_key key = {.kind = kind};
+    __builtin_memcpy(key.addr, raddr, sizeof(key.addr));
+    struct hist *h = bpf_map_lookup_elem(&latency_hist, &key);
+    if (!h){
+        bpf_map_update_elem(&latency_hist, &key, &zero_hist, BPF_NOEXIST);
+        h = bpf_map_lookup_elem(&latency_hist, &key);
+        if (!h) return; //Table full until the next flush
+    }
+
+    u32 slot = hist_slot(kind == HIST_CONNECT ? connect_bounds : rtt_bounds, us);
+    __sync_fetch_and_add(&h->slots[slot], 1);
+}
+
+static __always_inline void conn_tuple_key(struct sock_event *se, struct conn_tuple *k){
+    __builtin_memcpy(k->saddr, se->saddr, sizeof(k->saddr));
+    __builtin_memcpy(k->daddr, se->daddr, sizeof(k->daddr));
+    k->sport = se->sport;
+    k->dport = se->dport;
+    k->netns = sock_netns((struct sock *)se->skaddr);
+}
+
+//Maintains the connection table and emits EVENT_CLOSE with the totals
+//saddr and daddr are the tracepoint's addresses already run through set_addr
+//user_stack is false from sock_ops, which can't call bpf_get_stackid or read user memory
+static __always_inline void track_lifetime(void *ctx, struct sock_event *se, bool user_stack){
+    struct conn_tuple tk = {};
+    u64 key = se->skaddr;
+
+    //Active open (connect) or passive open (the accepted child socket)
+    if (se->state == TCP_SYN_SENT ||
+        (se->state == TCP_ESTABLISHED && se->old_state == TCP_SYN_RECV)){
+        if (!allowed_current()) return; //Never tracked, so its retransmits and close are filtered too
+        struct conn_info conn = {
+            .start_ns = bpf_ktime_get_ns(),
+            .pid = bpf_get_current_pid_tgid() >> 32,
+            .family = se->family,
+            .sport = se->sport,
+            .dport = se->dport,
+            .cgroup_id = bpf_get_current_cgroup_id(),
+        };
+        bpf_get_current_comm(&conn.comm, sizeof(conn.comm));
+        __builtin_memcpy(conn.saddr, se->saddr, sizeof(conn.saddr));
+        __builtin_memcpy(conn.daddr, se->daddr, sizeof(conn.daddr));
+        //Only connects run in the task opening the connection, accepted children are made in softirq
+        if (se->state == TCP_SYN_SENT && user_stack){
+            if (capture_user_stacks){
+                long id = bpf_get_stackid(ctx, &user_stacks, BPF_F_USER_STACK);
+                if (id >= 0) conn.user_stack = id + 1;
+            }
+            conn.pid_start = record_owner();
+        }
+        bpf_map_update_elem(&conns, &key, &conn, BPF_ANY);
+        if (se->state == TCP_ESTABLISHED){
+            conn_tuple_key(se, &tk);
+            bpf_map_update_elem(&conn_tuples, &tk, &key, BPF_ANY);
+        }
+        return;
+    }
+
+    //connect() moves to SYN_SENT before the source port is picked, so refresh the tuple once established
+    //(the connect kretprobes did already if they're attached)
+    if (se->state == TCP_ESTABLISHED && se->old_state == TCP_SYN_SENT){
+        struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+        if (!conn) return;
+        conn->sport = se->sport;
+        __builtin_memcpy(conn->saddr, se->saddr, sizeof(conn->saddr));
+        conn_tuple_key(se, &tk);
+        bpf_map_update_elem(&conn_tuples, &tk, &key, BPF_ANY);
+
+        //start_ns was taken at SYN_SENT, right before the SYN goes out
+        u64 latency = bpf_ktime_get_ns() - conn->start_ns;
+        conn->connect_ns = latency; //For the TLS handshake that usually follows
+        hist_record(conn->daddr, HIST_CONNECT, latency / 1000);
+        struct tunables *t = get_tunables();
+        if (!t || !t->slow_connect_ns || latency < t->slow_connect_ns) return;
+        if (!allowed_tuple(se->saddr, se->daddr, se->sport, se->dport)) return;
+
+        struct event *e = reserve_event(EVENT_CONNECT);
+        if (!e) return;
+        set_owner(e, conn);
+        e->user_stack_id = conn->user_stack;
+        e->state = se->state;
+        e->old_state = se->old_state;
+        e->family = se->family;
+        __builtin_memcpy(e->saddr, se->saddr, sizeof(e->saddr));
+        __builtin_memcpy(e->daddr, se->daddr, sizeof(e->daddr));
+        e->sport = se->sport;
+        e->dport = se->dport;
+        e->duration_ns = latency;
+        e->netns = sock_netns((struct sock *)se->skaddr);
+        set_mptcp(e, (struct sock *)se->skaddr);
+        submit_event(ctx, e);
+        return;
+    }
+
+    if (se->state != TCP_CLOSE) return;
+
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (!conn) return; //Opened before the monitor started, no start time to report
+
+    //Ports and CIDRs are checked here rather than at open, when the source port isn't known yet
+    struct tcp_sock *tp = (struct tcp_sock *)se->skaddr;
+    u64 bytes_sent = BPF_CORE_READ(tp, bytes_acked);
+    u64 bytes_received = BPF_CORE_READ(tp, bytes_received);
+    struct tunables *t = get_tunables();
+    struct event *e = 0;
+    if (allowed_tuple(se->saddr, se->daddr, se->sport, se->dport) && (!t || bytes_sent + bytes_received >= t->min_bytes))
+        e = reserve_event(EVENT_CLOSE);
+    if (e){
+        set_owner(e, conn);
+        set_mptcp(e, (struct sock *)se->skaddr);
+        e->state = se->state;
+        e->old_state = se->old_state;
+        e->family = se->family;
+        __builtin_memcpy(e->saddr, se->saddr, sizeof(e->saddr));
+        __builtin_memcpy(e->daddr, se->daddr, sizeof(e->daddr));
+        e->sport = se->sport;
+        e->dport = se->dport;
+        e->duration_ns = bpf_ktime_get_ns() - conn->start_ns;
+        e->bytes_sent = bytes_sent;
+        e->bytes_received = bytes_received;
+        e->retransmits = conn->retransmits;
+        e->ooo_packets = conn->ooo_packets;
+        e->ooo_max_bytes = conn->ooo_max_bytes;
+        e->reordering = BPF_CORE_READ(tp, reordering);
+        if (bpf_core_field_exists(tp->reord_seen)) e->reord_seen = BPF_CORE_READ(tp, reord_seen);
+        e->sacks = conn->sacks;
+        e->sack_blocks = conn->sack_blocks;
+        e->dsacks = conn->dsacks;
+        e->dsack_bytes = conn->dsack_bytes;
+        e->netns = sock_netns((struct sock *)tp);
+        if (conn->rtt_samples){
+            e->rtt_min_us = conn->rtt_min_us;
+            e->rtt_avg_us = conn->rtt_sum_us / conn->rtt_samples;
+            e->rtt_max_us = conn->rtt_max_us;
+            e->rttvar_us = conn->rttvar_us;
+        }
+        submit_event(ctx, e);
+    }
+    bpf_map_delete_elem(&conns, &key);
+    conn_tuple_key(se, &tk);
+    bpf_map_delete_elem(&conn_tuples, &tk);
+}
+
+//Nanoseconds per jiffy (1e9 / CONFIG_HZ), what the keepalive timer counts idle time in.
+//Set by userspace from the kernel config when bpf_jiffies64 (5.5+) is there, 0 otherwise
+//(the verifier then never sees the call)
+const volatile u64 jiffy_ns = 0;
+
+//Connections whose last probe was a keepalive one, the probes sent so far. A close
+//from ETIMEDOUT while probing is keepalive giving up, unless the probes were
+//zero window ones (the persist timer ends the same way), which delete the entry.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 16384);
+    __type(key, u64); //Sock pointer, like conns
+    __type(value, u32);
+} keepalives SEC(".maps");
+
+//How long the peer has been silent, as tcp_keepalive_timer counts it (keepalive_time_elapsed)
+static __always_inline u64 keepalive_idle_ns(struct sock *sk){
+    if (!jiffy_ns) return 0;
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    struct inet_connection_sock *icsk = (struct inet_connection_sock *)sk;
+    u32 now = bpf_jiffies64();
+    u32 since_data = now - BPF_CORE_READ(tp, rcv_tstamp);
+    u32 since_segment = now - BPF_CORE_READ(icsk, icsk_ack.lrcvtime);
+    return (u64)(since_data < since_segment ? since_data : since_segment) * jiffy_ns;
+}
+
+//TCP_KEEPCNT, or the namespace's sysctl when the socket didn't set it
+static __always_inline u32 keepalive_probes(struct sock *sk){
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    u32 n = BPF_CORE_READ(tp, keepalive_probes);
+    if (n) return n;
+    return BPF_CORE_READ(sk, __sk_common.skc_net.net, ipv4.sysctl_tcp_keepalive_probes);
+}
+
+static __always_inline void send_keepalive(void *ctx, struct sock *sk, struct sock_event *se, struct conn_info *conn,
+                                           u32 state, u32 kind, u32 probes){
+    if (!allowed_conn(conn)) return;
+    if (!allowed_tuple(se->saddr, se->daddr, se->sport, se->dport)) return;
+
+    struct event *e = reserve_event(EVENT_KEEPALIVE);
+    if (!e) return;
+    if (conn) set_owner(e, conn); //Otherwise whoever the timer interrupted
+    e->direction = kind;
+    e->probes = probes;
+    e->max_probes = keepalive_probes(sk);
+    e->duration_ns = keepalive_idle_ns(sk);
+    e->netns = sock_netns(sk);
+    e->state = state;
+    e->family = se->family;
+    __builtin_memcpy(e->saddr, se->saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se->daddr, sizeof(e->daddr));
+    e->sport = se->sport;
+    e->dport = se->dport;
+    submit_event(ctx, e);
+}
+
+//Sends a probe for the keepalive timer, or for the persist timer when the peer's
+//window is closed. icsk_probes_out is the probes before this one nobody answered:
+//any ACK from the peer resets it. The first probe only means the connection is idle
+SEC("kprobe/tcp_write_wakeup")
+int BPF_KPROBE(trace_tcp_write_wakeup, struct sock *sk){
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    u64 key = (u64)sk;
+    //Keepalive only probes when everything sent was acknowledged
+    if (BPF_CORE_READ(tp, write_seq) != BPF_CORE_READ(tp, snd_una)){
+        bpf_map_delete_elem(&keepalives, &key);
+        return 0;
+    }
+    u32 probes = BPF_CORE_READ((struct inet_connection_sock *)sk, icsk_probes_out);
+    bpf_map_update_elem(&keepalives, &key, &probes, BPF_ANY);
+    if (!probes) return 0;
+
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    send_keepalive(ctx, sk, &se, conn, se.state, KEEPALIVE_UNANSWERED, probes);
+    return 0;
+}
+
+//tcp_keepalive_timer giving up sets sk_err before tcp_done closes the socket,
+//and icsk_probes_out still counts the probes that went unanswered
+static __always_inline void keepalive_timeout(void *ctx, struct sock_event *se, struct conn_info *conn){
+    u64 key = se->skaddr;
+    if (!bpf_map_lookup_elem(&keepalives, &key)) return;
+    bpf_map_delete_elem(&keepalives, &key);
+
+    struct sock *sk = (struct sock *)se->skaddr;
+    u32 probes = BPF_CORE_READ((struct inet_connection_sock *)sk, icsk_probes_out);
+    if (!probes || BPF_CORE_READ(sk, sk_err) != ETIMEDOUT) return; //The peer answered, or it closed some other way
+    send_keepalive(ctx, sk, se, conn, se->old_state, KEEPALIVE_TIMEOUT, probes);
+}
+
+static __always_inline int handle_state(void *ctx, struct sock_event *se, bool user_stack){
+    //Looked up before track_lifetime, which removes the entry on close
+    u64 key = se->skaddr;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    bool ok = allowed_conn(conn);
+    struct conn_info owner = {};
+    if (conn) owner = *conn;
+    if (se->state == TCP_CLOSE) keepalive_timeout(ctx, se, conn);
+
+    track_lifetime(ctx, se, user_stack);
+    if (!ok) return 0;
+    if (!allowed_tuple(se->saddr, se->daddr, se->sport, se->dport)) return 0;
+
+    struct event *e = reserve_event(EVENT_STATE);
+    if (!e) return 0;
+    if (conn) set_owner(e, &owner);
+    if (se->old_state == TCP_SYN_SENT && se->state == TCP_CLOSE) e->user_stack_id = owner.user_stack; //A failed connect
+    e->netns = sock_netns((struct sock *)se->skaddr);
+    set_mptcp(e, (struct sock *)se->skaddr);
+    e->sock = se->skaddr;
+    e->state = se->state;
+    e->old_state = se->old_state;
+    e->family = se->family;
+    __builtin_memcpy(e->saddr, se->saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se->daddr, sizeof(e->daddr));
+    e->sport = se->sport;
+    e->dport = se->dport;
+    submit_event(ctx, e);
+    return 0;
+}
+
+SEC("tracepoint/sock/inet_sock_set_state") //every TCP state machine transition
+int trace_tcp_state(struct trace_event_raw_inet_sock_set_state *ctx){
+    //This tracepoint also fires for other protocols (SCTP, MPTCP subflows...)
+    if (ctx->protocol != IPPROTO_TCP) return 0;
+    if (ctx->family != AF_INET && ctx->family != AF_INET6) return 0;
+
+    struct sock_event se = {
+        .skaddr = (u64)ctx->skaddr,
+        .family = ctx->family,
+        .state = ctx->newstate,
+        .old_state = ctx->oldstate,
+        .sport = ctx->sport,
+        .dport = ctx->dport,
+    };
+    set_addr(se.saddr, ctx->family, ctx->saddr, ctx->saddr_v6);
+    set_addr(se.daddr, ctx->family, ctx->daddr, ctx->daddr_v6);
+    return handle_state(ctx, &se, true);
+}
+
+//Fallback for kernels without the tracepoint (before 4.16) or without tracefs
+//At entry the socket still has its old state, the new one is the argument
+//Misses the transitions that don't go through tcp_set_state, like a child
+//socket being created in SYN_RECV, which track_lifetime doesn't need
+SEC("kprobe/tcp_set_state")
+int BPF_KPROBE(kprobe_tcp_set_state, struct sock *sk, int state){
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    se.old_state = se.state;
+    se.state = state;
+    return handle_state(ctx, &se, true);
+}
+
+//Accepted children are tracked from softirq, where the current task is whoever the
+//SYN's ACK interrupted. accept() returning them runs in the task that owns them.
+//Connections accept() picks up after --pid or --comm left them out stay untracked.
+SEC("kretprobe/inet_csk_accept")
+int BPF_KRETPROBE(kretprobe_inet_csk_accept, struct sock *sk){
+    if (!sk) return 0;
+    u64 key = (u64)sk;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (!conn) return 0;
+    conn->pid = bpf_get_current_pid_tgid() >> 32;
+    bpf_get_current_comm(&conn->comm, sizeof(conn->comm));
+    conn->cgroup_id = bpf_get_current_cgroup_id();
+    conn->pid_start = record_owner();
+    return 0;
+}
+
+//Resets the kernel sends, answering a segment or aborting a connection, and ones it receives
+//A segment no socket wanted (e.g. a SYN to a closed port) is answered without a socket:
+//skaddr is 0 and the netns comes from the packet
+static __always_inline int handle_reset(void *ctx, struct sock_event *se, u32 direction, u32 reason, u32 netns){
+    u64 key = se->skaddr;
+    struct conn_info *conn = key ? bpf_map_lookup_elem(&conns, &key) : 0;
+    if (!allowed_conn(conn)) return 0;
+    if (!allowed_tuple(se->saddr, se->daddr, se->sport, se->dport)) return 0;
+
+    struct event *e = reserve_event(EVENT_RESET);
+    if (!e) return 0;
+    if (conn){
+        set_owner(e, conn);
+        e->user_stack_id = conn->user_stack;
+    }
+    e->reason = reason;
+    e->direction = direction;
+    e->netns = netns;
+    set_mptcp(e, (struct sock *)key);
+    e->state = key ? se->state : TCP_CLOSE;
+    e->family = se->family;
+    __builtin_memcpy(e->saddr, se->saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se->daddr, sizeof(e->daddr));
+    e->sport = se->sport;
+    e->dport = se->dport;
+    submit_event(ctx, e);
+    return 0;
+}
+
+//6.10 gave tcp_send_reset its own event class, with the reason and a socket that may be NULL
+//The addresses became sockaddr_in/sockaddr_in6, family and port included, always with our end in saddr
+struct trace_event_raw_tcp_send_reset___reason{
+    const void *skbaddr;
+    const void *skaddr;
+    int state;
+    u32 reason;
+    u8 saddr[28];
+    u8 daddr[28];
+} __attribute__((preserve_access_index));
+
+//Reads a sockaddr_in/sockaddr_in6 as the tracepoints store it, port in network byte order
+static __always_inline void read_sockaddr(const u8 *sa, u16 *family, u8 *addr, u16 *port){
+    *family = *(const u16 *)sa;
+    *port = bpf_ntohs(*(const u16 *)(sa + 2));
+    set_addr(addr, *family, sa + 4, sa + 8); //sin_addr, or sin6_addr after sin6_flowinfo
+}
+
+SEC("tracepoint/tcp/tcp_send_reset")
+int trace_tcp_reset_sent(void *ctx){
+    struct sock_event se = {};
+    u32 reason = 0; //SK_RST_REASON_NOT_SPECIFIED
+    const void *skb;
+
+    if (bpf_core_type_exists(struct trace_event_raw_tcp_send_reset___reason)){
+        struct trace_event_raw_tcp_send_reset___reason *r = ctx;
+        u16 family;
+        read_sockaddr(r->saddr, &family, se.saddr, &se.sport);
+        read_sockaddr(r->daddr, &family, se.daddr, &se.dport);
+        if (family != AF_INET && family != AF_INET6) return 0;
+        se.family = family;
+        se.skaddr = (u64)r->skaddr;
+        se.state = r->state;
+        reason = r->reason;
+        skb = r->skbaddr;
+    } else {
+        //Before 6.10 it shared tcp_event_sk_skb with tcp_retransmit_skb, and always had a socket
+        struct trace_event_raw_tcp_event_sk_skb *r = ctx;
+        if (r->family != AF_INET && r->family != AF_INET6) return 0;
+        se.skaddr = (u64)r->skaddr;
+        se.family = r->family;
+        se.state = r->state;
+        se.sport = r->sport;
+        se.dport = r->dport;
+        set_addr(se.saddr, r->family, r->saddr, r->saddr_v6);
+        set_addr(se.daddr, r->family, r->daddr, r->daddr_v6);
+        skb = r->skbaddr;
+    }
+    u32 netns = se.skaddr ? sock_netns((struct sock *)se.skaddr) : skb_netns((struct sk_buff *)skb);
+    return handle_reset(ctx, &se, RST_SENT, reason, netns);
+}
+
+SEC("tracepoint/tcp/tcp_receive_reset") //fires in tcp_reset, before the socket is closed
+int trace_tcp_reset_received(struct trace_event_raw_tcp_event_sk *ctx){
+    if (ctx->family != AF_INET && ctx->family != AF_INET6) return 0;
+
+    struct sock *sk = (struct sock *)ctx->skaddr;
+    struct sock_event se = {
+        .skaddr = (u64)sk,
+        .family = ctx->family,
+        .state = BPF_CORE_READ(sk, __sk_common.skc_state), //The event class has no state
+        .sport = ctx->sport,
+        .dport = ctx->dport,
+    };
+    set_addr(se.saddr, ctx->family, ctx->saddr, ctx->saddr_v6);
+    set_addr(se.daddr, ctx->family, ctx->daddr, ctx->daddr_v6);
+    return handle_reset(ctx, &se, RST_RECEIVED, 0, sock_netns(sk));
+}
+
+//Fallbacks for kernels without the tracepoints (before 4.16) or without tracefs
+//IPv4 only, as tcp_v6_send_reset is in the ipv6 module on some kernels
+SEC("kprobe/tcp_v4_send_reset")
+int BPF_KPROBE(kprobe_tcp_v4_send_reset, struct sock *sk, struct sk_buff *skb){
+    struct sock_event se = {};
+    if (sk){
+        if (!read_sock_event(sk, &se)) return 0;
+        return handle_reset(ctx, &se, RST_SENT, 0, sock_netns(sk));
+    }
+    //No socket: the tuple is the segment's, reversed so saddr is our end
+    struct tuple t = {};
+    const unsigned char *l4;
+    if (!read_skb_tuple(skb, ETH_P_IP, &t, &l4)) return 0;
+    se.family = t.family;
+    __builtin_memcpy(se.saddr, t.daddr, sizeof(se.saddr));
+    __builtin_memcpy(se.daddr, t.saddr, sizeof(se.daddr));
+    se.sport = t.dport;
+    se.dport = t.sport;
+    return handle_reset(ctx, &se, RST_SENT, 0, skb_netns(skb));
+}
+
+SEC("kprobe/tcp_reset")
+int BPF_KPROBE(kprobe_tcp_reset, struct sock *sk){
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    return handle_reset(ctx, &se, RST_RECEIVED, 0, sock_netns(sk));
+}
+
+//--proto udp: errors of UDP sockets, the DNS and QUIC traffic next to the TCP connections
+//The tuple is our end in saddr like everywhere else, reason the errno
+static __always_inline int handle_udp_error(void *ctx, struct tuple *t, u32 direction, u32 err, u32 netns){
+    if (!allowed_tuple(t->saddr, t->daddr, t->sport, t->dport)) return 0;
+    u32 suppressed;
+    if (conn_limited(EVENT_UDP_ERROR, netns, t->saddr, t->daddr, t->sport, t->dport, &suppressed)) return 0;
+
+    struct event *e = reserve_event(EVENT_UDP_ERROR);
+    if (!e) return 0;
+    e->reason = err;
+    e->direction = direction;
+    e->protocol = IPPROTO_UDP;
+    e->family = t->family;
+    __builtin_memcpy(e->saddr, t->saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, t->daddr, sizeof(e->daddr));
+    e->sport = t->sport;
+    e->dport = t->dport;
+    e->suppressed = suppressed;
+    e->netns = netns;
+    submit_event(ctx, e);
+    return 0;
+}
+
+//What udp_sendmsg was called with, kept until it returns
+struct udp_send{
+    struct sock *sk;
+    struct tuple t;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //A kretprobe that missed its return can't leak entries
+    __uint(max_entries, 4096);
+    __type(key, u64); //pid_tgid, a task is in one sendmsg at a time
+    __type(value, struct udp_send);
+} udp_sends SEC(".maps");
+
+//The destination is the socket's peer for connected sockets, otherwise msg_name
+//(already copied into the kernel by the time sendmsg runs)
+static __always_inline int udp_send_enter(struct sock *sk, struct msghdr *msg){
+    if (!allowed_current()) return 0;
+
+    struct udp_send s = {.sk = sk};
+    if (!read_sock_addrs(sk, &s.t.family, s.t.saddr, s.t.daddr, &s.t.sport, &s.t.dport)) return 0;
+    void *name = BPF_CORE_READ(msg, msg_name);
+    if (name){
+        u8 sa[28] = {}; //sizeof(struct sockaddr_in6)
+        u16 family;
+        bpf_probe_read_kernel(sa, sizeof(sa), name);
+        read_sockaddr(sa, &family, s.t.daddr, &s.t.dport);
+        if (family != AF_INET && family != AF_INET6) return 0;
+    }
+    u64 id = bpf_get_current_pid_tgid();
+    bpf_map_update_elem(&udp_sends, &id, &s, BPF_ANY);
+    return 0;
+}
+
+//IPv4 sends on an IPv6 socket go from udpv6_sendmsg to udp_sendmsg, the inner return
+//reports the error and the outer one finds nothing left
+static __always_inline int udp_send_exit(void *ctx, int ret){
+    u64 id = bpf_get_current_pid_tgid();
+    struct udp_send *p = bpf_map_lookup_elem(&udp_sends, &id);
+    if (!p) return 0;
+    struct udp_send s = *p;
+    bpf_map_delete_elem(&udp_sends, &id);
+    if (ret >= 0) return 0;
+    return handle_udp_error(ctx, &s.t, UDP_SENT, -ret, sock_netns(s.sk));
+}
+
+SEC("kprobe/udp_sendmsg")
+int BPF_KPROBE(kprobe_udp_sendmsg, struct sock *sk, struct msghdr *msg){
+    return udp_send_enter(sk, msg);
+}
+
+SEC("kretprobe/udp_sendmsg")
+int BPF_KRETPROBE(kretprobe_udp_sendmsg, int ret){
+    return udp_send_exit(ctx, ret);
+}
+
+SEC("kprobe/udpv6_sendmsg")
+int BPF_KPROBE(kprobe_udpv6_sendmsg, struct sock *sk, struct msghdr *msg){
+    return udp_send_enter(sk, msg);
+}
+
+SEC("kretprobe/udpv6_sendmsg")
+int BPF_KRETPROBE(kretprobe_udpv6_sendmsg, int ret){
+    return udp_send_exit(ctx, ret);
+}
+
+//udp:udp_fail_queue_rcv_skb, a datagram that arrived and didn't fit its socket's receive
+//buffer (ENOMEM) or UDP's memory limit (ENOBUFS). Before 6.10 it only had the local port,
+//since then the datagram's addresses as sockaddrs, the sender in saddr
+struct trace_event_raw_udp_fail_queue_rcv_skb___lport{
+    int rc;
+    u16 lport;
+} __attribute__((preserve_access_index));
+
+struct trace_event_raw_udp_fail_queue_rcv_skb___tuple{
+    int rc;
+    u16 sport;
+    u16 dport;
+    u16 family;
+    u8 saddr[28];
+    u8 daddr[28];
+} __attribute__((preserve_access_index));
+
+SEC("tracepoint/udp/udp_fail_queue_rcv_skb")
+int trace_udp_fail_queue_rcv_skb(void *ctx){
+    //No --pid/--comm/--cgroup check: this is usually softirq, where the current task is
+    //whichever was running, and the tracepoint doesn't have the socket to go by instead
+    struct tuple t = {};
+    int rc;
+
+    struct trace_event_raw_udp_fail_queue_rcv_skb___tuple *r = ctx;
+    if (bpf_core_field_exists(r->family)){
+        u16 family;
+        read_sockaddr(r->daddr, &family, t.saddr, &t.sport);
+        read_sockaddr(r->saddr, &family, t.daddr, &t.dport);
+        if (family != AF_INET && family != AF_INET6) return 0;
+        t.family = family;
+        rc = r->rc;
+    } else {
+        //No addresses, the event has family 0 and only our port
+        struct trace_event_raw_udp_fail_queue_rcv_skb___lport *old = ctx;
+        t.sport = old->lport;
+        rc = old->rc;
+    }
+    return handle_udp_error(ctx, &t, UDP_RECEIVED, -rc, 0);
+}
+
+//ICMP errors about segments we sent: destination unreachable, and the path MTU discovery
+//ones, fragmentation needed (IPv4) and packet too big (IPv6). The segment quoted in the
+//ICMP message finds the connection, so the event names the one a router or firewall hurts
+#define ICMP_DEST_UNREACH   3
+#define ICMP_FRAG_NEEDED    4 //A code of ICMP_DEST_UNREACH
+#define ICMPV6_DEST_UNREACH 1
+#define ICMPV6_PKT_TOOBIG   2
+
+//The first 8 bytes of an ICMP or ICMPv6 message
+struct icmp_start{
+    u8 type;
+    u8 code;
+    u16 checksum;
+    union {
+        u32 mtu6; //ICMPV6_PKT_TOOBIG, network byte order
+        struct {
+            u16 unused;
+            u16 mtu4; //ICMP_FRAG_NEEDED, network byte order
+        };
+    };
+};
+
+//The quoted segment's tuple is in t, with our end in saddr
+static __always_inline int handle_icmp_error(void *ctx, struct sk_buff *skb, struct tuple *t, struct icmp_start *icmp, u32 mtu){
+    u32 netns = skb_netns(skb);
+    struct conn_tuple k = {.sport = t->sport, .dport = t->dport, .netns = netns};
+    __builtin_memcpy(k.saddr, t->saddr, sizeof(k.saddr));
+    __builtin_memcpy(k.daddr, t->daddr, sizeof(k.daddr));
+    u64 *skaddr = bpf_map_lookup_elem(&conn_tuples, &k);
+    u64 key = skaddr ? *skaddr : 0;
+    struct conn_info *conn = key ? bpf_map_lookup_elem(&conns, &key) : 0;
+    if (!allowed_conn(conn)) return 0;
+    if (!allowed_tuple(t->saddr, t->daddr, t->sport, t->dport)) return 0;
+    u32 suppressed;
+    if (conn_limited(EVENT_ICMP_ERROR, netns, t->saddr, t->daddr, t->sport, t->dport, &suppressed)) return 0;
+
+    struct event *e = reserve_event(EVENT_ICMP_ERROR);
+    if (!e) return 0;
+    if (conn){
+        set_owner(e, conn);
+        e->state = BPF_CORE_READ((struct sock *)key, __sk_common.skc_state);
+        e->user_stack_id = conn->user_stack;
+    }
+    e->reason = icmp->type << 8 | icmp->code;
+    e->mtu = mtu;
+    e->family = t->family;
+    __builtin_memcpy(e->saddr, t->saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, t->daddr, sizeof(e->daddr));
+    e->sport = t->sport;
+    e->dport = t->dport;
+    e->suppressed = suppressed;
+    e->netns = netns;
+    submit_event(ctx, e);
+    return 0;
+}
+
+//What tcp_v4_connect/tcp_v6_connect were called with, kept until they return
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //A kretprobe that missed its return can't leak entries
+    __uint(max_entries, 4096);
+    __type(key, u64); //pid_tgid
+    __type(value, u64); //The sock
+} connects SEC(".maps");
+
+static __always_inline int tcp_connect_enter(struct sock *sk){
+    u64 id = bpf_get_current_pid_tgid();
+    u64 skaddr = (u64)sk;
+    bpf_map_update_elem(&connects, &id, &skaddr, BPF_ANY);
+    return 0;
+}
+
+//The SYN is out and the source port bound by the time connect returns, so the tuple
+//goes in conn_tuples here and an ICMP error answering the SYN finds the connection.
+//IPv4 connects on an IPv6 socket go from tcp_v6_connect to tcp_v4_connect, the inner
+//return adds the tuple and the outer one finds nothing left
+static __always_inline int tcp_connect_exit(int ret){
+    u64 id = bpf_get_current_pid_tgid();
+    u64 *p = bpf_map_lookup_elem(&connects, &id);
+    if (!p) return 0;
+    u64 key = *p;
+    bpf_map_delete_elem(&connects, &id);
+    if (ret) return 0;
+
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (!conn) return 0; //Filtered out at SYN_SENT
+    struct sock_event se = {};
+    if (!read_sock_event((struct sock *)key, &se) || !se.sport) return 0;
+    conn->sport = se.sport;
+    __builtin_memcpy(conn->saddr, se.saddr, sizeof(conn->saddr));
+    struct conn_tuple tk = {};
+    conn_tuple_key(&se, &tk);
+    bpf_map_update_elem(&conn_tuples, &tk, &key, BPF_ANY);
+    return 0;
+}
+
+SEC("kprobe/tcp_v4_connect")
+int BPF_KPROBE(kprobe_tcp_v4_connect, struct sock *sk){
+    return tcp_connect_enter(sk);
+}
+
+SEC("kretprobe/tcp_v4_connect")
+int BPF_KRETPROBE(kretprobe_tcp_v4_connect, int ret){
+    return tcp_connect_exit(ret);
+}
+
+SEC("kprobe/tcp_v6_connect")
+int BPF_KPROBE(kprobe_tcp_v6_connect, struct sock *sk){
+    return tcp_connect_enter(sk);
+}
+
+SEC("kretprobe/tcp_v6_connect")
+int BPF_KRETPROBE(kretprobe_tcp_v6_connect, int ret){
+    return tcp_connect_exit(ret);
+}
+
+//Both handlers get the ICMP message with skb->data at the quoted IP header,
+//and the ICMP header still at the transport header
+static __always_inline bool read_icmp_start(struct sk_buff *skb, struct icmp_start *icmp){
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    u16 transport_header = BPF_CORE_READ(skb, transport_header);
+    return bpf_probe_read_kernel(icmp, sizeof(*icmp), head + transport_header) == 0;
+}
+
+SEC("kprobe/tcp_v4_err")
+int BPF_KPROBE(kprobe_tcp_v4_err, struct sk_buff *skb){
+    struct icmp_start icmp;
+    if (!read_icmp_start(skb, &icmp) || icmp.type != ICMP_DEST_UNREACH) return 0;
+
+    unsigned char *data = BPF_CORE_READ(skb, data);
+    struct iphdr iph;
+    if (bpf_probe_read_kernel(&iph, sizeof(iph), data)) return 0;
+    struct tuple t = {.family = AF_INET};
+    set_addr(t.saddr, AF_INET, (u8 *)&iph.saddr, 0);
+    set_addr(t.daddr, AF_INET, (u8 *)&iph.daddr, 0);
+    read_ports(data + iph.ihl * 4, IPPROTO_TCP, &t);
+    u32 mtu = icmp.code == ICMP_FRAG_NEEDED ? bpf_ntohs(icmp.mtu4) : 0;
+    return handle_icmp_error(ctx, skb, &t, &icmp, mtu);
+}
+
+//offset is where the quoted TCP header starts, past any extension headers. type and code
+//are the message's as icmpv6_notify decoded them, the header is only read for the MTU
+SEC("kprobe/tcp_v6_err")
+int BPF_KPROBE(kprobe_tcp_v6_err, struct sk_buff *skb, struct inet6_skb_parm *opt, u8 type, u8 code, int offset){
+    if (type != ICMPV6_DEST_UNREACH && type != ICMPV6_PKT_TOOBIG) return 0;
+    struct icmp_start icmp;
+    if (!read_icmp_start(skb, &icmp)) return 0;
+    icmp.type = type;
+    icmp.code = code;
+
+    unsigned char *data = BPF_CORE_READ(skb, data);
+    struct ipv6hdr ip6h;
+    if (bpf_probe_read_kernel(&ip6h, sizeof(ip6h), data)) return 0;
+    struct tuple t = {.family = AF_INET6};
+    __builtin_memcpy(t.saddr, &ip6h.saddr, sizeof(t.saddr));
+    __builtin_memcpy(t.daddr, &ip6h.daddr, sizeof(t.daddr));
+    read_ports(data + offset, IPPROTO_TCP, &t);
+    u32 mtu = icmp.type == ICMPV6_PKT_TOOBIG ? bpf_ntohl(icmp.mtu6) : 0;
+    return handle_icmp_error(ctx, skb, &t, &icmp, mtu);
+}
+
+//Zero window stalls: a receiver that doesn't read fills its buffer and advertises a zero window,
+//and the sender can only send window probes from its persist timer until it reads again
+//A stall is reported when it's seen first and then at most every ZERO_WINDOW_REPEAT_NS
+//while it lasts, whichever end of it is on this host (both, over loopback)
+#define ZERO_WINDOW_REPEAT_NS 10000000000ULL
+
+struct zero_window_key{
+    u64 skaddr;
+    u32 direction; //WINDOW_SENT or WINDOW_RECEIVED
+    u32 pad;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //Sockets that stalled once and went away are evicted eventually
+    __uint(max_entries, 4096);
+    __type(key, struct zero_window_key);
+    __type(value, u64); //When the stall was last reported
+} zero_windows SEC(".maps");
+
+static __always_inline int handle_zero_window(void *ctx, struct sock *sk, u32 direction, u32 queued){
+    u64 now = bpf_ktime_get_ns();
+    struct zero_window_key zk = {.skaddr = (u64)sk, .direction = direction};
+    u64 *last = bpf_map_lookup_elem(&zero_windows, &zk);
+    if (last && now - *last < ZERO_WINDOW_REPEAT_NS) return 0;
+
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    u64 key = se.skaddr;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (!allowed_conn(conn)) return 0;
+    if (!allowed_tuple(se.saddr, se.daddr, se.sport, se.dport)) return 0;
+    bpf_map_update_elem(&zero_windows, &zk, &now, BPF_ANY);
+
+    struct event *e = reserve_event(EVENT_ZERO_WINDOW);
+    if (!e) return 0;
+    if (conn) set_owner(e, conn);
+    e->direction = direction;
+    e->queued = queued;
+    e->netns = sock_netns(sk);
+    e->state = se.state;
+    e->family = se.family;
+    __builtin_memcpy(e->saddr, se.saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se.daddr, sizeof(e->daddr));
+    e->sport = se.sport;
+    e->dport = se.dport;
+    submit_event(ctx, e);
+    return 0;
+}
+
+//rcv_wnd is the window last advertised, so on segments arriving after a zero one
+//(usually the peer's window probes) it's 0. Costs one read per segment otherwise.
+SEC("kprobe/tcp_rcv_established")
+int BPF_KPROBE(trace_tcp_zero_window_sent, struct sock *sk){
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    if (BPF_CORE_READ(tp, rcv_wnd)) return 0;
+    u32 unread = BPF_CORE_READ(tp, rcv_nxt) - BPF_CORE_READ(tp, copied_seq);
+    return handle_zero_window(ctx, sk, WINDOW_SENT, unread);
+}
+
+//The persist timer firing: the peer's window is still closed and we have data for it
+SEC("kprobe/tcp_send_probe0")
+int BPF_KPROBE(trace_tcp_zero_window_received, struct sock *sk){
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    if (BPF_CORE_READ(tp, snd_wnd)) return 0; //A window too small for the next segment arms the timer too
+    u32 unsent = BPF_CORE_READ(tp, write_seq) - BPF_CORE_READ(tp, snd_una);
+    return handle_zero_window(ctx, sk, WINDOW_RECEIVED, unsent);
+}
+
+//A tcp_prune_queue run in progress, kept until it returns
+struct buffer_prune{
+    struct sock *sk;
+    u32 rmem_alloc;
+    u32 collapses;
+    u32 ofo_pruned; //tcp_prune_ofo_queue ran, out-of-order data is gone
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //A kretprobe that missed its return can't leak entries
+    __uint(max_entries, 4096);
+    __type(key, u64); //pid_tgid: the softirq, or the owner processing its backlog
+    __type(value, struct buffer_prune);
+} buffer_prunes SEC(".maps");
+
+//A segment arrived with the socket over its receive buffer (or TCP over tcp_mem):
+//the reader isn't keeping up, or the buffer is too small for the path.
+//Static in tcp_input.c, like the two below, a kernel may have inlined it
+SEC("kprobe/tcp_prune_queue")
+int BPF_KPROBE(kprobe_tcp_prune_queue, struct sock *sk){
+    struct buffer_prune b = {.sk = sk, .rmem_alloc = BPF_CORE_READ(sk, sk_backlog.rmem_alloc.counter)};
+    u64 id = bpf_get_current_pid_tgid();
+    bpf_map_update_elem(&buffer_prunes, &id, &b, BPF_ANY);
+    return 0;
+}
+
+//Once for the out-of-order queue and once for the receive queue, more when
+//the ranges have holes
+SEC("kprobe/tcp_collapse")
+int BPF_KPROBE(trace_tcp_collapse){
+    u64 id = bpf_get_current_pid_tgid();
+    struct buffer_prune *b = bpf_map_lookup_elem(&buffer_prunes, &id);
+    if (b) b->collapses++;
+    return 0;
+}
+
+SEC("kprobe/tcp_prune_ofo_queue")
+int BPF_KPROBE(trace_tcp_prune_ofo_queue){
+    u64 id = bpf_get_current_pid_tgid();
+    struct buffer_prune *b = bpf_map_lookup_elem(&buffer_prunes, &id);
+    if (b) b->ofo_pruned = 1;
+    return 0;
+}
+
+//-1 when even pruning didn't make room and the segment is dropped (TcpExtRcvPruned).
+//Runs that only clamped the window under tcp_mem pressure aren't reported
+SEC("kretprobe/tcp_prune_queue")
+int BPF_KRETPROBE(kretprobe_tcp_prune_queue, int ret){
+    u64 id = bpf_get_current_pid_tgid();
+    struct buffer_prune *p = bpf_map_lookup_elem(&buffer_prunes, &id);
+    if (!p) return 0;
+    struct buffer_prune b = *p;
+    bpf_map_delete_elem(&buffer_prunes, &id);
+
+    u32 kind;
+    if (ret < 0) kind = BUFFER_DROPPED;
+    else if (b.ofo_pruned) kind = BUFFER_OFO_PRUNED;
+    else if (b.collapses) kind = BUFFER_COLLAPSED;
+    else return 0;
+    if (!(event_mask & (1 << EVENT_BUFFER))) return 0;
+
+    struct sock *sk = b.sk;
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    u64 key = (u64)sk;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (!allowed_conn(conn)) return 0;
+    if (!allowed_tuple(se.saddr, se.daddr, se.sport, se.dport)) return 0;
+    u32 netns = sock_netns(sk);
+    u32 suppressed;
+    if (conn_limited(EVENT_BUFFER, netns, se.saddr, se.daddr, se.sport, se.dport, &suppressed)) return 0;
+
+    struct event *e = reserve_event(EVENT_BUFFER);
+    if (!e) return 0;
+    if (conn) set_owner(e, conn); //The process that isn't reading fast enough
+    e->direction = kind;
+    e->rmem_alloc = b.rmem_alloc;
+    e->rmem_after = BPF_CORE_READ(sk, sk_backlog.rmem_alloc.counter);
+    e->rcvbuf = BPF_CORE_READ(sk, sk_rcvbuf);
+    e->rmem_max = BPF_CORE_READ(sk, __sk_common.skc_net.net, ipv4.sysctl_tcp_rmem[2]);
+    e->collapses = b.collapses;
+    if (BPF_CORE_READ_BITFIELD_PROBED(sk, sk_userlocks) & SOCK_RCVBUF_LOCK) e->buffer_flags |= BUFFER_RCVBUF_LOCKED;
+    //tcp_memory_pressure, an int before 5.4 and an unsigned long since: the low bytes either way
+    int pressure = 0;
+    bpf_probe_read_kernel(&pressure, sizeof(pressure), BPF_CORE_READ(sk, sk_prot, memory_pressure));
+    if (pressure) e->buffer_flags |= BUFFER_MEM_PRESSURE;
+    e->suppressed = suppressed;
+    e->netns = netns;
+    e->state = se.state;
+    e->family = se.family;
+    __builtin_memcpy(e->saddr, se.saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se.daddr, sizeof(e->daddr));
+    e->sport = se.sport;
+    e->dport = se.dport;
+    submit_event(ctx, e);
+    return 0;
+}
+
+//setsockopt on TCP sockets, for the options behind most latency that "just happens":
+//Nagle and corking, buffer sizes, the user timeout, the congestion algorithm.
+//SOL_SOCKET options go through sock_setsockopt, SOL_TCP ones through tcp_setsockopt, both
+//with the level and name in the same arguments since 2.6. The kretprobes read what the
+//call left on the socket rather than the user's buffer, whose layout changed in 5.9.
+#define SOL_SOCKET 1
+#define SOL_TCP    6
+
+#define SO_SNDBUF      7
+#define SO_RCVBUF      8
+#define SO_KEEPALIVE   9
+#define SO_SNDBUFFORCE 32
+#define SO_RCVBUFFORCE 33
+#define SO_MARK        36
+
+#define TCP_NODELAY       1
+#define TCP_MAXSEG        2
+#define TCP_CORK          3
+#define TCP_CONGESTION    13
+#define TCP_USER_TIMEOUT  18
+#define TCP_NOTSENT_LOWAT 25
+
+#define TCP_NAGLE_OFF  1 //tp->nonagle bits
+#define TCP_NAGLE_CORK 2
+
+struct sockopt_call{
+    struct sock *sk;
+    u32 sockopt; //level << 16 | optname, like the event
+    u32 old;
+    char ca_old[TCP_CA_NAME_MAX];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //A kretprobe that missed its return can't leak entries
+    __uint(max_entries, 4096);
+    __type(key, u64); //pid_tgid, setsockopt runs in the caller
+    __type(value, struct sockopt_call);
+} sockopt_calls SEC(".maps");
+
+static __always_inline bool sockopt_traced(u32 level, u32 optname){
+    if (level == SOL_SOCKET)
+        return optname == SO_SNDBUF || optname == SO_RCVBUF || optname == SO_KEEPALIVE ||
+               optname == SO_SNDBUFFORCE || optname == SO_RCVBUFFORCE || optname == SO_MARK;
+    return optname == TCP_NODELAY || optname == TCP_MAXSEG || optname == TCP_CORK ||
+           optname == TCP_CONGESTION || optname == TCP_USER_TIMEOUT || optname == TCP_NOTSENT_LOWAT;
+}
+
+//The option's value as the socket has it now, TCP_CONGESTION's name goes into ca instead
+static __always_inline u32 sockopt_value(struct sock *sk, u32 sockopt, char (*ca)[TCP_CA_NAME_MAX]){
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    struct inet_connection_sock *icsk = (struct inet_connection_sock *)sk;
+    switch (sockopt){
+    case SOL_SOCKET << 16 | SO_SNDBUF:
+    case SOL_SOCKET << 16 | SO_SNDBUFFORCE:
+        return BPF_CORE_READ(sk, sk_sndbuf);
+    case SOL_SOCKET << 16 | SO_RCVBUF:
+    case SOL_SOCKET << 16 | SO_RCVBUFFORCE:
+        return BPF_CORE_READ(sk, sk_rcvbuf);
+    case SOL_SOCKET << 16 | SO_KEEPALIVE:
+        return (BPF_CORE_READ(sk, sk_flags) >> SOCK_KEEPOPEN) & 1;
+    case SOL_SOCKET << 16 | SO_MARK:
+        return BPF_CORE_READ(sk, sk_mark);
+    case SOL_TCP << 16 | TCP_NODELAY:
+        return (BPF_CORE_READ_BITFIELD_PROBED(tp, nonagle) & TCP_NAGLE_OFF) != 0;
+    case SOL_TCP << 16 | TCP_CORK:
+        return (BPF_CORE_READ_BITFIELD_PROBED(tp, nonagle) & TCP_NAGLE_CORK) != 0;
+    case SOL_TCP << 16 | TCP_MAXSEG:
+        return BPF_CORE_READ(tp, rx_opt.user_mss);
+    case SOL_TCP << 16 | TCP_USER_TIMEOUT:
+        return BPF_CORE_READ(icsk, icsk_user_timeout); //Milliseconds
+    case SOL_TCP << 16 | TCP_NOTSENT_LOWAT:
+        return BPF_CORE_READ(tp, notsent_lowat);
+    case SOL_TCP << 16 | TCP_CONGESTION:
+        BPF_CORE_READ_STR_INTO(ca, icsk, icsk_ca_ops, name);
+        return 0;
+    }
+    return 0;
+}
+
+static __always_inline int sockopt_enter(struct sock *sk, u32 level, u32 optname){
+    if (!sk || !sockopt_traced(level, optname)) return 0;
+    if (BPF_CORE_READ_BITFIELD_PROBED(sk, sk_protocol) != IPPROTO_TCP) return 0;
+    if (!allowed_current()) return 0;
+    struct sockopt_call c = {.sk = sk, .sockopt = level << 16 | optname};
+    c.old = sockopt_value(sk, c.sockopt, &c.ca_old);
+    u64 id = bpf_get_current_pid_tgid();
+    bpf_map_update_elem(&sockopt_calls, &id, &c, BPF_ANY);
+    return 0;
+}
+
+static __always_inline int sockopt_exit(void *ctx, int ret){
+    u64 id = bpf_get_current_pid_tgid();
+    struct sockopt_call *p = bpf_map_lookup_elem(&sockopt_calls, &id);
+    if (!p) return 0;
+    struct sockopt_call c = *p;
+    bpf_map_delete_elem(&sockopt_calls, &id);
+
+    struct sock *sk = c.sk;
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    //Options are mostly set before connect(), when there's no tuple to filter on yet
+    if (se.dport && !allowed_tuple(se.saddr, se.daddr, se.sport, se.dport)) return 0;
+
+    struct sockopt_event *so = reserve_sockopt();
+    if (!so) return 0;
+    struct event *e = &so->e;
+    so->s.sockopt = c.sockopt;
+    so->s.sockopt_old = c.old;
+    __builtin_memcpy(so->s.ca_old, c.ca_old, sizeof(so->s.ca_old));
+    so->s.sockopt_new = sockopt_value(sk, c.sockopt, &so->s.ca_new);
+    if (ret < 0) e->reason = -ret;
+    e->sock = (u64)sk;
+    e->netns = sock_netns(sk);
+    e->state = se.state;
+    e->family = se.family;
+    __builtin_memcpy(e->saddr, se.saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se.daddr, sizeof(e->daddr));
+    e->sport = se.sport;
+    e->dport = se.dport;
+    submit_event(ctx, so);
+    return 0;
+}
+
+SEC("kprobe/sock_setsockopt")
+int BPF_KPROBE(kprobe_sock_setsockopt, struct socket *sock, int level, int optname){
+    if (level != SOL_SOCKET) return 0;
+    return sockopt_enter(BPF_CORE_READ(sock, sk), level, optname);
+}
+
+SEC("kretprobe/sock_setsockopt")
+int BPF_KRETPROBE(kretprobe_sock_setsockopt, int ret){
+    return sockopt_exit(ctx, ret);
+}
+
+//Other levels, IP and IPv6, pass through here on their way to ip_setsockopt
+SEC("kprobe/tcp_setsockopt")
+int BPF_KPROBE(kprobe_tcp_setsockopt, struct sock *sk, int level, int optname){
+    if (level != SOL_TCP) return 0;
+    return sockopt_enter(sk, level, optname);
+}
+
+SEC("kretprobe/tcp_setsockopt")
+int BPF_KRETPROBE(kretprobe_tcp_setsockopt, int ret){
+    return sockopt_exit(ctx, ret);
+}
+
+//TLS handshakes of OpenSSL (libssl) users, from uprobes on SSL_do_handshake and
+//SSL_connect/SSL_accept, which call it. A non-blocking handshake takes several
+//calls: it starts with the first, ends with the one returning 1, and the socket
+//it runs on is the one tcp_sendmsg or tcp_recvmsg sees during them.
+struct tls_key{
+    u32 tgid;
+    u32 pad;  //Zeroed, so the key has no holes with garbage in them
+    u64 ssl;  //SSL * in the process
+};
+
+struct tls_handshake{
+    u64 start_ns;
+    u64 skaddr; //0 until the handshake reads or writes its socket
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //Failed handshakes are evicted eventually, SSL_free removes most of them
+    __uint(max_entries, 16384);
+    __type(key, struct tls_key);
+    __type(value, struct tls_handshake);
+} tls_handshakes SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //A uretprobe that missed its return can't leak entries
+    __uint(max_entries, 4096);
+    __type(key, u32); //Thread ID, a thread is in one handshake call at a time
+    __type(value, struct tls_key);
+} tls_threads SEC(".maps");
+
+static __always_inline int tls_enter(void *ssl){
+    if (!(event_mask & (1 << EVENT_TLS))) return 0;
+    if (!allowed_current()) return 0;
+    u64 id = bpf_get_current_pid_tgid();
+    u32 tid = id;
+    struct tls_key k = {.tgid = id >> 32, .ssl = (u64)ssl};
+    struct tls_handshake h = {.start_ns = bpf_ktime_get_ns()};
+    bpf_map_update_elem(&tls_handshakes, &k, &h, BPF_NOEXIST); //Later calls keep the first one's start
+    bpf_map_update_elem(&tls_threads, &tid, &k, BPF_ANY);
+    return 0;
+}
+
+//SSL_connect's own return finds nothing left once SSL_do_handshake's has been through
+static __always_inline int tls_exit(void *ctx, int ret){
+    u32 tid = bpf_get_current_pid_tgid();
+    struct tls_key *p = bpf_map_lookup_elem(&tls_threads, &tid);
+    if (!p) return 0;
+    struct tls_key k = *p;
+    bpf_map_delete_elem(&tls_threads, &tid);
+    if (ret != 1) return 0; //Wants to read or write first (non-blocking), or failed
+
+    struct tls_handshake *h = bpf_map_lookup_elem(&tls_handshakes, &k);
+    if (!h) return 0;
+    struct tls_handshake hs = *h;
+    bpf_map_delete_elem(&tls_handshakes, &k);
+    if (!hs.skaddr) return 0; //Over a memory BIO, no socket to report it with
+    u64 now = bpf_ktime_get_ns();
+
+    struct sock *sk = (struct sock *)hs.skaddr;
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    if (!allowed_tuple(se.saddr, se.daddr, se.sport, se.dport)) return 0;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &hs.skaddr);
+
+    struct event *e = reserve_event(EVENT_TLS);
+    if (!e) return 0;
+    //The owner is the thread doing the handshake, which init_event already set
+    if (conn){
+        e->direction = conn->connect_ns ? TLS_CLIENT : TLS_SERVER;
+        e->tcp_connect_ns = conn->connect_ns;
+        //Accepted connections enter the table established, connects once the SYN is sent
+        u64 established = conn->start_ns + conn->connect_ns;
+        if (hs.start_ns > established) e->tls_wait_ns = hs.start_ns - established;
+    }
+    e->duration_ns = now - hs.start_ns;
+    e->netns = sock_netns(sk);
+    e->state = se.state;
+    e->family = se.family;
+    __builtin_memcpy(e->saddr, se.saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se.daddr, sizeof(e->daddr));
+    e->sport = se.sport;
+    e->dport = se.dport;
+    submit_event(ctx, e);
+    return 0;
+}
+
+//The first socket a handshake call on this thread sends or receives on
+static __always_inline void tls_socket(struct sock *sk){
+    u32 tid = bpf_get_current_pid_tgid();
+    struct tls_key *k = bpf_map_lookup_elem(&tls_threads, &tid);
+    if (!k) return;
+    struct tls_handshake *h = bpf_map_lookup_elem(&tls_handshakes, k);
+    if (h && !h->skaddr) h->skaddr = (u64)sk;
+}
+
+SEC("uprobe/SSL_do_handshake")
+int BPF_UPROBE(uprobe_ssl_do_handshake, void *ssl){
+    return tls_enter(ssl);
+}
+
+SEC("uretprobe/SSL_do_handshake")
+int BPF_URETPROBE(uretprobe_ssl_do_handshake, int ret){
+    return tls_exit(ctx, ret);
+}
+
+//SSL_connect and SSL_accept start the handshake too, before calling SSL_do_handshake
+SEC("uprobe/SSL_connect")
+int BPF_UPROBE(uprobe_ssl_connect, void *ssl){
+    return tls_enter(ssl);
+}
+
+SEC("uretprobe/SSL_connect")
+int BPF_URETPROBE(uretprobe_ssl_connect, int ret){
+    return tls_exit(ctx, ret);
+}
+
+SEC("uprobe/SSL_accept")
+int BPF_UPROBE(uprobe_ssl_accept, void *ssl){
+    return tls_enter(ssl);
+}
+
+SEC("uretprobe/SSL_accept")
+int BPF_URETPROBE(uretprobe_ssl_accept, int ret){
+    return tls_exit(ctx, ret);
+}
+
+//A failed handshake's SSL may be freed and the address reused for the next one
+SEC("uprobe/SSL_free")
+int BPF_UPROBE(uprobe_ssl_free, void *ssl){
+    struct tls_key k = {.tgid = bpf_get_current_pid_tgid() >> 32, .ssl = (u64)ssl};
+    bpf_map_delete_elem(&tls_handshakes, &k);
+    return 0;
+}
+
+SEC("kprobe/tcp_sendmsg")
+int BPF_KPROBE(tls_tcp_sendmsg, struct sock *sk){
+    tls_socket(sk);
+    return 0;
+}
+
+SEC("kprobe/tcp_recvmsg")
+int BPF_KPROBE(tls_tcp_recvmsg, struct sock *sk){
+    tls_socket(sk);
+    return 0;
+}
+
+//Only samples connections already in the table, and each at most every RTT_SAMPLE_NS.
+//The congestion window is sampled with the RTT, the two explain throughput together
+static __always_inline void sample_rtt(struct sock *sk){
+    u64 key = (u64)sk;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (!conn) return;
+
+    u64 now = bpf_ktime_get_ns();
+    if (now - conn->rtt_last_ns < RTT_SAMPLE_NS) return;
+
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    u32 srtt = BPF_CORE_READ(tp, srtt_us) >> 3; //The kernel keeps 8x the smoothed RTT
+    if (!srtt) return;                         //No RTT measured yet
+    u32 rttvar = BPF_CORE_READ(tp, mdev_us) >> 2; //and 4x the mean deviation
+
+    //The socket is locked while tcp_rcv_established runs, so plain updates are safe
+    conn->rtt_last_ns = now;
+    conn->rtt_sum_us += srtt;
+    conn->rtt_samples++;
+    if (!conn->rtt_min_us || srtt < conn->rtt_min_us) conn->rtt_min_us = srtt;
+    if (srtt > conn->rtt_max_us) conn->rtt_max_us = srtt;
+    conn->rttvar_us = rttvar;
+    conn->snd_cwnd = BPF_CORE_READ(tp, snd_cwnd);
+    conn->snd_ssthresh = BPF_CORE_READ(tp, snd_ssthresh);
+    conn->reordering = BPF_CORE_READ(tp, reordering);
+    conn->bytes_acked = BPF_CORE_READ(tp, bytes_acked);
+    conn->bytes_received = BPF_CORE_READ(tp, bytes_received);
+    if (bpf_core_field_exists(tp->segs_out)) conn->segs_out = BPF_CORE_READ(tp, segs_out); //4.6+
+    struct inet_connection_sock *icsk = (struct inet_connection_sock *)sk;
+    BPF_CORE_READ_STR_INTO(&conn->ca_name, icsk, icsk_ca_ops, name); //setsockopt(TCP_CONGESTION) can change it
+    hist_record(conn->daddr, HIST_RTT, srtt);
+}
+
+//tcp_rcv_established runs for every segment on an established connection
+SEC("kprobe/tcp_rcv_established")
+int BPF_KPROBE(trace_tcp_rtt, struct sock *sk){
+    sample_rtt(sk);
+    return 0;
+}
+
+//A data segment that isn't the next one expected, on its way into the out-of-order
+//queue. How far ahead of rcv_nxt it starts is how far the path reordered it, or
+//how much was lost before it: a gap that fills in without retransmits was reordering.
+//Static in tcp_input.c, a kernel may have inlined it
+SEC("kprobe/tcp_data_queue_ofo")
+int BPF_KPROBE(trace_tcp_ooo, struct sock *sk, struct sk_buff *skb){
+    u64 key = (u64)sk;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (!conn) return 0;
+
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    struct tcp_skb_cb *cb = (struct tcp_skb_cb *)skb->cb; //TCP_SKB_CB()
+    u32 ahead = BPF_CORE_READ(cb, seq) - BPF_CORE_READ(tp, rcv_nxt);
+
+    //The socket is locked here too
+    conn->ooo_packets++;
+    if (ahead > conn->ooo_max_bytes) conn->ooo_max_bytes = ahead;
+    return 0;
+}
+
+static __always_inline int handle_dsack(void *ctx, struct sock *sk, struct conn_info *conn, u32 bytes){
+    if (!(event_mask & (1 << EVENT_DSACK))) return 0; //Only counted, saves reading the tuple
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    if (!allowed_conn(conn)) return 0;
+    if (!allowed_tuple(se.saddr, se.daddr, se.sport, se.dport)) return 0;
+    u32 netns = sock_netns(sk);
+    u32 suppressed;
+    if (conn_limited(EVENT_DSACK, netns, se.saddr, se.daddr, se.sport, se.dport, &suppressed)) return 0;
+
+    struct event *e = reserve_event(EVENT_DSACK);
+    if (!e) return 0;
+    if (conn) set_owner(e, conn);
+    e->suppressed = suppressed;
+    e->dsack_bytes = bytes;
+    e->netns = netns;
+    e->state = se.state;
+    e->family = se.family;
+    __builtin_memcpy(e->saddr, se.saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, se.daddr, sizeof(e->daddr));
+    e->sport = se.sport;
+    e->dport = se.dport;
+    submit_event(ctx, e);
+    return 0;
+}
+
+//One SACK block as it is on the wire, network byte order
+struct sack_block_wire{
+    u32 start_seq;
+    u32 end_seq;
+};
+
+//Only called for ACKs that carry SACK blocks. The first block being below the
+//cumulative ACK, or inside the second, makes it a DSACK (RFC 2883, tcp_check_dsack):
+//the peer received that segment twice, so our retransmit of it was spurious, unless
+//the network duplicated it. Static in tcp_input.c like tcp_data_queue_ofo
+SEC("kprobe/tcp_sacktag_write_queue")
+int BPF_KPROBE(trace_tcp_sack, struct sock *sk, struct sk_buff *ack_skb){
+    //On a received segment TCP_SKB_CB()->sacked is where the SACK option starts in the TCP header
+    struct tcp_skb_cb *cb = (struct tcp_skb_cb *)ack_skb->cb;
+    u8 offset = BPF_CORE_READ(cb, sacked);
+    u32 ack_seq = BPF_CORE_READ(cb, ack_seq);
+    unsigned char *opt = BPF_CORE_READ(ack_skb, head) + BPF_CORE_READ(ack_skb, transport_header) + offset;
+
+    u8 len; //Kind, length, then 8 bytes per block
+    if (bpf_probe_read_kernel(&len, sizeof(len), opt + 1)) return 0;
+    u32 blocks = (len - 2) >> 3;
+    if (blocks > 4) blocks = 4;
+    struct sack_block_wire b[2] = {};
+    if (bpf_probe_read_kernel(b, sizeof(b), opt + 2)) return 0;
+
+    u32 start = bpf_ntohl(b[0].start_seq), end = bpf_ntohl(b[0].end_seq);
+    bool dsack = (s32)(start - ack_seq) < 0;
+    if (!dsack && blocks > 1)
+        dsack = (s32)(end - bpf_ntohl(b[1].end_seq)) <= 0 && (s32)(start - bpf_ntohl(b[1].start_seq)) >= 0;
+
+    u64 key = (u64)sk;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    if (conn){ //Locked by tcp_ack like the RTT sample
+        conn->sacks++;
+        conn->sack_blocks += blocks;
+        if (dsack){
+            conn->dsacks++;
+            conn->dsack_bytes += end - start;
+        }
+    }
+    if (!dsack) return 0;
+    return handle_dsack(ctx, sk, conn, end - start);
+}
+
+//--sockops: the retransmit, state and RTT probes as one sock_ops program on the
+//root cgroup. The kernel calls it directly rather than through a breakpoint or
+//tracepoint, but only for connections that asked for the callbacks, so ones
+//opened before it was attached go unseen. sockops_cbs is the
+//BPF_SOCK_OPS_*_CB_FLAG bits userspace wants, see sockops.go
+const volatile u32 sockops_cbs = 0;
+
+SEC("sockops")
+int tcp_sockops(struct bpf_sock_ops *skops){
+    struct bpf_sock *bsk = skops->sk;
+    if (!bsk) return 1;
+    struct tcp_sock *tp = bpf_skc_to_tcp_sock(bsk);
+    if (!tp) return 1;
+    struct sock *sk = (struct sock *)tp;
+    struct sock_event se = {};
+
+    switch (skops->op){
+    case BPF_SOCK_OPS_TCP_CONNECT_CB:
+        //connect() has already moved to SYN_SENT, before the callbacks were on,
+        //so that transition is reported from here, still in the connecting task
+        bpf_sock_ops_cb_flags_set(skops, sockops_cbs);
+        if (!(sockops_cbs & BPF_SOCK_OPS_STATE_CB_FLAG)) return 1;
+        if (!read_sock_event(sk, &se)) return 1;
+        se.old_state = TCP_CLOSE;
+        handle_state(skops, &se, false);
+        return 1;
+    case BPF_SOCK_OPS_PASSIVE_ESTABLISHED_CB:
+        //The accepted child is still in SYN_RECV, its move to ESTABLISHED is the next state callback
+        bpf_sock_ops_cb_flags_set(skops, sockops_cbs);
+        return 1;
+    case BPF_SOCK_OPS_STATE_CB:
+        //Called before the socket changes state, the states are the arguments
+        if (!read_sock_event(sk, &se)) return 1;
+        se.old_state = skops->args[0];
+        se.state = skops->args[1];
+        handle_state(skops, &se, false);
+        return 1;
+    case BPF_SOCK_OPS_RETRANS_CB:
+        if (skops->args[2]) return 1; //Failed before the segment went out, the tracepoint doesn't see those either
+        if (!read_sock_event(sk, &se)) return 1;
+        handle_retransmit(skops, &se);
+        return 1;
+    case BPF_SOCK_OPS_RTT_CB:
+        sample_rtt(sk);
+        return 1;
+    }
+    return 1;
+}
+
+//--enforce: connect() to a destination matching a rule fails with EPERM, from cgroup
+//connect4/connect6 programs on the root cgroup, and an EVENT_BLOCKED says which rule
+//did it. Userspace writes the rules into free slots and zeroes them to remove them,
+//enforce_slots is one past the last slot in use so connects don't walk all of them.
+//See enforce.go
+#define ENFORCE_MAX_RULES 64
+
+struct enforce_rule{
+    u64 cgroup_id;    //0 for every task, otherwise tasks in this cgroup or below it
+    u32 cgroup_level; //Depth of cgroup_id under the root cgroup, for bpf_get_current_ancestor_cgroup_id
+    u16 port;         //Host byte order, 0 for every port
+    u8 protocol;      //IPPROTO_TCP or IPPROTO_UDP, 0 for both
+    u8 used;          //0 for a free slot
+    u8 addr[16];      //Masked, IPv4 stored IPv4-mapped like struct event
+    u8 mask[16];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, ENFORCE_MAX_RULES);
+    __type(key, u32);
+    __type(value, struct enforce_rule);
+} enforce_rules SEC(".maps");
+
+//Per-CPU connects each slot's rule blocked, cleared when the slot is reused
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, ENFORCE_MAX_RULES);
+    __type(key, u32);
+    __type(value, u64);
+} enforce_blocked SEC(".maps");
+
+//Writable like the filter switches, rules come and go while the programs run
+volatile u32 enforce_slots = 0;
+
+static __always_inline bool rule_matches(struct enforce_rule *r, const u64 *addr, u16 port, u8 protocol){
+    if (!r->used) return false;
+    if (r->port && r->port != port) return false;
+    if (r->protocol && r->protocol != protocol) return false;
+    u64 a[2], m[2];
+    __builtin_memcpy(a, r->addr, sizeof(a));
+    __builtin_memcpy(m, r->mask, sizeof(m));
+    if ((addr[0] & m[0]) != a[0] || (addr[1] & m[1]) != a[1]) return false;
+    //Last, it's the one helper call; 0 past the task's own level, so deeper rules don't match
+    if (r->cgroup_id && bpf_get_current_ancestor_cgroup_id(r->cgroup_level) != r->cgroup_id) return false;
+    return true;
+}
+
+//Returns 0 to fail the connect with EPERM, 1 to let it through
+static __always_inline int enforce(struct bpf_sock_addr *ctx, u32 family, const u64 *addr){
+    u16 port = bpf_ntohs(ctx->user_port);
+    u8 protocol = ctx->protocol;
+    for (u32 i = 0; i < ENFORCE_MAX_RULES; i++){
+        if (i >= enforce_slots) break;
+        struct enforce_rule *r = bpf_map_lookup_elem(&enforce_rules, &i);
+        if (!r || !rule_matches(r, addr, port, protocol)) continue;
+
+        u64 *blocked = bpf_map_lookup_elem(&enforce_blocked, &i);
+        if (blocked) (*blocked)++; //Per-CPU, no atomics needed
+        if (!allowed_current()) return 0; //Blocked all the same, just not reported
+        struct event *e = reserve_event(EVENT_BLOCKED);
+        if (!e) return 0;
+        e->family = family;
+        __builtin_memcpy(e->daddr, addr, sizeof(e->daddr));
+        e->dport = port;
+        e->protocol = protocol == IPPROTO_UDP ? IPPROTO_UDP : 0;
+        e->reason = i + 1; //The rule's id, its slot + 1
+        submit_event(ctx, e);
+        return 0;
+    }
+    return 1;
+}
+
+SEC("cgroup/connect4")
+int enforce_connect4(struct bpf_sock_addr *ctx){
+    u32 ip4 = ctx->user_ip4; //Network byte order
+    u64 addr[2];
+    set_addr((u8 *)addr, AF_INET, (u8 *)&ip4, 0);
+    return enforce(ctx, AF_INET, addr);
+}
+
+SEC("cgroup/connect6")
+int enforce_connect6(struct bpf_sock_addr *ctx){
+    //The context only allows loads of the whole u32s. v4-mapped destinations of dual-stack
+    //sockets are matched here, their connect doesn't go through connect4.
+    u32 ip6[4] = {ctx->user_ip6[0], ctx->user_ip6[1], ctx->user_ip6[2], ctx->user_ip6[3]};
+    u64 addr[2];
+    __builtin_memcpy(addr, ip6, sizeof(addr));
+    return enforce(ctx, AF_INET6, addr);
+}
+
+//Bytes per (process, connection) for the top mode, read and cleared every --interval (see top.go)
+struct top_key{
+    u32 pid;
+    u32 family;
+    u8 saddr[16]; //Local end, same form as struct event
+    u8 daddr[16];
+    u16 sport;
+    u16 dport;
+};
+
+struct top_value{
+    u64 sent;
+    u64 received;
+    char comm[TASK_COMM_LEN];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, struct top_key);
+    __type(value, struct top_value);
+} top_bytes SEC(".maps");
+
+static __always_inline bool read_sock_tuple(struct sock *sk, struct top_key *k){
+    return read_sock_addrs(sk, &k->family, k->saddr, k->daddr, &k->sport, &k->dport);
+}
+
+//Both probes run in the context of the process doing the read/write, so the current task is the right owner
+static __always_inline void top_add(struct sock *sk, u64 sent, u64 received){
+    if (!allowed_current()) return;
+
+    struct top_key key = {.pid = bpf_get_current_pid_tgid() >> 32};
+    if (!read_sock_tuple(sk, &key)) return;
+    if (!allowed_tuple(key.saddr, key.daddr, key.sport, key.dport)) return;
+
+    struct top_value *v = bpf_map_lookup_elem(&top_bytes, &key);
+    if (!v){
+        struct top_value init = {};
+        bpf_get_current_comm(&init.comm, sizeof(init.comm));
+        bpf_map_update_elem(&top_bytes, &key, &init, BPF_NOEXIST);
+        v = bpf_map_lookup_elem(&top_bytes, &key);
+        if (!v) return; //Table full until the next interval
+    }
+    if (sent) __sync_fetch_and_add(&v->sent, sent);
+    if (received) __sync_fetch_and_add(&v->received, received);
+}
+
+//Counts what the process asked to send, like tcptop, whether or not it all fit in the send buffer
+SEC("kprobe/tcp_sendmsg")
+int BPF_KPROBE(trace_tcp_sendmsg, struct sock *sk, struct msghdr *msg, size_t size){
+    top_add(sk, size, 0);
+    return 0;
+}
+
+//Called after data was copied to userspace, copied is the byte count
+SEC("kprobe/tcp_cleanup_rbuf")
+int BPF_KPROBE(trace_tcp_cleanup_rbuf, struct sock *sk, int copied){
+    if (copied <= 0) return 0;
+    top_add(sk, 0, copied);
+    return 0;
+}
+
+//Bytes for --cgroup-metrics, on the same functions as the top probe but without its tuple key
+//Both run in the reading or writing process, whose cgroup stands in on kernels without sock_cgroup
+static __always_inline void cgroup_add_bytes(struct sock *sk, u64 sent, u64 received){
+    if (!allowed_current()) return;
+    if (filter_by_port || filter_by_cidr){
+        struct top_key t = {};
+        if (!read_sock_tuple(sk, &t) || !allowed_tuple(t.saddr, t.daddr, t.sport, t.dport)) return;
+    }
+    u64 id = sock_cgroup(sk);
+    if (!id) id = bpf_get_current_cgroup_id();
+    struct cgroup_stats *s = cgroup_stats_of(id);
+    if (!s) return;
+    s->bytes_sent += sent;
+    s->bytes_received += received;
+}
+
+SEC("kprobe/tcp_sendmsg")
+int BPF_KPROBE(cgroup_tcp_sendmsg, struct sock *sk, struct msghdr *msg, size_t size){
+    cgroup_add_bytes(sk, size, 0);
+    return 0;
+}
+
+SEC("kprobe/tcp_cleanup_rbuf")
+int BPF_KPROBE(cgroup_tcp_cleanup_rbuf, struct sock *sk, int copied){
+    if (copied <= 0) return 0;
+    cgroup_add_bytes(sk, 0, copied);
+    return 0;
+}
+
+//SYN and accept queue overflows per listening socket for the listen command,
+//read and cleared every --interval like top_bytes (see listen.go)
+struct listen_drop_count{
+    u32 family;
+    u8 saddr[16];     //Listening address, same form as struct event
+    u16 sport;
+    u16 pad;          //Zeroed, so the value has no holes with garbage in them
+    u32 netns;
+    u32 backlog;      //Accept queue length at the last drop
+    u32 max_backlog;  //The listen() backlog, capped at net.core.somaxconn
+    u32 pad2;         //Zeroed too, inode is 8 byte aligned on every architecture
+    u64 inode;        //Socket inode, userspace finds the server by it in /proc/<pid>/fd
+    u64 syn_queue_drops;    //SYNs dropped with the SYN queue full and syncookies off (TcpExtTCPReqQFullDrop)
+    u64 accept_queue_drops; //SYNs and handshake ACKs dropped with the accept queue full (TcpExtListenOverflows)
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1024);
+    __type(key, u64); //struct sock address of the listener, SO_REUSEPORT listeners each have their own queues
+    __type(value, struct listen_drop_count);
+} listen_drops SEC(".maps");
+
+#define LISTEN_SYN_QUEUE    1
+#define LISTEN_ACCEPT_QUEUE 2
+
+//Older kernels have u16 backlog fields and an int for syncookies,
+//the bitfield reads cope with whichever size the kernel has
+static __always_inline bool accept_queue_full(struct sock *sk){
+    return BPF_CORE_READ_BITFIELD_PROBED(sk, sk_ack_backlog) > BPF_CORE_READ_BITFIELD_PROBED(sk, sk_max_ack_backlog);
+}
+
+static __always_inline void count_listen_drop(struct sock *sk, u32 queue){
+    struct listen_drop_count init = {};
+    u8 daddr[16];
+    u16 dport;
+    if (!read_sock_addrs(sk, &init.family, init.saddr, daddr, &init.sport, &dport)) return;
+    if (!allowed_tuple(init.saddr, daddr, init.sport, dport)) return;
+
+    u64 key = (u64)sk;
+    struct listen_drop_count *v = bpf_map_lookup_elem(&listen_drops, &key);
+    if (!v){
+        init.netns = sock_netns(sk);
+        init.inode = BPF_CORE_READ(sk, sk_socket, file, f_inode, i_ino);
+        bpf_map_update_elem(&listen_drops, &key, &init, BPF_NOEXIST);
+        v = bpf_map_lookup_elem(&listen_drops, &key);
+        if (!v) return; //Table full until the next interval
+    }
+    v->backlog = BPF_CORE_READ_BITFIELD_PROBED(sk, sk_ack_backlog);
+    v->max_backlog = BPF_CORE_READ_BITFIELD_PROBED(sk, sk_max_ack_backlog);
+    if (queue == LISTEN_SYN_QUEUE) __sync_fetch_and_add(&v->syn_queue_drops, 1);
+    else __sync_fetch_and_add(&v->accept_queue_drops, 1);
+}
+
+//A SYN to a listener, checked the way tcp_conn_request goes on to check it:
+//with the SYN queue full it's answered with a cookie, or dropped if syncookies are off,
+//then with the accept queue full it's dropped either way
+SEC("kprobe/tcp_conn_request")
+int BPF_KPROBE(trace_tcp_conn_request, struct request_sock_ops *rsk_ops, void *af_ops, struct sock *sk){
+    struct inet_connection_sock *icsk = (void *)sk;
+    u32 qlen = BPF_CORE_READ(icsk, icsk_accept_queue.qlen.counter);
+    struct net *net = BPF_CORE_READ(sk, __sk_common.skc_net.net);
+    u32 syncookies = BPF_CORE_READ_BITFIELD_PROBED(net, ipv4.sysctl_tcp_syncookies);
+
+    if (!syncookies && qlen >= BPF_CORE_READ_BITFIELD_PROBED(sk, sk_max_ack_backlog)){
+        count_listen_drop(sk, LISTEN_SYN_QUEUE);
+        return 0;
+    }
+    if (accept_queue_full(sk)) count_listen_drop(sk, LISTEN_ACCEPT_QUEUE);
+    return 0;
+}
+
+//The ACK completing a handshake: with the accept queue full there's nowhere to put
+//the new socket, so the ACK is dropped and the client sends it again later
+//(or is reset, with net.ipv4.tcp_abort_on_overflow)
+SEC("kprobe/tcp_v4_syn_recv_sock")
+int BPF_KPROBE(trace_tcp_v4_syn_recv_sock, struct sock *sk){
+    if (accept_queue_full(sk)) count_listen_drop(sk, LISTEN_ACCEPT_QUEUE);
+    return 0;
+}
+
+//IPv4 handshakes on a dual-stack listener go on to tcp_v4_syn_recv_sock, and are counted there
+SEC("kprobe/tcp_v6_syn_recv_sock")
+int BPF_KPROBE(trace_tcp_v6_syn_recv_sock, struct sock *sk, struct sk_buff *skb){
+    if (BPF_CORE_READ(skb, protocol) == bpf_htons(ETH_P_IP)) return 0;
+    if (accept_queue_full(sk)) count_listen_drop(sk, LISTEN_ACCEPT_QUEUE);
+    return 0;
+}
+
+//Listeners coming and going, and the bind() and listen() calls that failed, for the
+//listen command's inventory (see listeners.go). listen() has the backlog capped at
+//somaxconn before inet_listen sees it, so what was asked for is gone, only the cap is left.
+//IPv6 sockets are bound with inet6_bind, and listen with inet_listen like IPv4 ones.
+struct listen_call{
+    struct sock *sk;
+    u32 old_state;
+    u32 pad;
+    u8 sa[28]; //bind() only: the sockaddr_in/sockaddr_in6 asked for
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //A kretprobe that missed its return can't leak entries
+    __uint(max_entries, 1024);
+    __type(key, u64); //pid_tgid, both run in the caller
+    __type(value, struct listen_call);
+} listen_calls SEC(".maps");
+
+static __always_inline int listen_enter(struct sock *sk, const void *uaddr){
+    if (!sk || BPF_CORE_READ_BITFIELD_PROBED(sk, sk_protocol) != IPPROTO_TCP) return 0;
+    if (!allowed_current()) return 0;
+    struct listen_call c = {.sk = sk, .old_state = BPF_CORE_READ(sk, __sk_common.skc_state)};
+    if (uaddr) bpf_probe_read_kernel(c.sa, sizeof(c.sa), uaddr); //Already copied into the kernel
+    u64 id = bpf_get_current_pid_tgid();
+    bpf_map_update_elem(&listen_calls, &id, &c, BPF_ANY);
+    return 0;
+}
+
+static __always_inline struct event *reserve_listen(struct sock *sk, u32 direction, const u8 *saddr, u16 sport, u32 family){
+    u8 daddr[16] = {};
+    if (!allowed_tuple(saddr, daddr, sport, 0)) return 0;
+    struct event *e = reserve_event(EVENT_LISTEN);
+    if (!e) return 0;
+    e->direction = direction;
+    e->family = family;
+    __builtin_memcpy(e->saddr, saddr, sizeof(e->saddr));
+    e->sport = sport;
+    e->netns = sock_netns(sk);
+    e->state = BPF_CORE_READ(sk, __sk_common.skc_state);
+    e->backlog = BPF_CORE_READ_BITFIELD_PROBED(sk, sk_max_ack_backlog);
+    return e;
+}
+
+SEC("kprobe/inet_listen")
+int BPF_KPROBE(kprobe_inet_listen, struct socket *sock){
+    return listen_enter(BPF_CORE_READ(sock, sk), 0);
+}
+
+SEC("kretprobe/inet_listen")
+int BPF_KRETPROBE(kretprobe_inet_listen, int ret){
+    u64 id = bpf_get_current_pid_tgid();
+    struct listen_call *p = bpf_map_lookup_elem(&listen_calls, &id);
+    if (!p) return 0;
+    struct sock *sk = p->sk;
+    u32 old_state = p->old_state;
+    bpf_map_delete_elem(&listen_calls, &id);
+
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    struct event *e = reserve_listen(sk, ret < 0 ? LISTEN_FAILED : LISTEN_STARTED, se.saddr, se.sport, se.family);
+    if (!e) return 0;
+    if (ret < 0) e->reason = -ret;
+    e->old_state = old_state;
+    e->somaxconn = BPF_CORE_READ(sk, __sk_common.skc_net.net, core.sysctl_somaxconn);
+    submit_event(ctx, e);
+    return 0;
+}
+
+static __always_inline int bind_exit(void *ctx, int ret){
+    u64 id = bpf_get_current_pid_tgid();
+    struct listen_call *p = bpf_map_lookup_elem(&listen_calls, &id);
+    if (!p) return 0;
+    struct listen_call c = *p;
+    bpf_map_delete_elem(&listen_calls, &id);
+    if (ret >= 0) return 0;
+
+    u16 family;
+    u8 saddr[16];
+    u16 sport;
+    read_sockaddr(c.sa, &family, saddr, &sport);
+    if (family != AF_INET && family != AF_INET6) return 0;
+    struct event *e = reserve_listen(c.sk, BIND_FAILED, saddr, sport, family);
+    if (!e) return 0;
+    e->reason = -ret;
+    e->backlog = 0;
+    submit_event(ctx, e);
+    return 0;
+}
+
+SEC("kprobe/inet_bind")
+int BPF_KPROBE(kprobe_inet_bind, struct socket *sock, void *uaddr){
+    return listen_enter(BPF_CORE_READ(sock, sk), uaddr);
+}
+
+SEC("kretprobe/inet_bind")
+int BPF_KRETPROBE(kretprobe_inet_bind, int ret){
+    return bind_exit(ctx, ret);
+}
+
+SEC("kprobe/inet6_bind")
+int BPF_KPROBE(kprobe_inet6_bind, struct socket *sock, void *uaddr){
+    return listen_enter(BPF_CORE_READ(sock, sk), uaddr);
+}
+
+SEC("kretprobe/inet6_bind")
+int BPF_KRETPROBE(kretprobe_inet6_bind, int ret){
+    return bind_exit(ctx, ret);
+}
+
+//A listener closing still has its port here: by inet_csk_listen_stop the state change
+//may have given back one that listen() picked itself
+SEC("kprobe/tcp_close")
+int BPF_KPROBE(kprobe_tcp_close, struct sock *sk){
+    if (BPF_CORE_READ(sk, __sk_common.skc_state) != TCP_LISTEN) return 0;
+    if (!allowed_current()) return 0;
+    struct sock_event se = {};
+    if (!read_sock_event(sk, &se)) return 0;
+    struct event *e = reserve_listen(sk, LISTEN_CLOSED, se.saddr, se.sport, se.family);
+    if (!e) return 0;
+    e->accept_queue = BPF_CORE_READ_BITFIELD_PROBED(sk, sk_ack_backlog);
+    submit_event(ctx, e);
+    return 0;
+}
+
+static __always_inline void send_fastopen(void *ctx, struct tuple *t, struct conn_info *conn, u32 netns,
+                                          u32 state, u32 direction, u32 outcome){
+    if (!allowed_conn(conn)) return;
+    if (!allowed_tuple(t->saddr, t->daddr, t->sport, t->dport)) return;
+
+    struct event *e = reserve_event(EVENT_FASTOPEN);
+    if (!e) return;
+    if (conn) set_owner(e, conn);
+    e->direction = direction;
+    e->reason = outcome;
+    e->state = state;
+    e->netns = netns;
+    e->family = t->family;
+    __builtin_memcpy(e->saddr, t->saddr, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, t->daddr, sizeof(e->daddr));
+    e->sport = t->sport;
+    e->dport = t->dport;
+    submit_event(ctx, e);
+}
+
+//Client side: tcp_rcv_fastopen_synack remembers the cookie of the SYN-ACK for the
+//next connect, for any connect that wanted TFO (MSG_FASTOPEN or TCP_FASTOPEN_CONNECT).
+//By then the SYN-ACK was acknowledged, and data in our SYN it didn't cover is still
+//queued to be retransmitted
+SEC("kprobe/tcp_fastopen_cache_set")
+int BPF_KPROBE(trace_tcp_fastopen_cache_set, struct sock *sk, u16 mss, struct tcp_fastopen_cookie *cookie){
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    if (!BPF_CORE_READ_BITFIELD_PROBED(tp, syn_fastopen)) return 0; //A cookie we didn't ask for
+
+    u32 outcome;
+    if (BPF_CORE_READ_BITFIELD_PROBED(tp, syn_data)){
+        if (!BPF_CORE_READ(sk, tcp_rtx_queue.rb_node)) outcome = FASTOPEN_ACCEPTED;
+        else if (BPF_CORE_READ(tp, total_retrans)) outcome = FASTOPEN_SYN_RETRANSMITTED;
+        else outcome = FASTOPEN_DATA_NOT_ACKED;
+    } else if (bpf_core_field_exists(tp->fastopen_client_fail) &&
+               BPF_CORE_READ_BITFIELD_PROBED(tp, fastopen_client_fail) != TFO_CLIENT_COOKIE_UNAVAILABLE){
+        outcome = FASTOPEN_BLACKHOLE; //A plain SYN, without even the cookie request
+    } else {
+        outcome = BPF_CORE_READ(cookie, len) > 0 ? FASTOPEN_COOKIE_REQUEST : FASTOPEN_NO_COOKIE;
+    }
+
+    struct tuple t = {};
+    if (!read_sock_addrs(sk, &t.family, t.saddr, t.daddr, &t.sport, &t.dport)) return 0;
+    u64 key = (u64)sk;
+    struct conn_info *conn = bpf_map_lookup_elem(&conns, &key);
+    send_fastopen(ctx, &t, conn, sock_netns(sk), BPF_CORE_READ(sk, __sk_common.skc_state), FASTOPEN_SENT, outcome);
+    return 0;
+}
+
+//Server side: what tcp_try_fastopen was called with, kept until it returns
+struct fastopen_syn{
+    struct tcp_fastopen_cookie *foc; //Holds the cookie for the SYN-ACK on return
+    s32 cookie_len; //-1 without the option, 0 for a cookie request
+    u32 netns;
+    struct tuple t; //Our end first, from the request socket
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //A kretprobe that missed its return can't leak entries
+    __uint(max_entries, 4096);
+    __type(key, u64); //pid_tgid, of whoever the softirq handling the SYN interrupted
+    __type(value, struct fastopen_syn);
+} fastopen_syns SEC(".maps");
+
+//tcp_conn_request calls it for every SYN it doesn't answer with a syncookie
+SEC("kprobe/tcp_try_fastopen")
+int BPF_KPROBE(kprobe_tcp_try_fastopen, struct sock *sk, struct sk_buff *skb, struct request_sock *req,
+               struct tcp_fastopen_cookie *foc){
+    struct fastopen_syn s = {.foc = foc, .cookie_len = BPF_CORE_READ(foc, len)};
+    struct tcp_skb_cb *cb = (struct tcp_skb_cb *)skb->cb; //TCP_SKB_CB()
+    bool data = BPF_CORE_READ(cb, end_seq) != BPF_CORE_READ(cb, seq) + 1;
+    if (s.cookie_len < 0 && !data) return 0; //A plain SYN
+
+    //The request socket already has the tuple, like the child will
+    if (!read_sock_addrs((struct sock *)req, &s.t.family, s.t.saddr, s.t.daddr, &s.t.sport, &s.t.dport)) return 0;
+    s.netns = sock_netns(sk);
+    u64 id = bpf_get_current_pid_tgid();
+    bpf_map_update_elem(&fastopen_syns, &id, &s, BPF_ANY);
+    return 0;
+}
+
+//The child socket for an accepted SYN. Otherwise the cookie it left in foc tells
+//why not: a fresh one for cookie requests and wrong cookies, none when refused
+SEC("kretprobe/tcp_try_fastopen")
+int BPF_KRETPROBE(kretprobe_tcp_try_fastopen, struct sock *child){
+    u64 id = bpf_get_current_pid_tgid();
+    struct fastopen_syn *p = bpf_map_lookup_elem(&fastopen_syns, &id);
+    if (!p) return 0;
+    struct fastopen_syn s = *p;
+    bpf_map_delete_elem(&fastopen_syns, &id);
+
+    u32 outcome;
+    if (child){
+        outcome = FASTOPEN_ACCEPTED;
+    } else {
+        if (s.cookie_len < 0) return 0; //Data without the option, not TFO after all
+        bool cookie = BPF_CORE_READ(s.foc, len) > 0;
+        if (s.cookie_len == 0) outcome = cookie ? FASTOPEN_COOKIE_REQUEST : FASTOPEN_REFUSED;
+        else outcome = cookie ? FASTOPEN_INVALID_COOKIE : FASTOPEN_REFUSED;
+    }
+    u32 state = child ? BPF_CORE_READ(child, __sk_common.skc_state) : 0;
+    send_fastopen(ctx, &s.t, 0, s.netns, state, FASTOPEN_RECEIVED, outcome);
+    return 0;
+}
+
+//--interface: TCP segments on their way in, counted per interface at tc ingress or in XDP,
+//and again when tcp_v4_rcv/tcp_v6_rcv get them. What arrived and never got to TCP was dropped
+//in between (netfilter, another tc or XDP program, IP's own checks; with an skb those also go
+//through kfree_skb, and have a reason) or was for another host. Malformed segments the stack
+//throws away are counted on their own. GRO merges segments into one skb, so an skb counts as
+//the segments it was made of, and XDP (before GRO) and tc (after) count the same.
+//Userspace creates an entry for each --interface, nothing else is counted.
+#define TC_ACT_UNSPEC -1 //On to the next program, or the stack
+#define ETH_HLEN      14
+
+#define TCP_FLAG_FIN 0x01
+#define TCP_FLAG_SYN 0x02
+#define TCP_FLAG_RST 0x04
+#define TCP_FLAG_ACK 0x10
+
+//Inode of the netns the interfaces are in, so a container's tcp_v4_rcv on an interface with
+//the same ifindex isn't counted. 0 = --interface is off
+const volatile u32 prestack_netns = 0;
+
+struct prestack_stats{
+    u64 segments;   //TCP segments that arrived
+    u64 bytes;      //Their length from the IP header on
+    u64 reached;    //Segments tcp_v4_rcv/tcp_v6_rcv got
+    u64 truncated;  //Shorter than their IP header says, or than a TCP header
+    u64 bad_header; //An IP header length, total length or TCP data offset that can't be right
+    u64 bad_flags;  //None of SYN, ACK and RST, or SYN with FIN or RST: scans, the stack discards them
+    u64 syns;       //SYNs without an ACK among the rest: new connections, or a flood of them
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_HASH); //Bumped without atomics
+    __uint(max_entries, 1); //Sized from userspace to the --interface list
+    __type(key, u32); //ifindex
+    __type(value, struct prestack_stats);
+} prestack_stats SEC(".maps");
+
+//802.1Q, the tag XDP still sees; tc ingress gets frames with it taken off already
+struct prestack_vlan{
+    __be16 tci;
+    __be16 proto;
+};
+
+//What the IP header of an arriving TCP segment says
+struct prestack_ip{
+    u32 hlen; //Of the IP header
+    u32 len;  //Of the packet from the IP header on
+    u32 family;
+    u8 saddr[16]; //IPv4-mapped, as in events
+    u8 daddr[16];
+};
+
+//False for what isn't TCP, and for fragments: TCP only sees them reassembled
+//A length of 0 is BIG TCP's GRO packets over 64KB, those are as long as what arrived
+static __always_inline bool prestack_ipv4(const struct iphdr *iph, u32 arrived, struct prestack_ip *ip){
+    if (iph->protocol != IPPROTO_TCP) return false;
+    if (bpf_ntohs(iph->frag_off) & 0x3fff) return false; //More fragments, or an offset
+    ip->hlen = iph->ihl * 4;
+    ip->len = bpf_ntohs(iph->tot_len);
+    if (!ip->len) ip->len = arrived;
+    ip->family = AF_INET;
+    set_addr(ip->saddr, AF_INET, (const u8 *)&iph->saddr, 0);
+    set_addr(ip->daddr, AF_INET, (const u8 *)&iph->daddr, 0);
+    return true;
+}
+
+//Extension headers aren't followed, TCP behind them isn't counted
+static __always_inline bool prestack_ipv6(const struct ipv6hdr *ip6h, u32 arrived, struct prestack_ip *ip){
+    if (ip6h->nexthdr != IPPROTO_TCP) return false;
+    ip->hlen = sizeof(*ip6h);
+    ip->len = ip6h->payload_len ? sizeof(*ip6h) + bpf_ntohs(ip6h->payload_len) : arrived;
+    ip->family = AF_INET6;
+    set_addr(ip->saddr, AF_INET6, 0, (const u8 *)&ip6h->saddr);
+    set_addr(ip->daddr, AF_INET6, 0, (const u8 *)&ip6h->daddr);
+    return true;
+}
+
+//Counts a segment of arrived bytes from the IP header on, whose TCP header is th when all
+//of it is there. segs is what GRO made it of, 0 when it didn't touch it
+static __always_inline void prestack_count(struct prestack_stats *s, u32 segs, u32 arrived, const struct prestack_ip *ip, const u8 *th){
+    if (!segs) segs = 1;
+    s->segments += segs;
+    s->bytes += arrived;
+    if (ip->hlen < 20 || ip->len < ip->hlen + 20){
+        s->bad_header += segs;
+        return;
+    }
+    if (!th || arrived < ip->len){
+        s->truncated += segs;
+        return;
+    }
+    u8 doff = th[12] >> 4, flags = th[13];
+    if (doff < 5 || ip->len < ip->hlen + doff * 4){
+        s->bad_header += segs;
+        return;
+    }
+    if (!(flags & (TCP_FLAG_SYN | TCP_FLAG_ACK | TCP_FLAG_RST)) ||
+        ((flags & TCP_FLAG_SYN) && (flags & (TCP_FLAG_FIN | TCP_FLAG_RST)))){
+        s->bad_flags += segs;
+        return;
+    }
+    if ((flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == TCP_FLAG_SYN) s->syns += segs;
+}
+
+//--syn-flood: SYNs per second from one source prefix that flag it, 0 = off. Prefixes are the
+//first syn_prefix4 bits of IPv4 sources, syn_prefix6 of IPv6 ones
+const volatile u32 syn_flood_threshold = 0;
+const volatile u32 syn_prefix4 = 24;
+const volatile u32 syn_prefix6 = 64;
+
+#define SYN_WINDOW_NS 1000000000ULL
+
+struct syn_source{
+    u8 prefix[16]; //The source address with the host bits cleared, IPv4-mapped
+};
+
+struct syn_window{
+    u64 start_ns; //When the current second began
+    u32 syns;     //SYNs in it so far
+    u32 flagged;  //Past syn_flood_threshold, the event for this second went out
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH); //A source busy flooding stays, quiet ones make room
+    __uint(max_entries, 1); //Sized from userspace with --syn-flood
+    __type(key, struct syn_source);
+    __type(value, struct syn_window);
+} syn_sources SEC(".maps");
+
+//Clears all but the first bits of addr
+static __always_inline void mask_prefix(u8 *addr, u32 bits){
+    #pragma unroll
+    for (int i = 0; i < 16; i++){
+        if (bits >= 8){
+            bits -= 8;
+            continue;
+        }
+        addr[i] &= (u8)(0xff00 >> bits);
+        bits = 0;
+    }
+}
+
+//Counts a SYN against its source prefix, and sends EVENT_SYN_FLOOD the first time in a second
+//the prefix sends more than syn_flood_threshold. Like conn_limited, two CPUs starting a new
+//second at once may lose a SYN or two, or send the event twice.
+static __always_inline void prestack_syn(void *ctx, u32 ifindex, const struct prestack_ip *ip, const u8 *th){
+    if (!syn_flood_threshold || !th) return;
+    if ((th[13] & (TCP_FLAG_SYN | TCP_FLAG_ACK | TCP_FLAG_RST | TCP_FLAG_FIN)) != TCP_FLAG_SYN) return;
+
+    struct syn_source src = {};
+    __builtin_memcpy(src.prefix, ip->saddr, sizeof(src.prefix));
+    u32 prefix_len = ip->family == AF_INET ? syn_prefix4 : syn_prefix6;
+    mask_prefix(src.prefix, ip->family == AF_INET ? 96 + prefix_len : prefix_len);
+
+    u64 now = bpf_ktime_get_ns();
+    struct syn_window *w = bpf_map_lookup_elem(&syn_sources, &src);
+    if (!w){
+        struct syn_window init = {.start_ns = now, .syns = 1};
+        bpf_map_update_elem(&syn_sources, &src, &init, BPF_NOEXIST);
+        return;
+    }
+    if (now - w->start_ns >= SYN_WINDOW_NS){
+        w->start_ns = now;
+        w->syns = 1;
+        w->flagged = 0;
+        return;
+    }
+    u32 syns = __sync_fetch_and_add(&w->syns, 1) + 1;
+    if (syns <= syn_flood_threshold || w->flagged) return;
+    w->flagged = 1;
+
+    struct event *e = reserve_packet_event(EVENT_SYN_FLOOD);
+    if (!e) return;
+    e->family = ip->family;
+    __builtin_memcpy(e->saddr, src.prefix, sizeof(e->saddr));
+    __builtin_memcpy(e->daddr, ip->daddr, sizeof(e->daddr)); //Where the SYN that tipped it went
+    e->dport = (th[2] << 8) | th[3];
+    e->duration_ns = now - w->start_ns;
+    e->ifindex = ifindex;
+    e->prefix_len = prefix_len;
+    e->syns = syns;
+    submit_event(ctx, e);
+}
+
+//tc ingress: after GRO, before netfilter and IP. The headers are copied out rather than
+//read in place, they may not be in the linear part of the skb
+SEC("tc")
+int prestack_tc(struct __sk_buff *skb){
+    u32 ifindex = skb->ifindex;
+    struct prestack_stats *s = bpf_map_lookup_elem(&prestack_stats, &ifindex);
+    if (!s || skb->len < ETH_HLEN) return TC_ACT_UNSPEC;
+    u32 arrived = skb->len - ETH_HLEN;
+
+    struct prestack_ip ip = {};
+    if (skb->protocol == bpf_htons(ETH_P_IP)){
+        struct iphdr iph;
+        if (bpf_skb_load_bytes(skb, ETH_HLEN, &iph, sizeof(iph))) return TC_ACT_UNSPEC;
+        if (!prestack_ipv4(&iph, arrived, &ip)) return TC_ACT_UNSPEC;
+    } else if (skb->protocol == bpf_htons(ETH_P_IPV6)){
+        struct ipv6hdr ip6h;
+        if (bpf_skb_load_bytes(skb, ETH_HLEN, &ip6h, sizeof(ip6h))) return TC_ACT_UNSPEC;
+        if (!prestack_ipv6(&ip6h, arrived, &ip)) return TC_ACT_UNSPEC;
+    } else {
+        return TC_ACT_UNSPEC;
+    }
+
+    u8 th[20];
+    bool whole = !bpf_skb_load_bytes(skb, ETH_HLEN + ip.hlen, th, sizeof(th));
+    prestack_count(s, skb->gso_segs, arrived, &ip, whole ? th : NULL);
+    prestack_syn(skb, ifindex, &ip, whole ? th : NULL);
+    return TC_ACT_UNSPEC;
+}
+
+//XDP: in the driver, before GRO, tc and everything else. Frames are counted one by one,
+//multi-buffer frames by their first buffer
+SEC("xdp")
+int prestack_xdp(struct xdp_md *ctx){
+    u32 ifindex = ctx->ingress_ifindex;
+    struct prestack_stats *s = bpf_map_lookup_elem(&prestack_stats, &ifindex);
+    if (!s) return XDP_PASS;
+    void *data = (void *)(long)ctx->data;
+    void *data_end = (void *)(long)ctx->data_end;
+
+    struct ethhdr *eth = data;
+    if ((void *)(eth + 1) > data_end) return XDP_PASS;
+    __be16 proto = eth->h_proto;
+    u32 off = sizeof(*eth);
+    if (proto == bpf_htons(ETH_P_8021Q) || proto == bpf_htons(ETH_P_8021AD)){
+        struct prestack_vlan *vlan = data + off;
+        if ((void *)(vlan + 1) > data_end) return XDP_PASS;
+        proto = vlan->proto;
+        off += sizeof(*vlan);
+    }
+    u32 arrived = data_end - data - off;
+
+    struct prestack_ip ip = {};
+    if (proto == bpf_htons(ETH_P_IP)){
+        struct iphdr *iph = data + off;
+        if ((void *)(iph + 1) > data_end) return XDP_PASS;
+        if (!prestack_ipv4(iph, arrived, &ip)) return XDP_PASS;
+    } else if (proto == bpf_htons(ETH_P_IPV6)){
+        struct ipv6hdr *ip6h = data + off;
+        if ((void *)(ip6h + 1) > data_end) return XDP_PASS;
+        if (!prestack_ipv6(ip6h, arrived, &ip)) return XDP_PASS;
+    } else {
+        return XDP_PASS;
+    }
+
+    u32 hlen = ip.hlen;
+    if (hlen > 60) return XDP_PASS; //What an IPv4 header can be, and more than IPv6's; tells the verifier
+    const u8 *th = data + off + hlen;
+    if ((void *)(th + 20) > data_end) th = NULL;
+    prestack_count(s, 1, arrived, &ip, th);
+    prestack_syn(ctx, ifindex, &ip, th);
+    return XDP_PASS;
+}
+
+//A segment reaching TCP, on the interface it arrived on as the stack sees it: a VLAN or bond
+//device rather than the one under it
+static __always_inline void prestack_reached(struct sk_buff *skb){
+    if (!prestack_netns) return;
+    struct net_device *dev = BPF_CORE_READ(skb, dev);
+    if (!dev || BPF_CORE_READ(dev, nd_net.net, ns.inum) != prestack_netns) return;
+    u32 ifindex = BPF_CORE_READ(dev, ifindex);
+    struct prestack_stats *s = bpf_map_lookup_elem(&prestack_stats, &ifindex);
+    if (!s) return;
+    //skb_shinfo()
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    struct skb_shared_info *shinfo = (struct skb_shared_info *)(head + skb_data_offset(head, BPF_CORE_READ(skb, end)));
+    u16 segs = BPF_CORE_READ(shinfo, gso_segs);
+    s->reached += segs ? segs : 1;
+}
+
+SEC("kprobe/tcp_v4_rcv")
+int BPF_KPROBE(prestack_tcp_v4_rcv, struct sk_buff *skb){
+    prestack_reached(skb);
+    return 0;
+}
+
+SEC("kprobe/tcp_v6_rcv")
+int BPF_KPROBE(prestack_tcp_v6_rcv, struct sk_buff *skb){
+    prestack_reached(skb);
+    return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,117 @@
+// +build ignore
+//The snapshot command's iterator, kept out of monitor.c: iterators need 5.9+,
+//and monitor.c has to load on kernels that are much older
+
+#include "vmlinux.h"
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_endian.h>
+
+#define AF_INET         2
+#define AF_INET6        10
+#define TCP_LISTEN      10
+#define TCP_CA_NAME_MAX 16
+
+//One record per socket, written to the iterator's seq_file and read back
+//by snapshot.go in host byte order. No holes, the verifier won't let
+//bpf_seq_write copy uninitialized stack.
+struct socket_info{
+    u32 family;
+    u32 state;
+    u8 saddr[16]; //IPv4 stored IPv4-mapped, like struct event in monitor.c
+    u8 daddr[16];
+    u16 sport;
+    u16 dport;
+    u32 uid;
+    u32 netns;
+    u32 rx_queue; //Unread bytes, or for listeners the accept queue length (ss's Recv-Q)
+    u32 tx_queue; //Unsent and unacked bytes, or for listeners the accept queue size (ss's Send-Q)
+    u32 full;     //1 for full sockets, the rest is tcp_info and only set for those
+    u64 inode;    //What /proc/<pid>/fd links to, 0 for children not accepted yet
+    u32 srtt_us;
+    u32 rttvar_us;
+    u32 mss;
+    u32 snd_cwnd;
+    u32 snd_ssthresh;
+    u32 snd_wnd;
+    u32 rcv_wnd;
+    u32 packets_out; //Unacked segments
+    u32 retrans_out;
+    u32 lost_out;
+    u32 total_retrans;
+    u32 segs_out;
+    u32 segs_in;
+    u32 reordering;
+    u64 bytes_acked;
+    u64 bytes_received;
+    char ca_name[TCP_CA_NAME_MAX];
+};
+
+//Walks every TCP socket in the network namespace of whoever reads the
+//iterator, including time-wait and request sockets, like ss -t -a
+SEC("iter/tcp")
+int dump_tcp(struct bpf_iter__tcp *ctx){
+    struct sock_common *skc = ctx->sk_common;
+    if (!skc) return 0; //The final call, after the last socket
+
+    struct socket_info s = {};
+
+    u16 family = BPF_CORE_READ(skc, skc_family);
+    if (family == AF_INET){
+        s.saddr[10] = s.saddr[11] = 0xff;
+        s.daddr[10] = s.daddr[11] = 0xff;
+        BPF_CORE_READ_INTO(&s.saddr[12], skc, skc_rcv_saddr);
+        BPF_CORE_READ_INTO(&s.daddr[12], skc, skc_daddr);
+    } else if (family == AF_INET6){
+        BPF_CORE_READ_INTO(&s.saddr, skc, skc_v6_rcv_saddr.in6_u.u6_addr8);
+        BPF_CORE_READ_INTO(&s.daddr, skc, skc_v6_daddr.in6_u.u6_addr8);
+    } else {
+        return 0;
+    }
+    s.family = family;
+    s.state = BPF_CORE_READ(skc, skc_state);
+    s.sport = BPF_CORE_READ(skc, skc_num);
+    s.dport = bpf_ntohs(BPF_CORE_READ(skc, skc_dport));
+    s.uid = ctx->uid;
+    s.netns = BPF_CORE_READ(skc, skc_net.net, ns.inum);
+
+    //NULL for time-wait and request sockets, they only have the sock_common part
+    struct tcp_sock *tp = bpf_skc_to_tcp_sock(skc);
+    if (tp){
+        struct sock *sk = (struct sock *)tp;
+        s.inode = BPF_CORE_READ(sk, sk_socket, file, f_inode, i_ino);
+        if (s.state == TCP_LISTEN){
+            //u16 before 5.5, hence the probed bitfield reads
+            s.rx_queue = BPF_CORE_READ_BITFIELD_PROBED(sk, sk_ack_backlog);
+            s.tx_queue = BPF_CORE_READ_BITFIELD_PROBED(sk, sk_max_ack_backlog);
+        } else {
+            s.rx_queue = BPF_CORE_READ(tp, rcv_nxt) - BPF_CORE_READ(tp, copied_seq);
+            s.tx_queue = BPF_CORE_READ(tp, write_seq) - BPF_CORE_READ(tp, snd_una);
+            if ((int)s.rx_queue < 0) s.rx_queue = 0; //A racing reader, as tcp_diag clamps it
+        }
+        s.full = 1;
+        s.srtt_us = BPF_CORE_READ(tp, srtt_us) >> 3; //The kernel keeps 8x the smoothed RTT
+        s.rttvar_us = BPF_CORE_READ(tp, mdev_us) >> 2; //and 4x the mean deviation
+        s.mss = BPF_CORE_READ(tp, mss_cache);
+        s.snd_cwnd = BPF_CORE_READ(tp, snd_cwnd);
+        s.snd_ssthresh = BPF_CORE_READ(tp, snd_ssthresh);
+        s.snd_wnd = BPF_CORE_READ(tp, snd_wnd);
+        s.rcv_wnd = BPF_CORE_READ(tp, rcv_wnd);
+        s.packets_out = BPF_CORE_READ(tp, packets_out);
+        s.retrans_out = BPF_CORE_READ(tp, retrans_out);
+        s.lost_out = BPF_CORE_READ(tp, lost_out);
+        s.total_retrans = BPF_CORE_READ(tp, total_retrans);
+        s.segs_out = BPF_CORE_READ(tp, segs_out);
+        s.segs_in = BPF_CORE_READ(tp, segs_in);
+        s.reordering = BPF_CORE_READ(tp, reordering);
+        s.bytes_acked = BPF_CORE_READ(tp, bytes_acked);
+        s.bytes_received = BPF_CORE_READ(tp, bytes_received);
+        struct inet_connection_sock *icsk = (struct inet_connection_sock *)tp;
+        BPF_CORE_READ_STR_INTO(&s.ca_name, icsk, icsk_ca_ops, name);
+    }
+
+    bpf_seq_write(ctx->meta->seq, &s, sizeof(s));
+    return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf/btf"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+// The programs are CO-RE, so their field offsets are relocated against the
+// running kernel's BTF when they're loaded. Kernels built without
+// CONFIG_DEBUG_INFO_BTF (CentOS 8, Ubuntu 20.04's 5.4, ...) don't have
+// /sys/kernel/btf/vmlinux, but BTFHub publishes the BTF of most distribution
+// kernels as <release>.btf.tar.xz, which works just as well.
+const (
+	kernelBTFPath = "/sys/kernel/btf/vmlinux"
+	btfCacheDir   = "/var/cache/tcpmon/btf"
+	btfhubURL     = "https://github.com/aquasecurity/btfhub-archive/raw/main/%s/%s/%s/%s.btf.tar.xz" // ID, VERSION_ID, arch, release
+)
+
+// loadKernelBTF returns the BTF to load the programs against, or nil to use
+// the kernel's own. path is --btf, a .btf or .btf.tar.xz file or a directory
+// holding <release>.btf[.tar.xz]. Without it, a kernel that has no BTF of its
+// own gets the copy in btfCacheDir, downloaded from BTFHub first if download
+// (--btf-download) is set.
+func loadKernelBTF(path string, download bool) (*btf.Spec, error) {
+	release := kernelRelease()
+	if path != "" {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			file, ok := findBTF(path, release)
+			if !ok {
+				return nil, fmt.Errorf("no BTF for kernel %s in %s", release, path)
+			}
+			path = file
+		}
+		return readBTF(path)
+	}
+
+	if _, err := os.Stat(kernelBTFPath); err == nil {
+		return nil, nil
+	}
+	if file, ok := findBTF(btfCacheDir, release); ok {
+		return readBTF(file)
+	}
+	if !download {
+		// cilium/ebpf still looks for a vmlinux with BTF under /boot and /lib/modules
+		slog.Warn("kernel BTF not found, use --btf or --btf-download if the programs fail to load", "path", kernelBTFPath)
+		return nil, nil
+	}
+	file, err := downloadBTF(release)
+	if err != nil {
+		return nil, fmt.Errorf("downloading BTF for %s: %w", release, err)
+	}
+	return readBTF(file)
+}
+
+func kernelRelease() string {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(u.Release[:])
+}
+
+func findBTF(dir, release string) (string, bool) {
+	for _, name := range []string{release + ".btf", release + ".btf.tar.xz"} {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); err == nil {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// readBTF reads raw BTF, an ELF file with a .BTF section, or a BTFHub
+// .btf.tar.xz
+func readBTF(path string) (*btf.Spec, error) {
+	if !strings.HasSuffix(path, ".tar.xz") {
+		return btf.LoadSpec(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	xr, err := xz.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	tr := tar.NewReader(xr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s: no .btf file in the archive", path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if h.Typeflag != tar.TypeReg || !strings.HasSuffix(h.Name, ".btf") {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return btf.LoadSpecFromReader(bytes.NewReader(data))
+	}
+}
+
+// downloadBTF fetches the running kernel's BTF from BTFHub into btfCacheDir
+// and returns the file's path
+func downloadBTF(release string) (string, error) {
+	id, version, err := osRelease()
+	if err != nil {
+		return "", err
+	}
+	arch, ok := map[string]string{"amd64": "x86_64", "arm64": "arm64"}[runtime.GOARCH]
+	if !ok {
+		return "", fmt.Errorf("BTFHub has no BTF for %s kernels, use --btf", runtime.GOARCH)
+	}
+	url := fmt.Sprintf(btfhubURL, id, version, arch, release)
+	fmt.Fprintf(os.Stderr, "Downloading BTF for kernel %s from %s\n", release, url)
+
+	client := &http.Client{Timeout: 2 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s (BTFHub may not have this kernel, see --btf)", url, resp.Status)
+	}
+
+	if err := os.MkdirAll(btfCacheDir, 0o755); err != nil {
+		return "", err
+	}
+	// Written under a temporary name, so an interrupted download isn't found next time
+	tmp, err := os.CreateTemp(btfCacheDir, release+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	file := filepath.Join(btfCacheDir, release+".btf.tar.xz")
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// osRelease returns ID and VERSION_ID from /etc/os-release, which name the
+// BTFHub directories
+func osRelease() (id, version string, err error) {
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(v, `"'`)
+		switch k {
+		case "ID":
+			id = v
+		case "VERSION_ID":
+			version = v
+		}
+	}
+	if id == "" || version == "" {
+		return "", "", fmt.Errorf("/etc/os-release has no ID or VERSION_ID")
+	}
+	return id, version, nil
+}
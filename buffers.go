@@ -0,0 +1,41 @@
+package main
+
+import "fmt"
+
+// The buffers probe reports tcp_prune_queue runs in bpf/monitor.c: a segment
+// arrived and the connection's receive memory was over its limit, so the
+// kernel collapsed the queues and maybe threw data away to make room.
+
+// Buffer pressure kinds, BUFFER_* in bpf/monitor.c, mildest first
+const (
+	bufferCollapsed = 1
+	bufferOfoPruned = 2
+	bufferDropped   = 3
+)
+
+// bufferNames are the reasons of buffer pressure events
+var bufferNames = map[uint32]string{
+	bufferCollapsed: "COLLAPSED",
+	bufferOfoPruned: "OFO_PRUNED",
+	bufferDropped:   "DROPPED",
+}
+
+// BufferFlags bits, BUFFER_RCVBUF_LOCKED and BUFFER_MEM_PRESSURE
+const (
+	bufferRcvbufLocked = 0x1
+	bufferMemPressure  = 0x2
+)
+
+// bufferHint is the likeliest fix for what the event shows, naming the
+// sysctl or socket option that sets the limit it ran into
+func bufferHint(event *TcpEvent) string {
+	switch {
+	case event.BufferFlags&bufferMemPressure != 0:
+		return "TCP is over net.ipv4.tcp_mem, raise it or find the sockets holding memory (ss -tm)"
+	case event.BufferFlags&bufferRcvbufLocked != 0:
+		return fmt.Sprintf("SO_RCVBUF is set to %d B, which turns off autotuning: raise it or leave it to the kernel", event.Rcvbuf)
+	case event.RmemMax != 0 && event.Rcvbuf >= event.RmemMax:
+		return fmt.Sprintf("at the net.ipv4.tcp_rmem max of %d B, raise it if the path needs a larger window", event.RmemMax)
+	}
+	return "segments take more memory than the window allowed for (small packets, or the driver's buffers), see net.ipv4.tcp_adv_win_scale"
+}
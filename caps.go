@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/cilium/ebpf/rlimit"
+	"golang.org/x/sys/unix"
+)
+
+// Running without root: the monitor needs CAP_BPF to load programs and
+// maps, CAP_PERFMON for the kprobes, tracepoints and uprobes and the
+// kernel memory the programs read (CAP_SYS_ADMIN covers both, and is the
+// only way before 5.8), and CAP_NET_ADMIN for --sockops. checkCapabilities
+// names the missing capability and what wants it before anything is
+// loaded, rather than leaving it to an EPERM from somewhere in the
+// collection. What only gets worse without a capability says so in a
+// warning and carries on.
+
+// capDisplayNames are the capabilities the checks name
+var capDisplayNames = map[int]string{
+	unix.CAP_BPF:             "CAP_BPF",
+	unix.CAP_PERFMON:         "CAP_PERFMON",
+	unix.CAP_SYS_ADMIN:       "CAP_SYS_ADMIN",
+	unix.CAP_NET_ADMIN:       "CAP_NET_ADMIN",
+	unix.CAP_SYS_PTRACE:      "CAP_SYS_PTRACE",
+	unix.CAP_SYS_RESOURCE:    "CAP_SYS_RESOURCE",
+	unix.CAP_SETUID:          "CAP_SETUID",
+	unix.CAP_SETGID:          "CAP_SETGID",
+	unix.CAP_SETPCAP:         "CAP_SETPCAP",
+	unix.CAP_DAC_READ_SEARCH: "CAP_DAC_READ_SEARCH",
+}
+
+// effectiveCaps is the effective set of the calling thread, which before
+// --user is every thread's
+func effectiveCaps() (uint64, error) {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return 0, err
+	}
+	return uint64(data[0].Effective) | uint64(data[1].Effective)<<32, nil
+}
+
+// needCaps is nil when the effective set has any of caps, and otherwise
+// an error naming them and feature. Capabilities the kernel doesn't know
+// are left out, so CAP_SYS_ADMIN alone is asked for before 5.8.
+func needCaps(feature string, caps ...int) error {
+	have, err := effectiveCaps()
+	if err != nil {
+		return nil // Let the kernel say no
+	}
+	var names []string
+	for _, c := range caps {
+		if c > lastCap() {
+			continue
+		}
+		if have&(1<<c) != 0 {
+			return nil
+		}
+		names = append(names, capDisplayNames[c])
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return fmt.Errorf("missing %s, needed for %s", strings.Join(names, " or "), feature)
+}
+
+// capNeed is a feature and the capabilities, any of which will do
+type capNeed struct {
+	feature string
+	caps    []int
+}
+
+// checkCapabilities checks what the command needs before anything is
+// loaded, with every missing capability in the error
+func checkCapabilities(command string, o *options) error {
+	needs := []capNeed{
+		{"loading the BPF programs and maps", []int{unix.CAP_BPF, unix.CAP_SYS_ADMIN}},
+		{"the kprobes, tracepoints and uprobes", []int{unix.CAP_PERFMON, unix.CAP_SYS_ADMIN}},
+	}
+	if command == "bench" {
+		needs = append(needs, capNeed{"bench's network namespace", []int{unix.CAP_SYS_ADMIN}})
+	}
+	if len(o.interfaces) > 0 {
+		needs = append(needs, capNeed{"--interface's tc and XDP programs", []int{unix.CAP_NET_ADMIN}})
+	}
+	if o.enforce || len(o.block) > 0 {
+		needs = append(needs, capNeed{"--enforce's cgroup programs", []int{unix.CAP_NET_ADMIN}})
+	}
+	if o.runAsUser != "" {
+		// Setting ids, and dropping from the bounding set
+		for _, c := range []int{unix.CAP_SETUID, unix.CAP_SETGID, unix.CAP_SETPCAP} {
+			needs = append(needs, capNeed{"--user", []int{c}})
+		}
+	}
+
+	var missing []string
+	for _, n := range needs {
+		if err := needCaps(n.feature, n.caps...); err != nil {
+			missing = append(missing, err.Error())
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New(strings.Join(missing, "; "))
+	}
+
+	if err := needCaps("namespace names and --user-stacks of other users' processes", unix.CAP_SYS_PTRACE); err != nil {
+		slog.Warn("other users' processes can't be looked into", "err", err)
+	}
+	return nil
+}
+
+// removeMemlock lifts RLIMIT_MEMLOCK, which BPF maps were charged to
+// before 5.11. Later kernels charge the memory cgroup and it's a no-op.
+func removeMemlock() error {
+	err := rlimit.RemoveMemlock()
+	if errors.Is(err, unix.EPERM) {
+		if capErr := needCaps("raising the memlock limit on kernels before 5.11", unix.CAP_SYS_RESOURCE); capErr != nil {
+			return fmt.Errorf("%w (%w)", err, capErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupResolver maps the cgroup v2 ids carried by events back to cgroup
+// paths. A cgroup's id is the inode number of its directory in cgroupfs,
+// so one walk of the hierarchy builds the whole table.
+type cgroupResolver struct {
+	root string
+
+	mu    sync.RWMutex
+	paths map[uint64]string // id -> path relative to root, e.g. /kubepods.slice/...
+
+	kick chan struct{}
+}
+
+func newCgroupResolver(root string) *cgroupResolver {
+	r := &cgroupResolver{root: root, kick: make(chan struct{}, 1)}
+	r.scan()
+	go r.loop()
+	return r
+}
+
+// Path returns the cgroup path for id. An unknown id is most likely a cgroup
+// created since the last walk, so it schedules a rescan instead of blocking
+func (r *cgroupResolver) Path(id uint64) (string, bool) {
+	r.mu.RLock()
+	path, ok := r.paths[id]
+	r.mu.RUnlock()
+
+	if !ok {
+		select {
+		case r.kick <- struct{}{}:
+		default: // A rescan is already pending
+		}
+	}
+	return path, ok
+}
+
+func (r *cgroupResolver) loop() {
+	for range r.kick {
+		r.scan()
+		time.Sleep(5 * time.Second) // Unknown ids arrive in bursts, walk at most this often
+	}
+}
+
+func (r *cgroupResolver) scan() {
+	paths := make(map[uint64]string)
+	err := filepath.WalkDir(r.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil // Cgroups come and go while we walk
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(r.root, path)
+		paths[info.Sys().(*syscall.Stat_t).Ino] = filepath.Join("/", rel)
+		return nil
+	})
+	if err != nil {
+		slog.Warn("walking cgroups", "root", r.root, "err", err)
+	}
+
+	r.mu.Lock()
+	r.paths = paths
+	r.mu.Unlock()
+}
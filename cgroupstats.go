@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/cilium/ebpf"
+)
+
+// With --cgroup-metrics, the drop and retransmit programs and the cgroups
+// probe count into cgroup_stats in bpf/monitor.c, keyed by the cgroup v2
+// id of the socket. /metrics reads the map at every scrape and labels the
+// totals with the cgroup's path, pod and container, so per-tenant network
+// health costs a map update per packet instead of an event.
+
+const cgroupStatsEntries = 4096 // Cgroups counted at once, the least recently counted is evicted
+
+// sizeCgroupStats gives cgroup_stats room for the cgroups and turns
+// counting on. Per-CPU hashes preallocate a value per CPU and entry, so
+// without --cgroup-metrics it stays at one entry.
+func sizeCgroupStats(spec *ebpf.CollectionSpec) error {
+	m, ok := spec.Maps["cgroup_stats"]
+	if !ok {
+		return errors.New("map cgroup_stats not found in BPF object")
+	}
+	m.MaxEntries = cgroupStatsEntries
+	return setVariable(spec, "count_cgroups", uint8(1))
+}
+
+// readCgroupStats sums each cgroup's counters over the CPUs
+func readCgroupStats(m *ebpf.Map) (map[uint64]monitorCgroupStats, error) {
+	totals := make(map[uint64]monitorCgroupStats)
+	var id uint64
+	var perCPU []monitorCgroupStats
+	iter := m.Iterate()
+	for iter.Next(&id, &perCPU) {
+		var t monitorCgroupStats
+		for _, s := range perCPU {
+			t.Drops += s.Drops
+			t.Retransmits += s.Retransmits
+			t.BytesSent += s.BytesSent
+			t.BytesReceived += s.BytesReceived
+		}
+		totals[id] = t
+	}
+	return totals, iter.Err()
+}
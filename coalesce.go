@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// coalescer is --coalesce: drops, retransmits, DSACKs, resets and buffer
+// prunes that repeat within the window are held back and handed on as one
+// event with Count set, so a connection losing thousands of segments takes one line instead of
+// thousands. An event is held from its first occurrence, and comes out when
+// the window that started then is over. Only used from the processor
+// goroutine.
+type coalescer struct {
+	window  time.Duration
+	pending map[coalesceKey]*coalescedEvent
+}
+
+// coalesceKey is what makes two events the same: the type, the connection,
+// the reason and the interface, and for a tunnel's drops the flow inside
+// too. Drops without a tuple only have the reason,
+// the function, the network namespace and the interface to go by. The PID
+// isn't part of it, softirq drops and retransmits are charged to whichever
+// task was running.
+type coalesceKey struct {
+	typ, reason, direction, family, netns uint32
+	ifindex                               uint32 // Drops and retransmits, a bond member's don't count into another's
+	location                              uint64
+	saddr, daddr                          [16]byte
+	sport, dport                          uint16
+	innerSaddr, innerDaddr                [16]byte
+	innerSport, innerDport                uint16
+}
+
+type coalescedEvent struct {
+	event TcpEvent // The first one, counting the rest
+	due   time.Time
+}
+
+// Most distinct events held at once, past that new ones go through as they are
+const coalesceMaxPending = 16384
+
+func newCoalescer(window time.Duration) *coalescer {
+	return &coalescer{window: window, pending: make(map[coalesceKey]*coalescedEvent)}
+}
+
+// Add holds event, or counts it into the held one it repeats. It returns
+// false for events that aren't coalesced and should go on right away.
+func (c *coalescer) Add(event *TcpEvent, now time.Time) bool {
+	if event.Type != eventDrop && event.Type != eventRetransmit && event.Type != eventDSACK && event.Type != eventReset && event.Type != eventBuffer {
+		return false
+	}
+	k := coalesceKey{
+		typ: event.Type, reason: event.Reason, direction: event.Direction,
+		family: event.Family, netns: event.Netns, ifindex: event.Ifindex, location: event.Location,
+		saddr: event.Saddr, daddr: event.Daddr, sport: event.Sport, dport: event.Dport,
+		innerSaddr: event.InnerSaddr, innerDaddr: event.InnerDaddr, innerSport: event.InnerSport, innerDport: event.InnerDport,
+	}
+	if held := c.pending[k]; held != nil {
+		held.event.Count++
+		held.event.Suppressed += event.Suppressed
+		return true
+	}
+	if len(c.pending) >= coalesceMaxPending {
+		return false
+	}
+	held := &coalescedEvent{event: *event, due: now.Add(c.window)}
+	held.event.Count = 1
+	held.event.Packet = bytes.Clone(event.Packet) // event's batch is reused
+	c.pending[k] = held
+	return true
+}
+
+// Due returns the held events whose window is over, oldest first, and
+// forgets them. Events that didn't repeat come out with Count 0, the same
+// as without --coalesce.
+func (c *coalescer) Due(now time.Time) []TcpEvent {
+	return c.take(func(held *coalescedEvent) bool { return !held.due.After(now) })
+}
+
+// Flush returns everything still held, for shutdown
+func (c *coalescer) Flush() []TcpEvent {
+	return c.take(func(*coalescedEvent) bool { return true })
+}
+
+func (c *coalescer) take(want func(*coalescedEvent) bool) []TcpEvent {
+	var due []*coalescedEvent
+	for k, held := range c.pending {
+		if want(held) {
+			due = append(due, held)
+			delete(c.pending, k)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].due.Before(due[j].due) })
+	events := make([]TcpEvent, len(due))
+	for i, held := range due {
+		events[i] = held.event
+		if events[i].Count == 1 {
+			events[i].Count = 0
+		}
+	}
+	return events
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	drop := TcpEvent{Type: eventDrop, Reason: 2, Family: afInet, Saddr: replayAddr("10.0.0.1"), Sport: 1000, Daddr: replayAddr("10.0.0.2"), Dport: 80}
+	otherPort := drop
+	otherPort.Sport = 1001
+	otherReason := drop
+	otherReason.Reason = 3
+	otherLink := drop
+	otherLink.Ifindex = 4
+	suppressed := drop
+	suppressed.Suppressed = 5
+	retransmit := drop
+	retransmit.Type = eventRetransmit
+	closed := drop
+	closed.Type = eventClose
+
+	window := time.Second
+	start := time.Unix(1767225600, 0)
+	for _, tt := range []struct {
+		name   string
+		events []TcpEvent
+		at     []time.Duration // Each event's time after start
+		due    time.Duration   // When Due is asked
+		want   []uint32        // Count of each event that's due, in order
+		held   int             // Left for Flush
+		passed int             // Not coalesced
+	}{
+		{"one", []TcpEvent{drop}, []time.Duration{0}, window, []uint32{0}, 0, 0},
+		{"repeats", []TcpEvent{drop, drop, drop}, []time.Duration{0, 100 * time.Millisecond, 900 * time.Millisecond}, window, []uint32{3}, 0, 0},
+		{"not due yet", []TcpEvent{drop, drop}, []time.Duration{0, 0}, window - 1, nil, 1, 0},
+		{"suppressed counted in", []TcpEvent{drop, suppressed}, []time.Duration{0, 0}, window, []uint32{2}, 0, 0},
+		{"different connections", []TcpEvent{drop, otherPort, drop}, []time.Duration{0, time.Millisecond, 0}, 2 * window, []uint32{2, 0}, 0, 0}, // Apart, equal due times come out in any order
+		{"different reasons", []TcpEvent{drop, otherReason}, []time.Duration{0, 0}, window, []uint32{0, 0}, 0, 0},
+		{"different interfaces", []TcpEvent{drop, otherLink}, []time.Duration{0, 0}, window, []uint32{0, 0}, 0, 0},
+		{"different types", []TcpEvent{drop, retransmit}, []time.Duration{0, 0}, window, []uint32{0, 0}, 0, 0},
+		{"oldest first", []TcpEvent{otherPort, drop}, []time.Duration{500 * time.Millisecond, 0}, 2 * window, []uint32{0, 0}, 0, 0},
+		{"half due", []TcpEvent{drop, otherPort}, []time.Duration{0, 500 * time.Millisecond}, window, []uint32{0}, 1, 0},
+		{"closes go on", []TcpEvent{closed, drop}, []time.Duration{0, 0}, window, []uint32{0}, 0, 1},
+	} {
+		c := newCoalescer(window)
+		passed := 0
+		for i := range tt.events {
+			if !c.Add(&tt.events[i], start.Add(tt.at[i])) {
+				passed++
+			}
+		}
+		due := c.Due(start.Add(tt.due))
+		var counts []uint32
+		for _, e := range due {
+			counts = append(counts, e.Count)
+		}
+		if len(counts) != len(tt.want) || passed != tt.passed {
+			t.Errorf("%s: due %v and %d passed, want %v and %d", tt.name, counts, passed, tt.want, tt.passed)
+			continue
+		}
+		for i := range counts {
+			if counts[i] != tt.want[i] {
+				t.Errorf("%s: due %v, want %v", tt.name, counts, tt.want)
+			}
+		}
+		if tt.name == "suppressed counted in" && due[0].Suppressed != 5 {
+			t.Errorf("%s: suppressed %d, want 5", tt.name, due[0].Suppressed)
+		}
+		if tt.name == "oldest first" && due[0].Sport != drop.Sport {
+			t.Errorf("%s: port %d first, want %d", tt.name, due[0].Sport, drop.Sport)
+		}
+		if held := c.Flush(); len(held) != tt.held {
+			t.Errorf("%s: %d held, want %d", tt.name, len(held), tt.held)
+		}
+		if len(c.pending) != 0 {
+			t.Errorf("%s: %d still pending after Flush", tt.name, len(c.pending))
+		}
+	}
+}
+
+func TestCoalescerFull(t *testing.T) {
+	c := newCoalescer(time.Second)
+	now := time.Now()
+	for i := range coalesceMaxPending {
+		e := TcpEvent{Type: eventRetransmit, Sport: uint16(i)}
+		if !c.Add(&e, now) {
+			t.Fatalf("event %d not held", i)
+		}
+	}
+	e := TcpEvent{Type: eventRetransmit, Sport: 1, Dport: 1}
+	if c.Add(&e, now) {
+		t.Error("new event held past coalesceMaxPending")
+	}
+	e = TcpEvent{Type: eventRetransmit, Sport: 1}
+	if !c.Add(&e, now) {
+		t.Error("repeat of a held event not counted in when full")
+	}
+}
+
+func TestCoalescerPacket(t *testing.T) {
+	c := newCoalescer(time.Second)
+	packet := []byte{0x45, 0, 0, 40}
+	e := TcpEvent{Type: eventDrop, Packet: packet}
+	c.Add(&e, time.Now())
+	packet[0] = 0 // The batch being reused
+	if held := c.Flush(); len(held) != 1 || held[0].Packet[0] != 0x45 {
+		t.Errorf("held packet %v, want a copy of the first", held)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BENCHMARK MODES
+
+type BenchmarkMode struct {
+	Name        string
+	DoPrint     bool
+	Output      io.Writer
+	Description string
+}
+
+// command is one subcommand: what it attaches, which events it wants from
+// the kernel, and the flags only it takes
+type command struct {
+	Mode   BenchmarkMode
+	hooks  hooks
+	events uint32                             // 1 << eventDrop etc., see event_mask in bpf/monitor.c
+	flags  func(fs *flag.FlagSet, o *options) // nil if the command only takes the common flags
+}
+
+const allEvents = 1<<eventDrop | 1<<eventRetransmit | 1<<eventState | 1<<eventClose | 1<<eventConnect | 1<<eventReset | 1<<eventZeroWindow | 1<<eventUDPError | 1<<eventICMPError | 1<<eventDSACK | 1<<eventKeepalive | 1<<eventFastOpen | 1<<eventBuffer | 1<<eventTLS | 1<<eventSynFlood | 1<<eventBlocked | 1<<eventSockopt | 1<<eventListen
+
+func getCommands() map[string]command {
+	// Not hookTLS, its uprobes need a libssl to attach to
+	everything := hookDrops | hookRetransmits | hookStates | hookRTT | hookReorder | hookSACK | hookResets | hookWindows | hookICMP | hookKeepalive | hookFastOpen | hookBuffers | hookSockopts | hookListeners
+
+	return map[string]command{
+		// Everything at once, for comparing how output is handled (compare.sh)
+		"terminal": {
+			Mode: BenchmarkMode{
+				Name:        "TERMINAL MODE",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print each event to terminal (slowest, limited by TTY)",
+			},
+			hooks: everything, events: allEvents, flags: everythingFlags,
+		},
+		"file": {
+			Mode: BenchmarkMode{
+				Name:        "FILE MODE",
+				DoPrint:     true,
+				Output:      nil, // Set dynamically
+				Description: "Print to file via stdout redirect (tests buffered I/O)",
+			},
+			hooks: everything, events: allEvents, flags: everythingFlags,
+		},
+		"benchmark": {
+			Mode: BenchmarkMode{
+				Name:        "BENCHMARK MODE",
+				DoPrint:     false,
+				Output:      io.Discard,
+				Description: "No printing, pure counting (tests max throughput)",
+			},
+			hooks: everything, events: allEvents, flags: everythingFlags,
+		},
+		"bench": {
+			Mode: BenchmarkMode{
+				Name:        "BENCH MODE",
+				DoPrint:     false,
+				Output:      io.Discard,
+				Description: "Count everything under TCP churn generated in a throwaway netns, then report the monitor's CPU, throughput and loss",
+			},
+			hooks: everything, events: allEvents,
+			flags: func(fs *flag.FlagSet, o *options) {
+				everythingFlags(fs, o)
+				fs.IntVar(&o.benchRate, "rate", 1000, "Connections per second to open, each sending --payload bytes that are echoed back before it's closed")
+				fs.IntVar(&o.benchPayload, "payload", 1024, "Bytes each connection sends and reads back (just connect and close if 0)")
+				fs.Float64Var(&o.benchLoss, "loss", 0, "Percentage of packets netem drops, for retransmits (needs tc)")
+				fs.DurationVar(&o.benchDelay, "delay", 0, "Delay netem adds to every packet, twice over per round trip, e.g. 5ms (needs tc)")
+			},
+		},
+		"busy": {
+			Mode: BenchmarkMode{
+				Name:        "BUSY MODE",
+				DoPrint:     false,
+				Output:      io.Discard,
+				Description: "Do all work except print (tests if work helps throughput)",
+			},
+			hooks: everything, events: allEvents, flags: everythingFlags,
+		},
+
+		// One kind of event each
+		"drops": {
+			Mode: BenchmarkMode{
+				Name:        "DROPS",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print packet drops with their reason and kernel function",
+			},
+			hooks: hookDrops, events: 1 << eventDrop,
+			flags: dropFlags,
+		},
+		"retrans": {
+			Mode: BenchmarkMode{
+				Name:        "RETRANSMITS",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print TCP retransmits, and DSACKs showing which were spurious, with the connection and its owner",
+			},
+			// The state hook only keeps the connection table, for the owner
+			hooks: hookRetransmits | hookSACK | hookStates, events: 1<<eventRetransmit | 1<<eventDSACK,
+		},
+		"resets": {
+			Mode: BenchmarkMode{
+				Name:        "RESETS",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print TCP resets sent and received, with the reason when the kernel gives one",
+			},
+			hooks: hookResets | hookStates, events: 1 << eventReset,
+		},
+		"windows": {
+			Mode: BenchmarkMode{
+				Name:        "ZERO WINDOWS",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print connections stalled on a zero receive window, naming the process that isn't reading",
+			},
+			hooks: hookWindows | hookStates, events: 1 << eventZeroWindow,
+		},
+		"icmp": {
+			Mode: BenchmarkMode{
+				Name:        "ICMP ERRORS",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print ICMP unreachable and fragmentation needed messages with the TCP connection they hit",
+			},
+			hooks: hookICMP | hookStates, events: 1 << eventICMPError,
+		},
+		"buffers": {
+			Mode: BenchmarkMode{
+				Name:        "RECEIVE BUFFERS",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print connections whose receive queue was collapsed or pruned to fit the buffer, with the limit they hit",
+			},
+			// The state hook only keeps the connection table, for the owner
+			hooks: hookBuffers | hookStates, events: 1 << eventBuffer,
+		},
+		"keepalive": {
+			Mode: BenchmarkMode{
+				Name:        "KEEPALIVE FAILURES",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print unanswered keepalive probes and connections keepalive closed, with the idle time",
+			},
+			// The state hook sees the close, and keeps the connection table for the owner
+			hooks: hookKeepalive | hookStates, events: 1 << eventKeepalive,
+		},
+		"fastopen": {
+			Mode: BenchmarkMode{
+				Name:        "TCP FAST OPEN",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print TFO cookie requests, SYNs whose data was accepted, and fallbacks to a plain handshake",
+			},
+			// The state hook only keeps the connection table, for the owner of connects
+			hooks: hookFastOpen | hookStates, events: 1 << eventFastOpen,
+		},
+		"sockopts": {
+			Mode: BenchmarkMode{
+				Name:        "SOCKET OPTIONS",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print setsockopt calls on TCP sockets (Nagle, corking, buffer sizes, the user timeout, congestion control) with the value before and after",
+			},
+			hooks: hookSockopts, events: 1 << eventSockopt,
+		},
+		"tls": {
+			Mode: BenchmarkMode{
+				Name:        "TLS HANDSHAKES",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print OpenSSL handshakes with how long they took, next to the TCP handshake and the wait before them",
+			},
+			// The state hook keeps the connection table, for the TCP handshake
+			hooks: hookTLS | hookStates, events: 1 << eventTLS,
+		},
+		"life": {
+			Mode: BenchmarkMode{
+				Name:        "CONNECTION LIFECYCLE",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "Print state changes, slow connects, socket options set and closes with totals, RTT and reordering",
+			},
+			hooks: hookStates | hookRTT | hookReorder | hookSACK | hookSockopts, events: 1<<eventState | 1<<eventClose | 1<<eventConnect | 1<<eventSockopt,
+			flags: lifecycleFlags,
+		},
+		"top": {
+			Mode: BenchmarkMode{
+				Name:        "TOP MODE",
+				DoPrint:     false, // Only the table is printed
+				Output:      os.Stdout,
+				Description: "Busiest connections by bytes sent/received, every --interval",
+			},
+			hooks: hookTop, events: 0,
+			flags: func(fs *flag.FlagSet, o *options) {
+				fs.IntVar(&o.topN, "top", 10, "Rows in the table")
+			},
+		},
+		"listen": {
+			Mode: BenchmarkMode{
+				Name:        "LISTEN QUEUES",
+				DoPrint:     true,
+				Output:      os.Stdout,
+				Description: "SYN and accept queue overflows per listening socket and its server every --interval, listeners starting and closing, and failed binds and listens",
+			},
+			hooks: hookListen | hookListeners, events: 1 << eventListen,
+		},
+		"record": {
+			Mode: BenchmarkMode{
+				Name:        "RECORD MODE",
+				DoPrint:     false, // Events go to --out
+				Output:      io.Discard,
+				Description: "Write every event to a zstd compressed file of length-prefixed protobuf messages",
+			},
+			hooks: everything, events: allEvents,
+			flags: func(fs *flag.FlagSet, o *options) {
+				everythingFlags(fs, o)
+				fs.StringVar(&o.recordPath, "out", "", "The file to write, e.g. events.bin.zst (required)")
+				fs.Int64Var(&o.recordMaxSize, "out-max-size", 0, "Start a new --out file after this many MB compressed (disabled if 0)")
+				fs.DurationVar(&o.recordRotate, "out-rotate", 0, "Start a new --out file at this interval, e.g. 1h (disabled if 0)")
+			},
+		},
+	}
+}
+
+// commandNames lists the commands in the order usage prints them
+func commandNames(commands map[string]command) []string {
+	order := map[string]int{"drops": 0, "retrans": 1, "resets": 2, "windows": 3, "buffers": 4, "icmp": 5, "keepalive": 6, "fastopen": 7, "sockopts": 8, "tls": 9, "life": 10, "top": 11, "listen": 12, "record": 13}
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		oi, iok := order[names[i]]
+		oj, jok := order[names[j]]
+		if iok != jok {
+			return iok // The single purpose commands first, then the benchmark modes
+		}
+		if iok {
+			return oi < oj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// options holds every flag value; commands only register the ones they use
+type options struct {
+	config          string
+	probes          listFlag
+	protos          listFlag
+	format          string
+	listenAddr      string
+	controlAddr     string
+	controlToken    string
+	otlpEndpoint    string
+	otlpInsecure    bool
+	grpcListen      string
+	plugins         pluginFlag
+	pluginEncoding  string
+	statsdAddr      string
+	statsdPrefix    string
+	statsdTags      listFlag
+	labels          listFlag
+	ipfixAddr       string
+	ipfixDomain     uint
+	ipfixActive     time.Duration
+	kafkaBrokers    listFlag
+	kafkaTopic      string
+	kafkaEncoding   string
+	kafkaKey        string
+	kafkaBatchSize  int
+	kafkaBatchWait  time.Duration
+	natsURL         string
+	natsSubject     string
+	natsEncoding    string
+	natsJetStream   bool
+	natsStream      string
+	syslogAddr      string
+	syslogFacility  string
+	pids, comms     listFlag
+	ports, cidrs    listFlag
+	cgroupPath      string
+	k8sSource       string
+	kubeletURL      string
+	kubeletInsecure bool
+	containers      string
+	containerSocket string
+	processInfo     bool
+	reverseDNS      bool
+	geoip           listFlag
+	tlsLibs         listFlag
+	sockOps         bool
+	interfaces      listFlag
+	interfaceHook   string
+	synFlood        uint
+	synFloodV4      uint
+	synFloodV6      uint
+	enforce         bool
+	block           blockFlag
+	bpfStats        bool
+	logLevel        string
+	logFormat       string
+	topInterval     time.Duration
+	tui             bool
+	csvPath         string
+	csvMaxSize      int64
+	csvRotate       time.Duration
+	recordPath      string
+	recordMaxSize   int64
+	recordRotate    time.Duration
+	dbPath          string
+	pcapPath        string
+	pcapSnaplen     uint
+	stacks          bool
+	userStacks      bool
+	cgroupMetrics   bool
+	sample          sampleFlag
+	connLimit       uint
+	coalesce        time.Duration
+	bufferSize      int
+	overflowPolicy  string
+	sinkBuffer      int
+	aggregate       bool
+	rollupInterval  time.Duration
+	processReport   int
+	anomaly         bool
+	anomalyTop      int
+	anomalyScore    float64
+	btfPath         string
+	btfDownload     bool
+	pinPath         string
+	daemon          bool
+	pidFile         string
+	runAsUser       string
+	keepCaps        listFlag
+
+	alerts configAlerts // Only from the --config file
+
+	// Command specific
+	slowConnect  time.Duration
+	minBytes     uint64
+	histInterval time.Duration
+	topN         int
+	benchRate    int
+	benchPayload int
+	benchLoss    float64
+	benchDelay   time.Duration
+
+	connectBuckets, rttBuckets listFlag // --hist-interval buckets, a preset or the bounds
+}
+
+func commonFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.config, "config", "", "Read settings from this YAML file, flags on the command line take precedence")
+	fs.Var(&o.probes, "probes", "Attach these probes instead of the command's own and emit all their events: drops, retransmits, resets, windows, buffers, icmp, states, rtt, reorder, sack, keepalive, fastopen, sockopts, tls, sockops, top, cgroups, listen, listeners, udp, enforce (repeatable or comma separated)")
+	fs.Var(&o.protos, "proto", "Monitor these protocols: tcp, udp (repeatable or comma separated). udp adds UDP send and receive errors, and without tcp only UDP drops and errors are reported (defaults to the TCP events and drops of every protocol)")
+	fs.StringVar(&o.format, "format", formatText, "Output format: text or json (one object per line)")
+	fs.StringVar(&o.listenAddr, "listen-addr", "", "Serve Prometheus metrics and the JSON API on this address, e.g. :9090 (disabled if empty)")
+	fs.StringVar(&o.controlAddr, "control-addr", "", "Serve the API calls that change the monitor (--block rules, attaching probes, filter reloads) here: unix:/run/tcpmon-control.sock, for root and the monitor's user, or a loopback address with --control-token-file (disabled if empty)")
+	fs.StringVar(&o.controlToken, "control-token-file", "", "File holding the bearer token --control-addr wants in every request's Authorization header, required for a TCP address")
+	fs.Var(&o.labels, "label", "Add this key=value label to every event and metric, in JSON, the broker and gRPC messages, Prometheus, OTLP and StatsD, e.g. cluster=eu1 (repeatable or comma separated)")
+	fs.StringVar(&o.otlpEndpoint, "otlp-endpoint", "", "Export events and counters over OTLP/gRPC to this collector, e.g. localhost:4317 (disabled if empty)")
+	fs.BoolVar(&o.otlpInsecure, "otlp-insecure", false, "Use plaintext gRPC for --otlp-endpoint")
+	fs.Var(&o.kafkaBrokers, "kafka-brokers", "Publish every event to Kafka through these brokers, e.g. kafka-1:9092 (repeatable or comma separated, disabled if empty)")
+	fs.StringVar(&o.kafkaTopic, "kafka-topic", "tcpmon-events", "Topic for --kafka-brokers")
+	fs.StringVar(&o.kafkaEncoding, "kafka-encoding", formatJSON, "Kafka message encoding: json or protobuf (the Event message in proto/tcpmon.proto)")
+	fs.StringVar(&o.kafkaKey, "kafka-key", kafkaKeyRemote, "Kafka partition key: raddr (the remote address), host or none")
+	fs.IntVar(&o.kafkaBatchSize, "kafka-batch-size", 500, "Most events in one Kafka write")
+	fs.DurationVar(&o.kafkaBatchWait, "kafka-batch-timeout", time.Second, "Longest an event waits for its Kafka batch to fill")
+	fs.StringVar(&o.natsURL, "nats-url", "", "Publish every event to this NATS server, e.g. nats://nats-1:4222 (comma separated for a cluster, disabled if empty)")
+	fs.StringVar(&o.natsSubject, "nats-subject", "tcpmon.{type}.{host}", "Subject for --nats-url, with {host}, {type}, {comm}, {reason}, {namespace} and {pod} filled in per event")
+	fs.StringVar(&o.natsEncoding, "nats-encoding", formatJSON, "NATS message encoding: json or protobuf (the Event message in proto/tcpmon.proto)")
+	fs.BoolVar(&o.natsJetStream, "nats-jetstream", false, "Publish to JetStream and wait for acks, so events are persisted by a stream")
+	fs.StringVar(&o.natsStream, "nats-stream", "", "Create this JetStream stream for the --nats-subject subjects if it doesn't exist")
+	fs.StringVar(&o.syslogAddr, "syslog", "", "Send every event as an RFC 5424 message to local, unix:/path, udp://host[:514] or tcp://host[:601] (disabled if empty)")
+	fs.StringVar(&o.syslogFacility, "syslog-facility", "local0", "Syslog facility: kern, user, daemon, auth, syslog or local0-local7")
+	fs.StringVar(&o.grpcListen, "grpc-listen", "", "Stream events over gRPC on this address, e.g. 127.0.0.1:50051 or unix:/run/tcpmon.sock (disabled if empty)")
+	fs.Var(&o.plugins, "plugin", "Run this command and write every event to its stdin, e.g. /usr/local/bin/forward --team net (repeatable, disabled if empty)")
+	fs.StringVar(&o.pluginEncoding, "plugin-encoding", formatJSON, "What --plugin programs read: json (one object per line) or protobuf (Event messages from proto/tcpmon.proto, each after its length as a varint)")
+	fs.StringVar(&o.statsdAddr, "statsd", "", "Send counters and timings in DogStatsD format over UDP to this address, e.g. 127.0.0.1:8125 (disabled if empty)")
+	fs.StringVar(&o.statsdPrefix, "statsd-prefix", "tcpmon.", "Prefix for --statsd metric names")
+	fs.Var(&o.statsdTags, "statsd-tags", "Tags added to every --statsd metric, e.g. env:prod (repeatable or comma separated)")
+	fs.StringVar(&o.ipfixAddr, "ipfix", "", "Export closed connections as IPFIX flow records over UDP to this collector, e.g. 10.0.0.2:4739 (disabled if empty)")
+	fs.UintVar(&o.ipfixDomain, "ipfix-domain", 0, "Observation domain ID of the --ipfix messages")
+	fs.DurationVar(&o.ipfixActive, "ipfix-active-timeout", time.Minute, "Export live connections' bytes over --ipfix this often instead of only at close, with the rtt probe (0 = only at close)")
+	fs.Var(&o.pids, "pid", "Only report events for these PIDs (repeatable or comma separated)")
+	fs.Var(&o.comms, "comm", "Only report events for these process names (repeatable or comma separated)")
+	fs.Var(&o.ports, "port", "Only report connections with either end on these ports (repeatable or comma separated)")
+	fs.Var(&o.cidrs, "cidr", "Only report connections with either end in these CIDRs, IPv4 or IPv6 (repeatable or comma separated)")
+	fs.StringVar(&o.cgroupPath, "cgroup", "", "Only report sockets owned by tasks in this cgroup v2 directory or its children")
+	fs.StringVar(&o.k8sSource, "k8s", "", "Attach Kubernetes pod identity to events, listing pods from: kubelet or apiserver (disabled if empty)")
+	fs.StringVar(&o.kubeletURL, "kubelet-url", "https://127.0.0.1:10250", "Kubelet to list pods from with --k8s=kubelet")
+	fs.BoolVar(&o.kubeletInsecure, "kubelet-insecure", false, "Don't verify the kubelet's TLS certificate")
+	fs.StringVar(&o.containers, "containers", "", "Attach container name and image to events, asking: docker, containerd or crio (disabled if empty)")
+	fs.StringVar(&o.containerSocket, "container-socket", "", "Runtime socket for --containers (defaults to the runtime's usual path)")
+	fs.BoolVar(&o.processInfo, "process-info", false, "Attach the command line, user and cgroup path from /proc to events")
+	fs.BoolVar(&o.reverseDNS, "reverse-dns", false, "Show the PTR names of event addresses, looked up in the background and cached")
+	fs.Var(&o.geoip, "geoip", "Label events and metrics with the remote end's country and ASN from these MaxMind DB files, e.g. GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb (repeatable or comma separated)")
+	fs.BoolVar(&o.userStacks, "user-stacks", false, "Show where in the program connections that were reset, got ICMP errors, or failed or were slow to connect were opened: the user stack of their connect() call")
+	fs.BoolVar(&o.cgroupMetrics, "cgroup-metrics", false, "Count drops, retransmits and bytes per cgroup in the kernel and export them on --listen-addr by cgroup, pod and container, without an event for each")
+	fs.Var(&o.tlsLibs, "tls-lib", "Attach the TLS probe to these libssl files, e.g. a container's or another OpenSSL build (repeatable or comma separated, defaults to the system libssl)")
+	fs.DurationVar(&o.topInterval, "interval", time.Second, "How often the top talkers are refreshed (top, --tui) and the --aggregate and listen counts printed")
+	fs.BoolVar(&o.aggregate, "aggregate", false, "Count drops and retransmits in the kernel and print the totals every --interval instead of each event")
+	fs.DurationVar(&o.rollupInterval, "rollup-interval", 0, "Print drop, retransmit and new connection rates over the last 1m, 5m and 1h to stderr at this interval, e.g. 1m (disabled if 0, every minute in benchmark and bench)")
+	fs.IntVar(&o.processReport, "process-report", 0, "Print the connects, failures, resets, drops, bytes, retransmits and worst destinations of this many processes at exit and on SIGUSR1, and serve them all on GET /api/v1/processes (disabled if 0)")
+	fs.BoolVar(&o.anomaly, "anomaly", false, "Learn the usual drop and retransmit rates of the host and its busiest destinations, and mark drops and retransmits with anomaly=true while a rate is unusually high")
+	fs.IntVar(&o.anomalyTop, "anomaly-top", 10, "How many of the busiest destinations --anomaly keeps a baseline for, per event type")
+	fs.Float64Var(&o.anomalyScore, "anomaly-threshold", 3, "Standard deviations above its baseline a rate has to be for --anomaly to flag it")
+	fs.StringVar(&o.csvPath, "output", "", "Also write every event to this CSV file (disabled if empty)")
+	fs.Int64Var(&o.csvMaxSize, "output-max-size", 0, "Start a new --output file after this many MB (disabled if 0)")
+	fs.DurationVar(&o.csvRotate, "output-rotate", 0, "Start a new --output file at this interval, e.g. 1h (disabled if 0)")
+	fs.StringVar(&o.dbPath, "db", "", "Also store every event in this SQLite database, for the query command (disabled if empty)")
+	o.sample = 1
+	fs.Var(&o.sample, "sample", "Only emit every Nth event of each type, as 1/N or N, decided in the kernel so busy hosts don't fill the ring buffer (1 = every event)")
+	fs.UintVar(&o.connLimit, "conn-limit", 0, "Emit at most this many drops and retransmits per connection and second, counting the rest in the kernel (disabled if 0)")
+	fs.DurationVar(&o.coalesce, "coalesce", 0, "Fold identical drops, retransmits and resets within this window into one event with a count, e.g. 1s (disabled if 0)")
+	fs.IntVar(&o.bufferSize, "buffer-size", 4096, "Most events read from the kernel that can wait for the processor and its sinks")
+	fs.StringVar(&o.overflowPolicy, "overflow-policy", overflowBlock, "What the reader does when --buffer-size events are waiting: block (the kernel buffer fills up and loses events) or drop (drop them in userspace and count them)")
+	fs.IntVar(&o.sinkBuffer, "sink-buffer", 2048, "Events each file and network sink can fall behind the processor before it loses them, so a slow one doesn't hold up the others (0 = call them on the processor goroutine)")
+	fs.StringVar(&o.btfPath, "btf", "", "Load the programs against this kernel BTF, a .btf or BTFHub .btf.tar.xz file or a directory of them named by kernel release (defaults to /sys/kernel/btf/vmlinux)")
+	fs.BoolVar(&o.sockOps, "sockops", false, "Get retransmits, state changes and RTT from a sock_ops program on the root cgroup instead of tracepoints and kprobes, where the kernel supports it (only sees connections opened after startup)")
+	fs.Var(&o.interfaces, "interface", "Count TCP segments arriving on these Ethernet interfaces and those reaching the TCP stack, to see what's dropped in between (repeatable or comma separated, disabled if empty)")
+	fs.StringVar(&o.interfaceHook, "interface-hook", interfaceHookTC, "Where --interface counts arriving segments: tc (clsact ingress through tcx, Linux 6.6) or xdp (before GRO, and only with the interface's XDP slot free)")
+	fs.UintVar(&o.synFlood, "syn-flood", 0, "With --interface, send a syn_flood event when a source prefix sends more than this many SYNs in a second (disabled if 0)")
+	fs.UintVar(&o.synFloodV4, "syn-flood-v4-prefix", 24, "Prefix length --syn-flood groups IPv4 sources by")
+	fs.UintVar(&o.synFloodV6, "syn-flood-v6-prefix", 64, "Prefix length --syn-flood groups IPv6 sources by")
+	fs.BoolVar(&o.enforce, "enforce", false, "Fail connect() calls that a --block rule matches with EPERM, from cgroup programs on the root cgroup, and take rules on --control-addr's /api/v1/enforce while running")
+	fs.Var(&o.block, "block", "With --enforce (which it turns on), a rule of connects to fail: to=CIDR [port=N] [proto=tcp|udp] [cgroup=DIR] (repeatable)")
+	fs.BoolVar(&o.bpfStats, "bpf-stats", false, "Have the kernel count runs and CPU time of the monitor's BPF programs, reported at exit, in the API summary and on /metrics (costs a little for every BPF program on the host while on)")
+	fs.StringVar(&o.logLevel, "log-level", "info", "Least severe log records to write: debug, info, warn or error")
+	fs.StringVar(&o.logFormat, "log-format", logFormatText, "Log record format on stderr: text (key=value) or json")
+	fs.BoolVar(&o.btfDownload, "btf-download", false, "Download the kernel's BTF from BTFHub when it has none of its own and --btf isn't given")
+	fs.StringVar(&o.pinPath, "pin-path", "", "Pin the BPF maps and links under this bpffs directory, e.g. /sys/fs/bpf/tcpmonitor, so counters and connections survive a restart (disabled if empty)")
+	fs.BoolVar(&o.daemon, "daemon", false, "Run as a systemd service: the duration is optional, readiness and watchdog pings go to $NOTIFY_SOCKET and logs are journald-friendly")
+	fs.StringVar(&o.pidFile, "pid-file", "", "Write the PID to this file while running, e.g. /run/tcpmon.pid (disabled if empty)")
+	fs.StringVar(&o.runAsUser, "user", "", "Once everything is loaded and attached, switch to this user, a name or uid, optionally :group, e.g. nobody or 65534:65534 (stays root if empty). The --pid-file, --pin-path and control socket are handed to it; the PID file is only emptied on exit, and --output/--out files can't be rotated in directories it can't write to")
+	fs.Var(&o.keepCaps, "keep-caps", "Capabilities kept with --user: bpf, perfmon, sys_admin, sys_ptrace, dac_read_search, net_bind_service, sys_resource, net_admin, or none (repeatable or comma separated, defaults to bpf,perfmon,sys_ptrace, or sys_admin,sys_ptrace before 5.8, plus net_admin with --control-addr)")
+	fs.BoolVar(&o.tui, "tui", false, "Show a live dashboard of drops, retransmits and top talkers instead of printing events")
+}
+
+// sampleFlag is --sample: 1/N, or just N
+type sampleFlag uint32
+
+func (s *sampleFlag) String() string {
+	if *s <= 1 {
+		return "1"
+	}
+	return fmt.Sprintf("1/%d", *s)
+}
+
+func (s *sampleFlag) Set(v string) error {
+	n, err := strconv.ParseUint(strings.TrimPrefix(v, "1/"), 10, 32)
+	if err != nil || n == 0 {
+		return fmt.Errorf("use 1/N with N at least 1")
+	}
+	*s = sampleFlag(n)
+	return nil
+}
+
+// Flags of the commands that see drops
+func dropFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.pcapPath, "pcap", "", "Write the start of every dropped packet to this pcap file (disabled if empty)")
+	fs.UintVar(&o.pcapSnaplen, "pcap-snaplen", 128, fmt.Sprintf("Bytes of each dropped packet to capture with --pcap, from the IP header on (at most %d)", pcapMaxSnaplen))
+	fs.BoolVar(&o.stacks, "stacks", false, "Record the kernel stack of every drop, to see the netfilter, tc or qdisc path it took")
+}
+
+// The benchmark modes see everything
+func everythingFlags(fs *flag.FlagSet, o *options) {
+	dropFlags(fs, o)
+	lifecycleFlags(fs, o)
+}
+
+// Flags of the commands that see connection state changes
+func lifecycleFlags(fs *flag.FlagSet, o *options) {
+	fs.DurationVar(&o.slowConnect, "slow-connect", 0, "Report outgoing connections whose handshake took at least this long, e.g. 200ms (disabled if 0)")
+	fs.Uint64Var(&o.minBytes, "min-bytes", 0, "Only report closed connections that sent and received at least this many bytes together (all if 0)")
+	fs.DurationVar(&o.histInterval, "hist-interval", 0, "Report connect latency and RTT histograms per remote address at this interval, e.g. 10s (disabled if 0)")
+	fs.Var(&o.connectBuckets, "connect-buckets", "Connect latency histogram buckets: log2 (default), datacenter, internet, satellite, or up to 26 upper bounds, e.g. 1ms,5ms,20ms,100ms")
+	fs.Var(&o.rttBuckets, "rtt-buckets", "RTT histogram buckets, the same choices as --connect-buckets")
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the --config file. Every setting but the alerts is one of
+// the command line flags; the file only fills in flags that weren't given on
+// the command line.
+//
+//	probes: [drops, retransmits, states]
+//	proto: [tcp, udp]
+//	format: json
+//	filters:
+//	  comms: [nginx]
+//	  cidrs: [10.0.0.0/8]
+//	prometheus:
+//	  listen_addr: ":9090"
+type configFile struct {
+	Probes       []string `yaml:"probes"`          // --probes
+	Proto        []string `yaml:"proto"`           // --proto
+	Format       string   `yaml:"format"`          // --format
+	Interval     string   `yaml:"interval"`        // --interval, e.g. 2s
+	TUI          bool     `yaml:"tui"`             // --tui
+	Top          int      `yaml:"top"`             // --top
+	SlowConnect  string   `yaml:"slow_connect"`    // --slow-connect
+	MinBytes     int      `yaml:"min_bytes"`       // --min-bytes
+	HistInterval string   `yaml:"hist_interval"`   // --hist-interval
+	Sample       string   `yaml:"sample"`          // --sample, e.g. 1/100
+	ConnLimit    int      `yaml:"conn_limit"`      // --conn-limit
+	Coalesce     string   `yaml:"coalesce"`        // --coalesce, e.g. 1s
+	BufferSize   int      `yaml:"buffer_size"`     // --buffer-size
+	Overflow     string   `yaml:"overflow_policy"` // --overflow-policy
+	SinkBuffer   int      `yaml:"sink_buffer"`     // --sink-buffer
+	Aggregate    bool     `yaml:"aggregate"`       // --aggregate
+	Rollups      string   `yaml:"rollup_interval"` // --rollup-interval, e.g. 1m
+	Processes    int      `yaml:"process_report"`  // --process-report
+	Stacks       bool     `yaml:"stacks"`          // --stacks
+	UserStacks   bool     `yaml:"user_stacks"`     // --user-stacks
+	CgroupStats  bool     `yaml:"cgroup_metrics"`  // --cgroup-metrics
+	PinPath      string   `yaml:"pin_path"`        // --pin-path
+	Daemon       bool     `yaml:"daemon"`          // --daemon
+	PIDFile      string   `yaml:"pid_file"`        // --pid-file
+	User         string   `yaml:"user"`            // --user
+	KeepCaps     []string `yaml:"keep_caps"`       // --keep-caps
+
+	HistBuckets struct {
+		Connect []string `yaml:"connect"` // --connect-buckets, [datacenter] or [1ms, 5ms, 20ms]
+		RTT     []string `yaml:"rtt"`     // --rtt-buckets
+	} `yaml:"hist_buckets"`
+
+	BTF struct {
+		Path     string `yaml:"path"`     // --btf
+		Download bool   `yaml:"download"` // --btf-download
+	} `yaml:"btf"`
+
+	Anomaly struct {
+		Enabled   bool    `yaml:"enabled"`   // --anomaly
+		Top       int     `yaml:"top"`       // --anomaly-top
+		Threshold float64 `yaml:"threshold"` // --anomaly-threshold
+	} `yaml:"anomaly"`
+
+	Filters configFilters `yaml:"filters"`
+
+	Output struct {
+		CSV     string `yaml:"csv"`      // --output
+		MaxSize int    `yaml:"max_size"` // --output-max-size, MB
+		Rotate  string `yaml:"rotate"`   // --output-rotate
+		DB      string `yaml:"db"`       // --db
+	} `yaml:"output"`
+
+	Record struct {
+		Out     string `yaml:"out"`      // --out
+		MaxSize int    `yaml:"max_size"` // --out-max-size, MB
+		Rotate  string `yaml:"rotate"`   // --out-rotate
+	} `yaml:"record"`
+
+	Pcap struct {
+		File    string `yaml:"file"`    // --pcap
+		Snaplen int    `yaml:"snaplen"` // --pcap-snaplen
+	} `yaml:"pcap"`
+
+	Prometheus struct {
+		ListenAddr string `yaml:"listen_addr"`
+	} `yaml:"prometheus"`
+
+	Control struct {
+		Address   string `yaml:"address"`    // --control-addr
+		TokenFile string `yaml:"token_file"` // --control-token-file
+	} `yaml:"control"`
+
+	OTLP struct {
+		Endpoint string `yaml:"endpoint"`
+		Insecure bool   `yaml:"insecure"`
+	} `yaml:"otlp"`
+
+	StatsD struct {
+		Address string   `yaml:"address"`
+		Prefix  string   `yaml:"prefix"`
+		Tags    []string `yaml:"tags"`
+	} `yaml:"statsd"`
+
+	IPFIX struct {
+		Collector string `yaml:"collector"`
+		Domain    int    `yaml:"domain"`
+		Active    string `yaml:"active_timeout"`
+	} `yaml:"ipfix"`
+
+	Kafka struct {
+		Brokers      []string `yaml:"brokers"`
+		Topic        string   `yaml:"topic"`
+		Encoding     string   `yaml:"encoding"`
+		Key          string   `yaml:"key"`
+		BatchSize    int      `yaml:"batch_size"`
+		BatchTimeout string   `yaml:"batch_timeout"`
+	} `yaml:"kafka"`
+
+	NATS struct {
+		URL       string `yaml:"url"`
+		Subject   string `yaml:"subject"`
+		Encoding  string `yaml:"encoding"`
+		JetStream bool   `yaml:"jetstream"`
+		Stream    string `yaml:"stream"`
+	} `yaml:"nats"`
+
+	Syslog struct {
+		Address  string `yaml:"address"`
+		Facility string `yaml:"facility"`
+	} `yaml:"syslog"`
+
+	GRPC struct {
+		ListenAddr string `yaml:"listen_addr"`
+	} `yaml:"grpc"`
+
+	Plugins struct {
+		Commands []string `yaml:"commands"`
+		Encoding string   `yaml:"encoding"`
+	} `yaml:"plugins"`
+
+	Kubernetes struct {
+		Source          string `yaml:"source"`
+		KubeletURL      string `yaml:"kubelet_url"`
+		KubeletInsecure bool   `yaml:"kubelet_insecure"`
+	} `yaml:"kubernetes"`
+
+	Containers struct {
+		Runtime string `yaml:"runtime"`
+		Socket  string `yaml:"socket"`
+	} `yaml:"containers"`
+
+	ProcessInfo bool     `yaml:"process_info"` // --process-info
+	ReverseDNS  bool     `yaml:"reverse_dns"`  // --reverse-dns
+	GeoIP       []string `yaml:"geoip"`        // --geoip, the database files
+	TLSLib      []string `yaml:"tls_lib"`      // --tls-lib
+	SockOps     bool     `yaml:"sockops"`      // --sockops
+	BPFStats    bool     `yaml:"bpf_stats"`    // --bpf-stats
+	LogLevel    string   `yaml:"log_level"`    // --log-level
+	LogFormat   string   `yaml:"log_format"`   // --log-format
+
+	Interfaces struct {
+		Names []string `yaml:"names"` // --interface
+		Hook  string   `yaml:"hook"`  // --interface-hook
+	} `yaml:"interfaces"`
+
+	SynFlood struct {
+		Threshold int `yaml:"threshold"` // --syn-flood
+		V4Prefix  int `yaml:"v4_prefix"` // --syn-flood-v4-prefix
+		V6Prefix  int `yaml:"v6_prefix"` // --syn-flood-v6-prefix
+	} `yaml:"syn_flood"`
+
+	Enforce struct {
+		Enabled bool     `yaml:"enabled"` // --enforce
+		Block   []string `yaml:"block"`   // --block
+	} `yaml:"enforce"`
+
+	Labels map[string]string `yaml:"labels"` // --label
+
+	Alerts configAlerts `yaml:"alerts"` // Only in the file, see alerts.go
+}
+
+type configFilters struct {
+	PIDs   []uint32 `yaml:"pids"`
+	Comms  []string `yaml:"comms"`
+	Ports  []uint16 `yaml:"ports"`
+	CIDRs  []string `yaml:"cidrs"`
+	Cgroup string   `yaml:"cgroup"`
+}
+
+// parse is parseFilters for a filters section
+func (c configFilters) parse() (*Filters, error) {
+	return parseFilters(uintStrings(c.PIDs), c.Comms, uintStrings(c.Ports), c.CIDRs, c.Cgroup)
+}
+
+// applyConfig reads path and sets the flags of fs it mentions, unless they
+// were already set on the command line. Settings for flags the command
+// doesn't take are skipped with a warning, so one file can serve every
+// command. The file is returned for the settings that aren't flags.
+func applyConfig(fs *flag.FlagSet, path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c configFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true) // A typo should be an error, not a silently ignored setting
+	// io.EOF means the file is empty
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	settings := []struct {
+		flag   string
+		values []string
+	}{
+		{"probes", c.Probes},
+		{"proto", c.Proto},
+		{"format", nonEmpty(c.Format)},
+		{"interval", nonEmpty(c.Interval)},
+		{"tui", nonFalse(c.TUI)},
+		{"top", nonZero(c.Top)},
+		{"slow-connect", nonEmpty(c.SlowConnect)},
+		{"min-bytes", nonZero(c.MinBytes)},
+		{"hist-interval", nonEmpty(c.HistInterval)},
+		{"connect-buckets", c.HistBuckets.Connect},
+		{"rtt-buckets", c.HistBuckets.RTT},
+		{"sample", nonEmpty(c.Sample)},
+		{"conn-limit", nonZero(c.ConnLimit)},
+		{"coalesce", nonEmpty(c.Coalesce)},
+		{"buffer-size", nonZero(c.BufferSize)},
+		{"overflow-policy", nonEmpty(c.Overflow)},
+		{"sink-buffer", nonZero(c.SinkBuffer)},
+		{"aggregate", nonFalse(c.Aggregate)},
+		{"rollup-interval", nonEmpty(c.Rollups)},
+		{"process-report", nonZero(c.Processes)},
+		{"stacks", nonFalse(c.Stacks)},
+		{"user-stacks", nonFalse(c.UserStacks)},
+		{"cgroup-metrics", nonFalse(c.CgroupStats)},
+		{"pin-path", nonEmpty(c.PinPath)},
+		{"daemon", nonFalse(c.Daemon)},
+		{"pid-file", nonEmpty(c.PIDFile)},
+		{"user", nonEmpty(c.User)},
+		{"keep-caps", c.KeepCaps},
+		{"btf", nonEmpty(c.BTF.Path)},
+		{"btf-download", nonFalse(c.BTF.Download)},
+		{"anomaly", nonFalse(c.Anomaly.Enabled)},
+		{"anomaly-top", nonZero(c.Anomaly.Top)},
+		{"anomaly-threshold", nonZeroFloat(c.Anomaly.Threshold)},
+		{"pid", uintStrings(c.Filters.PIDs)},
+		{"comm", c.Filters.Comms},
+		{"port", uintStrings(c.Filters.Ports)},
+		{"cidr", c.Filters.CIDRs},
+		{"cgroup", nonEmpty(c.Filters.Cgroup)},
+		{"output", nonEmpty(c.Output.CSV)},
+		{"output-max-size", nonZero(c.Output.MaxSize)},
+		{"output-rotate", nonEmpty(c.Output.Rotate)},
+		{"db", nonEmpty(c.Output.DB)},
+		{"out", nonEmpty(c.Record.Out)},
+		{"out-max-size", nonZero(c.Record.MaxSize)},
+		{"out-rotate", nonEmpty(c.Record.Rotate)},
+		{"pcap", nonEmpty(c.Pcap.File)},
+		{"pcap-snaplen", nonZero(c.Pcap.Snaplen)},
+		{"listen-addr", nonEmpty(c.Prometheus.ListenAddr)},
+		{"control-addr", nonEmpty(c.Control.Address)},
+		{"control-token-file", nonEmpty(c.Control.TokenFile)},
+		{"otlp-endpoint", nonEmpty(c.OTLP.Endpoint)},
+		{"otlp-insecure", nonFalse(c.OTLP.Insecure)},
+		{"statsd", nonEmpty(c.StatsD.Address)},
+		{"statsd-prefix", nonEmpty(c.StatsD.Prefix)},
+		{"statsd-tags", c.StatsD.Tags},
+		{"ipfix", nonEmpty(c.IPFIX.Collector)},
+		{"ipfix-domain", nonZero(c.IPFIX.Domain)},
+		{"ipfix-active-timeout", nonEmpty(c.IPFIX.Active)},
+		{"kafka-brokers", c.Kafka.Brokers},
+		{"kafka-topic", nonEmpty(c.Kafka.Topic)},
+		{"kafka-encoding", nonEmpty(c.Kafka.Encoding)},
+		{"kafka-key", nonEmpty(c.Kafka.Key)},
+		{"kafka-batch-size", nonZero(c.Kafka.BatchSize)},
+		{"kafka-batch-timeout", nonEmpty(c.Kafka.BatchTimeout)},
+		{"nats-url", nonEmpty(c.NATS.URL)},
+		{"nats-subject", nonEmpty(c.NATS.Subject)},
+		{"nats-encoding", nonEmpty(c.NATS.Encoding)},
+		{"nats-jetstream", nonFalse(c.NATS.JetStream)},
+		{"nats-stream", nonEmpty(c.NATS.Stream)},
+		{"syslog", nonEmpty(c.Syslog.Address)},
+		{"syslog-facility", nonEmpty(c.Syslog.Facility)},
+		{"grpc-listen", nonEmpty(c.GRPC.ListenAddr)},
+		{"plugin", c.Plugins.Commands},
+		{"plugin-encoding", nonEmpty(c.Plugins.Encoding)},
+		{"k8s", nonEmpty(c.Kubernetes.Source)},
+		{"kubelet-url", nonEmpty(c.Kubernetes.KubeletURL)},
+		{"kubelet-insecure", nonFalse(c.Kubernetes.KubeletInsecure)},
+		{"containers", nonEmpty(c.Containers.Runtime)},
+		{"container-socket", nonEmpty(c.Containers.Socket)},
+		{"process-info", nonFalse(c.ProcessInfo)},
+		{"reverse-dns", nonFalse(c.ReverseDNS)},
+		{"geoip", c.GeoIP},
+		{"tls-lib", c.TLSLib},
+		{"sockops", nonFalse(c.SockOps)},
+		{"interface", c.Interfaces.Names},
+		{"interface-hook", nonEmpty(c.Interfaces.Hook)},
+		{"syn-flood", nonZero(c.SynFlood.Threshold)},
+		{"syn-flood-v4-prefix", nonZero(c.SynFlood.V4Prefix)},
+		{"syn-flood-v6-prefix", nonZero(c.SynFlood.V6Prefix)},
+		{"enforce", nonFalse(c.Enforce.Enabled)},
+		{"block", c.Enforce.Block},
+		{"bpf-stats", nonFalse(c.BPFStats)},
+		{"log-level", nonEmpty(c.LogLevel)},
+		{"log-format", nonEmpty(c.LogFormat)},
+		{"label", labelPairs(c.Labels, "=")},
+	}
+	for _, s := range settings {
+		if len(s.values) == 0 || explicit[s.flag] {
+			continue
+		}
+		if fs.Lookup(s.flag) == nil {
+			slog.Warn("config setting not used by this command, ignoring it", "config", path, "command", fs.Name(), "flag", s.flag)
+			continue
+		}
+		for _, v := range s.values {
+			if err := fs.Set(s.flag, v); err != nil {
+				return nil, fmt.Errorf("%s: invalid value %q for %s: %w", path, v, s.flag, err)
+			}
+		}
+	}
+	return &c, nil
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+func nonFalse(b bool) []string {
+	if !b {
+		return nil
+	}
+	return []string{"true"}
+}
+
+func nonZero(n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return []string{strconv.Itoa(n)}
+}
+
+func nonZeroFloat(f float64) []string {
+	if f == 0 {
+		return nil
+	}
+	return []string{strconv.FormatFloat(f, 'g', -1, 64)}
+}
+
+func uintStrings[T uint16 | uint32](ns []T) listFlag {
+	s := make(listFlag, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return s
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// ConnHistory keeps what happened to each connection, for the TUI's and
+// the API's drill-down: its state changes, retransmits, drops and other
+// events as they go by, and RTT and cwnd samples from polling the
+// connection table once a second. Each connection gets a ring of the last
+// connHistoryLen entries, and only the last connHistoryConns connections
+// are kept, closed ones and those idle longest going first.
+//
+// A connection is tracked from its first state change, connect,
+// retransmit or socket option, or from the connection table; drops and the
+// rest are only added to connections already tracked, so a scan or a flood
+// doesn't push out the ones worth looking at. Options set before connect()
+// wait by socket until a state change shows its tuple, for at most
+// connHistoryPendingTTL, and are dropped when the socket closes: a socket
+// address is reused once it's freed, and a socket that never connects
+// shouldn't hold its slot for good.
+
+const (
+	connHistoryLen   = 128
+	connHistoryConns = 4096
+	connHistoryPoll  = time.Second
+
+	connHistoryPending        = 1024 // Unconnected sockets with options waiting
+	connHistoryPendingEntries = 16   // Options waiting per socket, later ones are left out
+	connHistoryPendingTTL     = time.Minute
+)
+
+// connHistoryKey is a connection from its own side
+type connHistoryKey struct{ local, remote netip.AddrPort }
+
+type connHistory struct {
+	entries []apiHistoryEntry // A ring once it's connHistoryLen long
+	next    int               // The oldest entry, once it is
+	updated time.Time
+	comm    string
+	closed  bool // A close event, or gone from the connection table
+	inTable bool
+
+	// The connection table's running RTT sum as of the last poll, new
+	// samples are the difference
+	rttSamples uint32
+	rttSumUs   uint64
+}
+
+// GET /api/v1/connections/history, one per event or sample, oldest first
+type apiHistoryEntry struct {
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"`                // An event type, or sample for a poll of the connection table
+	State       string    `json:"state,omitempty"`     // Retransmits, and the new state of state changes
+	OldState    string    `json:"old_state,omitempty"` // State changes
+	Reason      string    `json:"reason,omitempty"`    // Drops, sent resets and the other events with one
+	Count       uint32    `json:"count,omitempty"`     // Folded by --coalesce
+	RttUs       uint32    `json:"rtt_us,omitempty"`    // Samples: the average since the last one
+	RttvarUs    uint32    `json:"rttvar_us,omitempty"`
+	Cwnd        uint32    `json:"cwnd,omitempty"`        // Segments
+	Ssthresh    uint32    `json:"ssthresh,omitempty"`    // Left out during the first slow start
+	Retransmits uint32    `json:"retransmits,omitempty"` // Samples: the connection's so far
+	Change      string    `json:"change,omitempty"`      // Sockopts: what the call did to reason's option, e.g. off -> on
+}
+
+// pendingOptions are a socket's options waiting for its tuple
+type pendingOptions struct {
+	since   time.Time // The first one
+	entries []apiHistoryEntry
+}
+
+type apiHistory struct {
+	Saddr   string            `json:"saddr"` // The connection's own side
+	Sport   uint16            `json:"sport"`
+	Daddr   string            `json:"daddr"`
+	Dport   uint16            `json:"dport"`
+	Comm    string            `json:"comm,omitempty"`
+	Closed  bool              `json:"closed"`
+	Entries []apiHistoryEntry `json:"entries"`
+}
+
+type ConnHistory struct {
+	conns *ebpf.Map
+
+	mu        sync.Mutex // Observe runs on the processor goroutine, the poller and readers on their own
+	histories map[connHistoryKey]*connHistory
+	pending   map[uint64]*pendingOptions // By the socket's address, see TcpEvent.Sock
+}
+
+// NewConnHistory polls conns unless it's nil, as when replaying
+func NewConnHistory(conns *ebpf.Map) *ConnHistory {
+	c := &ConnHistory{conns: conns, histories: make(map[connHistoryKey]*connHistory), pending: make(map[uint64]*pendingOptions)}
+	if conns != nil {
+		go c.poll()
+	}
+	return c
+}
+
+func (c *ConnHistory) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/connections/history", c.handleHistory)
+}
+
+func addrPort(addr [16]uint8, port uint16) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom16(addr).Unmap(), port)
+}
+
+func (h *connHistory) add(e apiHistoryEntry) {
+	if len(h.entries) < connHistoryLen {
+		h.entries = append(h.entries, e)
+	} else {
+		h.entries[h.next] = e
+		h.next = (h.next + 1) % connHistoryLen
+	}
+	if e.Time.After(h.updated) {
+		h.updated = e.Time
+	}
+}
+
+// lookup finds a tracked connection from either side, drops are often
+// seen from the peer's. Called with mu held.
+func (c *ConnHistory) lookup(a, b netip.AddrPort) (connHistoryKey, *connHistory) {
+	k := connHistoryKey{a, b}
+	if h := c.histories[k]; h != nil {
+		return k, h
+	}
+	k = connHistoryKey{b, a}
+	return k, c.histories[k]
+}
+
+func (c *ConnHistory) Observe(event *TcpEvent, p *EventProcessor) {
+	if event.Family == 0 || event.Type == eventUDPError {
+		return
+	}
+	e := apiHistoryEntry{Time: event.when(), Kind: eventTypeNames[event.Type], Reason: p.eventReason(event)}
+	if event.Count > 1 {
+		e.Count = event.Count
+	}
+	switch event.Type {
+	case eventState:
+		e.State, e.OldState = p.stateName(event.State), p.stateName(event.OldState)
+	case eventRetransmit:
+		e.State = p.stateName(event.State)
+	case eventSockopt:
+		e.Change = sockoptChange(event)
+	}
+	local, remote := addrPort(event.Saddr, event.Sport), addrPort(event.Daddr, event.Dport)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if event.Type == eventSockopt && event.Dport == 0 {
+		c.wait(event.Sock, e)
+		return
+	}
+	closing := event.Type == eventClose || event.Type == eventState && event.State == tcpClose
+	if closing && event.Dport == 0 {
+		delete(c.pending, event.Sock) // A socket that never connected, like a listener
+	}
+	_, h := c.lookup(local, remote)
+	if h == nil {
+		if event.Type != eventState && event.Type != eventConnect && event.Type != eventRetransmit && event.Type != eventSockopt {
+			if closing {
+				delete(c.pending, event.Sock)
+			}
+			return
+		}
+		if len(c.histories) >= connHistoryConns {
+			c.trim()
+		}
+		h = &connHistory{comm: commString(event.Comm[:])}
+		c.histories[connHistoryKey{local, remote}] = h
+	}
+	// connect() moves to SYN_SENT before it picks the source port, so the
+	// tuple is only whole from the next state change on
+	if waiting := c.pending[event.Sock]; waiting != nil && (event.Type == eventState && event.Sport != 0 || closing) {
+		if e.Time.Sub(waiting.since) < connHistoryPendingTTL {
+			for _, w := range waiting.entries {
+				h.add(w)
+			}
+		}
+		delete(c.pending, event.Sock)
+	}
+	h.add(e)
+	if event.Type == eventClose {
+		h.closed = true
+	}
+}
+
+// wait keeps an option set on an unconnected socket for its connection.
+// Sockets that never connect, like listeners, aren't worth pushing out the
+// others for, so once there are connHistoryPending new ones, and none has
+// waited out connHistoryPendingTTL, they are left out. Called with mu held.
+func (c *ConnHistory) wait(sock uint64, e apiHistoryEntry) {
+	if sock == 0 {
+		return
+	}
+	waiting := c.pending[sock]
+	if waiting != nil && e.Time.Sub(waiting.since) >= connHistoryPendingTTL {
+		waiting = nil // Another socket at a freed one's address
+	}
+	if waiting == nil {
+		if len(c.pending) >= connHistoryPending {
+			c.expirePending(e.Time)
+		}
+		if len(c.pending) >= connHistoryPending {
+			return
+		}
+		waiting = &pendingOptions{since: e.Time}
+		c.pending[sock] = waiting
+	}
+	if len(waiting.entries) < connHistoryPendingEntries {
+		waiting.entries = append(waiting.entries, e)
+	}
+}
+
+// expirePending drops the options that waited connHistoryPendingTTL for
+// a connection. Called with mu held.
+func (c *ConnHistory) expirePending(now time.Time) {
+	for sock, waiting := range c.pending {
+		if now.Sub(waiting.since) >= connHistoryPendingTTL {
+			delete(c.pending, sock)
+		}
+	}
+}
+
+// trim makes room for connHistoryConns/8 more connections at once, rather
+// than looking for the oldest on every new one. Called with mu held.
+func (c *ConnHistory) trim() {
+	type candidate struct {
+		key connHistoryKey
+		h   *connHistory
+	}
+	all := make([]candidate, 0, len(c.histories))
+	for k, h := range c.histories {
+		all = append(all, candidate{k, h})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].h.closed != all[j].h.closed {
+			return all[i].h.closed
+		}
+		return all[i].h.updated.Before(all[j].h.updated)
+	})
+	for _, cand := range all[:len(all)-connHistoryConns*7/8] {
+		delete(c.histories, cand.key)
+	}
+}
+
+func (c *ConnHistory) poll() {
+	ticker := time.NewTicker(connHistoryPoll)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.sample(now)
+	}
+}
+
+// sample adds an entry to every connection in the table with new RTT
+// samples. The table is read before taking mu, it can be big.
+func (c *ConnHistory) sample(now time.Time) {
+	type row struct {
+		key  connHistoryKey
+		info monitorConnInfo
+	}
+	var rows []row
+	var key uint64
+	var info monitorConnInfo
+	iter := c.conns.Iterate()
+	for iter.Next(&key, &info) {
+		rows = append(rows, row{connHistoryKey{addrPort(info.Saddr, info.Sport), addrPort(info.Daddr, info.Dport)}, info})
+	}
+	if iter.Err() != nil {
+		return // Try again next time
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expirePending(now)
+	seen := make(map[connHistoryKey]bool, len(rows))
+	for _, r := range rows {
+		seen[r.key] = true
+		h := c.histories[r.key]
+		if h == nil {
+			if r.info.RttSamples == 0 || len(c.histories) >= connHistoryConns {
+				continue // Connections from events make room, the table's only fill it
+			}
+			var comm [16]byte
+			for i, ch := range r.info.Comm {
+				comm[i] = byte(ch)
+			}
+			h = &connHistory{comm: commString(comm[:])}
+			c.histories[r.key] = h
+		}
+		h.inTable = true
+		if r.info.RttSamples == h.rttSamples {
+			continue
+		}
+		e := apiHistoryEntry{
+			Time:        now,
+			Kind:        "sample",
+			RttUs:       uint32((r.info.RttSumUs - h.rttSumUs) / uint64(r.info.RttSamples-h.rttSamples)),
+			RttvarUs:    r.info.RttvarUs,
+			Cwnd:        r.info.SndCwnd,
+			Retransmits: r.info.Retransmits,
+		}
+		if r.info.SndSsthresh != tcpInfiniteSsthresh {
+			e.Ssthresh = r.info.SndSsthresh
+		}
+		h.add(e)
+		h.rttSamples, h.rttSumUs = r.info.RttSamples, r.info.RttSumUs
+	}
+	for k, h := range c.histories {
+		if h.inTable && !seen[k] {
+			h.closed = true
+		}
+	}
+}
+
+// History is a connection's entries, from either side, oldest first
+func (c *ConnHistory) History(a, b netip.AddrPort) (*apiHistory, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, h := c.lookup(a, b)
+	if h == nil {
+		return nil, false
+	}
+	entries := append(append([]apiHistoryEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+	// Samples are timed at the poll, events by the kernel
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return &apiHistory{
+		Saddr:   k.local.Addr().String(),
+		Sport:   k.local.Port(),
+		Daddr:   k.remote.Addr().String(),
+		Dport:   k.remote.Port(),
+		Comm:    h.comm,
+		Closed:  h.closed,
+		Entries: entries,
+	}, true
+}
+
+// handleHistory takes the saddr, sport, daddr and dport of a connection
+// as GET /api/v1/connections lists it, either way round
+func (c *ConnHistory) handleHistory(w http.ResponseWriter, r *http.Request) {
+	var ends [2]netip.AddrPort
+	for i, names := range [2][2]string{{"saddr", "sport"}, {"daddr", "dport"}} {
+		addr, err := netip.ParseAddr(r.URL.Query().Get(names[0]))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad %s: %v", names[0], err), http.StatusBadRequest)
+			return
+		}
+		port, err := strconv.ParseUint(r.URL.Query().Get(names[1]), 10, 16)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad %s: %v", names[1], err), http.StatusBadRequest)
+			return
+		}
+		ends[i] = netip.AddrPortFrom(addr.Unmap(), uint16(port))
+	}
+	h, ok := c.History(ends[0], ends[1])
+	if !ok {
+		http.Error(w, "no history for this connection", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, h)
+}
+
+// historyLine is an entry for the TUI
+func historyLine(e apiHistoryEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %-11s", e.Time.Format("15:04:05.000"), e.Kind)
+	switch {
+	case e.Kind == "sample":
+		fmt.Fprintf(&b, " rtt %v ±%v  cwnd %d", usDuration(e.RttUs), usDuration(e.RttvarUs), e.Cwnd)
+		if e.Ssthresh != 0 {
+			fmt.Fprintf(&b, "  ssthresh %d", e.Ssthresh)
+		}
+		fmt.Fprintf(&b, "  retransmits %d", e.Retransmits)
+	case e.OldState != "":
+		fmt.Fprintf(&b, " %s -> %s", e.OldState, e.State)
+	case e.State != "":
+		fmt.Fprintf(&b, " in %s", e.State)
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(&b, " %s", e.Reason)
+	}
+	if e.Change != "" {
+		fmt.Fprintf(&b, " %s", e.Change)
+	}
+	if e.Count > 1 {
+		fmt.Fprintf(&b, " (x%d)", e.Count)
+	}
+	return b.String()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// On Kubernetes nodes and gateways a dropped packet's addresses may be the
+// Service's, or the node's after masquerading, rather than the client's and
+// the pod's. The drop programs look up the packet's conntrack entry
+// (skb->_nfct) and send both tuples of connections NAT translated: the one
+// the client sent, and the one it became.
+
+// NAT_* in bpf/monitor.c
+const (
+	natSrc   = 0x1 // Source NAT: masquerade, SNAT
+	natDst   = 0x2 // Destination NAT: a Service, DNAT, a port forward
+	natReply = 0x4 // The packet was going the reply way, server to client
+)
+
+// Size of struct nf_conntrack_tuple, which struct ct_tuple in
+// bpf/monitor.c mirrors
+const conntrackTupleSize = 40
+
+// conntrackOffsets is where struct nf_conn keeps its two tuples and its
+// status, zero when there's no conntrack to read them from
+type conntrackOffsets struct {
+	orig, reply, status uint32
+}
+
+// loadConntrack never fails: without conntrack drops just go without their
+// NAT tuples. kernel is the --btf spec, nil for the running kernel's.
+func loadConntrack(kernel *btf.Spec) conntrackOffsets {
+	offsets, err := conntrackLayout(kernel)
+	if errors.Is(err, btf.ErrNotFound) {
+		slog.Info("no BTF for struct nf_conn, drops won't have NAT tuples", "err", err)
+		return conntrackOffsets{}
+	}
+	if err != nil {
+		slog.Warn("reading struct nf_conn from kernel BTF, drops won't have NAT tuples", "err", err)
+		return conntrackOffsets{}
+	}
+	return offsets
+}
+
+// conntrackLayout reads the offsets from struct nf_conn, which is in the
+// kernel's BTF when conntrack is built in and in nf_conntrack's otherwise.
+// Module BTF only comes with the running kernel.
+func conntrackLayout(kernel *btf.Spec) (conntrackOffsets, error) {
+	spec := kernel
+	if spec == nil {
+		var err error
+		if spec, err = btf.LoadKernelSpec(); err != nil {
+			return conntrackOffsets{}, err
+		}
+	}
+	var conn *btf.Struct
+	err := spec.TypeByName("nf_conn", &conn)
+	if errors.Is(err, btf.ErrNotFound) && kernel == nil {
+		// Not loaded yet, or a kernel without module BTF
+		module, merr := btf.LoadKernelModuleSpec("nf_conntrack")
+		if merr != nil {
+			return conntrackOffsets{}, fmt.Errorf("%w: %w", btf.ErrNotFound, merr)
+		}
+		err = module.TypeByName("nf_conn", &conn)
+	}
+	if err != nil {
+		return conntrackOffsets{}, err
+	}
+
+	var offsets conntrackOffsets
+	var hash *btf.Array
+	var hashOff uint32
+	for _, m := range conn.Members {
+		switch m.Name {
+		case "status":
+			offsets.status = m.Offset.Bytes()
+		case "tuplehash":
+			hash, _ = btf.UnderlyingType(m.Type).(*btf.Array)
+			hashOff = m.Offset.Bytes()
+		}
+	}
+	if hash == nil || hash.Nelems != 2 || offsets.status == 0 {
+		return conntrackOffsets{}, errors.New("struct nf_conn has no tuplehash[2] or status")
+	}
+
+	// struct nf_conntrack_tuple_hash: a list node, then the tuple
+	entry, ok := btf.UnderlyingType(hash.Type).(*btf.Struct)
+	if !ok {
+		return conntrackOffsets{}, errors.New("nf_conn.tuplehash isn't an array of structs")
+	}
+	entrySize, err := btf.Sizeof(entry)
+	if err != nil {
+		return conntrackOffsets{}, err
+	}
+	for _, m := range entry.Members {
+		if m.Name != "tuple" {
+			continue
+		}
+		if size, err := btf.Sizeof(m.Type); err != nil || size != conntrackTupleSize {
+			return conntrackOffsets{}, fmt.Errorf("struct nf_conntrack_tuple is %d bytes, expected %d", size, conntrackTupleSize)
+		}
+		offsets.orig = hashOff + m.Offset.Bytes()
+		offsets.reply = offsets.orig + uint32(entrySize)
+		return offsets, nil
+	}
+	return conntrackOffsets{}, errors.New("struct nf_conntrack_tuple_hash has no tuple")
+}
+
+// rewriteSpec tells the drop programs where to find the tuples
+func (o conntrackOffsets) rewriteSpec(spec *ebpf.CollectionSpec) error {
+	for name, value := range map[string]uint32{
+		"ct_orig_off":   o.orig,
+		"ct_reply_off":  o.reply,
+		"ct_status_off": o.status,
+	} {
+		if err := setVariable(spec, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// natKinds names the translations a connection went through
+func natKinds(flags uint32) string {
+	switch flags & (natSrc | natDst) {
+	case natSrc:
+		return "SNAT"
+	case natDst:
+		return "DNAT"
+	case natSrc | natDst:
+		return "SNAT+DNAT"
+	}
+	return ""
+}
+
+// natSuffix is the connection of a translated drop, as the client sent it
+// and as NAT turned it into, whichever way the packet was going
+func natSuffix(event *TcpEvent) string {
+	if event.NatFlags == 0 {
+		return ""
+	}
+	var reply string
+	if event.NatFlags&natReply != 0 {
+		reply = " (reply)"
+	}
+	return fmt.Sprintf(" | %s: %s -> %s => %s -> %s%s", natKinds(event.NatFlags),
+		formatEndpoint(event.CtSaddr, event.CtSport), formatEndpoint(event.CtDaddr, event.CtDport),
+		formatEndpoint(event.NatSaddr, event.NatSport), formatEndpoint(event.NatDaddr, event.NatDport), reply)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// ContainerInfo is what a container runtime tells us about a container
+type ContainerInfo struct {
+	ID    string
+	Name  string
+	Image string
+}
+
+// containerRuntime looks containers up by ID. Implementations talk to the
+// runtime's local socket; add one here to support another runtime.
+type containerRuntime interface {
+	Inspect(ctx context.Context, id string) (*ContainerInfo, error)
+}
+
+// Runtimes for --containers, with their usual socket paths
+var containerRuntimes = map[string]string{
+	"docker":     "/var/run/docker.sock",
+	"containerd": "/run/containerd/containerd.sock",
+	"crio":       "/var/run/crio/crio.sock",
+}
+
+func newContainerRuntime(name, socket string) (containerRuntime, error) {
+	defaultSocket, ok := containerRuntimes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown runtime %q, use: docker, containerd or crio", name)
+	}
+	if socket == "" {
+		socket = defaultSocket
+	}
+	if _, err := os.Stat(socket); err != nil {
+		return nil, fmt.Errorf("%s socket: %w", name, err)
+	}
+
+	if name == "docker" {
+		return newDockerRuntime(socket), nil
+	}
+	// containerd (through its CRI plugin) and CRI-O both serve the CRI API
+	return newCRIRuntime(socket)
+}
+
+// dockerRuntime uses the Docker Engine HTTP API over its unix socket
+type dockerRuntime struct {
+	client *http.Client
+}
+
+func newDockerRuntime(socket string) *dockerRuntime {
+	return &dockerRuntime{client: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+func (d *dockerRuntime) Inspect(ctx context.Context, id string) (*ContainerInfo, error) {
+	// The host is ignored, every request goes to the socket
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/containers/"+url.PathEscape(id)+"/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inspecting %s: %s", id, resp.Status)
+	}
+
+	var body struct {
+		Name   string
+		Config struct{ Image string }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", id, err)
+	}
+	return &ContainerInfo{ID: id, Name: strings.TrimPrefix(body.Name, "/"), Image: body.Config.Image}, nil
+}
+
+// criRuntime uses the Kubernetes Container Runtime Interface over gRPC
+type criRuntime struct {
+	client cri.RuntimeServiceClient
+}
+
+func newCRIRuntime(socket string) (*criRuntime, error) {
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &criRuntime{client: cri.NewRuntimeServiceClient(conn)}, nil
+}
+
+func (c *criRuntime) Inspect(ctx context.Context, id string) (*ContainerInfo, error) {
+	resp, err := c.client.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: id})
+	if err != nil {
+		return nil, fmt.Errorf("inspecting %s: %w", id, err)
+	}
+	status := resp.GetStatus()
+	return &ContainerInfo{ID: id, Name: status.GetMetadata().GetName(), Image: status.GetImage().GetImage()}, nil
+}
+
+// Runtimes name a container's cgroup after its 64 hex digit ID:
+// docker-<id>.scope, cri-containerd-<id>.scope, crio-<id>.scope, /docker/<id>...
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+func containerIDFromCgroup(path string) string {
+	ids := containerIDPattern.FindAllString(path, -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1] // Innermost, for containers nested in containers
+}
+
+// procCgroupPath reads a task's cgroup v2 path from /proc/<pid>/cgroup
+func procCgroupPath(pid uint32) (string, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// ContainerEnricher attaches the container name and image to events. The
+// runtime is only asked once per container, in the background; events seen
+// before the answer arrives go out without container info.
+type ContainerEnricher struct {
+	cgroups *cgroupResolver
+	runtime containerRuntime
+
+	mu          sync.RWMutex
+	cgroupToID  map[uint64]string         // "" for cgroups outside any container
+	containers  map[string]*ContainerInfo // nil while pending or when the runtime doesn't know it
+	inspectNext chan string
+}
+
+func NewContainerEnricher(runtime containerRuntime, cgroups *cgroupResolver) *ContainerEnricher {
+	c := &ContainerEnricher{
+		cgroups:     cgroups,
+		runtime:     runtime,
+		cgroupToID:  make(map[uint64]string),
+		containers:  make(map[string]*ContainerInfo),
+		inspectNext: make(chan string, 256),
+	}
+	go c.inspectLoop()
+	return c
+}
+
+// Container returns what's known about the container owning cgroupID
+// pid is only used to find the cgroup when the resolver hasn't seen it yet
+// Safe to call from any goroutine
+func (c *ContainerEnricher) Container(cgroupID uint64, pid uint32) *ContainerInfo {
+	c.mu.RLock()
+	id, cached := c.cgroupToID[cgroupID]
+	info, known := c.containers[id]
+	c.mu.RUnlock()
+
+	if !cached {
+		path, ok := c.cgroups.Path(cgroupID)
+		if !ok && pid != 0 {
+			path, ok = procCgroupPath(pid)
+		}
+		if !ok {
+			return nil
+		}
+		id = containerIDFromCgroup(path)
+
+		c.mu.Lock()
+		c.cgroupToID[cgroupID] = id
+		info, known = c.containers[id]
+		c.mu.Unlock()
+	}
+
+	if id != "" && !known {
+		c.mu.Lock()
+		_, known = c.containers[id] // Another goroutine may have queued it meanwhile
+		if !known {
+			c.containers[id] = nil // Pending
+		}
+		c.mu.Unlock()
+		if known {
+			return info
+		}
+		select {
+		case c.inspectNext <- id:
+		default:
+			// Queue is full, forget it so a later event retries
+			c.mu.Lock()
+			delete(c.containers, id)
+			c.mu.Unlock()
+		}
+	}
+	return info
+}
+
+func (c *ContainerEnricher) Enrich(event *TcpEvent) {
+	event.Container = c.Container(event.CgroupID, event.Pid)
+}
+
+func (c *ContainerEnricher) inspectLoop() {
+	for id := range c.inspectNext {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		info, err := c.runtime.Inspect(ctx, id)
+		cancel()
+		if err != nil {
+			// Left as nil, most likely the container is already gone
+			slog.Warn("inspecting container", "id", id, "err", err)
+			continue
+		}
+
+		c.mu.Lock()
+		c.containers[id] = info
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Endpoints that change what the monitor does, adding a --block rule or
+// attaching a probe, aren't served on --listen-addr: that's the metrics
+// port, usually open to the network and to any browser page that posts
+// to it. They go on --control-addr instead, off unless it's given, and
+// either a Unix socket only root and the monitor's own user may use, or
+// a loopback address that wants the --control-token-file's token as a
+// bearer token.
+
+// controlServer is the --control-addr listener's handler
+type controlServer struct {
+	mux   *http.ServeMux
+	token []byte // Wanted as "Authorization: Bearer <token>", nil for none
+	unix  bool   // Peers are checked by their credentials
+}
+
+type controlConnKey struct{}
+
+// newControlServer listens on addr, unix:/path/to.sock or a loopback
+// host:port, the latter only with a token
+func newControlServer(addr, tokenFile string) (*controlServer, net.Listener, error) {
+	c := &controlServer{mux: http.NewServeMux()}
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.token = bytes.TrimSpace(token); len(c.token) == 0 {
+			return nil, nil, fmt.Errorf("%s is empty", tokenFile)
+		}
+	}
+
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path) // Left behind by a previous run that was killed
+		old := unix.Umask(0o177)
+		ln, err := net.Listen("unix", path)
+		unix.Umask(old)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.unix = true
+		return c, ln, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, nil, fmt.Errorf("%s is not a loopback address, use one or unix:/path", addr)
+	}
+	if c.token == nil {
+		return nil, nil, errors.New("a TCP control address needs --control-token-file")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, ln, nil
+}
+
+// Serve answers on ln until it's closed
+func (c *controlServer) Serve(ln net.Listener) error {
+	srv := &http.Server{
+		Handler: c,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, controlConnKey{}, conn)
+		},
+	}
+	return srv.Serve(ln)
+}
+
+func (c *controlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.unix {
+		conn, _ := r.Context().Value(controlConnKey{}).(*net.UnixConn)
+		if uid, err := peerUID(conn); err != nil || uid != 0 && uid != os.Geteuid() {
+			slog.Warn("control request from a peer that isn't root or the monitor's user", "uid", uid, "err", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	if c.token != nil {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), c.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	c.mux.ServeHTTP(w, r)
+}
+
+// peerUID is the uid of the process at the other end of conn
+func peerUID(conn *net.UnixConn) (int, error) {
+	if conn == nil {
+		return -1, errors.New("not a Unix socket connection")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+	return int(cred.Uid), nil
+}
+
+// requireJSON answers 415 to a request whose body isn't said to be JSON,
+// which HTML forms and simple cross-site requests can't say
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
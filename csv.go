@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// csvColumns is the --output schema. Columns are only ever appended, so
+// scripts indexing by position keep working; cells that don't apply to an
+// event type are left empty, same as the fields left out of the JSON.
+var csvColumns = []string{
+	"timestamp", "type", "pid", "comm",
+	"reason", "function",
+	"family", "saddr", "sport", "daddr", "dport",
+	"state", "old_state",
+	"duration_ns", "bytes_sent", "bytes_received", "retransmits",
+	"rtt_min_us", "rtt_avg_us", "rtt_max_us", "rttvar_us",
+	"cgroup_id", "namespace", "pod", "container", "image",
+	"suppressed",
+	"cmdline", "uid", "user", "cgroup_path",
+	"netns", "netns_name",
+	"saddr_name", "daddr_name",
+	"direction", "queued_bytes",
+	"count",
+	"protocol",
+	"mtu",
+	"ooo_packets", "ooo_max_bytes", "reordering", "reord_seen",
+	"sacks", "sack_blocks", "dsacks", "dsack_bytes",
+	"probes", "max_probes",
+	"rmem_alloc", "rmem_after", "rcvbuf", "rmem_max", "collapses", "buffer_hint",
+	"nat", "ct_saddr", "ct_sport", "ct_daddr", "ct_dport", "nat_saddr", "nat_sport", "nat_daddr", "nat_dport",
+	"country", "asn", "as_org",
+	"tcp_connect_ns", "tls_wait_ns",
+	"stack", "user_stack",
+	"interface", "prefix_len", "syns",
+	"layer",
+	"rule",
+	"mptcp_token", "mptcp_subflow",
+	"sockopt", "sockopt_old", "sockopt_new",
+	"listen", "backlog", "somaxconn", "accept_queue",
+	"vlan", "master", "in_interface",
+	"tunnel", "vni", "inner_protocol", "inner_saddr", "inner_sport", "inner_daddr", "inner_dport",
+}
+
+// CSVSink writes every event to a CSV file, starting a new file when the
+// current one reaches maxBytes or is older than maxAge (0 disables either).
+// Rotated files get the time they were started in their name, e.g.
+// drops.csv becomes drops-20260131T220000.csv. Age is checked on a timer
+// too, so a file is rotated on time when no events come.
+type CSVSink struct {
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu      sync.Mutex // Observe and the age timer's goroutine
+	file    *os.File
+	w       *csv.Writer
+	counter *countingWriter
+	opened  time.Time
+
+	quit chan struct{} // nil without maxAge
+	done chan struct{}
+}
+
+// countingWriter tracks the size of the current file without a stat per row
+type countingWriter struct {
+	f *os.File
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.f.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func NewCSVSink(path string, maxBytes int64, maxAge time.Duration) (*CSVSink, error) {
+	s := &CSVSink{path: path, maxBytes: maxBytes, maxAge: maxAge}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if maxAge > 0 {
+		s.quit, s.done = make(chan struct{}), make(chan struct{})
+		go s.rotateOnTime()
+	}
+	return s, nil
+}
+
+// rotateOnTime rotates the file once it's maxAge old, whether or not
+// there's an event to write then
+func (s *CSVSink) rotateOnTime() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		if s.file == nil {
+			s.mu.Unlock()
+			return
+		}
+		due := time.Until(s.opened.Add(s.maxAge))
+		s.mu.Unlock()
+
+		timer := time.NewTimer(due)
+		select {
+		case <-timer.C:
+		case <-s.quit:
+			timer.Stop()
+			return
+		}
+		s.mu.Lock()
+		if s.file != nil && time.Since(s.opened) >= s.maxAge {
+			s.rotateOrStop()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// open starts a file at s.path, appending to it (without a second header)
+// if it's already there
+func (s *CSVSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.counter = &countingWriter{f: f, n: info.Size()}
+	s.w = csv.NewWriter(s.counter)
+	s.opened = time.Now()
+	if info.Size() == 0 {
+		return s.w.Write(csvColumns)
+	}
+	return nil
+}
+
+func (s *CSVSink) rotate() error {
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path, rotatedPath(s.path, s.opened)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// rotatedPath is where a file started at opened goes when it's rotated,
+// its name with the time before the extension. A compressed file keeps
+// both of its extensions, events.bin.zst becomes events-<time>.bin.zst.
+func rotatedPath(path string, opened time.Time) string {
+	ext := filepath.Ext(path)
+	if ext == ".zst" {
+		ext = filepath.Ext(strings.TrimSuffix(path, ext)) + ext
+	}
+	base := fmt.Sprintf("%s-%s", strings.TrimSuffix(path, ext), opened.Format("20060102T150405"))
+	rotated := base + ext
+	// Small size limits can rotate more than once a second
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+	return rotated
+}
+
+// rotateOrStop rotates, or gives up on the output, called with mu held
+func (s *CSVSink) rotateOrStop() {
+	if err := s.rotate(); err != nil {
+		slog.Warn("rotating CSV output, stopping it", "path", s.path, "err", err)
+		s.file = nil
+	}
+}
+
+// Observe writes one row, called from the processor goroutine only
+func (s *CSVSink) Observe(event *TcpEvent, p *EventProcessor) {
+	row := csvRow(event, p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return // A failed rotation already logged why
+	}
+	s.w.Write(row)
+
+	// counter only sees csv.Writer's 4KB buffer as it's flushed, so files
+	// end up at most that much over maxBytes
+	if s.maxBytes > 0 && s.counter.n >= s.maxBytes ||
+		s.maxAge > 0 && time.Since(s.opened) >= s.maxAge {
+		s.rotateOrStop()
+	}
+}
+
+func (s *CSVSink) Close() error {
+	if s.quit != nil {
+		close(s.quit)
+		<-s.done
+		s.quit = nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFile()
+}
+
+func (s *CSVSink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	s.w.Flush()
+	err := s.w.Error()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func csvRow(event *TcpEvent, p *EventProcessor) []string {
+	row := make([]string, len(csvColumns))
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+
+	row[0] = event.when().Format(time.RFC3339Nano)
+	row[1] = eventTypeNames[event.Type]
+	row[2] = u(uint64(event.Pid))
+	row[3] = commString(event.Comm[:])
+
+	// Only IP drops carry a tuple, and UDP receive errors from 6.10 on
+	hasTuple := (event.Type != eventDrop && event.Type != eventUDPError) || event.Family != 0
+	if event.Type == eventDrop {
+		row[4] = p.reasonName(event.Reason)
+		row[5] = findNearestSymbol(event.Location)
+		row[75] = dropLayer(row[5], row[4])
+		if event.NatFlags != 0 {
+			row[56] = natKinds(event.NatFlags)
+			row[57] = formatAddr(event.CtSaddr)
+			row[58] = u(uint64(event.CtSport))
+			row[59] = formatAddr(event.CtDaddr)
+			row[60] = u(uint64(event.CtDport))
+			row[61] = formatAddr(event.NatSaddr)
+			row[62] = u(uint64(event.NatSport))
+			row[63] = formatAddr(event.NatDaddr)
+			row[64] = u(uint64(event.NatDport))
+		}
+		if event.Tunnel != 0 {
+			row[89] = tunnelNames[event.Tunnel]
+			row[90] = u(uint64(event.Vni))
+			if event.InnerFamily != 0 {
+				row[91] = protocolName(event.InnerProtocol)
+				row[92] = formatAddr(event.InnerSaddr)
+				row[93] = u(uint64(event.InnerSport))
+				row[94] = formatAddr(event.InnerDaddr)
+				row[95] = u(uint64(event.InnerDport))
+			}
+		}
+	}
+	if event.Type == eventReset {
+		if event.Direction == rstSent {
+			row[4] = p.resetReasonName(event.Reason)
+		}
+		row[35] = directionNames[event.Direction]
+	}
+	if event.Type == eventZeroWindow {
+		row[35] = directionNames[event.Direction]
+		row[36] = u(uint64(event.Queued))
+	}
+	if event.Type == eventUDPError {
+		row[4] = errnoName(event.Reason)
+		row[35] = directionNames[event.Direction]
+		row[8] = u(uint64(event.Sport))
+	}
+	if event.Type == eventDSACK {
+		row[47] = u(uint64(event.DsackBytes))
+	}
+	if event.Type == eventBuffer {
+		row[4] = bufferNames[event.Direction]
+		row[50] = u(uint64(event.RmemAlloc))
+		row[51] = u(uint64(event.RmemAfter))
+		row[52] = u(uint64(event.Rcvbuf))
+		row[53] = u(uint64(event.RmemMax))
+		row[54] = u(uint64(event.Collapses))
+		row[55] = bufferHint(event)
+	}
+	if event.Type == eventFastOpen {
+		row[4] = fastopenNames[event.Reason]
+		row[35] = directionNames[event.Direction]
+	}
+	if event.Type == eventTLS {
+		row[13] = u(event.DurationNs) // The TLS handshake
+		row[35] = tlsSideNames[event.Direction]
+		if event.TCPConnectNs != 0 {
+			row[68] = u(event.TCPConnectNs)
+		}
+		if event.TLSWaitNs != 0 {
+			row[69] = u(event.TLSWaitNs)
+		}
+	}
+	if event.Type == eventSynFlood {
+		row[13] = u(event.DurationNs) // Into the second, see jsonSynFlood
+		row[72] = synFloodInterface(event)
+		row[73] = u(uint64(event.PrefixLen)) // And saddr is the prefix
+		row[74] = u(uint64(event.Syns))
+	}
+	if event.Type == eventKeepalive {
+		row[4] = keepaliveNames[event.Direction]
+		if event.DurationNs != 0 {
+			row[13] = u(event.DurationNs) // The idle time
+		}
+		row[48] = u(uint64(event.Probes))
+		row[49] = u(uint64(event.MaxProbes))
+	}
+	if event.Type == eventICMPError {
+		row[4] = icmpName(event.Family, event.Reason)
+		if event.Mtu != 0 {
+			row[39] = u(uint64(event.Mtu))
+		}
+	}
+	if event.Protocol != 0 {
+		row[38] = protocolName(event.Protocol)
+	}
+	if hasTuple {
+		row[6] = familyNames[event.Family]
+		row[7] = formatAddr(event.Saddr)
+		row[8] = u(uint64(event.Sport))
+		row[9] = formatAddr(event.Daddr)
+		row[10] = u(uint64(event.Dport))
+	}
+	if event.Type == eventBlocked {
+		row[7], row[8] = "", "" // The connect hadn't picked a source yet
+		row[76] = blockedRule(event)
+	}
+	if event.Type == eventSockopt {
+		if event.Dport == 0 { // Not connected yet
+			row[9], row[10] = "", ""
+			if event.Sport == 0 {
+				row[7], row[8] = "", ""
+			}
+		}
+		if event.Reason != 0 {
+			row[4] = errnoName(event.Reason)
+		}
+		row[79] = sockoptName(event.Sockopt)
+		row[80], row[81] = u(uint64(event.SockoptOld)), u(uint64(event.SockoptNew))
+		if sockopts[event.Sockopt].kind == sockoptAlgorithm {
+			row[80], row[81] = commString(event.CaOld[:]), commString(event.CaNew[:])
+		}
+	}
+	if event.Type == eventListen {
+		row[9], row[10] = "", "" // Listeners have no peer
+		if event.Reason != 0 {
+			row[4] = errnoName(event.Reason)
+		}
+		row[82] = listenKinds[event.Direction]
+		row[83], row[84], row[85] = u(uint64(event.Backlog)), u(uint64(event.Somaxconn)), u(uint64(event.AcceptQueue))
+	}
+	if event.Type != eventDrop && event.Type != eventUDPError && event.State != 0 {
+		row[11] = p.stateName(event.State)
+	}
+	if event.Type == eventState {
+		row[12] = p.stateName(event.OldState)
+	}
+	if event.Type == eventConnect || event.Type == eventClose {
+		row[13] = u(event.DurationNs)
+	}
+	if event.Type == eventClose {
+		row[14] = u(event.BytesSent)
+		row[15] = u(event.BytesReceived)
+		row[16] = u(uint64(event.Retransmits))
+		if event.RttAvgUs != 0 {
+			row[17] = u(uint64(event.RttMinUs))
+			row[18] = u(uint64(event.RttAvgUs))
+			row[19] = u(uint64(event.RttMaxUs))
+			row[20] = u(uint64(event.RttvarUs))
+		}
+		if event.Reordering != 0 {
+			row[40] = u(uint64(event.OooPackets))
+			row[41] = u(uint64(event.OooMaxBytes))
+			row[42] = u(uint64(event.Reordering))
+			row[43] = u(uint64(event.ReordSeen))
+		}
+		if event.Sacks != 0 {
+			row[44] = u(uint64(event.Sacks))
+			row[45] = u(uint64(event.SackBlocks))
+			row[46] = u(uint64(event.Dsacks))
+			row[47] = u(uint64(event.DsackBytes))
+		}
+	}
+
+	row[21] = u(event.CgroupID)
+	if pod := event.Pod; pod != nil {
+		row[22] = pod.Namespace
+		row[23] = pod.Name
+	}
+	if c := event.Container; c != nil {
+		row[24] = c.Name
+		row[25] = c.Image
+	}
+	if event.Suppressed > 0 {
+		row[26] = u(uint64(event.Suppressed))
+	}
+	if proc := event.Process; proc != nil {
+		row[27] = proc.Cmdline
+		row[28] = u(uint64(proc.UID))
+		row[29] = proc.User
+		row[30] = proc.Cgroup
+	}
+	if event.Netns != 0 {
+		row[31] = u(uint64(event.Netns))
+		row[32] = event.NetnsName
+	}
+	row[33] = event.SaddrName
+	row[34] = event.DaddrName
+	if event.Count > 0 {
+		row[37] = u(uint64(event.Count))
+	}
+	if geo := event.Geo; geo != nil {
+		row[65] = geo.Country
+		if geo.ASN != 0 {
+			row[66] = u(uint64(geo.ASN))
+		}
+		row[67] = geo.ASOrg
+	}
+	row[70] = strings.Join(event.Stack, ";")
+	row[71] = strings.Join(event.UserStack, ";")
+	if event.MptcpToken != 0 {
+		row[77] = mptcpToken(event.MptcpToken)
+		if event.MptcpSubflow != 0 {
+			row[78] = u(uint64(event.MptcpSubflow))
+		}
+	}
+	if l := event.Link; l != nil { // Drops and retransmits share SYN floods' interface column
+		if l.Ifindex != 0 {
+			row[72] = linkName(l.Ifindex, l.Name)
+		}
+		if l.Vlan != 0 {
+			row[86] = u(uint64(l.Vlan))
+		}
+		row[87] = l.Master
+		if l.InIfindex != 0 {
+			row[88] = linkName(l.InIfindex, l.InName)
+		}
+	}
+	return row
+}
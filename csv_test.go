@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// --output-rotate starts a new file on time, with or without events
+func TestCSVRotateOnTime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.csv")
+	s, err := NewCSVSink(path, 0, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rotated, err := filepath.Glob(filepath.Join(dir, "events-*.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rotated) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not rotated without events")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The current file is a fresh one with its header
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) == 0 || b[0] != 't' {
+		t.Errorf("current file starts %q, want the header", b)
+	}
+}
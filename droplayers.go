@@ -0,0 +1,66 @@
+package main
+
+import "strings"
+
+// Every drop comes through the one skb:kfree_skb tracepoint, the stream the
+// kernel's own drop_monitor and dropwatch read, so netfilter, the bridge,
+// neighbour resolution, qdiscs and drivers drop into it as much as TCP
+// does. dropLayer sorts them by the function that freed the skb, and by
+// the reason when the function is a generic helper or a driver's.
+
+// By function name prefix, the first match wins: ip6t_ is netfilter before
+// ip6_ is IPv6, tcp_ is TCP before tc_ is tc
+var dropLayerFunctions = []struct{ prefix, layer string }{
+	{"nf_", "netfilter"}, {"nft_", "netfilter"}, {"ipt_", "netfilter"}, {"ip6t_", "netfilter"},
+	{"arpt_", "netfilter"}, {"ebt_", "netfilter"}, {"xt_", "netfilter"}, {"nfqnl_", "netfilter"},
+	{"br_", "bridge"}, {"__br_", "bridge"},
+	{"tcp", "tcp"}, {"__tcp", "tcp"}, {"inet_csk", "tcp"}, {"inet_twsk", "tcp"},
+	{"udp", "udp"}, {"__udp", "udp"},
+	{"icmp", "icmp"}, {"__icmp", "icmp"},
+	{"vxlan_", "tunnel"}, {"geneve_", "tunnel"}, {"ip_tunnel_", "tunnel"}, {"ip6_tnl_", "tunnel"},
+	{"ipgre_", "tunnel"}, {"ip6gre_", "tunnel"}, {"gre_", "tunnel"},
+	{"ip6", "ipv6"}, {"ipv6_", "ipv6"}, {"__ip6", "ipv6"},
+	{"ip_", "ip"}, {"__ip_", "ip"}, {"ipv4_", "ip"}, {"raw_", "ip"},
+	{"neigh_", "neigh"}, {"__neigh_", "neigh"}, {"arp_", "neigh"}, {"ndisc_", "neigh"},
+	{"xfrm", "xfrm"}, {"esp", "xfrm"},
+	{"xdp_", "xdp"}, {"do_xdp_", "xdp"}, {"bpf_xdp_", "xdp"},
+	{"tcf_", "tc"}, {"tc_", "tc"}, {"sch_", "tc"}, {"qdisc_", "tc"}, {"__qdisc_", "tc"}, {"__dev_xmit_skb", "tc"},
+	{"sk_", "socket"}, {"__sk_", "socket"}, {"sock_", "socket"}, {"unix_", "socket"}, {"netlink_", "socket"},
+	{"netif_", "dev"}, {"__netif_", "dev"}, {"dev_", "dev"}, {"__dev_", "dev"}, {"napi_", "dev"},
+	{"enqueue_to_backlog", "dev"}, {"validate_xmit", "dev"},
+}
+
+// By reason name prefix, for functions the table doesn't know
+var dropLayerReasons = []struct{ prefix, layer string }{
+	{"NETFILTER_", "netfilter"}, {"TCP_", "tcp"}, {"UDP_", "udp"}, {"ICMP_", "icmp"},
+	{"IPV6", "ipv6"}, {"IP_", "ip"}, {"OTHERHOST", "ip"}, {"PKT_TOO_BIG", "ip"},
+	{"NEIGH_", "neigh"}, {"XFRM_", "xfrm"}, {"XDP", "xdp"}, {"QDISC_", "tc"}, {"TC_", "tc"},
+	{"SOCKET_", "socket"}, {"PROTO_MEM", "socket"},
+	{"VXLAN_", "tunnel"}, {"TUNNEL_", "tunnel"},
+	{"DEV_", "dev"}, {"FULL_RING", "dev"}, {"CPU_BACKLOG", "dev"}, {"TAP_", "dev"},
+}
+
+// dropLayer is the part of the stack a drop happened in: tcp, udp, icmp,
+// ip, ipv6, netfilter, bridge, neigh, tunnel, xfrm, xdp, tc, socket, dev,
+// or other. function is findNearestSymbol's, e.g. nf_hook_slow+0x12a.
+func dropLayer(function, reason string) string {
+	name, _, _ := strings.Cut(function, "+")
+	if !strings.HasPrefix(name, "0x") { // Kernel symbols hidden
+		for _, f := range dropLayerFunctions {
+			if strings.HasPrefix(name, f.prefix) {
+				return f.layer
+			}
+		}
+	}
+	for _, r := range dropLayerReasons {
+		if strings.HasPrefix(reason, r.prefix) {
+			return r.layer
+		}
+	}
+	return "other"
+}
+
+// dropLayer names the layer of a drop event
+func (p *EventProcessor) dropLayer(event *TcpEvent) string {
+	return dropLayer(findNearestSymbol(event.Location), p.reasonName(event.Reason))
+}
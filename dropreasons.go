@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// dropReasons names the values of the kernel's enum skb_drop_reason
+// (include/net/dropreason-core.h). The enum has been renumbered several times
+// since it appeared in 5.17, so the names are read from the running kernel's
+// BTF and the table below is only a fallback.
+type dropReasons struct {
+	names  map[uint32]string
+	resets map[uint32]string // enum sk_rst_reason, see loadResetReasons
+
+	// Values that don't mean a drop, -1 if the kernel has no such value
+	notDropped int32 // SKB_NOT_DROPPED_YET
+	consumed   int32 // SKB_CONSUMED
+}
+
+// Numbering as of 6.1
+var fallbackDropReasons = []string{
+	"NOT_DROPPED_YET", "CONSUMED", "NOT_SPECIFIED", "NO_SOCKET", "PKT_TOO_SMALL",
+	"TCP_CSUM", "SOCKET_FILTER", "UDP_CSUM", "NETFILTER_DROP", "OTHERHOST",
+	"IP_CSUM", "IP_INHDR", "IP_RPFILTER", "UNICAST_IN_L2_MULTICAST", "XFRM_POLICY",
+	"IP_NOPROTO", "SOCKET_RCVBUFF", "PROTO_MEM", "TCP_MD5NOTFOUND", "TCP_MD5UNEXPECTED",
+	"TCP_MD5FAILURE", "SOCKET_BACKLOG", "TCP_FLAGS", "TCP_ZEROWINDOW", "TCP_OLD_DATA",
+	"TCP_OVERWINDOW", "TCP_OFOMERGE", "TCP_RFC7323_PAWS", "TCP_INVALID_SEQUENCE", "TCP_RESET",
+	"TCP_INVALID_SYN", "TCP_CLOSE", "TCP_FASTOPEN", "TCP_OLD_ACK", "TCP_TOO_OLD_ACK",
+	"TCP_ACK_UNSENT_DATA", "TCP_OFO_QUEUE_PRUNE", "TCP_OFO_DROP", "IP_OUTNOROUTES", "BPF_CGROUP_EGRESS",
+	"IPV6DISABLED", "NEIGH_CREATEFAIL", "NEIGH_FAILED", "NEIGH_QUEUEFULL", "NEIGH_DEAD",
+	"TC_EGRESS", "QDISC_DROP", "CPU_BACKLOG", "XDP", "TC_INGRESS",
+	"UNHANDLED_PROTO", "SKB_CSUM", "SKB_GSO_SEG", "SKB_UCOPY_FAULT", "DEV_HDR",
+	"DEV_READY", "FULL_RING", "NOMEM", "HDR_TRUNC", "TAP_FILTER",
+	"TAP_TXFILTER", "ICMP_CSUM", "INVALID_PROTO", "IP_INADDRERRORS", "IP_INNOROUTES",
+	"PKT_TOO_BIG",
+}
+
+// loadDropReasons never fails: without kernel BTF it logs a warning and
+// falls back to the 6.1 numbering. kernel is the --btf spec, nil for the
+// running kernel's.
+func loadDropReasons(kernel *btf.Spec) *dropReasons {
+	r := loadSkbDropReasons(kernel)
+	r.resets = loadResetReasons(kernel)
+	return r
+}
+
+func loadSkbDropReasons(kernel *btf.Spec) *dropReasons {
+	r, err := kernelDropReasons(kernel)
+	if err == nil {
+		return r
+	}
+
+	if errors.Is(err, btf.ErrNotFound) {
+		// Before 5.17 kfree_skb has no reason, the programs report every drop as 0
+		return &dropReasons{names: map[uint32]string{0: "NOT_SPECIFIED"}, notDropped: -1, consumed: -1}
+	}
+
+	slog.Warn("reading drop reasons from kernel BTF, assuming 6.1 numbering", "err", err)
+	r = &dropReasons{names: make(map[uint32]string), notDropped: 0, consumed: 1}
+	for i, name := range fallbackDropReasons {
+		r.names[uint32(i)] = name
+	}
+	return r
+}
+
+func kernelDropReasons(spec *btf.Spec) (*dropReasons, error) {
+	if spec == nil {
+		var err error
+		if spec, err = btf.LoadKernelSpec(); err != nil {
+			return nil, err
+		}
+	}
+	var enum *btf.Enum
+	if err := spec.TypeByName("skb_drop_reason", &enum); err != nil {
+		return nil, err
+	}
+
+	r := &dropReasons{names: make(map[uint32]string), notDropped: -1, consumed: -1}
+	for _, v := range enum.Values {
+		switch v.Name {
+		case "SKB_NOT_DROPPED_YET":
+			r.notDropped = int32(v.Value)
+		case "SKB_CONSUMED":
+			r.consumed = int32(v.Value)
+		case "SKB_DROP_REASON_MAX":
+			continue
+		}
+		// Same names as the kernel's drop_monitor and perf print, e.g. NO_SOCKET
+		name := strings.TrimPrefix(v.Name, "SKB_DROP_REASON_")
+		r.names[uint32(v.Value)] = strings.TrimPrefix(name, "SKB_")
+	}
+	return r, nil
+}
+
+// loadResetReasons names enum sk_rst_reason (include/net/rstreason.h), which
+// sent resets carry from 6.10 on. Older kernels only ever report 0.
+func loadResetReasons(spec *btf.Spec) map[uint32]string {
+	names := map[uint32]string{0: "NOT_SPECIFIED"}
+	if spec == nil {
+		var err error
+		if spec, err = btf.LoadKernelSpec(); err != nil {
+			return names
+		}
+	}
+	var enum *btf.Enum
+	if err := spec.TypeByName("sk_rst_reason", &enum); err != nil {
+		return names
+	}
+	for _, v := range enum.Values {
+		if v.Name != "SK_RST_REASON_MAX" {
+			names[uint32(v.Value)] = strings.TrimPrefix(v.Name, "SK_RST_REASON_")
+		}
+	}
+	return names
+}
+
+// rewriteSpec tells the drop program which reasons to skip
+func (r *dropReasons) rewriteSpec(spec *ebpf.CollectionSpec) error {
+	for name, value := range map[string]int32{
+		"reason_not_dropped": r.notDropped,
+		"reason_consumed":    r.consumed,
+	} {
+		if err := setVariable(spec, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+//go:build e2e
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// End-to-end tests: the monitor loaded into the running kernel, watching
+// traffic between two network namespaces of the test's own joined by a
+// veth pair, with iptables and netem making the drops and retransmits it
+// should report. They're what to run after changing bpf/monitor.c, on
+// each kernel it has to work on, and need root, ip, tc and iptables:
+//
+//	go generate && sudo go test -tags e2e -run E2E -v .
+//
+// The monitor is this test binary run again with e2eMonitorEnv set, so
+// it's built from the same tree with nothing to install, and the tests
+// read its events back from --format=json. Deleting the namespaces takes
+// the veth pair, the iptables rules and the qdiscs with them, the host is
+// left as it was.
+
+const (
+	e2eMonitorEnv = "TCPMON_E2E_MONITOR"
+
+	e2eClientAddr = "10.199.0.1" // On e2e-c, in the client namespace
+	e2eServerAddr = "10.199.0.2" // On e2e-s, in the server's
+	e2eCIDR       = "10.199.0.0/24"
+
+	e2eTimeout = 30 * time.Second // For the monitor to be ready, and then for each event a test waits for
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(e2eMonitorEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// e2eNet is a client and a server namespace, as ip netns names them
+type e2eNet struct {
+	client, server string
+}
+
+var e2eNets atomic.Int32 // For namespace names no other test has
+
+// newE2ENet makes the namespaces and the veth pair between them, and
+// deletes them when the test is done. Tests that can't run here are
+// skipped.
+func newE2ENet(t *testing.T) *e2eNet {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root, for the BPF programs and the namespaces")
+	}
+	for _, tool := range []string{"ip", "tc", "iptables"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("needs %s", tool)
+		}
+	}
+
+	id := e2eNets.Add(1)
+	n := &e2eNet{
+		client: fmt.Sprintf("tcpmon-e2e-%d-%d-client", os.Getpid(), id),
+		server: fmt.Sprintf("tcpmon-e2e-%d-%d-server", os.Getpid(), id),
+	}
+	for _, ns := range []string{n.client, n.server} {
+		e2eRun(t, "ip", "netns", "add", ns)
+		t.Cleanup(func() { exec.Command("ip", "netns", "del", ns).Run() })
+	}
+	e2eRun(t, "ip", "-n", n.client, "link", "add", "e2e-c", "type", "veth", "peer", "name", "e2e-s", "netns", n.server)
+	for _, end := range []struct{ ns, dev, addr string }{
+		{n.client, "e2e-c", e2eClientAddr},
+		{n.server, "e2e-s", e2eServerAddr},
+	} {
+		e2eRun(t, "ip", "-n", end.ns, "addr", "add", end.addr+"/24", "dev", end.dev)
+		e2eRun(t, "ip", "-n", end.ns, "link", "set", end.dev, "up")
+		e2eRun(t, "ip", "-n", end.ns, "link", "set", "lo", "up")
+	}
+	return n
+}
+
+// exec runs a command in the namespace, e.g. iptables or tc
+func (n *e2eNet) exec(t *testing.T, ns string, args ...string) {
+	t.Helper()
+	e2eRun(t, "ip", append([]string{"netns", "exec", ns}, args...)...)
+}
+
+func e2eRun(t *testing.T, name string, args ...string) {
+	t.Helper()
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s %v: %v: %s", name, args, err, bytes.TrimSpace(out))
+	}
+}
+
+// e2eIn runs fn in the namespace, on a thread that exits with it instead
+// of going back to the runtime in the wrong namespace. Sockets stay in the
+// namespace they were made in, wherever they're used after.
+func e2eIn(ns string, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread() // Never unlocked, see above
+		f, err := os.Open(filepath.Join(netnsRunDir, ns))
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer f.Close()
+		if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+			errc <- fmt.Errorf("entering %s: %w", ns, err)
+			return
+		}
+		errc <- fn()
+	}()
+	return <-errc
+}
+
+// e2eMonitor is a running monitor and the events it has printed so far
+type e2eMonitor struct {
+	cmd    *exec.Cmd
+	stderr bytes.Buffer // Its log, only read once it has exited
+	events chan jsonEvent
+	done   chan struct{} // Closed at the end of its stdout
+	stop   sync.Once
+}
+
+// startE2EMonitor runs the monitor command on the test namespaces' traffic
+// and waits for it to be ready, i.e. for every probe to be attached. It's
+// stopped, and its log shown if the test failed, when the test is done.
+func startE2EMonitor(t *testing.T, command string, args ...string) *e2eMonitor {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0") // A free port for --listen-addr, for /readyz
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	args = append([]string{command, "--format", "json", "--cidr", e2eCIDR, "--listen-addr", addr}, args...)
+	m := &e2eMonitor{
+		cmd:    exec.Command(exe, append(args, "3600")...), // Stopped long before
+		events: make(chan jsonEvent, 4096),
+		done:   make(chan struct{}),
+	}
+	m.cmd.Env = append(os.Environ(), e2eMonitorEnv+"=1")
+	m.cmd.Stderr = &m.stderr
+	stdout, err := m.cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go m.read(stdout)
+	t.Cleanup(func() {
+		m.Stop()
+		if t.Failed() {
+			t.Logf("monitor's log:\n%s", m.stderr.Bytes())
+		}
+	})
+
+	deadline := time.Now().Add(e2eTimeout)
+	for {
+		if resp, err := http.Get("http://" + addr + "/readyz"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return m
+			}
+		}
+		select {
+		case <-m.done:
+			t.Fatal("monitor exited before it was ready")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("monitor not ready after %v", e2eTimeout)
+		}
+	}
+}
+
+func (m *e2eMonitor) read(r io.Reader) {
+	defer close(m.done)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64<<10), 1<<20)
+	for s.Scan() {
+		var e jsonEvent
+		if json.Unmarshal(s.Bytes(), &e) != nil {
+			continue // The banner and the summary
+		}
+		select {
+		case m.events <- e:
+		default: // Tests wait for one event each, not all of them
+		}
+	}
+}
+
+// Stop stops the monitor the way Ctrl+C does and waits for it to exit
+func (m *e2eMonitor) Stop() {
+	m.stop.Do(func() {
+		m.cmd.Process.Signal(syscall.SIGTERM)
+		<-m.done // Wait closes stdout, which has to be read to the end first
+		m.cmd.Wait()
+	})
+}
+
+// expect waits for an event match accepts and returns it
+func (m *e2eMonitor) expect(t *testing.T, what string, match func(*jsonEvent) bool) *jsonEvent {
+	t.Helper()
+	timeout := time.After(e2eTimeout)
+	for {
+		select {
+		case e := <-m.events:
+			if match(&e) {
+				return &e
+			}
+		case <-m.done:
+			t.Fatalf("monitor exited waiting for %s", what)
+		case <-timeout:
+			t.Fatalf("no %s in %v", what, e2eTimeout)
+		}
+	}
+}
+
+// A SYN iptables drops on the server is a netfilter drop, with its tuple
+// and the interface it was on
+func TestE2EDrops(t *testing.T) {
+	n := newE2ENet(t)
+	m := startE2EMonitor(t, "drops")
+	n.exec(t, n.server, "iptables", "-A", "INPUT", "-p", "tcp", "--dport", "8081", "-j", "DROP")
+
+	if err := e2eIn(n.client, func() error {
+		c, err := net.DialTimeout("tcp", e2eServerAddr+":8081", 2*time.Second)
+		if err == nil {
+			c.Close()
+			return errors.New("connected through the DROP rule")
+		}
+		return nil // Timing out is the point
+	}); err != nil {
+		t.Fatal(err)
+	}
+	e := m.expect(t, "drop of the SYN", func(e *jsonEvent) bool {
+		return e.Type == "drop" && e.Saddr == e2eClientAddr && e.Daddr == e2eServerAddr && e.Dport == 8081
+	})
+	if e.Layer != "netfilter" {
+		t.Errorf("drop in %s (%s, %s), want netfilter", e.Layer, e.Function, e.Reason)
+	}
+	if e.Protocol != "tcp" {
+		t.Errorf("protocol %s, want tcp", e.Protocol)
+	}
+	if e.Link == nil || e.Link.Ifindex == 0 {
+		t.Errorf("drop without the interface it was on")
+	}
+}
+
+// Loss netem adds on the server's side comes back as retransmits of the
+// server's end of the connection
+func TestE2ERetransmits(t *testing.T) {
+	n := newE2ENet(t)
+	m := startE2EMonitor(t, "retrans")
+	n.exec(t, n.server, "tc", "qdisc", "add", "dev", "e2e-s", "root", "netem", "loss", "10%")
+
+	var ln net.Listener
+	if err := e2eIn(n.server, func() (err error) {
+		ln, err = net.Listen("tcp", e2eServerAddr+":8082")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(e2eTimeout))
+				c.Write(make([]byte, 1<<20))
+			}()
+		}
+	}()
+
+	if err := e2eIn(n.client, func() error {
+		c, err := net.DialTimeout("tcp", e2eServerAddr+":8082", 10*time.Second)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(e2eTimeout))
+		_, err = io.Copy(io.Discard, c)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	m.expect(t, "retransmit by the server", func(e *jsonEvent) bool {
+		return e.Type == "retransmit" && e.Saddr == e2eServerAddr && e.Sport == 8082 && e.Daddr == e2eClientAddr
+	})
+}
+
+// Connecting to a port nothing listens on gets a reset back
+func TestE2EResets(t *testing.T) {
+	n := newE2ENet(t)
+	m := startE2EMonitor(t, "resets")
+
+	if err := e2eIn(n.client, func() error {
+		c, err := net.DialTimeout("tcp", e2eServerAddr+":8083", 2*time.Second)
+		if err == nil {
+			c.Close()
+			return errors.New("connected to a port nothing listens on")
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return err
+		}
+		return nil // Refused is the point
+	}); err != nil {
+		t.Fatal(err)
+	}
+	m.expect(t, "reset received by the client", func(e *jsonEvent) bool {
+		return e.Type == "reset" && e.Direction == "received" && e.Saddr == e2eClientAddr && e.Daddr == e2eServerAddr && e.Dport == 8083
+	})
+}
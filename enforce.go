@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+	"golang.org/x/sys/unix"
+)
+
+// --enforce turns what the monitor sees into containment: connect()
+// calls to a destination a --block rule matches fail with EPERM, from
+// cgroup connect4 and connect6 programs on the root cgroup, and each one
+// is a blocked event with the rule. Rules can be added and removed while
+// it runs, through /api/v1/enforce on --control-addr (listed on
+// --listen-addr too), so a destination found misbehaving can be cut off without a restart. There are only
+// deny rules; everything they don't match goes through as before.
+//
+// Only connect() is checked: TCP connections, and UDP sockets that are
+// connected. Datagrams sent with sendto() to an address go out, and so do
+// connections opened before a rule was added.
+
+const enforceMaxRules = 64 // ENFORCE_MAX_RULES in bpf/monitor.c
+
+// enforceRule is one --block rule, e.g.
+//
+//	to=203.0.113.0/24 port=443 proto=tcp cgroup=/sys/fs/cgroup/system.slice/app.service
+//
+// Only to is needed, the others narrow it down
+type enforceRule struct {
+	To       netip.Prefix
+	Port     uint16 // 0 for every port
+	Protocol string // "tcp", "udp" or "" for both
+	Cgroup   string // cgroup v2 directory, "" for every task; its children are in it too
+}
+
+func parseEnforceRule(s string) (enforceRule, error) {
+	var r enforceRule
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return r, fmt.Errorf("%q is not key=value", field)
+		}
+		switch key {
+		case "to":
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(value)
+				if aerr != nil {
+					return r, fmt.Errorf("to: %w", err)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			r.To = prefix.Masked()
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return r, fmt.Errorf("invalid port %q", value)
+			}
+			r.Port = uint16(port)
+		case "proto":
+			if value != "tcp" && value != "udp" {
+				return r, fmt.Errorf("unknown proto %q, use: tcp or udp", value)
+			}
+			r.Protocol = value
+		case "cgroup":
+			r.Cgroup = filepath.Clean(value)
+		default:
+			return r, fmt.Errorf("unknown key %q, use: to, port, proto, cgroup", key)
+		}
+	}
+	if !r.To.IsValid() {
+		return r, errors.New("to= is required, e.g. to=203.0.113.0/24")
+	}
+	return r, nil
+}
+
+func (r enforceRule) String() string {
+	s := "to=" + r.To.String()
+	if r.Port != 0 {
+		s += " port=" + strconv.Itoa(int(r.Port))
+	}
+	if r.Protocol != "" {
+		s += " proto=" + r.Protocol
+	}
+	if r.Cgroup != "" {
+		s += " cgroup=" + r.Cgroup
+	}
+	return s
+}
+
+// kernel is the rule as enforce_rules has it, with its cgroup looked up
+func (r enforceRule) kernel() (monitorEnforceRule, error) {
+	k := monitorEnforceRule{Port: r.Port, Used: 1}
+	switch r.Protocol {
+	case "tcp":
+		k.Protocol = unix.IPPROTO_TCP
+	case "udp":
+		k.Protocol = unix.IPPROTO_UDP
+	}
+	prefix := r.To
+	if prefix.Addr().Is4() {
+		prefix = netip.PrefixFrom(netip.AddrFrom16(prefix.Addr().As16()), prefix.Bits()+96)
+	}
+	k.Addr = prefix.Addr().As16()
+	for i := 0; i < prefix.Bits(); i++ {
+		k.Mask[i/8] |= 0x80 >> (i % 8)
+	}
+	if r.Cgroup != "" {
+		id, level, err := cgroupIDLevel(r.Cgroup)
+		if err != nil {
+			return k, err
+		}
+		k.CgroupId, k.CgroupLevel = id, level
+	}
+	return k, nil
+}
+
+// cgroupIDLevel is a cgroup directory's id, its inode like cgroupResolver
+// has it, and how far below cgroupRoot it is
+func cgroupIDLevel(path string) (uint64, uint32, error) {
+	rel, err := filepath.Rel(cgroupRoot, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return 0, 0, fmt.Errorf("cgroup %s is not under %s", path, cgroupRoot)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, fmt.Errorf("cgroup %s: %w", path, err)
+	}
+	if st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return 0, 0, fmt.Errorf("cgroup %s: not on a cgroup v2 filesystem", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cgroup %s: %w", path, err)
+	}
+	var level uint32
+	if rel != "." {
+		level = uint32(strings.Count(rel, "/") + 1)
+	}
+	return info.Sys().(*syscall.Stat_t).Ino, level, nil
+}
+
+// blockFlag is --block, repeatable. Rules have spaces but no commas to
+// split on, and are checked as they're given.
+type blockFlag []enforceRule
+
+func (f *blockFlag) String() string {
+	s := make([]string, len(*f))
+	for i, r := range *f {
+		s[i] = r.String()
+	}
+	return strings.Join(s, "; ")
+}
+
+func (f *blockFlag) Set(value string) error {
+	r, err := parseEnforceRule(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// enforceSupported checks for the helpers the connect programs call:
+// the ancestor cgroup lookup (5.7), --cgroup's check and the task helpers
+// events need
+func enforceSupported() error {
+	for _, fn := range []asm.BuiltinFunc{
+		asm.FnGetCurrentAncestorCgroupId, asm.FnCurrentTaskUnderCgroup, asm.FnGetCurrentCgroupId,
+		asm.FnGetCurrentPidTgid, asm.FnGetCurrentComm, asm.FnRingbufReserve,
+	} {
+		if err := features.HaveProgramHelper(ebpf.CGroupSockAddr, fn); err != nil {
+			if errors.Is(err, ebpf.ErrNotSupported) {
+				return fmt.Errorf("cgroup connect programs can't call %s on this kernel", fn)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func stubEnforce(spec *ebpf.CollectionSpec) {
+	stubProgram(spec, "enforce_connect4")
+	stubProgram(spec, "enforce_connect6")
+}
+
+// Enforcer keeps enforce_rules in step with the rules, by slot: a rule's
+// id is its slot + 1, which blocked events carry, and stays its own until
+// it's removed
+type Enforcer struct {
+	objs *monitorObjects
+
+	mu    sync.Mutex // The API and the enricher
+	rules [enforceMaxRules]*enforceRule
+}
+
+// GET /api/v1/enforce, and what POST and DELETE return
+type apiEnforceRule struct {
+	ID      int    `json:"id"`
+	Rule    string `json:"rule"`
+	Blocked uint64 `json:"blocked"` // Connects it failed, counted whether or not the filters let their events through
+}
+
+func NewEnforcer(objs *monitorObjects, rules []enforceRule) (*Enforcer, error) {
+	e := &Enforcer{objs: objs}
+	for _, r := range rules {
+		if _, err := e.Add(r); err != nil {
+			return nil, fmt.Errorf("%s: %w", r, err)
+		}
+	}
+	return e, nil
+}
+
+// Add starts blocking what r matches and returns its id
+func (e *Enforcer) Add(r enforceRule) (int, error) {
+	k, err := r.kernel()
+	if err != nil {
+		return 0, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	slot := -1
+	for i, have := range e.rules {
+		if have != nil && have.String() == r.String() {
+			return i + 1, nil
+		}
+		if have == nil && slot < 0 {
+			slot = i
+		}
+	}
+	if slot < 0 {
+		return 0, fmt.Errorf("%d rules already, at most %d fit", enforceMaxRules, enforceMaxRules)
+	}
+	// The count first, so the rule isn't matched with the last one's
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return 0, err
+	}
+	if err := e.objs.EnforceBlocked.Put(uint32(slot), make([]uint64, cpus)); err != nil {
+		return 0, fmt.Errorf("clearing the rule's count: %w", err)
+	}
+	if err := e.objs.EnforceRules.Put(uint32(slot), k); err != nil {
+		return 0, fmt.Errorf("adding the rule: %w", err)
+	}
+	e.rules[slot] = &r
+	if err := e.setSlots(); err != nil {
+		return 0, err
+	}
+	slog.Info("blocking connects", "rule", r.String(), "id", slot+1)
+	return slot + 1, nil
+}
+
+// Remove stops blocking what rule id matched
+func (e *Enforcer) Remove(id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if id < 1 || id > enforceMaxRules || e.rules[id-1] == nil {
+		return fmt.Errorf("no rule %d", id)
+	}
+	if err := e.objs.EnforceRules.Put(uint32(id-1), monitorEnforceRule{}); err != nil {
+		return fmt.Errorf("removing the rule: %w", err)
+	}
+	slog.Info("no longer blocking connects", "rule", e.rules[id-1].String(), "id", id)
+	e.rules[id-1] = nil
+	return e.setSlots()
+}
+
+// setSlots has the programs look at the slots up to the last one in use
+func (e *Enforcer) setSlots() error {
+	var n uint32
+	for i, r := range e.rules {
+		if r != nil {
+			n = uint32(i + 1)
+		}
+	}
+	if err := e.objs.EnforceSlots.Set(n); err != nil {
+		return fmt.Errorf("setting enforce_slots: %w", err)
+	}
+	return nil
+}
+
+// Rules is every rule in force, by id
+func (e *Enforcer) Rules() []apiEnforceRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	all := []apiEnforceRule{}
+	for i, r := range e.rules {
+		if r == nil {
+			continue
+		}
+		all = append(all, apiEnforceRule{ID: i + 1, Rule: r.String(), Blocked: e.blocked(i)})
+	}
+	return all
+}
+
+func (e *Enforcer) blocked(slot int) uint64 {
+	var perCPU []uint64
+	if err := e.objs.EnforceBlocked.Lookup(uint32(slot), &perCPU); err != nil {
+		return 0
+	}
+	var n uint64
+	for _, v := range perCPU {
+		n += v
+	}
+	return n
+}
+
+// blockedRule is the rule of a blocked event, by its id once it's been
+// removed
+func blockedRule(event *TcpEvent) string {
+	if event.Rule != "" {
+		return event.Rule
+	}
+	return fmt.Sprintf("rule %d", event.Reason)
+}
+
+// Enrich names the rule of a blocked event, if it's still there
+func (e *Enforcer) Enrich(event *TcpEvent) {
+	if event.Type != eventBlocked || event.Reason < 1 || event.Reason > enforceMaxRules {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if r := e.rules[event.Reason-1]; r != nil {
+		event.Rule = r.String()
+	}
+}
+
+// Register lists the rules on --listen-addr
+func (e *Enforcer) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/enforce", e.handleRules)
+}
+
+// RegisterControl adds and removes them on --control-addr
+func (e *Enforcer) RegisterControl(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/enforce", e.handleRules)
+	mux.HandleFunc("POST /api/v1/enforce", e.handleAdd)
+	mux.HandleFunc("DELETE /api/v1/enforce/{id}", e.handleRemove)
+}
+
+func (e *Enforcer) handleRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, e.Rules())
+}
+
+// handleAdd takes {"rule": "to=203.0.113.0/24 port=443"}, like --block
+func (e *Enforcer) handleAdd(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
+		return
+	}
+	var req struct {
+		Rule string `json:"rule"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule, err := parseEnforceRule(req.Rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := e.Add(rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, apiEnforceRule{ID: id, Rule: rule.String()})
+}
+
+func (e *Enforcer) handleRemove(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid rule id", http.StatusBadRequest)
+		return
+	}
+	if err := e.Remove(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
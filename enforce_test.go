@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseEnforceRule(t *testing.T) {
+	for _, tt := range []struct {
+		rule string
+		want enforceRule
+		err  bool
+	}{
+		{rule: "to=203.0.113.0/24", want: enforceRule{To: netip.MustParsePrefix("203.0.113.0/24")}},
+		{rule: "to=203.0.113.7/24", want: enforceRule{To: netip.MustParsePrefix("203.0.113.0/24")}}, // Masked
+		{rule: "to=203.0.113.7", want: enforceRule{To: netip.MustParsePrefix("203.0.113.7/32")}},
+		{rule: "to=2001:db8::1", want: enforceRule{To: netip.MustParsePrefix("2001:db8::1/128")}},
+		{
+			rule: "to=2001:db8::/32 port=443 proto=tcp cgroup=/sys/fs/cgroup/system.slice/app.service/",
+			want: enforceRule{To: netip.MustParsePrefix("2001:db8::/32"), Port: 443, Protocol: "tcp", Cgroup: "/sys/fs/cgroup/system.slice/app.service"},
+		},
+		{rule: "  proto=udp   to=0.0.0.0/0 ", want: enforceRule{To: netip.MustParsePrefix("0.0.0.0/0"), Protocol: "udp"}},
+		{rule: "", err: true},
+		{rule: "port=443", err: true},
+		{rule: "to", err: true},
+		{rule: "to=example.com", err: true},
+		{rule: "to=203.0.113.0/33", err: true},
+		{rule: "to=203.0.113.0/24 port=0", err: true},
+		{rule: "to=203.0.113.0/24 port=65536", err: true},
+		{rule: "to=203.0.113.0/24 port=https", err: true},
+		{rule: "to=203.0.113.0/24 proto=sctp", err: true},
+		{rule: "to=203.0.113.0/24 from=10.0.0.1", err: true},
+	} {
+		got, err := parseEnforceRule(tt.rule)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.rule, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.rule, got, err, tt.want)
+		}
+		// What the API lists parses back to the same rule
+		if again, err := parseEnforceRule(got.String()); err != nil || again != got {
+			t.Errorf("%q: %q parses to %+v, %v", tt.rule, got.String(), again, err)
+		}
+	}
+}
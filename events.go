@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+	"unsafe" // Only for Sizeof and Offsetof, to keep decodeEvent tied to the generated layout
+)
+
+// TcpEvent is the decoded form of struct event in bpf/monitor.c
+// Field order and sizes mirror the C struct and the tails that follow it,
+// see decodeEvent for the offsets
+type TcpEvent struct {
+	Pid           uint32
+	Reason        uint32
+	Location      uint64
+	Type          uint32
+	State         uint32
+	OldState      uint32
+	Family        uint32   // afInet or afInet6, 0 for drops without a tuple
+	Saddr         [16]byte // Network byte order, IPv4 as ::ffff:a.b.c.d
+	Daddr         [16]byte
+	Sport         uint16 // Host byte order
+	Dport         uint16
+	Retransmits   uint32
+	DurationNs    uint64
+	BytesSent     uint64
+	BytesReceived uint64
+	Comm          [16]byte // NUL padded, see commString
+	CgroupID      uint64
+	RttMinUs      uint32 // Close events only, 0 when never sampled
+	RttAvgUs      uint32
+	RttMaxUs      uint32
+	RttvarUs      uint32
+	Suppressed    uint32 // Drops and retransmits: left out by --conn-limit before this one
+	Netns         uint32 // Network namespace inode, 0 when the kernel couldn't tell (see netns.go)
+	Direction     uint32 // Resets: rstSent or rstReceived, zero windows: windowSent or windowReceived, UDP errors: udpSent or udpReceived, keepalives: keepaliveUnanswered or keepaliveTimeout, TFO: fastopenSent or fastopenReceived, buffer pressure: bufferCollapsed etc., TLS: tlsClient or tlsServer
+	Queued        uint32 // Zero windows only: bytes unread (sent) or not yet sent (received)
+	Protocol      uint32 // ipprotoTCP etc. of drops with a tuple and UDP errors, 0 for the TCP events
+	Mtu           uint32 // ICMP errors only: the next-hop MTU of fragmentation needed and packet too big
+	OooPackets    uint32 // Close events only: segments received out of order, 0 without the reorder probe
+	OooMaxBytes   uint32 // How far ahead of the next expected byte the furthest of them was
+	Reordering    uint32 // Close events only: the sender's reordering degree in segments
+	ReordSeen     uint32 // And how many reorderings it detected, 0 before 5.0
+	Sacks         uint32 // Close events only: ACKs with SACK blocks, 0 without the sack probe
+	SackBlocks    uint32
+	Dsacks        uint32 // The DSACKs among them
+	DsackBytes    uint32 // Close events: bytes of all DSACKs, DSACK events: of this one
+	Probes        uint32 // Keepalive events only: probes sent without an answer
+	MaxProbes     uint32 // And how many the connection gets before it's closed
+	RmemAlloc     uint32 // Buffer pressure only: receive memory in use when the segment arrived
+	RmemAfter     uint32 // And once pruned
+	Rcvbuf        uint32 // The socket's limit
+	RmemMax       uint32 // And the most autotuning grows it to, net.ipv4.tcp_rmem[2]
+	Collapses     uint32 // tcp_collapse runs the pruning took
+	BufferFlags   uint32 // bufferRcvbufLocked, bufferMemPressure
+	StackID       uint32 // Drops with --stacks: 1 + the id of the kernel stack in drop_stacks, 0 without one
+	UserStackID   uint32 // With --user-stacks, resets, ICMP errors, slow and failed connects: 1 + the id in user_stacks, 0 without one
+	TCPConnectNs  uint64 // TLS handshakes only: the TCP handshake before it, 0 for accepted connections
+	TLSWaitNs     uint64 // And the time from the connection being established to the TLS handshake starting
+	Mark          uint32 // Drops and retransmits: the packet's or socket's mark
+	Ifindex       uint32 // SYN floods: the interface the SYNs arrived on. Drops: the packet's device, retransmits: the route's
+	SockCookie    uint64 // Drops and retransmits: the socket's SO_COOKIE, 0 when no one asked for it
+	PrefixLen     uint32 // And Saddr is the source prefix of this length
+	Syns          uint32 // SYNs from it within DurationNs of the second starting
+	MptcpToken    uint32 // Events of MPTCP subflows: the MPTCP connection's token, 0 for plain TCP (see mptcp.go)
+	MptcpSubflow  uint32 // And the subflow's id within it, 0 before 6.6
+	Sock          uint64 // Sockopt and state events: the socket's kernel address, see ConnHistory
+	Backlog       uint32 // Listen events: the accept queue's size after listen(), or when the listener closed
+	Somaxconn     uint32 // listen() only: net.core.somaxconn, which Backlog is capped at
+	AcceptQueue   uint32 // Closed listeners only: connections queued that no one accepted
+	Iif           uint32 // Drops: the interface the packet came in on, retransmits: the one the connection receives on
+	Vlan          uint32 // Drops: vlanTagged | the id of the 802.1Q tag the packet still had, 0 without one
+	PidStart      uint32 // With --process-info, events with an owner from the connection table: when Pid started, see ProcessEnricher
+
+	// Drops only, struct drop_info
+	CtSaddr       [16]byte // Drops of translated connections: the conntrack tuple before NAT
+	CtDaddr       [16]byte
+	NatSaddr      [16]byte // And after it
+	NatDaddr      [16]byte
+	CtSport       uint16
+	CtDport       uint16
+	NatSport      uint16
+	NatDport      uint16
+	NatFlags      uint32 // natSrc, natDst, natReply, 0 when the connection wasn't translated (see conntrack.go)
+	Tunnel        uint32 // Drops of VXLAN and Geneve packets: tunnelVXLAN or tunnelGeneve, the tuple is the tunnel's (see tunnels.go)
+	Vni           uint32 // And the packet's VNI
+	InnerFamily   uint32 // And the tuple of the packet inside it, 0 when it isn't IP
+	InnerProtocol uint32
+	InnerSaddr    [16]byte
+	InnerDaddr    [16]byte
+	InnerSport    uint16
+	InnerDport    uint16
+
+	// Sockopt events only, struct sockopt_info
+	Sockopt    uint32 // level << 16 | optname, see sockopts.go
+	SockoptOld uint32 // And the option before and after the call, 0 for TCP_CONGESTION
+	SockoptNew uint32
+	CaOld      [16]byte // TCP_CONGESTION only: the algorithm before and after
+	CaNew      [16]byte
+
+	Count uint32 // With --coalesce: the identical events this one stands for, 0 when it's just itself
+
+	// Drops with --pcap only: the packet from its IP header on, cut at
+	// --pcap-snaplen, and its full length
+	Packet    []byte
+	PacketLen uint32
+
+	// Filled in by the enrichers in userspace, not part of struct event
+	Pod       *PodInfo
+	Container *ContainerInfo
+	Process   *ProcessInfo
+	// With --otlp-endpoint: the trace registered for the socket, see traces.go
+	Trace     *traceContext
+	Geo       *GeoInfo // With --geoip: the remote end's, nil when the databases don't have it
+	Stack     []string // With --stacks: the drop's kernel stack, innermost first, shared between events
+	UserStack []string // With --user-stacks: where the owner called connect(), innermost first, shared too
+	NetnsName string   // "host", an ip netns name, container:<id>... "" while unknown
+	SaddrName string   // PTR names with --reverse-dns, "" until looked up or without one
+	DaddrName string
+	Anomaly   bool      // With --anomaly: a drop or retransmit while the host's or its destination's rate is unusually high
+	Interface string    // SYN floods: the name of Ifindex, see InterfaceCounters
+	Link      *LinkInfo // Drops and retransmits: the interfaces of Ifindex and Iif, see linkResolver
+	Rule      string    // Blocked connects: the --block rule Reason is the id of, see Enforcer
+
+	// Replayed events only: when the event was recorded, see when
+	Time time.Time
+}
+
+// Reset directions, RST_* in bpf/monitor.c
+const (
+	rstSent     = 1
+	rstReceived = 2
+)
+
+// Zero window directions, WINDOW_* in bpf/monitor.c
+const (
+	windowSent     = 1
+	windowReceived = 2
+)
+
+// UDP error directions, UDP_* in bpf/monitor.c
+const (
+	udpSent     = 1
+	udpReceived = 2
+)
+
+// directionNames names all of them (fastopen.go has TFO's), whose values line up
+var directionNames = map[uint32]string{rstSent: "sent", rstReceived: "received"}
+
+// Address families, as in bpf/monitor.c
+const (
+	afInet  = 2
+	afInet6 = 10
+)
+
+// IP protocols, as in bpf/monitor.c
+const (
+	ipprotoTCP = 6
+	ipprotoUDP = 17
+)
+
+// Size of struct event, which has its padding spelled out so it's the same
+// for every GOARCH
+const eventSize = int(unsafe.Sizeof(monitorEvent{}))
+
+// decodeEvent's offsets of the fields the compiler would be first to move,
+// u64s after u32s and the ends of the struct, against the generated layout.
+// An index out of range here, on any GOARCH, means struct event changed and
+// decodeEvent has to follow it.
+var _ = [1]struct{}{}[eventSize-312]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.Location)-8]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.DurationNs)-72]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.CgroupId)-112]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.TcpConnectNs)-232]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.SockCookie)-256]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.MptcpSubflow)-276]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.Sock)-280]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.Vlan)-304]
+var _ = [1]struct{}{}[unsafe.Offsetof(monitorEvent{}.PidStart)-308]
+
+// Drops and sockopt events carry a tail after struct event, struct
+// drop_info and struct sockopt_info, whose sizes bpf/monitor.c asserts.
+// struct drop_capture is a drop and its tail followed by cap_len,
+// orig_len and the packet bytes.
+const (
+	dropInfoSize      = 128
+	sockoptInfoSize   = 48
+	pcapMaxSnaplen    = 256 // PCAP_MAX_SNAPLEN in bpf/monitor.c
+	captureHeaderSize = 8
+)
+
+var errShortEvent = errors.New("ring buffer sample smaller than struct event")
+
+// remoteAddr is the peer's end of an event. Drops are mostly of received
+// packets, where the source is the peer, and SYN floods always are (their
+// source is the first address of the prefix).
+func remoteAddr(e *TcpEvent) netip.Addr {
+	if e.Type == eventDrop || e.Type == eventSynFlood {
+		return netip.AddrFrom16(e.Saddr).Unmap()
+	}
+	return netip.AddrFrom16(e.Daddr).Unmap()
+}
+
+// when is the time the event is reported at: now for live events, which
+// are handled as they come, and the time it was recorded when replayed
+func (e *TcpEvent) when() time.Time {
+	if e.Time.IsZero() {
+		return time.Now()
+	}
+	return e.Time
+}
+
+// occurrences is how many events this one counts as, for the counters
+func (e *TcpEvent) occurrences() uint64 {
+	if e.Count == 0 {
+		return 1
+	}
+	return uint64(e.Count)
+}
+
+// decodeEvent fills e from a raw ring buffer sample
+// The kernel writes the struct in host byte order, so NativeEndian is the
+// right choice on both little and big endian machines. Decoding field by field
+// avoids binary.Read, which uses reflection and allocates on every call.
+// e may be a reused one: whatever the enrichers added is cleared, and the
+// buffer of its Packet is kept for the next one.
+func decodeEvent(raw []byte, e *TcpEvent) error {
+	packet := e.Packet[:0]
+	*e = TcpEvent{}
+	if len(raw) < eventSize {
+		return errShortEvent
+	}
+	ne := binary.NativeEndian
+
+	e.Pid = ne.Uint32(raw[0:4])
+	e.Reason = ne.Uint32(raw[4:8])
+	e.Location = ne.Uint64(raw[8:16])
+	e.Type = ne.Uint32(raw[16:20])
+	e.State = ne.Uint32(raw[20:24])
+	e.OldState = ne.Uint32(raw[24:28])
+	e.Family = ne.Uint32(raw[28:32])
+	copy(e.Saddr[:], raw[32:48])
+	copy(e.Daddr[:], raw[48:64])
+	e.Sport = ne.Uint16(raw[64:66])
+	e.Dport = ne.Uint16(raw[66:68])
+	e.Retransmits = ne.Uint32(raw[68:72])
+	e.DurationNs = ne.Uint64(raw[72:80])
+	e.BytesSent = ne.Uint64(raw[80:88])
+	e.BytesReceived = ne.Uint64(raw[88:96])
+	copy(e.Comm[:], raw[96:112])
+	e.CgroupID = ne.Uint64(raw[112:120])
+	e.RttMinUs = ne.Uint32(raw[120:124])
+	e.RttAvgUs = ne.Uint32(raw[124:128])
+	e.RttMaxUs = ne.Uint32(raw[128:132])
+	e.RttvarUs = ne.Uint32(raw[132:136])
+	e.Suppressed = ne.Uint32(raw[136:140])
+	e.Netns = ne.Uint32(raw[140:144])
+	e.Direction = ne.Uint32(raw[144:148])
+	e.Queued = ne.Uint32(raw[148:152])
+	e.Protocol = ne.Uint32(raw[152:156])
+	e.Mtu = ne.Uint32(raw[156:160])
+	e.OooPackets = ne.Uint32(raw[160:164])
+	e.OooMaxBytes = ne.Uint32(raw[164:168])
+	e.Reordering = ne.Uint32(raw[168:172])
+	e.ReordSeen = ne.Uint32(raw[172:176])
+	e.Sacks = ne.Uint32(raw[176:180])
+	e.SackBlocks = ne.Uint32(raw[180:184])
+	e.Dsacks = ne.Uint32(raw[184:188])
+	e.DsackBytes = ne.Uint32(raw[188:192])
+	e.Probes = ne.Uint32(raw[192:196])
+	e.MaxProbes = ne.Uint32(raw[196:200])
+	e.RmemAlloc = ne.Uint32(raw[200:204])
+	e.RmemAfter = ne.Uint32(raw[204:208])
+	e.Rcvbuf = ne.Uint32(raw[208:212])
+	e.RmemMax = ne.Uint32(raw[212:216])
+	e.Collapses = ne.Uint32(raw[216:220])
+	e.BufferFlags = ne.Uint32(raw[220:224])
+	e.StackID = ne.Uint32(raw[224:228])
+	e.UserStackID = ne.Uint32(raw[228:232])
+	e.TCPConnectNs = ne.Uint64(raw[232:240])
+	e.TLSWaitNs = ne.Uint64(raw[240:248])
+	e.Mark = ne.Uint32(raw[248:252])
+	e.Ifindex = ne.Uint32(raw[252:256])
+	e.SockCookie = ne.Uint64(raw[256:264])
+	e.PrefixLen = ne.Uint32(raw[264:268])
+	e.Syns = ne.Uint32(raw[268:272])
+	e.MptcpToken = ne.Uint32(raw[272:276])
+	e.MptcpSubflow = ne.Uint32(raw[276:280])
+	e.Sock = ne.Uint64(raw[280:288])
+	e.Backlog = ne.Uint32(raw[288:292])
+	e.Somaxconn = ne.Uint32(raw[292:296])
+	e.AcceptQueue = ne.Uint32(raw[296:300])
+	e.Iif = ne.Uint32(raw[300:304])
+	e.Vlan = ne.Uint32(raw[304:308])
+	e.PidStart = ne.Uint32(raw[308:312])
+
+	switch tail := raw[eventSize:]; {
+	case e.Type == eventDrop && len(tail) >= dropInfoSize:
+		decodeDropInfo(tail, e)
+		// A drop_capture, only sent with --pcap
+		if len(tail) >= dropInfoSize+captureHeaderSize {
+			capLen := ne.Uint32(tail[dropInfoSize : dropInfoSize+4])
+			e.PacketLen = ne.Uint32(tail[dropInfoSize+4 : dropInfoSize+8])
+			data := tail[dropInfoSize+captureHeaderSize:]
+			if int(capLen) <= len(data) {
+				e.Packet = append(packet, data[:capLen]...) // raw is reused by the next read
+			}
+		}
+	case e.Type == eventSockopt && len(tail) >= sockoptInfoSize:
+		e.Sockopt = ne.Uint32(tail[0:4])
+		e.SockoptOld = ne.Uint32(tail[4:8])
+		e.SockoptNew = ne.Uint32(tail[8:12])
+		copy(e.CaOld[:], tail[12:28])
+		copy(e.CaNew[:], tail[28:44])
+	}
+	return nil
+}
+
+// decodeDropInfo fills e from a struct drop_info
+func decodeDropInfo(d []byte, e *TcpEvent) {
+	ne := binary.NativeEndian
+	copy(e.CtSaddr[:], d[0:16])
+	copy(e.CtDaddr[:], d[16:32])
+	copy(e.NatSaddr[:], d[32:48])
+	copy(e.NatDaddr[:], d[48:64])
+	e.CtSport = ne.Uint16(d[64:66])
+	e.CtDport = ne.Uint16(d[66:68])
+	e.NatSport = ne.Uint16(d[68:70])
+	e.NatDport = ne.Uint16(d[70:72])
+	e.NatFlags = ne.Uint32(d[72:76])
+	e.Tunnel = ne.Uint32(d[76:80])
+	e.Vni = ne.Uint32(d[80:84])
+	e.InnerFamily = ne.Uint32(d[84:88])
+	e.InnerProtocol = ne.Uint32(d[88:92])
+	copy(e.InnerSaddr[:], d[92:108])
+	copy(e.InnerDaddr[:], d[108:124])
+	e.InnerSport = ne.Uint16(d[124:126])
+	e.InnerDport = ne.Uint16(d[126:128])
+}
+
+// commString trims the NUL padding off a kernel task name
+func commString(comm []byte) string {
+	if i := bytes.IndexByte(comm, 0); i >= 0 {
+		comm = comm[:i]
+	}
+	return string(comm)
+}
+
+// observer is implemented by the exporters (Prometheus, OTLP) and sinks
+// Each one sees every event on the processor goroutine, whatever the mode,
+// or on its own behind a SinkFanout queue
+type observer interface {
+	Observe(event *TcpEvent, p *EventProcessor)
+}
+
+// enricher attaches userspace metadata (pod identity...) to an event
+// Runs on the processor goroutine before observers and output see the event,
+// so implementations must answer from a cache and never block on I/O
+type enricher interface {
+	Enrich(event *TcpEvent)
+}
+
+// Most events readEvents puts in one batch
+const eventBatchSize = 64
+
+// eventBatch is the events read in one go, sent to the processor as one
+// instead of taking a channel send each. Batches and the events in them
+// are reused, so nothing may keep a pointer into one, or an event's
+// Packet, past release.
+type eventBatch struct {
+	events []TcpEvent
+}
+
+var eventBatches = sync.Pool{
+	New: func() any { return &eventBatch{events: make([]TcpEvent, 0, eventBatchSize)} },
+}
+
+func newEventBatch() *eventBatch {
+	b := eventBatches.Get().(*eventBatch)
+	b.events = b.events[:0]
+	return b
+}
+
+// release hands b back once every event in it was handled
+func (b *eventBatch) release() { eventBatches.Put(b) }
+
+// readEvents drains the event source into out until it is closed, or
+// drained past its deadline. It is the only goroutine reading src; closing
+// src or setting a deadline is how it gets stopped.
+// Samples are decoded into a batch for as long as the buffer has more of
+// them, so a busy buffer is read at one channel send per eventBatchSize
+// events and without allocating, while a quiet one still sends each event
+// right away.
+// out is closed on return so the processor can simply range over it.
+func readEvents(src eventSource, out *eventQueue) {
+	defer out.close()
+
+	batch := newEventBatch()
+	for {
+		raw, err := src.ReadSample()
+		if err != nil {
+			if isSourceClosed(err) {
+				if len(batch.events) > 0 {
+					out.push(batch)
+				}
+				return
+			}
+			continue
+		}
+
+		// Decoding into the next slot of the slice reuses the event, and
+		// the Packet buffer, that was there before
+		n := len(batch.events)
+		batch.events = batch.events[:n+1]
+		if err := decodeEvent(raw, &batch.events[n]); err != nil {
+			batch.events = batch.events[:n]
+			continue
+		}
+		if len(batch.events) == eventBatchSize || !src.Buffered() {
+			out.push(batch)
+			batch = newEventBatch()
+		}
+	}
+}
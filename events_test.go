@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// The event path from the buffer to the processor, without the kernel:
+// go test -run - -bench . -benchmem
+// reports events/s and how many GCs the run took next to allocs/op, which
+// should stay at 0.
+
+// replaySource hands out the same sample n times, then reports itself closed
+type replaySource struct {
+	raw []byte
+	n   int
+}
+
+func (s *replaySource) ReadSample() ([]byte, error) {
+	if s.n == 0 {
+		return nil, os.ErrClosed
+	}
+	s.n--
+	return s.raw, nil
+}
+
+func (s *replaySource) Buffered() bool          { return s.n > 0 }
+func (s *replaySource) SetDeadline(t time.Time) {}
+func (s *replaySource) Lost() uint64            { return 0 }
+func (s *replaySource) Close() error            { return nil }
+
+// benchSample is a drop as bpf/monitor.c sends it, with a captured packet
+// of capLen bytes after it when capLen isn't 0
+func benchSample(capLen int) []byte {
+	raw := make([]byte, eventSize+dropInfoSize)
+	ne := binary.NativeEndian
+	ne.PutUint32(raw[0:4], 1234)
+	ne.PutUint32(raw[4:8], 2)
+	ne.PutUint64(raw[8:16], 0xffffffff81a2b3c4)
+	ne.PutUint32(raw[16:20], eventDrop)
+	ne.PutUint32(raw[28:32], afInet)
+	copy(raw[96:112], "nginx")
+	if capLen == 0 {
+		return raw
+	}
+	raw = ne.AppendUint32(raw, uint32(capLen))
+	raw = ne.AppendUint32(raw, 1500)
+	return append(raw, make([]byte, capLen)...)
+}
+
+func BenchmarkDecodeEvent(b *testing.B) {
+	raw := benchSample(0)
+	var e TcpEvent
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := decodeEvent(raw, &e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEventPipeline runs b.N samples through readEvents and the
+// channel to a consumer that handles each event, as the processor does
+func BenchmarkEventPipeline(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		capLen int
+	}{{"event", 0}, {"pcap", pcapMaxSnaplen}} {
+		b.Run(bc.name, func(b *testing.B) {
+			src := &replaySource{raw: benchSample(bc.capLen), n: b.N}
+			queue, err := newEventQueue(4096, overflowBlock)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			go readEvents(src, queue)
+			var drops uint64
+			for batch := range queue.batches {
+				for i := range batch.events {
+					drops += batch.events[i].occurrences()
+				}
+				queue.done(batch)
+			}
+
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			if drops != uint64(b.N) {
+				b.Fatalf("got %d events, want %d", drops, b.N)
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+			b.ReportMetric(float64(after.NumGC-before.NumGC), "gcs")
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Any number of sinks can be on at once, stdout with --format json next
+// to /metrics, Kafka, syslog and a CSV file, and each sees every event.
+// The ones that encode, write or send every event (see main) are fed
+// through a queue of their own, --sink-buffer events long, by a goroutine
+// of their own. One that falls behind, hangs on a dead disk or panics
+// loses its own events, and counts them, while the processor and the
+// other sinks carry on. With --sink-buffer 0 they are called on the
+// processor goroutine as before, still each on its own when one panics.
+
+const sinkWarnInterval = 10 * time.Second
+
+// sinkQueue is one sink's queue and goroutine
+type sinkQueue struct {
+	name   string
+	sink   observer
+	events chan sinkEvent // nil with --sink-buffer 0
+	done   chan struct{}
+
+	mu     sync.RWMutex // Held for reading by Observe, so Close doesn't close events under it
+	closed bool
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64 // Full queue, or after a panic
+	lastBusy  atomic.Int64  // Unix nanoseconds the sink was last called or returned
+	failure   atomic.Pointer[string]
+}
+
+// An event copied out of its batch, which is reused once the processor
+// is done with it
+type sinkEvent struct {
+	event TcpEvent
+	p     *EventProcessor
+}
+
+// SinkFanout is every sink behind a queue, for /metrics, /readyz and
+// GET /api/v1/sinks
+type SinkFanout struct {
+	size int // --sink-buffer
+
+	mu     sync.Mutex // Sinks are added while --listen-addr already serves
+	queues []*sinkQueue
+
+	droppedDesc   *prometheus.Desc
+	depthDesc     *prometheus.Desc
+	deliveredDesc *prometheus.Desc
+	failedDesc    *prometheus.Desc
+}
+
+// GET /api/v1/sinks
+type apiSink struct {
+	Name      string `json:"name"`
+	Buffer    int    `json:"buffer"` // --sink-buffer, 0 when called on the processor goroutine
+	Queued    int    `json:"queued"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+	Failure   string `json:"failure,omitempty"` // The panic that stopped it
+}
+
+func NewSinkFanout(size int) (*SinkFanout, error) {
+	if size < 0 {
+		return nil, errors.New("--sink-buffer can't be negative")
+	}
+	return &SinkFanout{
+		size: size,
+		droppedDesc: prometheus.NewDesc("tcpmon_sink_events_dropped_total",
+			"Events a sink lost because its --sink-buffer queue was full, or because it stopped after a panic.", []string{"sink"}, nil),
+		depthDesc: prometheus.NewDesc("tcpmon_sink_queue_depth",
+			"Events waiting in a sink's queue.", []string{"sink"}, nil),
+		deliveredDesc: prometheus.NewDesc("tcpmon_sink_events_total",
+			"Events a sink was handed.", []string{"sink"}, nil),
+		failedDesc: prometheus.NewDesc("tcpmon_sink_failed",
+			"1 once a sink panicked and was stopped, 0 while it works.", []string{"sink"}, nil),
+	}, nil
+}
+
+// Add puts sink behind a queue, and returns what to observe events with
+func (f *SinkFanout) Add(name string, sink observer) observer {
+	q := &sinkQueue{name: name, sink: sink, done: make(chan struct{})}
+	q.lastBusy.Store(time.Now().UnixNano())
+	if f.size > 0 {
+		q.events = make(chan sinkEvent, f.size)
+		go q.run()
+		go q.warnDropped(sinkWarnInterval)
+	} else {
+		close(q.done)
+	}
+	f.mu.Lock()
+	f.queues = append(f.queues, q)
+	f.mu.Unlock()
+	return q
+}
+
+func (f *SinkFanout) all() []*sinkQueue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.queues)
+}
+
+// Observe queues event for the sink, or drops it when the sink is that
+// far behind. Called from the processor goroutine only.
+func (q *sinkQueue) Observe(event *TcpEvent, p *EventProcessor) {
+	if q.failure.Load() != nil {
+		q.dropped.Add(1)
+		return
+	}
+	if q.events == nil {
+		q.deliver(event, p)
+		return
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return // The processor outlived the shutdown timeout
+	}
+	e := sinkEvent{event: *event, p: p}
+	if len(event.Packet) > 0 {
+		e.event.Packet = slices.Clone(event.Packet)
+	}
+	select {
+	case q.events <- e:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for e := range q.events {
+		if q.failure.Load() != nil {
+			q.dropped.Add(1)
+			continue
+		}
+		q.deliver(&e.event, e.p)
+	}
+}
+
+// deliver hands one event to the sink. A sink that panics is stopped
+// rather than trusted with the next event, whatever state it was left in.
+func (q *sinkQueue) deliver(event *TcpEvent, p *EventProcessor) {
+	defer func() {
+		if r := recover(); r != nil {
+			failure := fmt.Sprint(r)
+			q.failure.Store(&failure)
+			q.dropped.Add(1)
+			slog.Error("sink panicked, stopping it", "sink", q.name, "panic", failure, "stack", string(debug.Stack()))
+		}
+	}()
+	q.lastBusy.Store(time.Now().UnixNano()) // An idle sink isn't a stalled one
+	q.sink.Observe(event, p)
+	q.delivered.Add(1)
+	q.lastBusy.Store(time.Now().UnixNano())
+}
+
+// warnDropped logs whenever the sink lost events in the last interval
+func (q *sinkQueue) warnDropped(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var reported uint64
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+		if dropped := q.dropped.Load(); dropped > reported {
+			slog.Warn("sink fell behind, events dropped", "sink", q.name, "dropped", dropped-reported, "interval", interval, "total", dropped)
+			reported = dropped
+		}
+	}
+}
+
+// Health is the sink's own, when it has one, after whether it stopped
+// or stopped taking events out of its queue
+func (q *sinkQueue) Health() error {
+	if failure := q.failure.Load(); failure != nil {
+		return fmt.Errorf("stopped after a panic: %s", *failure)
+	}
+	if n := len(q.events); n > 0 {
+		if stalled := time.Since(time.Unix(0, q.lastBusy.Load())); stalled >= healthStall {
+			return fmt.Errorf("%d events waiting, none delivered for %s", n, stalled.Round(time.Second))
+		}
+	}
+	if h, ok := q.sink.(healthReporter); ok {
+		return h.Health()
+	}
+	return nil
+}
+
+// Close lets the sink finish what's queued, for up to timeout. The sink
+// itself is closed (or not) by whoever created it, once this returned
+// and only if Busy says its goroutine is done with it.
+func (q *sinkQueue) Close(timeout time.Duration) {
+	if q.events == nil {
+		return
+	}
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+		slog.Warn("gave up waiting for a sink, leaving it open", "sink", q.name, "queued", len(q.events), "after", timeout)
+	}
+}
+
+func (q *sinkQueue) api(size int) apiSink {
+	s := apiSink{
+		Name:      q.name,
+		Buffer:    size,
+		Queued:    len(q.events),
+		Delivered: q.delivered.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+	if failure := q.failure.Load(); failure != nil {
+		s.Failure = *failure
+	}
+	return s
+}
+
+// AddHealth has /readyz check every sink
+func (f *SinkFanout) AddHealth(h *HealthChecker) {
+	for _, q := range f.all() {
+		h.AddSink(q.name, q)
+	}
+}
+
+// Close drains every queue at once, so a slow one doesn't eat into the
+// others' time
+func (f *SinkFanout) Close(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, q := range f.all() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.Close(timeout)
+		}()
+	}
+	wg.Wait()
+}
+
+// Busy is whether sink's goroutine is still running after Close, e.g.
+// stuck writing to a full disk, so closing the sink would race with it
+func (f *SinkFanout) Busy(sink observer) bool {
+	for _, q := range f.all() {
+		if q.sink != sink {
+			continue
+		}
+		select {
+		case <-q.done:
+			return false
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (f *SinkFanout) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/sinks", f.handleSinks)
+}
+
+func (f *SinkFanout) Sinks() []apiSink {
+	queues := f.all()
+	all := make([]apiSink, len(queues))
+	for i, q := range queues {
+		all[i] = q.api(f.size)
+	}
+	return all
+}
+
+func (f *SinkFanout) handleSinks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, f.Sinks())
+}
+
+func (f *SinkFanout) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.droppedDesc
+	ch <- f.depthDesc
+	ch <- f.deliveredDesc
+	ch <- f.failedDesc
+}
+
+func (f *SinkFanout) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range f.Sinks() {
+		failed := 0.0
+		if s.Failure != "" {
+			failed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(f.droppedDesc, prometheus.CounterValue, float64(s.Dropped), s.Name)
+		ch <- prometheus.MustNewConstMetric(f.depthDesc, prometheus.GaugeValue, float64(s.Queued), s.Name)
+		ch <- prometheus.MustNewConstMetric(f.deliveredDesc, prometheus.CounterValue, float64(s.Delivered), s.Name)
+		ch <- prometheus.MustNewConstMetric(f.failedDesc, prometheus.GaugeValue, failed, s.Name)
+	}
+}
+
+// Report writes the sinks that lost events at exit, e.g.
+//
+//	Sinks: sqlite dropped 1200 of 50210 events; kafka stopped after a panic: runtime error: index out of range [3] with length 3
+func (f *SinkFanout) Report(w io.Writer) {
+	var parts []string
+	for _, s := range f.Sinks() {
+		switch {
+		case s.Failure != "":
+			parts = append(parts, fmt.Sprintf("%s stopped after a panic: %s", s.Name, s.Failure))
+		case s.Dropped > 0:
+			parts = append(parts, fmt.Sprintf("%s dropped %d of %d events", s.Name, s.Dropped, s.Delivered+s.Dropped))
+		}
+	}
+	if len(parts) > 0 {
+		fmt.Fprintf(w, "Sinks: %s\n", strings.Join(parts, "; "))
+	}
+}
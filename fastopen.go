@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The fastopen probe reports what came of every connect that tried TCP Fast
+// Open, when its SYN-ACK arrives (trace_tcp_fastopen_cache_set in
+// bpf/monitor.c), and of every SYN with a TFO option or data that reached a
+// listener (tcp_try_fastopen).
+
+// TFO directions, FASTOPEN_* in bpf/monitor.c: whose SYN it was
+const (
+	fastopenSent     = 1
+	fastopenReceived = 2
+)
+
+// Outcomes, FASTOPEN_* in bpf/monitor.c
+const (
+	fastopenCookieRequest    = 1
+	fastopenAccepted         = 2
+	fastopenNoCookie         = 3
+	fastopenDataNotAcked     = 4
+	fastopenSynRetransmitted = 5
+	fastopenBlackhole        = 6
+	fastopenInvalidCookie    = 7
+	fastopenRefused          = 8
+)
+
+// fastopenNames are the reasons of TFO events
+var fastopenNames = map[uint32]string{
+	fastopenCookieRequest:    "COOKIE_REQUEST",
+	fastopenAccepted:         "ACCEPTED",
+	fastopenNoCookie:         "NO_COOKIE",
+	fastopenDataNotAcked:     "DATA_NOT_ACKED",
+	fastopenSynRetransmitted: "SYN_RETRANSMITTED",
+	fastopenBlackhole:        "BLACKHOLE",
+	fastopenInvalidCookie:    "INVALID_COOKIE",
+	fastopenRefused:          "REFUSED",
+}
+
+// fastopenFellBack is whether the SYN ended up as a plain handshake after
+// trying to carry data. Cookie requests are how TFO starts, not a fallback.
+func fastopenFellBack(outcome uint32) bool {
+	return outcome != fastopenCookieRequest && outcome != fastopenAccepted
+}
+
+// net.ipv4.tcp_fastopen bits
+const (
+	tfoClientEnable = 0x1
+	tfoServerEnable = 0x2
+)
+
+// warnFastOpenSysctl says so when TFO is off in our network namespace, the
+// usual reason for seeing only NO_COOKIE and REFUSED there. Other namespaces
+// have their own setting.
+func warnFastOpenSysctl() {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 0, 32)
+	if err != nil {
+		return
+	}
+	if v&tfoClientEnable == 0 {
+		slog.Info("net.ipv4.tcp_fastopen has client TFO off, connects here won't try it", "value", v)
+	}
+	if v&tfoServerEnable == 0 {
+		slog.Info("net.ipv4.tcp_fastopen has server TFO off, listeners here refuse it", "value", v)
+	}
+}
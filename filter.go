@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// listFlag collects a flag that can be repeated and/or comma separated
+// e.g. --pid 1234 --pid 5678 or --pid 1234,5678
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// Filters are enforced inside the eBPF programs, so events for processes and
+// connections we don't care about never cross the ring buffer
+type Filters struct {
+	PIDs  []uint32
+	Comms []string
+	Ports []uint16
+	CIDRs []netip.Prefix
+
+	CgroupPath string // cgroup v2 directory, e.g. /sys/fs/cgroup/system.slice/nginx.service
+}
+
+func parseFilters(pids, comms, ports, cidrs listFlag, cgroupPath string) (*Filters, error) {
+	f := &Filters{CgroupPath: cgroupPath}
+	if cgroupPath != "" {
+		var st unix.Statfs_t
+		if err := unix.Statfs(cgroupPath, &st); err != nil {
+			return nil, fmt.Errorf("cgroup %s: %w", cgroupPath, err)
+		}
+		if st.Type != unix.CGROUP2_SUPER_MAGIC {
+			return nil, fmt.Errorf("cgroup %s: not on a cgroup v2 filesystem", cgroupPath)
+		}
+	}
+	for _, p := range pids {
+		pid, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid %q: %w", p, err)
+		}
+		f.PIDs = append(f.PIDs, uint32(pid))
+	}
+	for _, c := range comms {
+		if len(c) >= 16 { // TASK_COMM_LEN, including the NUL
+			return nil, fmt.Errorf("comm %q is longer than the kernel's 15 character limit", c)
+		}
+		f.Comms = append(f.Comms, c)
+	}
+	for _, p := range ports {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", p, err)
+		}
+		f.Ports = append(f.Ports, uint16(port))
+	}
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			// A bare address means just that host
+			addr, addrErr := netip.ParseAddr(c)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		f.CIDRs = append(f.CIDRs, prefix.Masked())
+	}
+	return f, nil
+}
+
+// switches are the values of the programs' filter_by_* globals for f
+func (f *Filters) switches() map[string]uint8 {
+	on := func(b bool) uint8 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	return map[string]uint8{
+		"filter_by_pid":    on(len(f.PIDs) > 0),
+		"filter_by_comm":   on(len(f.Comms) > 0),
+		"filter_by_port":   on(len(f.Ports) > 0),
+		"filter_by_cidr":   on(len(f.CIDRs) > 0),
+		"filter_by_cgroup": on(f.CgroupPath != ""),
+	}
+}
+
+// rewriteSpec sets the filter switches before the programs are loaded
+func (f *Filters) rewriteSpec(spec *ebpf.CollectionSpec) error {
+	for name, v := range f.switches() {
+		if err := setVariable(spec, name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Filters) String() string {
+	var parts []string
+	add := func(name string, n int, values any) {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %v", name, values))
+		}
+	}
+	add("pids", len(f.PIDs), f.PIDs)
+	add("comms", len(f.Comms), f.Comms)
+	add("ports", len(f.Ports), f.Ports)
+	add("cidrs", len(f.CIDRs), f.CIDRs)
+	add("cgroup", len(f.CgroupPath), f.CgroupPath)
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// match is the kernel side's check in userspace, for consumers that narrow
+// the stream down further (gRPC subscribers, alert rules). The cgroup isn't
+// checked, events don't say which cgroup directory they came from.
+func (f *Filters) match(event *TcpEvent) bool {
+	if len(f.PIDs) > 0 && !slices.Contains(f.PIDs, event.Pid) {
+		return false
+	}
+	if len(f.Comms) > 0 && !slices.Contains(f.Comms, commString(event.Comm[:])) {
+		return false
+	}
+	// Like the drop programs, a translated drop matches on either tuple too,
+	// and a tunnel's on the flow inside
+	if f.matchTuple(event.Saddr, event.Daddr, event.Sport, event.Dport) {
+		return true
+	}
+	if event.InnerFamily != 0 && f.matchTuple(event.InnerSaddr, event.InnerDaddr, event.InnerSport, event.InnerDport) {
+		return true
+	}
+	return event.NatFlags != 0 &&
+		(f.matchTuple(event.CtSaddr, event.CtDaddr, event.CtSport, event.CtDport) ||
+			f.matchTuple(event.NatSaddr, event.NatDaddr, event.NatSport, event.NatDport))
+}
+
+func (f *Filters) matchTuple(saddr, daddr [16]byte, sport, dport uint16) bool {
+	if len(f.Ports) > 0 && !slices.Contains(f.Ports, sport) && !slices.Contains(f.Ports, dport) {
+		return false
+	}
+	if len(f.CIDRs) > 0 {
+		s := netip.AddrFrom16(saddr).Unmap()
+		d := netip.AddrFrom16(daddr).Unmap()
+		if !slices.ContainsFunc(f.CIDRs, func(c netip.Prefix) bool { return c.Contains(s) || c.Contains(d) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// cidrKey is prefix's key in filter_cidrs. The programs look up IPv4
+// addresses in their IPv4-mapped form, so IPv4 prefixes go in under
+// ::ffff:0:0/96 too.
+func cidrKey(prefix netip.Prefix) monitorLpmKey {
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	return monitorLpmKey{Prefixlen: uint32(bits), Addr: prefix.Addr().As16()}
+}
+
+// populate fills the filter maps once the objects are loaded. Entries
+// already there are left alone, see update.
+func (f *Filters) populate(objs *monitorObjects) error {
+	for _, pid := range f.PIDs {
+		if err := objs.FilterPids.Put(pid, uint8(1)); err != nil {
+			return fmt.Errorf("adding pid %d: %w", pid, err)
+		}
+	}
+	for _, c := range f.Comms {
+		var key [16]byte
+		copy(key[:], c)
+		if err := objs.FilterComms.Put(key, uint8(1)); err != nil {
+			return fmt.Errorf("adding comm %q: %w", c, err)
+		}
+	}
+	for _, port := range f.Ports {
+		if err := objs.FilterPorts.Put(port, uint8(1)); err != nil {
+			return fmt.Errorf("adding port %d: %w", port, err)
+		}
+	}
+	for _, prefix := range f.CIDRs {
+		if err := objs.FilterCidrs.Put(cidrKey(prefix), uint8(1)); err != nil {
+			return fmt.Errorf("adding CIDR %s: %w", prefix, err)
+		}
+	}
+	if f.CgroupPath != "" {
+		dir, err := os.Open(f.CgroupPath)
+		if err != nil {
+			return fmt.Errorf("opening cgroup: %w", err)
+		}
+		defer dir.Close() // The map keeps its own reference to the cgroup
+		if err := objs.FilterCgroup.Put(uint32(0), uint32(dir.Fd())); err != nil {
+			return fmt.Errorf("adding cgroup %s: %w", f.CgroupPath, err)
+		}
+		// For sockets, whose cgroup the programs walk up themselves
+		id, level, err := cgroupIDLevel(f.CgroupPath)
+		if err != nil {
+			return err
+		}
+		if err := objs.FilterCgroupId.Set(id); err != nil {
+			return fmt.Errorf("setting filter_cgroup_id: %w", err)
+		}
+		if err := objs.FilterCgroupLevel.Set(level); err != nil {
+			return fmt.Errorf("setting filter_cgroup_level: %w", err)
+		}
+	}
+	return nil
+}
+
+// errInvalidFilters is what Reload wraps errors of the filters themselves
+// in, as opposed to the kernel's refusing a map update
+var errInvalidFilters = errors.New("invalid filters")
+
+// update switches the running programs over to f without reloading them.
+// Switches that turn off go first; then stale entries come out, which a
+// filter that stays on doesn't want anyway, so the maps never hold more
+// than f's entries; then new ones go in, and only then do switches turn
+// on, so no event is checked against an empty or half-filled map. Bad
+// flags and filters that don't fit are caught before anything changes.
+func (f *Filters) update(objs *monitorObjects) error {
+	sizes := []struct {
+		name string
+		n    int
+		m    *ebpf.Map
+	}{
+		{"pids", len(f.PIDs), objs.FilterPids},
+		{"comms", len(f.Comms), objs.FilterComms},
+		{"ports", len(f.Ports), objs.FilterPorts},
+		{"CIDRs", len(f.CIDRs), objs.FilterCidrs},
+	}
+	for _, s := range sizes {
+		if s.n > int(s.m.MaxEntries()) {
+			return fmt.Errorf("%w: %d %s, at most %d fit", errInvalidFilters, s.n, s.name, s.m.MaxEntries())
+		}
+	}
+	if f.CgroupPath != "" {
+		if _, _, err := cgroupIDLevel(f.CgroupPath); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidFilters, err)
+		}
+	}
+
+	vars := map[string]*ebpf.Variable{
+		"filter_by_pid":    objs.FilterByPid,
+		"filter_by_comm":   objs.FilterByComm,
+		"filter_by_port":   objs.FilterByPort,
+		"filter_by_cidr":   objs.FilterByCidr,
+		"filter_by_cgroup": objs.FilterByCgroup,
+	}
+	switches := f.switches()
+	for name, v := range switches {
+		if v == 0 {
+			if err := vars[name].Set(v); err != nil {
+				return fmt.Errorf("setting %s: %w", name, err)
+			}
+		}
+	}
+
+	pids := make(map[uint32]bool)
+	for _, pid := range f.PIDs {
+		pids[pid] = true
+	}
+	comms := make(map[[16]byte]bool)
+	for _, c := range f.Comms {
+		var key [16]byte
+		copy(key[:], c)
+		comms[key] = true
+	}
+	ports := make(map[uint16]bool)
+	for _, port := range f.Ports {
+		ports[port] = true
+	}
+	cidrs := make(map[monitorLpmKey]bool)
+	for _, prefix := range f.CIDRs {
+		cidrs[cidrKey(prefix)] = true
+	}
+	if err := pruneFilter(objs.FilterPids, pids); err != nil {
+		return fmt.Errorf("removing pids: %w", err)
+	}
+	if err := pruneFilter(objs.FilterComms, comms); err != nil {
+		return fmt.Errorf("removing comms: %w", err)
+	}
+	if err := pruneFilter(objs.FilterPorts, ports); err != nil {
+		return fmt.Errorf("removing ports: %w", err)
+	}
+	if err := pruneFilter(objs.FilterCidrs, cidrs); err != nil {
+		return fmt.Errorf("removing CIDRs: %w", err)
+	}
+	if f.CgroupPath == "" {
+		if err := objs.FilterCgroup.Delete(uint32(0)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("removing cgroup: %w", err)
+		}
+	}
+
+	if err := f.populate(objs); err != nil {
+		return err
+	}
+	for name, v := range switches {
+		if v != 0 {
+			if err := vars[name].Set(v); err != nil {
+				return fmt.Errorf("setting %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// pruneFilter deletes the keys of a filter map that aren't in keep,
+// collecting them first since deleting while iterating can skip entries
+func pruneFilter[K comparable](m *ebpf.Map, keep map[K]bool) error {
+	var stale []K
+	var key K
+	var value uint8
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		if !keep[key] {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err := m.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterReload re-reads the filters (the flags and --config) and applies
+// them to the running programs, on SIGHUP or --control-addr's POST
+// /api/v1/reload. The probes
+// stay attached and every other map keeps its contents.
+type filterReload struct {
+	mu    sync.Mutex // SIGHUP and the API can race
+	objs  *monitorObjects
+	parse func() (*Filters, error)
+}
+
+func (r *filterReload) Reload() (*Filters, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := r.parse()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidFilters, err)
+	}
+	if err := f.update(r.objs); err != nil {
+		return nil, err
+	}
+	slog.Info("filters reloaded", "filters", f.String())
+	return f, nil
+}
+
+// POST /api/v1/reload, the filters now in place
+type apiFilters struct {
+	PIDs   []uint32 `json:"pids"`
+	Comms  []string `json:"comms"`
+	Ports  []uint16 `json:"ports"`
+	CIDRs  []string `json:"cidrs"`
+	Cgroup string   `json:"cgroup"`
+}
+
+// RegisterControl reloads on --control-addr, like SIGHUP
+func (r *filterReload) RegisterControl(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/reload", r.handleReload)
+}
+
+func (r *filterReload) handleReload(w http.ResponseWriter, req *http.Request) {
+	f, err := r.Reload()
+	if err != nil {
+		slog.Warn("reloading filters", "err", err)
+		status := http.StatusInternalServerError // The kernel refused a map update
+		if errors.Is(err, errInvalidFilters) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	resp := apiFilters{PIDs: f.PIDs, Comms: f.Comms, Ports: f.Ports, CIDRs: []string{}, Cgroup: f.CgroupPath}
+	for _, c := range f.CIDRs {
+		resp.CIDRs = append(resp.CIDRs, c.String())
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Output formats selected with --format
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+var familyNames = map[uint32]string{
+	afInet:  "ipv4",
+	afInet6: "ipv6",
+}
+
+// protocolNames names the protocols of drops and UDP errors, others print as
+// their number
+var protocolNames = map[uint32]string{
+	1:          "icmp",
+	ipprotoTCP: "tcp",
+	ipprotoUDP: "udp",
+	58:         "icmpv6",
+}
+
+func protocolName(protocol uint32) string {
+	if name := protocolNames[protocol]; name != "" {
+		return name
+	}
+	return strconv.FormatUint(uint64(protocol), 10)
+}
+
+// ICMP errors carry type << 8 | code, named like the kernel's ICMP_* and
+// ICMPV6_* codes. Only destination unreachable and packet too big are
+// reported, see bpf/monitor.c.
+var icmpNames = map[uint32]string{
+	3<<8 | 0:  "NET_UNREACH",
+	3<<8 | 1:  "HOST_UNREACH",
+	3<<8 | 2:  "PROT_UNREACH",
+	3<<8 | 3:  "PORT_UNREACH",
+	3<<8 | 4:  "FRAG_NEEDED",
+	3<<8 | 5:  "SR_FAILED",
+	3<<8 | 6:  "NET_UNKNOWN",
+	3<<8 | 7:  "HOST_UNKNOWN",
+	3<<8 | 8:  "HOST_ISOLATED",
+	3<<8 | 9:  "NET_ANO",
+	3<<8 | 10: "HOST_ANO",
+	3<<8 | 11: "NET_UNR_TOS",
+	3<<8 | 12: "HOST_UNR_TOS",
+	3<<8 | 13: "PKT_FILTERED",
+	3<<8 | 14: "PREC_VIOLATION",
+	3<<8 | 15: "PREC_CUTOFF",
+}
+
+var icmpv6Names = map[uint32]string{
+	1<<8 | 0: "NOROUTE",
+	1<<8 | 1: "ADM_PROHIBITED",
+	1<<8 | 2: "NOT_NEIGHBOUR",
+	1<<8 | 3: "ADDR_UNREACH",
+	1<<8 | 4: "PORT_UNREACH",
+	1<<8 | 5: "POLICY_FAIL",
+	1<<8 | 6: "REJECT_ROUTE",
+	2<<8 | 0: "PKT_TOOBIG",
+}
+
+func icmpName(family, reason uint32) string {
+	names := icmpNames
+	if family == afInet6 {
+		names = icmpv6Names
+	}
+	if name := names[reason]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("TYPE_%d_CODE_%d", reason>>8, reason&0xff)
+}
+
+var eventTypeNames = map[uint32]string{
+	eventDrop:       "drop",
+	eventRetransmit: "retransmit",
+	eventState:      "state",
+	eventClose:      "close",
+	eventConnect:    "connect",
+	eventReset:      "reset",
+	eventZeroWindow: "zero_window",
+	eventUDPError:   "udp_error",
+	eventICMPError:  "icmp_error",
+	eventDSACK:      "dsack",
+	eventKeepalive:  "keepalive",
+	eventFastOpen:   "fastopen",
+	eventBuffer:     "buffer",
+	eventTLS:        "tls",
+	eventSynFlood:   "syn_flood",
+	eventBlocked:    "blocked",
+	eventSockopt:    "sockopt",
+	eventListen:     "listen",
+}
+
+// jsonEvent is the --format=json schema, written as one object per line
+// Fields that don't apply to an event type are left out rather than zeroed
+type jsonEvent struct {
+	Timestamp  string         `json:"timestamp"` // RFC 3339 (ISO-8601) with nanoseconds
+	Type       string         `json:"type"`
+	Pid        uint32         `json:"pid"`
+	Reason     string         `json:"reason,omitempty"`
+	Function   string         `json:"function,omitempty"`
+	Layer      string         `json:"layer,omitempty"` // Drops: where in the stack, see droplayers.go
+	Family     string         `json:"family,omitempty"`
+	Protocol   string         `json:"protocol,omitempty"` // Drops with a tuple and UDP errors: tcp, udp...
+	Saddr      string         `json:"saddr,omitempty"`
+	SaddrName  string         `json:"saddr_name,omitempty"` // With --reverse-dns
+	Sport      uint16         `json:"sport,omitempty"`
+	Daddr      string         `json:"daddr,omitempty"`
+	DaddrName  string         `json:"daddr_name,omitempty"`
+	Dport      uint16         `json:"dport,omitempty"`
+	State      string         `json:"state,omitempty"`
+	OldState   string         `json:"old_state,omitempty"`
+	Direction  string         `json:"direction,omitempty"`    // Resets, zero windows and UDP errors: sent or received
+	Queued     uint32         `json:"queued_bytes,omitempty"` // Zero windows: bytes unread (sent) or not yet sent (received)
+	Mtu        uint32         `json:"mtu,omitempty"`          // ICMP errors: next-hop MTU of FRAG_NEEDED and PKT_TOOBIG
+	DsackBytes uint32         `json:"dsack_bytes,omitempty"`  // DSACKs: bytes the peer received twice
+	IdleNs     uint64         `json:"idle_ns,omitempty"`      // Keepalives: how long the peer has been silent
+	Probes     uint32         `json:"probes,omitempty"`       // Keepalives: probes sent without an answer
+	MaxProbes  uint32         `json:"max_probes,omitempty"`
+	Buffer     *jsonBuffer    `json:"buffer,omitempty"`     // Buffer pressure only
+	Nat        *jsonNat       `json:"nat,omitempty"`        // Drops of connections NAT translated
+	Tunnel     *jsonTunnel    `json:"tunnel,omitempty"`     // Drops of VXLAN and Geneve packets, whose tuple is the tunnel's
+	Stack      []string       `json:"stack,omitempty"`      // Drops with --stacks: the kernel stack, innermost first
+	UserStack  []string       `json:"user_stack,omitempty"` // With --user-stacks: where the connection was opened
+	TLS        *jsonTLS       `json:"tls,omitempty"`        // TLS handshakes only
+	SynFlood   *jsonSynFlood  `json:"syn_flood,omitempty"`  // SYN floods only
+	Rule       string         `json:"rule,omitempty"`       // Blocked connects only: the --block rule
+	Sockopt    *jsonSockopt   `json:"sockopt,omitempty"`    // Sockopt events only, reason is the errno of a failed call
+	Listen     *jsonListen    `json:"listen,omitempty"`     // Listen events only, reason is the errno of a failed call
+	LatencyNs  uint64         `json:"latency_ns,omitempty"` // Handshake time of slow connects
+	Suppressed uint32         `json:"suppressed,omitempty"` // Left out by --conn-limit since the last one
+	Count      uint32         `json:"count,omitempty"`      // Identical events folded into this one by --coalesce
+	Anomaly    bool           `json:"anomaly,omitempty"`    // With --anomaly, see anomaly.go
+	Netns      *jsonNetns     `json:"netns,omitempty"`
+	Link       *jsonLink      `json:"link,omitempty"`  // Drops and retransmits: the interfaces they were on, see links.go
+	Mptcp      *jsonMptcp     `json:"mptcp,omitempty"` // Events of MPTCP subflows, see mptcp.go
+	Lifetime   *jsonLifetime  `json:"lifetime,omitempty"`
+	Pod        *jsonPod       `json:"pod,omitempty"`
+	Container  *jsonContainer `json:"container,omitempty"`
+	Process    *jsonProcess   `json:"process,omitempty"`
+	Geo        *jsonGeo       `json:"geo,omitempty"` // With --geoip, the remote end's
+
+	Labels map[string]string `json:"labels,omitempty"` // --label, the same on every event
+}
+
+// Close events only, kept as a nested object so zero counters still show up
+type jsonLifetime struct {
+	DurationNs    uint64       `json:"duration_ns"`
+	BytesSent     uint64       `json:"bytes_sent"`
+	BytesReceived uint64       `json:"bytes_received"`
+	Retransmits   uint32       `json:"retransmits"`
+	Rtt           *jsonRtt     `json:"rtt,omitempty"` // Left out when RTT was never sampled
+	Reorder       *jsonReorder `json:"reorder,omitempty"`
+	Sack          *jsonSack    `json:"sack,omitempty"` // Left out without the sack probe or SACKs
+}
+
+// ACKs with SACK blocks the peer sent, and the DSACKs among them
+type jsonSack struct {
+	Acks       uint32 `json:"acks"`
+	Blocks     uint32 `json:"blocks"`
+	Dsacks     uint32 `json:"dsacks"`
+	DsackBytes uint32 `json:"dsack_bytes"`
+}
+
+// Receive memory of a connection tcp_prune_queue ran on, in bytes with the
+// kernel's overhead, and what to do about it
+type jsonBuffer struct {
+	RmemAlloc   uint32 `json:"rmem_alloc"`
+	RmemAfter   uint32 `json:"rmem_after"`
+	Rcvbuf      uint32 `json:"rcvbuf"`
+	RmemMax     uint32 `json:"rmem_max"`
+	Collapses   uint32 `json:"collapses"`
+	Locked      bool   `json:"rcvbuf_locked"`
+	MemPressure bool   `json:"mem_pressure"`
+	Hint        string `json:"hint"`
+}
+
+// A TLS handshake, and the time the connection took to get to it
+type jsonTLS struct {
+	Side         string `json:"side,omitempty"` // client or server, left out for connections opened before the monitor
+	HandshakeNs  uint64 `json:"handshake_ns"`
+	TCPConnectNs uint64 `json:"tcp_connect_ns,omitempty"` // Clients only
+	WaitNs       uint64 `json:"wait_ns,omitempty"`        // From established to the TLS handshake starting
+}
+
+// A source prefix over --syn-flood, Daddr and Dport are of the SYN that
+// crossed it
+type jsonSynFlood struct {
+	Prefix    string  `json:"prefix"`
+	Interface string  `json:"interface"`
+	Syns      uint32  `json:"syns"`       // In the second so far
+	ElapsedNs uint64  `json:"elapsed_ns"` // Into the second when Syns reached the threshold
+	Rate      float64 `json:"rate"`       // SYNs per second over ElapsedNs
+}
+
+// A setsockopt call, the option before and after it as the kernel keeps it
+type jsonSockopt struct {
+	Option       string `json:"option"` // e.g. TCP_NODELAY
+	Old          uint32 `json:"old"`
+	New          uint32 `json:"new"`
+	OldAlgorithm string `json:"old_algorithm,omitempty"` // TCP_CONGESTION only, old and new are 0
+	NewAlgorithm string `json:"new_algorithm,omitempty"`
+}
+
+// A listener starting or closing, or a bind() or listen() that failed
+type jsonListen struct {
+	Kind        string `json:"kind"`                   // started, listen_failed, bind_failed or closed
+	Backlog     uint32 `json:"backlog,omitempty"`      // The accept queue's size
+	Somaxconn   uint32 `json:"somaxconn,omitempty"`    // started and listen_failed: the backlog's cap
+	AcceptQueue uint32 `json:"accept_queue,omitempty"` // closed: connections no one accepted, reset with it
+}
+
+// The conntrack tuples of a translated connection: as the client sent it,
+// and as it reached the server
+type jsonNat struct {
+	Kind       string    `json:"kind"`  // SNAT, DNAT or SNAT+DNAT
+	Reply      bool      `json:"reply"` // The dropped packet was going server to client
+	Original   jsonTuple `json:"original"`
+	Translated jsonTuple `json:"translated"`
+}
+
+// The overlay network's flow a VXLAN or Geneve packet carried
+type jsonTunnel struct {
+	Kind  string     `json:"kind"` // vxlan or geneve
+	Vni   uint32     `json:"vni"`
+	Inner *jsonInner `json:"inner,omitempty"` // Only when the packet inside was IP
+}
+
+type jsonInner struct {
+	Protocol string `json:"protocol"`
+	jsonTuple
+}
+
+type jsonTuple struct {
+	Saddr string `json:"saddr"`
+	Sport uint16 `json:"sport,omitempty"`
+	Daddr string `json:"daddr"`
+	Dport uint16 `json:"dport,omitempty"`
+}
+
+// Out-of-order segments this end received, and the sender's view of
+// reordering: its degree in segments and how often it saw it
+type jsonReorder struct {
+	OooPackets  uint32 `json:"ooo_packets"`
+	OooMaxBytes uint32 `json:"ooo_max_bytes"`
+	Degree      uint32 `json:"degree"`
+	Seen        uint32 `json:"seen"`
+}
+
+type jsonRtt struct {
+	MinUs uint32 `json:"min_us"`
+	AvgUs uint32 `json:"avg_us"`
+	MaxUs uint32 `json:"max_us"`
+	VarUs uint32 `json:"var_us"`
+}
+
+// Latency histogram summaries, every --hist-interval (see histograms.go)
+// Slots are the raw log2 buckets: slots[i] counts values in [2^i, 2^(i+1)) µs
+type jsonLatency struct {
+	Timestamp string   `json:"timestamp"`
+	Type      string   `json:"type"` // Always "latency"
+	Kind      string   `json:"kind"` // connect or rtt
+	Daddr     string   `json:"daddr"`
+	Count     uint64   `json:"count"`
+	P50Us     int64    `json:"p50_us"`
+	P95Us     int64    `json:"p95_us"`
+	P99Us     int64    `json:"p99_us"`
+	BoundsUs  []uint64 `json:"bounds_us"` // Upper bounds of the slots but the last, which is open ended
+	Slots     []uint64 `json:"slots"`
+
+	Labels map[string]string `json:"labels,omitempty"` // --label
+}
+
+// Only with --k8s, and only for events from a pod's cgroup
+type jsonPod struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	UID       string            `json:"uid"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// Only with --containers
+type jsonContainer struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// The event's network namespace, name left out while it's unknown
+type jsonNetns struct {
+	Inode uint32 `json:"inode"`
+	Name  string `json:"name,omitempty"`
+}
+
+// Where a drop or retransmit happened, names left out outside the host
+// namespace
+type jsonLink struct {
+	Ifindex   uint32 `json:"ifindex,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Vlan      uint16 `json:"vlan,omitempty"`   // The packet's 802.1Q tag, or the VLAN the device is
+	Lower     string `json:"lower,omitempty"`  // Of a VLAN device: the interface it's on
+	Master    string `json:"master,omitempty"` // The bond or bridge it's a port of
+	InIfindex uint32 `json:"in_ifindex,omitempty"`
+	InName    string `json:"in_name,omitempty"`
+}
+
+// The MPTCP connection a subflow's event belongs to
+type jsonMptcp struct {
+	Token   string `json:"token"`             // In hex, like ss -M
+	Subflow uint32 `json:"subflow,omitempty"` // 6.6+
+}
+
+// Only with --geoip, and only for addresses the databases have
+type jsonGeo struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// Only with --process-info, and only while the process was still running
+type jsonProcess struct {
+	Cmdline string `json:"cmdline"`
+	UID     uint32 `json:"uid"`
+	User    string `json:"user"`
+	Cgroup  string `json:"cgroup"`
+}
+
+func (p *EventProcessor) formatJSON(event *TcpEvent) []byte {
+	out := jsonEvent{
+		Timestamp:  event.when().Format(time.RFC3339Nano),
+		Type:       eventTypeNames[event.Type],
+		Pid:        event.Pid,
+		Suppressed: event.Suppressed,
+		Count:      event.Count,
+		Anomaly:    event.Anomaly,
+		SaddrName:  event.SaddrName,
+		DaddrName:  event.DaddrName,
+	}
+
+	switch event.Type {
+	case eventDrop:
+		out.Reason = p.reasonName(event.Reason)
+		out.Function = findNearestSymbol(event.Location)
+		out.Layer = dropLayer(out.Function, out.Reason)
+		if event.Family != 0 { // Only IP drops carry a tuple
+			out.Family = familyNames[event.Family]
+			out.Protocol = protocolName(event.Protocol)
+			out.Saddr = formatAddr(event.Saddr)
+			out.Sport = event.Sport
+			out.Daddr = formatAddr(event.Daddr)
+			out.Dport = event.Dport
+		}
+		if event.NatFlags != 0 {
+			out.Nat = &jsonNat{
+				Kind:       natKinds(event.NatFlags),
+				Reply:      event.NatFlags&natReply != 0,
+				Original:   jsonTuple{formatAddr(event.CtSaddr), event.CtSport, formatAddr(event.CtDaddr), event.CtDport},
+				Translated: jsonTuple{formatAddr(event.NatSaddr), event.NatSport, formatAddr(event.NatDaddr), event.NatDport},
+			}
+		}
+		if event.Tunnel != 0 {
+			out.Tunnel = &jsonTunnel{Kind: tunnelNames[event.Tunnel], Vni: event.Vni}
+			if event.InnerFamily != 0 {
+				out.Tunnel.Inner = &jsonInner{protocolName(event.InnerProtocol),
+					jsonTuple{formatAddr(event.InnerSaddr), event.InnerSport, formatAddr(event.InnerDaddr), event.InnerDport}}
+			}
+		}
+		out.Stack = event.Stack
+	case eventUDPError:
+		out.Reason = errnoName(event.Reason)
+		out.Protocol = protocolName(event.Protocol)
+		out.Direction = directionNames[event.Direction]
+		out.Sport = event.Sport
+		if event.Family != 0 { // Receive errors before 6.10 only have our port
+			out.Family = familyNames[event.Family]
+			out.Saddr = formatAddr(event.Saddr)
+			out.Daddr = formatAddr(event.Daddr)
+			out.Dport = event.Dport
+		}
+	default:
+		out.Family = familyNames[event.Family]
+		out.Saddr = formatAddr(event.Saddr)
+		out.Sport = event.Sport
+		out.Daddr = formatAddr(event.Daddr)
+		out.Dport = event.Dport
+		if event.State != 0 { // Only untracked ICMP errors and TFO SYNs without a child socket have no state
+			out.State = p.stateName(event.State)
+		}
+		if event.Type == eventState {
+			out.OldState = p.stateName(event.OldState)
+		}
+		if event.Type == eventConnect {
+			out.LatencyNs = event.DurationNs
+		}
+		if event.Type == eventReset {
+			out.Direction = directionNames[event.Direction]
+			if event.Direction == rstSent {
+				out.Reason = p.resetReasonName(event.Reason)
+			}
+		}
+		if event.Type == eventZeroWindow {
+			out.Direction = directionNames[event.Direction]
+			out.Queued = event.Queued
+		}
+		if event.Type == eventICMPError {
+			out.Reason = icmpName(event.Family, event.Reason)
+			out.Mtu = event.Mtu
+		}
+		if event.Type == eventDSACK {
+			out.DsackBytes = event.DsackBytes
+		}
+		if event.Type == eventBuffer {
+			out.Reason = bufferNames[event.Direction]
+			out.Buffer = &jsonBuffer{
+				RmemAlloc:   event.RmemAlloc,
+				RmemAfter:   event.RmemAfter,
+				Rcvbuf:      event.Rcvbuf,
+				RmemMax:     event.RmemMax,
+				Collapses:   event.Collapses,
+				Locked:      event.BufferFlags&bufferRcvbufLocked != 0,
+				MemPressure: event.BufferFlags&bufferMemPressure != 0,
+				Hint:        bufferHint(event),
+			}
+		}
+		if event.Type == eventFastOpen {
+			out.Reason = fastopenNames[event.Reason]
+			out.Direction = directionNames[event.Direction]
+		}
+		if event.Type == eventSynFlood {
+			out.Saddr = ""
+			out.SynFlood = &jsonSynFlood{
+				Prefix:    synFloodPrefix(event),
+				Interface: synFloodInterface(event),
+				Syns:      event.Syns,
+				ElapsedNs: event.DurationNs,
+				Rate:      synFloodRate(event),
+			}
+		}
+		if event.Type == eventBlocked {
+			out.Saddr = "" // The connect hasn't picked one yet
+			out.Rule = blockedRule(event)
+		}
+		if event.Type == eventSockopt {
+			if event.Dport == 0 { // Not connected yet
+				out.Daddr = ""
+				if event.Sport == 0 {
+					out.Saddr = ""
+				}
+			}
+			if event.Reason != 0 {
+				out.Reason = errnoName(event.Reason)
+			}
+			out.Sockopt = &jsonSockopt{
+				Option:       sockoptName(event.Sockopt),
+				Old:          event.SockoptOld,
+				New:          event.SockoptNew,
+				OldAlgorithm: commString(event.CaOld[:]),
+				NewAlgorithm: commString(event.CaNew[:]),
+			}
+		}
+		if event.Type == eventListen {
+			out.Daddr, out.Dport = "", 0
+			if event.Reason != 0 {
+				out.Reason = errnoName(event.Reason)
+			}
+			if event.Direction == listenStarted && event.OldState == tcpListen {
+				out.OldState = p.stateName(event.OldState)
+			}
+			out.Listen = &jsonListen{
+				Kind:        listenKinds[event.Direction],
+				Backlog:     event.Backlog,
+				Somaxconn:   event.Somaxconn,
+				AcceptQueue: event.AcceptQueue,
+			}
+		}
+		if event.Type == eventTLS {
+			out.TLS = &jsonTLS{
+				Side:         tlsSideNames[event.Direction],
+				HandshakeNs:  event.DurationNs,
+				TCPConnectNs: event.TCPConnectNs,
+				WaitNs:       event.TLSWaitNs,
+			}
+		}
+		if event.Type == eventKeepalive {
+			out.Reason = keepaliveNames[event.Direction]
+			out.IdleNs = event.DurationNs
+			out.Probes = event.Probes
+			out.MaxProbes = event.MaxProbes
+		}
+		if event.Type == eventClose {
+			out.Lifetime = &jsonLifetime{
+				DurationNs:    event.DurationNs,
+				BytesSent:     event.BytesSent,
+				BytesReceived: event.BytesReceived,
+				Retransmits:   event.Retransmits,
+			}
+			if event.RttAvgUs != 0 {
+				out.Lifetime.Rtt = &jsonRtt{
+					MinUs: event.RttMinUs,
+					AvgUs: event.RttAvgUs,
+					MaxUs: event.RttMaxUs,
+					VarUs: event.RttvarUs,
+				}
+			}
+			if event.Reordering != 0 {
+				out.Lifetime.Reorder = &jsonReorder{
+					OooPackets:  event.OooPackets,
+					OooMaxBytes: event.OooMaxBytes,
+					Degree:      event.Reordering,
+					Seen:        event.ReordSeen,
+				}
+			}
+			if event.Sacks != 0 {
+				out.Lifetime.Sack = &jsonSack{
+					Acks:       event.Sacks,
+					Blocks:     event.SackBlocks,
+					Dsacks:     event.Dsacks,
+					DsackBytes: event.DsackBytes,
+				}
+			}
+		}
+	}
+
+	if event.Netns != 0 {
+		out.Netns = &jsonNetns{Inode: event.Netns, Name: event.NetnsName}
+	}
+
+	if l := event.Link; l != nil {
+		out.Link = &jsonLink{Ifindex: l.Ifindex, Name: l.Name, Vlan: l.Vlan, Lower: l.Lower, Master: l.Master,
+			InIfindex: l.InIfindex, InName: l.InName}
+	}
+
+	if event.MptcpToken != 0 {
+		out.Mptcp = &jsonMptcp{Token: mptcpToken(event.MptcpToken), Subflow: event.MptcpSubflow}
+	}
+
+	if pod := event.Pod; pod != nil {
+		out.Pod = &jsonPod{Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID, Labels: pod.Labels}
+	}
+
+	if c := event.Container; c != nil {
+		out.Container = &jsonContainer{ID: c.ID, Name: c.Name, Image: c.Image}
+	}
+
+	if proc := event.Process; proc != nil {
+		out.Process = &jsonProcess{Cmdline: proc.Cmdline, UID: proc.UID, User: proc.User, Cgroup: proc.Cgroup}
+	}
+
+	if geo := event.Geo; geo != nil {
+		out.Geo = &jsonGeo{Country: geo.Country, ASN: geo.ASN, ASOrg: geo.ASOrg}
+	}
+	out.UserStack = event.UserStack
+	out.Labels = p.labels
+
+	b, _ := json.Marshal(&out) // Can't fail, every field is a plain value
+	return append(b, '\n')
+}
@@ -1,3 +1,6 @@
 package main
 
-//go:generate /usr/local/go/bin/go run github.com/cilium/ebpf/cmd/bpf2go -target bpfel -go-package main monitor bpf/monitor.c -- -I./bpf
+//go:generate /usr/local/go/bin/go run github.com/cilium/ebpf/cmd/bpf2go -target amd64,arm64,arm -go-package main monitor bpf/monitor.c -- -I./bpf
+//go:generate /usr/local/go/bin/go run github.com/cilium/ebpf/cmd/bpf2go -target amd64,arm64,arm -go-package main monitorPerf bpf/monitor.c -- -I./bpf -DUSE_PERF_BUF
+//go:generate /usr/local/go/bin/go run github.com/cilium/ebpf/cmd/bpf2go -target amd64,arm64,arm -go-package main -type socket_info snapshot bpf/snapshot.c -- -I./bpf
+//go:generate protoc -I proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/tcpmon.proto
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// --geoip labels events with the country and autonomous system of the
+// remote peer, from MaxMind DB files: GeoLite2-Country or -City for the
+// country, GeoLite2-ASN for the AS, or the commercial and DB-IP databases
+// with the same layout. The format is small enough to read without a
+// library (https://maxmind.github.io/MaxMind-DB/): a binary search tree on
+// the address bits whose leaves point into a data section of typed values.
+
+// Where the metadata starts, it's searched for from the end of the file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Most addresses kept looked up, past that the cache starts over
+const geoCacheSize = 16384
+
+// GeoInfo is what the databases know about an address
+type GeoInfo struct {
+	Country string // ISO 3166-1 alpha-2, e.g. US, "" without a country database or entry
+	ASN     uint32 // 0 without an ASN database or entry
+	ASOrg   string // The AS's name, e.g. GOOGLE
+}
+
+// mmdb is one database, mapped read only
+type mmdb struct {
+	path       string
+	dbType     string // database_type, e.g. GeoLite2-ASN
+	file       []byte
+	tree       []byte // The search tree, then 16 zero bytes, then the data section
+	data       []byte
+	nodes      uint32
+	recordSize uint32 // Bits per record, 24, 28 or 32
+	ipv4Start  uint32 // Node IPv4 addresses start from, at ::/96 in an IPv6 tree
+	ipv6       bool
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	file, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mapping %s: %w", path, err)
+	}
+	db, err := parseMMDB(path, file)
+	if err != nil {
+		unix.Munmap(file)
+		return nil, err
+	}
+	return db, nil
+}
+
+func parseMMDB(path string, file []byte) (*mmdb, error) {
+	i := bytes.LastIndex(file, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s isn't a MaxMind DB file", path)
+	}
+	meta := file[i+len(mmdbMetadataMarker):]
+	v, _, err := (&mmdbDecoder{buf: meta}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s metadata: %w", path, err)
+	}
+	m, _ := v.(map[string]any)
+	db := &mmdb{path: path, file: file}
+	db.dbType, _ = m["database_type"].(string)
+	nodes, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	db.nodes, db.recordSize, db.ipv6 = uint32(nodes), uint32(recordSize), ipVersion == 6
+
+	treeSize := uint64(nodes) * recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, fmt.Errorf("%s: search tree larger than the file", path)
+	}
+	db.tree = file[:treeSize]
+	db.data = file[treeSize+16 : i]
+
+	// IPv4 addresses sit at ::a.b.c.d in an IPv6 tree
+	if db.ipv6 {
+		for range 96 {
+			if db.ipv4Start >= db.nodes {
+				break
+			}
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record is the left (bit 0) or right (bit 1) record of node
+func (db *mmdb) record(node uint32, bit uint) uint32 {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6:]
+		if bit == 1 {
+			b = b[3:]
+		}
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(db.tree[node*8+uint32(bit)*4:])
+	}
+}
+
+// lookup returns addr's record, nil when the database has none
+func (db *mmdb) lookup(addr netip.Addr) (map[string]any, error) {
+	addr = addr.Unmap()
+	var bits []byte
+	node := uint32(0)
+	if addr.Is4() {
+		a := addr.As4()
+		bits = a[:]
+		if db.ipv6 {
+			node = db.ipv4Start
+		}
+	} else {
+		if !db.ipv6 {
+			return nil, nil
+		}
+		a := addr.As16()
+		bits = a[:]
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodes; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodes { // Equal is the tree's "not found"
+		return nil, nil
+	}
+	v, _, err := (&mmdbDecoder{buf: db.data}).decode(int(node-db.nodes-16), 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", db.path, err)
+	}
+	m, _ := v.(map[string]any)
+	return m, nil
+}
+
+func (db *mmdb) Close() error {
+	return unix.Munmap(db.file)
+}
+
+// mmdbDecoder reads values of the data section (or the metadata), whose
+// pointers are offsets into buf
+type mmdbDecoder struct {
+	buf []byte
+}
+
+var errMMDBCorrupt = errors.New("corrupt data section")
+
+// MaxMind DB data types, as numbered in the control byte
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decode returns the value at off and the offset after it. Maps come out as
+// map[string]any, arrays as []any, integers as uint64 (int32 as int64).
+func (d *mmdbDecoder) decode(off, depth int) (any, int, error) {
+	if depth > 32 || off < 0 || off >= len(d.buf) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := d.buf[off]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == mmdbPointer {
+		target, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	}
+	if typ == mmdbExtended {
+		if off >= len(d.buf) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + int(d.buf[off])
+		off++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28 // 1, 2 or 3 more bytes
+		if off+n > len(d.buf) {
+			return nil, 0, errMMDBCorrupt
+		}
+		extra := 0
+		for _, b := range d.buf[off : off+n] {
+			extra = extra<<8 | int(b)
+		}
+		size = [...]int{0, 29, 285, 65821}[n] + extra
+		off += n
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], off = v, next
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, v), next
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > len(d.buf) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := d.buf[off : off+size]
+	off += size
+	switch typ {
+	case mmdbString:
+		return string(b), off, nil
+	case mmdbBytes, mmdbUint128:
+		return bytes.Clone(b), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, off, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), off, nil
+	}
+	return nil, 0, fmt.Errorf("%w: data type %d", errMMDBCorrupt, typ)
+}
+
+// pointer reads the pointer whose control byte was ctrl, returning where it
+// points and where the data after it starts
+func (d *mmdbDecoder) pointer(ctrl byte, off int) (int, int, error) {
+	n := int(ctrl>>3&0x3) + 1
+	if off+n > len(d.buf) {
+		return 0, 0, errMMDBCorrupt
+	}
+	p := 0
+	if n < 4 {
+		p = int(ctrl & 0x7)
+	}
+	for _, b := range d.buf[off : off+n] {
+		p = p<<8 | int(b)
+	}
+	p += [...]int{0, 0, 2048, 526336, 0}[n]
+	return p, off + n, nil
+}
+
+// GeoEnricher puts the country and AS of the remote end on events. Lookups
+// are a walk down the tree and are cached, so they're done inline.
+type GeoEnricher struct {
+	country *mmdb // nil without a country or city database
+	asn     *mmdb // nil without an ASN database
+
+	mu    sync.Mutex // Enrich runs on the processor goroutine, Prometheus scrapes on their own
+	cache map[netip.Addr]*GeoInfo
+}
+
+// NewGeoEnricher opens the --geoip databases, telling country and ASN ones
+// apart by their database_type
+func NewGeoEnricher(paths []string) (*GeoEnricher, error) {
+	g := &GeoEnricher{cache: make(map[netip.Addr]*GeoInfo)}
+	for _, path := range paths {
+		db, err := openMMDB(path)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		slot := &g.country
+		if strings.Contains(db.dbType, "ASN") {
+			slot = &g.asn
+		}
+		if *slot != nil {
+			db.Close()
+			g.Close()
+			return nil, fmt.Errorf("%s and %s are both %s databases, give one of each", (*slot).path, path, db.dbType)
+		}
+		*slot = db
+	}
+	return g, nil
+}
+
+// Enrich looks up the remote end of event
+func (g *GeoEnricher) Enrich(event *TcpEvent) {
+	if event.Family == 0 { // A drop without a tuple
+		return
+	}
+	event.Geo = g.Lookup(remoteAddr(event))
+}
+
+// Lookup returns what the databases know about addr, nil when neither has
+// it (private addresses, mostly)
+// Safe to call from any goroutine, and on a nil enricher
+func (g *GeoEnricher) Lookup(addr netip.Addr) *GeoInfo {
+	if g == nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if info, ok := g.cache[addr]; ok {
+		return info
+	}
+	info := g.lookup(addr)
+	if len(g.cache) >= geoCacheSize {
+		clear(g.cache)
+	}
+	g.cache[addr] = info
+	return info
+}
+
+func (g *GeoEnricher) lookup(addr netip.Addr) *GeoInfo {
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return nil
+	}
+	var info GeoInfo
+	if g.country != nil {
+		// Where the address is, or failing that where its block is registered
+		if rec, err := g.country.lookup(addr); err == nil && rec != nil {
+			for _, key := range []string{"country", "registered_country"} {
+				if c, ok := rec[key].(map[string]any); ok {
+					if code, _ := c["iso_code"].(string); code != "" {
+						info.Country = code
+						break
+					}
+				}
+			}
+		}
+	}
+	if g.asn != nil {
+		if rec, err := g.asn.lookup(addr); err == nil && rec != nil {
+			asn, _ := rec["autonomous_system_number"].(uint64)
+			info.ASN = uint32(asn)
+			info.ASOrg, _ = rec["autonomous_system_organization"].(string)
+		}
+	}
+	if info == (GeoInfo{}) {
+		return nil
+	}
+	return &info
+}
+
+func (g *GeoEnricher) Close() {
+	for _, db := range []*mmdb{g.country, g.asn} {
+		if db != nil {
+			db.Close()
+		}
+	}
+}
+
+// geoLabels are the country and ASN labels of an event's metrics, empty
+// (so dropped by Prometheus) without --geoip or an entry for the address
+func geoLabels(geo *GeoInfo) (country, asn string) {
+	if geo == nil {
+		return "", ""
+	}
+	if geo.ASN != 0 {
+		asn = strconv.FormatUint(uint64(geo.ASN), 10)
+	}
+	return geo.Country, asn
+}
+
+// geoString is how text output shows it, e.g. US AS15169 (GOOGLE)
+func geoString(geo *GeoInfo) string {
+	var parts []string
+	if geo.Country != "" {
+		parts = append(parts, geo.Country)
+	}
+	if geo.ASN != 0 {
+		as := "AS" + strconv.FormatUint(uint64(geo.ASN), 10)
+		if geo.ASOrg != "" {
+			as += " (" + geo.ASOrg + ")"
+		}
+		parts = append(parts, as)
+	}
+	return strings.Join(parts, " ")
+}
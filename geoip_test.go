@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// mmdbRaw is already encoded
+type mmdbRaw []byte
+
+// mmdbValue encodes a value of the data section: strings, uint32s, maps
+// as a list of key, value pairs, and mmdbRaw as it is
+func mmdbValue(v any) []byte {
+	ctrl := func(typ, size int) []byte {
+		if typ > 7 {
+			return []byte{byte(size), byte(typ - 7)}
+		}
+		return []byte{byte(typ<<5 | size)}
+	}
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(mmdbString, len(v)), v...)
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		return append(ctrl(mmdbUint32, 4), b...)
+	case []any:
+		b := ctrl(mmdbMap, len(v)/2)
+		for _, kv := range v {
+			b = append(b, mmdbValue(kv)...)
+		}
+		return b
+	case mmdbRaw:
+		return v
+	}
+	panic("can't encode")
+}
+
+// mmdbPointerTo is a 2-byte pointer to off, below 2048
+func mmdbPointerTo(off int) mmdbRaw {
+	return mmdbRaw{byte(mmdbPointer<<5 | off>>8), byte(off)}
+}
+
+// buildMMDB makes an IPv6 database with 24-bit records in which each of
+// prefixes leads to the data section's offset it maps to. IPv4 prefixes
+// go at ::a.b.c.d.
+func buildMMDB(t *testing.T, prefixes map[string]int, data []byte) []byte {
+	t.Helper()
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	leaves := map[[2]int]int{} // Node and bit to data offset
+	for s, off := range prefixes {
+		p := netip.MustParsePrefix(s)
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			bits += 96
+		}
+		a := p.Addr().As16()
+		if p.Addr().Is4() {
+			a = [16]byte{}
+			v4 := p.Addr().As4()
+			copy(a[12:], v4[:])
+		}
+		node := 0
+		for i := range bits {
+			bit := int(a[i/8] >> (7 - i%8) & 1)
+			if i == bits-1 {
+				leaves[[2]int{node, bit}] = off
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var file []byte
+	for n, records := range nodes {
+		for bit, r := range records {
+			switch off, ok := leaves[[2]int{n, bit}]; {
+			case ok:
+				r = len(nodes) + 16 + off
+			case r == empty:
+				r = len(nodes)
+			}
+			file = append(file, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	return append(file, mmdbValue([]any{
+		"node_count", uint32(len(nodes)),
+		"record_size", uint32(24),
+		"ip_version", uint32(6),
+		"database_type", "Test-Country",
+	})...)
+}
+
+func TestMMDBLookup(t *testing.T) {
+	// The second record reuses the first's iso_code by a pointer
+	de := mmdbValue([]any{"country", []any{"iso_code", "DE"}})
+	fr := mmdbValue([]any{"country", []any{"iso_code", "FR"}})
+	deCode := 1 + len(mmdbValue("country")) + 1 + len(mmdbValue("iso_code")) // Past both maps' control bytes
+	nl := mmdbValue([]any{"registered_country", []any{"iso_code", mmdbPointerTo(deCode)}})
+	data := append(append(append([]byte{}, de...), fr...), nl...)
+	file := buildMMDB(t, map[string]int{
+		"192.0.2.0/24":    0,
+		"2001:db8::/32":   len(de),
+		"198.51.100.0/24": len(de) + len(fr),
+	}, data)
+
+	db, err := parseMMDB("test.mmdb", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.dbType != "Test-Country" || !db.ipv6 || db.recordSize != 24 {
+		t.Fatalf("metadata: %+v", db)
+	}
+	g := &GeoEnricher{country: db, cache: make(map[netip.Addr]*GeoInfo)}
+	for _, tt := range []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.77", "DE"},       // IPv4 in the IPv6 tree
+		{"::ffff:192.0.2.1", "DE"}, // Mapped, as sockets give them
+		{"2001:db8:1::5", "FR"},
+		{"198.51.100.9", "DE"}, // Through the pointer
+		{"203.0.113.1", ""},
+		{"2001:db9::1", ""},
+	} {
+		var got string
+		if info := g.lookup(netip.MustParseAddr(tt.addr)); info != nil {
+			got = info.Country
+		}
+		if got != tt.want {
+			t.Errorf("%s: country %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestParseMMDBErrors(t *testing.T) {
+	good := buildMMDB(t, map[string]int{"192.0.2.0/24": 0}, mmdbValue("x"))
+	marker := len(good) - len(mmdbValue([]any{
+		"node_count", uint32(0), "record_size", uint32(24), "ip_version", uint32(6), "database_type", "Test-Country",
+	})) - len(mmdbMetadataMarker)
+	for _, tt := range []struct {
+		name string
+		file []byte
+	}{
+		{"empty", nil},
+		{"no metadata", good[:marker]},
+		{"truncated metadata", good[:len(good)-3]},
+		{"tree larger than the file", append(append([]byte{}, good[len(good)/2:marker]...), good[marker:]...)},
+		{"record size", append(append([]byte{}, mmdbMetadataMarker...), mmdbValue([]any{"node_count", uint32(1), "record_size", uint32(20)})...)},
+	} {
+		if _, err := parseMMDB("test.mmdb", tt.file); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestMMDBDecode(t *testing.T) {
+	nested := mmdbRaw{}
+	for range 40 {
+		nested = append(nested, mmdbMap<<5|1) // A map of one entry
+		nested = append(nested, mmdbValue("a")...)
+	}
+	nested = append(nested, mmdbValue("end")...)
+
+	for _, tt := range []struct {
+		name string
+		buf  []byte
+		want any
+		err  bool
+	}{
+		{"string", mmdbValue("GOOGLE"), "GOOGLE", false},
+		{"uint32", mmdbValue(uint32(15169)), uint64(15169), false},
+		{"int32", []byte{0x04, mmdbInt32 - 7, 0xff, 0xff, 0xff, 0xfe}, int64(-2), false},
+		{"bool", []byte{0x01, mmdbBool - 7}, true, false},
+		{"map", mmdbValue([]any{"iso_code", "US"}), map[string]any{"iso_code": "US"}, false},
+		{"array", []byte{0x02, mmdbArray - 7, 0x41, 'a', 0x41, 'b'}, []any{"a", "b"}, false},
+		{"pointer", append(mmdbPointerTo(2), mmdbValue("ok")...), "ok", false},
+		{"long string", append([]byte{mmdbString<<5 | 29, 1}, make([]byte, 30)...), string(make([]byte, 30)), false},
+		{"pointer loop", mmdbPointerTo(0), nil, true},
+		{"too deep", nested, nil, true},
+		{"truncated string", []byte{mmdbString<<5 | 5, 'a', 'b'}, nil, true},
+		{"truncated size", []byte{mmdbString<<5 | 30, 1}, nil, true},
+		{"truncated pointer", []byte{mmdbPointer<<5 | 0x08}, nil, true},
+		{"truncated map", mmdbValue([]any{"a", "b"})[:4], nil, true},
+		{"truncated extended type", []byte{0x01}, nil, true},
+		{"pointer past the end", mmdbPointerTo(100), nil, true},
+		{"map key not a string", []byte{mmdbMap<<5 | 1, 0x01, mmdbBool - 7, 0x41, 'a'}, nil, true},
+		{"double size", []byte{mmdbDouble<<5 | 4, 0, 0, 0, 0}, nil, true},
+		{"uint64 size", append([]byte{9, mmdbUint64 - 7}, make([]byte, 9)...), nil, true},
+	} {
+		got, _, err := (&mmdbDecoder{buf: tt.buf}).decode(0, 0)
+		if tt.err {
+			if !errors.Is(err, errMMDBCorrupt) {
+				t.Errorf("%s: got %v, %v, want a corrupt data error", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, %v, want %#v", tt.name, got, err, tt.want)
+		}
+	}
+}
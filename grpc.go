@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Events queued per subscriber before it starts missing them
+const grpcSubscriberBuffer = 1024
+
+// GRPCServer serves the EventStream service from proto/tcpmon.proto
+// (--grpc-listen). It's an
+// observer, so it gets events on the processor goroutine and hands each
+// subscriber a copy through its own buffered channel; a subscriber that
+// can't keep up misses events instead of blocking everyone else.
+type GRPCServer struct {
+	UnimplementedEventStreamServer
+
+	server *grpc.Server
+	lis    net.Listener
+
+	mu   sync.Mutex
+	subs map[*grpcSubscriber]struct{}
+}
+
+type grpcSubscriber struct {
+	filter *Filters
+	types  []EventType
+	events chan *Event
+	missed uint64 // Only touched by Observe
+}
+
+// NewGRPCServer listens on addr, host:port or unix:/path/to.sock
+func NewGRPCServer(addr string) (*GRPCServer, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+		os.Remove(path) // Left behind by a previous run that was killed
+	}
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &GRPCServer{
+		server: grpc.NewServer(),
+		lis:    lis,
+		subs:   make(map[*grpcSubscriber]struct{}),
+	}
+	RegisterEventStreamServer(s.server, s)
+	go func() {
+		if err := s.server.Serve(lis); err != nil {
+			slog.Warn("gRPC server stopped", "err", err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *GRPCServer) Subscribe(req *EventFilter, stream grpc.ServerStreamingServer[Event]) error {
+	var pids, comms, ports, cidrs listFlag
+	for _, p := range req.Pids {
+		pids = append(pids, strconv.FormatUint(uint64(p), 10))
+	}
+	for _, p := range req.Ports {
+		ports = append(ports, strconv.FormatUint(uint64(p), 10))
+	}
+	comms = append(comms, req.Comms...)
+	cidrs = append(cidrs, req.Cidrs...)
+	filter, err := parseFilters(pids, comms, ports, cidrs, "")
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sub := &grpcSubscriber{filter: filter, types: req.Types, events: make(chan *Event, grpcSubscriberBuffer)}
+	s.mu.Lock()
+	s.subs[sub] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, sub)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return nil // Shutting down
+			}
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *GRPCServer) Observe(event *TcpEvent, p *EventProcessor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subs) == 0 {
+		return
+	}
+
+	var msg *Event // Built once, only if someone wants it
+	for sub := range s.subs {
+		if !sub.match(event) {
+			continue
+		}
+		if msg == nil {
+			msg = protoEvent(event, p)
+		}
+		e := msg
+		if sub.missed > 0 {
+			e = proto.Clone(msg).(*Event)
+			e.Missed = sub.missed
+		}
+		select {
+		case sub.events <- e:
+			sub.missed = 0
+		default:
+			sub.missed++
+		}
+	}
+}
+
+func (sub *grpcSubscriber) match(event *TcpEvent) bool {
+	if len(sub.types) > 0 && !slices.Contains(sub.types, EventType(event.Type)) {
+		return false
+	}
+	return sub.filter.match(event)
+}
+
+// Close ends every stream and stops the server, giving clients a couple of
+// seconds to take what's queued for them
+func (s *GRPCServer) Close() {
+	s.mu.Lock()
+	for sub := range s.subs {
+		close(sub.events) // Observe only sends to subscribers in s.subs
+		delete(s.subs, sub)
+	}
+	s.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		s.server.Stop()
+	}
+}
+
+// Message encodings for the brokers (Kafka, NATS): formatJSON or this
+const encodingProtobuf = "protobuf"
+
+// encodeEvent is a broker message body: the JSON schema without the
+// newline, or the Event message
+func encodeEvent(event *TcpEvent, p *EventProcessor, encoding string) []byte {
+	if encoding == encodingProtobuf {
+		b, _ := proto.Marshal(protoEvent(event, p)) // Can't fail, every field is a plain value
+		return b
+	}
+	return bytes.TrimSuffix(p.formatJSON(event), []byte("\n"))
+}
+
+// protoEvent is formatJSON's mapping, into the proto schema
+func protoEvent(event *TcpEvent, p *EventProcessor) *Event {
+	out := &Event{
+		TimestampNs: event.when().UnixNano(),
+		Type:        EventType(event.Type),
+		Pid:         event.Pid,
+		Comm:        commString(event.Comm[:]),
+		CgroupId:    event.CgroupID,
+		Suppressed:  event.Suppressed,
+		Count:       event.Count,
+		Schema:      eventSchema,
+	}
+
+	// Only IP drops carry a tuple, and UDP receive errors from 6.10 on
+	hasTuple := (event.Type != eventDrop && event.Type != eventUDPError) || event.Family != 0
+	if hasTuple {
+		out.Family = familyNames[event.Family]
+		out.Saddr = formatAddr(event.Saddr)
+		out.Sport = uint32(event.Sport)
+		out.Daddr = formatAddr(event.Daddr)
+		out.Dport = uint32(event.Dport)
+	}
+	if event.Protocol != 0 {
+		out.Protocol = protocolName(event.Protocol)
+	}
+	switch event.Type {
+	case eventDrop:
+		out.Reason = p.reasonName(event.Reason)
+		out.Function = findNearestSymbol(event.Location)
+		out.Layer = dropLayer(out.Function, out.Reason)
+		if event.NatFlags != 0 {
+			out.Nat = &Nat{
+				Kind:       natKinds(event.NatFlags),
+				Reply:      event.NatFlags&natReply != 0,
+				Original:   &Tuple{Saddr: formatAddr(event.CtSaddr), Sport: uint32(event.CtSport), Daddr: formatAddr(event.CtDaddr), Dport: uint32(event.CtDport)},
+				Translated: &Tuple{Saddr: formatAddr(event.NatSaddr), Sport: uint32(event.NatSport), Daddr: formatAddr(event.NatDaddr), Dport: uint32(event.NatDport)},
+			}
+		}
+		if event.Tunnel != 0 {
+			out.Tunnel = &Tunnel{Kind: tunnelNames[event.Tunnel], Vni: event.Vni}
+			if event.InnerFamily != 0 {
+				out.Tunnel.Family = familyNames[event.InnerFamily]
+				out.Tunnel.Protocol = protocolName(event.InnerProtocol)
+				out.Tunnel.Inner = &Tuple{Saddr: formatAddr(event.InnerSaddr), Sport: uint32(event.InnerSport), Daddr: formatAddr(event.InnerDaddr), Dport: uint32(event.InnerDport)}
+			}
+		}
+		out.Stack = event.Stack
+	case eventState:
+		out.State = p.stateName(event.State)
+		out.OldState = p.stateName(event.OldState)
+	case eventConnect:
+		out.State = p.stateName(event.State)
+		out.LatencyNs = event.DurationNs
+	case eventReset:
+		out.State = p.stateName(event.State)
+		out.Direction = directionNames[event.Direction]
+		if event.Direction == rstSent {
+			out.Reason = p.resetReasonName(event.Reason)
+		}
+	case eventZeroWindow:
+		out.State = p.stateName(event.State)
+		out.Direction = directionNames[event.Direction]
+		out.QueuedBytes = event.Queued
+	case eventUDPError:
+		out.Reason = errnoName(event.Reason)
+		out.Direction = directionNames[event.Direction]
+		out.Sport = uint32(event.Sport)
+	case eventDSACK:
+		out.State = p.stateName(event.State)
+		out.DsackBytes = event.DsackBytes
+	case eventKeepalive:
+		out.State = p.stateName(event.State)
+		out.Reason = keepaliveNames[event.Direction]
+		out.IdleNs = event.DurationNs
+		out.Probes = event.Probes
+		out.MaxProbes = event.MaxProbes
+	case eventBuffer:
+		out.State = p.stateName(event.State)
+		out.Reason = bufferNames[event.Direction]
+		out.Buffer = &Buffer{
+			RmemAlloc:    event.RmemAlloc,
+			RmemAfter:    event.RmemAfter,
+			Rcvbuf:       event.Rcvbuf,
+			RmemMax:      event.RmemMax,
+			Collapses:    event.Collapses,
+			RcvbufLocked: event.BufferFlags&bufferRcvbufLocked != 0,
+			MemPressure:  event.BufferFlags&bufferMemPressure != 0,
+			Hint:         bufferHint(event),
+		}
+	case eventTLS:
+		out.State = p.stateName(event.State)
+		out.Tls = &Tls{
+			Side:         tlsSideNames[event.Direction],
+			HandshakeNs:  event.DurationNs,
+			TcpConnectNs: event.TCPConnectNs,
+			WaitNs:       event.TLSWaitNs,
+		}
+	case eventSynFlood:
+		out.Saddr = ""
+		out.SynFlood = &SynFlood{
+			Prefix:    synFloodPrefix(event),
+			Interface: synFloodInterface(event),
+			Syns:      event.Syns,
+			ElapsedNs: event.DurationNs,
+			Rate:      synFloodRate(event),
+		}
+	case eventBlocked:
+		out.Saddr = ""
+		out.Rule = blockedRule(event)
+	case eventSockopt:
+		out.State = p.stateName(event.State)
+		if event.Dport == 0 {
+			out.Daddr = ""
+			if event.Sport == 0 {
+				out.Saddr = ""
+			}
+		}
+		if event.Reason != 0 {
+			out.Reason = errnoName(event.Reason)
+		}
+		out.Sockopt = &Sockopt{
+			Option:       sockoptName(event.Sockopt),
+			Old:          event.SockoptOld,
+			New:          event.SockoptNew,
+			OldAlgorithm: commString(event.CaOld[:]),
+			NewAlgorithm: commString(event.CaNew[:]),
+		}
+	case eventListen:
+		out.State = p.stateName(event.State)
+		out.Daddr, out.Dport = "", 0
+		if event.Reason != 0 {
+			out.Reason = errnoName(event.Reason)
+		}
+		if event.Direction == listenStarted && event.OldState == tcpListen {
+			out.OldState = p.stateName(event.OldState)
+		}
+		out.Listen = &Listen{
+			Kind:        listenKinds[event.Direction],
+			Backlog:     event.Backlog,
+			Somaxconn:   event.Somaxconn,
+			AcceptQueue: event.AcceptQueue,
+		}
+	case eventFastOpen:
+		if event.State != 0 {
+			out.State = p.stateName(event.State)
+		}
+		out.Reason = fastopenNames[event.Reason]
+		out.Direction = directionNames[event.Direction]
+	case eventICMPError:
+		if event.State != 0 {
+			out.State = p.stateName(event.State)
+		}
+		out.Reason = icmpName(event.Family, event.Reason)
+		out.Mtu = event.Mtu
+	case eventClose:
+		out.State = p.stateName(event.State)
+		out.Lifetime = &Lifetime{
+			DurationNs:    event.DurationNs,
+			BytesSent:     event.BytesSent,
+			BytesReceived: event.BytesReceived,
+			Retransmits:   event.Retransmits,
+		}
+		if event.RttAvgUs != 0 {
+			out.Lifetime.Rtt = &Rtt{
+				MinUs: event.RttMinUs,
+				AvgUs: event.RttAvgUs,
+				MaxUs: event.RttMaxUs,
+				VarUs: event.RttvarUs,
+			}
+		}
+		if event.Reordering != 0 {
+			out.Lifetime.Reorder = &Reorder{
+				OooPackets:  event.OooPackets,
+				OooMaxBytes: event.OooMaxBytes,
+				Degree:      event.Reordering,
+				Seen:        event.ReordSeen,
+			}
+		}
+		if event.Sacks != 0 {
+			out.Lifetime.Sack = &Sack{
+				Acks:       event.Sacks,
+				Blocks:     event.SackBlocks,
+				Dsacks:     event.Dsacks,
+				DsackBytes: event.DsackBytes,
+			}
+		}
+	default:
+		out.State = p.stateName(event.State)
+	}
+
+	if pod := event.Pod; pod != nil {
+		out.Pod = &Pod{Namespace: pod.Namespace, Name: pod.Name, Uid: pod.UID, Labels: pod.Labels}
+	}
+	if c := event.Container; c != nil {
+		out.Container = &Container{Id: c.ID, Name: c.Name, Image: c.Image}
+	}
+	out.Netns, out.NetnsName = event.Netns, event.NetnsName
+	if l := event.Link; l != nil {
+		out.Link = &Link{Ifindex: l.Ifindex, Name: l.Name, Vlan: uint32(l.Vlan), Lower: l.Lower, Master: l.Master,
+			InIfindex: l.InIfindex, InName: l.InName}
+	}
+	if event.MptcpToken != 0 {
+		out.Mptcp = &Mptcp{Token: mptcpToken(event.MptcpToken), Subflow: event.MptcpSubflow}
+	}
+	out.SaddrName, out.DaddrName = event.SaddrName, event.DaddrName
+	if proc := event.Process; proc != nil {
+		out.Process = &Process{Cmdline: proc.Cmdline, Uid: proc.UID, User: proc.User, Cgroup: proc.Cgroup}
+	}
+	if geo := event.Geo; geo != nil {
+		out.Geo = &Geo{Country: geo.Country, Asn: geo.ASN, AsOrg: geo.ASOrg}
+	}
+	out.UserStack = event.UserStack
+	out.Labels = p.labels
+	return out
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// /healthz and /readyz on --listen-addr, for a kubelet or systemd-less
+// supervisor to restart a monitor that wedged. /healthz is liveness: the
+// probes are still attached, the reader is still reading the kernel
+// buffer and the processor is still taking events off the queue. /readyz
+// adds that startup finished and that the sinks which know whether their
+// destination is reachable (Kafka, NATS, syslog) are delivering.
+//
+// Both answer 200 or 503, with every check by name in a JSON body.
+
+const (
+	healthInterval = 5 * time.Second  // How often reader progress is sampled
+	healthStall    = 30 * time.Second // Events waiting this long without a batch done is a wedged processor
+)
+
+// healthReporter is a sink that can tell whether its destination is
+// reachable: nil, or what's wrong
+type healthReporter interface {
+	Health() error
+}
+
+type HealthChecker struct {
+	probes  *ProbeManager
+	queue   *eventQueue
+	lost    func() uint64
+	metrics *Metrics
+
+	sinks map[string]healthReporter // Only added to before Ready
+	ready atomic.Bool
+
+	stuckSince atomic.Int64 // Unix nanoseconds, while the kernel loses events and nothing is read
+}
+
+// GET /healthz and /readyz
+type apiHealth struct {
+	Status string            `json:"status"` // ok or failing
+	Checks map[string]string `json:"checks"` // ok or what's wrong, by check
+}
+
+func NewHealthChecker(probes *ProbeManager, queue *eventQueue, lost func() uint64, metrics *Metrics) *HealthChecker {
+	h := &HealthChecker{
+		probes:  probes,
+		queue:   queue,
+		lost:    lost,
+		metrics: metrics,
+		sinks:   make(map[string]healthReporter),
+	}
+	go h.watchReader()
+	return h
+}
+
+func (h *HealthChecker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", h.handleHealthz)
+	mux.HandleFunc("GET /readyz", h.handleReadyz)
+}
+
+// AddSink has /readyz check s. Sinks are added while starting up, before
+// Ready.
+func (h *HealthChecker) AddSink(name string, s healthReporter) {
+	h.sinks[name] = s
+}
+
+// Ready is startup having finished, or, with false, shutdown starting
+func (h *HealthChecker) Ready(ready bool) { h.ready.Store(ready) }
+
+// watchReader samples the reader's progress. Nothing read isn't a problem
+// on a quiet host; nothing read while the kernel keeps losing events for
+// want of room in the buffer is a reader that stopped reading.
+func (h *HealthChecker) watchReader() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	lastLost, lastRead := h.lost(), h.metrics.EventsRead.Load()
+	for now := range ticker.C {
+		lost, read := h.lost(), h.metrics.EventsRead.Load()
+		if lost > lastLost && read == lastRead {
+			h.stuckSince.CompareAndSwap(0, now.Add(-healthInterval).UnixNano())
+		} else {
+			h.stuckSince.Store(0)
+		}
+		lastLost, lastRead = lost, read
+	}
+}
+
+// liveness adds the /healthz checks to checks, and says whether they passed
+func (h *HealthChecker) liveness(checks map[string]string) bool {
+	ok := true
+	check := func(name string, err error) {
+		checks[name] = "ok"
+		if err != nil {
+			checks[name] = err.Error()
+			ok = false
+		}
+	}
+
+	check("probes", h.probes.Check())
+
+	var reader error
+	if h.queue.Closed() {
+		reader = fmt.Errorf("stopped reading the kernel buffer")
+	} else if since := h.stuckSince.Load(); since != 0 {
+		reader = fmt.Errorf("nothing read for %s while the kernel lost events", time.Since(time.Unix(0, since)).Round(time.Second))
+	}
+	check("reader", reader)
+
+	var processor error
+	if stalled := h.queue.Stalled(); stalled >= healthStall {
+		processor = fmt.Errorf("%d events waiting, none processed for %s", h.queue.Depth(), stalled.Round(time.Second))
+	}
+	check("processor", processor)
+	return ok
+}
+
+func (h *HealthChecker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	writeHealth(w, h.liveness(checks), checks)
+}
+
+func (h *HealthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	if !h.ready.Load() {
+		checks["startup"] = "starting or shutting down"
+		writeHealth(w, false, checks)
+		return
+	}
+	ok := h.liveness(checks)
+	for name, s := range h.sinks {
+		checks[name] = "ok"
+		if err := s.Health(); err != nil {
+			checks[name] = err.Error()
+			ok = false
+		}
+	}
+	writeHealth(w, ok, checks)
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, checks map[string]string) {
+	resp := apiHealth{Status: "ok", Checks: checks}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		resp.Status = "failing"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// Must match HIST_SLOTS and HIST_* in bpf/monitor.c
+const (
+	histSlots   = 27
+	histConnect = 1
+	histRTT     = 2
+)
+
+var histKindNames = map[uint32]string{
+	histConnect: "connect",
+	histRTT:     "rtt",
+}
+
+// histBuckets is the upper bounds of a histogram's slots in microseconds,
+// ascending. Slot i counts values below Bounds[i] (and at or above the one
+// before), the slot after the last bound everything above it, so there's
+// room for histSlots-1 bounds.
+type histBuckets []uint64
+
+// histLayout is the buckets of each kind of histogram, from
+// --connect-buckets and --rtt-buckets
+type histLayout map[uint32]histBuckets
+
+// Presets for --connect-buckets and --rtt-buckets. log2 is the default,
+// the others step linearly within each power of ten so they're as fine
+// at 300ms as at 3ms.
+var histPresets = map[string]histBuckets{
+	"log2":       log2Buckets(),
+	"datacenter": logLinearBuckets(10, 5, 1, 2, 5),             // 10µs to 500ms
+	"internet":   logLinearBuckets(1000, 5, 1, 2, 5),           // 1ms to 50s
+	"satellite":  logLinearBuckets(10000, 3, 1, 2, 3, 4, 6, 8), // 10ms to 8s
+}
+
+// log2Buckets are powers of two from 2µs, what the kernel does with no
+// bounds set
+func log2Buckets() histBuckets {
+	b := make(histBuckets, histSlots-1)
+	for i := range b {
+		b[i] = 1 << (i + 1)
+	}
+	return b
+}
+
+// logLinearBuckets are from, from*10... for decades powers of ten, each
+// split at steps
+func logLinearBuckets(from uint64, decades int, steps ...uint64) histBuckets {
+	var b histBuckets
+	for range decades {
+		for _, s := range steps {
+			b = append(b, from*s)
+		}
+		from *= 10
+	}
+	return b
+}
+
+// parseHistBuckets reads --connect-buckets or --rtt-buckets: a preset
+// name, or the bounds as durations (e.g. 1ms,5ms,20ms). Nothing is log2.
+func parseHistBuckets(values listFlag) (histBuckets, error) {
+	if len(values) == 0 {
+		return histPresets["log2"], nil
+	}
+	if len(values) == 1 {
+		if b, ok := histPresets[values[0]]; ok {
+			return b, nil
+		}
+	}
+	if len(values) > histSlots-1 {
+		return nil, fmt.Errorf("%d bounds, at most %d fit", len(values), histSlots-1)
+	}
+	b := make(histBuckets, 0, len(values))
+	for _, v := range values {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither a preset (log2, datacenter, internet, satellite) nor a duration", v)
+		}
+		us := uint64(d.Microseconds())
+		if us == 0 {
+			return nil, fmt.Errorf("bound %s is under a microsecond", v)
+		}
+		if len(b) > 0 && us <= b[len(b)-1] {
+			return nil, fmt.Errorf("bound %s isn't above the one before it", v)
+		}
+		b = append(b, us)
+	}
+	return b, nil
+}
+
+// kernelBounds is b as connect_bounds and rtt_bounds in bpf/monitor.c
+// take it: unused bounds are the largest u64 so the slot after the last
+// real one takes everything above
+func (b histBuckets) kernelBounds() [histSlots - 1]uint64 {
+	var k [histSlots - 1]uint64
+	for i := range k {
+		k[i] = math.MaxUint64
+	}
+	copy(k[:], b)
+	return k
+}
+
+// latencyHist is one interval's worth of a histogram for one remote
+// address. Slots[i] counts values in slotBounds(i) microseconds.
+type latencyHist struct {
+	Kind    uint32 // histConnect or histRTT
+	Raddr   [16]byte
+	Slots   [histSlots]uint64
+	Buckets histBuckets // The bounds Slots were counted with
+}
+
+// slots is the slots in use, one more than there are bounds
+func (h *latencyHist) slots() []uint64 {
+	return h.Slots[:len(h.Buckets)+1]
+}
+
+func (h *latencyHist) count() uint64 {
+	var n uint64
+	for _, c := range h.Slots {
+		n += c
+	}
+	return n
+}
+
+// percentile estimates the p-th percentile (0 < p <= 1) by interpolating
+// linearly inside the slot it falls in
+func (h *latencyHist) percentile(p float64) time.Duration {
+	total := h.count()
+	if total == 0 {
+		return 0
+	}
+	target := p * float64(total)
+
+	var seen float64
+	for i, c := range h.slots() {
+		if c == 0 {
+			continue
+		}
+		if seen+float64(c) >= target {
+			lo, hi := h.slotBounds(i)
+			us := lo + (hi-lo)*(target-seen)/float64(c)
+			return time.Duration(us * float64(time.Microsecond))
+		}
+		seen += float64(c)
+	}
+	_, hi := h.slotBounds(len(h.Buckets))
+	return time.Duration(hi * float64(time.Microsecond))
+}
+
+// slotBounds returns the range of slot i in microseconds. Slot 0 starts
+// at 0, and the open ended last one is taken to reach twice its lower
+// bound, which for log2 buckets is the next power of two.
+func (h *latencyHist) slotBounds(i int) (lo, hi float64) {
+	if i > 0 {
+		lo = float64(h.Buckets[i-1])
+	}
+	if i == len(h.Buckets) {
+		return lo, 2 * lo
+	}
+	return lo, float64(h.Buckets[i])
+}
+
+// drainHistograms reads and clears the kernel's histograms, which were
+// counted with the buckets of layout.
+// Counts added between the lookup and the delete of an entry are lost, a
+// small price for not needing a second map to swap with
+func drainHistograms(m *ebpf.Map, layout histLayout) ([]latencyHist, error) {
+	var hists []latencyHist
+	var keys []monitorHistKey
+
+	var key monitorHistKey
+	var value monitorHist
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		hists = append(hists, latencyHist{Kind: key.Kind, Raddr: key.Addr, Slots: value.Slots, Buckets: layout[key.Kind]})
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return hists, fmt.Errorf("iterating histograms: %w", err)
+	}
+
+	// Deleting while iterating a hash map restarts the iteration, so do it after
+	for _, k := range keys {
+		if err := m.Delete(k); err != nil {
+			return hists, fmt.Errorf("clearing histogram: %w", err)
+		}
+	}
+	return hists, nil
+}
+
+// histogramObserver is implemented by exporters that want the histograms
+// on top of the events, see observer
+type histogramObserver interface {
+	ObserveHistograms(hists []latencyHist)
+}
+
+// ProcessHistograms prints one summary line (or JSON object) per histogram
+func (p *EventProcessor) ProcessHistograms(hists []latencyHist) {
+	now := time.Now()
+	for i := range hists {
+		h := &hists[i]
+		n := h.count()
+		if n == 0 {
+			continue
+		}
+
+		if p.format == formatJSON {
+			b, _ := json.Marshal(&jsonLatency{
+				Timestamp: now.Format(time.RFC3339Nano),
+				Type:      "latency",
+				Kind:      histKindNames[h.Kind],
+				Daddr:     formatAddr(h.Raddr),
+				Count:     n,
+				P50Us:     h.percentile(0.50).Microseconds(),
+				P95Us:     h.percentile(0.95).Microseconds(),
+				P99Us:     h.percentile(0.99).Microseconds(),
+				BoundsUs:  h.Buckets,
+				Slots:     h.slots(),
+				Labels:    p.labels,
+			})
+			p.buffered.Write(append(b, '\n'))
+			continue
+		}
+
+		fmt.Fprintf(p.buffered, "[%s] Latency | %-7s | %s | n=%d | p50: %s | p95: %s | p99: %s\n",
+			now.Format("15:04:05"), histKindNames[h.Kind], formatAddr(h.Raddr), n,
+			h.percentile(0.50).Round(time.Microsecond),
+			h.percentile(0.95).Round(time.Microsecond),
+			h.percentile(0.99).Round(time.Microsecond))
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// --interface counts the TCP segments arriving on each interface given,
+// with prestack_tc on tc ingress or prestack_xdp in XDP, and again when
+// tcp_v4_rcv or tcp_v6_rcv get them (see prestack_stats in bpf/monitor.c).
+// The difference is what never reached the TCP stack: dropped by
+// netfilter, another tc or XDP program, a qdisc or IP's own checks, or
+// forwarded to another host. Nothing is sent per packet; /metrics, GET
+// /api/v1/interfaces and the exit report read the totals.
+
+const maxInterfaces = 64
+
+// --interface-hook
+const (
+	interfaceHookTC  = "tc"
+	interfaceHookXDP = "xdp"
+)
+
+type netInterface struct {
+	name  string
+	index int
+}
+
+// parseInterfaces turns --interface into interfaces of this network
+// namespace. The programs parse Ethernet frames, so lo, tun devices and
+// the like are refused.
+func parseInterfaces(names listFlag) ([]netInterface, error) {
+	if len(names) > maxInterfaces {
+		return nil, fmt.Errorf("at most %d interfaces", maxInterfaces)
+	}
+	var ifaces []netInterface
+	seen := make(map[int]bool)
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", name, err)
+		}
+		if len(iface.HardwareAddr) != 6 {
+			return nil, fmt.Errorf("interface %q isn't Ethernet", name)
+		}
+		if !seen[iface.Index] {
+			seen[iface.Index] = true
+			ifaces = append(ifaces, netInterface{name: iface.Name, index: iface.Index})
+		}
+	}
+	return ifaces, nil
+}
+
+// parseInterfaceHook checks --interface-hook
+func parseInterfaceHook(hook string) error {
+	if hook != interfaceHookTC && hook != interfaceHookXDP {
+		return fmt.Errorf("unknown hook %q, use: tc or xdp", hook)
+	}
+	return nil
+}
+
+// sizeInterfaces gives prestack_stats an entry per interface and turns
+// counting on. Like cgroup_stats it's per-CPU, so it stays at one entry
+// without --interface.
+func sizeInterfaces(spec *ebpf.CollectionSpec, n int) error {
+	m, ok := spec.Maps["prestack_stats"]
+	if !ok {
+		return errors.New("map prestack_stats not found in BPF object")
+	}
+	m.MaxEntries = uint32(n)
+	netns, ok := netnsInode("/proc/self/ns/net")
+	if !ok {
+		return errors.New("can't read the inode of this network namespace")
+	}
+	return setVariable(spec, "prestack_netns", netns)
+}
+
+// stubInterfaces swaps prestack_tc and prestack_xdp for programs that do
+// nothing without --interface: loading either needs CAP_NET_ADMIN, like
+// tcp_sockops, see stubSockOps
+func stubInterfaces(spec *ebpf.CollectionSpec) {
+	stubProgram(spec, "prestack_tc")
+	stubProgram(spec, "prestack_xdp")
+}
+
+// InterfaceCounters reads prestack_stats for the --interface list
+type InterfaceCounters struct {
+	stats  *ebpf.Map
+	ifaces []netInterface
+	hook   string // --interface-hook
+}
+
+// GET /api/v1/interfaces, one per --interface, totals since the monitor
+// started (or since the pinned map was created)
+type apiInterface struct {
+	Interface  string `json:"interface"`
+	Hook       string `json:"hook"`     // tc or xdp, where Segments were counted
+	Segments   uint64 `json:"segments"` // TCP segments that arrived
+	Bytes      uint64 `json:"bytes"`
+	ReachedTCP uint64 `json:"reached_tcp"`
+	Missing    uint64 `json:"missing"` // Segments that didn't reach TCP, see the Readme for what else ends up here
+	Truncated  uint64 `json:"truncated"`
+	BadHeader  uint64 `json:"bad_header"`
+	BadFlags   uint64 `json:"bad_flags"`
+	Syns       uint64 `json:"syns"` // SYNs without an ACK among Segments, what --syn-flood counts
+}
+
+// NewInterfaceCounters creates each interface's entry, the programs only
+// count into entries that are there. A pinned map keeps what it has.
+func NewInterfaceCounters(stats *ebpf.Map, ifaces []netInterface, hook string) (*InterfaceCounters, error) {
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return nil, err
+	}
+	zero := make([]monitorPrestackStats, cpus)
+	for _, iface := range ifaces {
+		err := stats.Update(uint32(iface.index), zero, ebpf.UpdateNoExist)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyExist) {
+			return nil, fmt.Errorf("adding interface %s: %w", iface.name, err)
+		}
+	}
+	return &InterfaceCounters{stats: stats, ifaces: ifaces, hook: hook}, nil
+}
+
+func (c *InterfaceCounters) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/interfaces", c.handleInterfaces)
+}
+
+// Read sums each interface's counters over the CPUs
+func (c *InterfaceCounters) Read() ([]apiInterface, error) {
+	all := make([]apiInterface, 0, len(c.ifaces))
+	var perCPU []monitorPrestackStats
+	for _, iface := range c.ifaces {
+		if err := c.stats.Lookup(uint32(iface.index), &perCPU); err != nil {
+			return nil, fmt.Errorf("reading interface %s: %w", iface.name, err)
+		}
+		a := apiInterface{Interface: iface.name, Hook: c.hook}
+		for _, s := range perCPU {
+			a.Segments += s.Segments
+			a.Bytes += s.Bytes
+			a.ReachedTCP += s.Reached
+			a.Truncated += s.Truncated
+			a.BadHeader += s.BadHeader
+			a.BadFlags += s.BadFlags
+			a.Syns += s.Syns
+		}
+		// Segments in flight between the two when read, or reaching TCP
+		// without passing the hook, can make it go the other way
+		if a.Segments > a.ReachedTCP {
+			a.Missing = a.Segments - a.ReachedTCP
+		}
+		all = append(all, a)
+	}
+	return all, nil
+}
+
+// Enrich names the interface of SYN flood events, the kernel only has
+// its index
+func (c *InterfaceCounters) Enrich(event *TcpEvent) {
+	if event.Type != eventSynFlood {
+		return
+	}
+	for _, iface := range c.ifaces {
+		if uint32(iface.index) == event.Ifindex {
+			event.Interface = iface.name
+			return
+		}
+	}
+}
+
+func (c *InterfaceCounters) handleInterfaces(w http.ResponseWriter, r *http.Request) {
+	all, err := c.Read()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, all)
+}
+
+// Report writes the totals at exit, e.g.
+//
+//	Interfaces (tc): eth0 12034 segments in (310 SYNs), 11990 reached TCP, 44 didn't (0 truncated, 0 bad headers, 12 bad flags)
+func (c *InterfaceCounters) Report(w io.Writer) {
+	all, err := c.Read()
+	if err != nil {
+		fmt.Fprintf(w, "Interfaces: %v\n", err)
+		return
+	}
+	parts := make([]string, len(all))
+	for i, a := range all {
+		parts[i] = fmt.Sprintf("%s %d segments in (%d SYNs), %d reached TCP, %d didn't (%d truncated, %d bad headers, %d bad flags)",
+			a.Interface, a.Segments, a.Syns, a.ReachedTCP, a.Missing, a.Truncated, a.BadHeader, a.BadFlags)
+	}
+	fmt.Fprintf(w, "Interfaces (%s): %s\n", c.hook, strings.Join(parts, "; "))
+}
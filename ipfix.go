@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// --ipfix exports closed connections as IPFIX (RFC 7011) flow records over
+// UDP, for collectors that already take NetFlow/IPFIX from routers. Each
+// close becomes two uniflow records, one per direction, since the lifetime
+// only has a byte count for each. There are no packet counts: the kernel
+// side never counts packets, only bytes.
+//
+// Connections that last are exported before they close too, like a
+// router's active timeout: every --ipfix-active-timeout a live connection
+// in the connection table gets records of the bytes since its last ones,
+// and its close then only has what's left. Live connections' byte counts
+// are taken with their RTT samples, so this needs the rtt probe, and
+// they're as of the last segment received, 100ms old at most while busy.
+
+// Messages are kept under this size, like statsdMaxPacket
+const ipfixMaxPacket = 1432
+
+// How often queued flows are sent, and how often the templates are sent
+// again for collectors that started after us (RFC 7011 section 10.3.6)
+const (
+	ipfixFlushInterval    = time.Second
+	ipfixTemplateInterval = time.Minute
+)
+
+// Flows waiting for the next flush, past this they are dropped and counted
+const ipfixMaxPending = 65536
+
+// Set IDs and the two template IDs, for IPv4 and IPv6 flows
+const (
+	ipfixVersion     = 10
+	ipfixTemplateSet = 2
+	ipfixTemplateV4  = 256
+	ipfixTemplateV6  = 257
+)
+
+// flowEndReason values, 0x02 active timeout and 0x03 end of flow
+// detected, and flowDirection values
+const (
+	ipfixActiveTimeout = 2
+	ipfixEndOfFlow     = 3
+	ipfixIngress       = 0
+	ipfixEgress        = 1
+)
+
+// ipfixField is a field specifier: an IANA information element and its length
+type ipfixField struct {
+	id, length uint16
+}
+
+// The information elements of both templates, the addresses aside
+var ipfixFlowFields = []ipfixField{
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{1, 8},   // octetDeltaCount
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+	{136, 1}, // flowEndReason
+	{61, 1},  // flowDirection
+}
+
+var ipfixTemplates = map[uint16][]ipfixField{
+	ipfixTemplateV4: append([]ipfixField{{8, 4}, {12, 4}}, ipfixFlowFields...),    // sourceIPv4Address, destinationIPv4Address
+	ipfixTemplateV6: append([]ipfixField{{27, 16}, {28, 16}}, ipfixFlowFields...), // sourceIPv6Address, destinationIPv6Address
+}
+
+// ipfixRecordSize is the length of one data record of template id
+func ipfixRecordSize(id uint16) int {
+	n := 0
+	for _, f := range ipfixTemplates[id] {
+		n += int(f.length)
+	}
+	return n
+}
+
+// ipfixFlow is one direction of a connection, closed or for as long as
+// the active timeout
+type ipfixFlow struct {
+	src, dst   netip.Addr
+	sport      uint16
+	dport      uint16
+	octets     uint64
+	start, end time.Time
+	direction  uint8
+	reason     uint8 // flowEndReason
+}
+
+// ipfixConn is a connection by its tuple, which close events have and conns' entries too
+type ipfixConn struct {
+	saddr, daddr [16]byte
+	sport, dport uint16
+}
+
+// ipfixExported is what a live connection's last records counted
+type ipfixExported struct {
+	sent, received uint64
+	at             time.Time
+	closed         bool // Its entry in conns can outlive the close briefly
+}
+
+func (f *ipfixFlow) template() uint16 {
+	if f.src.Is4() {
+		return ipfixTemplateV4
+	}
+	return ipfixTemplateV6
+}
+
+// IPFIXExporter queues the flows of closed connections and sends them to
+// the collector once a second, packed into as few messages as fit
+type IPFIXExporter struct {
+	conn   net.Conn
+	domain uint32 // --ipfix-domain, the observation domain ID
+
+	conns         *ebpf.Map     // Live connections, nil for closes only
+	activeTimeout time.Duration // --ipfix-active-timeout, 0 for closes only
+
+	mu       sync.Mutex // Observe runs on the processor goroutine, flush on its own
+	flows    []ipfixFlow
+	exported map[ipfixConn]*ipfixExported // Live connections exported before
+	dropped  atomic.Uint64                // Over ipfixMaxPending
+
+	// Only touched by flush
+	seq          uint32 // Data records sent so far, the header's sequence number
+	templateSent time.Time
+	reported     uint64
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func NewIPFIXExporter(addr string, domain uint32, conns *ebpf.Map, activeTimeout time.Duration) (*IPFIXExporter, error) {
+	conn, err := net.Dial("udp", withDefaultPort(addr, "4739"))
+	if err != nil {
+		return nil, err
+	}
+	e := &IPFIXExporter{
+		conn:          conn,
+		domain:        domain,
+		conns:         conns,
+		activeTimeout: activeTimeout,
+		exported:      make(map[ipfixConn]*ipfixExported),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go e.flusher()
+	return e, nil
+}
+
+// Observe turns a close into its two flows, the host's address as the
+// source of what it sent. A connection the active timeout exported before
+// only has the bytes since.
+func (e *IPFIXExporter) Observe(event *TcpEvent, p *EventProcessor) {
+	if event.Type != eventClose || event.Family == 0 {
+		return
+	}
+	end := time.Now()
+	start := end.Add(-time.Duration(event.DurationNs))
+	sent, received := event.BytesSent, event.BytesReceived
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if x := e.exported[ipfixConn{event.Saddr, event.Daddr, event.Sport, event.Dport}]; x != nil && !x.closed {
+		start, x.closed = x.at, true
+		sent -= min(sent, x.sent)
+		received -= min(received, x.received)
+	}
+	e.queue(event.Saddr, event.Daddr, event.Sport, event.Dport, sent, received, start, end, ipfixEndOfFlow)
+}
+
+// queue adds both directions of a connection, called with mu held
+func (e *IPFIXExporter) queue(saddr, daddr [16]byte, sport, dport uint16, sent, received uint64, start, end time.Time, reason uint8) {
+	local := netip.AddrFrom16(saddr).Unmap()
+	remote := netip.AddrFrom16(daddr).Unmap()
+	if local.Is4() != remote.Is4() {
+		return
+	}
+	if len(e.flows)+2 > ipfixMaxPending {
+		e.dropped.Add(1)
+		return
+	}
+	e.flows = append(e.flows,
+		ipfixFlow{local, remote, sport, dport, sent, start, end, ipfixEgress, reason},
+		ipfixFlow{remote, local, dport, sport, received, start, end, ipfixIngress, reason})
+}
+
+// exportActive queues the live connections whose last records, or their
+// start, are at least the active timeout ago, and forgets the ones that
+// are gone from the table
+func (e *IPFIXExporter) exportActive(now time.Time) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return
+	}
+	mono := uint64(ts.Nano()) // start_ns is bpf_ktime_get_ns()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	seen := make(map[ipfixConn]bool, len(e.exported))
+	var key uint64
+	var info monitorConnInfo
+	iter := e.conns.Iterate()
+	for iter.Next(&key, &info) {
+		if info.Dport == 0 || info.BytesAcked == 0 && info.BytesReceived == 0 {
+			continue // Not connected yet, or not sampled
+		}
+		k := ipfixConn{info.Saddr, info.Daddr, info.Sport, info.Dport}
+		seen[k] = true
+		x := e.exported[k]
+		if x == nil {
+			x = &ipfixExported{at: now.Add(-time.Duration(mono - min(mono, info.StartNs)))}
+			e.exported[k] = x
+		}
+		if x.closed || now.Sub(x.at) < e.activeTimeout {
+			continue
+		}
+		sent, received := info.BytesAcked-min(info.BytesAcked, x.sent), info.BytesReceived-min(info.BytesReceived, x.received)
+		e.queue(info.Saddr, info.Daddr, info.Sport, info.Dport, sent, received, x.at, now, ipfixActiveTimeout)
+		x.sent, x.received, x.at = info.BytesAcked, info.BytesReceived, now
+	}
+	if err := iter.Err(); err != nil {
+		slog.Warn("iterating connection table for IPFIX", "err", err)
+	}
+	for k := range e.exported {
+		if !seen[k] {
+			delete(e.exported, k)
+		}
+	}
+}
+
+func (e *IPFIXExporter) flusher() {
+	defer close(e.done)
+	ticker := time.NewTicker(ipfixFlushInterval)
+	defer ticker.Stop()
+	e.flush() // The templates, so the collector knows them before the first flow
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-e.quit:
+			e.flush()
+			return
+		}
+	}
+}
+
+// flush sends the templates when they're due and every queued flow
+func (e *IPFIXExporter) flush() {
+	if e.conns != nil && e.activeTimeout > 0 {
+		e.exportActive(time.Now())
+	}
+	e.mu.Lock()
+	flows := e.flows
+	e.flows = nil
+	e.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(e.templateSent) >= ipfixTemplateInterval {
+		e.send(e.templateMessage(now), 0)
+		e.templateSent = now
+	}
+
+	// One data set per message, so a message only holds flows of one family
+	var msg []byte
+	var records uint32
+	var tmpl uint16
+	for i := range flows {
+		f := &flows[i]
+		if msg != nil && (f.template() != tmpl || len(msg)+ipfixRecordSize(tmpl) > ipfixMaxPacket) {
+			e.send(msg, records)
+			msg = nil
+		}
+		if msg == nil {
+			tmpl, records = f.template(), 0
+			msg = e.header(now)
+			msg = binary.BigEndian.AppendUint16(msg, tmpl)
+			msg = binary.BigEndian.AppendUint16(msg, 0) // Set length, see send
+		}
+		msg = f.append(msg)
+		records++
+	}
+	if msg != nil {
+		e.send(msg, records)
+	}
+
+	if n := e.dropped.Load(); n > e.reported {
+		slog.Warn("connections not exported over IPFIX, too many queued", "connections", n-e.reported, "total", n)
+		e.reported = n
+	}
+}
+
+// header starts a message, the length and sequence number are set by send
+func (e *IPFIXExporter) header(now time.Time) []byte {
+	msg := make([]byte, 16, ipfixMaxPacket)
+	be := binary.BigEndian
+	be.PutUint16(msg[0:2], ipfixVersion)
+	be.PutUint32(msg[4:8], uint32(now.Unix()))
+	be.PutUint32(msg[12:16], e.domain)
+	return msg
+}
+
+// templateMessage is a template set with both templates
+func (e *IPFIXExporter) templateMessage(now time.Time) []byte {
+	be := binary.BigEndian
+	msg := e.header(now)
+	msg = be.AppendUint16(msg, ipfixTemplateSet)
+	msg = be.AppendUint16(msg, 0)
+	for _, id := range []uint16{ipfixTemplateV4, ipfixTemplateV6} {
+		msg = be.AppendUint16(msg, id)
+		msg = be.AppendUint16(msg, uint16(len(ipfixTemplates[id])))
+		for _, f := range ipfixTemplates[id] {
+			msg = be.AppendUint16(msg, f.id)
+			msg = be.AppendUint16(msg, f.length)
+		}
+	}
+	return msg
+}
+
+// send fills in the lengths and sequence number of msg, one message with a
+// single set holding records data records, and writes it
+func (e *IPFIXExporter) send(msg []byte, records uint32) {
+	be := binary.BigEndian
+	be.PutUint16(msg[2:4], uint16(len(msg)))
+	be.PutUint32(msg[8:12], e.seq)
+	be.PutUint16(msg[18:20], uint16(len(msg)-16))
+	e.seq += records
+	// UDP, a collector that's down is only noticed as ECONNREFUSED sometimes
+	if _, err := e.conn.Write(msg); err != nil {
+		slog.Warn("sending IPFIX flows", "err", err)
+	}
+}
+
+// append adds f as a data record of its template
+func (f *ipfixFlow) append(b []byte) []byte {
+	be := binary.BigEndian
+	if f.src.Is4() {
+		src, dst := f.src.As4(), f.dst.As4()
+		b = append(append(b, src[:]...), dst[:]...)
+	} else {
+		src, dst := f.src.As16(), f.dst.As16()
+		b = append(append(b, src[:]...), dst[:]...)
+	}
+	b = be.AppendUint16(b, f.sport)
+	b = be.AppendUint16(b, f.dport)
+	b = append(b, 6) // TCP
+	b = be.AppendUint64(b, f.octets)
+	b = be.AppendUint64(b, uint64(f.start.UnixMilli()))
+	b = be.AppendUint64(b, uint64(f.end.UnixMilli()))
+	b = append(b, f.reason, f.direction)
+	return b
+}
+
+// Close sends what's left and closes the socket
+func (e *IPFIXExporter) Close() {
+	close(e.quit)
+	<-e.done
+	e.conn.Close()
+}
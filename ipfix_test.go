@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// ipfixCollector receives the exporter's messages on a local UDP socket
+func ipfixCollector(t *testing.T) (*IPFIXExporter, func() []byte) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	// No flusher, the test calls flush itself
+	e := &IPFIXExporter{conn: conn, domain: 7}
+	return e, func() []byte {
+		t.Helper()
+		buf := make([]byte, 65536)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+}
+
+// ipfixSet checks a message's header and returns its one set
+func ipfixSet(t *testing.T, msg []byte, seq uint32) (uint16, []byte) {
+	t.Helper()
+	be := binary.BigEndian
+	if len(msg) < 20 {
+		t.Fatalf("message of %d bytes", len(msg))
+	}
+	if v, l, s, d := be.Uint16(msg[0:2]), be.Uint16(msg[2:4]), be.Uint32(msg[8:12]), be.Uint32(msg[12:16]); v != ipfixVersion || int(l) != len(msg) || s != seq || d != 7 {
+		t.Fatalf("header: version %d, length %d of %d, sequence %d (want %d), domain %d", v, l, len(msg), s, seq, d)
+	}
+	if l := be.Uint16(msg[18:20]); int(l) != len(msg)-16 {
+		t.Fatalf("set length %d, want %d", l, len(msg)-16)
+	}
+	return be.Uint16(msg[16:18]), msg[20:]
+}
+
+func TestIPFIXTemplates(t *testing.T) {
+	e, read := ipfixCollector(t)
+	e.flush()
+	id, set := ipfixSet(t, read(), 0)
+	if id != ipfixTemplateSet {
+		t.Fatalf("set %d, want the template set", id)
+	}
+	be := binary.BigEndian
+	for _, want := range []uint16{ipfixTemplateV4, ipfixTemplateV6} {
+		if len(set) < 4 {
+			t.Fatalf("template %d missing", want)
+		}
+		id, count := be.Uint16(set[0:2]), int(be.Uint16(set[2:4]))
+		set = set[4:]
+		if id != want || count != len(ipfixTemplates[want]) || len(set) < 4*count {
+			t.Fatalf("template %d with %d fields, want %d with %d", id, count, want, len(ipfixTemplates[want]))
+		}
+		for i, f := range ipfixTemplates[want] {
+			if got := (ipfixField{be.Uint16(set[4*i:]), be.Uint16(set[4*i+2:])}); got != f {
+				t.Errorf("template %d field %d: %+v, want %+v", id, i, got, f)
+			}
+		}
+		set = set[4*count:]
+	}
+	if len(set) != 0 {
+		t.Errorf("%d bytes after the templates", len(set))
+	}
+	if ipfixRecordSize(ipfixTemplateV4) != 39 || ipfixRecordSize(ipfixTemplateV6) != 63 {
+		t.Errorf("record sizes %d and %d, want 39 and 63", ipfixRecordSize(ipfixTemplateV4), ipfixRecordSize(ipfixTemplateV6))
+	}
+}
+
+func TestIPFIXRecords(t *testing.T) {
+	e, read := ipfixCollector(t)
+	e.templateSent = time.Now() // Only the data sets
+	closes := []TcpEvent{
+		{Type: eventClose, Family: afInet, Saddr: replayAddr("10.0.0.1"), Sport: 43210, Daddr: replayAddr("192.0.2.80"), Dport: 443,
+			BytesSent: 517, BytesReceived: 48213, DurationNs: uint64(2 * time.Second)},
+		{Type: eventClose, Family: afInet6, Saddr: replayAddr("2001:db8::1"), Sport: 5000, Daddr: replayAddr("2001:db8::2"), Dport: 22,
+			BytesSent: 1, BytesReceived: 2},
+		{Type: eventRetransmit, Family: afInet, Saddr: replayAddr("10.0.0.1"), Daddr: replayAddr("10.0.0.2")}, // Not exported
+	}
+	for i := range closes {
+		e.Observe(&closes[i], nil)
+	}
+	e.flush()
+
+	type record struct {
+		src, dst     netip.Addr
+		sport, dport uint16
+		octets       uint64
+		direction    uint8
+	}
+	want := [][]record{
+		{
+			{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.0.2.80"), 43210, 443, 517, ipfixEgress},
+			{netip.MustParseAddr("192.0.2.80"), netip.MustParseAddr("10.0.0.1"), 443, 43210, 48213, ipfixIngress},
+		},
+		{
+			{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), 5000, 22, 1, ipfixEgress},
+			{netip.MustParseAddr("2001:db8::2"), netip.MustParseAddr("2001:db8::1"), 22, 5000, 2, ipfixIngress},
+		},
+	}
+	be := binary.BigEndian
+	var seq uint32
+	for i, tmpl := range []uint16{ipfixTemplateV4, ipfixTemplateV6} {
+		id, set := ipfixSet(t, read(), seq)
+		if id != tmpl {
+			t.Fatalf("message %d: set %d, want %d", i, id, tmpl)
+		}
+		size := ipfixRecordSize(tmpl)
+		if len(set) != size*len(want[i]) {
+			t.Fatalf("message %d: %d bytes of records, want %d", i, len(set), size*len(want[i]))
+		}
+		alen := 4
+		if tmpl == ipfixTemplateV6 {
+			alen = 16
+		}
+		for j, w := range want[i] {
+			r := set[j*size : (j+1)*size]
+			src, _ := netip.AddrFromSlice(r[:alen])
+			dst, _ := netip.AddrFromSlice(r[alen : 2*alen])
+			r = r[2*alen:]
+			got := record{src, dst, be.Uint16(r[0:2]), be.Uint16(r[2:4]), be.Uint64(r[5:13]), r[30]}
+			if got != w {
+				t.Errorf("message %d record %d: %+v, want %+v", i, j, got, w)
+			}
+			if r[4] != 6 || r[29] != ipfixEndOfFlow {
+				t.Errorf("message %d record %d: protocol %d, end reason %d", i, j, r[4], r[29])
+			}
+			if start, end := be.Uint64(r[13:21]), be.Uint64(r[21:29]); end-start != uint64(closes[i].DurationNs/uint64(time.Millisecond)) {
+				t.Errorf("message %d record %d: lasted %dms, want %v", i, j, end-start, time.Duration(closes[i].DurationNs))
+			}
+		}
+		seq += uint32(len(want[i]))
+	}
+}
+
+// A close of a connection the active timeout exported only has the rest
+func TestIPFIXCloseAfterActive(t *testing.T) {
+	e, read := ipfixCollector(t)
+	e.templateSent = time.Now()
+	closed := TcpEvent{Type: eventClose, Family: afInet, Saddr: replayAddr("10.0.0.1"), Sport: 43210, Daddr: replayAddr("192.0.2.80"), Dport: 443,
+		BytesSent: 517, BytesReceived: 48213, DurationNs: uint64(time.Hour)}
+	last := time.Now().Add(-30 * time.Second).Truncate(time.Millisecond)
+	e.exported = map[ipfixConn]*ipfixExported{
+		{closed.Saddr, closed.Daddr, closed.Sport, closed.Dport}: {sent: 500, received: 48000, at: last},
+	}
+	e.Observe(&closed, nil)
+	e.Observe(&closed, nil) // Counted in full, the entry is for the closed connection
+	e.flush()
+
+	be := binary.BigEndian
+	_, set := ipfixSet(t, read(), 0)
+	size := ipfixRecordSize(ipfixTemplateV4)
+	if len(set) != 4*size {
+		t.Fatalf("%d bytes of records, want 4 records", len(set))
+	}
+	for i, want := range []uint64{17, 213, 517, 48213} {
+		r := set[i*size+8 : (i+1)*size]
+		if octets := be.Uint64(r[5:13]); octets != want {
+			t.Errorf("record %d: %d bytes, want %d", i, octets, want)
+		}
+		if start := int64(be.Uint64(r[13:21])); i < 2 && start != last.UnixMilli() {
+			t.Errorf("record %d: starts at %d, want the last export's %d", i, start, last.UnixMilli())
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources for --k8s
+const (
+	k8sKubelet   = "kubelet"
+	k8sAPIServer = "apiserver"
+)
+
+// In-cluster credentials mounted into every pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// PodInfo is the pod identity attached to events whose cgroup belongs to a pod
+type PodInfo struct {
+	Namespace string
+	Name      string
+	UID       string
+	Labels    map[string]string
+}
+
+// Both cgroup drivers put the pod UID in a path component:
+// cgroupfs: /kubepods/burstable/pod<uid>/<container>
+// systemd:  /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid_with_underscores>.slice/...
+var podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+func podUIDFromCgroup(path string) string {
+	m := podUIDPattern.FindStringSubmatch(path)
+	if m == nil {
+		return ""
+	}
+	return strings.ReplaceAll(m[1], "_", "-")
+}
+
+// K8sEnricher resolves an event's cgroup to the pod running in it. Pods on
+// this node are listed from the kubelet or the API server in the background,
+// so Enrich only ever reads from memory.
+type K8sEnricher struct {
+	cgroups *cgroupResolver
+	client  *http.Client
+	podsURL string
+
+	mu        sync.RWMutex
+	pods      map[string]*PodInfo // By UID
+	cgroupUID map[uint64]string   // Cgroup id -> pod UID, "" for cgroups outside any pod
+
+	kick chan struct{}
+}
+
+// NewK8sEnricher lists pods from source (kubelet or apiserver) and keeps the
+// list fresh. kubeletURL and insecure only apply to the kubelet source.
+func NewK8sEnricher(source, kubeletURL string, insecure bool, cgroups *cgroupResolver) (*K8sEnricher, error) {
+	k := &K8sEnricher{
+		cgroups:   cgroups,
+		pods:      make(map[string]*PodInfo),
+		cgroupUID: make(map[uint64]string),
+		kick:      make(chan struct{}, 1),
+	}
+	tlsConfig := &tls.Config{}
+
+	switch source {
+	case k8sKubelet:
+		// Kubelets usually serve a self-signed certificate
+		tlsConfig.InsecureSkipVerify = insecure
+		k.podsURL = strings.TrimSuffix(kubeletURL, "/") + "/pods"
+	case k8sAPIServer:
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("apiserver source needs to run in a pod (KUBERNETES_SERVICE_HOST is not set)")
+		}
+		ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return nil, fmt.Errorf("reading cluster CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+
+		// Only pods on this node can own the sockets we see
+		node := os.Getenv("NODE_NAME")
+		if node == "" {
+			node, _ = os.Hostname()
+		}
+		k.podsURL = "https://" + net.JoinHostPort(host, port) + "/api/v1/pods?fieldSelector=" +
+			url.QueryEscape("spec.nodeName="+node)
+	default:
+		return nil, fmt.Errorf("unknown source %q, use: %s or %s", source, k8sKubelet, k8sAPIServer)
+	}
+
+	k.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	go k.loop()
+	return k, nil
+}
+
+// Pod returns the pod owning cgroupID, nil if it isn't a (known) pod
+// Safe to call from any goroutine
+func (k *K8sEnricher) Pod(cgroupID uint64) *PodInfo {
+	k.mu.RLock()
+	uid, cached := k.cgroupUID[cgroupID]
+	pod := k.pods[uid]
+	k.mu.RUnlock()
+
+	if !cached {
+		path, ok := k.cgroups.Path(cgroupID)
+		if !ok {
+			return nil // Resolver has queued a rescan, we'll get it next time
+		}
+		uid = podUIDFromCgroup(path)
+
+		k.mu.Lock()
+		k.cgroupUID[cgroupID] = uid
+		pod = k.pods[uid]
+		k.mu.Unlock()
+	}
+
+	if uid != "" && pod == nil {
+		// Pod started after the last listing
+		select {
+		case k.kick <- struct{}{}:
+		default:
+		}
+	}
+	return pod
+}
+
+func (k *K8sEnricher) Enrich(event *TcpEvent) {
+	event.Pod = k.Pod(event.CgroupID)
+}
+
+func (k *K8sEnricher) loop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.kick:
+		}
+		if err := k.refresh(); err != nil {
+			slog.Warn("listing pods", "err", err)
+		}
+		time.Sleep(5 * time.Second) // Don't hammer the API for a burst of unknown pods
+	}
+}
+
+// Just the parts of a v1.PodList we use
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			UID       string            `json:"uid"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+	} `json:"items"`
+}
+
+func (k *K8sEnricher) refresh() error {
+	req, err := http.NewRequest(http.MethodGet, k.podsURL, nil)
+	if err != nil {
+		return err
+	}
+	// Re-read every time, projected service account tokens are rotated
+	if token, err := os.ReadFile(serviceAccountDir + "/token"); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", k.podsURL, resp.Status)
+	}
+
+	var list podList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("decoding pod list: %w", err)
+	}
+
+	pods := make(map[string]*PodInfo, len(list.Items))
+	for _, item := range list.Items {
+		m := item.Metadata
+		pods[m.UID] = &PodInfo{Namespace: m.Namespace, Name: m.Name, UID: m.UID, Labels: m.Labels}
+	}
+
+	k.mu.Lock()
+	k.pods = pods
+	// Forget cgroups of pods that are gone, their ids are never reused
+	for id, uid := range k.cgroupUID {
+		if uid != "" && pods[uid] == nil {
+			delete(k.cgroupUID, id)
+		}
+	}
+	k.mu.Unlock()
+	return nil
+}
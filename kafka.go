@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Events waiting for the producer; past this, new events are dropped
+// rather than holding up the pipeline while Kafka is slow or down
+const kafkaQueueSize = 10000
+
+// Partition keys for --kafka-key
+const (
+	kafkaKeyRemote = "raddr" // Events for one peer stay in order on one partition
+	kafkaKeyHost   = "host"  // Everything from this host in order
+	kafkaKeyNone   = "none"  // Spread evenly
+)
+
+// KafkaSink publishes every event to a Kafka topic (--kafka-brokers), as
+// JSON in the --format=json schema or as the Event message from
+// proto/tcpmon.proto. Observe only encodes and queues; one goroutine
+// collects batches and writes them, so a slow broker fills the queue
+// instead of pausing event processing, and what doesn't fit is counted
+// and dropped.
+type KafkaSink struct {
+	w            *kafka.Writer
+	topic        string
+	encoding     string // formatJSON or encodingProtobuf
+	key          string // kafkaKeyRemote etc.
+	host         string
+	batchSize    int
+	batchTimeout time.Duration
+
+	mu      sync.RWMutex // Write locked only by Close, so Observe never sends on a closed queue
+	closed  bool
+	queue   chan kafka.Message
+	dropped atomic.Uint64 // Queue full
+	failed  atomic.Uint64 // Written but rejected or timed out
+	lastErr error         // Why, only touched by run
+	done    chan struct{}
+
+	writeErr atomic.Pointer[error] // The last write's, nil once one worked, see Health
+}
+
+func NewKafkaSink(brokers []string, topic, encoding, key string, batchSize int, batchTimeout time.Duration) (*KafkaSink, error) {
+	if encoding != formatJSON && encoding != encodingProtobuf {
+		return nil, fmt.Errorf("unknown encoding %q, use: json or protobuf", encoding)
+	}
+	if key != kafkaKeyRemote && key != kafkaKeyHost && key != kafkaKeyNone {
+		return nil, fmt.Errorf("unknown key %q, use: %s, %s or %s", key, kafkaKeyRemote, kafkaKeyHost, kafkaKeyNone)
+	}
+	if batchSize <= 0 || batchTimeout <= 0 {
+		return nil, fmt.Errorf("batch size and timeout must be positive")
+	}
+
+	var balancer kafka.Balancer = &kafka.Hash{}
+	if key == kafkaKeyNone {
+		balancer = &kafka.RoundRobin{}
+	}
+	k := &KafkaSink{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     balancer,
+			BatchSize:    batchSize,
+			BatchTimeout: 10 * time.Millisecond, // run already waited for the batch to fill, don't wait again per partition
+			RequiredAcks: kafka.RequireOne,
+			Compression:  kafka.Snappy,
+		},
+		topic:        topic,
+		encoding:     encoding,
+		key:          key,
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+		queue:        make(chan kafka.Message, kafkaQueueSize),
+		done:         make(chan struct{}),
+	}
+	k.host, _ = os.Hostname()
+	go k.run()
+	return k, nil
+}
+
+func (k *KafkaSink) Observe(event *TcpEvent, p *EventProcessor) {
+	msg := kafka.Message{
+		Value: encodeEvent(event, p, k.encoding),
+		Headers: []kafka.Header{
+			{Key: "host", Value: []byte(k.host)},
+			{Key: "encoding", Value: []byte(k.encoding)},
+			{Key: "schema", Value: []byte(eventSchemaHeader)},
+		},
+	}
+	switch k.key {
+	case kafkaKeyRemote:
+		msg.Key = []byte(remoteAddr(event).String())
+	case kafkaKeyHost:
+		msg.Key = []byte(k.host)
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.closed {
+		return // The processor outlived the shutdown timeout
+	}
+	select {
+	case k.queue <- msg:
+	default:
+		k.dropped.Add(1)
+	}
+}
+
+// run writes batches of up to batchSize, or whatever arrived within
+// batchTimeout of the first one, until the queue is closed and drained
+func (k *KafkaSink) run() {
+	defer close(k.done)
+	warn := time.NewTicker(10 * time.Second)
+	defer warn.Stop()
+	var reported uint64
+
+	batch := make([]kafka.Message, 0, k.batchSize)
+	for {
+		select {
+		case msg, ok := <-k.queue:
+			if !ok {
+				return
+			}
+			batch = append(batch[:0], msg)
+			timeout := time.After(k.batchTimeout)
+		fill:
+			for len(batch) < k.batchSize {
+				select {
+				case msg, ok := <-k.queue:
+					if !ok {
+						break fill
+					}
+					batch = append(batch, msg)
+				case <-timeout:
+					break fill
+				}
+			}
+			k.write(batch)
+		case <-warn.C:
+			if n := k.dropped.Load() + k.failed.Load(); n > reported {
+				slog.Warn("events not delivered to Kafka so far", "events", n, "topic", k.topic,
+					"queue_full", k.dropped.Load(), "failed", k.failed.Load(), "last_err", k.lastErr)
+				reported = n
+			}
+		}
+	}
+}
+
+func (k *KafkaSink) write(batch []kafka.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := k.w.WriteMessages(ctx, batch...)
+	if err == nil {
+		k.writeErr.Store(nil)
+		return
+	}
+	k.writeErr.Store(&err)
+	// WriteErrors says which messages failed, anything else means all of them
+	failed := len(batch)
+	if werrs, ok := err.(kafka.WriteErrors); ok {
+		failed = werrs.Count()
+	}
+	k.failed.Add(uint64(failed))
+	k.lastErr = err // Reported every 10s by run, a broker that's down would fail every batch
+}
+
+// Health is for /readyz: whether the last batch reached the brokers
+func (k *KafkaSink) Health() error {
+	if err := k.writeErr.Load(); err != nil {
+		return fmt.Errorf("last write failed: %w", *err)
+	}
+	return nil
+}
+
+// Close writes what's still queued, giving up after a few seconds
+func (k *KafkaSink) Close() error {
+	k.mu.Lock()
+	k.closed = true
+	close(k.queue)
+	k.mu.Unlock()
+	select {
+	case <-k.done:
+	case <-time.After(5 * time.Second):
+		slog.Warn("gave up on events still queued for Kafka", "events", len(k.queue))
+	}
+	if n := k.dropped.Load() + k.failed.Load(); n > 0 {
+		slog.Warn("events were not delivered to Kafka", "events", n)
+	}
+	return k.w.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+)
+
+// The keepalive probe (trace_tcp_write_wakeup in bpf/monitor.c) reports
+// probes that went unanswered, and closes where keepalive gave up. How long
+// the peer has been silent is only in jiffies on the socket, which is why
+// the programs need CONFIG_HZ.
+
+// Keepalive event kinds, KEEPALIVE_* in bpf/monitor.c
+const (
+	keepaliveUnanswered = 1
+	keepaliveTimeout    = 2
+)
+
+// keepaliveNames are the reasons of keepalive events
+var keepaliveNames = map[uint32]string{
+	keepaliveUnanswered: "UNANSWERED",
+	keepaliveTimeout:    "TIMEOUT",
+}
+
+// Where distributions and the kernel itself put the config, like libbpf
+// looks for it
+func kernelConfigPaths() []string {
+	release := kernelRelease()
+	return []string{"/boot/config-" + release, "/proc/config.gz", "/lib/modules/" + release + "/config"}
+}
+
+// kernelHZ is CONFIG_HZ of the running kernel, 0 when there's no config to
+// read it from
+func kernelHZ() uint64 {
+	for _, path := range kernelConfigPaths() {
+		hz, err := readConfigHZ(path)
+		if err == nil && hz != 0 {
+			return hz
+		}
+	}
+	return 0
+}
+
+func readConfigHZ(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CONFIG_HZ="); ok {
+			return strconv.ParseUint(value, 10, 64)
+		}
+	}
+	return 0, scanner.Err()
+}
+
+// keepaliveJiffyNs is jiffy_ns: nanoseconds per jiffy, or 0 when the idle
+// time can't be worked out and keepalive events go without it
+func keepaliveJiffyNs() uint64 {
+	if err := features.HaveProgramHelper(ebpf.Kprobe, asm.FnJiffies64); err != nil {
+		slog.Info("kernel has no bpf_jiffies64, keepalive events won't have the idle time", "err", err)
+		return 0
+	}
+	hz := kernelHZ()
+	if hz == 0 {
+		slog.Info("no kernel config to read CONFIG_HZ from, keepalive events won't have the idle time", "tried", kernelConfigPaths())
+		return 0
+	}
+	return 1_000_000_000 / hz
+}
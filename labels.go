@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// --label adds the same key=value pairs to everything the monitor exports:
+// a labels object in JSON and the broker and gRPC messages, constant labels
+// on /metrics, resource attributes in OTLP and tags in StatsD. With one
+// monitor per cluster, that's what tells the clusters apart downstream.
+
+// Keys have to be valid Prometheus label names, which suits the other sinks too
+var labelKey = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseLabels turns the --label key=value pairs into a map. A key given
+// twice is an error rather than the last one winning.
+func parseLabels(pairs listFlag) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q isn't key=value", pair)
+		}
+		if !labelKey.MatchString(k) || strings.HasPrefix(k, "__") {
+			return nil, fmt.Errorf("label name %q must be letters, digits and underscores, not starting with a digit or __", k)
+		}
+		if _, dup := labels[k]; dup {
+			return nil, fmt.Errorf("label %q given twice", k)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// labelPairs is labels as key=value, sorted by key, for the config file
+// and StatsD
+func labelPairs(labels map[string]string, sep string) []string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+sep+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Drops and retransmits carry the index of the interface they happened on
+// and of the one the traffic came in on (set_skb_link and set_sock_link in
+// bpf/monitor.c), and drops the 802.1Q tag the packet still had. On a host
+// with bonds and VLANs that's what sets one bad bond member or VLAN apart
+// from the rest: linkResolver names the interfaces and says which VLAN,
+// bond or bridge each belongs to. Indexes are per network namespace, and
+// only the host's interfaces are named, other namespaces' events keep the
+// index next to their Netns.
+
+const (
+	vlanTagged = 0x10000 // VLAN_TAGGED in bpf/monitor.c
+	vlanIDMask = 0x0fff
+
+	vlanConfig = "/proc/net/vlan/config" // Only there with the 8021q module loaded, as it is with VLAN devices
+	sysNet     = "/sys/class/net"
+)
+
+// LinkInfo is where a drop or retransmit happened
+type LinkInfo struct {
+	Ifindex   uint32
+	Name      string // "" outside the host namespace, or when the interface is gone
+	Vlan      uint16 // The packet's tag or, without one, the VLAN Name is the device of
+	Lower     string // Of a VLAN device: the interface it's on
+	Master    string // The bond or bridge Name is a port of
+	InIfindex uint32 // Where the packet came in or the connection receives, 0 when that's Ifindex
+	InName    string
+}
+
+type linkAttrs struct {
+	name, lower, master string
+	vlan                uint16
+}
+
+// linkResolver names the host's interfaces by index. Like netnsResolver,
+// an index it doesn't know schedules a rescan instead of blocking, so the
+// first events of a new interface go without its name.
+type linkResolver struct {
+	host uint32 // The namespace the indexes are looked up in
+
+	mu    sync.RWMutex
+	links map[uint32]linkAttrs
+
+	kick chan struct{}
+}
+
+func newLinkResolver(host uint32) *linkResolver {
+	r := &linkResolver{host: host, kick: make(chan struct{}, 1)}
+	r.scan()
+	go r.loop()
+	return r
+}
+
+func (r *linkResolver) Enrich(event *TcpEvent) {
+	if event.Type != eventDrop && event.Type != eventRetransmit || event.Ifindex == 0 && event.Iif == 0 {
+		return
+	}
+	info := &LinkInfo{Ifindex: event.Ifindex}
+	if event.Iif != event.Ifindex {
+		info.InIfindex = event.Iif
+	}
+	if event.Netns == 0 || event.Netns == r.host {
+		if event.Ifindex != 0 {
+			l := r.link(event.Ifindex)
+			info.Name, info.Vlan, info.Lower, info.Master = l.name, l.vlan, l.lower, l.master
+		}
+		if info.InIfindex != 0 {
+			info.InName = r.link(info.InIfindex).name
+		}
+	}
+	if event.Vlan&vlanTagged != 0 {
+		info.Vlan = uint16(event.Vlan & vlanIDMask)
+	}
+	event.Link = info
+}
+
+func (r *linkResolver) link(ifindex uint32) linkAttrs {
+	r.mu.RLock()
+	l, ok := r.links[ifindex]
+	r.mu.RUnlock()
+	if !ok {
+		select {
+		case r.kick <- struct{}{}:
+		default: // A rescan is already pending
+		}
+	}
+	return l
+}
+
+func (r *linkResolver) loop() {
+	for range r.kick {
+		r.scan()
+		time.Sleep(5 * time.Second) // Interfaces come up with a burst of events, scan at most this often
+	}
+}
+
+// scan lists the interfaces, the VLAN devices' ids and what each is a
+// port of
+func (r *linkResolver) scan() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		slog.Warn("listing interfaces", "err", err)
+		return
+	}
+	vlans := readVlanConfig(vlanConfig)
+	links := make(map[uint32]linkAttrs, len(ifaces))
+	for _, iface := range ifaces {
+		l := linkAttrs{name: iface.Name}
+		if v, ok := vlans[iface.Name]; ok {
+			l.vlan, l.lower = v.vlan, v.lower
+		}
+		if master, err := os.Readlink(filepath.Join(sysNet, iface.Name, "master")); err == nil {
+			l.master = filepath.Base(master)
+		}
+		links[uint32(iface.Index)] = l
+	}
+	r.mu.Lock()
+	r.links = links
+	r.mu.Unlock()
+}
+
+// readVlanConfig reads the VLAN devices, by name, from lines like
+//
+//	bond0.100      | 100  | bond0
+//
+// after two header lines, nil without VLAN devices
+func readVlanConfig(path string) map[string]linkAttrs {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	vlans := make(map[string]linkAttrs)
+	s := bufio.NewScanner(f)
+	for line := 0; s.Scan(); line++ {
+		fields := strings.Split(s.Text(), "|")
+		if line < 2 || len(fields) != 3 {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 16)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSpace(fields[0])
+		vlans[name] = linkAttrs{name: name, vlan: uint16(id), lower: strings.TrimSpace(fields[2])}
+	}
+	return vlans
+}
+
+// linkName is an interface by name, or by index until it has one
+func linkName(ifindex uint32, name string) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("if%d", ifindex)
+}
+
+// linkLabel is the text output's, e.g. "bond0.100 (VLAN 100 on bond0)",
+// "eth1 (port of bond0)", "eth0 (VLAN 100), in via eth1"
+func linkLabel(l *LinkInfo) string {
+	var s string
+	if l.Ifindex != 0 {
+		s = linkName(l.Ifindex, l.Name)
+		var about []string
+		if l.Vlan != 0 {
+			vlan := "VLAN " + strconv.Itoa(int(l.Vlan))
+			if l.Lower != "" {
+				vlan += " on " + l.Lower
+			}
+			about = append(about, vlan)
+		}
+		if l.Master != "" {
+			about = append(about, "port of "+l.Master)
+		}
+		if len(about) > 0 {
+			s += " (" + strings.Join(about, ", ") + ")"
+		}
+	}
+	if l.InIfindex != 0 {
+		if s != "" {
+			s += ", "
+		}
+		s += "in via " + linkName(l.InIfindex, l.InName)
+	}
+	return s
+}
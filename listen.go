@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// listenDrop is one listening socket's row of the listen command: the
+// SYNs and handshakes it had no room for during the last interval
+type listenDrop struct {
+	Family     uint32
+	Addr       [16]byte
+	Port       uint16
+	Netns      uint32
+	NetnsName  string // Filled in after the drain, see netnsResolver
+	Inode      uint64
+	Pid        uint32 // The server, from listenOwners, 0 if it wasn't found
+	Comm       string
+	Backlog    uint32 // Accept queue length at the last drop
+	MaxBacklog uint32
+
+	SynQueueDrops    uint64
+	AcceptQueueDrops uint64
+}
+
+// drainListenDrops reads and clears the kernel's listen queue table, most
+// drops first. Like drainTop, drops counted between the lookup and the
+// delete of an entry are lost.
+func drainListenDrops(m *ebpf.Map) ([]listenDrop, error) {
+	var entries []listenDrop
+	var keys []uint64
+
+	var key uint64
+	var value monitorListenDropCount
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		entries = append(entries, listenDrop{
+			Family:           value.Family,
+			Addr:             value.Saddr,
+			Port:             value.Sport,
+			Netns:            value.Netns,
+			Inode:            value.Inode,
+			Backlog:          value.Backlog,
+			MaxBacklog:       value.MaxBacklog,
+			SynQueueDrops:    value.SynQueueDrops,
+			AcceptQueueDrops: value.AcceptQueueDrops,
+		})
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return entries, fmt.Errorf("iterating listen queue table: %w", err)
+	}
+	for _, k := range keys {
+		if err := m.Delete(k); err != nil {
+			return entries, fmt.Errorf("clearing listen queue table: %w", err)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].SynQueueDrops+entries[i].AcceptQueueDrops > entries[j].SynQueueDrops+entries[j].AcceptQueueDrops
+	})
+	return entries, nil
+}
+
+// listenObserver is implemented by observers that want the listen queue
+// drops each interval, like topObserver for the throughput table
+type listenObserver interface {
+	ObserveListenDrops(entries []listenDrop)
+}
+
+// listenOwners finds the server behind a listening socket by its inode,
+// the socket:[<inode>] link in /proc/<pid>/fd. Prefork servers share the
+// listener with their workers, the lowest PID is the one that opened it.
+// Listeners live long, so owners are cached and /proc is only walked again
+// when an inode it hasn't looked for shows up. Only used from the processor
+// goroutine.
+type listenOwners struct {
+	owners map[uint64]listenOwner
+}
+
+type listenOwner struct {
+	pid  uint32 // 0 when no process has it open, e.g. outside our PID namespace
+	comm string
+}
+
+const listenOwnersCacheSize = 4096
+
+func newListenOwners() *listenOwners {
+	return &listenOwners{owners: make(map[uint64]listenOwner)}
+}
+
+// Resolve fills in Pid and Comm of entries
+func (l *listenOwners) Resolve(entries []listenDrop) {
+	want := make(map[uint64]bool)
+	for _, e := range entries {
+		if _, ok := l.owners[e.Inode]; !ok && e.Inode != 0 {
+			want[e.Inode] = true
+		}
+	}
+	if len(want) > 0 {
+		if len(l.owners)+len(want) > listenOwnersCacheSize {
+			l.owners = make(map[uint64]listenOwner) // Listeners that are long gone, mostly
+		}
+		found := scanSocketOwners(want)
+		for inode := range want {
+			l.owners[inode] = found[inode] // Not found is cached too, it won't turn up later
+		}
+	}
+	for i := range entries {
+		owner := l.owners[entries[i].Inode]
+		entries[i].Pid, entries[i].Comm = owner.pid, owner.comm
+	}
+}
+
+// scanSocketOwners walks every process's fds for the wanted socket inodes
+func scanSocketOwners(want map[uint64]bool) map[uint64]listenOwner {
+	found := make(map[uint64]listenOwner)
+	procs, _ := os.ReadDir("/proc")
+	for _, p := range procs {
+		pid, err := strconv.ParseUint(p.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // Gone already, or a kernel thread
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(fdDir + "/" + fd.Name())
+			if err != nil {
+				continue
+			}
+			rest, ok := strings.CutPrefix(target, "socket:[")
+			if !ok {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(rest, "]"), 10, 64)
+			if err != nil || !want[inode] {
+				continue
+			}
+			if owner, seen := found[inode]; seen && owner.pid < uint32(pid) {
+				continue
+			}
+			comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+			found[inode] = listenOwner{pid: uint32(pid), comm: strings.TrimSpace(string(comm))}
+		}
+	}
+	return found
+}
+
+// Listen command rows with --format=json, one object per listener with
+// drops per interval
+type jsonListenDrop struct {
+	Timestamp        string `json:"timestamp"`
+	Type             string `json:"type"` // Always "listen_drop"
+	Pid              uint32 `json:"pid,omitempty"`
+	Comm             string `json:"comm,omitempty"`
+	Family           string `json:"family"`
+	Laddr            string `json:"laddr"`
+	Lport            uint16 `json:"lport"`
+	Netns            uint32 `json:"netns,omitempty"`
+	NetnsName        string `json:"netns_name,omitempty"`
+	Backlog          uint32 `json:"backlog"`
+	MaxBacklog       uint32 `json:"max_backlog"`
+	SynQueueDrops    uint64 `json:"syn_queue_drops"`
+	AcceptQueueDrops uint64 `json:"accept_queue_drops"`
+
+	Labels map[string]string `json:"labels,omitempty"` // --label
+}
+
+// PrintListenDrops writes the listeners that dropped anything in the last
+// interval. Quiet intervals print nothing, like --aggregate.
+func (p *EventProcessor) PrintListenDrops(entries []listenDrop) {
+	now := time.Now()
+	defer p.Flush()
+
+	if p.format == formatJSON {
+		ts := now.Format(time.RFC3339Nano)
+		for _, e := range entries {
+			b, _ := json.Marshal(&jsonListenDrop{
+				Timestamp: ts, Type: "listen_drop",
+				Pid: e.Pid, Comm: e.Comm, Family: familyNames[e.Family],
+				Laddr: formatAddr(e.Addr), Lport: e.Port,
+				Netns: e.Netns, NetnsName: e.NetnsName,
+				Backlog: e.Backlog, MaxBacklog: e.MaxBacklog,
+				SynQueueDrops: e.SynQueueDrops, AcceptQueueDrops: e.AcceptQueueDrops,
+				Labels: p.labels,
+			})
+			p.buffered.Write(append(b, '\n'))
+		}
+		return
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+	if len(entries) > aggregateRows {
+		entries = entries[:aggregateRows]
+	}
+	fmt.Fprintf(p.buffered, "\n%s\n%10s %10s  %-9s %-7s %-16s %-47s %s\n", now.Format("15:04:05"),
+		"SYN_Q", "ACCEPT_Q", "BACKLOG", "PID", "COMM", "LADDR", "NETNS")
+	for _, e := range entries {
+		pid, comm := "-", "-"
+		if e.Pid != 0 {
+			pid, comm = strconv.Itoa(int(e.Pid)), e.Comm
+		}
+		fmt.Fprintf(p.buffered, "%10d %10d  %-9s %-7s %-16s %-47s %s\n",
+			e.SynQueueDrops, e.AcceptQueueDrops, fmt.Sprintf("%d/%d", e.Backlog, e.MaxBacklog),
+			pid, comm, formatEndpoint(e.Addr, e.Port), netnsLabel(e.Netns, e.NetnsName))
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The listeners probe (inet_listen, inet_bind, inet6_bind and tcp_close in
+// bpf/monitor.c) reports the server side's lifecycle next to the listen
+// command's queue drops: sockets starting to listen and with what backlog,
+// listeners closing with connections nobody accepted, and the bind() and
+// listen() calls that failed, with the errno and whoever made them.
+// ListenerInventory keeps what's listening from those, seeded with the
+// listeners that were there before the monitor, and the latest failures
+// with who was holding the address.
+
+// Listen event kinds, LISTEN_* in bpf/monitor.c and a listen event's Direction
+const (
+	listenStarted = 1
+	listenFailed  = 2
+	bindFailed    = 3
+	listenClosed  = 4
+)
+
+var listenKinds = map[uint32]string{
+	listenStarted: "started",
+	listenFailed:  "listen_failed",
+	bindFailed:    "bind_failed",
+	listenClosed:  "closed",
+}
+
+const (
+	listenersMax        = 4096 // Tracked at once, closed ones make room first
+	listenFailuresKept  = 64
+	listenersReportRows = 20 // Shown at exit by the listen command
+)
+
+// listenWhat is the text output's name for a listen event
+func listenWhat(event *TcpEvent) string {
+	switch event.Direction {
+	case listenFailed:
+		return "Listen failed"
+	case bindFailed:
+		return "Bind failed"
+	case listenClosed:
+		return "Listener closed"
+	}
+	if event.OldState == tcpListen {
+		return "Backlog changed"
+	}
+	return "Listening"
+}
+
+// listenDetail is the rest of its line, e.g. "Backlog: 4096 (net.core.somaxconn)"
+// or "Error: EADDRINUSE"
+func listenDetail(event *TcpEvent) string {
+	switch event.Direction {
+	case listenFailed, bindFailed:
+		return "Error: " + errnoName(event.Reason)
+	case listenClosed:
+		if event.AcceptQueue == 0 {
+			return fmt.Sprintf("Backlog: %d", event.Backlog)
+		}
+		return fmt.Sprintf("Backlog: %d | Unaccepted: %d (reset)", event.Backlog, event.AcceptQueue)
+	}
+	return "Backlog: " + listenBacklog(event.Backlog, event.Somaxconn)
+}
+
+// listenBacklog says when a backlog is the somaxconn cap, which may be
+// less than what the server asked for
+func listenBacklog(backlog, somaxconn uint32) string {
+	if somaxconn != 0 && backlog == somaxconn {
+		return strconv.FormatUint(uint64(backlog), 10) + " (net.core.somaxconn)"
+	}
+	return strconv.FormatUint(uint64(backlog), 10)
+}
+
+// listenErrorCall is the failed call of a failure, bind or listen
+func listenErrorCall(event *TcpEvent) string {
+	if event.Direction == bindFailed {
+		return "bind"
+	}
+	return "listen"
+}
+
+// Listeners are told apart by namespace and address; SO_REUSEPORT
+// listeners on the same one are counted together in sockets
+type listenerKey struct {
+	netns uint32
+	addr  netip.AddrPort
+}
+
+type listener struct {
+	pid        uint32
+	comm       string
+	backlog    uint32
+	somaxconn  uint32 // 0 for listeners seeded from the socket table
+	sockets    int
+	since      time.Time // Zero for ones seeded, they were there before the monitor
+	closed     time.Time // Zero while listening
+	unaccepted uint64    // Connections reset with its sockets as they closed
+	failures   uint64    // Failed bind() and listen() calls on its port
+}
+
+type ListenerInventory struct {
+	mu        sync.Mutex // Observe runs on the processor goroutine, readers on their own
+	listeners map[listenerKey]*listener
+	failures  []apiListenFailure // Oldest first
+}
+
+// GET /api/v1/listeners
+type apiListeners struct {
+	Listeners []apiListener      `json:"listeners"` // Listening ones first, then by address
+	Failures  []apiListenFailure `json:"failures"`  // The latest, oldest first
+}
+
+type apiListener struct {
+	Laddr      string     `json:"laddr"`
+	Lport      uint16     `json:"lport"`
+	Netns      uint32     `json:"netns,omitempty"`
+	Pid        uint32     `json:"pid,omitempty"`
+	Comm       string     `json:"comm,omitempty"`
+	Backlog    uint32     `json:"backlog"`
+	Somaxconn  uint32     `json:"somaxconn,omitempty"`
+	Sockets    int        `json:"sockets"`         // More than 1 with SO_REUSEPORT
+	Since      *time.Time `json:"since,omitempty"` // Unset for listeners that were there before the monitor
+	Closed     *time.Time `json:"closed,omitempty"`
+	Unaccepted uint64     `json:"unaccepted"`
+	Failures   uint64     `json:"failures"`
+}
+
+type apiListenFailure struct {
+	Time       time.Time `json:"time"`
+	Call       string    `json:"call"` // bind or listen
+	Laddr      string    `json:"laddr"`
+	Lport      uint16    `json:"lport"`
+	Netns      uint32    `json:"netns,omitempty"`
+	Pid        uint32    `json:"pid"`
+	Comm       string    `json:"comm"`
+	Error      string    `json:"error"`                 // e.g. EADDRINUSE
+	HolderPid  uint32    `json:"holder_pid,omitempty"`  // Who was listening on the port then, if anyone we know of
+	HolderComm string    `json:"holder_comm,omitempty"` // was
+}
+
+func NewListenerInventory() *ListenerInventory {
+	return &ListenerInventory{listeners: make(map[listenerKey]*listener)}
+}
+
+// Seed adds the listeners in our network namespace from the socket table,
+// the iterator snapshot uses, and finds their servers in /proc
+func (l *ListenerInventory) Seed() error {
+	sockets, err := dumpSockets()
+	if err != nil {
+		return err
+	}
+	want := make(map[uint64]bool)
+	for _, s := range sockets {
+		if s.State == tcpListen && s.Inode != 0 {
+			want[s.Inode] = true
+		}
+	}
+	owners := scanSocketOwners(want)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range sockets {
+		if s.State != tcpListen {
+			continue
+		}
+		k := listenerKey{netns: s.Netns, addr: addrPort(s.Saddr, s.Sport)}
+		if _, ok := l.listeners[k]; !ok && len(l.listeners) >= listenersMax {
+			break
+		}
+		ln := l.listener(k)
+		if owner := owners[s.Inode]; owner.pid != 0 && (ln.pid == 0 || owner.pid < ln.pid) {
+			ln.pid, ln.comm = owner.pid, owner.comm
+		}
+		ln.backlog = s.TxQueue // ss's Send-Q, the backlog for listeners
+		ln.sockets++
+	}
+	return nil
+}
+
+func (l *ListenerInventory) Observe(event *TcpEvent, p *EventProcessor) {
+	if event.Type != eventListen {
+		return
+	}
+	k := listenerKey{netns: event.Netns, addr: addrPort(event.Saddr, event.Sport)}
+	now := event.when()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch event.Direction {
+	case listenStarted:
+		ln := l.listener(k)
+		if !ln.closed.IsZero() {
+			*ln = listener{}
+		}
+		if event.OldState != tcpListen {
+			ln.sockets++
+		}
+		if ln.since.IsZero() {
+			ln.since = now
+		}
+		ln.pid, ln.comm = event.Pid, commString(event.Comm[:])
+		ln.backlog, ln.somaxconn = event.Backlog, event.Somaxconn
+	case listenClosed:
+		ln, ok := l.listeners[k]
+		if !ok || !ln.closed.IsZero() {
+			return // Opened before the monitor, in a namespace it didn't seed from
+		}
+		ln.unaccepted += uint64(event.AcceptQueue)
+		if ln.sockets--; ln.sockets <= 0 {
+			ln.sockets = 0
+			ln.closed = now
+		}
+	case listenFailed, bindFailed:
+		f := apiListenFailure{
+			Time:  now,
+			Call:  listenErrorCall(event),
+			Laddr: k.addr.Addr().String(),
+			Lport: event.Sport,
+			Netns: event.Netns,
+			Pid:   event.Pid,
+			Comm:  commString(event.Comm[:]),
+			Error: errnoName(event.Reason),
+		}
+		if ln := l.holder(k); ln != nil {
+			f.HolderPid, f.HolderComm = ln.pid, ln.comm
+			ln.failures++
+		}
+		if len(l.failures) >= listenFailuresKept {
+			l.failures = append(l.failures[:0], l.failures[1:]...)
+		}
+		l.failures = append(l.failures, f)
+	}
+}
+
+func (l *ListenerInventory) listener(k listenerKey) *listener {
+	if ln, ok := l.listeners[k]; ok {
+		return ln
+	}
+	if len(l.listeners) >= listenersMax {
+		l.evict()
+	}
+	ln := &listener{}
+	l.listeners[k] = ln
+	return ln
+}
+
+// evict makes room by forgetting the listener closed longest ago, or
+// without one, one listening since longest ago
+func (l *ListenerInventory) evict() {
+	var oldest listenerKey
+	var oldestListener *listener
+	for k, ln := range l.listeners {
+		closed, oldestClosed := !ln.closed.IsZero(), oldestListener != nil && !oldestListener.closed.IsZero()
+		if oldestListener == nil || closed && !oldestClosed ||
+			closed && oldestClosed && ln.closed.Before(oldestListener.closed) ||
+			!closed && !oldestClosed && ln.since.Before(oldestListener.since) {
+			oldest, oldestListener = k, ln
+		}
+	}
+	delete(l.listeners, oldest)
+}
+
+// holder is the open listener a failed call on k ran into: the one on k,
+// or another on its port in the namespace, as a wildcard address overlaps
+// every other
+func (l *ListenerInventory) holder(k listenerKey) *listener {
+	if ln, ok := l.listeners[k]; ok && ln.closed.IsZero() {
+		return ln
+	}
+	for other, ln := range l.listeners {
+		if other.netns == k.netns && other.addr.Port() == k.addr.Port() && ln.closed.IsZero() {
+			return ln
+		}
+	}
+	return nil
+}
+
+// Listeners is every listener tracked, listening ones first, then by
+// namespace, port and address, and the latest failures
+func (l *ListenerInventory) Listeners() apiListeners {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := apiListeners{
+		Listeners: make([]apiListener, 0, len(l.listeners)),
+		Failures:  append([]apiListenFailure{}, l.failures...),
+	}
+	for k, ln := range l.listeners {
+		a := apiListener{
+			Laddr:      k.addr.Addr().String(),
+			Lport:      k.addr.Port(),
+			Netns:      k.netns,
+			Pid:        ln.pid,
+			Comm:       ln.comm,
+			Backlog:    ln.backlog,
+			Somaxconn:  ln.somaxconn,
+			Sockets:    ln.sockets,
+			Unaccepted: ln.unaccepted,
+			Failures:   ln.failures,
+		}
+		if !ln.since.IsZero() {
+			since := ln.since
+			a.Since = &since
+		}
+		if !ln.closed.IsZero() {
+			closed := ln.closed
+			a.Closed = &closed
+		}
+		out.Listeners = append(out.Listeners, a)
+	}
+	sort.Slice(out.Listeners, func(i, j int) bool {
+		a, b := out.Listeners[i], out.Listeners[j]
+		if (a.Closed == nil) != (b.Closed == nil) {
+			return a.Closed == nil
+		}
+		if a.Netns != b.Netns {
+			return a.Netns < b.Netns
+		}
+		if a.Lport != b.Lport {
+			return a.Lport < b.Lport
+		}
+		return a.Laddr < b.Laddr
+	})
+	return out
+}
+
+func (l *ListenerInventory) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/listeners", l.handleListeners)
+}
+
+func (l *ListenerInventory) handleListeners(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, l.Listeners())
+}
+
+// Report writes what's listening and the latest failures, e.g.
+//
+//	Listeners (3 listening, 1 closed):
+//	  0.0.0.0:443            nginx        PID 812    backlog 511     4 sockets
+//	  127.0.0.1:5432         postgres     PID 990    backlog 244
+//	  [::]:8080              java         PID 4242   backlog 4096 (net.core.somaxconn)
+//	  0.0.0.0:9000           worker       PID 5120   closed 10:02:11, 12 unaccepted
+//	Failed binds and listens:
+//	  10:02:14 bind   0.0.0.0:443            PID 5301   nginx        EADDRINUSE (held by nginx PID 812)
+func (l *ListenerInventory) Report(w io.Writer, n int) {
+	all := l.Listeners()
+	if len(all.Listeners) == 0 && len(all.Failures) == 0 {
+		return
+	}
+	var listening int
+	for _, ln := range all.Listeners {
+		if ln.Closed == nil {
+			listening++
+		}
+	}
+	fmt.Fprintf(w, "\nListeners (%d listening, %d closed):\n", listening, len(all.Listeners)-listening)
+	if len(all.Listeners) > n {
+		all.Listeners = all.Listeners[:n]
+	}
+	for _, ln := range all.Listeners {
+		addr := netip.AddrPortFrom(netip.MustParseAddr(ln.Laddr), ln.Lport).String()
+		state := "backlog " + listenBacklog(ln.Backlog, ln.Somaxconn)
+		if ln.Sockets > 1 {
+			state += fmt.Sprintf(" %5d sockets", ln.Sockets)
+		}
+		if ln.Closed != nil {
+			state = fmt.Sprintf("closed %s, %d unaccepted", ln.Closed.Format("15:04:05"), ln.Unaccepted)
+		}
+		fmt.Fprintf(w, "  %-22s %-12s PID %-6d %s\n", addr, ln.Comm, ln.Pid, state)
+	}
+	if len(all.Failures) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Failed binds and listens:\n")
+	for _, f := range all.Failures {
+		addr := netip.AddrPortFrom(netip.MustParseAddr(f.Laddr), f.Lport).String()
+		var holder string
+		if f.HolderPid != 0 {
+			holder = fmt.Sprintf(" (held by %s PID %d)", f.HolderComm, f.HolderPid)
+		}
+		fmt.Fprintf(w, "  %s %-6s %-22s PID %-6d %-12s %s%s\n",
+			f.Time.Format("15:04:05"), f.Call, addr, f.Pid, f.Comm, f.Error, holder)
+	}
+}
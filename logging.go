@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logWriter is where log records go, stderr unless the dashboard holds
+// them back while it owns the terminal
+type logWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func (l *logWriter) SetOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w = w
+}
+
+var logOutput = &logWriter{w: os.Stderr}
+
+// setupLogging makes slog, and the log package the libraries use, write
+// records of at least level as key=value text or JSON lines. Under
+// journald (journal set) the time is left to it and each line gets a
+// priority instead.
+func setupLogging(level, format string, journal bool) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid --log-level %q, use: debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	if journal {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	var newHandler func(io.Writer) slog.Handler
+	switch strings.ToLower(format) {
+	case logFormatText:
+		newHandler = func(w io.Writer) slog.Handler { return slog.NewTextHandler(w, opts) }
+	case logFormatJSON:
+		newHandler = func(w io.Writer) slog.Handler { return slog.NewJSONHandler(w, opts) }
+	default:
+		return fmt.Errorf("invalid --log-format %q, use: text or json", format)
+	}
+
+	var h slog.Handler
+	if journal {
+		h = newJournalHandler(logOutput, newHandler)
+	} else {
+		h = newHandler(logOutput)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// logVerifierError logs the verifier's whole log at debug level when err
+// is a rejected program. The error itself only ends with its last lines.
+func logVerifierError(err error) {
+	var ve *ebpf.VerifierError
+	if errors.As(err, &ve) {
+		slog.Debug("verifier log", "log", fmt.Sprintf("%+v", ve))
+	}
+}
+
+var (
+	fatalMu    sync.Mutex
+	fatalHooks []func()
+)
+
+// atFatal has fatal call fn before it logs and exits, the last added
+// first, for what a deferred call would undo: os.Exit skips those
+func atFatal(fn func()) {
+	fatalMu.Lock()
+	defer fatalMu.Unlock()
+	fatalHooks = append(fatalHooks, fn)
+}
+
+// fatal logs msg with args at error level and exits, for errors the
+// monitor can't run with
+func fatal(msg string, args ...any) {
+	fatalMu.Lock()
+	hooks := fatalHooks
+	fatalHooks = nil
+	fatalMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bufio" //Allows code to store large chunks of data in RAM
-	"errors"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"io" // Basic interfaces for i/o primitives
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip" // Formatting the raw address bytes from retransmit events
 	"os"        // Platform independent interface for calling os functionalities
 	"os/signal" // Listen for Ctrl+C
 	"runtime"   // Used here for MemStats
@@ -15,11 +20,9 @@ import (
 	"sync/atomic" // Uses locks for atomic updates to counters
 	"syscall"
 	"time"
-	"unsafe" // unsafe type casting of raw byte slice to monitorEvent struct
 
-	"github.com/cilium/ebpf/link" // Handles attaching compiled EBPF program to hook
-	"github.com/cilium/ebpf/ringbuf"
-	"github.com/cilium/ebpf/rlimit" // To remove the memory lock limit
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
 )
 
 // Metrics Tracking
@@ -35,7 +38,23 @@ func NewMetrics() *Metrics {
 	return &Metrics{StartTime: time.Now()}
 }
 
-func (m *Metrics) Report() {
+// warnLost logs whenever events were lost in the last interval, so a
+// monitor that can't keep up doesn't go unnoticed
+func warnLost(lost func() uint64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last uint64
+	for range ticker.C {
+		current := lost()
+		if current > last {
+			slog.Warn("events lost, the buffer was full", "lost", current-last, "interval", interval, "total", current)
+		}
+		last = current
+	}
+}
+
+func (m *Metrics) Report(lost func() uint64, queue *eventQueue) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
@@ -53,10 +72,12 @@ func (m *Metrics) Report() {
 		runtime.ReadMemStats(&mem)
 
 		// Print to stderr so it doesn't interfere with stdout redirection
-		fmt.Fprintf(os.Stderr, "[%s] Rate: %8.0f ev/s | Total: %10d | Mem: %5.1f MB\n",
+		fmt.Fprintf(os.Stderr, "[%s] Rate: %8.0f ev/s | Total: %10d | Lost: %8d | Queued: %5d | Mem: %5.1f MB\n",
 			now.Format("15:04:05"),
 			eps,
 			current,
+			lost(),
+			queue.Depth(),
 			float64(mem.Alloc)/1024/1024)
 
 		lastCount = current
@@ -64,7 +85,10 @@ func (m *Metrics) Report() {
 	}
 }
 
-func (m *Metrics) FinalReport(modeName string) {
+// sampled is what the kernel saw before --sample thinned it out, 0 without
+// it, suppressed what --conn-limit held back, dropped what the queue to the
+// processor had no room for
+func (m *Metrics) FinalReport(modeName string, lost, sampled, suppressed, dropped uint64) {
 	elapsed := time.Since(m.StartTime).Seconds()
 	read := m.EventsRead.Load()
 	printed := m.EventsPrinted.Load()
@@ -78,6 +102,16 @@ func (m *Metrics) FinalReport(modeName string) {
 	fmt.Fprintln(os.Stderr, "╠══════════════════════════════════════════════════════════════════════╣")
 	fmt.Fprintf(os.Stderr, "║ Duration:           %8.2f seconds                                   ║\n", elapsed)
 	fmt.Fprintf(os.Stderr, "║ Events Read:        %8d                                           ║\n", read)
+	fmt.Fprintf(os.Stderr, "║ Events Lost:        %8d                                           ║\n", lost)
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "║ Events Dropped:     %8d (queue full)                              ║\n", dropped)
+	}
+	if sampled > 0 {
+		fmt.Fprintf(os.Stderr, "║ Events Sampled:     %8d (before --sample)                         ║\n", sampled)
+	}
+	if suppressed > 0 {
+		fmt.Fprintf(os.Stderr, "║ Events Suppressed:  %8d (--conn-limit)                            ║\n", suppressed)
+	}
 
 	if printed > 0 {
 		fmt.Fprintf(os.Stderr, "║ Events Printed:     %8d                                           ║\n", printed)
@@ -112,11 +146,12 @@ var symbolList []Symbol
 func loadSymbols() {
 	file, err := os.Open("/proc/kallsyms")
 	if err != nil {
-		log.Printf("Warning: could not open kallsyms: %v", err)
+		slog.Warn("opening kallsyms", "err", err)
 		return
 	}
 	defer file.Close()
 
+	hidden := true
 	scanner := bufio.NewScanner(file) // Reads file line by line
 	for scanner.Scan() {
 		fields := strings.Fields(scanner.Text())
@@ -124,14 +159,21 @@ func loadSymbols() {
 			continue
 		}
 		addr, _ := strconv.ParseUint(fields[0], 16, 64)
+		hidden = hidden && addr == 0
 		symbolList = append(symbolList, Symbol{Addr: addr, Name: fields[2]})
 	}
+	if hidden {
+		// kptr_restrict zeroes them without CAP_SYSLOG, or for everyone at 2
+		slog.Warn("kernel symbol addresses are hidden, drop locations are shown as addresses", "hint", "needs CAP_SYSLOG and kernel.kptr_restrict below 2")
+		symbolList = nil
+		return
+	}
 
 	sort.Slice(symbolList, func(i, j int) bool {
 		return symbolList[i].Addr < symbolList[j].Addr
 	})
 
-	fmt.Fprintf(os.Stderr, "Loaded %d kernel symbols\n", len(symbolList))
+	slog.Debug("loaded kernel symbols", "symbols", len(symbolList))
 }
 
 func findNearestSymbol(addr uint64) string {
@@ -151,53 +193,381 @@ func findNearestSymbol(addr uint64) string {
 
 // Event Processing
 
+// Must match the EVENT_* defines in bpf/monitor.c
+const (
+	eventDrop       = 1
+	eventRetransmit = 2
+	eventState      = 3
+	eventClose      = 4
+	eventConnect    = 5
+	eventReset      = 6
+	eventZeroWindow = 7
+	eventUDPError   = 8
+	eventICMPError  = 9
+	eventDSACK      = 10
+	eventKeepalive  = 11
+	eventFastOpen   = 12
+	eventBuffer     = 13
+	eventTLS        = 14
+	eventSynFlood   = 15
+	eventBlocked    = 16
+	eventSockopt    = 17
+	eventListen     = 18
+)
+
 type EventProcessor struct {
 	writer      io.Writer
 	buffered    *bufio.Writer
 	metrics     *Metrics
-	dropReasons map[uint32]string
+	format      string            // formatText or formatJSON
+	labels      map[string]string // --label, added to every JSON object
+	dropReasons map[uint32]string // See dropreasons.go
+	rstReasons  map[uint32]string
+	tcpStates   map[uint32]string
 }
 
-func NewEventProcessor(output io.Writer, metrics *Metrics) *EventProcessor {
+func NewEventProcessor(output io.Writer, metrics *Metrics, format string, labels map[string]string, reasons *dropReasons) *EventProcessor {
 	return &EventProcessor{
-		writer:   output,
-		buffered: bufio.NewWriterSize(output, 256*1024), // 256KB buffer
-		metrics:  metrics,
-		dropReasons: map[uint32]string{
-			2:  "NOT_SPECIFIED",
-			3:  "NO_SOCKET",
-			5:  "TCP_CSUM",
-			8:  "NETFILTER_DROP",
-			21: "TCP_LISTEN_OVERFLOW",
-			64: "TCP_RETRANSMIT",
-		},
+		writer:      output,
+		buffered:    bufio.NewWriterSize(output, 256*1024), // 256KB buffer
+		metrics:     metrics,
+		format:      format,
+		labels:      labels,
+		dropReasons: reasons.names,
+		rstReasons:  reasons.resets,
+		tcpStates:   tcpStateNames,
 	}
 }
 
-func (p *EventProcessor) ProcessEvent(event *monitorEvent, doPrint bool) {
-	p.metrics.EventsRead.Add(1)
+var tcpStateNames = map[uint32]string{ // include/net/tcp_states.h
+	1:  "ESTABLISHED",
+	2:  "SYN_SENT",
+	3:  "SYN_RECV",
+	4:  "FIN_WAIT1",
+	5:  "FIN_WAIT2",
+	6:  "TIME_WAIT",
+	7:  "CLOSE",
+	8:  "CLOSE_WAIT",
+	9:  "LAST_ACK",
+	10: "LISTEN",
+	11: "CLOSING",
+	12: "NEW_SYN_RECV",
+}
 
-	if !doPrint {
-		return
+func (p *EventProcessor) reasonName(reason uint32) string {
+	if name := p.dropReasons[reason]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", reason)
+}
+
+func (p *EventProcessor) resetReasonName(reason uint32) string {
+	if name := p.rstReasons[reason]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", reason)
+}
+
+// eventReason is the drop reason of a drop, the reset reason of a sent
+// reset, the errno of a UDP error, the ICMP message of an ICMP error, the
+// kind of a keepalive event, the option of a sockopt event, the errno of
+// a failed bind or listen and "" for anything else
+func (p *EventProcessor) eventReason(event *TcpEvent) string {
+	switch {
+	case event.Type == eventDrop:
+		return p.reasonName(event.Reason)
+	case event.Type == eventReset && event.Direction == rstSent:
+		return p.resetReasonName(event.Reason)
+	case event.Type == eventUDPError:
+		return errnoName(event.Reason)
+	case event.Type == eventICMPError:
+		return icmpName(event.Family, event.Reason)
+	case event.Type == eventKeepalive:
+		return keepaliveNames[event.Direction]
+	case event.Type == eventFastOpen:
+		return fastopenNames[event.Reason]
+	case event.Type == eventBuffer:
+		return bufferNames[event.Direction]
+	case event.Type == eventSockopt:
+		return sockoptName(event.Sockopt)
+	case event.Type == eventListen && event.Reason != 0:
+		return errnoName(event.Reason)
+	}
+	return ""
+}
+
+// errnoName names the errno of a UDP error, e.g. ECONNREFUSED
+func errnoName(errno uint32) string {
+	if name := unix.ErrnoName(syscall.Errno(errno)); name != "" {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", errno)
+}
+
+func (p *EventProcessor) stateName(state uint32) string {
+	if name := p.tcpStates[state]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", state)
+}
+
+// IPv4 addresses arrive IPv4-mapped, Unmap prints them as plain dotted quads
+// (as it does for v4 peers of dual-stack IPv6 sockets)
+func formatAddr(addr [16]uint8) string {
+	return netip.AddrFrom16(addr).Unmap().String()
+}
+
+func formatEndpoint(addr [16]uint8, port uint16) string {
+	return netip.AddrPortFrom(netip.AddrFrom16(addr).Unmap(), port).String()
+}
+
+func usDuration(us uint32) time.Duration {
+	return time.Duration(us) * time.Microsecond
+}
+
+// countSuffix says how many identical events --coalesce folded into this
+// one, and how many --conn-limit left out before it
+func countSuffix(event *TcpEvent) string {
+	var s string
+	if event.Count > 1 {
+		s = fmt.Sprintf(" | Count: %d", event.Count)
+	}
+	if event.Suppressed != 0 {
+		s += fmt.Sprintf(" | Suppressed: %d", event.Suppressed)
+	}
+	return s
+}
+
+// reorderSuffix is what a close says about reordering: segments this end
+// received out of order, and reorderings the sender detected. Out of order
+// segments with few retransmits point at the path reordering rather than
+// losing them.
+func reorderSuffix(event *TcpEvent) string {
+	var s string
+	if event.OooPackets != 0 {
+		s = fmt.Sprintf(" | Out of order: %d (up to %d B ahead)", event.OooPackets, event.OooMaxBytes)
+	}
+	if event.ReordSeen != 0 {
+		s += fmt.Sprintf(" | Reordering: %d segments, seen %d times", event.Reordering, event.ReordSeen)
+	}
+	return s
+}
+
+// sackSuffix is how many ACKs of a closed connection carried SACK blocks,
+// and how many of those were DSACKs: retransmits the peer didn't need
+func sackSuffix(event *TcpEvent) string {
+	if event.Sacks == 0 {
+		return ""
+	}
+	s := fmt.Sprintf(" | SACKs: %d", event.Sacks)
+	if event.Dsacks != 0 {
+		s += fmt.Sprintf(" | DSACKs: %d (%d B)", event.Dsacks, event.DsackBytes)
+	}
+	return s
+}
+
+// enrichSuffix names the process, pod, container, network namespace and interface an
+// event came from, and where its peer is, if the enrichers found them. The
+// host namespace isn't worth saying on every line.
+func enrichSuffix(event *TcpEvent) string {
+	var s string
+	if proc := event.Process; proc != nil {
+		s += fmt.Sprintf(" | User: %s (%d)", proc.User, proc.UID)
+		if proc.Cmdline != "" {
+			s += " | Cmd: " + proc.Cmdline
+		}
+	}
+	if pod := event.Pod; pod != nil {
+		s += " | Pod: " + pod.Namespace + "/" + pod.Name
+	}
+	if c := event.Container; c != nil {
+		s += " | Container: " + c.Name + " (" + c.Image + ")"
+	}
+	if proc := event.Process; proc != nil && proc.Cgroup != "" {
+		s += " | Cgroup: " + proc.Cgroup
+	}
+	if event.Netns != 0 && event.NetnsName != "host" {
+		s += " | Netns: " + netnsLabel(event.Netns, event.NetnsName)
+	}
+	if event.Link != nil {
+		s += " | Interface: " + linkLabel(event.Link)
+	}
+	if event.MptcpToken != 0 {
+		s += " | MPTCP: " + mptcpSubflowLabel(event.MptcpToken, event.MptcpSubflow)
 	}
+	if event.Geo != nil {
+		s += " | Geo: " + geoString(event.Geo)
+	}
+	if event.Anomaly {
+		s += " | Anomaly: rate above its baseline"
+	}
+	return s
+}
 
-	// Format the event
-	reasonStr := p.dropReasons[event.Reason]
-	if reasonStr == "" {
-		reasonStr = fmt.Sprintf("UNKNOWN(%d)", event.Reason)
+// formatConnEvent renders the events that carry a connection tuple
+// (retransmits, state transitions, connection closes, resets, zero windows,
+// UDP and ICMP errors)
+func (p *EventProcessor) formatConnEvent(event *TcpEvent) string {
+	src := hostEndpoint(event.Saddr, event.SaddrName, event.Sport)
+	dst := hostEndpoint(event.Daddr, event.DaddrName, event.Dport)
+	now := event.when().Format("15:04:05")
+
+	switch event.Type {
+	case eventState:
+		return fmt.Sprintf("[%s] State | PID: %-6d | %s -> %s | %s -> %s%s\n",
+			now, event.Pid, src, dst,
+			p.stateName(event.OldState), p.stateName(event.State), enrichSuffix(event))
+	case eventConnect:
+		return fmt.Sprintf("[%s] Slow connect | PID: %-6d | %s -> %s | Handshake: %s%s\n",
+			now, event.Pid, src, dst,
+			time.Duration(event.DurationNs).Round(time.Microsecond), enrichSuffix(event))
+	case eventClose:
+		var rtt string
+		if event.RttAvgUs != 0 {
+			rtt = fmt.Sprintf(" | RTT min/avg/max: %s/%s/%s",
+				usDuration(event.RttMinUs), usDuration(event.RttAvgUs), usDuration(event.RttMaxUs))
+		}
+		return fmt.Sprintf("[%s] Close | PID: %-6d | %s -> %s | Duration: %s | TX: %d B | RX: %d B | Retransmits: %d%s%s%s%s\n",
+			now, event.Pid, src, dst,
+			time.Duration(event.DurationNs).Round(time.Microsecond),
+			event.BytesSent, event.BytesReceived, event.Retransmits, rtt, reorderSuffix(event), sackSuffix(event), enrichSuffix(event))
+	case eventReset:
+		var reason string
+		if event.Direction == rstSent && event.Reason != 0 {
+			reason = " | Reason: " + p.resetReasonName(event.Reason)
+		}
+		return fmt.Sprintf("[%s] Reset %s | PID: %-6d | %s -> %s | State: %s%s%s%s\n",
+			now, directionNames[event.Direction], event.Pid, src, dst, p.stateName(event.State), reason, countSuffix(event), enrichSuffix(event))
+	case eventZeroWindow:
+		// Sent: this process isn't reading. Received: the peer's isn't.
+		stall := fmt.Sprintf("Unread: %d bytes (%s isn't reading)", event.Queued, commString(event.Comm[:]))
+		if event.Direction == windowReceived {
+			stall = fmt.Sprintf("Unsent: %d bytes (the peer isn't reading)", event.Queued)
+		}
+		return fmt.Sprintf("[%s] Zero window %s | PID: %-6d | %s -> %s | %s%s\n",
+			now, directionNames[event.Direction], event.Pid, src, dst, stall, enrichSuffix(event))
+	case eventUDPError:
+		op, tuple := "send", src+" -> "+dst
+		if event.Direction == udpReceived {
+			op = "receive"
+		}
+		if event.Family == 0 {
+			tuple = fmt.Sprintf("Port: %d", event.Sport) // Receive errors before 6.10 only have ours
+		}
+		return fmt.Sprintf("[%s] UDP %s error | PID: %-6d | %s | Error: %s%s%s\n",
+			now, op, event.Pid, tuple, errnoName(event.Reason), countSuffix(event), enrichSuffix(event))
+	case eventKeepalive:
+		what := "probe unanswered"
+		if event.Direction == keepaliveTimeout {
+			what = "timeout, connection closed"
+		}
+		var idle string
+		if event.DurationNs != 0 {
+			idle = " | Idle: " + time.Duration(event.DurationNs).Round(time.Second).String()
+		}
+		return fmt.Sprintf("[%s] Keepalive %s | PID: %-6d | %s -> %s | Unanswered: %d of %d probes%s | State: %s%s\n",
+			now, what, event.Pid, src, dst, event.Probes, event.MaxProbes, idle, p.stateName(event.State), enrichSuffix(event))
+	case eventBuffer:
+		what := "collapsed"
+		switch event.Direction {
+		case bufferOfoPruned:
+			what = "pruned, out-of-order data dropped"
+		case bufferDropped:
+			what = "full, segment dropped"
+		}
+		return fmt.Sprintf("[%s] Receive buffer %s | PID: %-6d | %s -> %s | Memory: %d -> %d of %d B | Collapses: %d | Hint: %s%s%s\n",
+			now, what, event.Pid, src, dst, event.RmemAlloc, event.RmemAfter, event.Rcvbuf, event.Collapses,
+			bufferHint(event), countSuffix(event), enrichSuffix(event))
+	case eventFastOpen:
+		var fallback string
+		if fastopenFellBack(event.Reason) {
+			fallback = " | Fell back to a plain handshake"
+		}
+		return fmt.Sprintf("[%s] Fast Open %s | SYN %s | PID: %-6d | %s -> %s%s%s\n",
+			now, fastopenNames[event.Reason], directionNames[event.Direction], event.Pid, src, dst, fallback, enrichSuffix(event))
+	case eventTLS:
+		var side string
+		if name := tlsSideNames[event.Direction]; name != "" {
+			side = " (" + name + ")"
+		}
+		return fmt.Sprintf("[%s] TLS handshake%s | PID: %-6d | %s -> %s | TLS: %s%s%s\n",
+			now, side, event.Pid, src, dst,
+			time.Duration(event.DurationNs).Round(time.Microsecond), tlsBreakdown(event), enrichSuffix(event))
+	case eventSynFlood:
+		return fmt.Sprintf("[%s] SYN flood | %s -> %s | Interface: %s | SYNs: %d in %s (%.0f/s)%s\n",
+			now, synFloodPrefix(event), dst, synFloodInterface(event), event.Syns,
+			time.Duration(event.DurationNs).Round(time.Millisecond), synFloodRate(event), enrichSuffix(event))
+	case eventSockopt:
+		return fmt.Sprintf("[%s] Sockopt | PID: %-6d | Comm: %s | %s | %s: %s%s\n",
+			now, event.Pid, commString(event.Comm[:]), sockoptSocket(event, src, dst),
+			sockoptName(event.Sockopt), sockoptChange(event), enrichSuffix(event))
+	case eventListen:
+		return fmt.Sprintf("[%s] %s | PID: %-6d | Comm: %s | %s | %s%s\n",
+			now, listenWhat(event), event.Pid, commString(event.Comm[:]), src, listenDetail(event), enrichSuffix(event))
+	case eventBlocked:
+		return fmt.Sprintf("[%s] Connect blocked | PID: %-6d | Comm: %s | -> %s | Rule: %s%s\n",
+			now, event.Pid, commString(event.Comm[:]), dst, blockedRule(event), enrichSuffix(event))
+	case eventDSACK:
+		return fmt.Sprintf("[%s] DSACK | PID: %-6d | %s -> %s | Received twice: %d B (spurious retransmit) | State: %s%s%s\n",
+			now, event.Pid, src, dst, event.DsackBytes, p.stateName(event.State), countSuffix(event), enrichSuffix(event))
+	case eventICMPError:
+		var mtu, state string
+		if event.Mtu != 0 {
+			mtu = fmt.Sprintf(" | MTU: %d", event.Mtu)
+		}
+		if event.State != 0 {
+			state = " | State: " + p.stateName(event.State)
+		} else {
+			state = " | Untracked" // No owner, PID and comm are whoever the softirq interrupted
+		}
+		return fmt.Sprintf("[%s] ICMP %s | PID: %-6d | %s -> %s%s%s%s%s\n",
+			now, icmpName(event.Family, event.Reason), event.Pid, src, dst, mtu, state, countSuffix(event), enrichSuffix(event))
 	}
+	return fmt.Sprintf("[%s] Retransmit | PID: %-6d | %s -> %s | State: %s%s%s\n",
+		now, event.Pid, src, dst, p.stateName(event.State), countSuffix(event), enrichSuffix(event))
+}
 
+func (p *EventProcessor) formatDropEvent(event *TcpEvent) string {
 	symbolName := findNearestSymbol(event.Location)
 	if symbolName == "" {
 		symbolName = fmt.Sprintf("0x%x", event.Location)
 	}
-
-	// Write to buffer
-	n, _ := fmt.Fprintf(p.buffered, "[%s] Drop | PID: %-6d | Reason: %-18s | Function: %s\n",
-		time.Now().Format("15:04:05"),
+	return fmt.Sprintf("[%s] Drop | PID: %-6d | Reason: %-18s | Function: %s (%s)%s%s%s%s\n",
+		event.when().Format("15:04:05"),
 		event.Pid,
-		reasonStr,
-		symbolName)
+		p.reasonName(event.Reason),
+		symbolName,
+		p.dropLayer(event),
+		natSuffix(event),
+		tunnelSuffix(event),
+		countSuffix(event),
+		enrichSuffix(event))
+}
+
+func (p *EventProcessor) ProcessEvent(event *TcpEvent, doPrint bool) {
+	p.metrics.EventsRead.Add(event.occurrences())
+
+	if !doPrint {
+		return
+	}
+
+	if p.format == formatJSON {
+		n, _ := p.buffered.Write(p.formatJSON(event))
+
+		p.metrics.EventsPrinted.Add(1)
+		p.metrics.BytesWritten.Add(uint64(n))
+		return
+	}
+
+	if event.Type != eventDrop {
+		n, _ := p.buffered.WriteString(p.formatConnEvent(event) + stackLines(event.UserStack))
+
+		p.metrics.EventsPrinted.Add(1)
+		p.metrics.BytesWritten.Add(uint64(n))
+		return
+	}
+
+	n, _ := p.buffered.WriteString(p.formatDropEvent(event) + stackLines(event.Stack))
 
 	p.metrics.EventsPrinted.Add(1)
 	p.metrics.BytesWritten.Add(uint64(n))
@@ -205,27 +575,26 @@ func (p *EventProcessor) ProcessEvent(event *monitorEvent, doPrint bool) {
 
 // ProcessEventBusy does all the work of file mode but discards output
 // To isolate Work cost and I/O cost
-func (p *EventProcessor) ProcessEventBusy(event *monitorEvent) {
-	p.metrics.EventsRead.Add(1)
+func (p *EventProcessor) ProcessEventBusy(event *TcpEvent) {
+	p.metrics.EventsRead.Add(event.occurrences())
+
+	if p.format == formatJSON {
+		_ = p.formatJSON(event)
 
-	// Do ALL the same expensive work as file mode
-	reasonStr := p.dropReasons[event.Reason]
-	if reasonStr == "" {
-		reasonStr = fmt.Sprintf("UNKNOWN(%d)", event.Reason)
+		p.metrics.EventsPrinted.Add(1)
+		return
 	}
 
-	// This is the expensive part (binary search through kernel symbols)
-	symbolName := findNearestSymbol(event.Location)
-	if symbolName == "" {
-		symbolName = fmt.Sprintf("0x%x", event.Location)
+	if event.Type != eventDrop {
+		_ = p.formatConnEvent(event)
+
+		p.metrics.EventsPrinted.Add(1)
+		return
 	}
 
-	// Format the string (allocates memory, same as file mode)
-	_ = fmt.Sprintf("[%s] Drop | PID: %-6d | Reason: %-18s | Function: %s\n",
-		time.Now().Format("15:04:05"),
-		event.Pid,
-		reasonStr,
-		symbolName)
+	// Do ALL the same expensive work as file mode, the symbol lookup and
+	// the formatting (allocates memory, same as file mode)
+	_ = p.formatDropEvent(event) + stackLines(event.Stack)
 
 	// But DON'T write it (testing if the work itself helps)
 	p.metrics.EventsPrinted.Add(1)
@@ -235,94 +604,330 @@ func (p *EventProcessor) Flush() {
 	p.buffered.Flush()
 }
 
-// BENCHMARK MODES
-
-type BenchmarkMode struct {
-	Name        string
-	DoPrint     bool
-	Output      io.Writer
-	Description string
-}
-
-func getModes() map[string]BenchmarkMode {
-	return map[string]BenchmarkMode{
-		"terminal": {
-			Name:        "TERMINAL MODE",
-			DoPrint:     true,
-			Output:      os.Stdout,
-			Description: "Print each event to terminal (slowest, limited by TTY)",
-		},
-		"file": {
-			Name:        "FILE MODE",
-			DoPrint:     true,
-			Output:      nil, // Set dynamically
-			Description: "Print to file via stdout redirect (tests buffered I/O)",
-		},
-		"benchmark": {
-			Name:        "BENCHMARK MODE",
-			DoPrint:     false,
-			Output:      io.Discard,
-			Description: "No printing, pure counting (tests max throughput)",
-		},
-		"busy": {
-			Name:        "BUSY MODE",
-			DoPrint:     false,
-			Output:      io.Discard,
-			Description: "Do all work except print (tests if work helps throughput)",
-		},
+// MAIN
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] <duration_seconds>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+
+	commands := getCommands()
+	for _, name := range commandNames(commands) {
+		fmt.Fprintf(os.Stderr, "  %-10s - %s\n", name, commands[name].Mode.Description)
 	}
+	fmt.Fprintf(os.Stderr, "  %-10s - %s\n", "query", "Search events stored with --db")
+	fmt.Fprintf(os.Stderr, "  %-10s - %s\n", "snapshot", "List every TCP socket with its queues and tcp_info, like ss -ti")
+	fmt.Fprintf(os.Stderr, "  %-10s - %s\n", "replay", "Feed events written by record through the output, dashboard and summary")
+	fmt.Fprintf(os.Stderr, "  %-10s - %s\n", "set", "Change --slow-connect, --min-bytes, --sample or --conn-limit of a running monitor")
+
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the command's flags\n", os.Args[0])
+
+	fmt.Fprintf(os.Stderr, "\nExamples:\n")
+	fmt.Fprintf(os.Stderr, "  %s drops 30                 # Print drops to terminal\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s retrans --port 443 60    # Retransmits on port 443\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s resets --cidr 10.0.0.0/8 60  # Who resets connections to and from 10/8\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s life --slow-connect 200ms 60  # Connection lifecycles\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s windows --port 9092 300  # Connections stalled by a reader that fell behind\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s top --top 20 --interval 2s 60  # tcptop-style table\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s listen --port 80,443 300  # Servers whose accept queue overflows\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s file --format=json 30 > events.jsonl  # Everything, one JSON object per line\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s record --out events.bin.zst --out-rotate 1h 0  # Compressed capture for later\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s benchmark 30             # Pure counting\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s bench --rate 5000 --loss 1 60  # Overhead under generated churn\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s query --db events.db --since 30m --type drop --group reason\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s snapshot --state established --port 443 --format=json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s replay --tui --speed 10 events-*.bin.zst events.bin.zst\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s set slow-connect=50ms sample=1/10  # While another one runs\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nComparison script:\n")
+	fmt.Fprintf(os.Stderr, "  ./compare.sh               # Runs all 4 benchmarks\n")
 }
 
-// MAIN
-
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <mode> <duration_seconds>\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Modes:\n")
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		usage()
+		return
+	}
+	if name == "query" {
+		runQuery(os.Args[2:]) // Only reads --db back, nothing to load
+		return
+	}
+	if name == "snapshot" {
+		runSnapshot(os.Args[2:]) // Its own BPF object, see bpf/snapshot.c
+		return
+	}
+	if name == "replay" {
+		runReplay(os.Args[2:]) // Reads record's files, nothing to load
+		return
+	}
+	if name == "set" {
+		runSet(os.Args[2:]) // Writes a running monitor's tunables map
+		return
+	}
+	if name == benchLoadCommand {
+		runBenchLoad(os.Args[2:]) // Started by bench, in a namespace of its own
+		return
+	}
+	cmd, ok := getCommands()[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", name)
+		usage()
+		os.Exit(1)
+	}
 
-		modes := getModes()
-		for key, mode := range modes {
-			fmt.Fprintf(os.Stderr, "  %-10s - %s\n", key, mode.Description)
-		}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] <duration_seconds>\n\n%s\n\nFlags:\n", os.Args[0], name, cmd.Mode.Description)
+		fs.PrintDefaults()
+	}
+	o, err := parseOptions(fs, cmd, os.Args[2:])
+	if err != nil {
+		fatal("reading config", "err", err)
+	}
+	if err := setupLogging(o.logLevel, o.logFormat, o.daemon && os.Getenv("JOURNAL_STREAM") != ""); err != nil {
+		fatal("setting up logging", "err", err)
+	}
 
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s terminal 30              # Print to terminal\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s file 30 > output.txt     # Redirect to file\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s benchmark 30             # Pure counting\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nComparison script:\n")
-		fmt.Fprintf(os.Stderr, "  ./compare.sh               # Runs all 3 benchmarks\n")
+	// A service runs until it's stopped, 0 seconds
+	var duration int
+	if fs.NArg() < 1 && !o.daemon {
+		fs.Usage()
 		os.Exit(1)
 	}
+	if fs.NArg() > 0 {
+		if duration, err = strconv.Atoi(fs.Arg(0)); err != nil {
+			fatal("invalid duration", "err", err)
+		}
+	}
+
+	if o.format != formatText && o.format != formatJSON {
+		fatal("invalid --format, use: text or json", "format", o.format)
+	}
+	if o.topInterval <= 0 {
+		fatal("--interval must be positive", "interval", o.topInterval)
+	}
+	if name == "top" && o.topN <= 0 {
+		fatal("--top must be positive", "top", o.topN)
+	}
+	if o.pcapPath != "" && (o.pcapSnaplen == 0 || o.pcapSnaplen > pcapMaxSnaplen) {
+		fatal("--pcap-snaplen out of range", "snaplen", o.pcapSnaplen, "max", pcapMaxSnaplen)
+	}
+	if o.coalesce < 0 {
+		fatal("--coalesce can't be negative", "coalesce", o.coalesce)
+	}
+	if o.rollupInterval < 0 {
+		fatal("--rollup-interval can't be negative", "rollup_interval", o.rollupInterval)
+	}
+	if o.processReport < 0 {
+		fatal("--process-report can't be negative", "process_report", o.processReport)
+	}
+	if (name == "benchmark" || name == "bench") && o.rollupInterval == 0 {
+		o.rollupInterval = time.Minute // Next to the rate line
+	}
+	for _, r := range o.alerts.Rules {
+		if r.Anomaly {
+			o.anomaly = true
+		}
+	}
+	if o.anomaly && (o.anomalyTop < 0 || o.anomalyScore <= 0) {
+		fatal("--anomaly-top can't be negative and --anomaly-threshold has to be positive", "top", o.anomalyTop, "threshold", o.anomalyScore)
+	}
+	if name == "record" && o.recordPath == "" {
+		fatal("record needs --out")
+	}
+	if name == "bench" {
+		if o.benchRate <= 0 || o.benchPayload < 0 || o.benchLoss < 0 || o.benchLoss > 100 || o.benchDelay < 0 {
+			fatal("--rate must be positive, --payload and --delay not negative and --loss a percentage",
+				"rate", o.benchRate, "payload", o.benchPayload, "loss", o.benchLoss, "delay", o.benchDelay)
+		}
+		o.bpfStats = true // The report has the programs' CPU
+	}
+	if o.daemon && o.tui {
+		fatal("--daemon and --tui don't go together, a service has no terminal")
+	}
+
+	run(name, cmd, o, duration)
+}
+
+// parseOptions defines the command's flags on fs, parses args and then
+// fills in whatever the --config file sets. A filter reload calls it again
+// on the same arguments, so the file is re-read with the same precedence.
+func parseOptions(fs *flag.FlagSet, cmd command, args []string) (*options, error) {
+	var o options
+	commonFlags(fs, &o)
+	if cmd.flags != nil {
+		cmd.flags(fs, &o)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if o.config != "" {
+		cfg, err := applyConfig(fs, o.config)
+		if err != nil {
+			return nil, err
+		}
+		o.alerts = cfg.Alerts
+	}
+	return &o, nil
+}
+
+// run is everything after flag parsing: load and attach, consume events
+// until the duration is up or Ctrl+C, then report
+func run(name string, cmd command, o *options, duration int) {
+	var notifier *systemdNotifier
+	if o.daemon {
+		var err error
+		if notifier, err = newSystemdNotifier(); err != nil {
+			slog.Warn("connecting to systemd", "err", err)
+		}
+		defer notifier.Close()
+	}
+	if o.pidFile != "" {
+		if err := writePIDFile(o.pidFile); err != nil {
+			fatal("writing PID file", "path", o.pidFile, "err", err)
+		}
+		defer removePIDFile(o.pidFile)
+	}
+	var dropTo *runAs
+	if o.runAsUser != "" {
+		var err error
+		if dropTo, err = parseRunAs(o.runAsUser, o.keepCaps, o.controlAddr != ""); err != nil {
+			fatal("invalid --user", "err", err)
+		}
+	}
 
-	modeKey := os.Args[1]
-	duration, err := strconv.Atoi(os.Args[2])
+	filters, err := parseFilters(o.pids, o.comms, o.ports, o.cidrs, o.cgroupPath)
+	if err != nil {
+		fatal("invalid filter", "err", err)
+	}
+	labels, err := parseLabels(o.labels)
+	if err != nil {
+		fatal("invalid --label", "err", err)
+	}
+	connectBuckets, err := parseHistBuckets(o.connectBuckets)
+	if err != nil {
+		fatal("invalid --connect-buckets", "err", err)
+	}
+	rttBuckets, err := parseHistBuckets(o.rttBuckets)
 	if err != nil {
-		log.Fatalf("Invalid duration: %v", err)
+		fatal("invalid --rtt-buckets", "err", err)
+	}
+	buckets := histLayout{histConnect: connectBuckets, histRTT: rttBuckets}
+	queue, err := newEventQueue(o.bufferSize, o.overflowPolicy)
+	if err != nil {
+		fatal("invalid event queue", "err", err)
+	}
+	sinks, err := NewSinkFanout(o.sinkBuffer)
+	if err != nil {
+		fatal("invalid sink queues", "err", err)
 	}
 
-	modes := getModes()
-	mode, ok := modes[modeKey]
-	if !ok {
-		log.Fatalf("Invalid mode '%s'. Use: terminal, file, or benchmark", modeKey)
+	mode := cmd.Mode
+	hooks, eventMask := cmd.hooks, cmd.events
+	if len(o.probes) > 0 {
+		if hooks, err = parseProbes(o.probes); err != nil {
+			fatal("invalid --probes", "err", err)
+		}
+		eventMask = allEvents
+	}
+	hooks, eventMask, protocols, err := parseProtocols(o.protos, hooks, eventMask)
+	if err != nil {
+		fatal("invalid --proto", "err", err)
+	}
+	if o.tui {
+		hooks |= hookTop // For the top talkers table
+	}
+	if o.cgroupMetrics {
+		// The drop and retransmit probes count for the cgroups even when
+		// the command doesn't emit their events
+		hooks |= hookDrops | hookRetransmits | hookCgroups
+		if o.listenAddr == "" {
+			slog.Warn("--cgroup-metrics is only exported on /metrics, set --listen-addr")
+		}
+	}
+	if err := parseInterfaceHook(o.interfaceHook); err != nil {
+		fatal("invalid --interface-hook", "err", err)
+	}
+	ifaces, err := parseInterfaces(o.interfaces)
+	if err != nil {
+		fatal("invalid --interface", "err", err)
+	}
+	if len(ifaces) > 0 {
+		hooks |= hookInterfaces
+	} else if hooks&hookInterfaces != 0 {
+		fatal("--probes interfaces needs --interface")
+	}
+	synFlood := synFloodOptions{threshold: uint32(o.synFlood), v4Prefix: uint32(o.synFloodV4), v6Prefix: uint32(o.synFloodV6)}
+	if err := synFlood.validate(); err != nil {
+		fatal("invalid --syn-flood", "err", err)
+	}
+	if synFlood.threshold != 0 {
+		if len(ifaces) == 0 {
+			fatal("--syn-flood needs --interface, SYNs are counted where it counts segments")
+		}
+		eventMask |= 1 << eventSynFlood
+	}
+	enforce := o.enforce || len(o.block) > 0 || hooks&hookEnforce != 0
+	if enforce {
+		// Asked for containment, so rather no monitor than one without it
+		if err := enforceSupported(); err != nil {
+			fatal("--enforce unavailable", "err", err)
+		}
+		hooks |= hookEnforce
+		eventMask |= 1 << eventBlocked
+	}
+	var sockOpsCBs uint32
+	if o.sockOps || hooks&hookSockOps != 0 {
+		if hooks, sockOpsCBs, err = useSockOps(hooks); err != nil {
+			slog.Warn("--sockops unavailable, using tracepoints and kprobes", "err", err)
+		}
+	}
+	if err := checkCapabilities(name, o); err != nil {
+		fatal("not enough privileges, run as root or grant the capabilities", "err", err)
 	}
 
 	// Special handling for file mode
-	if modeKey == "file" {
+	if name == "file" {
 		// Check if stdout is redirected
-		stat, _ := os.Stdout.Stat()
+		stat, err := os.Stdout.Stat()
+		if err != nil {
+			fatal("checking stdout", "err", err)
+		}
 		if (stat.Mode() & os.ModeCharDevice) != 0 {
-			log.Fatalf("FILE mode requires stdout redirection. Use: %s file 30 > output.txt", os.Args[0])
+			fatal("FILE mode requires stdout redirection, e.g. " + os.Args[0] + " file 30 > output.txt")
 		}
 		mode.Output = os.Stdout
 	}
 
+	// The dashboard owns the terminal, so events aren't printed and
+	// warnings are held back until it exits
+	var logBuf bytes.Buffer
+	if o.tui {
+		mode.DoPrint = false
+		mode.Output = io.Discard
+		logOutput.SetOutput(&logBuf)
+		flushLogs := func() {
+			logOutput.SetOutput(os.Stderr)
+			os.Stderr.Write(logBuf.Bytes())
+		}
+		defer flushLogs()
+		atFatal(flushLogs)
+	}
+
 	// Setup
-	fmt.Fprintf(os.Stderr, "╔══════════════════════════════════════════════════════════════════════╗\n")
-	fmt.Fprintf(os.Stderr, "║  %-66s  ║\n", mode.Name)
-	fmt.Fprintf(os.Stderr, "╠══════════════════════════════════════════════════════════════════════╣\n")
-	fmt.Fprintf(os.Stderr, "║ %s%-66s%s ║\n", "", mode.Description, "")
-	fmt.Fprintf(os.Stderr, "║ Duration: %-57d seconds ║\n", duration)
-	fmt.Fprintf(os.Stderr, "╚══════════════════════════════════════════════════════════════════════╝\n\n")
+	if o.daemon {
+		slog.Info(mode.Description, "command", name, "duration", duration) // The box is for terminals
+	} else {
+		fmt.Fprintf(os.Stderr, "╔══════════════════════════════════════════════════════════════════════╗\n")
+		fmt.Fprintf(os.Stderr, "║  %-66s  ║\n", mode.Name)
+		fmt.Fprintf(os.Stderr, "╠══════════════════════════════════════════════════════════════════════╣\n")
+		fmt.Fprintf(os.Stderr, "║ %s%-66s%s ║\n", "", mode.Description, "")
+		fmt.Fprintf(os.Stderr, "║ Duration: %-57d seconds ║\n", duration)
+		fmt.Fprintf(os.Stderr, "╚══════════════════════════════════════════════════════════════════════╝\n\n")
+	}
 
 	loadSymbols()
 	// 1. Load all symbols
@@ -331,101 +936,897 @@ func main() {
 	// 2. Initialize metrics
 
 	// eBPF setup
-	if err := rlimit.RemoveMemlock(); err != nil {
-		log.Fatal(err)
+	if err := checkKernelArch(); err != nil {
+		fatal("unsupported kernel architecture", "err", err)
+	}
+	if err := removeMemlock(); err != nil {
+		fatal("removing the memlock limit", "err", err)
 	}
 	// 3. Remove memory lock limit
 
+	usePerf := usePerfBuffer()
+	if usePerf {
+		slog.Info("kernel has no BPF ring buffer support, falling back to perf event array")
+	}
+
+	var pcapSnaplen uint32
+	if o.pcapPath != "" {
+		pcapSnaplen = uint32(o.pcapSnaplen)
+	}
+
+	var jiffyNs uint64
+	if hooks&hookKeepalive != 0 {
+		jiffyNs = keepaliveJiffyNs()
+	}
+	if hooks&hookFastOpen != 0 {
+		warnFastOpenSysctl()
+	}
+
 	objs := monitorObjects{}
-	if err := loadMonitorObjects(&objs, nil); err != nil {
-		log.Fatalf("Loading eBPF objects: %v", err)
+	kernelBTF, err := loadKernelBTF(o.btfPath, o.btfDownload)
+	if err != nil {
+		fatal("loading kernel BTF", "err", err)
+	}
+	reasons := loadDropReasons(kernelBTF)
+	var conntrack conntrackOffsets
+	if hooks&hookDrops != 0 {
+		conntrack = loadConntrack(kernelBTF)
+	}
+	if err := loadObjects(&objs, usePerf, loadOptions{
+		filters:     filters,
+		reasons:     reasons,
+		collectHist: o.histInterval > 0,
+		histLayout:  buckets,
+		slowConnect: o.slowConnect,
+		eventMask:   eventMask,
+		pcapSnaplen: pcapSnaplen,
+		stacks:      o.stacks,
+		userStacks:  o.userStacks,
+		processInfo: o.processInfo,
+		cgroupStats: o.cgroupMetrics,
+		sampleRate:  uint32(o.sample),
+		connLimit:   uint32(o.connLimit),
+		minBytes:    o.minBytes,
+		aggregate:   o.aggregate,
+		kernelBTF:   kernelBTF,
+		pinPath:     o.pinPath,
+		sockOpsCBs:  sockOpsCBs,
+		interfaces:  len(ifaces),
+		enforce:     enforce,
+		synFlood:    synFlood,
+		protocols:   protocols,
+		jiffyNs:     jiffyNs,
+		conntrack:   conntrack,
+	}); err != nil {
+		logVerifierError(err)
+		fatal("loading eBPF objects", "perf_buffer", usePerf, "err", err)
 	}
 	defer objs.Close()
 	// 4. Load bytecode embedding variable (monitorObjects) into kernel
+	// (the ring buffer build, or the perf event array build on pre-5.8 kernels)
 
-	tp, err := link.Tracepoint("skb", "kfree_skb", objs.TraceTcpDrop, nil)
-	if err != nil {
-		log.Fatalf("Attaching tracepoint: %v", err)
+	var tlsLibs []string
+	if hooks&hookTLS != 0 {
+		if tlsLibs, err = tlsLibraries(o.tlsLibs); err != nil {
+			fatal("finding libssl for the tls probe", "err", err)
+		}
+		slog.Debug("tls probe libraries", "libs", tlsLibs)
 	}
-	defer tp.Close()
-	// 5. Attach to hook
+	var interfaces *InterfaceCounters
+	if len(ifaces) > 0 {
+		if interfaces, err = NewInterfaceCounters(objs.PrestackStats, ifaces, o.interfaceHook); err != nil {
+			fatal("setting up --interface counters", "err", err)
+		}
+	}
+	var enforcer *Enforcer
+	if enforce {
+		// The rules go in before the programs are attached
+		if enforcer, err = NewEnforcer(&objs, o.block); err != nil {
+			fatal("invalid --block rule", "err", err)
+		}
+	}
+	probeManager := NewProbeManager(&objs, o.pinPath, tlsLibs, ifaces, o.interfaceHook) // Detached explicitly on shutdown
+	if err := probeManager.Attach(hooks); err != nil {
+		fatal("attaching probes", "err", err)
+	}
+	probeManager.Report(os.Stderr)
+	var programs []attachedProgram
+	if o.bpfStats {
+		stats, err := enableProgramStats()
+		if err != nil {
+			slog.Warn("--bpf-stats unavailable", "err", err)
+		} else {
+			defer stats.Close()
+			programs = probeManager.Programs()
+		}
+	}
+	// 5. Attach the command's hooks (drops, retransmits and state changes share the same ring buffer,
+	// the RTT, top and listen kprobes only update maps)
+
+	reload := &filterReload{objs: &objs, parse: func() (*Filters, error) {
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		ro, err := parseOptions(fs, cmd, os.Args[2:])
+		if err != nil {
+			return nil, err
+		}
+		return parseFilters(ro.pids, ro.comms, ro.ports, ro.cidrs, ro.cgroupPath)
+	}}
+	// 5b. Filter reloads (SIGHUP, POST /api/v1/reload on --control-addr) update the filter maps in place
 
-	rd, err := ringbuf.NewReader(objs.Events) //objs.Events is FD to C's events description
+	rd, err := openEventSource(objs.Events, objs.LostEvents, usePerf)
 	if err != nil {
-		log.Fatalf("Opening ringbuf: %v", err)
+		fatal("opening event reader", "err", err)
 	}
 	defer rd.Close()
-	// 6. Create BPF ringbuf reader
+	// 6. Create BPF ringbuf (or perf) reader
+	if o.pinPath != "" {
+		// The previous run's links were replaced by Attach, not adopted
+		if n, err := resetLostEvents(objs.LostEvents); err != nil {
+			slog.Warn("resetting lost_events", "err", err)
+		} else if n > 0 {
+			slog.Info("not counting events the pinned probes lost while no monitor was reading", "events", n)
+		}
+	}
 
-	processor := NewEventProcessor(mode.Output, metrics)
+	processor := NewEventProcessor(mode.Output, metrics, o.format, labels, reasons)
 	// 7. New processor
 
+	netns := newNetnsResolver()
+	enrichers := []enricher{netns, newLinkResolver(netns.host)} // Interfaces of drops and retransmits
+	if o.stacks {
+		enrichers = append(enrichers, NewStackEnricher(objs.DropStacks))
+	}
+	if o.userStacks {
+		enrichers = append(enrichers, NewUserStackEnricher(objs.UserStacks))
+	}
+	if interfaces != nil {
+		enrichers = append(enrichers, interfaces) // Names where SYN floods arrived
+	}
+	if enforcer != nil {
+		enrichers = append(enrichers, enforcer) // The rules of blocked connects
+	}
+	var cgroups *cgroupResolver
+	if o.k8sSource != "" || o.containers != "" || o.cgroupMetrics || o.processInfo {
+		cgroups = newCgroupResolver(cgroupRoot) // Shared, walking cgroupfs isn't free
+	}
+
+	var k8s *K8sEnricher
+	if o.k8sSource != "" {
+		k8s, err = NewK8sEnricher(o.k8sSource, o.kubeletURL, o.kubeletInsecure, cgroups)
+		if err != nil {
+			fatal("setting up Kubernetes enrichment", "source", o.k8sSource, "err", err)
+		}
+		enrichers = append(enrichers, k8s)
+		slog.Info("enriching events with pods", "source", o.k8sSource)
+	}
+
+	var containers *ContainerEnricher
+	if o.containers != "" {
+		runtime, err := newContainerRuntime(o.containers, o.containerSocket)
+		if err != nil {
+			fatal("setting up container enrichment", "runtime", o.containers, "err", err)
+		}
+		containers = NewContainerEnricher(runtime, cgroups)
+		enrichers = append(enrichers, containers)
+		slog.Info("enriching events with containers", "runtime", o.containers)
+	}
+
+	if o.processInfo {
+		enrichers = append(enrichers, NewProcessEnricher(objs.ProcOwners, cgroups))
+	}
+	if o.reverseDNS {
+		enrichers = append(enrichers, NewDNSEnricher())
+	}
+	var geo *GeoEnricher
+	if len(o.geoip) > 0 {
+		geo, err = NewGeoEnricher(o.geoip)
+		if err != nil {
+			fatal("opening --geoip databases", "err", err)
+		}
+		defer geo.Close()
+		enrichers = append(enrichers, geo)
+	}
+	var traces *TraceCorrelator
+	if o.otlpEndpoint != "" {
+		traces = NewTraceCorrelator()
+		enrichers = append(enrichers, traces)
+		if o.controlAddr == "" {
+			slog.Warn("--otlp-endpoint without --control-addr, there's no POST /api/v1/trace-context to register traces for exemplars")
+		}
+	}
+	var anomalies *AnomalyDetector
+	if o.anomaly {
+		anomalies = NewAnomalyDetector(o.anomalyTop, o.anomalyScore)
+		enrichers = append(enrichers, anomalies)
+	}
+	// 7a. Optional enrichment
+
+	// Counted only where the attached probes and the command's events can
+	active := probeManager.Active()
+	rollups := NewRollups(rollupCounted{
+		drops:       active&hookDrops != 0 && (eventMask&(1<<eventDrop) != 0 || o.aggregate),
+		retransmits: active&(hookRetransmits|hookSockOps) != 0 && (eventMask&(1<<eventRetransmit) != 0 || o.aggregate),
+		conns:       active&(hookStates|hookSockOps) != 0 && eventMask&(1<<eventState) != 0,
+	})
+	mptcp := NewMptcpTracker()
+	listeners := NewListenerInventory()
+	if active&hookListeners != 0 {
+		if err := listeners.Seed(); err != nil {
+			slog.Info("listeners opened before the monitor are left out of the inventory", "err", err)
+		}
+	}
+	observers := []observer{rollups, mptcp, listeners}
+	var processReport *ProcessReport
+	if o.processReport > 0 {
+		processReport = NewProcessReport()
+		observers = append(observers, processReport)
+	}
+	// Drill-down for the dashboard and the API
+	var history *ConnHistory
+	if o.tui || o.listenAddr != "" {
+		history = NewConnHistory(objs.Conns)
+		observers = append(observers, history)
+	}
+	var health *HealthChecker
+	if o.listenAddr != "" {
+		mux := http.NewServeMux()
+		suppressed := func() uint64 { return sumCounters(objs.SuppressedEvents) }
+		var cgroupStats *ebpf.Map
+		if o.cgroupMetrics {
+			cgroupStats = objs.CgroupStats
+		}
+		sampleRate := func() uint32 { return currentSampleRate(objs.Tunables) }
+		exporter, err := NewPromExporter(objs.Conns, rd.Lost, suppressed, sampleRate, programs, queue, sinks, k8s, containers, geo, cgroupStats, cgroups, interfaces, labels)
+		if err != nil {
+			fatal("setting up Prometheus metrics", "err", err)
+		}
+		exporter.Register(mux)
+		api := NewAPIServer(objs.Conns, metrics, rd.Lost, queue, probeManager.Names, programs, k8s, containers)
+		api.Register(mux)
+		web := NewWebUI()
+		web.Register(mux)
+		rollups.Register(mux)
+		if processReport != nil {
+			processReport.Register(mux)
+		}
+		mptcp.Register(mux)
+		listeners.Register(mux)
+		history.Register(mux)
+		probeManager.Register(mux)
+		if enforcer != nil {
+			enforcer.Register(mux)
+		}
+		sinks.Register(mux)
+		if interfaces != nil {
+			interfaces.Register(mux)
+		}
+		if anomalies != nil {
+			anomalies.Register(mux)
+		}
+		health = NewHealthChecker(probeManager, queue, rd.Lost, metrics)
+		health.Register(mux)
+		// Bound right away, the port may need root that --user gives up
+		ln, err := net.Listen("tcp", o.listenAddr)
+		if err != nil {
+			fatal("serving metrics", "addr", o.listenAddr, "err", err)
+		}
+		go func() {
+			if err := http.Serve(ln, mux); err != nil {
+				fatal("serving metrics", "addr", o.listenAddr, "err", err)
+			}
+		}()
+		observers = append(observers, exporter, api, web)
+		slog.Info("serving Prometheus metrics on /metrics, the API on /api/v1, health on /healthz and /readyz and the live page on /", "addr", o.listenAddr)
+	}
+	if o.controlAddr != "" {
+		// Bound now too, a socket under /run needs the root --user gives up
+		control, ln, err := newControlServer(o.controlAddr, o.controlToken)
+		if err != nil {
+			fatal("serving the control API", "addr", o.controlAddr, "err", err)
+		}
+		probeManager.RegisterControl(control.mux)
+		reload.RegisterControl(control.mux)
+		if traces != nil {
+			traces.RegisterControl(control.mux)
+		}
+		if enforcer != nil {
+			enforcer.RegisterControl(control.mux)
+		}
+		go func() {
+			if err := control.Serve(ln); err != nil {
+				fatal("serving the control API", "addr", o.controlAddr, "err", err)
+			}
+		}()
+		slog.Info("serving the control API", "addr", o.controlAddr)
+	} else if enforcer != nil {
+		slog.Info("--block rules can only be changed at runtime with --control-addr")
+	}
+
+	var otlpExporter *OTLPExporter
+	if o.otlpEndpoint != "" {
+		otlpExporter, err = NewOTLPExporter(context.Background(), o.otlpEndpoint, o.otlpInsecure, labels)
+		if err != nil {
+			fatal("setting up OTLP export", "endpoint", o.otlpEndpoint, "err", err)
+		}
+		observers = append(observers, otlpExporter)
+		slog.Info("exporting OTLP", "endpoint", o.otlpEndpoint)
+	}
+
+	var statsd *StatsDSink
+	if o.statsdAddr != "" {
+		statsd, err = NewStatsDSink(o.statsdAddr, o.statsdPrefix, append(o.statsdTags, labelPairs(labels, ":")...), rd.Lost)
+		if err != nil {
+			fatal("setting up StatsD", "addr", o.statsdAddr, "err", err)
+		}
+		observers = append(observers, sinks.Add("statsd", statsd))
+		slog.Info("sending StatsD metrics", "addr", o.statsdAddr)
+	}
+
+	var ipfix *IPFIXExporter
+	if o.ipfixAddr != "" {
+		if o.ipfixActive < 0 {
+			fatal("--ipfix-active-timeout can't be negative", "timeout", o.ipfixActive)
+		}
+		ipfix, err = NewIPFIXExporter(o.ipfixAddr, uint32(o.ipfixDomain), objs.Conns, o.ipfixActive)
+		if err != nil {
+			fatal("setting up IPFIX", "addr", o.ipfixAddr, "err", err)
+		}
+		observers = append(observers, sinks.Add("ipfix", ipfix))
+		slog.Info("exporting IPFIX flows", "addr", o.ipfixAddr)
+		if eventMask&(1<<eventClose) == 0 {
+			slog.Warn("--ipfix only exports closed connections, which this command doesn't report; use life or --probes states")
+		}
+		if o.ipfixActive > 0 && probeManager.Active()&hookRTT == 0 {
+			slog.Warn("--ipfix-active-timeout needs the rtt probe (--probes rtt) for live connections' bytes, they're only exported at close")
+		}
+	}
+
+	var kafkaSink *KafkaSink
+	if len(o.kafkaBrokers) > 0 {
+		kafkaSink, err = NewKafkaSink(o.kafkaBrokers, o.kafkaTopic, o.kafkaEncoding, o.kafkaKey, o.kafkaBatchSize, o.kafkaBatchWait)
+		if err != nil {
+			fatal("setting up Kafka", "topic", o.kafkaTopic, "err", err)
+		}
+		observers = append(observers, sinks.Add("kafka", kafkaSink))
+		slog.Info("publishing events to Kafka", "topic", o.kafkaTopic)
+	}
+
+	var natsSink *NATSSink
+	if o.natsURL != "" {
+		natsSink, err = NewNATSSink(o.natsURL, o.natsSubject, o.natsEncoding, o.natsJetStream, o.natsStream)
+		if err != nil {
+			fatal("setting up NATS", "url", o.natsURL, "err", err)
+		}
+		observers = append(observers, sinks.Add("nats", natsSink))
+		slog.Info("publishing events to NATS", "subject", o.natsSubject)
+	}
+
+	var syslogSink *SyslogSink
+	if o.syslogAddr != "" {
+		syslogSink, err = NewSyslogSink(o.syslogAddr, o.syslogFacility)
+		if err != nil {
+			fatal("setting up syslog", "addr", o.syslogAddr, "err", err)
+		}
+		observers = append(observers, sinks.Add("syslog", syslogSink))
+		slog.Info("sending events to syslog", "addr", o.syslogAddr)
+	}
+
+	var grpcServer *GRPCServer
+	if o.grpcListen != "" {
+		grpcServer, err = NewGRPCServer(o.grpcListen)
+		if err != nil {
+			fatal("starting gRPC server", "addr", o.grpcListen, "err", err)
+		}
+		observers = append(observers, sinks.Add("grpc", grpcServer))
+		slog.Info("streaming events over gRPC", "addr", o.grpcListen)
+	}
+
+	var plugins []*PluginSink
+	for i, name := range pluginNames(o.plugins) {
+		plugin, err := NewPluginSink(o.plugins[i], o.pluginEncoding)
+		if err != nil {
+			fatal("starting plugin", "command", o.plugins[i], "err", err)
+		}
+		plugins = append(plugins, plugin)
+		observers = append(observers, sinks.Add(name, plugin))
+		slog.Info("writing events to a plugin", "command", o.plugins[i], "encoding", o.pluginEncoding)
+	}
+
+	var alerter *Alerter
+	if len(o.alerts.Rules) > 0 {
+		alerter, err = NewAlerter(o.alerts, objs.Conns)
+		if err != nil {
+			fatal("invalid alerts", "err", err)
+		}
+		for _, r := range alerter.rules {
+			if eventMask&(1<<r.eventType) == 0 {
+				slog.Warn("alert rule will never fire, the command doesn't emit its events",
+					"rule", r.name, "command", name, "event", eventTypeNames[r.eventType])
+			}
+			if r.perSegment && probeManager.Active()&hookRTT == 0 {
+				slog.Warn("alert rule with per: segments needs the rtt probe (--probes rtt) for the segments sent, its ratio stays 0", "rule", r.name)
+			}
+		}
+		observers = append(observers, alerter)
+		slog.Info("evaluating alert rules", "rules", len(o.alerts.Rules))
+	}
+
+	var recordSink *RecordSink
+	if o.recordPath != "" {
+		recordSink, err = NewRecordSink(o.recordPath, o.recordMaxSize*1024*1024, o.recordRotate)
+		if err != nil {
+			fatal("opening --out", "path", o.recordPath, "err", err)
+		}
+		observers = append(observers, sinks.Add("record", recordSink))
+		slog.Info("recording events", "path", o.recordPath)
+	}
+
+	var csvSink *CSVSink
+	if o.csvPath != "" {
+		csvSink, err = NewCSVSink(o.csvPath, o.csvMaxSize*1024*1024, o.csvRotate)
+		if err != nil {
+			fatal("opening CSV output", "path", o.csvPath, "err", err)
+		}
+		observers = append(observers, sinks.Add("csv", csvSink))
+		slog.Info("writing events to CSV", "path", o.csvPath)
+	}
+
+	var sqliteSink *SQLiteSink
+	if o.dbPath != "" {
+		sqliteSink, err = NewSQLiteSink(o.dbPath)
+		if err != nil {
+			fatal("opening database", "path", o.dbPath, "err", err)
+		}
+		observers = append(observers, sinks.Add("sqlite", sqliteSink))
+		slog.Info("storing events in the database", "path", o.dbPath)
+	}
+
+	var pcap *PcapWriter
+	if o.pcapPath != "" {
+		pcap, err = NewPcapWriter(o.pcapPath, pcapSnaplen)
+		if err != nil {
+			fatal("opening pcap output", "path", o.pcapPath, "err", err)
+		}
+		observers = append(observers, sinks.Add("pcap", pcap))
+		slog.Info("capturing dropped packets", "path", o.pcapPath)
+	}
+	// 7b. Optional exporters and sinks
+
+	var tui *TUI
+	tuiDone := make(<-chan struct{}) // Never closed without --tui
+	if o.tui {
+		tui = NewTUI(history)
+		atFatal(tui.Stop) // Gives the terminal back before the error is printed
+		observers = append(observers, tui)
+		tuiDone = tui.Done()
+	}
+	// 7c. Optional dashboard
+
+	// Benchmark mode stays pure counting
+	summary := newRunSummary()
+	if name != "benchmark" {
+		observers = append(observers, summary)
+	}
+	// 7d. End-of-run summary
+
 	fmt.Fprintf(os.Stderr, "eBPF program loaded and attached\n")
-	fmt.Fprintf(os.Stderr, "Starting in 3 seconds...\n\n")
-	time.Sleep(3 * time.Second)
+	if !o.daemon {
+		fmt.Fprintf(os.Stderr, "Starting in 3 seconds...\n\n")
+		time.Sleep(3 * time.Second)
+	}
 
 	// Signal handling
 	stopper := make(chan os.Signal, 1) // Buffered channel that can hold 1 signal at a time
 	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
-	// 8. Signal handling channel
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			notifier.Notify("RELOADING=1")
+			if _, err := reload.Reload(); err != nil {
+				slog.Warn("reloading filters, keeping the old ones", "err", err)
+			}
+			notifier.Notify("READY=1")
+		}
+	}()
+	if processReport != nil && !o.tui {
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		go func() {
+			for range usr1 {
+				processReport.Print(os.Stderr, o.processReport)
+			}
+		}()
+	}
+	// 8. Signal handling channel, SIGHUP reloads the filters, SIGUSR1 prints the process report
 
 	// Auto-stop timer
-	go func() {
-		time.Sleep(time.Duration(duration) * time.Second)
-		stopper <- syscall.SIGTERM
-	}() //erload effects introduce
+	if !o.daemon || duration > 0 {
+		go func() {
+			time.Sleep(time.Duration(duration) * time.Second)
+			stopper <- syscall.SIGTERM
+		}() //erload effects introduce
+	}
 	// 9. Timer
 
 	// Metrics reporter (only in benchmark mode to avoid cluttering terminal)
-	if modeKey == "benchmark" {
-		go metrics.Report()
+	if name == "benchmark" || name == "bench" {
+		go metrics.Report(rd.Lost, queue)
+	} else {
+		go warnLost(rd.Lost, 10*time.Second)
+		go queue.warnBackpressure(10 * time.Second)
+	}
+	if o.rollupInterval > 0 && !o.tui {
+		go rollups.Print(os.Stderr, o.rollupInterval)
+	}
+	// 10. Running report for benchmark mode, lost event warnings otherwise
+
+	// Event pipeline: ring buffer reader -> queue -> processor. The queue
+	// absorbs short bursts while the processor is busy formatting.
+	go readEvents(rd, queue)
+
+	// Histograms are drained on the processor goroutine too, so their output
+	// can't interleave with an event's
+	var histTick <-chan time.Time
+	if o.histInterval > 0 {
+		ticker := time.NewTicker(o.histInterval)
+		defer ticker.Stop()
+		histTick = ticker.C
+	}
+	flushHistograms := func() {
+		hists, err := drainHistograms(objs.LatencyHist, buckets)
+		if err != nil {
+			slog.Warn("reading histograms", "err", err)
+		}
+		for _, o := range observers {
+			if ho, ok := o.(histogramObserver); ok {
+				ho.ObserveHistograms(hists)
+			}
+		}
+		if mode.DoPrint {
+			processor.ProcessHistograms(hists)
+		}
+	}
+
+	// Top mode's table is drained the same way. The API can attach the top
+	// and listen probes later, so their tables are drained regardless then.
+	var topTick <-chan time.Time
+	var topClear bool
+	if probeManager.Active()&hookTop != 0 || o.listenAddr != "" {
+		ticker := time.NewTicker(o.topInterval)
+		defer ticker.Stop()
+		topTick = ticker.C
+		stat, err := os.Stdout.Stat()
+		topClear = o.format == formatText && err == nil && stat.Mode()&os.ModeCharDevice != 0
+	}
+
+	// And the listen queue drops, whose owners are found in /proc
+	var listenTick <-chan time.Time
+	owners := newListenOwners()
+	if probeManager.Active()&hookListen != 0 || o.listenAddr != "" {
+		ticker := time.NewTicker(o.topInterval)
+		defer ticker.Stop()
+		listenTick = ticker.C
+	}
+	flushListenDrops := func() {
+		entries, err := drainListenDrops(objs.ListenDrops)
+		if err != nil {
+			slog.Warn("reading listen queue drops", "err", err)
+		}
+		owners.Resolve(entries)
+		for i := range entries {
+			entries[i].NetnsName = netns.Name(entries[i].Netns)
+		}
+		for _, o := range observers {
+			if lo, ok := o.(listenObserver); ok {
+				lo.ObserveListenDrops(entries)
+			}
+		}
+		if name == "listen" {
+			processor.PrintListenDrops(entries)
+		}
+	}
+
+	// And so are the --aggregate counters
+	var aggTick <-chan time.Time
+	if o.aggregate {
+		ticker := time.NewTicker(o.topInterval)
+		defer ticker.Stop()
+		aggTick = ticker.C
+	}
+	flushAggregates := func() {
+		aggs, err := drainAggregates(&objs)
+		if err != nil {
+			slog.Warn("reading aggregates", "err", err)
+		}
+		for i := range aggs.Retransmits {
+			aggs.Retransmits[i].NetnsName = netns.Name(aggs.Retransmits[i].Netns)
+		}
+		for _, o := range observers {
+			if ao, ok := o.(aggregateObserver); ok {
+				ao.ObserveAggregates(aggs, processor)
+			}
+		}
+		if mode.DoPrint {
+			processor.PrintAggregates(aggs)
+		}
+	}
+
+	// --coalesce holds repeated events on the processor goroutine until
+	// their window is over, checked ten times per window
+	var coalesce *coalescer
+	var coalesceTick <-chan time.Time
+	if o.coalesce > 0 {
+		coalesce = newCoalescer(o.coalesce)
+		ticker := time.NewTicker(max(o.coalesce/10, 10*time.Millisecond))
+		defer ticker.Stop()
+		coalesceTick = ticker.C
+	}
+	handleEvent := func(event *TcpEvent) {
+		for _, en := range enrichers {
+			en.Enrich(event)
+		}
+		for _, o := range observers {
+			o.Observe(event, processor)
+		}
+		if name == "busy" {
+			processor.ProcessEventBusy(event)
+		} else {
+			processor.ProcessEvent(event, mode.DoPrint)
+		}
+	}
+
+	// The watchdog is pinged from the processor goroutine, so systemd
+	// restarts a monitor that stopped handling events, not just a dead one
+	var watchdogTick <-chan time.Time
+	if interval := watchdogInterval(); notifier != nil && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdogTick = ticker.C
 	}
-	// 10. Running report for benchmark mode
 
-	// Event reader
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
 		for {
 			select {
-			case <-stopper:
-				return
-			default:
-			}
-
-			record, err := rd.Read()
-			if err != nil {
-				if errors.Is(err, ringbuf.ErrClosed) {
+			case batch, ok := <-queue.batches:
+				if !ok {
+					if coalesce != nil {
+						for _, e := range coalesce.Flush() {
+							handleEvent(&e)
+						}
+					}
+					if histTick != nil {
+						flushHistograms() // Whatever the last partial interval collected
+					}
+					if aggTick != nil {
+						flushAggregates()
+					}
+					if listenTick != nil {
+						flushListenDrops()
+					}
 					return
 				}
-				continue
+				var now time.Time
+				if coalesce != nil {
+					now = time.Now()
+				}
+				for i := range batch.events {
+					event := &batch.events[i]
+					if coalesce != nil && coalesce.Add(event, now) {
+						continue
+					}
+					handleEvent(event)
+				}
+				queue.done(batch)
+			case now := <-coalesceTick:
+				for _, e := range coalesce.Due(now) {
+					handleEvent(&e)
+				}
+			case <-histTick:
+				flushHistograms()
+			case <-aggTick:
+				flushAggregates()
+			case <-listenTick:
+				flushListenDrops()
+			case <-watchdogTick:
+				notifier.Notify(fmt.Sprintf("WATCHDOG=1\nSTATUS=%d events, %d lost", metrics.EventsRead.Load(), rd.Lost()))
+			case <-topTick:
+				entries, err := drainTop(objs.TopBytes)
+				if err != nil {
+					slog.Warn("reading top talkers", "err", err)
+				}
+				for _, o := range observers {
+					if to, ok := o.(topObserver); ok {
+						to.ObserveTop(entries)
+					}
+				}
+				if name == "top" && !o.tui {
+					processor.PrintTop(entries, o.topN, topClear)
+				}
 			}
+		}
+	}()
 
-			if len(record.RawSample) < int(unsafe.Sizeof(monitorEvent{})) {
-				continue
+	if tui != nil {
+		go func() {
+			if err := tui.Run(); err != nil {
+				slog.Warn("dashboard stopped", "err", err)
+				tui.Stop()
 			}
+		}()
+	}
 
-			event := *(*monitorEvent)(unsafe.Pointer(&record.RawSample[0]))
+	var load *benchLoad
+	if name == "bench" {
+		if load, err = startBenchLoad(o, metrics, programs); err != nil {
+			fatal("starting the load", "err", err)
+		}
+	}
 
-			if modeKey == "busy" {
-				processor.ProcessEventBusy(&event)
-			} else {
-				processor.ProcessEvent(&event, mode.DoPrint)
-			}
+	// Last, everything that needs root is done by now
+	if dropTo != nil {
+		var owned []string
+		if o.pidFile != "" {
+			owned = append(owned, o.pidFile)
 		}
-	}()
+		if o.pinPath != "" {
+			owned = append(owned, o.pinPath, pinLinksDir(o.pinPath))
+		}
+		if path, ok := strings.CutPrefix(o.controlAddr, "unix:"); ok {
+			owned = append(owned, path)
+		}
+		if err := dropTo.handOver(owned...); err != nil {
+			fatal("handing files over to --user", "user", o.runAsUser, "err", err)
+		}
+		if err := dropTo.drop(); err != nil {
+			fatal("dropping privileges", "user", o.runAsUser, "err", err)
+		}
+		slog.Info("dropped privileges", "user", o.runAsUser, "uid", dropTo.uid, "gid", dropTo.gid, "caps", dropTo.keptNames())
+	}
 
-	// Wait for stop signal
-	<-stopper
+	if health != nil {
+		sinks.AddHealth(health) // Kafka, NATS and syslog say whether their destination is reachable too
+		health.Ready(true)
+	}
+	notifier.Notify("READY=1\nSTATUS=Monitoring")
 
-	// Flush any remaining buffered output
-	processor.Flush()
+	// Wait for stop signal, or for the user to quit the dashboard
+	select {
+	case <-stopper:
+	case <-tuiDone:
+	}
+	notifier.Notify("STOPPING=1")
+	if health != nil {
+		health.Ready(false)
+	}
+	var loadStats benchLoadStats
+	var loadElapsed time.Duration
+	if load != nil {
+		if loadStats, loadElapsed, err = load.Stop(); err != nil {
+			slog.Warn("stopping the load", "err", err)
+		}
+	}
+	if tui != nil {
+		tui.Stop()
+	}
+	signal.Stop(stopper) // A second Ctrl+C kills us if draining hangs
+	fmt.Fprintf(os.Stderr, "\nStopping, draining events...\n")
+
+	// Detach first so nothing new arrives, then let readEvents read what's
+	// left in the buffer; it returns (and closes the channel) once the
+	// buffer is empty past the deadline, and the processor drains the queue.
+	// Links pinned with --pin-path stay attached and keep the buffer from
+	// ever being empty, so reading is cut off shutdownDrain after shutdown
+	// started, whatever is left.
+	const (
+		shutdownDrain   = 2 * time.Second // For reading what's left in the buffer
+		shutdownTimeout = 5 * time.Second // For the processor to be done with it
+	)
+	stopping := time.Now()
+	if err := probeManager.Close(); err != nil {
+		slog.Warn("detaching probes", "err", err)
+	}
+	rd.SetDeadline(stopping)
+	cutoff := time.AfterFunc(time.Until(stopping.Add(shutdownDrain)), func() { rd.Close() })
 
-	// Give reader goroutine time to finish
+	processorDone := true
 	select {
 	case <-done:
-	case <-time.After(500 * time.Millisecond):
+	case <-time.After(time.Until(stopping.Add(shutdownTimeout))):
+		slog.Warn("gave up waiting for the processor, its output and sinks are left as they are", "after", shutdownTimeout)
+		processorDone = false
+	}
+	cutoff.Stop()
+	rd.Close()
+
+	// Flush any remaining buffered output, the sinks' queues first. Only
+	// once the processor has returned: until then it may still be writing
+	// to the same buffer and files. A sink whose queue didn't drain in time
+	// is left open, its goroutine may still be inside it.
+	if processorDone {
+		processor.Flush()
+		sinks.Close(5 * time.Second)
+		if csvSink != nil && !sinks.Busy(csvSink) {
+			if err := csvSink.Close(); err != nil {
+				slog.Warn("closing CSV output", "path", o.csvPath, "err", err)
+			}
+		}
+		if recordSink != nil && !sinks.Busy(recordSink) {
+			if err := recordSink.Close(); err != nil {
+				slog.Warn("closing --out", "path", o.recordPath, "err", err)
+			}
+		}
+		if grpcServer != nil && !sinks.Busy(grpcServer) {
+			grpcServer.Close()
+		}
+		for _, plugin := range plugins {
+			if !sinks.Busy(plugin) {
+				plugin.Close()
+			}
+		}
+		if statsd != nil && !sinks.Busy(statsd) {
+			statsd.Close()
+		}
+		if ipfix != nil && !sinks.Busy(ipfix) {
+			ipfix.Close()
+		}
+		if syslogSink != nil && !sinks.Busy(syslogSink) {
+			syslogSink.Close()
+		}
+		if natsSink != nil && !sinks.Busy(natsSink) {
+			natsSink.Close()
+		}
+		if kafkaSink != nil && !sinks.Busy(kafkaSink) {
+			if err := kafkaSink.Close(); err != nil {
+				slog.Warn("closing Kafka producer", "err", err)
+			}
+		}
+		if alerter != nil {
+			alerter.Close()
+		}
+		if sqliteSink != nil && !sinks.Busy(sqliteSink) {
+			if err := sqliteSink.Close(); err != nil {
+				slog.Warn("closing database", "path", o.dbPath, "err", err)
+			}
+		}
+		if pcap != nil && !sinks.Busy(pcap) {
+			if err := pcap.Close(); err != nil {
+				slog.Warn("closing pcap output", "path", o.pcapPath, "err", err)
+			}
+		}
+	}
+
+	if otlpExporter != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := otlpExporter.Shutdown(ctx); err != nil {
+			slog.Warn("flushing OTLP export", "err", err)
+		}
+		cancel()
 	}
 
-	metrics.FinalReport(mode.Name)
+	sampled := sumCounters(objs.SampleCounts) // Only counted while sampling, which monitor set may have changed
+	metrics.FinalReport(mode.Name, rd.Lost(), sampled, sumCounters(objs.SuppressedEvents), queue.Dropped())
+	sinks.Report(os.Stderr)
+	if interfaces != nil {
+		interfaces.Report(os.Stderr)
+	}
+	if programs != nil {
+		printProgramStats(os.Stderr, readProgramStats(programs), time.Since(metrics.StartTime))
+	}
+	if load != nil {
+		load.Report(os.Stderr, loadStats, loadElapsed, metrics, rd.Lost(), queue.Dropped(), programs)
+	}
+	if name != "benchmark" && name != "bench" {
+		summary.Print(os.Stderr, processor, 10)
+	}
+	if processReport != nil {
+		processReport.Print(os.Stderr, o.processReport)
+	}
+	mptcp.Report(os.Stderr, mptcpReportConns)
+	if name == "listen" {
+		listeners.Report(os.Stderr, listenersReportRows)
+	}
 }
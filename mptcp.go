@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// An MPTCP connection is one socket to the application over several TCP
+// subflows, each with a 4-tuple of its own and often over another
+// interface. Counted by tuple like plain TCP, a lossy path shows up as a
+// handful of unrelated connections, and the one the application is stuck
+// on looks fine. The programs tag each subflow's events with the token of
+// its connection and its subflow id (set_mptcp in bpf/monitor.c), and
+// MptcpTracker groups them back: per connection, its subflows and the
+// retransmits, drops and resets of each, on GET /api/v1/mptcp and at exit.
+// Hosts without MPTCP traffic never get an entry.
+
+const (
+	mptcpMaxConns    = 4096 // Tracked at once, finished ones make room first
+	mptcpMaxSubflows = 8    // Per connection, the kernel's default limit is 2 more than the first
+	mptcpReportConns = 10   // Shown at exit
+)
+
+// Tokens are only unique within a network namespace
+type mptcpKey struct {
+	netns, token uint32
+}
+
+// A subflow by its tuple, our end first, which is all there is before 6.6
+type subflowKey struct {
+	local, remote netip.AddrPort
+}
+
+type mptcpConn struct {
+	pid         uint32
+	comm        string
+	first, last time.Time
+	subflows    map[subflowKey]*mptcpSubflow
+}
+
+type mptcpSubflow struct {
+	id               uint32 // 0 before 6.6
+	state            string
+	closed           bool
+	retransmits      uint64
+	drops, resets    uint64
+	sent, received   uint64 // From its close event
+	closeRetransmits uint64 // The kernel's count at close, with the ones the events left out
+	first            time.Time
+}
+
+type MptcpTracker struct {
+	mu    sync.Mutex // Observe runs on the processor goroutine, readers on their own
+	conns map[mptcpKey]*mptcpConn
+}
+
+// GET /api/v1/mptcp, most trouble first
+type apiMptcpConn struct {
+	Token       string            `json:"token"` // In hex, like ss -M
+	Netns       uint32            `json:"netns,omitempty"`
+	Pid         uint32            `json:"pid"`
+	Comm        string            `json:"comm"`
+	FirstSeen   time.Time         `json:"first_seen"`
+	LastSeen    time.Time         `json:"last_seen"`
+	Retransmits uint64            `json:"retransmits"` // Of all its subflows
+	Drops       uint64            `json:"drops"`
+	Resets      uint64            `json:"resets"`
+	Subflows    []apiMptcpSubflow `json:"subflows"` // By id, or before 6.6 in the order first seen
+}
+
+type apiMptcpSubflow struct {
+	ID            uint32 `json:"id,omitempty"`
+	Local         string `json:"local"` // ip:port
+	Remote        string `json:"remote"`
+	State         string `json:"state,omitempty"`
+	Closed        bool   `json:"closed"`
+	Retransmits   uint64 `json:"retransmits"`
+	Drops         uint64 `json:"drops"`
+	Resets        uint64 `json:"resets"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+
+	first time.Time
+}
+
+func NewMptcpTracker() *MptcpTracker {
+	return &MptcpTracker{conns: make(map[mptcpKey]*mptcpConn)}
+}
+
+func (t *MptcpTracker) Observe(event *TcpEvent, p *EventProcessor) {
+	if event.MptcpToken == 0 || event.Family == 0 {
+		return
+	}
+	switch event.Type {
+	case eventState, eventClose, eventRetransmit, eventReset, eventDrop:
+	default:
+		return
+	}
+
+	now := event.when()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.conn(mptcpKey{netns: event.Netns, token: event.MptcpToken}, now)
+	c.last = now
+	if c.pid == 0 && event.Pid != 0 { // Retransmits and drops may run in softirq
+		c.pid, c.comm = event.Pid, commString(event.Comm[:])
+	}
+	s := c.subflow(event, now)
+	if s == nil {
+		return
+	}
+	if event.MptcpSubflow != 0 {
+		s.id = event.MptcpSubflow
+	}
+	n := event.occurrences()
+	switch event.Type {
+	case eventState:
+		s.state = p.stateName(event.State)
+		s.closed = event.State == tcpClose
+	case eventClose:
+		s.closed = true
+		s.sent, s.received = event.BytesSent, event.BytesReceived
+		s.closeRetransmits = uint64(event.Retransmits)
+	case eventRetransmit:
+		s.retransmits += n
+	case eventReset:
+		s.resets += n
+	case eventDrop:
+		s.drops += n
+	}
+}
+
+func (t *MptcpTracker) conn(k mptcpKey, now time.Time) *mptcpConn {
+	if c, ok := t.conns[k]; ok {
+		return c
+	}
+	if len(t.conns) >= mptcpMaxConns {
+		t.evict()
+	}
+	c := &mptcpConn{first: now, subflows: make(map[subflowKey]*mptcpSubflow)}
+	t.conns[k] = c
+	return c
+}
+
+// evict makes room by forgetting the connection finished longest ago, or
+// without one, the one idle longest
+func (t *MptcpTracker) evict() {
+	var oldest mptcpKey
+	var oldestConn *mptcpConn
+	for k, c := range t.conns {
+		if oldestConn == nil || c.finished() && !oldestConn.finished() ||
+			c.finished() == oldestConn.finished() && c.last.Before(oldestConn.last) {
+			oldest, oldestConn = k, c
+		}
+	}
+	delete(t.conns, oldest)
+}
+
+func (c *mptcpConn) finished() bool {
+	for _, s := range c.subflows {
+		if !s.closed {
+			return false
+		}
+	}
+	return true
+}
+
+// subflow is the event's, nil once the connection has as many as are kept
+func (c *mptcpConn) subflow(event *TcpEvent, now time.Time) *mptcpSubflow {
+	src := netip.AddrPortFrom(netip.AddrFrom16(event.Saddr).Unmap(), event.Sport)
+	dst := netip.AddrPortFrom(netip.AddrFrom16(event.Daddr).Unmap(), event.Dport)
+	k := subflowKey{local: src, remote: dst}
+	if event.Type == eventDrop { // Mostly of received packets, unless it's a subflow we know the other way round
+		if _, ok := c.subflows[k]; !ok {
+			k = subflowKey{local: dst, remote: src}
+		}
+	}
+	if s, ok := c.subflows[k]; ok {
+		return s
+	}
+	if len(c.subflows) >= mptcpMaxSubflows {
+		return nil
+	}
+	s := &mptcpSubflow{first: now}
+	c.subflows[k] = s
+	return s
+}
+
+// Connections is every MPTCP connection tracked, most trouble first, then
+// most recently active
+func (t *MptcpTracker) Connections() []apiMptcpConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	all := make([]apiMptcpConn, 0, len(t.conns))
+	for k, c := range t.conns {
+		conn := apiMptcpConn{
+			Token:     mptcpToken(k.token),
+			Netns:     k.netns,
+			Pid:       c.pid,
+			Comm:      c.comm,
+			FirstSeen: c.first,
+			LastSeen:  c.last,
+		}
+		for sk, s := range c.subflows {
+			sub := apiMptcpSubflow{
+				ID:            s.id,
+				Local:         sk.local.String(),
+				Remote:        sk.remote.String(),
+				State:         s.state,
+				Closed:        s.closed,
+				Retransmits:   max(s.retransmits, s.closeRetransmits),
+				Drops:         s.drops,
+				Resets:        s.resets,
+				BytesSent:     s.sent,
+				BytesReceived: s.received,
+				first:         s.first,
+			}
+			conn.Retransmits += sub.Retransmits
+			conn.Drops += sub.Drops
+			conn.Resets += sub.Resets
+			conn.Subflows = append(conn.Subflows, sub)
+		}
+		sort.Slice(conn.Subflows, func(i, j int) bool {
+			a, b := conn.Subflows[i], conn.Subflows[j]
+			if a.ID != b.ID {
+				return a.ID < b.ID
+			}
+			return a.first.Before(b.first)
+		})
+		all = append(all, conn)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if ta, tb := a.trouble(), b.trouble(); ta != tb {
+			return ta > tb
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	return all
+}
+
+func (c apiMptcpConn) trouble() uint64 { return c.Retransmits + c.Drops + c.Resets }
+
+func (t *MptcpTracker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/mptcp", t.handleConnections)
+}
+
+func (t *MptcpTracker) handleConnections(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, t.Connections())
+}
+
+// Report writes the connections with the most trouble and their subflows,
+// nothing when there was no MPTCP traffic, e.g.
+//
+//	MPTCP connections (2 seen):
+//	  token 5b1e9a03 | PID 4242 curl | 120 retransmits, 3 drops, 0 resets
+//	    subflow 1  10.0.0.5:40112 -> 203.0.113.9:443     ESTABLISHED      2 retrans      0 drops      0 resets
+//	    subflow 2  192.168.1.20:51230 -> 203.0.113.9:443 ESTABLISHED    118 retrans      3 drops      0 resets
+func (t *MptcpTracker) Report(w io.Writer, n int) {
+	all := t.Connections()
+	if len(all) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nMPTCP connections (%d seen):\n", len(all))
+	if len(all) > n {
+		all = all[:n]
+	}
+	for _, c := range all {
+		fmt.Fprintf(w, "  token %s | PID %d %s | %d retransmits, %d drops, %d resets\n",
+			c.Token, c.Pid, c.Comm, c.Retransmits, c.Drops, c.Resets)
+		for _, s := range c.Subflows {
+			id := "-" // Before 6.6
+			if s.ID != 0 {
+				id = strconv.FormatUint(uint64(s.ID), 10)
+			}
+			state := s.State
+			if s.Closed {
+				state = "CLOSED"
+			}
+			fmt.Fprintf(w, "    subflow %-2s %-40s %-12s %6d retrans %6d drops %6d resets\n",
+				id, s.Local+" -> "+s.Remote, state, s.Retransmits, s.Drops, s.Resets)
+		}
+	}
+}
+
+// mptcpToken is a token as ss -M prints it
+func mptcpToken(token uint32) string {
+	return strconv.FormatUint(uint64(token), 16)
+}
+
+// mptcpSubflowLabel is the text output's, e.g. 5b1e9a03 subflow 2
+func mptcpSubflowLabel(token, subflow uint32) string {
+	if subflow == 0 {
+		return mptcpToken(token)
+	}
+	return fmt.Sprintf("%s subflow %d", mptcpToken(token), subflow)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Events waiting for the publisher, like kafkaQueueSize
+const natsQueueSize = 10000
+
+// Placeholders for --nats-subject, each filled in with one subject token
+var natsPlaceholders = []string{"{host}", "{type}", "{comm}", "{reason}", "{namespace}", "{pod}"}
+
+// NATSSink publishes every event to NATS (--nats-url), on a subject built
+// from --nats-subject per event. Core NATS is fire and forget and buffers
+// while reconnecting; with --nats-jetstream the server acks every message
+// into a stream. Either way a publisher goroutine does the sending behind a
+// bounded queue, so a slow or unreachable server costs events, not the
+// pipeline.
+type NATSSink struct {
+	nc       *nats.Conn
+	js       nats.JetStreamContext // nil without --nats-jetstream
+	subject  string
+	encoding string
+	host     string // As a subject token
+
+	mu      sync.RWMutex // Write locked only by Close, see KafkaSink
+	closed  bool
+	queue   chan *nats.Msg
+	dropped atomic.Uint64 // Queue full
+	failed  atomic.Uint64 // Publish errors and missing acks
+	lastErr atomic.Value  // error
+	done    chan struct{}
+}
+
+// natsToken makes a value safe as one subject token: no separators,
+// wildcards or whitespace
+func natsToken(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func NewNATSSink(url, subject, encoding string, jetStream bool, stream string) (*NATSSink, error) {
+	if encoding != formatJSON && encoding != encodingProtobuf {
+		return nil, fmt.Errorf("unknown encoding %q, use: json or protobuf", encoding)
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("empty subject")
+	}
+	if stream != "" && !jetStream {
+		return nil, fmt.Errorf("a stream needs --nats-jetstream")
+	}
+
+	s := &NATSSink{
+		subject:  subject,
+		encoding: encoding,
+		queue:    make(chan *nats.Msg, natsQueueSize),
+		done:     make(chan struct{}),
+	}
+	host, _ := os.Hostname()
+	s.host = natsToken(host)
+
+	nc, err := nats.Connect(url,
+		nats.Name("tcpmon "+host),
+		nats.MaxReconnects(-1), // Forever, the monitor outlives server restarts
+		nats.ReconnectWait(2*time.Second),
+		nats.ReconnectBufSize(8*1024*1024),
+		nats.RetryOnFailedConnect(true), // Start even if the server isn't up yet
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("disconnected from NATS, reconnecting", "err", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("reconnected to NATS", "url", nc.ConnectedUrlRedacted())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.nc = nc
+
+	if jetStream {
+		s.js, err = nc.JetStream(
+			nats.PublishAsyncMaxPending(4096),
+			nats.PublishAsyncErrHandler(func(_ nats.JetStream, _ *nats.Msg, err error) {
+				s.fail(err)
+			}),
+		)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if stream != "" {
+			if err := s.ensureStream(stream); err != nil {
+				nc.Close()
+				return nil, fmt.Errorf("stream %s: %w", stream, err)
+			}
+		}
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// ensureStream creates stream for the subjects the template can produce,
+// leaving an existing one (and its limits) alone
+func (s *NATSSink) ensureStream(stream string) error {
+	_, err := s.js.StreamInfo(stream)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return err
+	}
+	wildcard := s.subject
+	for _, p := range natsPlaceholders {
+		wildcard = strings.ReplaceAll(wildcard, p, "*")
+	}
+	_, err = s.js.AddStream(&nats.StreamConfig{Name: stream, Subjects: []string{wildcard}})
+	return err
+}
+
+func (s *NATSSink) fail(err error) {
+	s.failed.Add(1)
+	s.lastErr.Store(err)
+}
+
+func (s *NATSSink) subjectFor(event *TcpEvent, p *EventProcessor) string {
+	if !strings.Contains(s.subject, "{") {
+		return s.subject
+	}
+	var reason, namespace, pod string
+	if event.Type == eventDrop {
+		reason = p.reasonName(event.Reason)
+	}
+	if event.Pod != nil {
+		namespace, pod = event.Pod.Namespace, event.Pod.Name
+	}
+	return strings.NewReplacer(
+		"{host}", s.host,
+		"{type}", eventTypeNames[event.Type],
+		"{comm}", natsToken(commString(event.Comm[:])),
+		"{reason}", natsToken(reason),
+		"{namespace}", natsToken(namespace),
+		"{pod}", natsToken(pod),
+	).Replace(s.subject)
+}
+
+func (s *NATSSink) Observe(event *TcpEvent, p *EventProcessor) {
+	msg := &nats.Msg{
+		Subject: s.subjectFor(event, p),
+		Data:    encodeEvent(event, p, s.encoding),
+		Header:  nats.Header{"encoding": []string{s.encoding}, "schema": []string{eventSchemaHeader}},
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *NATSSink) run() {
+	defer close(s.done)
+	warn := time.NewTicker(10 * time.Second)
+	defer warn.Stop()
+	var reported uint64
+
+	for {
+		select {
+		case msg, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			var err error
+			if s.js != nil {
+				// Blocks for a while once 4096 acks are outstanding, which is
+				// the backpressure; the ack itself is checked asynchronously
+				_, err = s.js.PublishMsgAsync(msg)
+			} else {
+				// Buffered while reconnecting, an error once that's full
+				err = s.nc.PublishMsg(msg)
+			}
+			if err != nil {
+				s.fail(err)
+			}
+		case <-warn.C:
+			if n := s.dropped.Load() + s.failed.Load(); n > reported {
+				slog.Warn("events not delivered to NATS so far", "events", n,
+					"queue_full", s.dropped.Load(), "failed", s.failed.Load(), "last_err", s.lastErr.Load())
+				reported = n
+			}
+		}
+	}
+}
+
+// Health is for /readyz: whether the client is connected, rather than
+// buffering while it reconnects
+func (s *NATSSink) Health() error {
+	if !s.nc.IsConnected() {
+		return fmt.Errorf("not connected, %s", s.nc.Status())
+	}
+	return nil
+}
+
+// Close publishes what's still queued and waits for it to reach the server
+// (and the acks, with JetStream), giving up after a few seconds
+func (s *NATSSink) Close() {
+	s.mu.Lock()
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case <-s.done:
+		if s.js != nil {
+			select {
+			case <-s.js.PublishAsyncComplete():
+			case <-timeout:
+			}
+		}
+	case <-timeout:
+	}
+	if err := s.nc.FlushTimeout(time.Second); err != nil && s.nc.IsConnected() {
+		slog.Warn("flushing NATS", "err", err)
+	}
+	if n := s.dropped.Load() + s.failed.Load() + uint64(len(s.queue)); n > 0 {
+		slog.Warn("events were not delivered to NATS", "events", n)
+	}
+	s.nc.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Containers each get their own network namespace, often with the same
+// 10.0.0.0/8 or 172.17.0.0/16 addresses, so a tuple alone doesn't say which
+// connection an event is about. Events carry the inode number of their
+// namespace, the one ip netns identify and readlink /proc/<pid>/ns/net show
+// as net:[<inode>], and netnsResolver names it.
+
+// netnsRunDir is where ip netns add bind mounts the namespaces it names
+const netnsRunDir = "/var/run/netns"
+
+// netnsMissingTTL is how long a namespace no process was found in stays
+// unnamed before it's looked for again
+const netnsMissingTTL = 5 * time.Minute
+
+// netnsResolver maps namespace inodes to names: "host" for the namespace
+// tcpmon runs in, the ip netns name, the container whose processes use it,
+// or failing that the lowest PID in it. Like cgroupResolver, an unknown
+// inode schedules a rescan instead of blocking.
+type netnsResolver struct {
+	host uint32
+
+	mu      sync.RWMutex
+	names   map[uint32]string    // Found in the last scan
+	missing map[uint32]time.Time // Namespaces no process was found in, and since when
+	pending map[uint32]bool      // Asked for since the last scan
+
+	kick chan struct{}
+}
+
+func newNetnsResolver() *netnsResolver {
+	r := &netnsResolver{
+		missing: make(map[uint32]time.Time),
+		pending: make(map[uint32]bool),
+		kick:    make(chan struct{}, 1),
+	}
+	r.host, _ = netnsInode("/proc/self/ns/net")
+	r.scan()
+	go r.loop()
+	return r
+}
+
+// Name returns the namespace's name, or "" while it's unknown
+// Safe to call from any goroutine, and on a nil resolver
+func (r *netnsResolver) Name(inode uint32) string {
+	if r == nil || inode == 0 {
+		return ""
+	}
+	if inode == r.host {
+		return "host"
+	}
+	r.mu.RLock()
+	name, ok := r.names[inode]
+	if !ok {
+		_, ok = r.missing[inode]
+	}
+	r.mu.RUnlock()
+
+	if !ok {
+		r.mu.Lock()
+		r.pending[inode] = true
+		r.mu.Unlock()
+		select {
+		case r.kick <- struct{}{}:
+		default: // A rescan is already pending
+		}
+	}
+	return name
+}
+
+func (r *netnsResolver) Enrich(event *TcpEvent) {
+	event.NetnsName = r.Name(event.Netns)
+}
+
+func (r *netnsResolver) loop() {
+	for range r.kick {
+		r.scan()
+		time.Sleep(5 * time.Second) // New namespaces come with a burst of events, scan at most this often
+	}
+}
+
+// scan finds a process in every namespace, then names the namespaces ip
+// netns knows, which take precedence
+func (r *netnsResolver) scan() {
+	names := make(map[uint32]string)
+	lowest := make(map[uint32]uint32) // inode -> lowest PID, the container's init
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		slog.Warn("listing /proc", "err", err)
+	}
+	for _, e := range entries {
+		pid, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		inode, ok := netnsInode(fmt.Sprintf("/proc/%d/ns/net", pid))
+		if !ok || inode == r.host {
+			continue // Gone already, or one of the many host processes
+		}
+		if p, seen := lowest[inode]; !seen || uint32(pid) < p {
+			lowest[inode] = uint32(pid)
+		}
+	}
+	for inode, pid := range lowest {
+		names[inode] = processNetnsName(pid)
+	}
+
+	if files, err := os.ReadDir(netnsRunDir); err == nil {
+		for _, f := range files {
+			if inode, ok := netnsInode(filepath.Join(netnsRunDir, f.Name())); ok {
+				names[inode] = f.Name()
+			}
+		}
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	for inode, since := range r.missing {
+		if _, ok := names[inode]; ok || now.Sub(since) >= netnsMissingTTL {
+			delete(r.missing, inode)
+		}
+	}
+	for inode := range r.pending {
+		if _, ok := names[inode]; !ok {
+			r.missing[inode] = now // Not found, don't scan for it again for a while
+		}
+	}
+	r.pending = make(map[uint32]bool)
+	r.names = names
+	r.mu.Unlock()
+}
+
+// processNetnsName names a namespace after the process found in it:
+// container:<id> if it's in a container's cgroup, else pid:<pid> (<comm>)
+func processNetnsName(pid uint32) string {
+	if path, ok := procCgroupPath(pid); ok {
+		if id := containerIDFromCgroup(path); id != "" {
+			return "container:" + id[:12] // The short form docker ps shows
+		}
+	}
+	comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	return fmt.Sprintf("pid:%d (%s)", pid, strings.TrimSpace(string(comm)))
+}
+
+// netnsInode stats a namespace file, /proc/<pid>/ns/net or an ip netns
+// bind mount; nsfs makes the inode number the namespace's
+func netnsInode(path string) (uint32, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(fi.Sys().(*syscall.Stat_t).Ino), true
+}
+
+// netnsLabel is how text output shows a namespace, by name when known
+func netnsLabel(inode uint32, name string) string {
+	if inode == 0 {
+		return "-"
+	}
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("net:[%d]", inode)
+}
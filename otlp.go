@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/metric"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OTLPExporter ships every event as an OTel log record and keeps drop and
+// retransmit counters as OTel metrics, both over OTLP/gRPC to one collector
+type OTLPExporter struct {
+	loggers     *sdklog.LoggerProvider
+	meters      *sdkmetric.MeterProvider
+	logger      otellog.Logger
+	drops       metric.Int64Counter
+	retransmits metric.Int64Counter
+	dsacks      metric.Int64Counter
+	resets      metric.Int64Counter
+	zeroWindows metric.Int64Counter
+	udpErrors   metric.Int64Counter
+	icmpErrors  metric.Int64Counter
+	keepalives  metric.Int64Counter
+	fastopens   metric.Int64Counter
+	buffers     metric.Int64Counter
+	synFloods   metric.Int64Counter
+	tlsTimes    metric.Float64Histogram
+}
+
+// labels (--label) become resource attributes, so they're on every record and metric
+func NewOTLPExporter(ctx context.Context, endpoint string, insecure bool, labels map[string]string) (*OTLPExporter, error) {
+	attrs := []attribute.KeyValue{semconv.ServiceName("ebpf-tcp-monitor")}
+	for k, v := range labels {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+
+	logOpts := []otlploggrpc.Option{otlploggrpc.WithEndpoint(endpoint)}
+	metricOpts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(endpoint)}
+	if insecure {
+		logOpts = append(logOpts, otlploggrpc.WithInsecure())
+		metricOpts = append(metricOpts, otlpmetricgrpc.WithInsecure())
+	}
+
+	logExp, err := otlploggrpc.New(ctx, logOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP log exporter: %w", err)
+	}
+	metricExp, err := otlpmetricgrpc.New(ctx, metricOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP metric exporter: %w", err)
+	}
+
+	e := &OTLPExporter{
+		// Batching keeps the event path from blocking on the network
+		loggers: sdklog.NewLoggerProvider(
+			sdklog.WithResource(res),
+			sdklog.WithProcessor(sdklog.NewBatchProcessor(logExp))),
+		meters: sdkmetric.NewMeterProvider(
+			sdkmetric.WithResource(res),
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExp, sdkmetric.WithInterval(10*time.Second)))),
+	}
+	e.logger = e.loggers.Logger("ebpf-tcp-monitor")
+
+	meter := e.meters.Meter("ebpf-tcp-monitor")
+	if e.drops, err = meter.Int64Counter("tcpmon.drops",
+		metric.WithDescription("Packets dropped by the kernel")); err != nil {
+		return nil, err
+	}
+	if e.retransmits, err = meter.Int64Counter("tcpmon.retransmits",
+		metric.WithDescription("TCP segments retransmitted")); err != nil {
+		return nil, err
+	}
+	if e.dsacks, err = meter.Int64Counter("tcpmon.dsacks",
+		metric.WithDescription("DSACKs received, segments the peer got twice, usually after a spurious retransmit")); err != nil {
+		return nil, err
+	}
+	if e.resets, err = meter.Int64Counter("tcpmon.resets",
+		metric.WithDescription("TCP resets sent and received")); err != nil {
+		return nil, err
+	}
+	if e.zeroWindows, err = meter.Int64Counter("tcpmon.zero_windows",
+		metric.WithDescription("Connections stalled on a zero receive window, ours (sent) or the peer's (received)")); err != nil {
+		return nil, err
+	}
+	if e.udpErrors, err = meter.Int64Counter("tcpmon.udp_errors",
+		metric.WithDescription("UDP sends that failed and datagrams that couldn't be queued, with --proto udp")); err != nil {
+		return nil, err
+	}
+	if e.icmpErrors, err = meter.Int64Counter("tcpmon.icmp_errors",
+		metric.WithDescription("ICMP destination unreachable and packet too big messages about TCP segments sent")); err != nil {
+		return nil, err
+	}
+	if e.keepalives, err = meter.Int64Counter("tcpmon.keepalive_failures",
+		metric.WithDescription("Keepalive probes left unanswered, and connections keepalive closed (timeout)")); err != nil {
+		return nil, err
+	}
+	if e.fastopens, err = meter.Int64Counter("tcpmon.fastopen",
+		metric.WithDescription("TCP Fast Open SYNs sent and received, by outcome")); err != nil {
+		return nil, err
+	}
+	if e.buffers, err = meter.Int64Counter("tcpmon.receive_buffer_prunes",
+		metric.WithDescription("Segments that arrived with the connection over its receive buffer, by what pruning took")); err != nil {
+		return nil, err
+	}
+	if e.synFloods, err = meter.Int64Counter("tcpmon.syn_floods",
+		metric.WithDescription("Seconds a source prefix sent more SYNs than --syn-flood, by prefix and interface")); err != nil {
+		return nil, err
+	}
+	if e.tlsTimes, err = meter.Float64Histogram("tcpmon.tls.handshake.duration", metric.WithUnit("s"),
+		metric.WithDescription("TLS handshakes of libssl programs")); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Observe emits the log record and updates the counters for one event
+func (e *OTLPExporter) Observe(event *TcpEvent, p *EventProcessor) {
+	now := time.Now()
+	ctx := traceContextOf(event)
+	attrs := []attribute.KeyValue{
+		attribute.String("event.type", eventTypeNames[event.Type]),
+		attribute.Int64("process.pid", int64(event.Pid)),
+		attribute.String("process.comm", commString(event.Comm[:])),
+	}
+	if pod := event.Pod; pod != nil {
+		attrs = append(attrs,
+			attribute.String("k8s.namespace.name", pod.Namespace),
+			attribute.String("k8s.pod.name", pod.Name),
+			attribute.String("k8s.pod.uid", pod.UID))
+	}
+	if c := event.Container; c != nil {
+		attrs = append(attrs,
+			attribute.String("container.id", c.ID),
+			attribute.String("container.name", c.Name),
+			attribute.String("container.image.name", c.Image))
+	}
+	if event.SaddrName != "" {
+		attrs = append(attrs, attribute.String("source.domain", event.SaddrName))
+	}
+	if event.DaddrName != "" {
+		attrs = append(attrs, attribute.String("destination.domain", event.DaddrName))
+	}
+	if event.Netns != 0 {
+		attrs = append(attrs, attribute.Int64("network.namespace.inode", int64(event.Netns)))
+		if event.NetnsName != "" {
+			attrs = append(attrs, attribute.String("network.namespace.name", event.NetnsName))
+		}
+	}
+	if event.Count > 0 {
+		attrs = append(attrs, attribute.Int64("event.count", int64(event.Count))) // --coalesce
+	}
+	if proc := event.Process; proc != nil {
+		attrs = append(attrs,
+			attribute.String("process.command_line", proc.Cmdline),
+			attribute.Int64("process.user.id", int64(proc.UID)),
+			attribute.String("process.user.name", proc.User),
+			attribute.String("process.linux.cgroup", proc.Cgroup))
+	}
+	geo := geoAttrs(event.Geo)
+	attrs = append(attrs, geo...)
+	if len(event.UserStack) > 0 {
+		attrs = append(attrs, attribute.String("code.stacktrace", strings.Join(event.UserStack, "\n")))
+	}
+
+	var rec otellog.Record
+	rec.SetTimestamp(now)
+	rec.SetObservedTimestamp(now)
+	rec.SetSeverity(otellog.SeverityInfo)
+
+	switch event.Type {
+	case eventDrop:
+		reason, function := p.reasonName(event.Reason), findNearestSymbol(event.Location)
+		layer := dropLayer(function, reason)
+		attrs = append(attrs,
+			attribute.String("drop.reason", reason),
+			attribute.String("drop.function", function),
+			attribute.String("drop.layer", layer))
+		if len(event.Stack) > 0 {
+			attrs = append(attrs, attribute.StringSlice("drop.stack", event.Stack))
+		}
+		rec.SetSeverity(otellog.SeverityWarn)
+		e.drops.Add(ctx, int64(event.occurrences()), metric.WithAttributes(attribute.String("reason", reason), attribute.String("layer", layer)))
+	case eventUDPError:
+		errno, direction := errnoName(event.Reason), directionNames[event.Direction]
+		attrs = append(attrs,
+			attribute.String("network.transport", "udp"),
+			attribute.String("udp.error.direction", direction),
+			attribute.String("error.type", errno),
+			attribute.Int64("source.port", int64(event.Sport)))
+		if event.Family != 0 {
+			attrs = append(attrs,
+				attribute.String("network.type", familyNames[event.Family]),
+				attribute.String("source.address", formatAddr(event.Saddr)),
+				attribute.String("destination.address", formatAddr(event.Daddr)),
+				attribute.Int64("destination.port", int64(event.Dport)))
+		}
+		rec.SetSeverity(otellog.SeverityWarn)
+		e.udpErrors.Add(context.Background(), int64(event.occurrences()), metric.WithAttributes(
+			attribute.String("udp.error.direction", direction),
+			attribute.String("error.type", errno)))
+	case eventSynFlood:
+		prefix, iface := synFloodPrefix(event), synFloodInterface(event)
+		attrs = append(attrs,
+			attribute.String("network.type", familyNames[event.Family]),
+			attribute.String("source.prefix", prefix),
+			attribute.String("destination.address", formatAddr(event.Daddr)),
+			attribute.Int64("destination.port", int64(event.Dport)),
+			attribute.String("network.interface.name", iface),
+			attribute.Int64("tcp.syn_flood.syns", int64(event.Syns)),
+			attribute.Int64("tcp.syn_flood.elapsed_ns", int64(event.DurationNs)))
+		rec.SetSeverity(otellog.SeverityWarn)
+		e.synFloods.Add(context.Background(), 1, metric.WithAttributes(
+			attribute.String("source.prefix", prefix),
+			attribute.String("network.interface.name", iface)))
+	default:
+		attrs = append(attrs,
+			attribute.String("network.type", familyNames[event.Family]),
+			attribute.String("source.address", formatAddr(event.Saddr)),
+			attribute.Int64("source.port", int64(event.Sport)),
+			attribute.String("destination.address", formatAddr(event.Daddr)),
+			attribute.Int64("destination.port", int64(event.Dport)),
+			attribute.String("tcp.state", p.stateName(event.State)))
+		switch event.Type {
+		case eventRetransmit:
+			rec.SetSeverity(otellog.SeverityWarn)
+			e.retransmits.Add(ctx, int64(event.occurrences()), metric.WithAttributes(append(geo,
+				attribute.String("destination.address", formatAddr(event.Daddr)),
+				attribute.Int("destination.port", int(event.Dport)))...))
+		case eventDSACK:
+			rec.SetSeverity(otellog.SeverityWarn)
+			attrs = append(attrs, attribute.Int64("tcp.dsack_bytes", int64(event.DsackBytes)))
+			e.dsacks.Add(context.Background(), int64(event.occurrences()), metric.WithAttributes(append(geo,
+				attribute.String("destination.address", formatAddr(event.Daddr)),
+				attribute.Int("destination.port", int(event.Dport)))...))
+		case eventState:
+			attrs = append(attrs, attribute.String("tcp.old_state", p.stateName(event.OldState)))
+		case eventReset:
+			rec.SetSeverity(otellog.SeverityWarn)
+			direction := directionNames[event.Direction]
+			attrs = append(attrs, attribute.String("tcp.reset.direction", direction))
+			if event.Direction == rstSent {
+				attrs = append(attrs, attribute.String("tcp.reset.reason", p.resetReasonName(event.Reason)))
+			}
+			e.resets.Add(context.Background(), int64(event.occurrences()), metric.WithAttributes(append(geo,
+				attribute.String("tcp.reset.direction", direction),
+				attribute.String("destination.address", formatAddr(event.Daddr)))...))
+		case eventZeroWindow:
+			rec.SetSeverity(otellog.SeverityWarn)
+			direction := directionNames[event.Direction]
+			attrs = append(attrs,
+				attribute.String("tcp.zero_window.direction", direction),
+				attribute.Int64("tcp.zero_window.queued_bytes", int64(event.Queued)))
+			e.zeroWindows.Add(context.Background(), 1, metric.WithAttributes(
+				attribute.String("tcp.zero_window.direction", direction),
+				attribute.String("destination.address", formatAddr(event.Daddr))))
+		case eventICMPError:
+			rec.SetSeverity(otellog.SeverityWarn)
+			message := icmpName(event.Family, event.Reason)
+			attrs = append(attrs, attribute.String("icmp.message", message))
+			if event.Mtu != 0 {
+				attrs = append(attrs, attribute.Int64("icmp.mtu", int64(event.Mtu)))
+			}
+			e.icmpErrors.Add(context.Background(), int64(event.occurrences()), metric.WithAttributes(append(geo,
+				attribute.String("icmp.message", message),
+				attribute.String("destination.address", formatAddr(event.Daddr)))...))
+		case eventBuffer:
+			rec.SetSeverity(otellog.SeverityWarn)
+			kind := bufferNames[event.Direction]
+			attrs = append(attrs,
+				attribute.String("tcp.buffer.kind", kind),
+				attribute.Int64("tcp.buffer.rmem_alloc", int64(event.RmemAlloc)),
+				attribute.Int64("tcp.buffer.rcvbuf", int64(event.Rcvbuf)),
+				attribute.Int64("tcp.buffer.collapses", int64(event.Collapses)),
+				attribute.String("tcp.buffer.hint", bufferHint(event)))
+			e.buffers.Add(context.Background(), int64(event.occurrences()), metric.WithAttributes(
+				attribute.String("tcp.buffer.kind", kind)))
+		case eventFastOpen:
+			direction, outcome := directionNames[event.Direction], fastopenNames[event.Reason]
+			if fastopenFellBack(event.Reason) {
+				rec.SetSeverity(otellog.SeverityWarn)
+			}
+			attrs = append(attrs,
+				attribute.String("tcp.fastopen.direction", direction),
+				attribute.String("tcp.fastopen.outcome", outcome))
+			e.fastopens.Add(context.Background(), 1, metric.WithAttributes(
+				attribute.String("tcp.fastopen.direction", direction),
+				attribute.String("tcp.fastopen.outcome", outcome)))
+		case eventKeepalive:
+			rec.SetSeverity(otellog.SeverityWarn)
+			kind := keepaliveNames[event.Direction]
+			attrs = append(attrs,
+				attribute.String("tcp.keepalive.kind", kind),
+				attribute.Int64("tcp.keepalive.probes", int64(event.Probes)),
+				attribute.Int64("tcp.keepalive.max_probes", int64(event.MaxProbes)))
+			if event.DurationNs != 0 {
+				attrs = append(attrs, attribute.Int64("tcp.keepalive.idle_ns", int64(event.DurationNs)))
+			}
+			e.keepalives.Add(context.Background(), 1, metric.WithAttributes(
+				attribute.String("tcp.keepalive.kind", kind),
+				attribute.String("destination.address", formatAddr(event.Daddr))))
+		case eventTLS:
+			side := tlsSideNames[event.Direction]
+			attrs = append(attrs,
+				attribute.String("tls.side", side),
+				attribute.Int64("tls.handshake_ns", int64(event.DurationNs)))
+			if event.TCPConnectNs != 0 {
+				attrs = append(attrs, attribute.Int64("tcp.connect_latency_ns", int64(event.TCPConnectNs)))
+			}
+			if event.TLSWaitNs != 0 {
+				attrs = append(attrs, attribute.Int64("tls.wait_ns", int64(event.TLSWaitNs)))
+			}
+			e.tlsTimes.Record(context.Background(), float64(event.DurationNs)/1e9, metric.WithAttributes(
+				attribute.String("tls.side", side)))
+		case eventConnect:
+			rec.SetSeverity(otellog.SeverityWarn)
+			attrs = append(attrs, attribute.Int64("tcp.connect_latency_ns", int64(event.DurationNs)))
+		case eventListen:
+			attrs = append(attrs,
+				attribute.String("tcp.listen.kind", listenKinds[event.Direction]),
+				attribute.Int64("tcp.listen.backlog", int64(event.Backlog)))
+			if event.Reason != 0 {
+				rec.SetSeverity(otellog.SeverityWarn)
+				attrs = append(attrs, attribute.String("error.type", errnoName(event.Reason)))
+			}
+			if event.AcceptQueue != 0 {
+				attrs = append(attrs, attribute.Int64("tcp.listen.unaccepted", int64(event.AcceptQueue)))
+			}
+		case eventSockopt:
+			old, cur := sockoptValues(event)
+			attrs = append(attrs,
+				attribute.String("tcp.sockopt.option", sockoptName(event.Sockopt)),
+				attribute.String("tcp.sockopt.old", old),
+				attribute.String("tcp.sockopt.new", cur),
+				attribute.String("tcp.sockopt.result", sockoptResult(event)))
+		case eventClose:
+			attrs = append(attrs,
+				attribute.Int64("tcp.duration_ns", int64(event.DurationNs)),
+				attribute.Int64("tcp.bytes_sent", int64(event.BytesSent)),
+				attribute.Int64("tcp.bytes_received", int64(event.BytesReceived)),
+				attribute.Int64("tcp.retransmits", int64(event.Retransmits)))
+			if event.RttAvgUs != 0 {
+				attrs = append(attrs,
+					attribute.Int64("tcp.rtt_min_us", int64(event.RttMinUs)),
+					attribute.Int64("tcp.rtt_avg_us", int64(event.RttAvgUs)),
+					attribute.Int64("tcp.rtt_max_us", int64(event.RttMaxUs)),
+					attribute.Int64("tcp.rttvar_us", int64(event.RttvarUs)))
+			}
+			if event.Reordering != 0 {
+				attrs = append(attrs,
+					attribute.Int64("tcp.ooo_packets", int64(event.OooPackets)),
+					attribute.Int64("tcp.ooo_max_bytes", int64(event.OooMaxBytes)),
+					attribute.Int64("tcp.reordering", int64(event.Reordering)),
+					attribute.Int64("tcp.reord_seen", int64(event.ReordSeen)))
+			}
+			if event.Sacks != 0 {
+				attrs = append(attrs,
+					attribute.Int64("tcp.sacks", int64(event.Sacks)),
+					attribute.Int64("tcp.sack_blocks", int64(event.SackBlocks)),
+					attribute.Int64("tcp.dsacks", int64(event.Dsacks)),
+					attribute.Int64("tcp.dsack_bytes", int64(event.DsackBytes)))
+			}
+		}
+	}
+
+	if l := event.Link; l != nil && l.Ifindex != 0 { // OpenTelemetry's network.interface.name, the rest are ours
+		attrs = append(attrs, attribute.String("network.interface.name", linkName(l.Ifindex, l.Name)))
+		if l.Vlan != 0 {
+			attrs = append(attrs, attribute.Int64("network.vlan.id", int64(l.Vlan)))
+		}
+		if l.Master != "" {
+			attrs = append(attrs, attribute.String("network.interface.master", l.Master))
+		}
+	}
+	if event.Tunnel != 0 { // Ours too, the source and destination attributes are the tunnel's endpoints
+		attrs = append(attrs,
+			attribute.String("network.tunnel.type", tunnelNames[event.Tunnel]),
+			attribute.Int64("network.tunnel.vni", int64(event.Vni)))
+		if event.InnerFamily != 0 {
+			attrs = append(attrs,
+				attribute.String("network.tunnel.inner.transport", protocolName(event.InnerProtocol)),
+				attribute.String("network.tunnel.inner.source.address", formatAddr(event.InnerSaddr)),
+				attribute.Int64("network.tunnel.inner.source.port", int64(event.InnerSport)),
+				attribute.String("network.tunnel.inner.destination.address", formatAddr(event.InnerDaddr)),
+				attribute.Int64("network.tunnel.inner.destination.port", int64(event.InnerDport)))
+		}
+	}
+
+	rec.SetBody(attribute.StringValue(eventTypeNames[event.Type]))
+	rec.AddAttributes(attrs...)
+	e.logger.Emit(ctx, rec)
+}
+
+// traceContextOf is the context the counters and the log record are
+// updated in. With a trace registered for the socket (see traces.go) it
+// carries the span, which the SDK's default exemplar filter turns into an
+// exemplar on the counters and the log record gets as its trace and span.
+func traceContextOf(event *TcpEvent) context.Context {
+	if event.Trace == nil {
+		return context.Background()
+	}
+	return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    event.Trace.TraceID,
+		SpanID:     event.Trace.SpanID,
+		TraceFlags: trace.FlagsSampled, // The trace_based filter only keeps sampled spans
+		Remote:     true,
+	}))
+}
+
+// geoAttrs are the remote end's country (OpenTelemetry's geo.*) and AS (as
+// in ECS, OpenTelemetry has none), for the record and the per-peer counters
+func geoAttrs(geo *GeoInfo) []attribute.KeyValue {
+	if geo == nil {
+		return nil
+	}
+	var attrs []attribute.KeyValue
+	if geo.Country != "" {
+		attrs = append(attrs, attribute.String("geo.country.iso_code", geo.Country))
+	}
+	if geo.ASN != 0 {
+		attrs = append(attrs,
+			attribute.Int64("as.number", int64(geo.ASN)),
+			attribute.String("as.organization.name", geo.ASOrg))
+	}
+	return attrs
+}
+
+// ObserveHistograms sends one log record per histogram with its percentiles
+func (e *OTLPExporter) ObserveHistograms(hists []latencyHist) {
+	now := time.Now()
+	for i := range hists {
+		h := &hists[i]
+		n := h.count()
+		if n == 0 {
+			continue
+		}
+
+		var rec otellog.Record
+		rec.SetTimestamp(now)
+		rec.SetObservedTimestamp(now)
+		rec.SetSeverity(otellog.SeverityInfo)
+		rec.SetBody(attribute.StringValue("latency"))
+		rec.AddAttributes(
+			attribute.String("event.type", "latency"),
+			attribute.String("latency.kind", histKindNames[h.Kind]),
+			attribute.String("destination.address", formatAddr(h.Raddr)),
+			attribute.Int64("latency.count", int64(n)),
+			attribute.Int64("latency.p50_us", h.percentile(0.50).Microseconds()),
+			attribute.Int64("latency.p95_us", h.percentile(0.95).Microseconds()),
+			attribute.Int64("latency.p99_us", h.percentile(0.99).Microseconds()),
+			attribute.Int64Slice("latency.bounds_us", int64s(h.Buckets)),
+			attribute.Int64Slice("latency.counts", int64s(h.slots())))
+		e.logger.Emit(context.Background(), rec)
+	}
+}
+
+// int64s is a histogram's bounds or counts for an Int64Slice attribute
+func int64s(v []uint64) []int64 {
+	out := make([]int64, len(v))
+	for i, x := range v {
+		out[i] = int64(x)
+	}
+	return out
+}
+
+// Shutdown flushes anything still batched
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	return errors.Join(e.loggers.Shutdown(ctx), e.meters.Shutdown(ctx))
+}
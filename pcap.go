@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+// PcapWriter writes the packets captured with drop events (--pcap) to a
+// classic pcap file that tcpdump or Wireshark can open. The kernel side
+// copies from the IP header on, so the link type is raw IP and there's no
+// ethernet header to fake.
+type PcapWriter struct {
+	file *os.File
+	w    *bufio.Writer
+	hdr  [16]byte // Record header, reused
+}
+
+const (
+	pcapMagicNanos = 0xa1b23c4d // Timestamps in nanoseconds
+	linktypeRaw    = 101        // LINKTYPE_RAW, IPv4 or IPv6 told apart by the version nibble
+)
+
+func NewPcapWriter(path string, snaplen uint32) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &PcapWriter{file: f, w: bufio.NewWriter(f)}
+
+	var hdr [24]byte
+	le := binary.LittleEndian
+	le.PutUint32(hdr[0:4], pcapMagicNanos)
+	le.PutUint16(hdr[4:6], 2) // Version 2.4
+	le.PutUint16(hdr[6:8], 4)
+	// 8:16 are the unused timezone and accuracy fields
+	le.PutUint32(hdr[16:20], snaplen)
+	le.PutUint32(hdr[20:24], linktypeRaw)
+	if _, err := p.w.Write(hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Observe writes one record per drop that came with a packet, on the
+// processor goroutine. Drops of non-IP packets have nothing to write.
+func (p *PcapWriter) Observe(event *TcpEvent, _ *EventProcessor) {
+	if event.Type != eventDrop || len(event.Packet) == 0 || p.file == nil {
+		return
+	}
+
+	// The kernel timestamp is since boot, the file wants wall clock time
+	now := time.Now()
+	le := binary.LittleEndian
+	le.PutUint32(p.hdr[0:4], uint32(now.Unix()))
+	le.PutUint32(p.hdr[4:8], uint32(now.Nanosecond()))
+	le.PutUint32(p.hdr[8:12], uint32(len(event.Packet)))
+	le.PutUint32(p.hdr[12:16], max(event.PacketLen, uint32(len(event.Packet))))
+	p.w.Write(p.hdr[:])
+	p.w.Write(event.Packet) // bufio keeps the first error, Close returns it
+}
+
+func (p *PcapWriter) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.w.Flush()
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	p.file = nil
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+)
+
+// With --pin-path the kernel side outlives the process: the state maps are
+// pinned under <pin-path>/maps and reused by the next run, and the links
+// under <pin-path>/links keep the programs attached in between, so counters
+// and the connection table carry on across a restart. Removing the directory
+// detaches everything for good.
+
+// pinnedMaps are the maps whose contents are worth keeping. The ring buffer
+// and scratch space belong to one process, and the filter maps are filled in
+// from each run's flags. tunables is too, but pinned so `monitor set
+// --pin-path` finds it.
+var pinnedMaps = map[string]bool{
+	"lost_events": true, "conns": true, "conn_tuples": true, "sample_counts": true, "conn_rates": true,
+	"suppressed_events": true, "drop_counts": true, "retransmit_counts": true,
+	"aggregate_overflow": true, "latency_hist": true, "top_bytes": true, "keepalives": true,
+	"tunables": true,
+}
+
+func pinMapsDir(pinPath string) string  { return filepath.Join(pinPath, "maps") }
+func pinLinksDir(pinPath string) string { return filepath.Join(pinPath, "links") }
+
+// pinMaps marks pinnedMaps to be pinned, or picked up if a previous run already
+// pinned them, when spec is loaded with the returned options
+func pinMaps(spec *ebpf.CollectionSpec, pinPath string) (ebpf.MapOptions, error) {
+	dir := pinMapsDir(pinPath)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return ebpf.MapOptions{}, err
+	}
+	for name, m := range spec.Maps {
+		if pinnedMaps[name] {
+			m.Pinning = ebpf.PinByName
+		}
+	}
+	return ebpf.MapOptions{PinPath: dir}, nil
+}
+
+// pinError explains the usual way loading pinned maps fails
+func pinError(err error, pinPath string) error {
+	if errors.Is(err, ebpf.ErrMapIncompatible) {
+		return fmt.Errorf("%w (the maps in %s were pinned by a different version, remove them to start over)", err, pinMapsDir(pinPath))
+	}
+	return err
+}
+
+// resetLostEvents zeroes lost_events once the previous run's links are
+// gone. Between runs its programs kept writing to a ring buffer no one
+// read, and counted everything past the point it filled up as lost, which
+// this run never had a chance to read. It returns how many that was.
+func resetLostEvents(lost *ebpf.Map) (uint64, error) {
+	var perCPU []uint64
+	if err := lost.Lookup(uint32(0), &perCPU); err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, v := range perCPU {
+		n += v
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, lost.Put(uint32(0), make([]uint64, len(perCPU)))
+}
+
+// removePinnedLinks detaches the programs a previous run left attached, so
+// they don't count every event a second time next to the new ones
+func removePinnedLinks(pinPath string) error {
+	dir := pinLinksDir(pinPath)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.MkdirAll(dir, 0o700)
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// Unlinking a bpffs pin drops its reference, the last one detaches the link
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
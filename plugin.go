@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// --plugin runs a program and writes every event to its stdin, for
+// systems the monitor has no sink for: newline delimited JSON in the
+// --format json schema, or with --plugin-encoding protobuf the Event
+// message from proto/tcpmon.proto, each after its length as a varint
+// (what protodelim and --out files use). Its stdout and stderr go to the
+// monitor's stderr. A plugin that exits or stops reading is restarted,
+// and the events in between are counted and dropped; one that reads too
+// slowly only fills its own --sink-buffer queue.
+
+const pluginRestart = 5 * time.Second // Least time between starts
+
+// pluginFlag is --plugin, repeatable for several plugins. Unlike listFlag
+// it doesn't split on commas, a command line may have them.
+type pluginFlag []string
+
+func (f *pluginFlag) String() string { return strings.Join(*f, "; ") }
+
+func (f *pluginFlag) Set(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return errors.New("empty plugin command")
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// PluginSink is one --plugin program, started through /bin/sh -c so the
+// command can have arguments, quotes and redirections
+type PluginSink struct {
+	command  string
+	encoding string // formatJSON or encodingProtobuf
+	buf      []byte // Only touched by Observe
+
+	mu        sync.Mutex
+	proc      *pluginProc // nil while it isn't running
+	closed    bool
+	nextStart time.Time
+	lastErr   error // Why it isn't running
+
+	failed atomic.Uint64 // Not written, while it wasn't running
+}
+
+type pluginProc struct {
+	cmd    *exec.Cmd
+	stdin  *os.File
+	exited chan struct{}
+	err    error // Wait's, once exited is closed
+}
+
+func NewPluginSink(command, encoding string) (*PluginSink, error) {
+	if encoding != formatJSON && encoding != encodingProtobuf {
+		return nil, fmt.Errorf("unknown encoding %q, use: json or protobuf", encoding)
+	}
+	s := &PluginSink{command: command, encoding: encoding}
+	proc, err := s.start()
+	if err != nil {
+		return nil, err
+	}
+	s.proc = proc
+	return s, nil
+}
+
+// pluginNames names each --plugin after its program, e.g. plugin:notify,
+// numbered from the second one with the same name on
+func pluginNames(commands []string) []string {
+	names := make([]string, len(commands))
+	seen := make(map[string]int)
+	for i, c := range commands {
+		name := "plugin"
+		if fields := strings.Fields(c); len(fields) > 0 {
+			name += ":" + filepath.Base(fields[0])
+		}
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s#%d", name, seen[name])
+		}
+		names[i] = name
+	}
+	return names
+}
+
+func (s *PluginSink) start() (*pluginProc, error) {
+	cmd := exec.Command("/bin/sh", "-c", s.command)
+	cmd.Stdout = os.Stderr // stdout is the monitor's own output
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "TCPMON_ENCODING="+s.encoding)
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = r
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return nil, fmt.Errorf("starting plugin %q: %w", s.command, err)
+	}
+	r.Close() // The plugin has its own copy
+	p := &pluginProc{cmd: cmd, stdin: w, exited: make(chan struct{})}
+	go func() {
+		p.err = cmd.Wait()
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+// running is the plugin's process, restarted if it exited and it's been
+// long enough, or nil
+func (s *PluginSink) running() *pluginProc {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	if s.proc != nil {
+		select {
+		case <-s.proc.exited:
+			s.stopLocked(s.proc, fmt.Errorf("exited: %v", exitStatus(s.proc.err)))
+		default:
+			return s.proc
+		}
+	}
+	if time.Now().Before(s.nextStart) {
+		return nil
+	}
+	proc, err := s.start()
+	if err != nil {
+		s.lastErr = err
+		s.nextStart = time.Now().Add(pluginRestart)
+		return nil
+	}
+	slog.Info("plugin restarted", "command", s.command, "missed", s.failed.Load())
+	s.proc, s.lastErr = proc, nil
+	return proc
+}
+
+// stopLocked gives up on proc, killing it if it still runs
+func (s *PluginSink) stopLocked(proc *pluginProc, err error) {
+	if s.proc != proc {
+		return // Already stopped
+	}
+	slog.Warn("plugin stopped, restarting it", "command", s.command, "err", err, "in", pluginRestart)
+	proc.stdin.Close()
+	proc.cmd.Process.Kill()
+	s.proc, s.lastErr = nil, err
+	s.nextStart = time.Now().Add(pluginRestart)
+}
+
+func exitStatus(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// Observe writes one event to the plugin, blocking while its pipe is full.
+// Called from its SinkFanout queue's goroutine only.
+func (s *PluginSink) Observe(event *TcpEvent, p *EventProcessor) {
+	proc := s.running()
+	if proc == nil {
+		s.failed.Add(1)
+		return
+	}
+	b := encodeEvent(event, p, s.encoding)
+	if s.encoding == encodingProtobuf {
+		s.buf = protowire.AppendVarint(s.buf[:0], uint64(len(b)))
+		s.buf = append(s.buf, b...)
+	} else {
+		s.buf = append(append(s.buf[:0], b...), '\n')
+	}
+	if _, err := proc.stdin.Write(s.buf); err != nil {
+		s.failed.Add(1)
+		s.mu.Lock()
+		s.stopLocked(proc, fmt.Errorf("writing to it: %w", err))
+		s.mu.Unlock()
+	}
+}
+
+// Health is why the plugin isn't running
+func (s *PluginSink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proc == nil && s.lastErr != nil {
+		return fmt.Errorf("%v, %d events missed", s.lastErr, s.failed.Load())
+	}
+	return nil
+}
+
+// Close ends the plugin's stdin, and gives it 5 seconds to finish up and
+// exit before it's killed
+func (s *PluginSink) Close() {
+	s.mu.Lock()
+	s.closed = true
+	proc := s.proc
+	s.proc = nil
+	s.mu.Unlock()
+	if proc == nil {
+		return
+	}
+	proc.stdin.Close()
+	select {
+	case <-proc.exited:
+	case <-time.After(5 * time.Second):
+		slog.Warn("plugin didn't exit, killing it", "command", s.command)
+		proc.cmd.Process.Kill()
+		<-proc.exited
+	}
+	if n := s.failed.Load(); n > 0 {
+		slog.Warn("plugin missed events", "command", s.command, "missed", n)
+	}
+}
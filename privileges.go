@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// --user: loading and attaching BPF programs needs root, running them
+// afterwards mostly doesn't. Once everything is loaded, attached, pinned
+// and opened, the monitor switches to the given user and keeps only the
+// --keep-caps capabilities, so the long-running part that parses events
+// and talks to sinks isn't root. The BPF objects, the ring buffer, the
+// pins and every file and socket stay open across the switch.
+//
+// Capabilities are per thread, and Go schedules goroutines on whatever
+// thread it likes, so each step is applied to every thread with
+// syscall.AllThreadsSyscall. That's only there in builds without cgo
+// (CGO_ENABLED=0, as the Makefile builds).
+
+// capabilityNames are the --keep-caps choices
+var capabilityNames = map[string]int{
+	"bpf":              unix.CAP_BPF,              // Reading and updating maps, from 5.8
+	"perfmon":          unix.CAP_PERFMON,          // Perf buffer and kprobe access, from 5.8
+	"sys_admin":        unix.CAP_SYS_ADMIN,        // What bpf and perfmon were part of before 5.8
+	"sys_ptrace":       unix.CAP_SYS_PTRACE,       // /proc/<pid>/ns/net and maps of other users' processes
+	"dac_read_search":  unix.CAP_DAC_READ_SEARCH,  // Reading files of other users, e.g. a container's libssl
+	"net_bind_service": unix.CAP_NET_BIND_SERVICE, // Binding ports below 1024 later on
+	"net_admin":        unix.CAP_NET_ADMIN,        // Attaching tc, XDP and cgroup programs through --control-addr
+	"sys_resource":     unix.CAP_SYS_RESOURCE,     // Raising limits later on
+}
+
+// defaultKeepCaps is what the monitor needs to keep working: map access
+// for the counters, filters and connection table (sys_admin before
+// CAP_BPF existed), sys_ptrace for the namespace names and
+// --user-stacks, and net_admin when probes can be attached later on
+func defaultKeepCaps(control bool) listFlag {
+	caps := listFlag{"sys_admin", "sys_ptrace"}
+	if lastCap() >= unix.CAP_BPF {
+		caps = listFlag{"bpf", "perfmon", "sys_ptrace"}
+	}
+	if control {
+		caps = append(caps, "net_admin")
+	}
+	return caps
+}
+
+// lastCap is the highest capability the kernel knows
+func lastCap() int {
+	b, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return n
+}
+
+// runAs is the --user to switch to
+type runAs struct {
+	uid, gid int
+	groups   []int // Supplementary, e.g. docker for the runtime socket
+	keep     []int // Capabilities
+}
+
+// parseRunAs reads --user (a name or uid, optionally :group or :gid) and
+// --keep-caps, control for a --control-addr
+func parseRunAs(spec string, caps listFlag, control bool) (*runAs, error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("unknown user %q", name)
+		}
+	}
+	r := &runAs{}
+	r.uid, _ = strconv.Atoi(u.Uid)
+	r.gid, _ = strconv.Atoi(u.Gid)
+	if hasGroup {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, fmt.Errorf("unknown group %q", group)
+			}
+		}
+		r.gid, _ = strconv.Atoi(g.Gid)
+	}
+	if r.uid == 0 {
+		return nil, fmt.Errorf("user %q is root", name)
+	}
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		if gid, err := strconv.Atoi(id); err == nil && gid != r.gid {
+			r.groups = append(r.groups, gid)
+		}
+	}
+	r.groups = append(r.groups, r.gid)
+
+	if len(caps) == 0 {
+		caps = defaultKeepCaps(control)
+	}
+	for _, c := range caps {
+		if c == "none" {
+			continue
+		}
+		capability, ok := capabilityNames[strings.TrimPrefix(strings.ToLower(c), "cap_")]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", c)
+		}
+		if capability > lastCap() {
+			return nil, fmt.Errorf("capability %q needs a newer kernel", c)
+		}
+		r.keep = append(r.keep, capability)
+	}
+	return r, nil
+}
+
+// allThreads runs a syscall on every thread of the process
+//
+//go:uintptrescapes
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	if _, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return errors.New("this build uses cgo, --user needs one with CGO_ENABLED=0")
+		}
+		return errno
+	}
+	return nil
+}
+
+// drop switches every thread to r. Every capability but the kept ones
+// leaves the bounding set first, and no_new_privs stops an exec from
+// getting any back.
+func (r *runAs) drop() error {
+	var keep uint64
+	for _, c := range r.keep {
+		keep |= 1 << c
+	}
+	for c := 0; c <= lastCap(); c++ {
+		if keep&(1<<c) != 0 {
+			continue
+		}
+		if err := allThreads(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, uintptr(c), 0); err != nil {
+			return fmt.Errorf("dropping capability %d from the bounding set: %w", c, err)
+		}
+	}
+	// Otherwise setuid clears the permitted set along with the effective one
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		return fmt.Errorf("PR_SET_KEEPCAPS: %w", err)
+	}
+
+	// These three are applied to every thread by the syscall package
+	if err := syscall.Setgroups(r.groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(r.gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", r.gid, err)
+	}
+	if err := syscall.Setuid(r.uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", r.uid, err)
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	data[0].Permitted, data[0].Effective = uint32(keep), uint32(keep)
+	data[1].Permitted, data[1].Effective = uint32(keep>>32), uint32(keep>>32)
+	if err := allThreads(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); err != nil {
+		return fmt.Errorf("capset: %w", err)
+	}
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return fmt.Errorf("PR_SET_NO_NEW_PRIVS: %w", err)
+	}
+	return nil
+}
+
+// handOver gives r the files the monitor still changes after the switch:
+// the PID file it empties on exit, the pin directories it pins and unpins
+// links in, the control socket. Paths that don't exist are skipped.
+func (r *runAs) handOver(paths ...string) error {
+	for _, path := range paths {
+		if err := os.Lchown(path, r.uid, r.gid); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// keptNames lists r.keep by name, for the log
+func (r *runAs) keptNames() []string {
+	names := make([]string, 0, len(r.keep))
+	for _, c := range r.keep {
+		for name, v := range capabilityNames {
+			if v == c {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
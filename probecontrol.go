@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/cilium/ebpf"
+)
+
+// Probes can be attached and detached while the monitor runs, through
+// /api/v1/probes on --control-addr, e.g. to turn on the top or cgroups
+// byte accounting only while an incident lasts. The programs are all
+// loaded at startup whatever the command attaches, so this only adds or
+// removes links. What the programs emit was fixed at load time though: a
+// probe attached later fills its maps, but its events only reach the ring
+// buffer if the command emits that event type anyway.
+
+// GET /api/v1/probes and POST /api/v1/probes/{name}/attach and /detach
+type apiProbe struct {
+	Name        string   `json:"name"`
+	Attached    bool     `json:"attached"`
+	Optional    bool     `json:"optional"`              // Left out at startup if it can't be attached
+	Attachments []string `json:"attachments,omitempty"` // What it's attached to, fallbacks included
+}
+
+// Register lists the probes on --listen-addr
+func (m *ProbeManager) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/probes", m.handleProbes)
+}
+
+// RegisterControl attaches and detaches them on --control-addr
+func (m *ProbeManager) RegisterControl(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/probes", m.handleProbes)
+	mux.HandleFunc("POST /api/v1/probes/{name}/attach", m.handleAttach)
+	mux.HandleFunc("POST /api/v1/probes/{name}/detach", m.handleDetach)
+}
+
+// Enable attaches one more probe. Unlike Attach, a probe that can't be
+// attached leaves the others alone.
+func (m *ProbeManager) Enable(name string) error {
+	p, err := probeNamed(name)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active&p.hook != 0 {
+		return nil
+	}
+	if p.hook == hookSockOps && m.objs.TcpSockops.Type() != ebpf.SockOps {
+		return errors.New("sockops needs --sockops at startup, its program is a stub otherwise")
+	}
+	if p.hook == hookEnforce && m.objs.EnforceConnect4.Type() != ebpf.CGroupSockAddr {
+		return errors.New("enforce needs --enforce at startup, its programs are stubs otherwise")
+	}
+	if p.hook == hookTLS && len(m.tlsLibs) == 0 {
+		return errors.New("libssl is only looked for when the tls probe is attached at startup")
+	}
+	if p.hook == hookInterfaces && len(m.ifaces) == 0 {
+		return errors.New("interfaces needs --interface at startup, its programs are stubs otherwise")
+	}
+	if err := m.attachProbe(p); err != nil {
+		return fmt.Errorf("attaching %s probe: %w", p.name, err)
+	}
+	m.active |= p.hook
+	return nil
+}
+
+// Disable detaches one probe, its pins included. A pin that can't be
+// removed would keep the probe attached behind the monitor's back, so then
+// nothing is detached and the probe stays active.
+func (m *ProbeManager) Disable(name string) error {
+	p, err := probeNamed(name)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []error
+	for _, pl := range m.links {
+		if pl.probe != p {
+			continue
+		}
+		if err := pl.link.Unpin(); err != nil {
+			errs = append(errs, fmt.Errorf("unpinning %s: %w", pl.target, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s stays attached: %w", p.name, errors.Join(errs...))
+	}
+	kept := m.links[:0]
+	for _, pl := range m.links {
+		if pl.probe != p {
+			kept = append(kept, pl)
+			continue
+		}
+		if err := pl.link.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("detaching %s: %w", pl.target, err))
+		}
+	}
+	m.links = kept
+	m.active &^= p.hook
+	return errors.Join(errs...)
+}
+
+// Probes is every probe, attached or not, in attach order
+func (m *ProbeManager) Probes() []apiProbe {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	all := make([]apiProbe, len(probes))
+	for i := range probes {
+		p := &probes[i]
+		all[i] = apiProbe{Name: p.name, Attached: m.active&p.hook != 0, Optional: p.optional}
+		for _, pl := range m.links {
+			if pl.probe == p {
+				all[i].Attachments = append(all[i].Attachments, pl.target.String())
+			}
+		}
+	}
+	return all
+}
+
+func (m *ProbeManager) handleProbes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, m.Probes())
+}
+
+func (m *ProbeManager) handleAttach(w http.ResponseWriter, r *http.Request) {
+	m.handleChange(w, r, "attached", m.Enable)
+}
+
+func (m *ProbeManager) handleDetach(w http.ResponseWriter, r *http.Request) {
+	m.handleChange(w, r, "detached", m.Disable)
+}
+
+// handleChange applies change to the probe in the path, and returns it
+// as it is now
+func (m *ProbeManager) handleChange(w http.ResponseWriter, r *http.Request, done string, change func(string) error) {
+	name := r.PathValue("name")
+	if _, err := probeNamed(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := change(name); err != nil {
+		slog.Warn("changing probe at runtime", "probe", name, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("probe "+done+" at runtime", "probe", name, "remote", r.RemoteAddr)
+	for _, p := range m.Probes() {
+		if p.Name == name {
+			writeJSON(w, p)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// hooks is the set of kernel hooks a command attaches
+type hooks uint32
+
+const (
+	hookDrops       hooks = 1 << iota // skb:kfree_skb
+	hookRetransmits                   // tcp:tcp_retransmit_skb
+	hookStates                        // sock:inet_sock_set_state, also maintains the connection table, and a kretprobe on inet_csk_accept for its owners
+	hookRTT                           // kprobe on tcp_rcv_established, samples RTT into the connection table
+	hookTop                           // kprobes on tcp_sendmsg and tcp_cleanup_rbuf
+	hookResets                        // tcp:tcp_send_reset and tcp:tcp_receive_reset
+	hookListen                        // kprobes on tcp_conn_request and tcp_v{4,6}_syn_recv_sock
+	hookWindows                       // kprobes on tcp_rcv_established and tcp_send_probe0
+	hookSockOps                       // sock_ops on the root cgroup, for the three above it (--sockops)
+	hookUDP                           // kprobes on udp{,v6}_sendmsg and udp:udp_fail_queue_rcv_skb (--proto udp)
+	hookICMP                          // kprobes on tcp_v4_err and tcp_v6_err
+	hookReorder                       // kprobe on tcp_data_queue_ofo, counts out-of-order segments into the connection table
+	hookSACK                          // kprobe on tcp_sacktag_write_queue, counts SACKs into the connection table and sends DSACKs
+	hookKeepalive                     // kprobe on tcp_write_wakeup, timeouts are caught by hookStates
+	hookFastOpen                      // kprobes on tcp_fastopen_cache_set and tcp_try_fastopen, and a kretprobe on the latter
+	hookBuffers                       // kprobes and a kretprobe on tcp_prune_queue, kprobes on tcp_collapse and tcp_prune_ofo_queue
+	hookTLS                           // uprobes on the SSL handshake functions of libssl, kprobes on tcp_sendmsg and tcp_recvmsg
+	hookCgroups                       // kprobes on tcp_sendmsg and tcp_cleanup_rbuf, bytes per cgroup for --cgroup-metrics
+	hookInterfaces                    // tc ingress or XDP on each --interface, kprobes on tcp_v4_rcv and tcp_v6_rcv
+	hookEnforce                       // cgroup connect4 and connect6 on the root cgroup, failing connects --block matches (--enforce)
+	hookSockopts                      // kprobes and kretprobes on sock_setsockopt and tcp_setsockopt
+	hookListeners                     // kprobes and kretprobes on inet_listen, inet_bind and inet6_bind, a kprobe on tcp_close
+)
+
+// attachment is one program on one kernel hook point
+type attachment struct {
+	kprobe bool         // Otherwise a tracepoint, unless cgroup, uprobe, tc or xdp is set
+	uprobe bool         // A symbol in binary, attached once per --tls-lib library
+	ret    bool         // With kprobe or uprobe, a kretprobe or uretprobe
+	cgroup bool         // A program on cgroupRoot, name is the attach type, see cgroupAttachTypes
+	tc     bool         // On tc ingress of each --interface with --interface-hook tc
+	xdp    bool         // In XDP on each --interface with --interface-hook xdp
+	group  string       // Tracepoints only
+	name   string       // Tracepoint, kernel function, symbol or attach type
+	binary string       // Uprobes only, filled in when attaching
+	iface  netInterface // tc and xdp only, filled in when attaching
+	prog   func(objs *monitorObjects) *ebpf.Program
+
+	// Tried in order when this one can't be attached, e.g. kprobes doing
+	// the same as a tracepoint the kernel doesn't have
+	fallbacks []attachment
+
+	// Left out with a warning if it can't be attached, the rest of the
+	// probe does without it, e.g. a function in the ipv6 module
+	optional bool
+}
+
+func (a attachment) String() string {
+	if a.kprobe && a.ret {
+		return "kretprobe:" + a.name
+	}
+	if a.kprobe {
+		return "kprobe:" + a.name
+	}
+	if a.uprobe && a.ret {
+		return "uretprobe:" + a.binary + ":" + a.name
+	}
+	if a.uprobe {
+		return "uprobe:" + a.binary + ":" + a.name
+	}
+	if a.cgroup {
+		return "cgroup:" + a.name
+	}
+	if a.tc {
+		return "tc:" + a.iface.name + ":" + a.name
+	}
+	if a.xdp {
+		return "xdp:" + a.iface.name
+	}
+	return "tracepoint:" + a.group + ":" + a.name
+}
+
+// cgroupAttachTypes are the cgroup attachments' names for their attach types
+var cgroupAttachTypes = map[string]ebpf.AttachType{
+	"sock_ops": ebpf.AttachCGroupSockOps,
+	"connect4": ebpf.AttachCGroupInet4Connect,
+	"connect6": ebpf.AttachCGroupInet6Connect,
+}
+
+func (a attachment) attachOne(objs *monitorObjects) (link.Link, error) {
+	if a.kprobe && a.ret {
+		return link.Kretprobe(a.name, a.prog(objs), nil)
+	}
+	if a.kprobe {
+		return link.Kprobe(a.name, a.prog(objs), nil)
+	}
+	if a.uprobe {
+		ex, err := link.OpenExecutable(a.binary)
+		if err != nil {
+			return nil, err
+		}
+		if a.ret {
+			return ex.Uretprobe(a.name, a.prog(objs), nil)
+		}
+		return ex.Uprobe(a.name, a.prog(objs), nil)
+	}
+	if a.cgroup {
+		return link.AttachCgroup(link.CgroupOptions{Path: cgroupRoot, Attach: cgroupAttachTypes[a.name], Program: a.prog(objs)})
+	}
+	if a.tc {
+		l, err := link.AttachTCX(link.TCXOptions{Interface: a.iface.index, Program: a.prog(objs), Attach: ebpf.AttachTCXIngress})
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			err = fmt.Errorf("%w (tcx needs Linux 6.6, try --interface-hook xdp)", err)
+		}
+		return l, err
+	}
+	if a.xdp {
+		return link.AttachXDP(link.XDPOptions{Program: a.prog(objs), Interface: a.iface.index})
+	}
+	l, err := link.Tracepoint(a.group, a.name, a.prog(objs), nil)
+	if errors.Is(err, os.ErrPermission) {
+		// The id comes from tracefs, which is only root's by default
+		err = fmt.Errorf("%w (reading tracefs needs root or CAP_DAC_READ_SEARCH)", err)
+	}
+	return l, err
+}
+
+// attach tries a, then its fallbacks, and returns the link and the one
+// that worked. The error has every reason when none of them did.
+func (a attachment) attach(objs *monitorObjects) (link.Link, attachment, error) {
+	var errs []error
+	for _, try := range append([]attachment{a}, a.fallbacks...) {
+		l, err := try.attachOne(objs)
+		if err == nil {
+			if len(errs) > 0 {
+				slog.Info("attachment unavailable, using a fallback", "attachment", a.String(), "fallback", try.String(), "err", errors.Join(errs...))
+			}
+			return l, try, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", try, err))
+	}
+	return nil, a, errors.Join(errs...)
+}
+
+// probe is what --probes names: one or more attachments that are only
+// useful together
+type probe struct {
+	name        string
+	hook        hooks
+	attachments []attachment
+	optional    bool // Warn and carry on if it can't be attached
+}
+
+// probes in attach order. The drop, retransmit, reset, window and state
+// probes share the ring buffer, RTT, top and listen only update maps.
+// sockops does what retransmits, states and rtt do, see sockops.go.
+var probes = []probe{
+	{name: "drops", hook: hookDrops, attachments: []attachment{
+		{group: "skb", name: "kfree_skb", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpDrop },
+			fallbacks: []attachment{
+				// Whichever function the kernel frees dropped skbs with,
+				// newest first; kfree_skb itself has no drop reason
+				{kprobe: true, name: "sk_skb_reason_drop", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeSkSkbReasonDrop }},
+				{kprobe: true, name: "kfree_skb_reason", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeKfreeSkbReason }},
+				{kprobe: true, name: "kfree_skb", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeKfreeSkb }},
+			}},
+	}},
+	{name: "retransmits", hook: hookRetransmits, attachments: []attachment{
+		{group: "tcp", name: "tcp_retransmit_skb", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpRetransmit },
+			fallbacks: []attachment{
+				{kprobe: true, name: "tcp_retransmit_skb", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpRetransmitSkb }},
+			}},
+	}},
+	{name: "resets", hook: hookResets, attachments: []attachment{
+		{group: "tcp", name: "tcp_send_reset", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpResetSent },
+			fallbacks: []attachment{
+				{kprobe: true, name: "tcp_v4_send_reset", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpV4SendReset }},
+			}},
+		{group: "tcp", name: "tcp_receive_reset", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpResetReceived },
+			fallbacks: []attachment{
+				{kprobe: true, name: "tcp_reset", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpReset }},
+			}},
+	}},
+	{name: "windows", hook: hookWindows, attachments: []attachment{
+		{kprobe: true, name: "tcp_rcv_established", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpZeroWindowSent }},
+		{kprobe: true, name: "tcp_send_probe0", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpZeroWindowReceived }},
+	}},
+	{name: "states", hook: hookStates, attachments: []attachment{
+		{group: "sock", name: "inet_sock_set_state", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpState },
+			fallbacks: []attachment{
+				{kprobe: true, name: "tcp_set_state", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpSetState }},
+			}},
+		// Accepted connections are owned by whoever was on the CPU without it
+		{kprobe: true, ret: true, name: "inet_csk_accept", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeInetCskAccept },
+			optional: true},
+	}},
+	// RTT sampling is nice to have, a kernel that won't let us kprobe
+	// tcp_rcv_established shouldn't stop everything else
+	{name: "rtt", hook: hookRTT, optional: true, attachments: []attachment{
+		{kprobe: true, name: "tcp_rcv_established", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpRtt }},
+	}},
+	// Static in tcp_input.c, so a kernel that inlined it has nothing to
+	// attach to; the lifetimes still get the sender's reordering then
+	{name: "reorder", hook: hookReorder, optional: true, attachments: []attachment{
+		{kprobe: true, name: "tcp_data_queue_ofo", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpOoo }},
+	}},
+	// Static too, the same goes for it
+	{name: "sack", hook: hookSACK, optional: true, attachments: []attachment{
+		{kprobe: true, name: "tcp_sacktag_write_queue", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpSack }},
+	}},
+	{name: "keepalive", hook: hookKeepalive, attachments: []attachment{
+		{kprobe: true, name: "tcp_write_wakeup", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpWriteWakeup }},
+	}},
+	{name: "fastopen", hook: hookFastOpen, attachments: []attachment{
+		{kprobe: true, name: "tcp_fastopen_cache_set", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpFastopenCacheSet }},
+		{kprobe: true, name: "tcp_try_fastopen", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpTryFastopen }},
+		{kprobe: true, ret: true, name: "tcp_try_fastopen", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeTcpTryFastopen }},
+	}},
+	// All static in tcp_input.c: without tcp_prune_queue there's nothing to
+	// report, without the other two the events don't say what pruning did
+	{name: "buffers", hook: hookBuffers, optional: true, attachments: []attachment{
+		{kprobe: true, name: "tcp_prune_queue", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpPruneQueue }},
+		{kprobe: true, ret: true, name: "tcp_prune_queue", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeTcpPruneQueue }},
+		{kprobe: true, name: "tcp_collapse", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpCollapse },
+			optional: true},
+		{kprobe: true, name: "tcp_prune_ofo_queue", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpPruneOfoQueue },
+			optional: true},
+	}},
+	{name: "sockopts", hook: hookSockopts, attachments: []attachment{
+		{kprobe: true, name: "sock_setsockopt", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeSockSetsockopt }},
+		{kprobe: true, ret: true, name: "sock_setsockopt", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeSockSetsockopt }},
+		{kprobe: true, name: "tcp_setsockopt", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpSetsockopt }},
+		{kprobe: true, ret: true, name: "tcp_setsockopt", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeTcpSetsockopt }},
+	}},
+	// Both kprobes only mark which socket a handshake is on, see tls.go.
+	// SSL_free only forgets handshakes that never finished; the LRU map
+	// does that too, eventually.
+	{name: "tls", hook: hookTLS, attachments: []attachment{
+		{uprobe: true, name: "SSL_do_handshake", prog: func(o *monitorObjects) *ebpf.Program { return o.UprobeSslDoHandshake }},
+		{uprobe: true, ret: true, name: "SSL_do_handshake", prog: func(o *monitorObjects) *ebpf.Program { return o.UretprobeSslDoHandshake }},
+		{uprobe: true, name: "SSL_connect", prog: func(o *monitorObjects) *ebpf.Program { return o.UprobeSslConnect }},
+		{uprobe: true, ret: true, name: "SSL_connect", prog: func(o *monitorObjects) *ebpf.Program { return o.UretprobeSslConnect }},
+		{uprobe: true, name: "SSL_accept", prog: func(o *monitorObjects) *ebpf.Program { return o.UprobeSslAccept }},
+		{uprobe: true, ret: true, name: "SSL_accept", prog: func(o *monitorObjects) *ebpf.Program { return o.UretprobeSslAccept }},
+		{uprobe: true, name: "SSL_free", prog: func(o *monitorObjects) *ebpf.Program { return o.UprobeSslFree },
+			optional: true},
+		{kprobe: true, name: "tcp_sendmsg", prog: func(o *monitorObjects) *ebpf.Program { return o.TlsTcpSendmsg }},
+		{kprobe: true, name: "tcp_recvmsg", prog: func(o *monitorObjects) *ebpf.Program { return o.TlsTcpRecvmsg }},
+	}},
+	{name: "sockops", hook: hookSockOps, attachments: []attachment{
+		{cgroup: true, name: "sock_ops", prog: func(o *monitorObjects) *ebpf.Program { return o.TcpSockops }},
+		{kprobe: true, ret: true, name: "inet_csk_accept", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeInetCskAccept },
+			optional: true},
+	}},
+	// Both or neither: a rule that only held for IPv4 would be a hole
+	{name: "enforce", hook: hookEnforce, attachments: []attachment{
+		{cgroup: true, name: "connect4", prog: func(o *monitorObjects) *ebpf.Program { return o.EnforceConnect4 }},
+		{cgroup: true, name: "connect6", prog: func(o *monitorObjects) *ebpf.Program { return o.EnforceConnect6 }},
+	}},
+	{name: "top", hook: hookTop, attachments: []attachment{
+		{kprobe: true, name: "tcp_sendmsg", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpSendmsg }},
+		{kprobe: true, name: "tcp_cleanup_rbuf", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpCleanupRbuf }},
+	}},
+	{name: "cgroups", hook: hookCgroups, attachments: []attachment{
+		{kprobe: true, name: "tcp_sendmsg", prog: func(o *monitorObjects) *ebpf.Program { return o.CgroupTcpSendmsg }},
+		{kprobe: true, name: "tcp_cleanup_rbuf", prog: func(o *monitorObjects) *ebpf.Program { return o.CgroupTcpCleanupRbuf }},
+	}},
+	// tcp_v6_rcv is in the ipv6 module on some kernels, IPv4 is still
+	// counted without it
+	{name: "interfaces", hook: hookInterfaces, attachments: []attachment{
+		{tc: true, name: "ingress", prog: func(o *monitorObjects) *ebpf.Program { return o.PrestackTc }},
+		{xdp: true, name: "xdp", prog: func(o *monitorObjects) *ebpf.Program { return o.PrestackXdp }},
+		{kprobe: true, name: "tcp_v4_rcv", prog: func(o *monitorObjects) *ebpf.Program { return o.PrestackTcpV4Rcv }},
+		{kprobe: true, name: "tcp_v6_rcv", prog: func(o *monitorObjects) *ebpf.Program { return o.PrestackTcpV6Rcv },
+			optional: true},
+	}},
+	{name: "listen", hook: hookListen, attachments: []attachment{
+		{kprobe: true, name: "tcp_conn_request", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpConnRequest }},
+		{kprobe: true, name: "tcp_v4_syn_recv_sock", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpV4SynRecvSock }},
+		{kprobe: true, name: "tcp_v6_syn_recv_sock", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceTcpV6SynRecvSock },
+			optional: true},
+	}},
+	// inet6_bind is in the ipv6 module on some kernels, IPv4 binds are
+	// still seen without it
+	{name: "listeners", hook: hookListeners, attachments: []attachment{
+		{kprobe: true, name: "inet_listen", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeInetListen }},
+		{kprobe: true, ret: true, name: "inet_listen", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeInetListen }},
+		{kprobe: true, name: "inet_bind", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeInetBind }},
+		{kprobe: true, ret: true, name: "inet_bind", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeInetBind }},
+		{kprobe: true, name: "inet6_bind", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeInet6Bind },
+			optional: true},
+		{kprobe: true, ret: true, name: "inet6_bind", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeInet6Bind },
+			optional: true},
+		{kprobe: true, name: "tcp_close", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpClose }},
+	}},
+	{name: "icmp", hook: hookICMP, attachments: []attachment{
+		{kprobe: true, name: "tcp_v4_err", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpV4Err }},
+		{kprobe: true, name: "tcp_v6_err", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpV6Err },
+			optional: true},
+		// Connects' tuples, so errors answering a SYN find their connection
+		{kprobe: true, name: "tcp_v4_connect", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpV4Connect },
+			optional: true},
+		{kprobe: true, ret: true, name: "tcp_v4_connect", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeTcpV4Connect },
+			optional: true},
+		{kprobe: true, name: "tcp_v6_connect", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeTcpV6Connect },
+			optional: true},
+		{kprobe: true, ret: true, name: "tcp_v6_connect", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeTcpV6Connect },
+			optional: true},
+	}},
+	// udpv6_sendmsg is in the ipv6 module on some kernels, and the
+	// tracepoint is missing without tracefs; sends still get through
+	{name: "udp", hook: hookUDP, attachments: []attachment{
+		{kprobe: true, name: "udp_sendmsg", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeUdpSendmsg }},
+		{kprobe: true, ret: true, name: "udp_sendmsg", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeUdpSendmsg }},
+		{kprobe: true, name: "udpv6_sendmsg", prog: func(o *monitorObjects) *ebpf.Program { return o.KprobeUdpv6Sendmsg },
+			optional: true},
+		{kprobe: true, ret: true, name: "udpv6_sendmsg", prog: func(o *monitorObjects) *ebpf.Program { return o.KretprobeUdpv6Sendmsg },
+			optional: true},
+		{group: "udp", name: "udp_fail_queue_rcv_skb", prog: func(o *monitorObjects) *ebpf.Program { return o.TraceUdpFailQueueRcvSkb },
+			optional: true},
+	}},
+}
+
+func probeNameList() string {
+	names := make([]string, len(probes))
+	for i, p := range probes {
+		names[i] = p.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// probeNamed is the probe --probes calls name
+func probeNamed(name string) (*probe, error) {
+	for i := range probes {
+		if probes[i].name == name {
+			return &probes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown probe %q, use: %s", name, probeNameList())
+}
+
+// parseProbes turns --probes into hooks
+func parseProbes(names listFlag) (hooks, error) {
+	var h hooks
+	for _, name := range names {
+		p, err := probeNamed(name)
+		if err != nil {
+			return 0, err
+		}
+		h |= p.hook
+	}
+	return h, nil
+}
+
+// --proto protocols, PROTO_* in bpf/monitor.c
+const (
+	protoTCP = 1
+	protoUDP = 2
+)
+
+// parseProtocols applies --proto to a command's hooks and events, and
+// returns them with the protocols whose drops the kernel side reports.
+// Without --proto that's every protocol, as before UDP was monitored.
+func parseProtocols(names listFlag, h hooks, events uint32) (hooks, uint32, uint32, error) {
+	if len(names) == 0 {
+		return h, events, protoTCP | protoUDP, nil
+	}
+	var protocols uint32
+	for _, name := range names {
+		switch name {
+		case "tcp":
+			protocols |= protoTCP
+		case "udp":
+			protocols |= protoUDP
+		default:
+			return 0, 0, 0, fmt.Errorf("unknown protocol %q, use: tcp or udp", name)
+		}
+	}
+	if protocols&protoUDP != 0 {
+		h |= hookUDP
+		events |= 1 << eventUDPError
+	}
+	if protocols&protoTCP == 0 {
+		h &= hookDrops | hookUDP
+		events &= 1<<eventDrop | 1<<eventUDPError
+	}
+	return h, events, protocols, nil
+}
+
+// ProbeManager attaches the probes for a set of hooks and keeps their links
+// until Close. With a pin path the links are also pinned, see pin.go.
+type ProbeManager struct {
+	objs      *monitorObjects
+	pinPath   string
+	tlsLibs   []string       // What the tls probe's uprobes go on, see tlsLibraries
+	ifaces    []netInterface // --interface, what the interfaces probe's tc or XDP program goes on
+	ifaceHook string         // --interface-hook
+	active    hooks
+	links     []probeLink
+	failed    []string // Optional probes and attachments that couldn't be attached, and why
+
+	pinsRemoved bool // The previous run's links are gone
+	pinWarned   bool
+
+	mu sync.Mutex // Close and Enable and Disable from the API against Check from /healthz
+}
+
+type probeLink struct {
+	probe  *probe
+	target attachment
+	link   link.Link
+
+	inspectable bool // Its info could be read right after attaching, see Check
+}
+
+// NewProbeManager attaches to objs, pinning the links under pinPath
+// (--pin-path) unless it's empty. Uprobes go on each of tlsLibs, the tc
+// or XDP program (ifaceHook) on each of ifaces.
+func NewProbeManager(objs *monitorObjects, pinPath string, tlsLibs []string, ifaces []netInterface, ifaceHook string) *ProbeManager {
+	return &ProbeManager{objs: objs, pinPath: pinPath, tlsLibs: tlsLibs, ifaces: ifaces, ifaceHook: ifaceHook}
+}
+
+// Attach attaches every probe in h. If a required probe fails, whatever
+// Attach got to so far is detached again before the error is returned.
+func (m *ProbeManager) Attach(h hooks) error {
+	if m.pinPath != "" && !m.pinsRemoved {
+		if err := removePinnedLinks(m.pinPath); err != nil {
+			return fmt.Errorf("removing pinned links: %w", err)
+		}
+		m.pinsRemoved = true
+	}
+	for i := range probes {
+		p := &probes[i]
+		if h&p.hook == 0 || m.active&p.hook != 0 {
+			continue
+		}
+		if err := m.attachProbe(p); err != nil {
+			if p.optional {
+				m.failed = append(m.failed, fmt.Sprintf("%s (%v)", p.name, err))
+				continue
+			}
+			err = fmt.Errorf("attaching %s probe: %w", p.name, err)
+			if uerr := m.unpin(); uerr != nil {
+				err = errors.Join(err, uerr)
+			}
+			m.Close()
+			return err
+		}
+		m.active |= p.hook
+	}
+	return nil
+}
+
+// attachments is p's attachments with each uprobe once per library, and
+// the tc or XDP program, whichever --interface-hook says, once per interface
+func (m *ProbeManager) attachments(p *probe) []attachment {
+	var all []attachment
+	for _, a := range p.attachments {
+		switch {
+		case a.uprobe:
+			for _, lib := range m.tlsLibs {
+				a.binary = lib
+				all = append(all, a)
+			}
+		case a.tc || a.xdp:
+			if a.tc != (m.ifaceHook == interfaceHookTC) {
+				continue
+			}
+			for _, iface := range m.ifaces {
+				a.iface = iface
+				all = append(all, a)
+			}
+		default:
+			all = append(all, a)
+		}
+	}
+	return all
+}
+
+// attachProbe attaches all of p or none of it, its optional attachments aside
+func (m *ProbeManager) attachProbe(p *probe) error {
+	var attached []probeLink
+	for _, a := range m.attachments(p) {
+		l, target, err := a.attach(m.objs)
+		if err != nil && a.optional {
+			m.failed = append(m.failed, fmt.Sprintf("%s (%v)", p.name, err))
+			continue
+		}
+		if err != nil {
+			for _, pl := range attached {
+				pl.link.Close()
+			}
+			return err
+		}
+		slog.Debug("attached", "probe", p.name, "attachment", target.String())
+		_, infoErr := l.Info()
+		attached = append(attached, probeLink{probe: p, target: target, link: l, inspectable: infoErr == nil})
+	}
+	m.links = append(m.links, attached...)
+	if m.pinPath != "" {
+		m.pin(attached)
+	}
+	return nil
+}
+
+// pin pins links as <probe>_[<library or interface>_]<function or tracepoint>[_ret] under
+// the links directory. Kprobe and tracepoint links can only be pinned from 5.15 on, the
+// sock_ops cgroup link from 5.7; before that they stay attached only while
+// the monitor runs.
+func (m *ProbeManager) pin(links []probeLink) {
+	for _, pl := range links {
+		name := pl.probe.name + "_" + pl.target.name
+		if pl.target.uprobe {
+			name = pl.probe.name + "_" + filepath.Base(pl.target.binary) + "_" + pl.target.name
+		}
+		if pl.target.tc || pl.target.xdp {
+			name = pl.probe.name + "_" + pl.target.iface.name + "_" + pl.target.name
+		}
+		if pl.target.ret {
+			name += "_ret" // Next to the kprobe on the same function
+		}
+		err := pl.link.Pin(filepath.Join(pinLinksDir(m.pinPath), name))
+		if err == nil || m.pinWarned {
+			continue
+		}
+		m.pinWarned = true
+		if errors.Is(err, link.ErrNotSupported) {
+			slog.Warn("this kernel can't pin kprobe and tracepoint links, the probes detach when the monitor exits")
+		} else {
+			slog.Warn("pinning link", "attachment", pl.target.String(), "err", err)
+		}
+	}
+}
+
+// unpin removes the pins of every link, so Close really detaches them.
+// A pin it can't remove keeps its link attached after Close.
+func (m *ProbeManager) unpin() error {
+	var errs []error
+	for _, pl := range m.links {
+		if err := pl.link.Unpin(); err != nil {
+			errs = append(errs, fmt.Errorf("unpinning %s: %w", pl.target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Active is the hooks that are attached right now
+func (m *ProbeManager) Active() hooks {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// Names lists the attached probes by their --probes name
+func (m *ProbeManager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for _, p := range probes {
+		if m.active&p.hook != 0 {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// Report lists the attached probes and logs the optional ones that failed, e.g.
+//
+//	Probes: drops (tracepoint:skb:kfree_skb), states (tracepoint:sock:inet_sock_set_state)
+func (m *ProbeManager) Report(w io.Writer) {
+	var parts []string
+	for i := 0; i < len(m.links); {
+		p := m.links[i].probe
+		var targets []string
+		for ; i < len(m.links) && m.links[i].probe == p; i++ {
+			targets = append(targets, m.links[i].target.String())
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", p.name, strings.Join(targets, ", ")))
+	}
+	if len(parts) == 0 {
+		parts = []string{"none"}
+	}
+	fmt.Fprintf(w, "Probes: %s\n", strings.Join(parts, ", "))
+	for _, f := range m.failed {
+		slog.Warn("probe not attached", "probe", f)
+	}
+}
+
+// kprobesEnabled is the switch for every kprobe on the host, which
+// echo 0 > ... turns off without detaching anything
+const kprobesEnabled = "/sys/kernel/debug/kprobes/enabled"
+
+// Check says whether the probes are still attached: each link is asked
+// for its info, which fails once it's been detached from under us, and
+// kprobes must not have been turned off host-wide. Links whose info
+// couldn't be read when they were attached (perf events on older kernels,
+// links before 5.8) are taken as attached.
+func (m *ProbeManager) Check() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.links) == 0 {
+		return errors.New("no probes attached")
+	}
+	kprobes := false
+	for _, pl := range m.links {
+		if _, err := pl.link.Info(); err != nil && pl.inspectable {
+			return fmt.Errorf("%s %s detached: %w", pl.probe.name, pl.target, err)
+		}
+		kprobes = kprobes || pl.target.kprobe
+	}
+	if b, err := os.ReadFile(kprobesEnabled); kprobes && err == nil && strings.TrimSpace(string(b)) == "0" {
+		return fmt.Errorf("kprobes are disabled host-wide (%s is 0)", kprobesEnabled)
+	}
+	return nil
+}
+
+// Close detaches everything, so nothing new reaches the ring buffer.
+// Pinned links stay attached, Close only lets go of them.
+func (m *ProbeManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []error
+	for _, pl := range m.links {
+		if err := pl.link.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("detaching %s: %w", pl.target, err))
+		}
+	}
+	m.links = nil
+	m.active = 0
+	return errors.Join(errs...)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// ProcessInfo is what /proc says about the process behind an event, beyond
+// the 16 byte comm the kernel gives us
+type ProcessInfo struct {
+	Cmdline string // Arguments joined by spaces, cut at maxCmdline bytes
+	UID     uint32 // Effective, like ps shows
+	User    string // The UID's name, or the number if it has none
+	Cgroup  string // cgroup v2 path, e.g. /system.slice/nginx.service
+}
+
+const (
+	processCacheSize = 4096
+	processCacheTTL  = 10 * time.Second // After that a PID is read again, it may have been reused
+	processReads     = 1024             // PIDs waiting to be read, past that they're asked for again on a later event
+	maxCmdline       = 512
+)
+
+// ProcessEnricher attaches ProcessInfo to events (--process-info). Each PID
+// is read from /proc once per processCacheTTL and kept in an LRU cache,
+// including PIDs that were already gone, so a burst of events from one
+// process costs one read. Like netnsResolver, the reads happen on a
+// goroutine of their own rather than the processor's: a PID it doesn't
+// know yet is queued, so the first events of a new process go without
+// its details, and one read more than processCacheTTL ago keeps what was
+// read until it's read again.
+//
+// Owners that exited before their events came, a close after a short-lived
+// client quit, say, are looked up in proc_owners instead, where the kernel
+// side put their command line and UID when they connected or accepted.
+// Events with an owner from the connection table say when it started
+// (PidStart), so a process that got its PID since isn't taken for it, in
+// /proc or in proc_owners.
+type ProcessEnricher struct {
+	mu      sync.Mutex // The processor's lookups and the reader's results
+	lru     *list.List // Of *processEntry, most recently used first
+	entries map[ownerKey]*list.Element
+	pending map[ownerKey]bool // Queued for the reader
+	reads   chan processRead
+
+	users   map[uint32]string // Reader goroutine only
+	owners  *ebpf.Map         // proc_owners
+	cgroups *cgroupResolver   // For the cgroup paths of owners that exited, nil to leave them out
+}
+
+// ownerKey is a PID and its start time in clock ticks since boot, as
+// /proc/<pid>/stat has it cut to 32 bits, or 0 when the event didn't say
+type ownerKey struct {
+	pid, start uint32
+}
+
+// processRead is a process to read, with the cgroup its event had for
+// proc_owners' copy
+type processRead struct {
+	key      ownerKey
+	cgroupID uint64
+}
+
+type processEntry struct {
+	key  ownerKey
+	read time.Time
+	info *ProcessInfo // nil when the process had exited
+}
+
+func NewProcessEnricher(owners *ebpf.Map, cgroups *cgroupResolver) *ProcessEnricher {
+	e := &ProcessEnricher{
+		lru:     list.New(),
+		entries: make(map[ownerKey]*list.Element),
+		pending: make(map[ownerKey]bool),
+		reads:   make(chan processRead, processReads),
+		users:   make(map[uint32]string),
+		owners:  owners,
+		cgroups: cgroups,
+	}
+	go e.reader()
+	return e
+}
+
+// sizeProcOwners gives proc_owners room for as many processes as the cache
+// holds and turns recording them on
+func sizeProcOwners(spec *ebpf.CollectionSpec) error {
+	m, ok := spec.Maps["proc_owners"]
+	if !ok {
+		return errors.New("map proc_owners not found in BPF object")
+	}
+	m.MaxEntries = processCacheSize
+	return setVariable(spec, "capture_owners", uint8(1))
+}
+
+func (e *ProcessEnricher) Enrich(event *TcpEvent) {
+	if event.Pid == 0 { // Softirq on an idle CPU, no process to speak of
+		return
+	}
+	event.Process = e.lookup(ownerKey{event.Pid, event.PidStart}, event.CgroupID)
+}
+
+// lookup is what the cache has for the process, nil while it's being read
+// for the first time. One that isn't cached or is due again is queued.
+func (e *ProcessEnricher) lookup(key ownerKey, cgroupID uint64) *ProcessInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var info *ProcessInfo
+	if el, ok := e.entries[key]; ok {
+		entry := el.Value.(*processEntry)
+		e.lru.MoveToFront(el)
+		if time.Since(entry.read) < processCacheTTL {
+			return entry.info
+		}
+		info = entry.info
+	}
+	if !e.pending[key] {
+		select {
+		case e.reads <- processRead{key, cgroupID}:
+			e.pending[key] = true
+		default: // The reader is behind, the next event asks again
+		}
+	}
+	return info
+}
+
+// reader reads the queued processes into the cache
+func (e *ProcessEnricher) reader() {
+	for r := range e.reads {
+		info := e.read(r.key)
+		if info == nil {
+			info = e.recorded(r.key, r.cgroupID)
+		}
+		e.store(r.key, info)
+	}
+}
+
+func (e *ProcessEnricher) store(key ownerKey, info *ProcessInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.pending, key)
+	if el, ok := e.entries[key]; ok {
+		e.lru.Remove(el)
+	}
+	e.entries[key] = e.lru.PushFront(&processEntry{key: key, read: time.Now(), info: info})
+	if e.lru.Len() > processCacheSize {
+		oldest := e.lru.Back()
+		e.lru.Remove(oldest)
+		delete(e.entries, oldest.Value.(*processEntry).key)
+	}
+}
+
+// read returns nil if the process is gone, or has been replaced by one
+// that started later, and whatever it could read if the process exits
+// halfway through
+func (e *ProcessEnricher) read(key ownerKey) *ProcessInfo {
+	pid := key.pid
+	if start, ok := procStart(pid); !ok || key.start != 0 && start != key.start {
+		return nil
+	}
+	uid, ok := procUID(pid)
+	if !ok {
+		return nil
+	}
+	info := &ProcessInfo{UID: uid, User: e.userName(uid)}
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		info.Cmdline = formatCmdline(data)
+	}
+	info.Cgroup, _ = procCgroupPath(pid)
+	return info
+}
+
+// recorded is what proc_owners kept of an owner that exited, or nil. It
+// needs the start time, without it the entry could be an earlier process's.
+func (e *ProcessEnricher) recorded(key ownerKey, cgroupID uint64) *ProcessInfo {
+	var o monitorProcOwner
+	if e.owners == nil || key.start == 0 || e.owners.Lookup(monitorProcOwnerKey{Tgid: key.pid, Start: key.start}, &o) != nil {
+		return nil
+	}
+	info := &ProcessInfo{UID: o.Uid, User: e.userName(o.Uid)}
+	cmdline := make([]byte, min(int(o.CmdlineLen), len(o.Cmdline)))
+	for i := range cmdline {
+		cmdline[i] = byte(o.Cmdline[i])
+	}
+	info.Cmdline = formatCmdline(cmdline)
+	if e.cgroups != nil && cgroupID != 0 {
+		info.Cgroup, _ = e.cgroups.Path(cgroupID)
+	}
+	return info
+}
+
+// formatCmdline turns the NUL separated arguments into one line. Kernel
+// threads have an empty cmdline.
+func formatCmdline(data []byte) string {
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) > maxCmdline {
+		data = data[:maxCmdline]
+	}
+	return string(bytes.ReplaceAll(data, []byte{0}, []byte{' '}))
+}
+
+// procStart reads a process's start time from /proc/<pid>/stat, field 22
+// in clock ticks since boot, cut to 32 bits like the kernel side's
+func procStart(pid uint32) (uint32, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, false
+	}
+	// The comm before them is in parentheses and may hold spaces and parentheses itself
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 { // From field 3, the state, on
+		return 0, false
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	return uint32(start), err == nil
+}
+
+// procUID reads the effective UID from the Uid: line of /proc/<pid>/status,
+// which lists the real, effective, saved and filesystem UIDs
+func procUID(pid uint32) (uint32, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, "Uid:"); ok {
+			fields := strings.Fields(rest)
+			if len(fields) < 2 {
+				return 0, false
+			}
+			uid, err := strconv.ParseUint(fields[1], 10, 32)
+			return uint32(uid), err == nil
+		}
+	}
+	return 0, false
+}
+
+// userName caches UID -> name for good, there are only so many users
+func (e *ProcessEnricher) userName(uid uint32) string {
+	if name, ok := e.users[uid]; ok {
+		return name
+	}
+	id := strconv.FormatUint(uint64(uid), 10)
+	name := id
+	if u, err := user.LookupId(id); err == nil {
+		name = u.Username
+	}
+	e.users[uid] = name
+	return name
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Lookups don't read /proc themselves, the PID is there once the reader got to it
+func TestProcessLookup(t *testing.T) {
+	e := NewProcessEnricher(nil, nil)
+	pid := uint32(os.Getpid())
+	start, ok := procStart(pid)
+	if !ok {
+		t.Fatal("no start time for our own PID")
+	}
+	key := ownerKey{pid, start}
+	deadline := time.Now().Add(5 * time.Second)
+	var info *ProcessInfo
+	for info == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("own PID never read")
+		}
+		info = e.lookup(key, 0)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(info.Cmdline, os.Args[0]) || info.UID != uint32(os.Geteuid()) {
+		t.Errorf("got %+v, want our command line and UID %d", info, os.Geteuid())
+	}
+
+	// Due again, the old entry stands in while it's read
+	e.mu.Lock()
+	e.entries[key].Value.(*processEntry).read = time.Now().Add(-processCacheTTL)
+	e.mu.Unlock()
+	if again := e.lookup(key, 0); again != info {
+		t.Errorf("expired entry: got %+v, want the cached one", again)
+	}
+
+	// Another start time is another process, one that had the PID before us
+	if info := e.read(ownerKey{pid, start + 1}); info != nil {
+		t.Errorf("reused PID: got %+v, want nil", info)
+	}
+}
+
+func TestFormatCmdline(t *testing.T) {
+	for _, tt := range []struct {
+		data, want string
+	}{
+		{"java\x00-jar\x00orders.jar\x00", "java -jar orders.jar"},
+		{"", ""}, // Kernel threads
+		{"nginx: worker process\x00\x00\x00", "nginx: worker process"},
+		{strings.Repeat("a", maxCmdline+10), strings.Repeat("a", maxCmdline)},
+	} {
+		if got := formatCmdline([]byte(tt.data)); got != tt.want {
+			t.Errorf("formatCmdline(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProcessReport is --process-report: per process, what its connections
+// went through, printed below the summary at exit and on SIGUSR1, and on
+// GET /api/v1/processes. A digest of the run to start a post-mortem from,
+// rather than the raw events to aggregate by hand. It's an observer, so it
+// counts what made it through the filters, and only what the command's
+// events carry: connects and failures come from state events, bytes and
+// retransmits from close events, which covers accepted connections too.
+//
+// Processes are told apart by PID and comm, so a PID reused by another
+// program gets its own row. Drops are charged like their pid, to the
+// connection's owner when the monitor tracks it.
+
+const (
+	processReportMax   = 4096 // Processes tallied, later ones go to one "other" row
+	processReportPeers = 64   // Remote ends tallied per process
+	processWorstPeers  = 3    // Shown per process
+)
+
+type processKey struct {
+	pid  uint32
+	comm string
+}
+
+type processTally struct {
+	connects, failed uint64 // connect() calls, and the ones that never got established
+	closed           uint64 // Connections closed, accepted ones included
+	retransmitted    uint64 // Of those, the ones with at least one retransmit
+	retransmits      uint64
+	resets, drops    uint64
+	sent, received   uint64
+	peers            map[netip.AddrPort]*peerTally
+}
+
+// peerTally is one remote end's trouble, for the worst destinations
+type peerTally struct {
+	failed, resets, drops, retransmits uint64
+}
+
+func (t *peerTally) trouble() uint64 { return t.failed + t.resets + t.drops + t.retransmits }
+
+type ProcessReport struct {
+	mu        sync.Mutex // Observe runs on the processor goroutine, readers on their own
+	processes map[processKey]*processTally
+}
+
+// GET /api/v1/processes, most trouble first
+type apiProcess struct {
+	Pid               uint32    `json:"pid"` // 0 for the row of processes past the first 4096
+	Comm              string    `json:"comm"`
+	Connects          uint64    `json:"connects"`
+	Failed            uint64    `json:"failed"`
+	Closed            uint64    `json:"closed"`
+	Retransmitted     uint64    `json:"retransmitted"` // Closed connections with a retransmit
+	RetransmitPct     float64   `json:"retransmit_pct"`
+	Retransmits       uint64    `json:"retransmits"`
+	Resets            uint64    `json:"resets"`
+	Drops             uint64    `json:"drops"`
+	BytesSent         uint64    `json:"bytes_sent"`
+	BytesReceived     uint64    `json:"bytes_received"`
+	WorstDestinations []apiPeer `json:"worst_destinations"`
+}
+
+type apiPeer struct {
+	Addr        string `json:"addr"` // ip:port
+	Failed      uint64 `json:"failed"`
+	Resets      uint64 `json:"resets"`
+	Drops       uint64 `json:"drops"`
+	Retransmits uint64 `json:"retransmits"`
+}
+
+func NewProcessReport() *ProcessReport {
+	return &ProcessReport{processes: make(map[processKey]*processTally)}
+}
+
+func (r *ProcessReport) Observe(event *TcpEvent, p *EventProcessor) {
+	switch event.Type {
+	case eventState, eventClose, eventReset, eventDrop:
+	default:
+		return
+	}
+	if event.Pid == 0 { // Softirq on an idle CPU
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.tally(processKey{pid: event.Pid, comm: commString(event.Comm[:])})
+	n := event.occurrences()
+	switch event.Type {
+	case eventState:
+		switch {
+		case event.State == tcpSynSent:
+			t.connects++
+		case event.OldState == tcpSynSent && event.State == tcpClose:
+			t.failed++
+			if peer := t.peer(event); peer != nil {
+				peer.failed++
+			}
+		}
+	case eventClose:
+		t.closed++
+		t.sent += event.BytesSent
+		t.received += event.BytesReceived
+		if event.Retransmits > 0 {
+			t.retransmitted++
+			t.retransmits += uint64(event.Retransmits)
+			if peer := t.peer(event); peer != nil {
+				peer.retransmits += uint64(event.Retransmits)
+			}
+		}
+	case eventReset:
+		t.resets += n
+		if peer := t.peer(event); peer != nil {
+			peer.resets += n
+		}
+	case eventDrop:
+		t.drops += n
+		if peer := t.peer(event); peer != nil {
+			peer.drops += n
+		}
+	}
+}
+
+func (r *ProcessReport) tally(k processKey) *processTally {
+	if t, ok := r.processes[k]; ok {
+		return t
+	}
+	if len(r.processes) >= processReportMax {
+		k = processKey{comm: "other"}
+		if t, ok := r.processes[k]; ok {
+			return t
+		}
+	}
+	t := &processTally{peers: make(map[netip.AddrPort]*peerTally)}
+	r.processes[k] = t
+	return t
+}
+
+// peer is the event's remote end, nil without a tuple or once the process
+// has as many as are kept
+func (t *processTally) peer(event *TcpEvent) *peerTally {
+	if event.Family == 0 {
+		return nil
+	}
+	port := event.Dport
+	if event.Type == eventDrop {
+		port = event.Sport // Like remoteAddr, most drops are of received packets
+	}
+	addr := netip.AddrPortFrom(remoteAddr(event), port)
+	if peer, ok := t.peers[addr]; ok {
+		return peer
+	}
+	if len(t.peers) >= processReportPeers {
+		return nil
+	}
+	peer := &peerTally{}
+	t.peers[addr] = peer
+	return peer
+}
+
+// Processes is every process seen, most trouble first, then busiest
+func (r *ProcessReport) Processes() []apiProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make([]apiProcess, 0, len(r.processes))
+	for k, t := range r.processes {
+		p := apiProcess{
+			Pid:           k.pid,
+			Comm:          k.comm,
+			Connects:      t.connects,
+			Failed:        t.failed,
+			Closed:        t.closed,
+			Retransmitted: t.retransmitted,
+			Retransmits:   t.retransmits,
+			Resets:        t.resets,
+			Drops:         t.drops,
+			BytesSent:     t.sent,
+			BytesReceived: t.received,
+		}
+		if t.closed > 0 {
+			p.RetransmitPct = 100 * float64(t.retransmitted) / float64(t.closed)
+		}
+		for addr, peer := range t.peers {
+			if peer.trouble() == 0 {
+				continue
+			}
+			p.WorstDestinations = append(p.WorstDestinations, apiPeer{
+				Addr:        addr.String(),
+				Failed:      peer.failed,
+				Resets:      peer.resets,
+				Drops:       peer.drops,
+				Retransmits: peer.retransmits,
+			})
+		}
+		sort.Slice(p.WorstDestinations, func(i, j int) bool {
+			a, b := p.WorstDestinations[i], p.WorstDestinations[j]
+			if ta, tb := a.trouble(), b.trouble(); ta != tb {
+				return ta > tb
+			}
+			return a.Addr < b.Addr
+		})
+		if len(p.WorstDestinations) > processWorstPeers {
+			p.WorstDestinations = p.WorstDestinations[:processWorstPeers]
+		}
+		all = append(all, p)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if ta, tb := a.trouble(), b.trouble(); ta != tb {
+			return ta > tb
+		}
+		if a.Connects+a.Closed != b.Connects+b.Closed {
+			return a.Connects+a.Closed > b.Connects+b.Closed
+		}
+		return a.Pid < b.Pid
+	})
+	return all
+}
+
+func (p apiProcess) trouble() uint64 { return p.Failed + p.Resets + p.Drops + p.Retransmits }
+
+func (p apiPeer) trouble() uint64 { return p.Failed + p.Resets + p.Drops + p.Retransmits }
+
+func (r *ProcessReport) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/processes", r.handleProcesses)
+}
+
+func (r *ProcessReport) handleProcesses(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, r.Processes())
+}
+
+// Print writes the n processes with the most trouble as a table, e.g.
+//
+//	PID     COMM             CONNECTS FAILED  CLOSED RESETS  DROPS    TX_KB    RX_KB RETRANS WORST DESTINATIONS
+//	4242    curl                   12      2      10      1      0     1200    40000   20.0% 10.0.0.9:443 (3), 10.0.0.7:443 (1)
+func (r *ProcessReport) Print(w io.Writer, n int) {
+	all := r.Processes()
+	if len(all) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nProcesses (%d seen):\n%-7s %-16s %8s %6s %7s %6s %6s %8s %8s %7s %s\n", len(all),
+		"PID", "COMM", "CONNECTS", "FAILED", "CLOSED", "RESETS", "DROPS", "TX_KB", "RX_KB", "RETRANS", "WORST DESTINATIONS")
+	if len(all) > n {
+		all = all[:n]
+	}
+	for _, p := range all {
+		retrans := "-" // No closes to tell from
+		if p.Closed > 0 {
+			retrans = fmt.Sprintf("%.1f%%", p.RetransmitPct)
+		}
+		worst := make([]string, len(p.WorstDestinations))
+		for i, peer := range p.WorstDestinations {
+			worst[i] = fmt.Sprintf("%s (%d)", peer.Addr, peer.trouble())
+		}
+		fmt.Fprintf(w, "%-7d %-16s %8d %6d %7d %6d %6d %8d %8d %7s %s\n",
+			p.Pid, p.Comm, p.Connects, p.Failed, p.Closed, p.Resets, p.Drops,
+			p.BytesSent/1024, p.BytesReceived/1024, retrans, strings.Join(worst, ", "))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// --bpf-stats has the kernel count how often each of our programs ran and
+// for how long, so the monitor's own cost shows up next to what it
+// measures. The kernel only keeps these while someone asks for them, and
+// then for every BPF program on the host, which is why it's a flag.
+
+// enableProgramStats turns the run time stats on until the returned Closer
+// is closed. Before 5.8 there's no BPF_ENABLE_STATS, but the stats may
+// still be on through the kernel.bpf_stats_enabled sysctl.
+func enableProgramStats() (io.Closer, error) {
+	c, err := ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME))
+	if err == nil {
+		return c, nil
+	}
+	if b, _ := os.ReadFile("/proc/sys/kernel/bpf_stats_enabled"); strings.TrimSpace(string(b)) == "1" {
+		return io.NopCloser(nil), nil
+	}
+	if capErr := needCaps("turning BPF stats on, or sysctl kernel.bpf_stats_enabled=1", unix.CAP_SYS_ADMIN); capErr != nil {
+		return nil, fmt.Errorf("%w (%w)", err, capErr)
+	}
+	return nil, fmt.Errorf("%w (needs Linux 5.8, or sysctl kernel.bpf_stats_enabled=1 before that)", err)
+}
+
+// attachedProgram is one program the ProbeManager attached, by the probe
+// and the hook it's on
+type attachedProgram struct {
+	probe  string
+	target string
+	prog   *ebpf.Program
+}
+
+// Programs lists the attached programs, each one once. The list stays
+// valid after Close, the programs live as long as the collection.
+func (m *ProbeManager) Programs() []attachedProgram {
+	var progs []attachedProgram
+	seen := make(map[*ebpf.Program]bool)
+	for _, pl := range m.links {
+		prog := pl.target.prog(m.objs)
+		if seen[prog] {
+			continue
+		}
+		seen[prog] = true
+		progs = append(progs, attachedProgram{probe: pl.probe.name, target: pl.target.String(), prog: prog})
+	}
+	return progs
+}
+
+// programStat is what the kernel counted for one program since it was loaded
+type programStat struct {
+	Probe    string
+	Target   string
+	RunCount uint64
+	Runtime  time.Duration
+}
+
+// readProgramStats asks the kernel for the stats of progs. Programs that
+// can't be read, e.g. closed already, are left out.
+func readProgramStats(progs []attachedProgram) []programStat {
+	stats := make([]programStat, 0, len(progs))
+	for _, p := range progs {
+		s, err := p.prog.Stats()
+		if err != nil {
+			continue
+		}
+		stats = append(stats, programStat{Probe: p.probe, Target: p.target, RunCount: s.RunCount, Runtime: s.Runtime})
+	}
+	return stats
+}
+
+// printProgramStats writes the stats box of the end-of-run report. CPU is
+// the share of one CPU the program took over the run.
+func printProgramStats(w io.Writer, stats []programStat, elapsed time.Duration) {
+	fmt.Fprintln(w, "\n╔══════════════════════════════════════════════════════════════════════╗")
+	fmt.Fprintf(w, "║  %-66s  ║\n", "BPF PROGRAMS")
+	fmt.Fprintln(w, "╠══════════════════════════════════════════════════════════════════════╣")
+	fmt.Fprintf(w, "║ %-39s %10s %8s %8s ║\n", "PROBE", "RUNS", "AVG", "CPU")
+	var runs uint64
+	var runtime time.Duration
+	for _, s := range stats {
+		fmt.Fprintf(w, "║ %-39.39s %10d %8s %7.3f%% ║\n", s.Probe+" "+s.Target,
+			s.RunCount, avgRuntime(s.RunCount, s.Runtime), cpuPercent(s.Runtime, elapsed))
+		runs += s.RunCount
+		runtime += s.Runtime
+	}
+	fmt.Fprintln(w, "╠══════════════════════════════════════════════════════════════════════╣")
+	fmt.Fprintf(w, "║ %-39s %10d %8s %7.3f%% ║\n", "Total", runs, avgRuntime(runs, runtime), cpuPercent(runtime, elapsed))
+	fmt.Fprintln(w, "╚══════════════════════════════════════════════════════════════════════╝")
+}
+
+func avgRuntime(runs uint64, runtime time.Duration) string {
+	if runs == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dns", uint64(runtime.Nanoseconds())/runs)
+}
+
+func cpuPercent(runtime, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return 100 * runtime.Seconds() / elapsed.Seconds()
+}
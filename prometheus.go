@@ -0,0 +1,781 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PromExporter serves drop/retransmit counters and live connection gauges
+// on /metrics. Counters are driven by the event pipeline; the connection
+// gauge is computed at scrape time from the kernel's conns map, so it shows
+// what the kernel is tracking right now rather than a sum of opens and closes.
+type PromExporter struct {
+	registry     *prometheus.Registry
+	drops        *prometheus.CounterVec
+	retransmits  *prometheus.CounterVec
+	dsacks       *prometheus.CounterVec
+	resets       *prometheus.CounterVec
+	slowConns    *prometheus.CounterVec
+	listenDrops  *prometheus.CounterVec
+	zeroWindows  *prometheus.CounterVec
+	udpErrors    *prometheus.CounterVec
+	icmpErrors   *prometheus.CounterVec
+	keepalives   *prometheus.CounterVec
+	fastopens    *prometheus.CounterVec
+	buffers      *prometheus.CounterVec
+	synFloods    *prometheus.CounterVec
+	blocked      *prometheus.CounterVec
+	sockopts     *prometheus.CounterVec
+	listens      *prometheus.CounterVec
+	links        *prometheus.CounterVec
+	tunnelDrops  *prometheus.CounterVec
+	tlsConnects  *prometheus.HistogramVec
+	conns        *ebpf.Map
+	connsDesc    *prometheus.Desc
+	rttDesc      *prometheus.Desc
+	cwndDesc     *prometheus.Desc
+	ssthreshDesc *prometheus.Desc
+	oooDesc      *prometheus.Desc
+	reorderDesc  *prometheus.Desc
+	histDescs    map[uint32]*prometheus.Desc // By histogram kind
+
+	// --cgroup-metrics, cgroupStats is nil without it
+	cgroupStats       *ebpf.Map
+	cgroups           *cgroupResolver
+	cgroupDropsDesc   *prometheus.Desc
+	cgroupRetransDesc *prometheus.Desc
+	cgroupSentDesc    *prometheus.Desc
+	cgroupRecvDesc    *prometheus.Desc
+
+	// --interface, nil without it
+	interfaces         *InterfaceCounters
+	ifaceSegmentsDesc  *prometheus.Desc
+	ifaceBytesDesc     *prometheus.Desc
+	ifaceReachedDesc   *prometheus.Desc
+	ifaceMalformedDesc *prometheus.Desc
+	ifaceSynsDesc      *prometheus.Desc
+
+	// --bpf-stats, nil without it
+	programs        []attachedProgram
+	progRunsDesc    *prometheus.Desc
+	progRuntimeDesc *prometheus.Desc
+
+	// Running totals of the --hist-interval histograms, which the kernel
+	// clears on every flush
+	histMu     sync.Mutex
+	hists      map[promHistKey]*promHist
+	pods       *K8sEnricher       // nil without --k8s
+	containers *ContainerEnricher // nil without --containers
+	geo        *GeoEnricher       // nil without --geoip
+
+	// When each per-connection counter series was last added to
+	connMu      sync.Mutex
+	connSeries  map[promConnSeries]time.Time
+	connExpired time.Time // Last look for idle ones
+}
+
+// Tuple labels shared by the per-connection metrics
+// namespace, pod and container are empty (so dropped by Prometheus) without
+// --k8s and --containers, country and asn (the remote end's) without --geoip
+var connLabels = []string{"laddr", "lport", "raddr", "rport", "comm", "namespace", "pod", "container", "country", "asn"}
+
+// Labels of the --cgroup-metrics totals, cgroup is the path under /sys/fs/cgroup
+var cgroupLabels = []string{"cgroup", "namespace", "pod", "container"}
+
+type promHistKey struct {
+	kind  uint32
+	raddr string
+}
+
+type promHist struct {
+	latencyHist
+	updated time.Time // Last flush that counted into it
+}
+
+// A destination's histograms are dropped once no flush counted into them
+// for promHistIdle, and the ones idle longest once there are more than
+// promHistMaxSeries, so a host talking to ever new addresses doesn't grow
+// them without end. One that comes back starts from zero, like a counter
+// after a restart.
+const (
+	promHistIdle      = time.Hour
+	promHistMaxSeries = 4096
+)
+
+// A series of one of the counters labelled by connection, its label values
+// joined by NULs
+type promConnSeries struct {
+	vec    *prometheus.CounterVec
+	labels string
+}
+
+// The same for the counters with connLabels, whose local port makes a new
+// series for nearly every client connection. Past promConnMaxSeries a
+// quarter of them goes at once, so they aren't sorted on every event.
+const (
+	promConnIdle      = time.Hour
+	promConnMaxSeries = 16384
+)
+
+func podLabels(pod *PodInfo) (namespace, name string) {
+	if pod == nil {
+		return "", ""
+	}
+	return pod.Namespace, pod.Name
+}
+
+func containerLabel(c *ContainerInfo) string {
+	if c == nil {
+		return ""
+	}
+	return c.Name
+}
+
+// lost reports the events the kernel couldn't hand over so far
+// suppressed reports the events --conn-limit held back
+// sampleRate is --sample as it is now, exported so the counters can be
+// scaled back up
+// programs are read for their run counts and time with --bpf-stats
+// queue is the reader to processor queue, for its depth and drops, and
+// sinks the queues of the sinks behind it
+// cgroupStats is read for the per-cgroup totals with --cgroup-metrics, their
+// paths come from cgroups
+// interfaces is read for the --interface counters
+// labels (--label) are added to every metric, a name one of them already
+// has is an error
+func NewPromExporter(conns *ebpf.Map, lost, suppressed func() uint64, sampleRate func() uint32, programs []attachedProgram, queue *eventQueue, sinks *SinkFanout, pods *K8sEnricher, containers *ContainerEnricher, geo *GeoEnricher, cgroupStats *ebpf.Map, cgroups *cgroupResolver, interfaces *InterfaceCounters, labels map[string]string) (*PromExporter, error) {
+	e := &PromExporter{
+		registry: prometheus.NewRegistry(),
+		drops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_drops_total",
+			Help: "Packets dropped by the kernel (kfree_skb with a drop reason), by reason and the layer of the stack that dropped them.",
+		}, []string{"reason", "layer", "comm", "namespace", "pod", "container"}), // kfree_skb doesn't give us the tuple
+		retransmits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_retransmits_total",
+			Help: "TCP segments retransmitted.",
+		}, connLabels),
+		dsacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_dsacks_total",
+			Help: "DSACKs received: segments the peer got twice, usually because a retransmit of them was spurious.",
+		}, connLabels),
+		resets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_resets_total",
+			Help: "TCP resets sent and received; reason is only known for sent ones, from 6.10 on.",
+		}, []string{"direction", "reason", "raddr", "comm", "namespace", "pod", "container", "country", "asn"}), // Ports would be one series per scanned port
+		slowConns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_slow_connects_total",
+			Help: "Outgoing connections whose handshake took longer than --slow-connect.",
+		}, connLabels),
+		zeroWindows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_zero_windows_total",
+			Help: "Zero window stalls, direction sent when this host's reader (comm) fell behind, received when the peer's did.",
+		}, append([]string{"direction"}, connLabels...)),
+		udpErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_udp_errors_total",
+			Help: "UDP sends that failed (direction sent) and datagrams that couldn't be queued on their socket (received), by errno, with --proto udp.",
+		}, []string{"direction", "error", "lport", "comm", "namespace", "pod", "container"}), // Peers would be one series per DNS client
+		icmpErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_icmp_errors_total",
+			Help: "ICMP destination unreachable and fragmentation needed / packet too big messages about TCP segments this host sent, by message and remote address.",
+		}, []string{"message", "raddr", "comm", "namespace", "pod", "container", "country", "asn"}),
+		keepalives: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_keepalive_failures_total",
+			Help: "Keepalive probes the peer left unanswered (kind unanswered), and connections keepalive gave up on and closed (timeout).",
+		}, []string{"kind", "raddr", "comm", "namespace", "pod", "container", "country", "asn"}),
+		fastopens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_fastopen_total",
+			Help: "TCP Fast Open SYNs sent and received, by outcome: COOKIE_REQUEST, ACCEPTED, or why it fell back to a plain handshake. port is the server's.",
+		}, []string{"direction", "outcome", "port", "comm", "namespace", "pod", "container"}),
+		tlsConnects: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tcpmon_tls_connect_seconds",
+			Help:    "Time TLS connections took to set up, by phase: the TCP handshake (tcp, clients only), the wait until the program started TLS (wait) and the TLS handshake (tls). port is the server's.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14), // 0.5ms to 4s
+		}, []string{"phase", "side", "port", "comm", "namespace", "pod", "container"}),
+		buffers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_receive_buffer_prunes_total",
+			Help: "Segments that arrived with the connection over its receive buffer, by what pruning took: COLLAPSED, OFO_PRUNED (out-of-order data thrown away) or DROPPED (the segment too).",
+		}, []string{"kind", "lport", "comm", "namespace", "pod", "container"}),
+		synFloods: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_syn_floods_total",
+			Help: "Seconds in which a source prefix sent more SYNs than --syn-flood, by prefix and the interface they arrived on.",
+		}, []string{"prefix", "interface"}),
+		blocked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_blocked_connects_total",
+			Help: "connect() calls --enforce failed, by the --block rule and the process that made them.",
+		}, []string{"rule", "comm", "namespace", "pod", "container"}),
+		sockopts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_sockopts_total",
+			Help: "setsockopt calls on TCP sockets, by option, whether the call changed it (changed, unchanged or failed) and the process that made them.",
+		}, []string{"option", "result", "comm", "namespace", "pod", "container"}),
+		listens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_listen_events_total",
+			Help: "Listeners started and closed, and bind() and listen() calls on TCP sockets that failed, by kind, errno, port and the process.",
+		}, []string{"kind", "errno", "lport", "comm", "namespace", "pod", "container"}),
+		links: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_interface_events_total",
+			Help: "Drops and retransmits by the interface they happened on (a drop's packet's device, a retransmit's route's), its VLAN and the bond or bridge it's a port of.",
+		}, []string{"event", "interface", "vlan", "master"}),
+		tunnelDrops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_tunnel_drops_total",
+			Help: "Drops of VXLAN and Geneve packets, by tunnel, VNI and the drop reason.",
+		}, []string{"tunnel", "vni", "reason"}),
+		listenDrops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpmon_listen_drops_total",
+			Help: "SYNs and handshakes a listening socket dropped because its SYN or accept queue (queue) was full.",
+		}, []string{"queue", "laddr", "lport", "comm"}),
+		conns:      conns,
+		pods:       pods,
+		containers: containers,
+		geo:        geo,
+		connsDesc: prometheus.NewDesc("tcpmon_active_connections",
+			"TCP connections opened since the monitor started and not yet closed.",
+			connLabels, nil),
+		rttDesc: prometheus.NewDesc("tcpmon_connection_rtt_seconds",
+			"Smoothed RTT of live connections over the samples taken so far (stat is min, avg or max).",
+			append(connLabels[:len(connLabels):len(connLabels)], "stat"), nil),
+		cwndDesc: prometheus.NewDesc("tcpmon_connection_cwnd_segments",
+			"Congestion window of live connections at the last RTT sample, by congestion control algorithm.",
+			append(connLabels[:len(connLabels):len(connLabels)], "congestion_control"), nil),
+		ssthreshDesc: prometheus.NewDesc("tcpmon_connection_ssthresh_segments",
+			"Slow start threshold of live connections at the last RTT sample, once a loss has set it.",
+			append(connLabels[:len(connLabels):len(connLabels)], "congestion_control"), nil),
+		oooDesc: prometheus.NewDesc("tcpmon_connection_ooo_packets",
+			"Segments live connections received out of order so far, with the reorder probe. Only connections that received any.",
+			connLabels, nil),
+		reorderDesc: prometheus.NewDesc("tcpmon_connection_reordering_segments",
+			"The sender's reordering degree of live connections at the last RTT sample, the kernel's default (net.ipv4.tcp_reordering) until it sees reordering.",
+			connLabels, nil),
+		cgroupStats: cgroupStats,
+		cgroups:     cgroups,
+		cgroupDropsDesc: prometheus.NewDesc("tcpmon_cgroup_drops_total",
+			"Packets dropped by the kernel, by the cgroup of their socket, with --cgroup-metrics. Sampling and --conn-limit don't apply.",
+			cgroupLabels, nil),
+		cgroupRetransDesc: prometheus.NewDesc("tcpmon_cgroup_retransmits_total",
+			"TCP segments retransmitted, by the cgroup of their socket, with --cgroup-metrics.",
+			cgroupLabels, nil),
+		cgroupSentDesc: prometheus.NewDesc("tcpmon_cgroup_sent_bytes_total",
+			"Bytes written to TCP sockets, by the cgroup of the socket, with --cgroup-metrics.",
+			cgroupLabels, nil),
+		cgroupRecvDesc: prometheus.NewDesc("tcpmon_cgroup_received_bytes_total",
+			"Bytes read from TCP sockets, by the cgroup of the socket, with --cgroup-metrics.",
+			cgroupLabels, nil),
+		interfaces: interfaces,
+		ifaceSegmentsDesc: prometheus.NewDesc("tcpmon_interface_tcp_segments_total",
+			"TCP segments that arrived on the interface, counted at tc ingress or in XDP (hook), with --interface.",
+			[]string{"interface", "hook"}, nil),
+		ifaceBytesDesc: prometheus.NewDesc("tcpmon_interface_tcp_bytes_total",
+			"Bytes of the TCP segments that arrived on the interface, from the IP header on, with --interface.",
+			[]string{"interface", "hook"}, nil),
+		ifaceReachedDesc: prometheus.NewDesc("tcpmon_interface_tcp_reached_total",
+			"TCP segments from the interface that reached the TCP stack, with --interface; segments minus this is what was dropped or forwarded before it.",
+			[]string{"interface"}, nil),
+		ifaceMalformedDesc: prometheus.NewDesc("tcpmon_interface_tcp_malformed_total",
+			"TCP segments that arrived on the interface malformed, by kind: truncated, bad_header or bad_flags, with --interface.",
+			[]string{"interface", "kind"}, nil),
+		ifaceSynsDesc: prometheus.NewDesc("tcpmon_interface_tcp_syns_total",
+			"SYNs opening a connection that arrived on the interface, counted where segments are, with --interface.",
+			[]string{"interface", "hook"}, nil),
+		programs: programs,
+		progRunsDesc: prometheus.NewDesc("tcpmon_bpf_program_runs_total",
+			"Times each attached BPF program ran, with --bpf-stats",
+			[]string{"probe", "attachment"}, nil),
+		progRuntimeDesc: prometheus.NewDesc("tcpmon_bpf_program_runtime_seconds_total",
+			"CPU time spent in each attached BPF program, with --bpf-stats",
+			[]string{"probe", "attachment"}, nil),
+		histDescs: map[uint32]*prometheus.Desc{
+			histConnect: prometheus.NewDesc("tcpmon_connect_latency_seconds",
+				"Time from SYN_SENT to ESTABLISHED for outgoing connections, by remote address (--hist-interval).",
+				[]string{"raddr"}, nil),
+			histRTT: prometheus.NewDesc("tcpmon_rtt_seconds",
+				"Smoothed RTT samples by remote address (--hist-interval).",
+				[]string{"raddr"}, nil),
+		},
+		hists:      make(map[promHistKey]*promHist),
+		connSeries: make(map[promConnSeries]time.Time),
+	}
+
+	lostEvents := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "tcpmon_events_lost_total",
+		Help: "Events dropped because the ring buffer (or perf buffer) was full; the other metrics undercount by this much.",
+	}, func() float64 { return float64(lost()) })
+
+	suppressedEvents := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "tcpmon_events_suppressed_total",
+		Help: "Drops and retransmits held back by --conn-limit, not in the other event counters.",
+	}, func() float64 { return float64(suppressed()) })
+
+	sample := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tcpmon_sample_rate",
+		Help: "N of --sample 1/N: the event counters count about one in N events, multiply them by this for the real rate.",
+	}, func() float64 { return float64(sampleRate()) })
+
+	queueDepth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tcpmon_queue_depth",
+		Help: "Events read from the kernel and waiting for the processor.",
+	}, func() float64 { return float64(queue.Depth()) })
+
+	queueSize := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcpmon_queue_size",
+		Help: "Most events that can wait for the processor, --buffer-size.",
+	})
+	queueSize.Set(float64(queue.size))
+
+	droppedEvents := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "tcpmon_events_dropped_total",
+		Help: "Events dropped in userspace because the queue to the processor was full (--overflow-policy drop); the other metrics undercount by this much.",
+	}, func() float64 { return float64(queue.Dropped()) })
+
+	queueBlocked := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "tcpmon_queue_blocked_seconds_total",
+		Help: "Time the reader waited for room in the queue to the processor (--overflow-policy block).",
+	}, func() float64 { return queue.Blocked().Seconds() })
+
+	reg := prometheus.WrapRegistererWith(labels, e.registry)
+	for _, c := range []prometheus.Collector{e.drops, e.retransmits, e.dsacks, e.resets, e.slowConns, e.zeroWindows, e.udpErrors, e.icmpErrors, e.keepalives, e.fastopens, e.buffers, e.synFloods, e.blocked, e.sockopts, e.listens, e.links, e.tunnelDrops, e.tlsConnects, e.listenDrops, lostEvents, suppressedEvents, sample,
+		queueDepth, queueSize, droppedEvents, queueBlocked, sinks, e} {
+		if err := reg.Register(c); err != nil {
+			return nil, err // Only a --label clashing with a metric's own labels gets here
+		}
+	}
+	return e, nil
+}
+
+// Observe updates the counters for one event
+// Called from the processor goroutine only
+func (e *PromExporter) Observe(event *TcpEvent, p *EventProcessor) {
+	comm := commString(event.Comm[:])
+	namespace, pod := podLabels(event.Pod)
+	container := containerLabel(event.Container)
+	country, asn := geoLabels(event.Geo)
+	n := float64(event.occurrences())
+	if l := event.Link; l != nil && l.Ifindex != 0 {
+		var vlan string
+		if l.Vlan != 0 {
+			vlan = strconv.Itoa(int(l.Vlan))
+		}
+		e.links.WithLabelValues(eventTypeNames[event.Type], linkName(l.Ifindex, l.Name), vlan, l.Master).Add(n)
+	}
+
+	switch event.Type {
+	case eventDrop:
+		e.drops.WithLabelValues(p.reasonName(event.Reason), p.dropLayer(event), comm, namespace, pod, container).Add(n)
+		if event.Tunnel != 0 {
+			e.tunnelDrops.WithLabelValues(tunnelNames[event.Tunnel], strconv.Itoa(int(event.Vni)), p.reasonName(event.Reason)).Add(n)
+		}
+	case eventRetransmit:
+		e.connCounter(e.retransmits, n,
+			formatAddr(event.Saddr), strconv.Itoa(int(event.Sport)),
+			formatAddr(event.Daddr), strconv.Itoa(int(event.Dport)),
+			comm, namespace, pod, container, country, asn)
+	case eventDSACK:
+		e.connCounter(e.dsacks, n,
+			formatAddr(event.Saddr), strconv.Itoa(int(event.Sport)),
+			formatAddr(event.Daddr), strconv.Itoa(int(event.Dport)),
+			comm, namespace, pod, container, country, asn)
+	case eventReset:
+		var reason string
+		if event.Direction == rstSent {
+			reason = p.resetReasonName(event.Reason)
+		}
+		e.resets.WithLabelValues(directionNames[event.Direction], reason, formatAddr(event.Daddr),
+			comm, namespace, pod, container, country, asn).Add(n)
+	case eventZeroWindow:
+		e.connCounter(e.zeroWindows, 1, directionNames[event.Direction],
+			formatAddr(event.Saddr), strconv.Itoa(int(event.Sport)),
+			formatAddr(event.Daddr), strconv.Itoa(int(event.Dport)),
+			comm, namespace, pod, container, country, asn)
+	case eventUDPError:
+		e.udpErrors.WithLabelValues(directionNames[event.Direction], errnoName(event.Reason), strconv.Itoa(int(event.Sport)),
+			comm, namespace, pod, container).Add(n)
+	case eventICMPError:
+		e.icmpErrors.WithLabelValues(icmpName(event.Family, event.Reason), formatAddr(event.Daddr),
+			comm, namespace, pod, container, country, asn).Add(n)
+	case eventKeepalive:
+		e.keepalives.WithLabelValues(strings.ToLower(keepaliveNames[event.Direction]), formatAddr(event.Daddr),
+			comm, namespace, pod, container, country, asn).Inc()
+	case eventBuffer:
+		e.buffers.WithLabelValues(bufferNames[event.Direction], strconv.Itoa(int(event.Sport)),
+			comm, namespace, pod, container).Add(n)
+	case eventFastOpen:
+		port := event.Dport // The server's end
+		if event.Direction == fastopenReceived {
+			port = event.Sport
+		}
+		e.fastopens.WithLabelValues(directionNames[event.Direction], fastopenNames[event.Reason], strconv.Itoa(int(port)),
+			comm, namespace, pod, container).Inc()
+	case eventTLS:
+		side, port := tlsSideNames[event.Direction], event.Dport
+		if event.Direction == tlsServer {
+			port = event.Sport
+		}
+		for _, phase := range []struct {
+			name string
+			ns   uint64
+		}{{"tcp", event.TCPConnectNs}, {"wait", event.TLSWaitNs}, {"tls", event.DurationNs}} {
+			if phase.ns == 0 && phase.name != "tls" {
+				continue // Accepted connections have no TCP handshake to report
+			}
+			e.tlsConnects.WithLabelValues(phase.name, side, strconv.Itoa(int(port)),
+				comm, namespace, pod, container).Observe(float64(phase.ns) / 1e9)
+		}
+	case eventSynFlood:
+		e.synFloods.WithLabelValues(synFloodPrefix(event), synFloodInterface(event)).Inc()
+	case eventBlocked:
+		e.blocked.WithLabelValues(blockedRule(event), comm, namespace, pod, container).Add(float64(event.occurrences()))
+	case eventSockopt:
+		e.sockopts.WithLabelValues(sockoptName(event.Sockopt), sockoptResult(event), comm, namespace, pod, container).Add(float64(event.occurrences()))
+	case eventListen:
+		var errno string
+		if event.Reason != 0 {
+			errno = errnoName(event.Reason)
+		}
+		e.listens.WithLabelValues(listenKinds[event.Direction], errno, strconv.Itoa(int(event.Sport)),
+			comm, namespace, pod, container).Inc()
+	case eventConnect:
+		e.connCounter(e.slowConns, 1,
+			formatAddr(event.Saddr), strconv.Itoa(int(event.Sport)),
+			formatAddr(event.Daddr), strconv.Itoa(int(event.Dport)),
+			comm, namespace, pod, container, country, asn)
+	}
+}
+
+// connCounter adds n to a per-connection counter's series and notes when,
+// for expireConnSeries
+func (e *PromExporter) connCounter(vec *prometheus.CounterVec, n float64, labels ...string) {
+	now := time.Now()
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	vec.WithLabelValues(labels...).Add(n)
+	e.connSeries[promConnSeries{vec: vec, labels: strings.Join(labels, "\x00")}] = now
+	if len(e.connSeries) > promConnMaxSeries || now.Sub(e.connExpired) >= time.Minute {
+		e.expireConnSeries(now)
+	}
+}
+
+// expireConnSeries deletes the idle per-connection series, called with
+// connMu held
+func (e *PromExporter) expireConnSeries(now time.Time) {
+	e.connExpired = now
+	for s, updated := range e.connSeries {
+		if now.Sub(updated) >= promConnIdle {
+			s.vec.DeleteLabelValues(strings.Split(s.labels, "\x00")...)
+			delete(e.connSeries, s)
+		}
+	}
+	if len(e.connSeries) > promConnMaxSeries {
+		series := make([]promConnSeries, 0, len(e.connSeries))
+		for s := range e.connSeries {
+			series = append(series, s)
+		}
+		slices.SortFunc(series, func(a, b promConnSeries) int { return e.connSeries[a].Compare(e.connSeries[b]) })
+		for _, s := range series[:len(series)-promConnMaxSeries*3/4] {
+			s.vec.DeleteLabelValues(strings.Split(s.labels, "\x00")...)
+			delete(e.connSeries, s)
+		}
+	}
+}
+
+// ObserveAggregates adds one --aggregate interval to the counters. The
+// kernel doesn't keep the owner of drops, so their comm is empty, and the
+// tables have no cgroup to find pods and containers by.
+func (e *PromExporter) ObserveAggregates(a *aggregates, p *EventProcessor) {
+	for _, d := range a.Drops {
+		reason := p.reasonName(d.Reason)
+		e.drops.WithLabelValues(reason, dropLayer(findNearestSymbol(d.Location), reason), "", "", "", "").Add(float64(d.Count))
+	}
+	for _, r := range a.Retransmits {
+		country, asn := geoLabels(e.geo.Lookup(netip.AddrFrom16(r.Daddr)))
+		e.connCounter(e.retransmits, float64(r.Count),
+			formatAddr(r.Saddr), strconv.Itoa(int(r.Sport)),
+			formatAddr(r.Daddr), strconv.Itoa(int(r.Dport)),
+			r.Comm, "", "", "", country, asn)
+	}
+}
+
+// ObserveListenDrops adds one interval of the listen command's table
+func (e *PromExporter) ObserveListenDrops(entries []listenDrop) {
+	for _, l := range entries {
+		laddr, lport := formatAddr(l.Addr), strconv.Itoa(int(l.Port))
+		if l.SynQueueDrops > 0 {
+			e.listenDrops.WithLabelValues("syn", laddr, lport, l.Comm).Add(float64(l.SynQueueDrops))
+		}
+		if l.AcceptQueueDrops > 0 {
+			e.listenDrops.WithLabelValues("accept", laddr, lport, l.Comm).Add(float64(l.AcceptQueueDrops))
+		}
+	}
+}
+
+// Describe and Collect make PromExporter a prometheus.Collector for the
+// connection gauge
+
+func (e *PromExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.connsDesc
+	ch <- e.rttDesc
+	ch <- e.cwndDesc
+	ch <- e.ssthreshDesc
+	ch <- e.oooDesc
+	ch <- e.reorderDesc
+	ch <- e.progRunsDesc
+	ch <- e.progRuntimeDesc
+	ch <- e.cgroupDropsDesc
+	ch <- e.cgroupRetransDesc
+	ch <- e.cgroupSentDesc
+	ch <- e.cgroupRecvDesc
+	ch <- e.ifaceSegmentsDesc
+	ch <- e.ifaceBytesDesc
+	ch <- e.ifaceReachedDesc
+	ch <- e.ifaceMalformedDesc
+	ch <- e.ifaceSynsDesc
+	for _, d := range e.histDescs {
+		ch <- d
+	}
+}
+
+// ObserveHistograms adds one flush of the kernel histograms to the totals
+func (e *PromExporter) ObserveHistograms(hists []latencyHist) {
+	now := time.Now()
+	e.histMu.Lock()
+	defer e.histMu.Unlock()
+	for i := range hists {
+		k := promHistKey{kind: hists[i].Kind, raddr: formatAddr(hists[i].Raddr)}
+		total := e.hists[k]
+		if total == nil {
+			total = &promHist{latencyHist: latencyHist{Kind: hists[i].Kind, Raddr: hists[i].Raddr, Buckets: hists[i].Buckets}}
+			e.hists[k] = total
+		}
+		for slot, c := range hists[i].Slots {
+			total.Slots[slot] += c
+		}
+		total.updated = now
+	}
+	e.expireHistograms(now)
+}
+
+// expireHistograms drops the idle histograms, called with histMu held
+func (e *PromExporter) expireHistograms(now time.Time) {
+	for k, h := range e.hists {
+		if now.Sub(h.updated) >= promHistIdle {
+			delete(e.hists, k)
+		}
+	}
+	if over := len(e.hists) - promHistMaxSeries; over > 0 {
+		keys := make([]promHistKey, 0, len(e.hists))
+		for k := range e.hists {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, func(a, b promHistKey) int { return e.hists[a].updated.Compare(e.hists[b].updated) })
+		for _, k := range keys[:over] {
+			delete(e.hists, k)
+		}
+	}
+}
+
+// collectHistograms turns the kernel's slots into Prometheus buckets, whose
+// upper bounds are the slot boundaries (2µs, 4µs, 8µs... by default, see
+// histBuckets). The sum isn't known exactly, so it's estimated from the
+// middle of each slot.
+func (e *PromExporter) collectHistograms(ch chan<- prometheus.Metric) {
+	e.histMu.Lock()
+	defer e.histMu.Unlock()
+	for k, h := range e.hists {
+		buckets := make(map[float64]uint64, len(h.Buckets))
+		var count uint64
+		var sum float64
+		for i, c := range h.slots() {
+			lo, hi := h.slotBounds(i)
+			count += c
+			sum += float64(c) * (lo + hi) / 2 / 1e6
+			if i < len(h.Buckets) { // The last slot is open ended, it only counts towards +Inf
+				buckets[hi/1e6] = count
+			}
+		}
+		ch <- prometheus.MustNewConstHistogram(e.histDescs[k.kind], count, sum, buckets, k.raddr)
+	}
+}
+
+// collectCgroups reads the --cgroup-metrics totals. Cgroups that resolve to
+// the same labels (ids not seen in /sys/fs/cgroup yet, say) are summed, as
+// two series can't share labels.
+func (e *PromExporter) collectCgroups(ch chan<- prometheus.Metric) {
+	if e.cgroupStats == nil {
+		return
+	}
+	stats, err := readCgroupStats(e.cgroupStats)
+	if err != nil {
+		slog.Warn("reading cgroup counters", "err", err)
+	}
+	type cgroupKey struct {
+		cgroup, namespace, pod, container string
+	}
+	totals := make(map[cgroupKey]*monitorCgroupStats)
+	for id, s := range stats {
+		var k cgroupKey
+		if id != 0 { // Not owned by a socket, see sock_cgroup
+			k.cgroup, _ = e.cgroups.Path(id)
+			if e.pods != nil {
+				k.namespace, k.pod = podLabels(e.pods.Pod(id))
+			}
+			if e.containers != nil {
+				k.container = containerLabel(e.containers.Container(id, 0))
+			}
+		}
+		t := totals[k]
+		if t == nil {
+			t = &monitorCgroupStats{}
+			totals[k] = t
+		}
+		t.Drops += s.Drops
+		t.Retransmits += s.Retransmits
+		t.BytesSent += s.BytesSent
+		t.BytesReceived += s.BytesReceived
+	}
+	for k, t := range totals {
+		labels := []string{k.cgroup, k.namespace, k.pod, k.container}
+		ch <- prometheus.MustNewConstMetric(e.cgroupDropsDesc, prometheus.CounterValue, float64(t.Drops), labels...)
+		ch <- prometheus.MustNewConstMetric(e.cgroupRetransDesc, prometheus.CounterValue, float64(t.Retransmits), labels...)
+		ch <- prometheus.MustNewConstMetric(e.cgroupSentDesc, prometheus.CounterValue, float64(t.BytesSent), labels...)
+		ch <- prometheus.MustNewConstMetric(e.cgroupRecvDesc, prometheus.CounterValue, float64(t.BytesReceived), labels...)
+	}
+}
+
+// collectInterfaces reads the --interface counters
+func (e *PromExporter) collectInterfaces(ch chan<- prometheus.Metric) {
+	if e.interfaces == nil {
+		return
+	}
+	all, err := e.interfaces.Read()
+	if err != nil {
+		slog.Warn("reading interface counters", "err", err)
+		return
+	}
+	for _, a := range all {
+		ch <- prometheus.MustNewConstMetric(e.ifaceSegmentsDesc, prometheus.CounterValue, float64(a.Segments), a.Interface, a.Hook)
+		ch <- prometheus.MustNewConstMetric(e.ifaceBytesDesc, prometheus.CounterValue, float64(a.Bytes), a.Interface, a.Hook)
+		ch <- prometheus.MustNewConstMetric(e.ifaceReachedDesc, prometheus.CounterValue, float64(a.ReachedTCP), a.Interface)
+		ch <- prometheus.MustNewConstMetric(e.ifaceMalformedDesc, prometheus.CounterValue, float64(a.Truncated), a.Interface, "truncated")
+		ch <- prometheus.MustNewConstMetric(e.ifaceMalformedDesc, prometheus.CounterValue, float64(a.BadHeader), a.Interface, "bad_header")
+		ch <- prometheus.MustNewConstMetric(e.ifaceMalformedDesc, prometheus.CounterValue, float64(a.BadFlags), a.Interface, "bad_flags")
+		ch <- prometheus.MustNewConstMetric(e.ifaceSynsDesc, prometheus.CounterValue, float64(a.Syns), a.Interface, a.Hook)
+	}
+}
+
+func (e *PromExporter) Collect(ch chan<- prometheus.Metric) {
+	e.collectHistograms(ch)
+	e.collectCgroups(ch)
+	e.collectInterfaces(ch)
+	for _, s := range readProgramStats(e.programs) {
+		ch <- prometheus.MustNewConstMetric(e.progRunsDesc, prometheus.CounterValue, float64(s.RunCount), s.Probe, s.Target)
+		ch <- prometheus.MustNewConstMetric(e.progRuntimeDesc, prometheus.CounterValue, s.Runtime.Seconds(), s.Probe, s.Target)
+	}
+
+	type connKey struct {
+		laddr, lport, raddr, rport, comm, namespace, pod, container, country, asn string
+	}
+	// Connections sharing all labels are merged, but with the local port in
+	// the key that's rare. Their windows and out-of-order segments add up,
+	// the reordering is the most any of them saw.
+	type connStats struct {
+		count              float64
+		rttSamples         uint64
+		rttSumUs           uint64
+		rttMinUs, rttMaxUs uint32
+		congestion         string // "" until one of them was sampled
+		cwnd, ssthresh     float64
+		ooo                float64
+		reordering         uint32
+	}
+	stats := make(map[connKey]*connStats)
+
+	var key uint64
+	var info monitorConnInfo
+	iter := e.conns.Iterate()
+	for iter.Next(&key, &info) {
+		var comm [16]byte
+		for i, c := range info.Comm {
+			comm[i] = byte(c)
+		}
+		k := connKey{
+			laddr: formatAddr(info.Saddr),
+			lport: strconv.Itoa(int(info.Sport)),
+			raddr: formatAddr(info.Daddr),
+			rport: strconv.Itoa(int(info.Dport)),
+			comm:  commString(comm[:]),
+		}
+		if e.pods != nil {
+			k.namespace, k.pod = podLabels(e.pods.Pod(info.CgroupId))
+		}
+		if e.containers != nil {
+			k.container = containerLabel(e.containers.Container(info.CgroupId, info.Pid))
+		}
+		if e.geo != nil {
+			k.country, k.asn = geoLabels(e.geo.Lookup(netip.AddrFrom16(info.Daddr)))
+		}
+		st := stats[k]
+		if st == nil {
+			st = &connStats{}
+			stats[k] = st
+		}
+		st.count++
+		if info.RttSamples > 0 {
+			if st.rttSamples == 0 || info.RttMinUs < st.rttMinUs {
+				st.rttMinUs = info.RttMinUs
+			}
+			st.rttMaxUs = max(st.rttMaxUs, info.RttMaxUs)
+			st.rttSamples += uint64(info.RttSamples)
+			st.rttSumUs += info.RttSumUs
+			st.reordering = max(st.reordering, info.Reordering)
+		}
+		st.ooo += float64(info.OooPackets)
+		if c := congestionFromConn(&info); c != nil {
+			st.congestion = c.Algorithm
+			st.cwnd += float64(c.Cwnd)
+			st.ssthresh += float64(c.Ssthresh)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.Warn("iterating connection table", "err", err)
+	}
+
+	for k, st := range stats {
+		labels := []string{k.laddr, k.lport, k.raddr, k.rport, k.comm, k.namespace, k.pod, k.container, k.country, k.asn}
+		ch <- prometheus.MustNewConstMetric(e.connsDesc, prometheus.GaugeValue, st.count, labels...)
+		if st.ooo > 0 { // Most connections never see any, no need for a series each
+			ch <- prometheus.MustNewConstMetric(e.oooDesc, prometheus.GaugeValue, st.ooo, labels...)
+		}
+		if st.reordering != 0 {
+			ch <- prometheus.MustNewConstMetric(e.reorderDesc, prometheus.GaugeValue, float64(st.reordering), labels...)
+		}
+		if st.congestion != "" {
+			ccLabels := append(labels[:len(labels):len(labels)], st.congestion)
+			ch <- prometheus.MustNewConstMetric(e.cwndDesc, prometheus.GaugeValue, st.cwnd, ccLabels...)
+			if st.ssthresh > 0 {
+				ch <- prometheus.MustNewConstMetric(e.ssthreshDesc, prometheus.GaugeValue, st.ssthresh, ccLabels...)
+			}
+		}
+		if st.rttSamples == 0 {
+			continue
+		}
+		for stat, us := range map[string]float64{
+			"min": float64(st.rttMinUs),
+			"avg": float64(st.rttSumUs) / float64(st.rttSamples),
+			"max": float64(st.rttMaxUs),
+		} {
+			ch <- prometheus.MustNewConstMetric(e.rttDesc, prometheus.GaugeValue, us/1e6, append(labels, stat)...)
+		}
+	}
+}
+
+// Register adds /metrics to the --listen-addr server
+func (e *PromExporter) Register(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runQuery is the query subcommand: reads events stored with --db back,
+// without loading anything into the kernel
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	var (
+		dbPath, since, until string
+		types, comms, addrs  listFlag
+		pids, ports          listFlag
+		group, format        string
+		limit                int
+	)
+	fs.StringVar(&dbPath, "db", "", "Database written with --db (required)")
+	fs.StringVar(&since, "since", "1h", "Start of the range: a duration back from now, e.g. 30m, or an RFC 3339 time")
+	fs.StringVar(&until, "until", "", "End of the range, same forms as --since (defaults to now)")
+	fs.Var(&types, "type", "Only these event types: drop, retransmit, state, close, connect (repeatable or comma separated)")
+	fs.Var(&pids, "pid", "Only these PIDs (repeatable or comma separated)")
+	fs.Var(&comms, "comm", "Only these process names (repeatable or comma separated)")
+	fs.Var(&addrs, "addr", "Only events with either end at these addresses (repeatable or comma separated)")
+	fs.Var(&ports, "port", "Only events with either end on these ports (repeatable or comma separated)")
+	fs.StringVar(&group, "group", "", "Count events per value of this column instead of listing them, e.g. reason, daddr or comm")
+	fs.IntVar(&limit, "limit", 100, "Print at most this many rows, the latest ones (0 for all)")
+	fs.StringVar(&format, "format", formatText, "Output format: text or json (one object per line)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s query --db <file> [flags]\n\nSearch events stored with --db\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if dbPath == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if format != formatText && format != formatJSON {
+		fatal("invalid --format, use: text or json", "format", format)
+	}
+	if group != "" && !slices.Contains(csvColumns, group) {
+		fatal("invalid --group, use one of: "+strings.Join(csvColumns, ", "), "group", group)
+	}
+
+	now := time.Now()
+	from, err := parseQueryTime(since, now)
+	if err != nil {
+		fatal("invalid --since", "err", err)
+	}
+	to := now
+	if until != "" {
+		if to, err = parseQueryTime(until, now); err != nil {
+			fatal("invalid --until", "err", err)
+		}
+	}
+
+	// Stored the way formatAddr prints them, IPv4 without the ::ffff: prefix
+	for i, a := range addrs {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			fatal("invalid --addr", "err", err)
+		}
+		addrs[i] = addr.Unmap().String()
+	}
+
+	where := []string{"timestamp >= ?", "timestamp <= ?"}
+	params := []any{from.UnixNano(), to.UnixNano()}
+	in := func(cols []string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+		var or []string
+		for _, c := range cols {
+			or = append(or, fmt.Sprintf("%s IN (%s)", c, marks))
+			for _, v := range values {
+				params = append(params, v)
+			}
+		}
+		where = append(where, "("+strings.Join(or, " OR ")+")")
+	}
+	in([]string{"type"}, types)
+	in([]string{"pid"}, pids)
+	in([]string{"comm"}, comms)
+	in([]string{"saddr", "daddr"}, addrs)
+	in([]string{"sport", "dport"}, ports)
+
+	limitClause := ""
+	if limit > 0 {
+		limitClause = " LIMIT " + strconv.Itoa(limit)
+	}
+	var query string
+	if group != "" {
+		query = fmt.Sprintf("SELECT %s, SUM(COALESCE(events.count, 1)) AS count FROM events WHERE %s GROUP BY 1 ORDER BY count DESC%s",
+			group, strings.Join(where, " AND "), limitClause)
+	} else {
+		// The latest rows, printed oldest first like a log
+		query = fmt.Sprintf("SELECT * FROM (SELECT * FROM events WHERE %s ORDER BY timestamp DESC%s) ORDER BY timestamp",
+			strings.Join(where, " AND "), limitClause)
+	}
+
+	db, err := openSQLite(dbPath, true)
+	if err != nil {
+		fatal("opening database", "path", dbPath, "err", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		fatal("querying database", "path", dbPath, "err", err)
+	}
+	defer rows.Close()
+	if err := printQueryRows(rows, format); err != nil {
+		fatal("querying database", "path", dbPath, "err", err)
+	}
+}
+
+// parseQueryTime takes either a duration back from now or an RFC 3339 time
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// printQueryRows writes text as aligned columns, leaving out the ones that
+// are empty in every row, and json as one object per row without the NULLs
+func printQueryRows(rows *sql.Rows, format string) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	var table [][]sql.NullString
+	enc := json.NewEncoder(os.Stdout)
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		if cols[0] == "timestamp" {
+			if ns, err := strconv.ParseInt(values[0].String, 10, 64); err == nil {
+				values[0].String = time.Unix(0, ns).Format(time.RFC3339Nano)
+			}
+		}
+
+		if format == formatJSON {
+			obj := make(map[string]any, len(cols))
+			for i, v := range values {
+				if !v.Valid {
+					continue
+				}
+				if n, err := strconv.ParseInt(v.String, 10, 64); err == nil && (sqliteIntColumns[cols[i]] || cols[i] == "count") {
+					obj[cols[i]] = n
+				} else {
+					obj[cols[i]] = v.String
+				}
+			}
+			if err := enc.Encode(obj); err != nil {
+				return err
+			}
+			continue
+		}
+		table = append(table, values)
+	}
+	if err := rows.Err(); err != nil || format == formatJSON {
+		return err
+	}
+
+	if len(table) == 0 {
+		fmt.Fprintln(os.Stderr, "No events in that range")
+		return nil
+	}
+	used := make([]bool, len(cols))
+	for _, r := range table {
+		for i, v := range r {
+			used[i] = used[i] || v.Valid && v.String != ""
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	var line []string
+	for i, c := range cols {
+		if used[i] {
+			line = append(line, strings.ToUpper(c))
+		}
+	}
+	fmt.Fprintln(w, strings.Join(line, "\t"))
+	for _, r := range table {
+		line = line[:0]
+		for i, v := range r {
+			if used[i] {
+				line = append(line, v.String)
+			}
+		}
+		fmt.Fprintln(w, strings.Join(line, "\t"))
+	}
+	return w.Flush()
+}
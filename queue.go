@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// --overflow-policy: what the reader does when --buffer-size events are
+// already waiting for the processor
+const (
+	overflowBlock = "block" // Wait, the kernel buffer fills up and loses events instead
+	overflowDrop  = "drop"  // Drop the batch in userspace and count it
+)
+
+// eventQueue is the bounded queue between readEvents and the processor.
+// It counts events rather than batches, so the bound means the same
+// however full the batches are. There is one reader pushing and one
+// processor taking batches out.
+type eventQueue struct {
+	batches chan *eventBatch
+	size    int
+	drop    bool
+	room    chan struct{} // Signalled when the processor took events out
+
+	queued  atomic.Int64  // Events pushed and not yet done
+	dropped atomic.Uint64 // Events dropped with --overflow-policy drop
+	blocked atomic.Int64  // Nanoseconds the reader waited with block
+
+	lastDone atomic.Int64 // Unix nanoseconds the processor last handed a batch back, or events started waiting
+	closed   atomic.Bool  // The reader returned
+}
+
+func newEventQueue(size int, policy string) (*eventQueue, error) {
+	if size < eventBatchSize {
+		return nil, fmt.Errorf("--buffer-size must be at least %d", eventBatchSize)
+	}
+	if policy != overflowBlock && policy != overflowDrop {
+		return nil, fmt.Errorf("invalid --overflow-policy %q, use: block or drop", policy)
+	}
+	q := &eventQueue{
+		batches: make(chan *eventBatch, size), // Each batch has at least one event
+		size:    size,
+		drop:    policy == overflowDrop,
+		room:    make(chan struct{}, 1),
+	}
+	q.lastDone.Store(time.Now().UnixNano())
+	return q, nil
+}
+
+// push queues batch, or with the drop policy releases it when it doesn't fit
+func (q *eventQueue) push(batch *eventBatch) {
+	n := int64(len(batch.events))
+	if q.queued.Load()+n > int64(q.size) {
+		if q.drop {
+			q.dropped.Add(uint64(n))
+			batch.release()
+			return
+		}
+		start := time.Now()
+		for q.queued.Load()+n > int64(q.size) {
+			<-q.room
+		}
+		q.blocked.Add(int64(time.Since(start)))
+	}
+	if q.queued.Add(n) == n {
+		q.lastDone.Store(time.Now().UnixNano()) // Nothing was waiting, see Stalled
+	}
+	q.batches <- batch
+}
+
+// done is the processor handing batch back once it handled every event
+func (q *eventQueue) done(batch *eventBatch) {
+	q.queued.Add(-int64(len(batch.events)))
+	q.lastDone.Store(time.Now().UnixNano())
+	batch.release()
+	select {
+	case q.room <- struct{}{}:
+	default:
+	}
+}
+
+// close is readEvents' way of saying nothing more is coming
+func (q *eventQueue) close() {
+	q.closed.Store(true)
+	close(q.batches)
+}
+
+// Closed is whether the reader stopped, on shutdown or because the
+// buffer was closed under it
+func (q *eventQueue) Closed() bool { return q.closed.Load() }
+
+// Stalled is how long events have been waiting without the processor
+// finishing a batch, 0 while it keeps up or there's nothing to do
+func (q *eventQueue) Stalled() time.Duration {
+	if q.Depth() == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, q.lastDone.Load()))
+}
+
+// Depth is how many events are waiting for the processor
+func (q *eventQueue) Depth() int { return int(q.queued.Load()) }
+
+// Dropped is how many events the drop policy dropped so far
+func (q *eventQueue) Dropped() uint64 { return q.dropped.Load() }
+
+// Blocked is how long the reader waited for the processor so far
+func (q *eventQueue) Blocked() time.Duration { return time.Duration(q.blocked.Load()) }
+
+// warnBackpressure logs whenever the processor fell behind in the last
+// interval: what was dropped, or how long the reader was held up
+func (q *eventQueue) warnBackpressure(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastDropped uint64
+	var lastBlocked time.Duration
+	for range ticker.C {
+		dropped, blocked := q.Dropped(), q.Blocked()
+		if dropped > lastDropped {
+			slog.Warn("events dropped, the processor fell behind", "dropped", dropped-lastDropped, "interval", interval, "total", dropped)
+		}
+		if blocked > lastBlocked {
+			slog.Warn("reader waited for the processor, the kernel buffer may overflow", "waited", (blocked - lastBlocked).Round(time.Millisecond), "interval", interval)
+		}
+		lastDropped, lastBlocked = dropped, blocked
+	}
+}
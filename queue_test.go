@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// queueBatch is a batch of n empty events
+func queueBatch(n int) *eventBatch {
+	b := newEventBatch()
+	b.events = append(b.events, make([]TcpEvent, n)...)
+	return b
+}
+
+func TestEventQueueDrop(t *testing.T) {
+	size := 4 * eventBatchSize
+	for _, tt := range []struct {
+		name    string
+		batches []int // Events in each batch pushed
+		taken   int   // Batches the processor hands back before the last push
+		depth   int
+		dropped uint64
+	}{
+		{"fits", []int{size / 2, size / 2}, 0, size, 0},
+		{"one over", []int{size, 1}, 0, size, 1},
+		{"whole batch dropped", []int{size - 10, 20}, 0, size - 10, 20},
+		{"room again", []int{size, size / 2}, 1, size / 2, 0},
+		{"several", []int{size, 5, 7, 1}, 0, size, 13},
+	} {
+		q, err := newEventQueue(size, overflowDrop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range tt.batches {
+			if i == len(tt.batches)-1 {
+				for range tt.taken {
+					q.done(<-q.batches)
+				}
+			}
+			q.push(queueBatch(n))
+		}
+		if q.Depth() != tt.depth || q.Dropped() != tt.dropped {
+			t.Errorf("%s: depth %d, dropped %d, want %d and %d", tt.name, q.Depth(), q.Dropped(), tt.depth, tt.dropped)
+		}
+		if q.Blocked() != 0 {
+			t.Errorf("%s: blocked %v with the drop policy", tt.name, q.Blocked())
+		}
+	}
+}
+
+func TestEventQueueBlock(t *testing.T) {
+	size := eventBatchSize
+	q, err := newEventQueue(size, overflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push(queueBatch(size))
+	q.room = make(chan struct{}) // Unbuffered, a send goes through once push waits for room
+	pushed := make(chan struct{})
+	go func() {
+		q.push(queueBatch(1))
+		close(pushed)
+	}()
+	q.room <- struct{}{} // Still full, push takes it and waits again
+	select {
+	case <-pushed:
+		t.Fatal("push didn't wait for room")
+	default:
+	}
+	q.done(<-q.batches)
+	select {
+	case q.room <- struct{}{}: // done's signal went out before push waited again
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push never waited again")
+	}
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push still waiting once there was room")
+	}
+	if q.Depth() != 1 || q.Dropped() != 0 || q.Blocked() == 0 {
+		t.Errorf("depth %d, dropped %d, blocked %v", q.Depth(), q.Dropped(), q.Blocked())
+	}
+}
+
+func TestEventQueueStalled(t *testing.T) {
+	q, err := newEventQueue(eventBatchSize, overflowDrop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.lastDone.Store(time.Now().Add(-time.Hour).UnixNano()) // Idle for an hour
+	if s := q.Stalled(); s != 0 {
+		t.Errorf("empty queue stalled for %v", s)
+	}
+	q.push(queueBatch(1))
+	if s := q.Stalled(); s > time.Minute {
+		t.Errorf("stalled for %v right after the first push", s)
+	}
+}
+
+func TestNewEventQueue(t *testing.T) {
+	if _, err := newEventQueue(eventBatchSize-1, overflowBlock); err == nil {
+		t.Error("no error for a size under a batch")
+	}
+	if _, err := newEventQueue(eventBatchSize, "spill"); err == nil {
+		t.Error("no error for an unknown policy")
+	}
+}
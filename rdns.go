@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	rdnsCacheSize   = 8192
+	rdnsQueueSize   = 1024 // Lookups waiting for a worker, misses beyond that are retried on a later event
+	rdnsWorkers     = 4
+	rdnsTimeout     = 2 * time.Second
+	rdnsMinTTL      = 30 * time.Second // Records with TTL 0 would otherwise be asked for on every event
+	rdnsMaxTTL      = time.Hour
+	rdnsNegativeTTL = 5 * time.Minute // For addresses without a PTR record, or servers that didn't answer
+)
+
+// DNSEnricher puts PTR names on event addresses (--reverse-dns). Lookups
+// never block the processor: an address seen for the first time goes out
+// without a name and is queued for the workers, which ask the resolv.conf
+// nameservers directly so each answer can be cached for its own TTL.
+type DNSEnricher struct {
+	servers []string
+	queue   chan netip.Addr
+
+	mu      sync.Mutex
+	lru     *list.List // Of *rdnsEntry, most recently used first
+	entries map[netip.Addr]*list.Element
+}
+
+type rdnsEntry struct {
+	addr    netip.Addr
+	name    string // "" while pending or when there's no PTR record
+	expires time.Time
+	pending bool
+}
+
+func NewDNSEnricher() *DNSEnricher {
+	d := &DNSEnricher{
+		servers: nameservers("/etc/resolv.conf"),
+		queue:   make(chan netip.Addr, rdnsQueueSize),
+		lru:     list.New(),
+		entries: make(map[netip.Addr]*list.Element),
+	}
+	for range rdnsWorkers {
+		go d.worker()
+	}
+	return d
+}
+
+func (d *DNSEnricher) Enrich(event *TcpEvent) {
+	if event.Family == 0 { // A drop without a tuple
+		return
+	}
+	event.SaddrName = d.Name(netip.AddrFrom16(event.Saddr).Unmap())
+	event.DaddrName = d.Name(netip.AddrFrom16(event.Daddr).Unmap())
+}
+
+// Name returns the cached name for addr, or "" and schedules a lookup
+// Stale entries keep their name until the new answer arrives
+func (d *DNSEnricher) Name(addr netip.Addr) string {
+	if addr.IsUnspecified() || addr.IsLoopback() {
+		return ""
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	el, ok := d.entries[addr]
+	if ok {
+		d.lru.MoveToFront(el)
+		entry := el.Value.(*rdnsEntry)
+		if entry.pending || now.Before(entry.expires) {
+			return entry.name
+		}
+		if d.enqueue(addr) {
+			entry.pending = true
+		}
+		return entry.name
+	}
+
+	if !d.enqueue(addr) {
+		return ""
+	}
+	d.entries[addr] = d.lru.PushFront(&rdnsEntry{addr: addr, pending: true})
+	if d.lru.Len() > rdnsCacheSize {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.entries, oldest.Value.(*rdnsEntry).addr)
+	}
+	return ""
+}
+
+func (d *DNSEnricher) enqueue(addr netip.Addr) bool {
+	select {
+	case d.queue <- addr:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *DNSEnricher) worker() {
+	for addr := range d.queue {
+		name, ttl := d.resolve(addr)
+
+		d.mu.Lock()
+		if el, ok := d.entries[addr]; ok { // Unless it was evicted meanwhile
+			entry := el.Value.(*rdnsEntry)
+			entry.name, entry.expires, entry.pending = name, time.Now().Add(ttl), false
+		}
+		d.mu.Unlock()
+	}
+}
+
+// resolve asks each nameserver in turn, until one answers
+func (d *DNSEnricher) resolve(addr netip.Addr) (string, time.Duration) {
+	for _, server := range d.servers {
+		name, ttl, err := queryPTR(server, addr)
+		if err != nil {
+			continue
+		}
+		return name, min(max(ttl, rdnsMinTTL), rdnsMaxTTL)
+	}
+	return "", rdnsNegativeTTL
+}
+
+// queryPTR sends one PTR query over UDP. A name that doesn't exist isn't an
+// error, it's cached like any other answer.
+func queryPTR(server string, addr netip.Addr) (string, time.Duration, error) {
+	qname, err := dnsmessage.NewName(reverseName(addr))
+	if err != nil {
+		return "", 0, err
+	}
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return "", 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+		return "", 0, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return "", 0, err
+	}
+
+	conn, err := net.DialTimeout("udp", server, rdnsTimeout)
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rdnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return "", 0, err
+	}
+	buf := make([]byte, 1232) // The EDNS buffer size DNS Flag Day 2020 settled on
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(buf[:n])
+	if err != nil {
+		return "", 0, err
+	}
+	if h.ID != id {
+		return "", 0, errors.New("reply to a different query")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return "", rdnsNegativeTTL, nil
+	default:
+		return "", 0, fmt.Errorf("%s: %s", server, h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", 0, err
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return "", rdnsNegativeTTL, nil // No PTR record, e.g. only a CNAME chain that led nowhere
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		if ah.Type != dnsmessage.TypePTR {
+			if err := p.SkipAnswer(); err != nil {
+				return "", 0, err
+			}
+			continue
+		}
+		ptr, err := p.PTRResource()
+		if err != nil {
+			return "", 0, err
+		}
+		return strings.TrimSuffix(ptr.PTR.String(), "."), time.Duration(ah.TTL) * time.Second, nil
+	}
+}
+
+// reverseName is addr's name under in-addr.arpa or ip6.arpa, e.g.
+// 5.0.0.10.in-addr.arpa. for 10.0.0.5
+func reverseName(addr netip.Addr) string {
+	var sb strings.Builder
+	if addr.Is4() {
+		b := addr.As4()
+		fmt.Fprintf(&sb, "%d.%d.%d.%d.in-addr.arpa.", b[3], b[2], b[1], b[0])
+		return sb.String()
+	}
+	b := addr.As16()
+	const hex = "0123456789abcdef"
+	for i := len(b) - 1; i >= 0; i-- {
+		sb.WriteByte(hex[b[i]&0xf])
+		sb.WriteByte('.')
+		sb.WriteByte(hex[b[i]>>4])
+		sb.WriteByte('.')
+	}
+	sb.WriteString("ip6.arpa.")
+	return sb.String()
+}
+
+// nameservers reads the nameserver lines of resolv.conf, falling back to
+// a local resolver the way the C library does
+func nameservers(path string) []string {
+	var servers []string
+	data, _ := os.ReadFile(path)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(fields[1]); err == nil {
+			servers = append(servers, netip.AddrPortFrom(addr, 53).String())
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return servers
+}
+
+// hostEndpoint is formatEndpoint with the name in place of the address,
+// when there is one
+func hostEndpoint(addr [16]uint8, name string, port uint16) string {
+	if name == "" {
+		return formatEndpoint(addr, port)
+	}
+	return net.JoinHostPort(name, fmt.Sprint(port))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// The record command writes every event to --out as a zstd stream of
+// Event messages (proto/tcpmon.proto), each preceded by its length as a
+// varint, the framing protodelim and Java's writeDelimitedTo use. That's
+// a fraction of the size of JSON or CSV for the same events, for long
+// captures that are only looked at later.
+//
+// Every file is a complete zstd stream, rotated ones included, so each
+// can be read on its own with zstd and protodelim.UnmarshalFrom, or the
+// equivalent in any language protobuf has.
+
+// RecordSink writes events to a zstd compressed file, starting a new one
+// when the current one reaches maxBytes compressed or is older than maxAge
+// (0 disables either), named like the CSV ones: events.bin.zst becomes
+// events-20260131T220000.bin.zst.
+type RecordSink struct {
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+
+	file    *os.File
+	counter *countingWriter
+	zw      *zstd.Encoder
+	w       *bufio.Writer // Between protodelim's small writes and the encoder
+	opened  time.Time
+}
+
+func NewRecordSink(path string, maxBytes int64, maxAge time.Duration) (*RecordSink, error) {
+	s := &RecordSink{path: path, maxBytes: maxBytes, maxAge: maxAge}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open starts a new stream at s.path. An existing file is appended to:
+// concatenated zstd streams decompress as one.
+func (s *RecordSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.counter = &countingWriter{f: f, n: info.Size()}
+	// One goroutine, the default of one per CPU buys nothing at event rates
+	zw, err := zstd.NewWriter(s.counter, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.zw = f, zw
+	s.w = bufio.NewWriter(zw)
+	s.opened = time.Now()
+	return nil
+}
+
+func (s *RecordSink) rotate() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path, rotatedPath(s.path, s.opened)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// Observe writes one event, called from the processor goroutine only
+func (s *RecordSink) Observe(event *TcpEvent, p *EventProcessor) {
+	if s.file == nil {
+		return // A failed write or rotation already logged why
+	}
+	if _, err := protodelim.MarshalTo(s.w, protoEvent(event, p)); err != nil {
+		slog.Warn("writing recorded events, stopping", "path", s.path, "err", err)
+		s.Close()
+		return
+	}
+
+	// counter only sees what the encoder has compressed so far, so files
+	// end up a block (128KB of events) or so over maxBytes
+	if s.maxBytes > 0 && s.counter.n >= s.maxBytes ||
+		s.maxAge > 0 && time.Since(s.opened) >= s.maxAge {
+		if err := s.rotate(); err != nil {
+			slog.Warn("rotating recorded events, stopping", "path", s.path, "err", err)
+			s.file = nil
+		}
+	}
+}
+
+// Close ends the zstd stream, without which the last block can't be read
+func (s *RecordSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordEvents is one event of each kind whose fields record and replay
+// carry differently: a state change, a close's lifetime and a sockopt
+func recordEvents() []TcpEvent {
+	base := TcpEvent{
+		Pid: 4242, Family: afInet,
+		Saddr: replayAddr("10.0.0.1"), Sport: 43210,
+		Daddr: replayAddr("192.0.2.80"), Dport: 443,
+		State: tcpEstablished,
+		Time:  time.Unix(1767225600, 0),
+	}
+	copy(base.Comm[:], "curl")
+
+	state := base
+	state.Type, state.OldState = eventState, tcpSynSent
+	closed := base
+	closed.Type, closed.State = eventClose, tcpClose
+	closed.DurationNs, closed.BytesSent, closed.BytesReceived, closed.Retransmits = 1500000000, 517, 48213, 2
+	closed.RttMinUs, closed.RttAvgUs, closed.RttMaxUs = 900, 1400, 3100
+	sockopt := base
+	sockopt.Type, sockopt.Sockopt = eventSockopt, solTCP<<16|13
+	copy(sockopt.CaOld[:], "cubic")
+	copy(sockopt.CaNew[:], "bbr")
+	return []TcpEvent{state, closed, sockopt}
+}
+
+func TestRecordReplay(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		repeat int
+	}{
+		{"one file", 1},
+		{"appended to", 2}, // Two streams in one file, as a restart leaves it
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.bin.zst")
+			names := newReplayNames()
+			p := NewEventProcessor(io.Discard, NewMetrics(), formatText, nil, names.reasons)
+			var want []TcpEvent
+			for range tt.repeat {
+				s, err := NewRecordSink(path, 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, event := range recordEvents() {
+					s.Observe(&event, p)
+					want = append(want, event)
+				}
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []TcpEvent
+			if err := replayFile(path, func(e *Event) error {
+				got = append(got, names.event(e))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("replayed %d events, want %d", len(got), len(want))
+			}
+			for i := range want {
+				w, g := &want[i], &got[i]
+				if g.Type != w.Type || g.Pid != w.Pid || g.Comm != w.Comm || !g.Time.Equal(w.Time) ||
+					g.Family != w.Family || g.Saddr != w.Saddr || g.Sport != w.Sport || g.Daddr != w.Daddr || g.Dport != w.Dport ||
+					g.State != w.State || g.OldState != w.OldState {
+					t.Errorf("event %d: got %+v, want %+v", i, g, w)
+				}
+				if g.DurationNs != w.DurationNs || g.BytesSent != w.BytesSent || g.BytesReceived != w.BytesReceived ||
+					g.Retransmits != w.Retransmits || g.RttAvgUs != w.RttAvgUs || g.RttMaxUs != w.RttMaxUs {
+					t.Errorf("event %d: lifetime %+v, want %+v", i, g, w)
+				}
+				if g.Sockopt != w.Sockopt || g.CaOld != w.CaOld || g.CaNew != w.CaNew {
+					t.Errorf("event %d: sockopt %#x %q -> %q, want %#x %q -> %q", i,
+						g.Sockopt, commString(g.CaOld[:]), commString(g.CaNew[:]), w.Sockopt, commString(w.CaOld[:]), commString(w.CaNew[:]))
+				}
+			}
+		})
+	}
+}
+
+func TestReplayTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.bin.zst")
+	names := newReplayNames()
+	p := NewEventProcessor(io.Discard, NewMetrics(), formatText, nil, names.reasons)
+	s, err := NewRecordSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 100 {
+		for _, event := range recordEvents() {
+			s.Observe(&event, p)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// As a monitor that was killed leaves it
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-8); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayFile(path, func(*Event) error { return nil }); err == nil {
+		t.Error("no error for a truncated file")
+	}
+}
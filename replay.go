@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// The replay command reads files written by record and hands the events to
+// the same processor and observers a live run does: text or JSON output,
+// the dashboard, CSV, --db and the summary at the end. Nothing is loaded
+// into the kernel, so a capture from production can be looked at on a
+// laptop, without root.
+//
+// The recording has names where TcpEvent has numbers (drop reasons,
+// states, the kernel function of a drop), so replayNames turns them back.
+// Drop and reset reasons, and kernel functions, are the recording host's,
+// not this one's, and get numbers and addresses of their own.
+
+// errReplayStopped ends reading early, on Ctrl+C or the dashboard quitting
+var errReplayStopped = errors.New("replay stopped")
+
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		format, csvPath, dbPath string
+		since, until            string
+		types, comms            listFlag
+		pids, ports             listFlag
+		speed                   float64
+		tui                     bool
+		processes               int
+	)
+	fs.StringVar(&format, "format", formatText, "Output format: text or json (one object per line)")
+	fs.BoolVar(&tui, "tui", false, "Show the events in the live dashboard instead of printing them")
+	fs.Float64Var(&speed, "speed", 0, "Replay at this multiple of the recorded pace, e.g. 1 for as it happened or 10 for ten times faster (as fast as possible if 0)")
+	fs.Var(&types, "type", "Only these event types: drop, retransmit, state, close, connect... (repeatable or comma separated)")
+	fs.Var(&pids, "pid", "Only these PIDs (repeatable or comma separated)")
+	fs.Var(&comms, "comm", "Only these process names (repeatable or comma separated)")
+	fs.Var(&ports, "port", "Only events with either end on these ports (repeatable or comma separated)")
+	fs.StringVar(&since, "since", "", "Only events recorded at or after this RFC 3339 time")
+	fs.StringVar(&until, "until", "", "Only events recorded before this RFC 3339 time")
+	fs.StringVar(&csvPath, "output", "", "Also write the events to this CSV file (disabled if empty)")
+	fs.IntVar(&processes, "process-report", 0, "Print the connects, failures, resets, drops, bytes, retransmits and worst destinations of this many processes at the end (disabled if 0)")
+	fs.StringVar(&dbPath, "db", "", "Also store the events in this SQLite database, for the query command (disabled if empty)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] <file>...\n\nFeed events written by record through the output, dashboard and summary\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if format != formatText && format != formatJSON {
+		fatal("invalid --format, use: text or json", "format", format)
+	}
+	if speed < 0 {
+		fatal("--speed can't be negative", "speed", speed)
+	}
+	filter, err := newReplayFilter(types, pids, comms, ports, since, until)
+	if err != nil {
+		fatal("invalid filter", "err", err)
+	}
+	if err := setupLogging(slog.LevelInfo.String(), logFormatText, false); err != nil {
+		fatal("setting up logging", "err", err)
+	}
+
+	names := newReplayNames()
+	metrics := NewMetrics()
+	output := io.Writer(os.Stdout)
+	if tui {
+		output = io.Discard
+	}
+	processor := NewEventProcessor(output, metrics, format, nil, names.reasons)
+
+	summary := newRunSummary()
+	observers := []observer{summary}
+	var processReport *ProcessReport
+	if processes > 0 {
+		processReport = NewProcessReport()
+		observers = append(observers, processReport)
+	}
+	var dash *TUI
+	if tui {
+		history := NewConnHistory(nil) // Events only, there's no connection table to poll
+		dash = NewTUI(history)
+		observers = append(observers, history, dash)
+	}
+	var csvSink *CSVSink
+	if csvPath != "" {
+		if csvSink, err = NewCSVSink(csvPath, 0, 0); err != nil {
+			fatal("opening CSV output", "path", csvPath, "err", err)
+		}
+		observers = append(observers, csvSink)
+	}
+	var sqliteSink *SQLiteSink
+	if dbPath != "" {
+		if sqliteSink, err = NewSQLiteSink(dbPath); err != nil {
+			fatal("opening database", "path", dbPath, "err", err)
+		}
+		observers = append(observers, sqliteSink)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var replayed, skipped uint64
+	replayAll := func() {
+		var first time.Time
+		started := time.Now()
+		for _, path := range fs.Args() {
+			err := replayFile(path, func(e *Event) error {
+				if ctx.Err() != nil {
+					return errReplayStopped
+				}
+				event := names.event(e)
+				if !filter.match(&event) {
+					skipped++
+					return nil
+				}
+				if speed > 0 {
+					if first.IsZero() {
+						first = event.Time
+					}
+					due := started.Add(time.Duration(float64(event.Time.Sub(first)) / speed))
+					select {
+					case <-time.After(time.Until(due)):
+					case <-ctx.Done():
+						return errReplayStopped
+					}
+				}
+				processor.labels = e.Labels // The recording's --label
+				for _, o := range observers {
+					o.Observe(&event, processor)
+				}
+				processor.ProcessEvent(&event, dash == nil)
+				replayed++
+				return nil
+			})
+			if errors.Is(err, errReplayStopped) {
+				return
+			}
+			if err != nil {
+				slog.Warn("replaying", "path", path, "err", err)
+			}
+		}
+	}
+
+	if dash != nil {
+		// The dashboard owns the terminal, warnings wait until it's closed
+		var logBuf bytes.Buffer
+		logOutput.SetOutput(&logBuf)
+		atFatal(func() {
+			dash.Stop()
+			logOutput.SetOutput(os.Stderr)
+			os.Stderr.Write(logBuf.Bytes())
+		})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			replayAll()
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+				dash.Stop()
+			case <-dash.Done():
+			}
+		}()
+		if err := dash.Run(); err != nil {
+			slog.Warn("dashboard stopped", "err", err)
+		}
+		dash.Stop()
+		stop() // The dashboard stays up after the files end, until it's quit
+		<-done
+		logOutput.SetOutput(os.Stderr)
+		os.Stderr.Write(logBuf.Bytes())
+	} else {
+		replayAll()
+	}
+
+	processor.Flush()
+	if csvSink != nil {
+		if err := csvSink.Close(); err != nil {
+			slog.Warn("closing CSV output", "path", csvPath, "err", err)
+		}
+	}
+	if sqliteSink != nil {
+		if err := sqliteSink.Close(); err != nil {
+			slog.Warn("closing database", "path", dbPath, "err", err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nReplayed %d events from %d files, %d filtered out\n", replayed, fs.NArg(), skipped)
+	summary.Print(os.Stderr, processor, 10)
+	if processReport != nil {
+		processReport.Print(os.Stderr, processes)
+	}
+}
+
+// replayFile calls fn with each event of a file written by record, until
+// its end or an error. Events from older monitors are upgraded first.
+func replayFile(path string, fn func(*Event) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	r := bufio.NewReader(zr)
+	schema := schemaCheck{path: path}
+	for {
+		var e Event
+		if err := protodelim.UnmarshalFrom(r, &e); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err // Including a file cut short by a monitor that was killed
+		}
+		schema.check(&e)
+		upgradeEvent(&e)
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+}
+
+// replayFilter is --type, --pid, --comm, --port, --since and --until, done
+// here as the kernel isn't there to do them. Empty sets match everything.
+type replayFilter struct {
+	types    map[uint32]bool
+	pids     map[uint32]bool
+	comms    map[string]bool
+	ports    map[uint16]bool
+	from, to time.Time
+}
+
+func newReplayFilter(types, pids, comms, ports listFlag, since, until string) (*replayFilter, error) {
+	f := &replayFilter{
+		types: make(map[uint32]bool),
+		pids:  make(map[uint32]bool),
+		comms: make(map[string]bool),
+		ports: make(map[uint16]bool),
+	}
+	for _, t := range types {
+		code := codeOf(eventTypeNames, t)
+		if code == 0 {
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+		f.types[code] = true
+	}
+	for _, p := range pids {
+		pid, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PID %q", p)
+		}
+		f.pids[uint32(pid)] = true
+	}
+	for _, c := range comms {
+		f.comms[c] = true
+	}
+	for _, p := range ports {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		f.ports[uint16(port)] = true
+	}
+	var err error
+	if since != "" {
+		if f.from, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	if until != "" {
+		if f.to, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, fmt.Errorf("invalid --until: %w", err)
+		}
+	}
+	return f, nil
+}
+
+func (f *replayFilter) match(e *TcpEvent) bool {
+	if len(f.types) > 0 && !f.types[e.Type] ||
+		len(f.pids) > 0 && !f.pids[e.Pid] ||
+		len(f.comms) > 0 && !f.comms[commString(e.Comm[:])] ||
+		len(f.ports) > 0 && !f.ports[e.Sport] && !f.ports[e.Dport] {
+		return false
+	}
+	if !f.from.IsZero() && e.Time.Before(f.from) || !f.to.IsZero() && !e.Time.Before(f.to) {
+		return false
+	}
+	return true
+}
+
+// replayNames turns a recorded Event back into a TcpEvent. Reasons take
+// the next free number the first time they come up, which the processor
+// names them by through reasons, and each kernel function becomes a made
+// up symbol in symbolList, so findNearestSymbol prints the recorded name
+// and offset again.
+type replayNames struct {
+	reasons    *dropReasons
+	dropCodes  map[string]uint32
+	resetCodes map[string]uint32
+	functions  map[string]uint64 // Address of each function's symbol
+}
+
+// Apart by more than the 0x10000 findNearestSymbol takes as an offset
+const replaySymbolSpacing = 1 << 20
+
+func newReplayNames() *replayNames {
+	return &replayNames{
+		reasons:    &dropReasons{names: make(map[uint32]string), resets: make(map[uint32]string), notDropped: -1, consumed: -1},
+		dropCodes:  make(map[string]uint32),
+		resetCodes: make(map[string]uint32),
+		functions:  make(map[string]uint64),
+	}
+}
+
+// reason numbers a drop or reset reason, the same one every time
+func (n *replayNames) reason(codes map[string]uint32, names map[uint32]string, name string) uint32 {
+	if code, ok := codes[name]; ok {
+		return code
+	}
+	code := uint32(len(codes) + 1)
+	codes[name], names[code] = code, name
+	return code
+}
+
+// location is an address findNearestSymbol turns back into function, e.g.
+// tcp_v4_rcv+0x1f4. Addresses that weren't resolved when recording are
+// kept as they were.
+func (n *replayNames) location(function string) uint64 {
+	name, off, ok := strings.Cut(function, "+0x")
+	if !ok {
+		addr, _ := strconv.ParseUint(strings.TrimPrefix(function, "0x"), 16, 64)
+		return addr
+	}
+	offset, _ := strconv.ParseUint(off, 16, 64)
+	base, ok := n.functions[name]
+	if !ok {
+		// Handed out in ascending order, so symbolList stays sorted
+		base = uint64(len(n.functions)+1) * replaySymbolSpacing
+		n.functions[name] = base
+		symbolList = append(symbolList, Symbol{Addr: base, Name: name})
+	}
+	return base + offset
+}
+
+// codeOf is the number names gives name, or the n of UNKNOWN(n), 0 for
+// anything else
+func codeOf(names map[uint32]string, name string) uint32 {
+	for code, v := range names {
+		if v == name {
+			return code
+		}
+	}
+	var code uint32
+	fmt.Sscanf(name, "UNKNOWN(%d)", &code)
+	return code
+}
+
+// protocolCode reverses protocolName
+func protocolCode(name string) uint32 {
+	if code := codeOf(protocolNames, name); code != 0 {
+		return code
+	}
+	p, _ := strconv.ParseUint(name, 10, 32)
+	return uint32(p)
+}
+
+// replayAddr is an address as formatAddr printed it, IPv4 mapped again
+func replayAddr(s string) [16]byte {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return [16]byte{}
+	}
+	return addr.As16()
+}
+
+// icmpCode reverses icmpName
+func icmpCode(family uint32, name string) uint32 {
+	names := icmpNames
+	if family == afInet6 {
+		names = icmpv6Names
+	}
+	if code := codeOf(names, name); code != 0 {
+		return code
+	}
+	var typ, code uint32
+	fmt.Sscanf(name, "TYPE_%d_CODE_%d", &typ, &code)
+	return typ<<8 | code
+}
+
+// errnoCode reverses errnoName
+func errnoCode(name string) uint32 {
+	for errno := syscall.Errno(1); errno < 256; errno++ {
+		if unix.ErrnoName(errno) == name {
+			return uint32(errno)
+		}
+	}
+	return codeOf(nil, name)
+}
+
+// event undoes protoEvent
+func (n *replayNames) event(e *Event) TcpEvent {
+	out := TcpEvent{
+		Type:       uint32(e.Type),
+		Pid:        e.Pid,
+		CgroupID:   e.CgroupId,
+		Suppressed: e.Suppressed,
+		Count:      e.Count,
+		Family:     codeOf(familyNames, e.Family),
+		Saddr:      replayAddr(e.Saddr),
+		Sport:      uint16(e.Sport),
+		Daddr:      replayAddr(e.Daddr),
+		Dport:      uint16(e.Dport),
+		State:      codeOf(tcpStateNames, e.State),
+		Time:       time.Unix(0, e.TimestampNs),
+	}
+	copy(out.Comm[:len(out.Comm)-1], e.Comm)
+	if e.Protocol != "" {
+		out.Protocol = protocolCode(e.Protocol)
+	}
+
+	switch out.Type {
+	case eventDrop:
+		out.Reason = n.reason(n.dropCodes, n.reasons.names, e.Reason)
+		out.Location = n.location(e.Function)
+		if nat := e.Nat; nat != nil {
+			switch nat.Kind {
+			case "SNAT":
+				out.NatFlags = natSrc
+			case "DNAT":
+				out.NatFlags = natDst
+			case "SNAT+DNAT":
+				out.NatFlags = natSrc | natDst
+			}
+			if nat.Reply {
+				out.NatFlags |= natReply
+			}
+			if t := nat.Original; t != nil {
+				out.CtSaddr, out.CtSport, out.CtDaddr, out.CtDport = replayAddr(t.Saddr), uint16(t.Sport), replayAddr(t.Daddr), uint16(t.Dport)
+			}
+			if t := nat.Translated; t != nil {
+				out.NatSaddr, out.NatSport, out.NatDaddr, out.NatDport = replayAddr(t.Saddr), uint16(t.Sport), replayAddr(t.Daddr), uint16(t.Dport)
+			}
+		}
+		if tun := e.Tunnel; tun != nil {
+			out.Tunnel = codeOf(tunnelNames, tun.Kind)
+			out.Vni = tun.Vni
+			out.InnerFamily = codeOf(familyNames, tun.Family)
+			out.InnerProtocol = protocolCode(tun.Protocol)
+			if t := tun.Inner; t != nil {
+				out.InnerSaddr, out.InnerSport, out.InnerDaddr, out.InnerDport = replayAddr(t.Saddr), uint16(t.Sport), replayAddr(t.Daddr), uint16(t.Dport)
+			}
+		}
+		out.Stack = e.Stack
+	case eventState:
+		out.OldState = codeOf(tcpStateNames, e.OldState)
+	case eventConnect:
+		out.DurationNs = e.LatencyNs
+	case eventReset:
+		out.Direction = codeOf(directionNames, e.Direction)
+		if out.Direction == rstSent {
+			out.Reason = n.reason(n.resetCodes, n.reasons.resets, e.Reason)
+		}
+	case eventZeroWindow:
+		out.Direction = codeOf(directionNames, e.Direction)
+		out.Queued = e.QueuedBytes
+	case eventUDPError:
+		out.Reason = errnoCode(e.Reason)
+		out.Direction = codeOf(directionNames, e.Direction)
+	case eventDSACK:
+		out.DsackBytes = e.DsackBytes
+	case eventKeepalive:
+		out.Direction = codeOf(keepaliveNames, e.Reason)
+		out.DurationNs = e.IdleNs
+		out.Probes, out.MaxProbes = e.Probes, e.MaxProbes
+	case eventBuffer:
+		out.Direction = codeOf(bufferNames, e.Reason)
+		if b := e.Buffer; b != nil {
+			out.RmemAlloc, out.RmemAfter, out.Rcvbuf, out.RmemMax, out.Collapses = b.RmemAlloc, b.RmemAfter, b.Rcvbuf, b.RmemMax, b.Collapses
+			if b.RcvbufLocked {
+				out.BufferFlags |= bufferRcvbufLocked
+			}
+			if b.MemPressure {
+				out.BufferFlags |= bufferMemPressure
+			}
+		}
+	case eventSynFlood:
+		if f := e.SynFlood; f != nil {
+			if prefix, err := netip.ParsePrefix(f.Prefix); err == nil {
+				out.Saddr, out.PrefixLen = prefix.Addr().As16(), uint32(prefix.Bits())
+			}
+			out.Interface, out.Syns, out.DurationNs = f.Interface, f.Syns, f.ElapsedNs
+		}
+	case eventBlocked:
+		out.Rule = e.Rule
+	case eventSockopt:
+		if e.Reason != "" {
+			out.Reason = errnoCode(e.Reason)
+		}
+		if s := e.Sockopt; s != nil {
+			out.Sockopt, out.SockoptOld, out.SockoptNew = sockoptCode(s.Option), s.Old, s.New
+			copy(out.CaOld[:], s.OldAlgorithm)
+			copy(out.CaNew[:], s.NewAlgorithm)
+		}
+	case eventListen:
+		if e.Reason != "" {
+			out.Reason = errnoCode(e.Reason)
+		}
+		out.OldState = codeOf(tcpStateNames, e.OldState)
+		if l := e.Listen; l != nil {
+			out.Direction = codeOf(listenKinds, l.Kind)
+			out.Backlog, out.Somaxconn, out.AcceptQueue = l.Backlog, l.Somaxconn, l.AcceptQueue
+		}
+	case eventTLS:
+		if t := e.Tls; t != nil {
+			out.Direction = codeOf(tlsSideNames, t.Side)
+			out.DurationNs, out.TCPConnectNs, out.TLSWaitNs = t.HandshakeNs, t.TcpConnectNs, t.WaitNs
+		}
+	case eventFastOpen:
+		out.Reason = codeOf(fastopenNames, e.Reason)
+		out.Direction = codeOf(directionNames, e.Direction)
+	case eventICMPError:
+		out.Reason = icmpCode(out.Family, e.Reason)
+		out.Mtu = e.Mtu
+	case eventClose:
+		if l := e.Lifetime; l != nil {
+			out.DurationNs, out.BytesSent, out.BytesReceived, out.Retransmits = l.DurationNs, l.BytesSent, l.BytesReceived, l.Retransmits
+			if r := l.Rtt; r != nil {
+				out.RttMinUs, out.RttAvgUs, out.RttMaxUs, out.RttvarUs = r.MinUs, r.AvgUs, r.MaxUs, r.VarUs
+			}
+			if r := l.Reorder; r != nil {
+				out.OooPackets, out.OooMaxBytes, out.Reordering, out.ReordSeen = r.OooPackets, r.OooMaxBytes, r.Degree, r.Seen
+			}
+			if s := l.Sack; s != nil {
+				out.Sacks, out.SackBlocks, out.Dsacks, out.DsackBytes = s.Acks, s.Blocks, s.Dsacks, s.DsackBytes
+			}
+		}
+	}
+
+	if pod := e.Pod; pod != nil {
+		out.Pod = &PodInfo{Namespace: pod.Namespace, Name: pod.Name, UID: pod.Uid, Labels: pod.Labels}
+	}
+	if c := e.Container; c != nil {
+		out.Container = &ContainerInfo{ID: c.Id, Name: c.Name, Image: c.Image}
+	}
+	if proc := e.Process; proc != nil {
+		out.Process = &ProcessInfo{Cmdline: proc.Cmdline, UID: proc.Uid, User: proc.User, Cgroup: proc.Cgroup}
+	}
+	if geo := e.Geo; geo != nil {
+		out.Geo = &GeoInfo{Country: geo.Country, ASN: geo.Asn, ASOrg: geo.AsOrg}
+	}
+	out.Netns, out.NetnsName = e.Netns, e.NetnsName
+	if l := e.Link; l != nil {
+		out.Link = &LinkInfo{Ifindex: l.Ifindex, Name: l.Name, Vlan: uint16(l.Vlan), Lower: l.Lower, Master: l.Master,
+			InIfindex: l.InIfindex, InName: l.InName}
+	}
+	if m := e.Mptcp; m != nil {
+		token, _ := strconv.ParseUint(m.Token, 16, 32)
+		out.MptcpToken, out.MptcpSubflow = uint32(token), m.Subflow
+	}
+	out.SaddrName, out.DaddrName = e.SaddrName, e.DaddrName
+	out.UserStack = e.UserStack
+	return out
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rollups keeps drops, retransmits and new connections per second for the
+// last hour, and sums them over the last minute, 5 minutes and hour, so a
+// trend is visible on GET /api/v1/rollups and in the --rollup-interval
+// line without a TSDB to send the counters to. It's an observer, so it
+// counts what made it through the filters, --aggregate included.
+//
+// New connections are state changes into ESTABLISHED, from SYN_SENT (a
+// connect) or SYN_RECV (an accept), so they're only counted when the
+// command emits state events.
+
+const rollupSlots = 3600 // One per second, for the longest window
+
+// include/net/tcp_states.h, see tcpStateNames
+const (
+	tcpEstablished = 1
+	tcpSynSent     = 2
+	tcpSynRecv     = 3
+	tcpClose       = 7
+)
+
+// rollupWindows are the windows summed, shortest first
+var rollupWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+type rollupSlot struct {
+	sec                       int64 // Unix second the counts are for, older ones are stale
+	drops, retransmits, conns uint64
+}
+
+// rollupCounted is which of the three the command's probes and events can
+// count at all; the others are reported as unknown rather than 0
+type rollupCounted struct {
+	drops, retransmits, conns bool
+}
+
+type Rollups struct {
+	counted rollupCounted
+	started time.Time
+
+	mu    sync.Mutex // Observe runs on the processor goroutine, readers on their own
+	slots [rollupSlots]rollupSlot
+}
+
+// GET /api/v1/rollups, one per window. Rates are per second over the part
+// of the window the monitor has been running for; what the command doesn't
+// count is null.
+type apiRollup struct {
+	Window         string   `json:"window"`
+	Seconds        float64  `json:"seconds"`  // Covered, less than the window until the monitor has run that long
+	Complete       bool     `json:"complete"` // Seconds is the whole window
+	Drops          *uint64  `json:"drops"`
+	DropRate       *float64 `json:"drops_per_sec"`
+	Retransmits    *uint64  `json:"retransmits"`
+	RetransmitRate *float64 `json:"retransmits_per_sec"`
+	Connections    *uint64  `json:"new_connections"`
+	ConnectionRate *float64 `json:"new_connections_per_sec"`
+}
+
+func NewRollups(counted rollupCounted) *Rollups {
+	return &Rollups{counted: counted, started: time.Now()}
+}
+
+func (r *Rollups) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/rollups", r.handleRollups)
+}
+
+// slot is the current second's, cleared when it last held an older one.
+// Called with mu held.
+func (r *Rollups) slot(now time.Time) *rollupSlot {
+	sec := now.Unix()
+	s := &r.slots[sec%rollupSlots]
+	if s.sec != sec {
+		*s = rollupSlot{sec: sec}
+	}
+	return s
+}
+
+func (r *Rollups) Observe(event *TcpEvent, p *EventProcessor) {
+	switch event.Type {
+	case eventDrop, eventRetransmit:
+	case eventState:
+		if event.State != tcpEstablished || (event.OldState != tcpSynSent && event.OldState != tcpSynRecv) {
+			return
+		}
+	default:
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.slot(time.Now())
+	switch event.Type {
+	case eventDrop:
+		s.drops += event.occurrences()
+	case eventRetransmit:
+		s.retransmits += event.occurrences()
+	case eventState:
+		s.conns++
+	}
+}
+
+// ObserveAggregates counts one --aggregate interval in the second it was
+// read, as the events would have been
+func (r *Rollups) ObserveAggregates(a *aggregates, p *EventProcessor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.slot(time.Now())
+	for _, d := range a.Drops {
+		s.drops += d.Count
+	}
+	for _, rt := range a.Retransmits {
+		s.retransmits += rt.Count
+	}
+}
+
+// Windows sums every window as of now
+func (r *Rollups) Windows() []apiRollup {
+	now := time.Now()
+	running := now.Sub(r.started)
+
+	r.mu.Lock()
+	sums := make([]rollupSlot, len(rollupWindows))
+	for _, s := range r.slots {
+		age := now.Unix() - s.sec
+		for i, w := range rollupWindows {
+			if age >= 0 && age < int64(w.d/time.Second) {
+				sums[i].drops += s.drops
+				sums[i].retransmits += s.retransmits
+				sums[i].conns += s.conns
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	windows := make([]apiRollup, len(rollupWindows))
+	for i, w := range rollupWindows {
+		covered := min(running.Truncate(time.Second), w.d)
+		secs := max(covered.Seconds(), 1)
+		windows[i] = apiRollup{Window: w.name, Seconds: covered.Seconds(), Complete: covered == w.d}
+		if r.counted.drops {
+			windows[i].Drops, windows[i].DropRate = rollupRate(sums[i].drops, secs)
+		}
+		if r.counted.retransmits {
+			windows[i].Retransmits, windows[i].RetransmitRate = rollupRate(sums[i].retransmits, secs)
+		}
+		if r.counted.conns {
+			windows[i].Connections, windows[i].ConnectionRate = rollupRate(sums[i].conns, secs)
+		}
+	}
+	return windows
+}
+
+func rollupRate(n uint64, secs float64) (*uint64, *float64) {
+	rate := float64(n) / secs
+	return &n, &rate
+}
+
+func (r *Rollups) handleRollups(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, r.Windows())
+}
+
+// Print writes the windows to w every interval, one line each time, like
+// the benchmark rate line
+func (r *Rollups) Print(w io.Writer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var b strings.Builder
+		fmt.Fprintf(&b, "[%s] Rollups", now.Format("15:04:05"))
+		for _, win := range r.Windows() {
+			fmt.Fprintf(&b, " | %s: %s drops/s, %s retrans/s, %s conns/s", win.Window,
+				rollupField(win.DropRate), rollupField(win.RetransmitRate), rollupField(win.ConnectionRate))
+		}
+		fmt.Fprintln(w, b.String())
+	}
+}
+
+// rollupField is a rate, or - when it isn't counted
+func rollupField(rate *float64) string {
+	if rate == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", *rate)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+)
+
+// Event in proto/tcpmon.proto is the one protobuf schema gRPC, Kafka,
+// NATS, --plugin and record files share, versioned by its package
+// (tcpmon.v1) and, within that, by the revision in Event.schema. The
+// compatibility policy is at the top of the proto file: fields are only
+// added, so any revision reads any other, and upgradeEvent fills in what
+// older writers didn't have but can be worked out from what they did.
+
+// eventSchema is the revision protoEvent writes, bumped with every field
+// or enum value added to tcpmon.v1
+const eventSchema = 7
+
+var eventSchemaHeader = strconv.Itoa(eventSchema) // Kafka and NATS "schema" header
+
+// upgradeEvent brings an event written by an older monitor up to
+// eventSchema, as far as its fields allow
+func upgradeEvent(e *Event) {
+	if e.Schema >= eventSchema {
+		return
+	}
+	// Revision 0 covers monitors from before drop layers (field 43)
+	if e.Type == EventType_EVENT_TYPE_DROP && e.Layer == "" {
+		e.Layer = dropLayer(e.Function, e.Reason)
+	}
+}
+
+// schemaCheck warns, once per file, about events written by a newer
+// monitor than this one: what this one doesn't know of them is skipped
+type schemaCheck struct {
+	path   string
+	warned bool
+}
+
+func (c *schemaCheck) check(e *Event) {
+	if c.warned {
+		return
+	}
+	if e.Schema > eventSchema || len(e.ProtoReflect().GetUnknown()) > 0 {
+		slog.Warn("written by a newer monitor, fields this one doesn't know are skipped",
+			"path", c.path, "schema", e.Schema, "known", eventSchema)
+		c.warned = true
+	}
+}
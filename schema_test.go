@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestUpgradeEvent(t *testing.T) {
+	drop := EventType_EVENT_TYPE_DROP
+	for _, tt := range []struct {
+		name string
+		in   *Event
+		want string // Layer
+	}{
+		{"layer from the function", &Event{Type: drop, Function: "nf_hook_slow+0x9c", Reason: "NETFILTER_DROP"}, "netfilter"},
+		{"layer from the reason", &Event{Type: drop, Function: "0xffffffff81a2b3c4", Reason: "TCP_CSUM"}, "tcp"},
+		{"neither known", &Event{Type: drop, Function: "some_driver_rx", Reason: "WHATEVER"}, "other"},
+		{"layer kept", &Event{Type: drop, Function: "nf_hook_slow", Layer: "bridge"}, "bridge"},
+		{"current schema", &Event{Type: drop, Function: "nf_hook_slow", Schema: eventSchema}, ""},
+		{"not a drop", &Event{Type: EventType_EVENT_TYPE_RETRANSMIT, Function: "tcp_retransmit_skb"}, ""},
+	} {
+		upgradeEvent(tt.in)
+		if tt.in.Layer != tt.want {
+			t.Errorf("%s: layer %q, want %q", tt.name, tt.in.Layer, tt.want)
+		}
+	}
+}
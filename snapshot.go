@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// runSnapshot is the snapshot subcommand: one pass of the bpf/snapshot.c
+// iterator over every TCP socket, printed like ss -tiap. Unlike the other
+// commands it only sees sockets, not events, so nothing stays attached.
+func runSnapshot(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	var (
+		states, ports listFlag
+		format        string
+	)
+	fs.Var(&states, "state", "Only sockets in these states, e.g. established,listen or time_wait (repeatable or comma separated)")
+	fs.Var(&ports, "port", "Only sockets with either end on these ports (repeatable or comma separated)")
+	fs.StringVar(&format, "format", formatText, "Output format: text or json (one object per socket)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s snapshot [flags]\n\nList every TCP socket with its queues and tcp_info\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if format != formatText && format != formatJSON {
+		fatal("invalid --format, use: text or json", "format", format)
+	}
+	wantState := make(map[uint32]bool)
+	for _, s := range states {
+		state, ok := parseTCPState(s)
+		if !ok {
+			fatal("invalid --state", "state", s)
+		}
+		wantState[state] = true
+	}
+	var wantPorts []uint16
+	for _, p := range ports {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			fatal("invalid --port", "port", p)
+		}
+		wantPorts = append(wantPorts, uint16(port))
+	}
+
+	sockets, err := dumpSockets()
+	if err != nil {
+		fatal("reading the socket table", "err", err)
+	}
+	sockets = slices.DeleteFunc(sockets, func(s snapshotSocketInfo) bool {
+		if len(wantState) > 0 && !wantState[s.State] {
+			return true
+		}
+		return len(wantPorts) > 0 && !slices.Contains(wantPorts, s.Sport) && !slices.Contains(wantPorts, s.Dport)
+	})
+
+	want := make(map[uint64]bool)
+	for _, s := range sockets {
+		if s.Inode != 0 {
+			want[s.Inode] = true
+		}
+	}
+	owners := scanSocketOwners(want)
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if format == formatJSON {
+		printSocketsJSON(out, sockets, owners)
+		return
+	}
+	printSockets(out, sockets, owners)
+}
+
+// dumpSockets loads the iterator, runs it once and decodes its records
+func dumpSockets() ([]snapshotSocketInfo, error) {
+	if err := needCaps("the socket iterator", unix.CAP_BPF, unix.CAP_SYS_ADMIN); err != nil {
+		return nil, err
+	}
+	if err := needCaps("the socket iterator", unix.CAP_PERFMON, unix.CAP_SYS_ADMIN); err != nil {
+		return nil, err
+	}
+	if err := removeMemlock(); err != nil {
+		return nil, err
+	}
+	var objs snapshotObjects
+	if err := loadSnapshotObjects(&objs, nil); err != nil {
+		return nil, fmt.Errorf("loading the iterator (needs 5.9+ and /sys/kernel/btf/vmlinux): %w", err)
+	}
+	defer objs.Close()
+
+	it, err := link.AttachIter(link.IterOptions{Program: objs.DumpTcp})
+	if err != nil {
+		return nil, fmt.Errorf("attaching the iterator: %w", err)
+	}
+	defer it.Close()
+	rd, err := it.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	var sockets []snapshotSocketInfo
+	br := bufio.NewReader(rd)
+	for {
+		var s snapshotSocketInfo
+		err := binary.Read(br, binary.NativeEndian, &s)
+		if errors.Is(err, io.EOF) {
+			return sockets, nil
+		}
+		if err != nil {
+			return sockets, err
+		}
+		sockets = append(sockets, s)
+	}
+}
+
+// parseTCPState takes a state name the way tcpStateNames has it, in any
+// case and with - for _ like ss, e.g. time-wait
+func parseTCPState(s string) (uint32, bool) {
+	s = strings.ToUpper(strings.ReplaceAll(s, "-", "_"))
+	if s == "ESTAB" {
+		s = "ESTABLISHED" // What ss prints
+	}
+	for state, name := range tcpStateNames {
+		if name == s {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+// TCP_LISTEN, the one state the output treats differently
+const tcpListen = 10
+
+func tcpStateName(state uint32) string {
+	if name := tcpStateNames[state]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", state)
+}
+
+func socketCongestion(s *snapshotSocketInfo) string {
+	var name [16]byte
+	for i, c := range s.CaName {
+		name[i] = byte(c)
+	}
+	return commString(name[:])
+}
+
+// One socket with --format=json. tcp_info is left out for time-wait and
+// request sockets, which only have the addresses and the state.
+type jsonSocket struct {
+	Timestamp string       `json:"timestamp"`
+	Type      string       `json:"type"` // Always "socket"
+	Family    string       `json:"family"`
+	State     string       `json:"state"`
+	Saddr     string       `json:"saddr"`
+	Sport     uint16       `json:"sport"`
+	Daddr     string       `json:"daddr"`
+	Dport     uint16       `json:"dport"`
+	RecvQ     uint32       `json:"recv_q"`
+	SendQ     uint32       `json:"send_q"`
+	UID       uint32       `json:"uid"`
+	Pid       uint32       `json:"pid,omitempty"`
+	Comm      string       `json:"comm,omitempty"`
+	Inode     uint64       `json:"inode,omitempty"`
+	Netns     uint32       `json:"netns,omitempty"`
+	TCPInfo   *jsonTCPInfo `json:"tcp_info,omitempty"`
+}
+
+type jsonTCPInfo struct {
+	CongestionControl string `json:"congestion_control"`
+	RttUs             uint32 `json:"rtt_us"`
+	RttvarUs          uint32 `json:"rttvar_us"`
+	Mss               uint32 `json:"mss"`
+	Cwnd              uint32 `json:"cwnd"`
+	Ssthresh          uint32 `json:"ssthresh,omitempty"` // Left out during the first slow start
+	SndWnd            uint32 `json:"snd_wnd"`
+	RcvWnd            uint32 `json:"rcv_wnd"`
+	Unacked           uint32 `json:"unacked"`
+	Retrans           uint32 `json:"retrans"`
+	Lost              uint32 `json:"lost"`
+	TotalRetrans      uint32 `json:"total_retrans"`
+	Reordering        uint32 `json:"reordering"`
+	BytesAcked        uint64 `json:"bytes_acked"`
+	BytesReceived     uint64 `json:"bytes_received"`
+	SegsOut           uint32 `json:"segs_out"`
+	SegsIn            uint32 `json:"segs_in"`
+}
+
+func printSocketsJSON(w io.Writer, sockets []snapshotSocketInfo, owners map[uint64]listenOwner) {
+	ts := time.Now().Format(time.RFC3339Nano)
+	enc := json.NewEncoder(w)
+	for i := range sockets {
+		s := &sockets[i]
+		owner := owners[s.Inode]
+		j := &jsonSocket{
+			Timestamp: ts, Type: "socket",
+			Family: familyNames[s.Family], State: tcpStateName(s.State),
+			Saddr: formatAddr(s.Saddr), Sport: s.Sport, Daddr: formatAddr(s.Daddr), Dport: s.Dport,
+			RecvQ: s.RxQueue, SendQ: s.TxQueue,
+			UID: s.Uid, Pid: owner.pid, Comm: owner.comm, Inode: s.Inode, Netns: s.Netns,
+		}
+		if s.Full != 0 {
+			j.TCPInfo = &jsonTCPInfo{
+				CongestionControl: socketCongestion(s),
+				RttUs:             s.SrttUs, RttvarUs: s.RttvarUs, Mss: s.Mss,
+				Cwnd: s.SndCwnd, SndWnd: s.SndWnd, RcvWnd: s.RcvWnd,
+				Unacked: s.PacketsOut, Retrans: s.RetransOut, Lost: s.LostOut,
+				TotalRetrans: s.TotalRetrans, Reordering: s.Reordering,
+				BytesAcked: s.BytesAcked, BytesReceived: s.BytesReceived,
+				SegsOut: s.SegsOut, SegsIn: s.SegsIn,
+			}
+			if s.SndSsthresh != tcpInfiniteSsthresh {
+				j.TCPInfo.Ssthresh = s.SndSsthresh
+			}
+		}
+		enc.Encode(j)
+	}
+}
+
+// printSockets writes one line per socket and, for full sockets that got
+// past the handshake, an indented tcp_info line under it like ss -i
+func printSockets(w io.Writer, sockets []snapshotSocketInfo, owners map[uint64]listenOwner) {
+	fmt.Fprintf(w, "%-12s %8s %8s  %-47s %-47s %-7s %s\n",
+		"STATE", "RECV-Q", "SEND-Q", "LADDR", "RADDR", "PID", "COMM")
+	for i := range sockets {
+		s := &sockets[i]
+		pid, comm := "-", "-"
+		if owner := owners[s.Inode]; owner.pid != 0 {
+			pid, comm = strconv.Itoa(int(owner.pid)), owner.comm
+		}
+		fmt.Fprintf(w, "%-12s %8d %8d  %-47s %-47s %-7s %s\n",
+			tcpStateName(s.State), s.RxQueue, s.TxQueue,
+			formatEndpoint(s.Saddr, s.Sport), formatEndpoint(s.Daddr, s.Dport), pid, comm)
+		if s.Full == 0 || s.State == tcpListen { // Listeners have no peer to measure
+			continue
+		}
+		ssthresh := ""
+		if s.SndSsthresh != tcpInfiniteSsthresh {
+			ssthresh = fmt.Sprintf(" ssthresh:%d", s.SndSsthresh)
+		}
+		fmt.Fprintf(w, "\t %s rtt:%v/%v mss:%d cwnd:%d%s snd_wnd:%d rcv_wnd:%d unacked:%d retrans:%d/%d lost:%d reordering:%d bytes_acked:%d bytes_received:%d segs_out:%d segs_in:%d\n",
+			socketCongestion(s), usDuration(s.SrttUs), usDuration(s.RttvarUs), s.Mss, s.SndCwnd, ssthresh,
+			s.SndWnd, s.RcvWnd, s.PacketsOut, s.RetransOut, s.TotalRetrans, s.LostOut, s.Reordering,
+			s.BytesAcked, s.BytesReceived, s.SegsOut, s.SegsIn)
+	}
+}
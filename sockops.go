@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+	"golang.org/x/sys/unix"
+)
+
+// --sockops serves the retransmit, state and RTT probes from tcp_sockops
+// in bpf/monitor.c, one sock_ops program on the root cgroup, instead of
+// tracepoints and kprobes. Each connection turns on the callbacks it needs
+// when it's opened, so the kernel calls the program directly and only for
+// those. Connections that were already open when it was attached aren't
+// seen at all.
+
+// sockOpsHooks are the hooks tcp_sockops can stand in for
+const sockOpsHooks = hookRetransmits | hookStates | hookRTT
+
+// BPF_SOCK_OPS_*_CB_FLAG in include/uapi/linux/bpf.h
+const (
+	sockOpsRetransCB = 1 << 1
+	sockOpsStateCB   = 1 << 2
+	sockOpsRTTCB     = 1 << 3
+)
+
+// sockOpsCallbacks is sockops_cbs for the hooks in h it replaces
+func sockOpsCallbacks(h hooks) uint32 {
+	var cbs uint32
+	if h&hookRetransmits != 0 {
+		cbs |= sockOpsRetransCB
+	}
+	if h&hookStates != 0 {
+		cbs |= sockOpsStateCB
+	}
+	if h&hookRTT != 0 {
+		cbs |= sockOpsRTTCB
+	}
+	return cbs
+}
+
+// useSockOps moves the hooks in h that tcp_sockops can serve over to it,
+// if the kernel gives sock_ops programs the helpers it calls. It returns
+// the hooks to attach and sockops_cbs; on error, h with the tracepoints
+// and kprobes instead.
+func useSockOps(h hooks) (hooks, uint32, error) {
+	if h&hookSockOps != 0 && h&sockOpsHooks == 0 {
+		h |= sockOpsHooks // --probes sockops on its own
+	}
+	h &^= hookSockOps
+	if h&sockOpsHooks == 0 {
+		return h, 0, nil
+	}
+	if err := needCaps("attaching the sock_ops program to the root cgroup", unix.CAP_NET_ADMIN); err != nil {
+		return h, 0, err
+	}
+	if err := sockOpsSupported(); err != nil {
+		return h, 0, err
+	}
+	return h&^sockOpsHooks | hookSockOps, sockOpsCallbacks(h), nil
+}
+
+// sockOpsSupported checks for the helpers tcp_sockops needs beyond the
+// callbacks themselves: bpf_skc_to_tcp_sock (5.9), bpf_probe_read_kernel
+// for its BPF_CORE_READs, which sock_ops programs only get on newer
+// kernels, and the current task helpers the connection table and filters
+// use
+func sockOpsSupported() error {
+	for _, fn := range []asm.BuiltinFunc{
+		asm.FnSockOpsCbFlagsSet, asm.FnSkcToTcpSock, asm.FnProbeReadKernel,
+		asm.FnGetCurrentPidTgid, asm.FnGetCurrentComm, asm.FnGetCurrentCgroupId,
+	} {
+		if err := features.HaveProgramHelper(ebpf.SockOps, fn); err != nil {
+			if errors.Is(err, ebpf.ErrNotSupported) {
+				return fmt.Errorf("sock_ops programs can't call %s on this kernel", fn)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// stubSockOps swaps tcp_sockops for a program that does nothing when it
+// isn't used, since a kernel that lacks its helpers would refuse to load
+// the whole collection. The stub is a socket filter: loading a sock_ops
+// program needs CAP_NET_ADMIN, which only --sockops should.
+func stubSockOps(spec *ebpf.CollectionSpec) {
+	stubProgram(spec, "tcp_sockops")
+}
+
+// stubProgram replaces a program with a socket filter that returns 1
+func stubProgram(spec *ebpf.CollectionSpec, name string) {
+	p, ok := spec.Programs[name]
+	if !ok {
+		return
+	}
+	stub := p.Copy()
+	stub.Type, stub.AttachType = ebpf.SocketFilter, ebpf.AttachNone
+	stub.Instructions = asm.Instructions{
+		asm.Mov.Imm(asm.R0, 1).WithSymbol(p.Name),
+		asm.Return(),
+	}
+	spec.Programs[name] = stub
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The sockopts probe (sock_setsockopt and tcp_setsockopt in bpf/monitor.c)
+// reports setsockopt calls on TCP sockets for the options behind a good
+// share of latency nobody can explain: Nagle and corking, buffer sizes,
+// the user timeout, the congestion algorithm. Events have the value the
+// socket had before the call and after, read from the socket as the kernel
+// keeps it, so SO_SNDBUF and SO_RCVBUF come out doubled and a call that
+// failed or changed nothing says so. Most options are set before
+// connect(), without a tuple yet; ConnHistory files those under the
+// connection once it's established.
+
+// Socket option levels, as setsockopt takes them
+const (
+	solSocket = 1
+	solTCP    = 6
+)
+
+// How a sockopt event's values read
+const (
+	sockoptNumber = iota
+	sockoptBool
+	sockoptBytes
+	sockoptMillis
+	sockoptAlgorithm // In CaOld and CaNew
+)
+
+type sockoptInfo struct {
+	name string
+	kind int
+}
+
+// sockopts are the options the probe traces, by level << 16 | optname
+var sockopts = map[uint32]sockoptInfo{
+	solSocket<<16 | 7:  {"SO_SNDBUF", sockoptBytes},
+	solSocket<<16 | 8:  {"SO_RCVBUF", sockoptBytes},
+	solSocket<<16 | 9:  {"SO_KEEPALIVE", sockoptBool},
+	solSocket<<16 | 32: {"SO_SNDBUFFORCE", sockoptBytes},
+	solSocket<<16 | 33: {"SO_RCVBUFFORCE", sockoptBytes},
+	solSocket<<16 | 36: {"SO_MARK", sockoptNumber},
+	solTCP<<16 | 1:     {"TCP_NODELAY", sockoptBool},
+	solTCP<<16 | 2:     {"TCP_MAXSEG", sockoptNumber}, // 0 until set, the route's MSS applies
+	solTCP<<16 | 3:     {"TCP_CORK", sockoptBool},
+	solTCP<<16 | 13:    {"TCP_CONGESTION", sockoptAlgorithm},
+	solTCP<<16 | 18:    {"TCP_USER_TIMEOUT", sockoptMillis},
+	solTCP<<16 | 25:    {"TCP_NOTSENT_LOWAT", sockoptBytes},
+}
+
+// sockoptName names an event's option, e.g. TCP_NODELAY
+func sockoptName(sockopt uint32) string {
+	if o, ok := sockopts[sockopt]; ok {
+		return o.name
+	}
+	return fmt.Sprintf("LEVEL_%d_OPTION_%d", sockopt>>16, sockopt&0xffff)
+}
+
+// sockoptCode undoes sockoptName
+func sockoptCode(name string) uint32 {
+	for code, o := range sockopts {
+		if o.name == name {
+			return code
+		}
+	}
+	var level, option uint32
+	fmt.Sscanf(name, "LEVEL_%d_OPTION_%d", &level, &option)
+	return level<<16 | option
+}
+
+// sockoptValues are an event's values before and after in text
+func sockoptValues(event *TcpEvent) (string, string) {
+	kind := sockopts[event.Sockopt].kind
+	if kind == sockoptAlgorithm {
+		return commString(event.CaOld[:]), commString(event.CaNew[:])
+	}
+	return sockoptValue(kind, event.SockoptOld), sockoptValue(kind, event.SockoptNew)
+}
+
+func sockoptValue(kind int, v uint32) string {
+	switch kind {
+	case sockoptBool:
+		if v != 0 {
+			return "on"
+		}
+		return "off"
+	case sockoptBytes:
+		return strconv.FormatUint(uint64(v), 10) + " B"
+	case sockoptMillis:
+		if v == 0 {
+			return "off"
+		}
+		return (time.Duration(v) * time.Millisecond).String()
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+// sockoptChange is what the call did, e.g. "off -> on", "unchanged (on)"
+// or "failed: EPERM (cubic)"
+func sockoptChange(event *TcpEvent) string {
+	old, cur := sockoptValues(event)
+	switch {
+	case event.Reason != 0:
+		return fmt.Sprintf("failed: %s (%s)", errnoName(event.Reason), cur)
+	case old == cur:
+		return "unchanged (" + cur + ")"
+	}
+	return old + " -> " + cur
+}
+
+// sockoptResult is the metric's result label
+func sockoptResult(event *TcpEvent) string {
+	old, cur := sockoptValues(event)
+	switch {
+	case event.Reason != 0:
+		return "failed"
+	case old == cur:
+		return "unchanged"
+	}
+	return "changed"
+}
+
+// sockoptSocket is the socket a sockopt event's option went on in text:
+// its tuple once connected, its port once bound, otherwise not yet either
+func sockoptSocket(event *TcpEvent, src, dst string) string {
+	switch {
+	case event.Dport != 0:
+		return src + " -> " + dst
+	case event.Sport != 0:
+		return fmt.Sprintf("Port: %d (not connected)", event.Sport)
+	}
+	return "Not connected"
+}
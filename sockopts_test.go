@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSockoptName(t *testing.T) {
+	for _, tt := range []struct {
+		code uint32
+		name string
+	}{
+		{solTCP<<16 | 1, "TCP_NODELAY"},
+		{solTCP<<16 | 13, "TCP_CONGESTION"},
+		{solSocket<<16 | 7, "SO_SNDBUF"},
+		{solSocket<<16 | 36, "SO_MARK"},
+		{solTCP<<16 | 99, "LEVEL_6_OPTION_99"},
+		{300<<16 | 0xffff, "LEVEL_300_OPTION_65535"},
+	} {
+		if got := sockoptName(tt.code); got != tt.name {
+			t.Errorf("sockoptName(%#x) = %q, want %q", tt.code, got, tt.name)
+		}
+		if got := sockoptCode(tt.name); got != tt.code {
+			t.Errorf("sockoptCode(%q) = %#x, want %#x", tt.name, got, tt.code)
+		}
+	}
+	for code := range sockopts {
+		if got := sockoptCode(sockoptName(code)); got != code {
+			t.Errorf("%s: round trips to %#x, want %#x", sockoptName(code), got, code)
+		}
+	}
+	if got := sockoptCode("SO_NOSUCHOPTION"); got != 0 {
+		t.Errorf("unknown name: %#x, want 0", got)
+	}
+}
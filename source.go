@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features" // Kernel feature probing
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// eventSource hides whether events arrive over a BPF ring buffer (5.8+)
+// or the older per-CPU perf event array
+type eventSource interface {
+	// ReadSample blocks until the next raw struct event is available
+	// The returned slice is only valid until the next call
+	ReadSample() ([]byte, error)
+	// Buffered reports whether the last sample wasn't the last one ready,
+	// so the next ReadSample won't wait
+	Buffered() bool
+	// SetDeadline makes ReadSample return os.ErrDeadlineExceeded once
+	// nothing is left to read after t, used to drain on shutdown
+	SetDeadline(t time.Time)
+	// Lost counts samples the kernel couldn't hand over because the buffer was full
+	Lost() uint64
+	Close() error
+}
+
+type ringbufSource struct {
+	rd     *ringbuf.Reader
+	record ringbuf.Record // Reused across reads so RawSample isn't reallocated
+	lost   *ebpf.Map      // lost_events, counted by reserve_event
+}
+
+func (s *ringbufSource) ReadSample() ([]byte, error) {
+	if err := s.rd.ReadInto(&s.record); err != nil {
+		return nil, err
+	}
+	return s.record.RawSample, nil
+}
+
+func (s *ringbufSource) Buffered() bool { return s.record.Remaining > 0 }
+
+func (s *ringbufSource) SetDeadline(t time.Time) { s.rd.SetDeadline(t) }
+
+func (s *ringbufSource) Lost() uint64 {
+	var perCPU []uint64
+	if err := s.lost.Lookup(uint32(0), &perCPU); err != nil {
+		return 0
+	}
+	var n uint64
+	for _, v := range perCPU {
+		n += v
+	}
+	return n
+}
+
+func (s *ringbufSource) Close() error { return s.rd.Close() }
+
+type perfSource struct {
+	rd     *perf.Reader
+	record perf.Record
+	lost   atomic.Uint64 // Read by Lost from other goroutines
+}
+
+func (s *perfSource) ReadSample() ([]byte, error) {
+	for {
+		if err := s.rd.ReadInto(&s.record); err != nil {
+			return nil, err
+		}
+		// A record either carries a sample or only a count of lost ones
+		if s.record.LostSamples == 0 {
+			return s.record.RawSample, nil
+		}
+		s.lost.Add(s.record.LostSamples)
+	}
+}
+
+// Buffered only knows about the buffer of the CPU the last sample came
+// from, other CPUs' samples start a new batch
+func (s *perfSource) Buffered() bool { return s.record.Remaining > 0 }
+
+func (s *perfSource) SetDeadline(t time.Time) { s.rd.SetDeadline(t) }
+
+func (s *perfSource) Lost() uint64 { return s.lost.Load() }
+
+func (s *perfSource) Close() error { return s.rd.Close() }
+
+// Both readers report a closed reader as os.ErrClosed, and a drained one
+// past its deadline as os.ErrDeadlineExceeded
+func isSourceClosed(err error) bool {
+	return errors.Is(err, os.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// usePerfBuffer reports whether the kernel lacks BPF_MAP_TYPE_RINGBUF
+func usePerfBuffer() bool {
+	return features.HaveMapType(ebpf.RingBuf) != nil
+}
+
+// loadOptions are the knobs baked into the programs before they're loaded,
+// and the tunables they start with
+type loadOptions struct {
+	filters     *Filters
+	reasons     *dropReasons
+	collectHist bool          // --hist-interval
+	histLayout  histLayout    // --connect-buckets and --rtt-buckets
+	slowConnect time.Duration // --slow-connect, 0 = off
+	eventMask   uint32        // 1 << eventDrop etc. for each event type to emit
+	pcapSnaplen uint32        // --pcap-snaplen with --pcap, 0 = off
+	stacks      bool          // --stacks
+	userStacks  bool          // --user-stacks
+	processInfo bool          // --process-info
+	cgroupStats bool          // --cgroup-metrics
+	sampleRate  uint32        // --sample, 1 = every event
+	connLimit   uint32        // --conn-limit, 0 = off
+	minBytes    uint64        // --min-bytes, 0 = every close
+	aggregate   bool          // --aggregate
+	kernelBTF   *btf.Spec     // --btf, nil for the running kernel's
+	pinPath     string        // --pin-path, empty = nothing pinned
+	sockOpsCBs  uint32        // sockops_cbs with --sockops, 0 = tcp_sockops isn't used
+	interfaces  int           // --interface count, 0 = prestack_tc and prestack_xdp aren't used
+	enforce     bool          // --enforce, otherwise enforce_connect4 and 6 are stubs
+	protocols   uint32        // protoTCP etc. whose drops are reported, from --proto
+	jiffyNs     uint64        // Nanoseconds per jiffy for keepalive idle times, 0 = unknown
+	conntrack   conntrackOffsets
+
+	// --syn-flood and its prefix lengths, threshold 0 = syn_sources isn't used
+	synFlood synFloodOptions
+}
+
+// loadObjects loads the ring buffer build of the BPF programs, or the
+// -DUSE_PERF_BUF build (see gen.go) when ring buffers aren't supported.
+// Both builds define the same program and map names, so either one can be
+// assigned into monitorObjects.
+func loadObjects(objs *monitorObjects, usePerf bool, opts loadOptions) error {
+	load := loadMonitor
+	if usePerf {
+		load = loadMonitorPerf
+	}
+
+	build := "ring buffer"
+	if usePerf {
+		build = "perf buffer"
+	}
+	slog.Debug("loading BPF objects", "build", build, "pin_path", opts.pinPath)
+	spec, err := load()
+	if err != nil {
+		return fmt.Errorf("loading %s spec: %w", build, err)
+	}
+	if err := opts.filters.rewriteSpec(spec); err != nil {
+		return fmt.Errorf("configuring filters: %w", err)
+	}
+	if err := opts.reasons.rewriteSpec(spec); err != nil {
+		return fmt.Errorf("configuring drop reasons: %w", err)
+	}
+	if err := opts.conntrack.rewriteSpec(spec); err != nil {
+		return fmt.Errorf("configuring conntrack: %w", err)
+	}
+	if opts.collectHist {
+		if err := setVariable(spec, "collect_hist", uint8(1)); err != nil {
+			return err
+		}
+		if err := setVariable(spec, "connect_bounds", opts.histLayout[histConnect].kernelBounds()); err != nil {
+			return err
+		}
+		if err := setVariable(spec, "rtt_bounds", opts.histLayout[histRTT].kernelBounds()); err != nil {
+			return err
+		}
+	}
+	if err := setVariable(spec, "event_mask", opts.eventMask); err != nil {
+		return err
+	}
+	if err := setVariable(spec, "pcap_snaplen", opts.pcapSnaplen); err != nil {
+		return err
+	}
+	if opts.stacks {
+		if err := sizeStacks(spec); err != nil {
+			return err
+		}
+	}
+	if opts.userStacks {
+		if err := sizeUserStacks(spec); err != nil {
+			return err
+		}
+	}
+	if opts.processInfo {
+		if err := sizeProcOwners(spec); err != nil {
+			return err
+		}
+	}
+	if opts.cgroupStats {
+		if err := sizeCgroupStats(spec); err != nil {
+			return err
+		}
+	}
+	if err := setVariable(spec, "protocols", opts.protocols); err != nil {
+		return err
+	}
+	if err := setVariable(spec, "jiffy_ns", opts.jiffyNs); err != nil {
+		return err
+	}
+	if opts.aggregate {
+		if err := setVariable(spec, "aggregate", uint8(1)); err != nil {
+			return err
+		}
+	}
+	if opts.sockOpsCBs == 0 {
+		stubSockOps(spec)
+	} else if err := setVariable(spec, "sockops_cbs", opts.sockOpsCBs); err != nil {
+		return err
+	}
+	if opts.interfaces == 0 {
+		stubInterfaces(spec)
+	} else if err := sizeInterfaces(spec, opts.interfaces); err != nil {
+		return err
+	}
+	if !opts.enforce {
+		stubEnforce(spec)
+	}
+	if opts.synFlood.threshold != 0 {
+		if err := sizeSynFlood(spec, opts.synFlood); err != nil {
+			return err
+		}
+	}
+	collOpts := &ebpf.CollectionOptions{
+		Programs: ebpf.ProgramOptions{KernelTypes: opts.kernelBTF},
+	}
+	if opts.pinPath != "" {
+		if collOpts.Maps, err = pinMaps(spec, opts.pinPath); err != nil {
+			return fmt.Errorf("pinning maps: %w", err)
+		}
+	}
+	if err := spec.LoadAndAssign(objs, collOpts); err != nil {
+		return fmt.Errorf("loading %s build into the kernel: %w", build, pinError(err, opts.pinPath))
+	}
+	if err := opts.filters.populate(objs); err != nil {
+		objs.Close()
+		return fmt.Errorf("populating filters: %w", err)
+	}
+	if err := objs.Tunables.Put(uint32(0), opts.tunables()); err != nil {
+		objs.Close()
+		return fmt.Errorf("setting tunables: %w", err)
+	}
+	return nil
+}
+
+// setVariable sets one of the const volatile switches in .rodata before load
+func setVariable(spec *ebpf.CollectionSpec, name string, value any) error {
+	v, ok := spec.Variables[name]
+	if !ok {
+		return fmt.Errorf("variable %s not found in BPF object", name)
+	}
+	if err := v.Set(value); err != nil {
+		return fmt.Errorf("setting %s: %w", name, err)
+	}
+	return nil
+}
+
+// sumCounters adds up a per-CPU array of u64 counters over every key and
+// CPU, for sample_counts and suppressed_events
+func sumCounters(counts *ebpf.Map) uint64 {
+	var n uint64
+	var perCPU []uint64
+	for t := uint32(0); t < counts.MaxEntries(); t++ {
+		if err := counts.Lookup(t, &perCPU); err != nil {
+			continue
+		}
+		for _, v := range perCPU {
+			n += v
+		}
+	}
+	return n
+}
+
+// openEventSource opens the reader matching the map type that was loaded
+// lost is the lost_events map, only used by the ring buffer build
+func openEventSource(events, lost *ebpf.Map, usePerf bool) (eventSource, error) {
+	if usePerf {
+		// Same 64KB as the ring buffer, but per CPU
+		rd, err := perf.NewReader(events, 16*os.Getpagesize())
+		if err != nil {
+			return nil, err
+		}
+		return &perfSource{rd: rd}, nil
+	}
+
+	rd, err := ringbuf.NewReader(events) // events is FD to C's events description
+	if err != nil {
+		return nil, err
+	}
+	return &ringbufSource{rd: rd, lost: lost}, nil
+}
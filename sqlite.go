@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go, so the binary stays static like the rest of it
+)
+
+// The events table has the --output CSV columns, except that timestamp is
+// nanoseconds since the epoch so time ranges can use the index. Empty CSV
+// cells are stored as NULL.
+var sqliteIntColumns = map[string]bool{
+	"timestamp": true, "pid": true, "sport": true, "dport": true,
+	"duration_ns": true, "bytes_sent": true, "bytes_received": true, "retransmits": true,
+	"rtt_min_us": true, "rtt_avg_us": true, "rtt_max_us": true, "rttvar_us": true,
+	"cgroup_id": true, "suppressed": true, "uid": true, "netns": true, "queued_bytes": true, "count": true,
+	"mtu": true, "ooo_packets": true, "ooo_max_bytes": true, "reordering": true, "reord_seen": true,
+	"sacks": true, "sack_blocks": true, "dsacks": true, "dsack_bytes": true, "probes": true, "max_probes": true,
+	"rmem_alloc": true, "rmem_after": true, "rcvbuf": true, "rmem_max": true, "collapses": true,
+	"ct_sport": true, "ct_dport": true, "nat_sport": true, "nat_dport": true, "asn": true,
+	"tcp_connect_ns": true, "tls_wait_ns": true, "prefix_len": true, "syns": true,
+}
+
+// Drops carry the packet's tuple, so the remote end can be either address;
+// monitor query --addr matches both
+var sqliteIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS events_timestamp ON events (timestamp)",
+	"CREATE INDEX IF NOT EXISTS events_saddr ON events (saddr, timestamp)",
+	"CREATE INDEX IF NOT EXISTS events_daddr ON events (daddr, timestamp)",
+	"CREATE INDEX IF NOT EXISTS events_pid ON events (pid, timestamp)",
+}
+
+// Rows are written in one transaction per batch, a transaction per event
+// would make every event an fsync
+const (
+	sqliteBatchSize     = 1000
+	sqliteBatchInterval = time.Second
+)
+
+// SQLiteSink stores every event in a SQLite database (--db) for monitor
+// query. The database is in WAL mode, so it can be queried while the
+// monitor is still writing to it.
+type SQLiteSink struct {
+	path   string
+	db     *sql.DB
+	insert *sql.Stmt
+	quit   chan struct{}
+	done   chan struct{}
+
+	mu       sync.Mutex // Observe is on the processor goroutine, the flusher on its own
+	tx       *sql.Tx
+	txInsert *sql.Stmt // insert, bound to tx
+	pending  int
+}
+
+func openSQLite(path string, readOnly bool) (*sql.DB, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)"
+	if readOnly {
+		dsn += "&mode=ro"
+	} else {
+		dsn += "&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil { // sql.Open doesn't touch the file
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func NewSQLiteSink(path string) (*SQLiteSink, error) {
+	db, err := openSQLite(path, false)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // One writer anyway, and the pragmas are per connection
+
+	cols := make([]string, len(csvColumns))
+	for i, c := range csvColumns {
+		cols[i] = sqliteColumn(c)
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS events (" + strings.Join(cols, ", ") + ")"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+	if err := addSQLiteColumns(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("updating schema: %w", err)
+	}
+	for _, stmt := range sqliteIndexes {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating indexes: %w", err)
+		}
+	}
+
+	insert, err := db.Prepare(fmt.Sprintf("INSERT INTO events (%s) VALUES (%s)",
+		strings.Join(csvColumns, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(csvColumns)), ", ")))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &SQLiteSink{path: path, db: db, insert: insert, quit: make(chan struct{}), done: make(chan struct{})}
+	go s.flusher()
+	return s, nil
+}
+
+func sqliteColumn(name string) string {
+	if sqliteIntColumns[name] {
+		return name + " INTEGER"
+	}
+	return name + " TEXT"
+}
+
+// addSQLiteColumns adds the columns appended to csvColumns since the
+// database was created, so an older --db keeps working
+func addSQLiteColumns(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('events')")
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range csvColumns {
+		if have[c] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE events ADD COLUMN " + sqliteColumn(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flusher commits a partial batch after a quiet second, so queries don't
+// wait for the next busy spell to see it
+func (s *SQLiteSink) flusher() {
+	defer close(s.done)
+	ticker := time.NewTicker(sqliteBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.commit()
+			s.mu.Unlock()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// commit ends the current batch, called with s.mu held
+func (s *SQLiteSink) commit() {
+	if s.tx == nil {
+		return
+	}
+	if err := s.tx.Commit(); err != nil {
+		slog.Warn("writing events to the database", "events", s.pending, "path", s.path, "err", err)
+	}
+	s.tx, s.txInsert = nil, nil
+	s.pending = 0
+}
+
+func (s *SQLiteSink) Observe(event *TcpEvent, p *EventProcessor) {
+	row := csvRow(event, p)
+	args := make([]any, len(row))
+	for i, v := range row {
+		if v != "" {
+			args[i] = v // Column affinity turns the numbers back into integers
+		}
+	}
+	args[0] = event.when().UnixNano()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			slog.Warn("writing to the database", "path", s.path, "err", err)
+			return
+		}
+		s.tx = tx
+		s.txInsert = tx.Stmt(s.insert)
+	}
+	if _, err := s.txInsert.Exec(args...); err != nil {
+		slog.Warn("writing to the database", "path", s.path, "err", err)
+		return
+	}
+	if s.pending++; s.pending >= sqliteBatchSize {
+		s.commit()
+	}
+}
+
+func (s *SQLiteSink) Close() error {
+	close(s.quit)
+	<-s.done
+	s.mu.Lock()
+	s.commit()
+	s.mu.Unlock()
+	s.insert.Close()
+	return s.db.Close()
+}
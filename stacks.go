@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// With --stacks, handle_drop in bpf/monitor.c records the kernel stack of
+// every drop in the drop_stacks stack map, which keeps one copy of each
+// distinct stack, and sends its id with the event. The function a drop
+// was freed in rarely says how the packet got there; the stack shows the
+// netfilter hook, tc action or qdisc on the way.
+
+const (
+	stackDepth   = 64   // STACK_DEPTH in bpf/monitor.c
+	stackEntries = 4096 // Distinct stacks drop_stacks holds with --stacks
+)
+
+// sizeStacks gives drop_stacks room for the stacks and turns capturing on.
+// The map is preallocated, so without --stacks it stays at one entry.
+func sizeStacks(spec *ebpf.CollectionSpec) error {
+	m, ok := spec.Maps["drop_stacks"]
+	if !ok {
+		return errors.New("map drop_stacks not found in BPF object")
+	}
+	m.MaxEntries = stackEntries
+	return setVariable(spec, "capture_stacks", uint8(1))
+}
+
+// StackEnricher puts the kernel stack on drops that have one, symbolized
+// against /proc/kallsyms (see loadSymbols). An id always stands for the
+// same stack, so each one is only read from the map and symbolized once.
+type StackEnricher struct {
+	stacks *ebpf.Map
+	cache  map[uint32][]string // By StackID, at most stackEntries of them
+}
+
+func NewStackEnricher(stacks *ebpf.Map) *StackEnricher {
+	return &StackEnricher{stacks: stacks, cache: make(map[uint32][]string)}
+}
+
+// Enrich looks up event's stack the first time its id comes up, a map
+// lookup that doesn't wait on anything
+func (s *StackEnricher) Enrich(event *TcpEvent) {
+	if event.StackID == 0 {
+		return
+	}
+	if stack, ok := s.cache[event.StackID]; ok {
+		event.Stack = stack
+		return
+	}
+	var ips [stackDepth]uint64
+	if err := s.stacks.Lookup(event.StackID-1, &ips); err != nil {
+		return
+	}
+	stack := make([]string, 0, stackDepth)
+	for _, ip := range ips {
+		if ip == 0 {
+			break
+		}
+		stack = append(stack, findNearestSymbol(ip))
+	}
+	s.cache[event.StackID] = stack
+	event.Stack = stack
+}
+
+// stackLines is a stack in text output, a frame per indented line under
+// the event
+func stackLines(stack []string) string {
+	if len(stack) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, frame := range stack {
+		b.WriteString("\t")
+		b.WriteString(frame)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
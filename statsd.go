@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lines are packed into datagrams of at most this size, small enough not to
+// be fragmented on a regular 1500 byte MTU
+const statsdMaxPacket = 1432
+
+// How often counters are sent; timings are queued and go out with them
+const statsdFlushInterval = time.Second
+
+// StatsDSink sends counters and timings over UDP (--statsd), with tags in
+// the DogStatsD "|#key:value" form that Datadog and Telegraf understand.
+// Counters are summed in memory and sent once a second, so a burst of drops
+// is one line per reason rather than a packet per event.
+type StatsDSink struct {
+	conn   net.Conn
+	prefix string
+	tags   []string // --statsd-tags, added to every line
+	lost   func() uint64
+
+	mu       sync.Mutex // Observe runs on the processor goroutine, flush on its own
+	counters map[statsdKey]uint64
+	timings  []string // Whole lines
+	lastLost uint64
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func NewStatsDSink(addr, prefix string, tags []string, lost func() uint64) (*StatsDSink, error) {
+	// A UDP "connection" only sets the destination, nothing is sent yet
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tags {
+		if strings.ContainsAny(t, ",|#\n") {
+			conn.Close()
+			return nil, fmt.Errorf("tag %q can't contain ',', '|', '#' or newlines", t)
+		}
+	}
+	s := &StatsDSink{
+		conn:     conn,
+		prefix:   prefix,
+		tags:     tags,
+		lost:     lost,
+		counters: make(map[statsdKey]uint64),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.flusher()
+	return s, nil
+}
+
+// statsdTag sanitizes a tag value from an event, where a comm or pod name
+// could otherwise break the line format
+func statsdTag(key, value string) string {
+	if value == "" {
+		value = "none"
+	}
+	return key + ":" + strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+type statsdKey struct {
+	name string
+	tags string // As formatted by tagSuffix
+}
+
+// tagSuffix is the "|#..." end of a line, the event's tags then the common ones
+func (s *StatsDSink) tagSuffix(tags []string) string {
+	all := append(tags[:len(tags):len(tags)], s.tags...)
+	if len(all) == 0 {
+		return ""
+	}
+	return "|#" + strings.Join(all, ",")
+}
+
+func (s *StatsDSink) line(name, value, kind, tags string) string {
+	return s.prefix + name + ":" + value + "|" + kind + tags
+}
+
+func (s *StatsDSink) Observe(event *TcpEvent, p *EventProcessor) {
+	if event.Type == eventState {
+		return // Too many to be worth counting
+	}
+	owner := []string{statsdTag("comm", commString(event.Comm[:]))}
+	if pod := event.Pod; pod != nil {
+		owner = append(owner, statsdTag("namespace", pod.Namespace), statsdTag("pod", pod.Name))
+	}
+	if c := event.Container; c != nil {
+		owner = append(owner, statsdTag("container", c.Name))
+	}
+	if event.Type == eventDrop {
+		owner = append(owner, statsdTag("reason", p.reasonName(event.Reason)), statsdTag("layer", p.dropLayer(event)))
+	}
+	if event.Type == eventReset && event.Direction == rstSent {
+		owner = append(owner, statsdTag("reason", p.resetReasonName(event.Reason)))
+	}
+	if event.Type == eventUDPError {
+		owner = append(owner, statsdTag("error", errnoName(event.Reason)))
+	}
+	if event.Type == eventICMPError {
+		owner = append(owner, statsdTag("message", icmpName(event.Family, event.Reason)))
+	}
+	if event.Type == eventFastOpen {
+		owner = append(owner, statsdTag("outcome", fastopenNames[event.Reason]))
+	}
+	if event.Type == eventBuffer {
+		owner = append(owner, statsdTag("kind", bufferNames[event.Direction]))
+	}
+	if event.Type == eventSynFlood {
+		owner = append(owner, statsdTag("prefix", synFloodPrefix(event)), statsdTag("interface", synFloodInterface(event)))
+	}
+	if event.Type == eventTLS && event.Direction != 0 {
+		owner = append(owner, statsdTag("side", tlsSideNames[event.Direction]))
+	}
+	tags := s.tagSuffix(owner)
+	ms := func(ns uint64) string { return strconv.FormatFloat(float64(ns)/1e6, 'f', 3, 64) }
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch event.Type {
+	case eventDrop:
+		s.counters[statsdKey{"drops", tags}] += event.occurrences()
+	case eventRetransmit:
+		s.counters[statsdKey{"retransmits", tags}] += event.occurrences()
+	case eventReset:
+		s.counters[statsdKey{"resets." + directionNames[event.Direction], tags}] += event.occurrences()
+	case eventZeroWindow:
+		s.counters[statsdKey{"zero_windows." + directionNames[event.Direction], tags}]++
+	case eventUDPError:
+		s.counters[statsdKey{"udp_errors." + directionNames[event.Direction], tags}] += event.occurrences()
+	case eventICMPError:
+		s.counters[statsdKey{"icmp_errors", tags}] += event.occurrences()
+	case eventDSACK:
+		s.counters[statsdKey{"dsacks", tags}] += event.occurrences()
+	case eventKeepalive:
+		s.counters[statsdKey{"keepalive." + strings.ToLower(keepaliveNames[event.Direction]), tags}]++
+	case eventFastOpen:
+		s.counters[statsdKey{"fastopen." + directionNames[event.Direction], tags}]++
+	case eventBuffer:
+		s.counters[statsdKey{"receive_buffer_prunes", tags}] += event.occurrences()
+	case eventSynFlood:
+		s.counters[statsdKey{"syn_floods", tags}]++
+	case eventTLS:
+		s.counters[statsdKey{"tls.handshakes", tags}]++
+		s.timings = append(s.timings, s.line("tls.handshake", ms(event.DurationNs), "ms", tags))
+		if event.TCPConnectNs != 0 {
+			s.timings = append(s.timings, s.line("tls.tcp_connect", ms(event.TCPConnectNs), "ms", tags))
+		}
+		if event.TLSWaitNs != 0 {
+			s.timings = append(s.timings, s.line("tls.wait", ms(event.TLSWaitNs), "ms", tags))
+		}
+	case eventConnect:
+		s.counters[statsdKey{"slow_connects", tags}]++
+	case eventSockopt:
+		s.counters[statsdKey{"sockopts." + strings.ToLower(sockoptName(event.Sockopt)), tags}]++
+	case eventListen:
+		s.counters[statsdKey{"listen." + listenKinds[event.Direction], tags}]++
+		s.timings = append(s.timings, s.line("connect.latency", ms(event.DurationNs), "ms", tags))
+	case eventClose:
+		s.counters[statsdKey{"connections.closed", tags}]++
+		s.counters[statsdKey{"connections.bytes_sent", tags}] += event.BytesSent
+		s.counters[statsdKey{"connections.bytes_received", tags}] += event.BytesReceived
+		s.counters[statsdKey{"connections.ooo_packets", tags}] += uint64(event.OooPackets)
+		s.timings = append(s.timings, s.line("connection.duration", ms(event.DurationNs), "ms", tags))
+		if event.RttAvgUs != 0 {
+			s.timings = append(s.timings, s.line("connection.rtt", ms(uint64(event.RttAvgUs)*1000), "ms", tags))
+		}
+	}
+}
+
+func (s *StatsDSink) flusher() {
+	defer close(s.done)
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.quit:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush sends everything collected since the last one
+func (s *StatsDSink) flush() {
+	s.mu.Lock()
+	lines := make([]string, 0, len(s.counters)+len(s.timings)+1)
+	for k, n := range s.counters {
+		lines = append(lines, s.line(k.name, strconv.FormatUint(n, 10), "c", k.tags))
+	}
+	lines = append(lines, s.timings...)
+	clear(s.counters)
+	s.timings = s.timings[:0]
+	s.mu.Unlock()
+
+	if lost := s.lost(); lost > s.lastLost {
+		lines = append(lines, s.line("events.lost", strconv.FormatUint(lost-s.lastLost, 10), "c", s.tagSuffix(nil)))
+		s.lastLost = lost
+	}
+
+	var pkt bytes.Buffer
+	send := func() {
+		if pkt.Len() == 0 {
+			return
+		}
+		// UDP, the server being down is only noticed as ECONNREFUSED sometimes
+		if _, err := s.conn.Write(pkt.Bytes()); err != nil {
+			slog.Warn("sending StatsD metrics", "err", err)
+		}
+		pkt.Reset()
+	}
+	for _, l := range lines {
+		if pkt.Len() > 0 && pkt.Len()+1+len(l) > statsdMaxPacket {
+			send()
+		}
+		if pkt.Len() > 0 {
+			pkt.WriteByte('\n')
+		}
+		pkt.WriteString(l)
+	}
+	send()
+}
+
+// Close sends what's left and closes the socket
+func (s *StatsDSink) Close() {
+	close(s.quit)
+	<-s.done
+	s.conn.Close()
+}
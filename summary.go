@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// runSummary tallies what the end-of-run summary reports. It's an observer,
+// so it only sees events that made it through the filters.
+type runSummary struct {
+	mu            sync.Mutex // Observe runs on the processor goroutine, Print after it may have timed out
+	dropsByReason map[uint32]uint64
+	conns         map[summaryConnKey]*summaryConn
+}
+
+type summaryConnKey struct {
+	saddr, daddr [16]byte
+	sport, dport uint16
+}
+
+type summaryConn struct {
+	drops, retransmits uint64
+	comm               string // Latest owner seen
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		dropsByReason: make(map[uint32]uint64),
+		conns:         make(map[summaryConnKey]*summaryConn),
+	}
+}
+
+func (s *runSummary) Observe(event *TcpEvent, p *EventProcessor) {
+	if event.Type != eventDrop && event.Type != eventRetransmit {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.Type == eventDrop {
+		s.dropsByReason[event.Reason] += event.occurrences()
+		if event.Family == 0 {
+			return // Not an IP packet we could parse, no tuple to blame
+		}
+	}
+
+	k := summaryConnKey{saddr: event.Saddr, daddr: event.Daddr, sport: event.Sport, dport: event.Dport}
+	c := s.conns[k]
+	if c == nil {
+		c = &summaryConn{}
+		s.conns[k] = c
+	}
+	if event.Type == eventDrop {
+		c.drops += event.occurrences()
+	} else {
+		c.retransmits += event.occurrences()
+	}
+	c.comm = commString(event.Comm[:])
+}
+
+// ObserveAggregates tallies one --aggregate interval
+func (s *runSummary) ObserveAggregates(a *aggregates, p *EventProcessor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range a.Drops {
+		s.dropsByReason[d.Reason] += d.Count
+	}
+	for _, r := range a.Retransmits {
+		k := summaryConnKey{saddr: r.Saddr, daddr: r.Daddr, sport: r.Sport, dport: r.Dport}
+		c := s.conns[k]
+		if c == nil {
+			c = &summaryConn{}
+			s.conns[k] = c
+		}
+		c.retransmits += r.Count
+		c.comm = r.Comm
+	}
+}
+
+// Print writes the summary box, n connections at most
+// Lost events are in the metrics report printed right before it
+func (s *runSummary) Print(w io.Writer, p *EventProcessor, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type reasonCount struct {
+		name  string
+		count uint64
+	}
+	reasons := make([]reasonCount, 0, len(s.dropsByReason))
+	var drops uint64
+	for r, c := range s.dropsByReason {
+		reasons = append(reasons, reasonCount{p.reasonName(r), c})
+		drops += c
+	}
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i].count > reasons[j].count })
+
+	type connCount struct {
+		key summaryConnKey
+		*summaryConn
+	}
+	conns := make([]connCount, 0, len(s.conns))
+	for k, c := range s.conns {
+		conns = append(conns, connCount{k, c})
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].drops+conns[i].retransmits > conns[j].drops+conns[j].retransmits
+	})
+	if len(conns) > n {
+		conns = conns[:n]
+	}
+
+	fmt.Fprintln(w, "\n╔══════════════════════════════════════════════════════════════════════╗")
+	fmt.Fprintf(w, "║  %-66s  ║\n", "SUMMARY")
+	fmt.Fprintln(w, "╠══════════════════════════════════════════════════════════════════════╣")
+	fmt.Fprintf(w, "║ Drops:              %8d                                         ║\n", drops)
+	for _, r := range reasons {
+		fmt.Fprintf(w, "║   %-30s %8d                            ║\n", r.name, r.count)
+	}
+
+	if len(conns) > 0 {
+		fmt.Fprintln(w, "╠══════════════════════════════════════════════════════════════════════╣")
+		fmt.Fprintf(w, "║ %-68s ║\n", "Top connections (drops / retransmits)")
+		for _, c := range conns {
+			line := fmt.Sprintf("%s -> %s %s", formatEndpoint(c.key.saddr, c.key.sport),
+				formatEndpoint(c.key.daddr, c.key.dport), c.comm)
+			fmt.Fprintf(w, "║   %-50.50s %6d / %6d ║\n", line, c.drops, c.retransmits)
+		}
+	}
+	fmt.Fprintln(w, "╚══════════════════════════════════════════════════════════════════════╝")
+}
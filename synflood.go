@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// --syn-flood counts SYNs per source prefix in the --interface programs,
+// in one second windows (syn_sources in bpf/monitor.c), and sends a
+// syn_flood event the first time in a second a prefix goes over the
+// threshold. A flood that keeps going is one event per prefix and second,
+// through the same sinks as every other event.
+
+const synFloodSources = 65536 // Prefixes counted at once, the quietest is evicted
+
+// synFloodOptions are --syn-flood and the prefix lengths sources are
+// grouped by
+type synFloodOptions struct {
+	threshold uint32 // 0 = off
+	v4Prefix  uint32
+	v6Prefix  uint32
+}
+
+func (o synFloodOptions) validate() error {
+	if o.v4Prefix > 32 {
+		return fmt.Errorf("--syn-flood-v4-prefix %d is longer than an IPv4 address", o.v4Prefix)
+	}
+	if o.v6Prefix > 128 {
+		return fmt.Errorf("--syn-flood-v6-prefix %d is longer than an IPv6 address", o.v6Prefix)
+	}
+	return nil
+}
+
+// sizeSynFlood gives syn_sources room for the prefixes and sets the
+// threshold, which turns counting on
+func sizeSynFlood(spec *ebpf.CollectionSpec, o synFloodOptions) error {
+	m, ok := spec.Maps["syn_sources"]
+	if !ok {
+		return errors.New("map syn_sources not found in BPF object")
+	}
+	m.MaxEntries = synFloodSources
+	if err := setVariable(spec, "syn_prefix4", o.v4Prefix); err != nil {
+		return err
+	}
+	if err := setVariable(spec, "syn_prefix6", o.v6Prefix); err != nil {
+		return err
+	}
+	return setVariable(spec, "syn_flood_threshold", o.threshold)
+}
+
+// synFloodPrefix is the source prefix of a SYN flood event, e.g. 203.0.113.0/24
+func synFloodPrefix(event *TcpEvent) string {
+	return netip.PrefixFrom(netip.AddrFrom16(event.Saddr).Unmap(), int(event.PrefixLen)).String()
+}
+
+// synFloodRate is SYNs per second from the prefix, over the part of the
+// second it took to go over the threshold
+func synFloodRate(event *TcpEvent) float64 {
+	if event.DurationNs == 0 {
+		return float64(event.Syns)
+	}
+	return float64(event.Syns) / time.Duration(event.DurationNs).Seconds()
+}
+
+// synFloodInterface is the interface a SYN flood arrived on, by name once
+// InterfaceCounters has named it
+func synFloodInterface(event *TcpEvent) string {
+	if event.Interface != "" {
+		return event.Interface
+	}
+	return fmt.Sprintf("if%d", event.Ifindex)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages waiting for the writer, like kafkaQueueSize
+const syslogQueueSize = 10000
+
+// syslogSDID names the structured data element holding the event fields.
+// IDs without an @ are reserved for IANA, so it's qualified with 32473, the
+// enterprise number RFC 5612 sets aside for examples and private use.
+const syslogSDID = "tcpmon@32473"
+
+// Severities from RFC 5424 section 6.2.1
+const (
+	syslogWarning = 4
+	syslogNotice  = 5
+	syslogInfo    = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Where --syslog local looks for the daemon, the same places as log/syslog
+var syslogLocalPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogSink sends every event as an RFC 5424 message (--syslog) to the
+// local daemon or to a collector over UDP or TCP. The event fields go in a
+// structured data element named like the --output columns, and the message
+// is the text output line. As with Kafka, Observe only formats and queues,
+// and one goroutine writes, reconnecting after errors.
+type SyslogSink struct {
+	network  string // unixgram, unix, udp or tcp
+	addr     string
+	facility int
+	host     string
+	procID   string
+
+	conn     net.Conn
+	nextDial time.Time // Don't redial more than once per syslogRedial
+
+	mu      sync.RWMutex // Write locked only by Close, see KafkaSink
+	closed  bool
+	queue   chan []byte
+	dropped atomic.Uint64 // Queue full
+	failed  atomic.Uint64 // Not written, e.g. while the collector was down
+	lastErr error         // Only touched by run
+	done    chan struct{}
+
+	writeErr atomic.Pointer[error] // The last write's, nil once one worked, see Health
+}
+
+const syslogRedial = 2 * time.Second
+
+// parseSyslogAddr turns --syslog into a network and address: local,
+// unix:/path, udp://host[:514] or tcp://host[:601]
+func parseSyslogAddr(s string) (network, addr string, err error) {
+	switch {
+	case s == "local":
+		for _, path := range syslogLocalPaths {
+			if fileExists(path) {
+				return "unixgram", path, nil
+			}
+		}
+		return "", "", fmt.Errorf("no local syslog socket in %s", strings.Join(syslogLocalPaths, ", "))
+	case strings.HasPrefix(s, "unix:"):
+		return "unixgram", strings.TrimPrefix(s, "unix:"), nil
+	case strings.HasPrefix(s, "udp://"):
+		return "udp", withDefaultPort(strings.TrimPrefix(s, "udp://"), "514"), nil
+	case strings.HasPrefix(s, "tcp://"):
+		return "tcp", withDefaultPort(strings.TrimPrefix(s, "tcp://"), "601"), nil
+	}
+	return "", "", fmt.Errorf("invalid address %q, use: local, unix:/path, udp://host[:port] or tcp://host[:port]", s)
+}
+
+func withDefaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+}
+
+func NewSyslogSink(address, facility string) (*SyslogSink, error) {
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", facility)
+	}
+	network, addr, err := parseSyslogAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "-"
+	}
+	s := &SyslogSink{
+		network:  network,
+		addr:     addr,
+		facility: fac,
+		host:     host,
+		procID:   strconv.Itoa(os.Getpid()),
+		queue:    make(chan []byte, syslogQueueSize),
+		done:     make(chan struct{}),
+	}
+	// Fail at startup on a typo, later errors are only logged
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *SyslogSink) dial() error {
+	conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+	if err != nil && s.network == "unixgram" {
+		// Some daemons only listen on a stream socket
+		conn, err = net.DialTimeout("unix", s.addr, 5*time.Second)
+		if err == nil {
+			s.network = "unix"
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func syslogSeverity(event *TcpEvent) int {
+	switch event.Type {
+	case eventDrop, eventSynFlood, eventBlocked:
+		return syslogWarning
+	case eventKeepalive:
+		if event.Direction == keepaliveTimeout {
+			return syslogWarning // The connection is gone
+		}
+		return syslogNotice
+	case eventRetransmit, eventDSACK, eventReset, eventZeroWindow, eventUDPError, eventICMPError:
+		return syslogNotice
+	case eventFastOpen:
+		if fastopenFellBack(event.Reason) {
+			return syslogNotice
+		}
+	case eventBuffer:
+		if event.Direction == bufferCollapsed {
+			return syslogNotice
+		}
+		return syslogWarning // Received data was thrown away
+	case eventListen:
+		if event.Reason != 0 || event.AcceptQueue != 0 {
+			return syslogWarning // A server that didn't start, or connections reset unaccepted
+		}
+	}
+	return syslogInfo
+}
+
+// sdEscape escapes a PARAM-VALUE, RFC 5424 section 6.3.3
+var sdEscape = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// format renders one message:
+//
+//	<164>1 2026-01-31T22:00:00.123456+01:00 web-1 tcpmon 4242 drop [tcpmon@32473 pid="1234" ...] Drop | PID: 1234 | ...
+func (s *SyslogSink) format(event *TcpEvent, p *EventProcessor) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s tcpmon %s %s [%s",
+		s.facility*8+syslogSeverity(event),
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), // At most microseconds
+		s.host, s.procID, eventTypeNames[event.Type], syslogSDID)
+	for i, v := range csvRow(event, p) {
+		if i == 0 || v == "" {
+			continue // The header already has the timestamp
+		}
+		b.WriteString(" " + csvColumns[i] + `="` + sdEscape.Replace(v) + `"`)
+	}
+	b.WriteString("] ")
+
+	var line string
+	if event.Type == eventDrop {
+		line = p.formatDropEvent(event)
+	} else {
+		line = p.formatConnEvent(event)
+	}
+	_, msg, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "] ") // Without the time
+	b.WriteString(msg)
+	return []byte(b.String())
+}
+
+func (s *SyslogSink) Observe(event *TcpEvent, p *EventProcessor) {
+	msg := s.format(event, p)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// write sends one message, framed with its length on stream sockets
+// (RFC 6587 octet counting) and as one datagram otherwise
+func (s *SyslogSink) write(msg []byte) error {
+	if s.conn == nil {
+		if time.Now().Before(s.nextDial) {
+			return fmt.Errorf("not connected to %s", s.addr)
+		}
+		if err := s.dial(); err != nil {
+			s.nextDial = time.Now().Add(syslogRedial)
+			return err
+		}
+	}
+	if s.network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write(msg); err != nil {
+		// UDP errors are usually an ICMP from a collector that's down, the
+		// socket itself is still fine
+		if s.network != "udp" {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SyslogSink) run() {
+	defer close(s.done)
+	warn := time.NewTicker(10 * time.Second)
+	defer warn.Stop()
+	var reported uint64
+
+	for {
+		select {
+		case msg, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			if err := s.write(msg); err != nil {
+				s.failed.Add(1)
+				s.lastErr = err
+				s.writeErr.Store(&err)
+			} else {
+				s.writeErr.Store(nil)
+			}
+		case <-warn.C:
+			if n := s.dropped.Load() + s.failed.Load(); n > reported {
+				slog.Warn("events not sent to syslog so far", "events", n,
+					"queue_full", s.dropped.Load(), "failed", s.failed.Load(), "last_err", s.lastErr)
+				reported = n
+			}
+		}
+	}
+}
+
+// Health is for /readyz: whether the last message reached the collector
+func (s *SyslogSink) Health() error {
+	if err := s.writeErr.Load(); err != nil {
+		return fmt.Errorf("last write failed: %w", *err)
+	}
+	return nil
+}
+
+// Close sends what's still queued, for up to 5 seconds
+func (s *SyslogSink) Close() {
+	s.mu.Lock()
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	case <-time.After(5 * time.Second):
+	}
+	if n := s.dropped.Load() + s.failed.Load() + uint64(len(s.queue)); n > 0 {
+		slog.Warn("events were not sent to syslog", "events", n)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// systemdNotifier speaks the sd_notify protocol: datagrams like READY=1 on
+// the unix socket in $NOTIFY_SOCKET. A nil notifier, outside systemd or
+// without Type=notify, ignores everything.
+type systemdNotifier struct {
+	conn *net.UnixConn
+}
+
+func newSystemdNotifier() (*systemdNotifier, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // Abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to NOTIFY_SOCKET: %w", err)
+	}
+	return &systemdNotifier{conn: conn}, nil
+}
+
+// Notify sends one or more newline separated assignments, e.g. READY=1
+func (n *systemdNotifier) Notify(state string) {
+	if n == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		slog.Warn("notifying systemd", "state", state, "err", err)
+	}
+}
+
+func (n *systemdNotifier) Close() {
+	if n != nil {
+		n.conn.Close()
+	}
+}
+
+// watchdogInterval is how often to send WATCHDOG=1, half of WatchdogSec as
+// sd_watchdog_enabled(3) suggests, or 0 when there's no watchdog for us
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec == 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0 // Meant for a parent process
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// journalHandler puts a sd-daemon(3) priority in front of each record, so
+// journalctl -p warning finds the warnings. The wrapped handler formats
+// into buf, which is then written as one line.
+type journalHandler struct {
+	slog.Handler
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+	w   io.Writer
+}
+
+func newJournalHandler(w io.Writer, newHandler func(io.Writer) slog.Handler) *journalHandler {
+	buf := new(bytes.Buffer)
+	return &journalHandler{Handler: newHandler(buf), mu: new(sync.Mutex), buf: buf, w: w}
+}
+
+func (j *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.buf.Reset()
+	if err := j.Handler.Handle(ctx, r); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(j.w, "<%d>%s", journalPriority(r.Level), j.buf.Bytes())
+	return err
+}
+
+func (j *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journalHandler{Handler: j.Handler.WithAttrs(attrs), mu: j.mu, buf: j.buf, w: j.w}
+}
+
+func (j *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{Handler: j.Handler.WithGroup(name), mu: j.mu, buf: j.buf, w: j.w}
+}
+
+// journalPriority is the syslog priority of a level
+func journalPriority(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3 // LOG_ERR
+	case l >= slog.LevelWarn:
+		return 4 // LOG_WARNING
+	case l >= slog.LevelInfo:
+		return 6 // LOG_INFO
+	}
+	return 7 // LOG_DEBUG
+}
+
+// removePIDFile removes path, or empties it when the directory isn't ours
+// any more after --user
+func removePIDFile(path string) {
+	if err := os.Remove(path); errors.Is(err, os.ErrPermission) {
+		os.Truncate(path, 0)
+	}
+}
+
+// writePIDFile writes our PID to path, through a temporary file so a
+// reader never sees it half written
+func writePIDFile(path string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
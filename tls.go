@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The tls probe (uprobe_ssl_do_handshake and the rest in bpf/monitor.c)
+// times TLS handshakes inside libssl. Each one is sent with the TCP handshake
+// that came before it, from the connection table, so a slow connect can be
+// told apart from a slow certificate exchange.
+
+// TLS event sides, TLS_* in bpf/monitor.c
+const (
+	tlsClient = 1
+	tlsServer = 2
+)
+
+// tlsSideNames are the directions of TLS events
+var tlsSideNames = map[uint32]string{
+	tlsClient: "client",
+	tlsServer: "server",
+}
+
+// Where distributions install libssl, for when --tls-lib isn't given.
+// A program linked against another copy (a container's, or a static one)
+// needs --tls-lib pointing at it.
+var libsslGlobs = []string{
+	"/usr/lib/x86_64-linux-gnu/libssl.so.*",
+	"/usr/lib/aarch64-linux-gnu/libssl.so.*",
+	"/lib/x86_64-linux-gnu/libssl.so.*",
+	"/lib/aarch64-linux-gnu/libssl.so.*",
+	"/usr/lib/arm-linux-gnueabihf/libssl.so.*",
+	"/lib/arm-linux-gnueabihf/libssl.so.*",
+	"/usr/lib64/libssl.so.*",
+	"/lib64/libssl.so.*",
+	"/usr/lib/libssl.so.*",
+	"/lib/libssl.so.*",
+	"/usr/local/lib/libssl.so.*",
+	"/usr/local/lib64/libssl.so.*",
+}
+
+// tlsLibraries is what the TLS uprobes are attached to: the --tls-lib paths,
+// or every libssl found in the usual places. The same file under two names
+// (merged /usr, libssl.so.3 -> libssl.so.3.0.2) is only listed once.
+func tlsLibraries(paths []string) ([]string, error) {
+	if len(paths) > 0 {
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				return nil, err
+			}
+		}
+		return paths, nil
+	}
+	seen := make(map[string]bool)
+	var libs []string
+	for _, glob := range libsslGlobs {
+		matches, _ := filepath.Glob(glob)
+		for _, path := range matches {
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil || seen[real] {
+				continue
+			}
+			seen[real] = true
+			libs = append(libs, real)
+		}
+	}
+	if len(libs) == 0 {
+		return nil, fmt.Errorf("no libssl found, give its path with --tls-lib")
+	}
+	return libs, nil
+}
+
+// tlsBreakdown is the connection's time before the TLS handshake started:
+// the TCP handshake of connects, and how long the connection sat
+// established until the program started TLS
+func tlsBreakdown(event *TcpEvent) string {
+	var s string
+	if event.TCPConnectNs != 0 {
+		s += " | TCP: " + time.Duration(event.TCPConnectNs).Round(time.Microsecond).String()
+	}
+	if event.TLSWaitNs != 0 {
+		s += " | Before TLS: " + time.Duration(event.TLSWaitNs).Round(time.Microsecond).String()
+	}
+	return s
+}
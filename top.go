@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// topEntry is one (process, connection) row of the top mode table
+type topEntry struct {
+	Pid      uint32
+	Comm     string
+	Saddr    [16]byte
+	Daddr    [16]byte
+	Sport    uint16
+	Dport    uint16
+	Sent     uint64
+	Received uint64
+}
+
+// drainTop reads and clears the kernel's throughput table, busiest first
+// Like drainHistograms, bytes counted between the lookup and the delete of
+// an entry are lost
+func drainTop(m *ebpf.Map) ([]topEntry, error) {
+	var entries []topEntry
+	var keys []monitorTopKey
+
+	var key monitorTopKey
+	var value monitorTopValue
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		var comm [16]byte
+		for i, c := range value.Comm {
+			comm[i] = byte(c)
+		}
+		entries = append(entries, topEntry{
+			Pid:      key.Pid,
+			Comm:     commString(comm[:]),
+			Saddr:    key.Saddr,
+			Daddr:    key.Daddr,
+			Sport:    key.Sport,
+			Dport:    key.Dport,
+			Sent:     value.Sent,
+			Received: value.Received,
+		})
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return entries, fmt.Errorf("iterating throughput table: %w", err)
+	}
+	for _, k := range keys {
+		if err := m.Delete(k); err != nil {
+			return entries, fmt.Errorf("clearing throughput table: %w", err)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Sent+entries[i].Received > entries[j].Sent+entries[j].Received
+	})
+	return entries, nil
+}
+
+// topObserver is implemented by observers that want the throughput table
+// each interval, like histogramObserver for the histograms
+type topObserver interface {
+	ObserveTop(entries []topEntry)
+}
+
+// Top mode rows with --format=json, one object per row per interval
+type jsonTop struct {
+	Timestamp string `json:"timestamp"`
+	Type      string `json:"type"` // Always "top"
+	Pid       uint32 `json:"pid"`
+	Comm      string `json:"comm"`
+	Saddr     string `json:"saddr"`
+	Sport     uint16 `json:"sport"`
+	Daddr     string `json:"daddr"`
+	Dport     uint16 `json:"dport"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxBytes   uint64 `json:"tx_bytes"`
+
+	Labels map[string]string `json:"labels,omitempty"` // --label
+}
+
+// PrintTop writes the n busiest connections of the last interval. clear
+// redraws the table in place, only worth it on a terminal.
+func (p *EventProcessor) PrintTop(entries []topEntry, n int, clear bool) {
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	now := time.Now()
+
+	if p.format == formatJSON {
+		for _, e := range entries {
+			b, _ := json.Marshal(&jsonTop{
+				Timestamp: now.Format(time.RFC3339Nano),
+				Type:      "top",
+				Pid:       e.Pid,
+				Comm:      e.Comm,
+				Saddr:     formatAddr(e.Saddr),
+				Sport:     e.Sport,
+				Daddr:     formatAddr(e.Daddr),
+				Dport:     e.Dport,
+				RxBytes:   e.Received,
+				TxBytes:   e.Sent,
+				Labels:    p.labels,
+			})
+			p.buffered.Write(append(b, '\n'))
+		}
+		p.Flush()
+		return
+	}
+
+	if clear {
+		p.buffered.WriteString("\033[H\033[2J")
+	} else {
+		p.buffered.WriteString("\n")
+	}
+	fmt.Fprintf(p.buffered, "%s\n%-7s %-16s %-47s %-47s %10s %10s\n",
+		now.Format("15:04:05"), "PID", "COMM", "LADDR", "RADDR", "RX_KB", "TX_KB")
+	for _, e := range entries {
+		fmt.Fprintf(p.buffered, "%-7d %-16s %-47s %-47s %10d %10d\n",
+			e.Pid, e.Comm,
+			formatEndpoint(e.Saddr, e.Sport), formatEndpoint(e.Daddr, e.Dport),
+			e.Received/1024, e.Sent/1024)
+	}
+	p.Flush()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --otlp-endpoint, drops and retransmits of sockets an application
+// has registered a trace for carry exemplars on the OTLP counters, and
+// their log records link to the trace, so a spike in Grafana leads
+// straight to a request that was hit.
+//
+// The kernel knows nothing about traces, so applications tell the monitor
+// with POST /api/v1/trace-context on --control-addr which trace a socket
+// belongs to, as it's attached to what the monitor exports. The
+// socket is named by its SO_COOKIE, which getsockopt() also makes the
+// kernel assign, or by a SO_MARK the application set on it. Drops and
+// retransmits carry both (see handle_drop and handle_retransmit in
+// bpf/monitor.c). Registrations expire after their TTL, a socket is
+// usually reused for many requests.
+
+const (
+	traceContextTTL     = time.Minute      // Unless the registration says otherwise
+	traceContextMaxTTL  = 10 * time.Minute // Longer ones are cut to this
+	traceContextEntries = 65536            // Registrations held at once, per cookie and per mark
+)
+
+// traceContext is a W3C trace context, the trace and the span to link to
+type traceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+type traceEntry struct {
+	ctx     *traceContext
+	expires time.Time
+}
+
+// TraceCorrelator keeps the registered trace contexts and puts them on
+// events. Enrich runs on the processor goroutine, the handler on
+// net/http's.
+type TraceCorrelator struct {
+	mu       sync.Mutex
+	byCookie map[uint64]traceEntry
+	byMark   map[uint32]traceEntry
+}
+
+func NewTraceCorrelator() *TraceCorrelator {
+	return &TraceCorrelator{
+		byCookie: make(map[uint64]traceEntry),
+		byMark:   make(map[uint32]traceEntry),
+	}
+}
+
+// RegisterControl takes registrations on --control-addr
+func (t *TraceCorrelator) RegisterControl(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/trace-context", t.handleRegister)
+}
+
+// Enrich looks the socket's cookie up first, it names one socket where a
+// mark may be shared
+func (t *TraceCorrelator) Enrich(event *TcpEvent) {
+	if event.SockCookie == 0 && event.Mark == 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.byCookie[event.SockCookie]; ok && event.SockCookie != 0 {
+		if now.Before(e.expires) {
+			event.Trace = e.ctx
+			return
+		}
+		delete(t.byCookie, event.SockCookie)
+	}
+	if e, ok := t.byMark[event.Mark]; ok && event.Mark != 0 {
+		if now.Before(e.expires) {
+			event.Trace = e.ctx
+			return
+		}
+		delete(t.byMark, event.Mark)
+	}
+}
+
+// POST /api/v1/trace-context
+type apiTraceContext struct {
+	Cookie      uint64 `json:"cookie"`      // SO_COOKIE of the socket
+	Mark        uint32 `json:"mark"`        // Or the SO_MARK set on it
+	Traceparent string `json:"traceparent"` // 00-<trace id>-<span id>-<flags>
+	TTL         string `json:"ttl"`         // A Go duration, traceContextTTL when left out
+}
+
+func (t *TraceCorrelator) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
+		return
+	}
+	var req apiTraceContext
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (req.Cookie == 0) == (req.Mark == 0) {
+		http.Error(w, "give one of cookie and mark", http.StatusBadRequest)
+		return
+	}
+	ctx, err := parseTraceparent(req.Traceparent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := traceContextTTL
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("bad ttl %q", req.TTL), http.StatusBadRequest)
+			return
+		}
+		ttl = min(ttl, traceContextMaxTTL)
+	}
+
+	now := time.Now()
+	e := traceEntry{ctx: ctx, expires: now.Add(ttl)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if req.Cookie != 0 {
+		if !roomFor(t.byCookie, req.Cookie, now) {
+			http.Error(w, "too many trace contexts registered", http.StatusServiceUnavailable)
+			return
+		}
+		t.byCookie[req.Cookie] = e
+	} else {
+		if !roomFor(t.byMark, req.Mark, now) {
+			http.Error(w, "too many trace contexts registered", http.StatusServiceUnavailable)
+			return
+		}
+		t.byMark[req.Mark] = e
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// roomFor says whether k can go into m, sweeping out the expired entries
+// when it's full
+func roomFor[K comparable](m map[K]traceEntry, k K, now time.Time) bool {
+	if _, ok := m[k]; ok || len(m) < traceContextEntries {
+		return true
+	}
+	for k, e := range m {
+		if !now.Before(e.expires) {
+			delete(m, k)
+		}
+	}
+	return len(m) < traceContextEntries
+}
+
+// parseTraceparent reads a W3C traceparent header value
+func parseTraceparent(s string) (*traceContext, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, fmt.Errorf("traceparent %q isn't version-traceid-spanid-flags", s)
+	}
+	var ctx traceContext
+	if _, err := hex.Decode(ctx.TraceID[:], []byte(parts[1])); err != nil {
+		return nil, fmt.Errorf("traceparent %q: %w", s, err)
+	}
+	if _, err := hex.Decode(ctx.SpanID[:], []byte(parts[2])); err != nil {
+		return nil, fmt.Errorf("traceparent %q: %w", s, err)
+	}
+	if ctx.TraceID == [16]byte{} || ctx.SpanID == [8]byte{} {
+		return nil, errors.New("traceparent has an all-zero trace or span id")
+	}
+	return &ctx, nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// TUI is the --tui dashboard: live tables of drops, retransmits and top
+// talkers. It's an observer like the exporters, so it sees every event on the
+// processor goroutine and only aggregates there; drawing happens on tview's
+// own goroutine once a second. Enter on a connection opens its history.
+type TUI struct {
+	app    *tview.Application
+	pages  *tview.Pages
+	filter *tview.InputField
+	status *tview.TextView
+	tables []*tuiTable
+	focus  int
+	quit   chan struct{}
+	stop   sync.Once
+
+	history *ConnHistory
+	detail  *tview.TextView
+	showing *connHistoryKey // The connection open in detail, only used on the draw goroutine
+	shown   int             // Entries in detail, to leave it alone until there are more
+
+	mu          sync.Mutex
+	drops       map[tuiDropKey]*tuiCount
+	retransmits map[tuiConnKey]*tuiCount
+	top         []topEntry // Last --interval only
+	events      uint64
+	query       string // Lowercase filter, matched against every cell of a row
+}
+
+type tuiDropKey struct{ reason, function, comm, owner string }
+type tuiConnKey struct{ src, dst, comm, owner, state string }
+
+type tuiCount struct {
+	n    uint64
+	last time.Time
+}
+
+// tuiTable is one sortable table; rows is called with TUI.mu held
+type tuiTable struct {
+	view    *tview.Table
+	headers []string
+	numeric []bool // Columns sorted as numbers
+	sortCol int
+	asc     bool
+	rows    func() [][]string
+	ends    []int // The columns of a connection's two endpoints, for Enter
+}
+
+func NewTUI(history *ConnHistory) *TUI {
+	t := &TUI{
+		app:         tview.NewApplication(),
+		quit:        make(chan struct{}),
+		drops:       make(map[tuiDropKey]*tuiCount),
+		retransmits: make(map[tuiConnKey]*tuiCount),
+		history:     history,
+	}
+
+	t.tables = []*tuiTable{
+		t.newTable("Drops",
+			[]string{"REASON", "FUNCTION", "COMM", "POD/CONTAINER", "COUNT", "LAST"},
+			[]bool{false, false, false, false, true, false}, 4, t.dropRows),
+		t.newTable("Retransmits",
+			[]string{"SOURCE", "DESTINATION", "COMM", "POD/CONTAINER", "STATE", "COUNT", "LAST"},
+			[]bool{false, false, false, false, false, true, false}, 5, t.retransmitRows),
+		t.newTable("Top talkers (last interval)",
+			[]string{"PID", "COMM", "LOCAL", "REMOTE", "RX_KB", "TX_KB"},
+			[]bool{true, false, false, false, true, true}, 4, t.topRows),
+	}
+	t.tables[1].ends = []int{0, 1}
+	t.tables[2].ends = []int{2, 3}
+	for _, tbl := range t.tables {
+		tbl.view.SetSelectedFunc(func(row, col int) { t.openHistory(tbl, row) })
+	}
+
+	t.filter = tview.NewInputField().SetLabel("Filter: ")
+	t.filter.SetChangedFunc(func(text string) {
+		t.mu.Lock()
+		t.query = strings.ToLower(text)
+		t.mu.Unlock()
+		t.redraw()
+	})
+	t.filter.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			t.filter.SetText("")
+		}
+		t.app.SetFocus(t.tables[t.focus].view)
+	})
+
+	t.status = tview.NewTextView().SetDynamicColors(true)
+
+	layout := tview.NewFlex().SetDirection(tview.FlexRow)
+	for _, tbl := range t.tables {
+		layout.AddItem(tbl.view, 0, 1, false)
+	}
+	layout.AddItem(t.filter, 1, 0, false).AddItem(t.status, 1, 0, false)
+
+	t.detail = tview.NewTextView().SetScrollable(true)
+	t.detail.SetBorder(true)
+	t.pages = tview.NewPages().AddPage("tables", layout, true, true).AddPage("history", t.detail, true, false)
+
+	t.app.SetRoot(t.pages, true).SetFocus(t.tables[0].view)
+	t.app.SetInputCapture(t.handleKey)
+	return t
+}
+
+func (t *TUI) newTable(title string, headers []string, numeric []bool, sortCol int, rows func() [][]string) *tuiTable {
+	view := tview.NewTable().SetFixed(1, 0).SetSelectable(true, false)
+	view.SetBorder(true).SetTitle(" " + title + " ")
+	return &tuiTable{view: view, headers: headers, numeric: numeric, sortCol: sortCol, rows: rows}
+}
+
+// Tab/Shift-Tab switch tables, s/r change the sort, / filters, Esc clears
+// the filter, Enter opens a connection's history and Esc closes it, q quits
+func (t *TUI) handleKey(ev *tcell.EventKey) *tcell.EventKey {
+	if t.filter.HasFocus() {
+		return ev
+	}
+	if t.showing != nil {
+		switch {
+		case ev.Key() == tcell.KeyEscape:
+			t.closeHistory()
+		case ev.Key() == tcell.KeyRune && ev.Rune() == 'q':
+			t.Stop()
+		default:
+			return ev // Scrolling
+		}
+		return nil
+	}
+	tbl := t.tables[t.focus]
+
+	switch ev.Key() {
+	case tcell.KeyTab, tcell.KeyBacktab:
+		step := 1
+		if ev.Key() == tcell.KeyBacktab {
+			step = len(t.tables) - 1
+		}
+		t.focus = (t.focus + step) % len(t.tables)
+		t.app.SetFocus(t.tables[t.focus].view)
+		return nil
+	case tcell.KeyEscape:
+		t.filter.SetText("") // Also redraws, through the changed func
+		return nil
+	case tcell.KeyRune:
+	default:
+		return ev
+	}
+
+	switch ev.Rune() {
+	case 'q':
+		t.Stop()
+	case 's':
+		tbl.sortCol = (tbl.sortCol + 1) % len(tbl.headers)
+		tbl.asc = !tbl.numeric[tbl.sortCol] // Numbers biggest first, text A-Z
+	case 'r':
+		tbl.asc = !tbl.asc
+	case '/':
+		t.app.SetFocus(t.filter)
+	default:
+		return ev
+	}
+	t.redraw()
+	return nil
+}
+
+// Run blocks drawing the dashboard until Stop, or the user quits
+func (t *TUI) Run() error {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.app.QueueUpdateDraw(t.draw)
+			case <-t.quit:
+				return
+			}
+		}
+	}()
+	t.app.QueueUpdateDraw(t.draw)
+	return t.app.Run()
+}
+
+// Done is closed when the dashboard stops, e.g. because the user pressed q
+func (t *TUI) Done() <-chan struct{} { return t.quit }
+
+func (t *TUI) Stop() {
+	t.stop.Do(func() {
+		close(t.quit)
+		t.app.Stop()
+	})
+}
+
+func (t *TUI) redraw() {
+	go t.app.QueueUpdateDraw(t.draw) // Key handlers already run on the draw goroutine
+}
+
+// openHistory shows the history of the connection on row, for tables with
+// one per row
+func (t *TUI) openHistory(tbl *tuiTable, row int) {
+	if t.history == nil || len(tbl.ends) == 0 {
+		return
+	}
+	local, err := netip.ParseAddrPort(tbl.view.GetCell(row, tbl.ends[0]).Text)
+	if err != nil {
+		return
+	}
+	remote, err := netip.ParseAddrPort(tbl.view.GetCell(row, tbl.ends[1]).Text)
+	if err != nil {
+		return
+	}
+	t.showing, t.shown = &connHistoryKey{local, remote}, -1
+	t.detail.SetTitle(fmt.Sprintf(" %s -> %s  (Esc: back) ", local, remote))
+	t.pages.SwitchToPage("history")
+	t.app.SetFocus(t.detail)
+	t.redraw()
+}
+
+func (t *TUI) closeHistory() {
+	t.showing = nil
+	t.pages.SwitchToPage("tables")
+	t.app.SetFocus(t.tables[t.focus].view)
+}
+
+// drawHistory refreshes the open history when it has grown, which scrolls
+// it to the newest entry
+func (t *TUI) drawHistory() {
+	h, ok := t.history.History(t.showing.local, t.showing.remote)
+	if !ok {
+		if t.shown != 0 {
+			t.detail.SetText("No history for this connection yet: it's tracked from its first state change, connect or retransmit, or its first RTT sample.")
+			t.shown = 0
+		}
+		return
+	}
+	n := len(h.Entries)
+	if h.Closed {
+		n++
+	}
+	if n == t.shown {
+		return
+	}
+	var b strings.Builder
+	if h.Comm != "" {
+		fmt.Fprintf(&b, "comm %s\n", h.Comm)
+	}
+	for _, e := range h.Entries {
+		b.WriteString(historyLine(e) + "\n")
+	}
+	if h.Closed {
+		b.WriteString("closed\n")
+	}
+	t.detail.SetText(b.String()).ScrollToEnd()
+	t.shown = n
+}
+
+// Observe aggregates one event into the tables
+func (t *TUI) Observe(event *TcpEvent, p *EventProcessor) {
+	now := event.when()
+	comm := commString(event.Comm[:])
+	owner := tuiOwner(event)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events += event.occurrences()
+
+	var c *tuiCount
+	switch event.Type {
+	case eventDrop:
+		k := tuiDropKey{
+			reason:   p.reasonName(event.Reason),
+			function: findNearestSymbol(event.Location),
+			comm:     comm,
+			owner:    owner,
+		}
+		if c = t.drops[k]; c == nil {
+			c = &tuiCount{}
+			t.drops[k] = c
+		}
+	case eventRetransmit:
+		k := tuiConnKey{
+			src:   formatEndpoint(event.Saddr, event.Sport),
+			dst:   formatEndpoint(event.Daddr, event.Dport),
+			comm:  comm,
+			owner: owner,
+			state: p.stateName(event.State),
+		}
+		if c = t.retransmits[k]; c == nil {
+			c = &tuiCount{}
+			t.retransmits[k] = c
+		}
+	default:
+		return
+	}
+	c.n += event.occurrences()
+	c.last = now
+}
+
+// ObserveTop replaces the top talkers with the latest interval
+func (t *TUI) ObserveTop(entries []topEntry) {
+	t.mu.Lock()
+	t.top = entries
+	t.mu.Unlock()
+}
+
+func tuiOwner(event *TcpEvent) string {
+	switch {
+	case event.Pod != nil:
+		return event.Pod.Namespace + "/" + event.Pod.Name
+	case event.Container != nil:
+		return event.Container.Name
+	}
+	return ""
+}
+
+func (t *TUI) dropRows() [][]string {
+	rows := make([][]string, 0, len(t.drops))
+	for k, c := range t.drops {
+		rows = append(rows, []string{k.reason, k.function, k.comm, k.owner,
+			strconv.FormatUint(c.n, 10), c.last.Format("15:04:05")})
+	}
+	return rows
+}
+
+func (t *TUI) retransmitRows() [][]string {
+	rows := make([][]string, 0, len(t.retransmits))
+	for k, c := range t.retransmits {
+		rows = append(rows, []string{k.src, k.dst, k.comm, k.owner, k.state,
+			strconv.FormatUint(c.n, 10), c.last.Format("15:04:05")})
+	}
+	return rows
+}
+
+func (t *TUI) topRows() [][]string {
+	rows := make([][]string, 0, len(t.top))
+	for _, e := range t.top {
+		rows = append(rows, []string{strconv.Itoa(int(e.Pid)), e.Comm,
+			formatEndpoint(e.Saddr, e.Sport), formatEndpoint(e.Daddr, e.Dport),
+			strconv.FormatUint(e.Received/1024, 10), strconv.FormatUint(e.Sent/1024, 10)})
+	}
+	return rows
+}
+
+// draw runs on the tview goroutine
+func (t *TUI) draw() {
+	if t.showing != nil {
+		t.drawHistory()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, tbl := range t.tables {
+		rows := tbl.rows()
+		if t.query != "" {
+			kept := rows[:0]
+			for _, r := range rows {
+				if strings.Contains(strings.ToLower(strings.Join(r, " ")), t.query) {
+					kept = append(kept, r)
+				}
+			}
+			rows = kept
+		}
+		tbl.sort(rows)
+
+		tbl.view.Clear()
+		for col, h := range tbl.headers {
+			if col == tbl.sortCol {
+				if tbl.asc {
+					h += " ▲"
+				} else {
+					h += " ▼"
+				}
+			}
+			tbl.view.SetCell(0, col, tview.NewTableCell(h).
+				SetTextColor(tcell.ColorYellow).SetSelectable(false).SetExpansion(1))
+		}
+		for i, r := range rows {
+			for col, cell := range r {
+				c := tview.NewTableCell(cell).SetExpansion(1)
+				if tbl.numeric[col] {
+					c.SetAlign(tview.AlignRight)
+				}
+				tbl.view.SetCell(i+1, col, c)
+			}
+		}
+	}
+
+	fmt.Fprintf(t.status.Clear(),
+		"[::b]%d events[::-]  Tab: next table  s: sort column  r: reverse  /: filter  Esc: clear filter  Enter: history  q: quit", t.events)
+}
+
+func (tbl *tuiTable) sort(rows [][]string) {
+	col := tbl.sortCol
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i][col], rows[j][col]
+		var less bool
+		if tbl.numeric[col] {
+			x, _ := strconv.ParseFloat(a, 64)
+			y, _ := strconv.ParseFloat(b, 64)
+			less = x < y
+		} else {
+			less = a < b
+		}
+		if tbl.asc {
+			return less
+		}
+		return a != b && !less
+	})
+}
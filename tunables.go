@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// The thresholds in the tunables map (bpf/monitor.c) are read by the
+// programs on every event, so `monitor set` can change them in a running
+// monitor: --slow-connect, --min-bytes, --sample and --conn-limit, by
+// their flag names. The loader writes the flags into the map at startup,
+// so a restart goes back to them.
+
+// tunable is one field of struct tunables, set and shown like its flag
+type tunable struct {
+	name  string // The flag's
+	get   func(t *monitorTunables) string
+	set   func(t *monitorTunables, value string) error
+	usage string
+}
+
+var tunableSettings = []tunable{
+	{
+		name: "slow-connect",
+		get:  func(t *monitorTunables) string { return time.Duration(t.SlowConnectNs).String() },
+		set: func(t *monitorTunables, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return errors.New("use a duration like 200ms, 0 to turn it off")
+			}
+			t.SlowConnectNs = uint64(d)
+			return nil
+		},
+		usage: "handshakes at least this long are reported, e.g. 200ms (0 = off)",
+	},
+	{
+		name: "min-bytes",
+		get:  func(t *monitorTunables) string { return strconv.FormatUint(t.MinBytes, 10) },
+		set: func(t *monitorTunables, v string) error {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return errors.New("use a number of bytes, 0 for every connection")
+			}
+			t.MinBytes = n
+			return nil
+		},
+		usage: "closed connections are only reported once they moved this many bytes (0 = all)",
+	},
+	{
+		name: "sample",
+		get: func(t *monitorTunables) string {
+			s := sampleFlag(t.SampleRate)
+			return s.String()
+		},
+		set: func(t *monitorTunables, v string) error {
+			var s sampleFlag
+			if err := s.Set(v); err != nil {
+				return err
+			}
+			t.SampleRate = uint32(s)
+			return nil
+		},
+		usage: "only every Nth event of each type is emitted, as 1/N or N (1 = every event)",
+	},
+	{
+		name: "conn-limit",
+		get:  func(t *monitorTunables) string { return strconv.FormatUint(uint64(t.ConnLimit), 10) },
+		set: func(t *monitorTunables, v string) error {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return errors.New("use a number of events per second, 0 for no limit")
+			}
+			t.ConnLimit = uint32(n)
+			return nil
+		},
+		usage: "drops and retransmits emitted per connection and second (0 = no limit)",
+	},
+}
+
+// tunables is what the loader puts in the map
+func (o loadOptions) tunables() monitorTunables {
+	return monitorTunables{
+		SlowConnectNs: uint64(o.slowConnect),
+		MinBytes:      o.minBytes,
+		SampleRate:    o.sampleRate,
+		ConnLimit:     o.connLimit,
+	}
+}
+
+func readTunables(m *ebpf.Map) (monitorTunables, error) {
+	var t monitorTunables
+	err := m.Lookup(uint32(0), &t)
+	return t, err
+}
+
+// currentSampleRate is --sample as the programs apply it now, for scaling
+// counts back up
+func currentSampleRate(m *ebpf.Map) uint32 {
+	t, err := readTunables(m)
+	if err != nil {
+		return 1
+	}
+	return max(t.SampleRate, 1)
+}
+
+// findTunables opens the tunables map of a running monitor: the one pinned
+// under pinPath, or, without one, the only map by that name in the kernel
+func findTunables(pinPath string) (*ebpf.Map, error) {
+	if pinPath != "" {
+		m, err := ebpf.LoadPinnedMap(filepath.Join(pinMapsDir(pinPath), "tunables"), nil)
+		if err != nil {
+			return nil, fmt.Errorf("opening the pinned map, was the monitor started with --pin-path %s? %w", pinPath, err)
+		}
+		return m, nil
+	}
+
+	var found []*ebpf.Map
+	for id := ebpf.MapID(0); ; {
+		next, err := ebpf.MapGetNextID(id)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing BPF maps: %w", err)
+		}
+		id = next
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			continue // Gone since, or not ours to open
+		}
+		info, err := m.Info()
+		if err == nil && info.Name == "tunables" && info.Type == ebpf.Array &&
+			info.KeySize == 4 && info.ValueSize == uint32(binary.Size(monitorTunables{})) && info.MaxEntries == 1 {
+			found = append(found, m)
+			continue
+		}
+		m.Close()
+	}
+	switch len(found) {
+	case 0:
+		return nil, errors.New("no monitor is running")
+	case 1:
+		return found[0], nil
+	}
+	for _, m := range found {
+		m.Close()
+	}
+	return nil, fmt.Errorf("%d monitors are running, start them with --pin-path and pick one with it", len(found))
+}
+
+// runSet is `monitor set key=value...`, or without settings, what the
+// running monitor uses now
+func runSet(args []string) {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	var pinPath string
+	fs.StringVar(&pinPath, "pin-path", "", "The --pin-path of the monitor to change, needed when more than one runs")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s set [flags] [key=value...]\n\nChange thresholds of a running monitor, or show them\n\nKeys:\n", os.Args[0])
+		for _, t := range tunableSettings {
+			fmt.Fprintf(os.Stderr, "  %-13s %s\n", t.name, t.usage)
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	m, err := findTunables(pinPath)
+	if err != nil {
+		fatal("finding the monitor", "err", err)
+	}
+	defer m.Close()
+	t, err := readTunables(m)
+	if err != nil {
+		fatal("reading tunables", "err", err)
+	}
+
+	for _, arg := range fs.Args() {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			fatal("settings are key=value", "arg", arg)
+		}
+		setting, ok := tunableNamed(key)
+		if !ok {
+			fatal("unknown setting", "key", key, "known", tunableNames())
+		}
+		if err := setting.set(&t, value); err != nil {
+			fatal("invalid value", "key", key, "value", value, "err", err)
+		}
+	}
+	if fs.NArg() > 0 {
+		if err := m.Put(uint32(0), &t); err != nil {
+			fatal("writing tunables", "err", err)
+		}
+	}
+	for _, s := range tunableSettings {
+		fmt.Printf("%s=%s\n", s.name, s.get(&t))
+	}
+}
+
+func tunableNamed(name string) (tunable, bool) {
+	for _, t := range tunableSettings {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return tunable{}, false
+}
+
+func tunableNames() string {
+	names := make([]string, len(tunableSettings))
+	for i, t := range tunableSettings {
+		names[i] = t.name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestTunableSettings(t *testing.T) {
+	byName := make(map[string]tunable)
+	for _, s := range tunableSettings {
+		byName[s.name] = s
+	}
+	for _, tt := range []struct {
+		name, value string
+		want        monitorTunables
+		shown       string // get's, "" when it's value
+		err         bool
+	}{
+		{name: "slow-connect", value: "200ms", want: monitorTunables{SlowConnectNs: 200000000}},
+		{name: "slow-connect", value: "0", want: monitorTunables{}, shown: "0s"},
+		{name: "slow-connect", value: "1m30s", want: monitorTunables{SlowConnectNs: 90000000000}},
+		{name: "slow-connect", value: "-1s", err: true},
+		{name: "slow-connect", value: "200", err: true},
+		{name: "min-bytes", value: "1048576", want: monitorTunables{MinBytes: 1048576}},
+		{name: "min-bytes", value: "0", want: monitorTunables{}},
+		{name: "min-bytes", value: "1MB", err: true},
+		{name: "min-bytes", value: "-1", err: true},
+		{name: "sample", value: "1/100", want: monitorTunables{SampleRate: 100}},
+		{name: "sample", value: "100", want: monitorTunables{SampleRate: 100}, shown: "1/100"},
+		{name: "sample", value: "1", want: monitorTunables{SampleRate: 1}},
+		{name: "sample", value: "0", err: true},
+		{name: "sample", value: "1/0", err: true},
+		{name: "sample", value: "half", err: true},
+		{name: "conn-limit", value: "50", want: monitorTunables{ConnLimit: 50}},
+		{name: "conn-limit", value: "4294967296", err: true},
+		{name: "conn-limit", value: "", err: true},
+	} {
+		s, ok := byName[tt.name]
+		if !ok {
+			t.Fatalf("no tunable %q", tt.name)
+		}
+		var got monitorTunables
+		err := s.set(&got, tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s %q: got %+v, want an error", tt.name, tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s %q: got %+v, %v, want %+v", tt.name, tt.value, got, err, tt.want)
+		}
+		shown := tt.shown
+		if shown == "" {
+			shown = tt.value
+		}
+		if s := s.get(&got); s != shown {
+			t.Errorf("%s %q: shown as %q, want %q", tt.name, tt.value, s, shown)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "fmt"
+
+// On overlay networks (flannel, Calico's and Cilium's VXLAN modes, OVN's
+// Geneve) pod-to-pod traffic between nodes goes in UDP between the nodes'
+// tunnel endpoints, and a drop of it would only say which two nodes. The
+// drop programs look inside packets to VXLAN's and Geneve's ports
+// (read_tunnel in bpf/monitor.c) and send the flow they carry too: the
+// tuple stays the tunnel's, Inner* are the pods'. Retransmits need none of
+// this, the socket is the pod's and its tuple the inner one already, and
+// Link names the VXLAN device it went out of.
+
+// TUNNEL_* in bpf/monitor.c
+const (
+	tunnelVXLAN  = 1
+	tunnelGeneve = 2
+)
+
+var tunnelNames = map[uint32]string{
+	tunnelVXLAN:  "vxlan",
+	tunnelGeneve: "geneve",
+}
+
+// tunnelSuffix is the text output's, whose drop lines have no tuple
+// otherwise: the tunnel's endpoints and the flow inside, e.g.
+// " | VXLAN 1 (192.168.1.10 -> 192.168.1.11): 10.244.1.5:43210 -> 10.244.2.7:80 (tcp)"
+func tunnelSuffix(event *TcpEvent) string {
+	if event.Tunnel == 0 {
+		return ""
+	}
+	kind := "VXLAN"
+	if event.Tunnel == tunnelGeneve {
+		kind = "Geneve"
+	}
+	s := fmt.Sprintf(" | %s %d (%s -> %s)", kind, event.Vni, formatAddr(event.Saddr), formatAddr(event.Daddr))
+	if event.InnerFamily == 0 {
+		return s
+	}
+	return fmt.Sprintf("%s: %s -> %s (%s)", s,
+		formatEndpoint(event.InnerSaddr, event.InnerSport), formatEndpoint(event.InnerDaddr, event.InnerDport),
+		protocolName(event.InnerProtocol))
+}
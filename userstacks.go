@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// With --user-stacks, track_lifetime in bpf/monitor.c records the user
+// stack of the task calling connect() in the user_stacks stack map, and
+// resets, ICMP errors, slow connects and connects that failed carry its id.
+// That shows which code path opened the connection that went wrong, which
+// the events alone can only narrow down to a process.
+//
+// The kernel walks user stacks by frame pointers. Programs built without
+// them (-fomit-frame-pointer, the default of most C and C++ builds) get
+// the innermost frame or two; Go, and anything built with
+// -fno-omit-frame-pointer, get the whole stack. DWARF unwinding would mean
+// copying the stack itself out of the kernel at every connect and isn't
+// done.
+
+const (
+	userStackEntries = 4096 // Distinct stacks user_stacks holds with --user-stacks
+	userStackCache   = 4096 // Symbolized stacks kept, by process and id
+	userELFCache     = 64   // Symbol tables of binaries and libraries kept
+)
+
+// sizeUserStacks gives user_stacks room for the stacks and turns capturing on
+func sizeUserStacks(spec *ebpf.CollectionSpec) error {
+	m, ok := spec.Maps["user_stacks"]
+	if !ok {
+		return errors.New("map user_stacks not found in BPF object")
+	}
+	m.MaxEntries = userStackEntries
+	return setVariable(spec, "capture_user_stacks", uint8(1))
+}
+
+// UserStackEnricher symbolizes the user stacks of events against the
+// process's mappings in /proc/<pid>/maps and the ELF symbol tables of the
+// files mapped. Processes that exited before their event came get bare
+// addresses. Only used from the processor goroutine.
+type UserStackEnricher struct {
+	stacks *ebpf.Map
+	done   map[userStackKey][]string
+	maps   map[uint32]*procMaps
+	files  *list.List // Of *elfSymbols, most recently used first
+	byPath map[string]*list.Element
+}
+
+// The same stack id is different code in two processes, addresses are
+// their own
+type userStackKey struct {
+	pid, id uint32
+}
+
+// procMaps is the executable mappings of one process
+type procMaps struct {
+	read     time.Time
+	mappings []mapping // Sorted by start
+}
+
+type mapping struct {
+	start, end, offset uint64
+	path               string // As the process sees it
+}
+
+// elfSymbols is the function symbols of one file, and its loadable
+// segments for turning file offsets into symbol addresses
+type elfSymbols struct {
+	path     string
+	symbols  []elfSymbol // Sorted by addr
+	segments []elf.ProgHeader
+}
+
+type elfSymbol struct {
+	addr, size uint64
+	name       string
+}
+
+func NewUserStackEnricher(stacks *ebpf.Map) *UserStackEnricher {
+	return &UserStackEnricher{
+		stacks: stacks,
+		done:   make(map[userStackKey][]string),
+		maps:   make(map[uint32]*procMaps),
+		files:  list.New(),
+		byPath: make(map[string]*list.Element),
+	}
+}
+
+func (u *UserStackEnricher) Enrich(event *TcpEvent) {
+	if event.UserStackID == 0 {
+		return
+	}
+	k := userStackKey{event.Pid, event.UserStackID}
+	if stack, ok := u.done[k]; ok {
+		event.UserStack = stack
+		return
+	}
+	var ips [stackDepth]uint64
+	if err := u.stacks.Lookup(event.UserStackID-1, &ips); err != nil {
+		return
+	}
+	pm := u.procMaps(event.Pid)
+	stack := make([]string, 0, stackDepth)
+	for _, ip := range ips {
+		if ip == 0 {
+			break
+		}
+		stack = append(stack, u.symbolize(event.Pid, pm, ip))
+	}
+	if len(u.done) >= userStackCache {
+		clear(u.done) // Stacks come from few places, this is rare
+	}
+	u.done[k] = stack
+	event.UserStack = stack
+}
+
+// procMaps reads a process's mappings, again after processCacheTTL in
+// case the PID was reused. A process that's gone has none.
+func (u *UserStackEnricher) procMaps(pid uint32) *procMaps {
+	if pm, ok := u.maps[pid]; ok && time.Since(pm.read) < processCacheTTL {
+		return pm
+	}
+	if len(u.maps) >= processCacheSize {
+		clear(u.maps)
+	}
+	pm, err := readProcMaps(pid)
+	if err != nil {
+		pm = &procMaps{read: time.Now()}
+	}
+	u.maps[pid] = pm
+	return pm
+}
+
+// symbolize names ip as function+offset (file), or the address and the
+// file when the file has no symbol for it
+func (u *UserStackEnricher) symbolize(pid uint32, pm *procMaps, ip uint64) string {
+	i := sort.Search(len(pm.mappings), func(i int) bool { return pm.mappings[i].end > ip })
+	if i == len(pm.mappings) || pm.mappings[i].start > ip {
+		return fmt.Sprintf("0x%x", ip)
+	}
+	m := pm.mappings[i]
+	name := filepath.Base(m.path)
+	// Through the process's root, so a container's libraries are the ones read
+	syms := u.elfSymbols(fmt.Sprintf("/proc/%d/root%s", pid, m.path))
+	if sym, ok := syms.lookup(ip - m.start + m.offset); ok {
+		return sym + " (" + name + ")"
+	}
+	return fmt.Sprintf("0x%x (%s)", ip, name)
+}
+
+// elfSymbols reads a file's symbols once, keeping the last userELFCache
+// files. Files without symbols are remembered too.
+func (u *UserStackEnricher) elfSymbols(path string) *elfSymbols {
+	if el, ok := u.byPath[path]; ok {
+		u.files.MoveToFront(el)
+		return el.Value.(*elfSymbols)
+	}
+	syms, err := readELFSymbols(path)
+	if err != nil {
+		syms = &elfSymbols{path: path}
+	}
+	u.byPath[path] = u.files.PushFront(syms)
+	if u.files.Len() > userELFCache {
+		oldest := u.files.Back()
+		u.files.Remove(oldest)
+		delete(u.byPath, oldest.Value.(*elfSymbols).path)
+	}
+	return syms
+}
+
+// lookup finds the function at a file offset
+func (s *elfSymbols) lookup(off uint64) (string, bool) {
+	var addr uint64
+	found := false
+	for _, seg := range s.segments {
+		if off >= seg.Off && off < seg.Off+seg.Filesz {
+			addr, found = off-seg.Off+seg.Vaddr, true
+			break
+		}
+	}
+	if !found {
+		return "", false
+	}
+	i := sort.Search(len(s.symbols), func(i int) bool { return s.symbols[i].addr > addr })
+	if i == 0 {
+		return "", false
+	}
+	sym := s.symbols[i-1]
+	if sym.size != 0 && addr >= sym.addr+sym.size {
+		return "", false // Between functions, or in one the file has no symbol for
+	}
+	return fmt.Sprintf("%s+0x%x", sym.name, addr-sym.addr), true
+}
+
+// readProcMaps keeps the executable file mappings of /proc/<pid>/maps
+func readProcMaps(pid uint32) (*procMaps, error) {
+	f, err := os.Open("/proc/" + strconv.FormatUint(uint64(pid), 10) + "/maps")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pm := &procMaps{read: time.Now()}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 7f2c1a000000-7f2c1a1b5000 r-xp 00028000 08:01 1234 /usr/lib/x86_64-linux-gnu/libc.so.6
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.Contains(fields[1], "x") || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		start, end, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			continue
+		}
+		var m mapping
+		m.start, _ = strconv.ParseUint(start, 16, 64)
+		m.end, _ = strconv.ParseUint(end, 16, 64)
+		m.offset, _ = strconv.ParseUint(fields[2], 16, 64)
+		m.path = strings.Join(fields[5:], " ")
+		m.path = strings.TrimSuffix(m.path, " (deleted)")
+		pm.mappings = append(pm.mappings, m)
+	}
+	sort.Slice(pm.mappings, func(i, j int) bool { return pm.mappings[i].start < pm.mappings[j].start })
+	return pm, scanner.Err()
+}
+
+// readELFSymbols reads the function symbols of a file, from .symtab or,
+// for stripped files, .dynsym
+func readELFSymbols(path string) (*elfSymbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &elfSymbols{path: path}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD {
+			s.segments = append(s.segments, p.ProgHeader)
+		}
+	}
+	syms, err := f.Symbols()
+	if errors.Is(err, elf.ErrNoSymbols) || len(syms) == 0 {
+		syms, err = f.DynamicSymbols()
+	}
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, err
+	}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value != 0 {
+			s.symbols = append(s.symbols, elfSymbol{addr: sym.Value, size: sym.Size, name: sym.Name})
+		}
+	}
+	sort.Slice(s.symbols, func(i, j int) bool { return s.symbols[i].addr < s.symbols[j].addr })
+	return s, nil
+}
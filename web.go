@@ -0,0 +1,107 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+//go:embed web/index.html
+var webIndex []byte
+
+// Drops and retransmits queued per browser before it starts missing them
+const webClientBuffer = 256
+
+// WebUI serves the live page on / of --listen-addr and streams drops and
+// retransmits to it over a WebSocket on /api/v1/stream, in the
+// --format=json schema. Like the gRPC subscribers, a slow browser misses
+// events rather than holding up the pipeline.
+type WebUI struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+func NewWebUI() *WebUI {
+	return &WebUI{clients: make(map[chan []byte]struct{})}
+}
+
+func (u *WebUI) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webIndex)
+	})
+	mux.Handle("GET /api/v1/stream", websocket.Server{Handshake: sameOrigin, Handler: u.stream})
+}
+
+// sameOrigin refuses pages from other sites, which a browser would
+// otherwise happily let connect to a monitor on localhost or the LAN
+// Clients that aren't browsers don't send an Origin at all
+func sameOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host != r.Host {
+		return websocket.ErrBadWebSocketOrigin
+	}
+	cfg.Origin = u
+	return nil
+}
+
+func (u *WebUI) stream(ws *websocket.Conn) {
+	events := make(chan []byte, webClientBuffer)
+	u.mu.Lock()
+	u.clients[events] = struct{}{}
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		delete(u.clients, events)
+		u.mu.Unlock()
+	}()
+
+	// The page never sends anything, a read only returns once it's gone
+	gone := make(chan struct{})
+	go func() {
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		close(gone)
+	}()
+
+	for {
+		select {
+		case msg := <-events:
+			if err := websocket.Message.Send(ws, string(msg)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+func (u *WebUI) Observe(event *TcpEvent, p *EventProcessor) {
+	if event.Type != eventDrop && event.Type != eventRetransmit {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.clients) == 0 {
+		return
+	}
+
+	msg := p.formatJSON(event)
+	for c := range u.clients {
+		select {
+		case c <- msg:
+		default: // The page counts what it got, missing a few doesn't break it
+		}
+	}
+}